@@ -1,10 +1,13 @@
 #include <linux/kconfig.h>
+#include <linux/version.h>
 #include "bpf_helpers.h"
 
 #define KBUILD_MODNAME "empty" // Required for including printk.h
 #include <net/netfilter/nf_conntrack.h>
 #include <net/netfilter/nf_conntrack_acct.h>
 #include <net/netfilter/nf_conntrack_timestamp.h>
+#include <net/netfilter/nf_conntrack_helper.h>
+#include <linux/if_ether.h>
 
 struct acct_event_t {
   u64 start;
@@ -21,8 +24,54 @@ struct acct_event_t {
   u16 dstport;
   u32 netns;
   u8 proto;
+  u8 flags;
+  u32 cpu;
+  u32 seq;
+  u32 syn_count;
+  u32 fin_count;
+  u32 rst_count;
+  u64 duration;
+  char helper[NF_CT_HELPER_NAME_LEN];
+  u32 status;
+  u8 srcmac[ETH_ALEN];
+  u8 dstmac[ETH_ALEN];
 };
 
+// Per-flow state kept between events of a flow.
+struct flow_state_t {
+  u64 next;  // deadline of the next update event
+  u64 start; // timestamp of the flow's first event
+};
+
+// Conntrack entry being refreshed, stashed by the kprobe for its kretprobe.
+struct curr_ct_t {
+  struct nf_conn *ct;
+  u64 reply; // the packet being accounted travels in the reply direction
+  u8 srcmac[ETH_ALEN]; // Ethernet addresses of the packet, if it has any
+  u8 dstmac[ETH_ALEN];
+};
+
+// Per-flow counts of TCP packets carrying the SYN, FIN or RST flag.
+struct tcp_flags_t {
+  u32 syn;
+  u32 fin;
+  u32 rst;
+};
+
+// TCP header flags, found in the 14th byte of the header.
+#define TCP_HDR_FLAGS_OFF 13
+#define TCP_HDR_FIN (1 << 0)
+#define TCP_HDR_SYN (1 << 1)
+#define TCP_HDR_RST (1 << 2)
+
+// Flags of acct_event_t.
+#define EVENT_FLAG_NEW (1 << 0)
+#define EVENT_FLAG_SEEN_REPLY (1 << 1)
+#define EVENT_FLAG_ASSURED (1 << 2)
+#define EVENT_FLAG_UNACCOUNTED (1 << 3)
+#define EVENT_FLAG_REPLY (1 << 4)
+#define EVENT_FLAG_EXPECTED (1 << 5)
+
 // get_acct_ext gets a reference to the nf_conn's accounting extension.
 // Returns non-zero on error.
 __attribute__((always_inline))
@@ -72,6 +121,33 @@ static int get_ts_ext(struct nf_conn_tstamp **ts_ext, struct nf_conn *ct) {
   return 0;
 }
 
+// extract_helper extracts the name of the nf_conn's conntrack helper, eg. 'ftp',
+// into an acct_event_t. The helper extension is only added to flows a helper
+// was assigned to, the name remains empty for all other flows.
+__attribute__((always_inline))
+static void extract_helper(struct acct_event_t *data, struct nf_conn *ct) {
+
+  struct nf_ct_ext *ct_ext;
+  bpf_probe_read(&ct_ext, sizeof(ct_ext), &ct->ext);
+  if (!ct_ext)
+    return;
+
+  u8 ct_help_offset;
+  bpf_probe_read(&ct_help_offset, sizeof(ct_help_offset), &ct_ext->offset[NF_CT_EXT_HELPER]);
+  if (!ct_help_offset)
+    return;
+
+  struct nf_conn_help *help_ext = ((void *)ct_ext + ct_help_offset);
+
+  // The helper is unset when it was unregistered while the flow was alive.
+  struct nf_conntrack_helper *helper;
+  bpf_probe_read(&helper, sizeof(helper), &help_ext->helper);
+  if (!helper)
+    return;
+
+  bpf_probe_read(&data->helper, sizeof(data->helper), &helper->name);
+}
+
 // extract_counters extracts accounting info from an nf_conn_acct into acct_event_t.
 __attribute__((always_inline))
 static void extract_counters(struct acct_event_t *data, struct nf_conn_acct *acct_ext) {
@@ -111,6 +187,24 @@ static void extract_tuple(struct acct_event_t *data, struct nf_conn *ct) {
 
 }
 
+// extract_status extracts the nf_conn's status bitmap into an acct_event_t,
+// along with its SEEN_REPLY, ASSURED and EXPECTED bits as event flags.
+__attribute__((always_inline))
+static void extract_status(struct acct_event_t *data, struct nf_conn *ct) {
+
+  unsigned long status = 0;
+  bpf_probe_read(&status, sizeof(status), &ct->status);
+
+  data->status = status;
+
+  if (status & IPS_SEEN_REPLY)
+    data->flags |= EVENT_FLAG_SEEN_REPLY;
+  if (status & IPS_ASSURED)
+    data->flags |= EVENT_FLAG_ASSURED;
+  if (status & IPS_EXPECTED)
+    data->flags |= EVENT_FLAG_EXPECTED;
+}
+
 // extract_netns extracts the nf_conn's network namespace inode number into an acct_event_t.
 __attribute__((always_inline))
 static void extract_netns(struct acct_event_t *data, struct nf_conn *ct) {
@@ -146,10 +240,36 @@ struct bpf_map_def SEC("maps/perf_acct_end") perf_acct_end = {
 	.namespace = "",
 };
 
+// Per-flow state, holding the deadline of the next update event and the start
+// of the flow. The map's size is the maximum amount of flows tracked by the
+// probe, and is set by userspace when loading the probe. When the map is full,
+// inserting a new flow's state evicts the least recently updated flow instead
+// of failing, so new flows keep being accounted for. Evicted flows become new
+// flows on their next update.
+// LRU hash maps were introduced in 4.10, inserts fail on older kernels.
+#if LINUX_VERSION_CODE >= KERNEL_VERSION(4, 10, 0)
+#define NEXTUPD_MAP_TYPE BPF_MAP_TYPE_LRU_HASH
+#else
+#define NEXTUPD_MAP_TYPE BPF_MAP_TYPE_HASH
+#endif
+
 struct bpf_map_def SEC("maps/nextupd") nextupd = {
-	.type = BPF_MAP_TYPE_HASH,
+	.type = NEXTUPD_MAP_TYPE,
 	.key_size = sizeof(int),
-	.value_size = sizeof(void *),
+	.value_size = sizeof(struct flow_state_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+// Flows rejected by the port filters, so their packets are dropped without
+// extracting their tuple. Kept apart from nextupd, so rejected flows don't
+// evict the state of accounted flows and aren't counted as tracked flows.
+// A rejected flow evicted from the map is rejected again on its next packet.
+struct bpf_map_def SEC("maps/filtered") filtered = {
+	.type = NEXTUPD_MAP_TYPE,
+	.key_size = sizeof(int),
+	.value_size = sizeof(u8),
 	.max_entries = 1024,
 	.pinning = 0,
 	.namespace = "",
@@ -158,7 +278,27 @@ struct bpf_map_def SEC("maps/nextupd") nextupd = {
 struct bpf_map_def SEC("maps/currct") currct = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(int),
-	.value_size = sizeof(void *),
+	.value_size = sizeof(struct curr_ct_t),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+// Per-flow event sequence numbers, only used when enabled in the config map.
+struct bpf_map_def SEC("maps/flowseq") flowseq = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(int),
+	.value_size = sizeof(u32),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+// Per-flow TCP flag counts, only used when enabled in the config map.
+struct bpf_map_def SEC("maps/tcpflags") tcpflags = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(int),
+	.value_size = sizeof(struct tcp_flags_t),
 	.max_entries = 1024,
 	.pinning = 0,
 	.namespace = "",
@@ -168,21 +308,314 @@ struct bpf_map_def SEC("maps/config") config = {
 	.type = BPF_MAP_TYPE_HASH,
 	.key_size = sizeof(int),
 	.value_size = sizeof(void *),
-	.max_entries = 1,
+	.max_entries = 7,
+	.pinning = 0,
+	.namespace = "",
+};
+
+// Probe-wide counters, indexed by the COUNTER_* keys.
+struct bpf_map_def SEC("maps/counters") counters = {
+	.type = BPF_MAP_TYPE_ARRAY,
+	.key_size = sizeof(int),
+	.value_size = sizeof(u64),
+	.max_entries = 2,
 	.pinning = 0,
 	.namespace = "",
 };
 
+// Sets of ports (network byte order) to account for. Only consulted
+// when the corresponding filter is enabled in the config map.
+struct bpf_map_def SEC("maps/dstports") dstports = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(u16),
+	.value_size = sizeof(u8),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+struct bpf_map_def SEC("maps/srcports") srcports = {
+	.type = BPF_MAP_TYPE_HASH,
+	.key_size = sizeof(u16),
+	.value_size = sizeof(u8),
+	.max_entries = 1024,
+	.pinning = 0,
+	.namespace = "",
+};
+
+// Keys of the config map.
+#define CONFIG_COOLDOWN 0
+#define CONFIG_DSTPORT_FILTER 1
+#define CONFIG_SRCPORT_FILTER 2
+#define CONFIG_SEQUENCE 3
+#define CONFIG_TCP_FLAGS 4
+#define CONFIG_MAX_FLOWS 5
+#define CONFIG_ALLOW_UNACCOUNTED 6
+
+// get_counters extracts the flow's accounting counters into acct_event_t.
+// Flows without an accounting extension, eg. because the acct sysctl was
+// disabled when the flow was created, are marked unaccounted and keep zero
+// counters if allowed in the config map. Returns non-zero if the flow
+// should not be accounted for.
+__attribute__((always_inline))
+static int get_counters(struct acct_event_t *data, struct nf_conn *ct) {
+
+  struct nf_conn_acct *acct_ext = 0;
+  if (get_acct_ext(&acct_ext, ct) == 0) {
+    extract_counters(data, acct_ext);
+    return 0;
+  }
+
+  int allow_key = CONFIG_ALLOW_UNACCOUNTED;
+  u64 *allowed = bpf_map_lookup_elem(&config, &allow_key);
+  if (!allowed || !*allowed)
+    return -1;
+
+  data->flags |= EVENT_FLAG_UNACCOUNTED;
+  return 0;
+}
+
+// Keys of the counters map.
+#define COUNTER_FLOWS 0
+#define COUNTER_OVERFLOWS 1
+
+// track_flow counts a new flow's insert into the nextupd map, given the
+// insert's return value. When the map was already at the maximum amount of
+// flows set in the config map, the insert evicted another flow (or failed
+// on kernels without LRU maps) and the overflow counter is incremented
+// instead. The flow count is approximate, since the kernel can also evict
+// flows before the map is completely full.
+__attribute__((always_inline))
+static void track_flow(int err) {
+
+  int over_key = COUNTER_OVERFLOWS;
+  u64 *overp;
+
+  if (err) {
+    overp = bpf_map_lookup_elem(&counters, &over_key);
+    if (overp)
+      __sync_fetch_and_add(overp, 1);
+    return;
+  }
+
+  int max_key = CONFIG_MAX_FLOWS;
+  u64 *maxp = bpf_map_lookup_elem(&config, &max_key);
+  if (!maxp || !*maxp)
+    return;
+
+  int flows_key = COUNTER_FLOWS;
+  u64 *flowsp = bpf_map_lookup_elem(&counters, &flows_key);
+  if (!flowsp)
+    return;
+
+  if (*flowsp < *maxp) {
+    __sync_fetch_and_add(flowsp, 1);
+    return;
+  }
+
+  overp = bpf_map_lookup_elem(&counters, &over_key);
+  if (overp)
+    __sync_fetch_and_add(overp, 1);
+}
+
+// untrack_flow counts a flow removed from the nextupd map.
+__attribute__((always_inline))
+static void untrack_flow(void) {
+
+  int flows_key = COUNTER_FLOWS;
+  u64 *flowsp = bpf_map_lookup_elem(&counters, &flows_key);
+  if (flowsp && *flowsp)
+    __sync_fetch_and_add(flowsp, -1);
+}
+
+// proto_has_ports returns non-zero if conntrack identifies flows of the given
+// protocol by their ports. Other protocols store different data in the ports'
+// place in the tuple, like the type, code and identifier of ICMP messages.
+__attribute__((always_inline))
+static int proto_has_ports(u8 proto) {
+  switch (proto) {
+  case IPPROTO_TCP:
+  case IPPROTO_UDP:
+  case IPPROTO_DCCP:
+  case IPPROTO_SCTP:
+  case IPPROTO_UDPLITE:
+    return 1;
+  }
+  return 0;
+}
+
+// port_allowed checks whether the port of a flow is in the given port set,
+// if the filter at index filter_key of the config map is enabled. Flows
+// without ports never match an enabled filter.
+// Returns non-zero if the flow should be accounted for.
+__attribute__((always_inline))
+static int port_allowed(void *ports, int filter_key, u8 proto, u16 port) {
+
+  u64 *enabled = bpf_map_lookup_elem(&config, &filter_key);
+  if (!enabled || !*enabled)
+    return 1;
+
+  if (!proto_has_ports(proto))
+    return 0;
+
+  return bpf_map_lookup_elem(ports, &port) != 0;
+}
+
+// tuple_allowed checks the event's tuple against the source and
+// destination port filters. Returns non-zero if the flow should be accounted for.
+__attribute__((always_inline))
+static int tuple_allowed(struct acct_event_t *data) {
+  return port_allowed(&dstports, CONFIG_DSTPORT_FILTER, data->proto, data->dstport) &&
+         port_allowed(&srcports, CONFIG_SRCPORT_FILTER, data->proto, data->srcport);
+}
+
+// flow_filtered returns non-zero if the flow was rejected by the port filters.
+__attribute__((always_inline))
+static int flow_filtered(struct nf_conn *ct) {
+  return bpf_map_lookup_elem(&filtered, &ct) != 0;
+}
+
+// next_seq returns the next sequence number of the flow, or 0 if sequence
+// numbering is disabled in the config map. The first event of a flow is
+// numbered 1. The counter is incremented atomically, since events of the
+// same flow can be generated on multiple CPUs at once.
+__attribute__((always_inline))
+static u32 next_seq(struct nf_conn *ct) {
+
+  int seq_key = CONFIG_SEQUENCE;
+  u64 *enabled = bpf_map_lookup_elem(&config, &seq_key);
+  if (!enabled || !*enabled)
+    return 0;
+
+  u32 *seqp = bpf_map_lookup_elem(&flowseq, &ct);
+  if (!seqp) {
+    // Insert the first sequence number of the flow. When losing the race
+    // against another CPU, fall through and increment its counter instead.
+    u32 first = 1;
+    if (bpf_map_update_elem(&flowseq, &ct, &first, BPF_NOEXIST) == 0)
+      return first;
+
+    seqp = bpf_map_lookup_elem(&flowseq, &ct);
+    if (!seqp)
+      return 0;
+  }
+
+  return __sync_fetch_and_add(seqp, 1) + 1;
+}
+
+// count_tcp_flags increments the flow's TCP flag counters with the flags
+// of the packet being accounted, if enabled in the config map. The skb's
+// transport header offset is set by the IPv4 and IPv6 receive paths and by
+// the TCP stack for local packets. IPv6 packets with extension headers are
+// not counted correctly, since the offset points to the first extension header.
+__attribute__((always_inline))
+static void count_tcp_flags(struct nf_conn *ct, struct sk_buff *skb) {
+
+  int flags_key = CONFIG_TCP_FLAGS;
+  u64 *enabled = bpf_map_lookup_elem(&config, &flags_key);
+  if (!enabled || !*enabled)
+    return;
+
+  u8 proto;
+  bpf_probe_read(&proto, sizeof(proto), &ct->tuplehash[IP_CT_DIR_ORIGINAL].tuple.dst.protonum);
+  if (proto != IPPROTO_TCP)
+    return;
+
+  unsigned char *head;
+  u16 thoff;
+  bpf_probe_read(&head, sizeof(head), &skb->head);
+  bpf_probe_read(&thoff, sizeof(thoff), &skb->transport_header);
+
+  u8 th_flags;
+  bpf_probe_read(&th_flags, sizeof(th_flags), head + thoff + TCP_HDR_FLAGS_OFF);
+  if (!(th_flags & (TCP_HDR_SYN | TCP_HDR_FIN | TCP_HDR_RST)))
+    return;
+
+  struct tcp_flags_t *fp = bpf_map_lookup_elem(&tcpflags, &ct);
+  if (!fp) {
+    // Insert zeroed counters, or increment the ones inserted
+    // by another CPU when losing the race.
+    struct tcp_flags_t zero = {};
+    bpf_map_update_elem(&tcpflags, &ct, &zero, BPF_NOEXIST);
+
+    fp = bpf_map_lookup_elem(&tcpflags, &ct);
+    if (!fp)
+      return;
+  }
+
+  if (th_flags & TCP_HDR_SYN)
+    __sync_fetch_and_add(&fp->syn, 1);
+  if (th_flags & TCP_HDR_FIN)
+    __sync_fetch_and_add(&fp->fin, 1);
+  if (th_flags & TCP_HDR_RST)
+    __sync_fetch_and_add(&fp->rst, 1);
+}
+
+// extract_mac extracts the source and destination addresses of the packet's
+// Ethernet header, if it has one. Conntrack sees packets received by the host
+// in PREROUTING, after the L2 header was pulled, but its offset is kept in the
+// skb. Locally generated packets don't have an L2 header yet, and packets of
+// devices without Ethernet headers, like tunnels, have a header of another
+// length, so the addresses stay zero.
+__attribute__((always_inline))
+static void extract_mac(struct curr_ct_t *curr, struct sk_buff *skb) {
+
+  unsigned char *head;
+  u16 mac_header, network_header;
+  bpf_probe_read(&head, sizeof(head), &skb->head);
+  bpf_probe_read(&mac_header, sizeof(mac_header), &skb->mac_header);
+  bpf_probe_read(&network_header, sizeof(network_header), &skb->network_header);
+
+  // The mac header offset is all ones when it was never set.
+  if (mac_header == (u16)~0U || network_header - mac_header != ETH_HLEN)
+    return;
+
+  struct ethhdr eth;
+  if (bpf_probe_read(&eth, sizeof(eth), head + mac_header))
+    return;
+
+  __builtin_memcpy(curr->srcmac, eth.h_source, ETH_ALEN);
+  __builtin_memcpy(curr->dstmac, eth.h_dest, ETH_ALEN);
+}
+
+// extract_tcp_flags copies the flow's TCP flag counters into acct_event_t.
+__attribute__((always_inline))
+static void extract_tcp_flags(struct acct_event_t *data, struct nf_conn *ct) {
+
+  struct tcp_flags_t *fp = bpf_map_lookup_elem(&tcpflags, &ct);
+  if (!fp)
+    return;
+
+  data->syn_count = fp->syn;
+  data->fin_count = fp->fin;
+  data->rst_count = fp->rst;
+}
 
 SEC("kprobe/__nf_ct_refresh_acct")
 int kprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
 
   struct nf_conn *ct = (struct nf_conn *) PT_REGS_PARM1(ctx);
+  enum ip_conntrack_info ctinfo = (enum ip_conntrack_info) PT_REGS_PARM2(ctx);
 
   u32 pid = bpf_get_current_pid_tgid();
 
+  // The direction of the packet tells which of the flow's counters it advances.
+  struct curr_ct_t curr = {
+    .ct = ct,
+    .reply = CTINFO2DIR(ctinfo) == IP_CT_DIR_REPLY,
+  };
+
+  struct sk_buff *skb = (struct sk_buff *) PT_REGS_PARM3(ctx);
+
+  // The skb is only available here, stash its Ethernet addresses.
+  extract_mac(&curr, skb);
+
 	// stash the conntrack pointer for lookup on return
-	bpf_map_update_elem(&currct, &pid, &ct, BPF_ANY);
+	bpf_map_update_elem(&currct, &pid, &curr, BPF_ANY);
+
+  // Count the packet's TCP flags before the update event is sent on return.
+  if (!flow_filtered(ct))
+    count_tcp_flags(ct, skb);
 
 	return 0;
 }
@@ -194,22 +627,25 @@ int kretprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
   u64 ts = bpf_ktime_get_ns();
 
   // Look up the conntrack structure stashed by the kprobe.
-  struct nf_conn **ctp;
-  ctp = bpf_map_lookup_elem(&currct, &pid);
-	if (ctp == 0)
+  struct curr_ct_t *currp;
+  currp = bpf_map_lookup_elem(&currct, &pid);
+	if (currp == 0)
 		return 0;
 
   // Dereference and delete from the stash table.
-  struct nf_conn *ct = *ctp;
+  struct nf_conn *ct = currp->ct;
+  u64 reply = currp->reply;
+  u8 srcmac[ETH_ALEN], dstmac[ETH_ALEN];
+  __builtin_memcpy(srcmac, currp->srcmac, ETH_ALEN);
+  __builtin_memcpy(dstmac, currp->dstmac, ETH_ALEN);
   bpf_map_delete_elem(&currct, &pid);
 
-  // Obtain reference to accounting conntrack extension.
-  struct nf_conn_acct *acct_ext = 0;
-  if (get_acct_ext(&acct_ext, ct))
+  // The flow was rejected by the port filters on an earlier event.
+  if (flow_filtered(ct))
     return 0;
 
   // Initialize cooldown value in the config map to 2 seconds.
-  u64 config_cd = 0;
+  u64 config_cd = CONFIG_COOLDOWN;
   u64 def_cd = 2000000000;
   bpf_map_update_elem(&config, &config_cd, &def_cd, BPF_NOEXIST);
 
@@ -218,11 +654,13 @@ int kretprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
     .start = 0,
     .ts = ts,
     .cid = (u32)ct,
+    .cpu = bpf_get_smp_processor_id(),
   };
 
   // Pull counters onto the BPF stack first, so that we can make event rate
   // limiting decisions based on packet counters without doing unnecessary work.
-  extract_counters(&data, acct_ext);
+  if (get_counters(&data, ct))
+    return 0;
 
   // Sample accounting events from the kernel using a hybrid rate limiting model.
   // On every event that is sent, a future deadline is set for that specific flow
@@ -243,13 +681,19 @@ int kretprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
   u64 pkts_total = (data.packets_orig + data.packets_ret);
 
   // Look up when the next event is scheduled to be sent to userspace.
-  u64 *nextp = bpf_map_lookup_elem(&nextupd, &ct);
-  u64 next = 0;
-  if (nextp)
-    next = *nextp;
+  struct flow_state_t *statep = bpf_map_lookup_elem(&nextupd, &ct);
+  struct flow_state_t state = {
+    .next = 0,
+    .start = ts,
+  };
+  if (statep)
+    state = *statep;
+  else
+    // No deadline was set for the flow yet, this is the first event.
+    data.flags |= EVENT_FLAG_NEW;
 
   // The deadline has not yet expired, but we allow certain exceptions.
-  if (ts < next) {
+  if (ts < state.next) {
     if (pkts_total > 32) {
       // Flow is no longer in burst mode and will only be sampled after deadline.
       return 0;
@@ -265,17 +709,49 @@ int kretprobe____nf_ct_refresh_acct(struct pt_regs *ctx) {
 
   // Extract proto, src/dst address and ports.
   extract_tuple(&data, ct);
+
+  // Drop events of flows that don't match the configured port filters, and
+  // remember the rejection so the flow's next events are dropped right away.
+  // State restored from a probe with other filters is removed.
+  if (!tuple_allowed(&data)) {
+    u8 one = 1;
+    bpf_map_update_elem(&filtered, &ct, &one, BPF_ANY);
+    if (statep && bpf_map_delete_elem(&nextupd, &ct) == 0)
+      untrack_flow();
+    return 0;
+  }
+
   // Extract network namespace identifier (inode).
   extract_netns(&data, ct);
+  // Extract conntrack status flags.
+  extract_status(&data, ct);
+  // Mark the direction of the packet triggering the event.
+  if (reply)
+    data.flags |= EVENT_FLAG_REPLY;
+  // Ethernet addresses of the packet triggering the event.
+  __builtin_memcpy(data.srcmac, srcmac, ETH_ALEN);
+  __builtin_memcpy(data.dstmac, dstmac, ETH_ALEN);
   // Extract conntrack connection mark.
   bpf_probe_read(&data.connmark, sizeof(data.connmark), &ct->mark);
+  // Extract TCP flag counters.
+  extract_tcp_flags(&data, ct);
+  // Extract the name of the flow's conntrack helper.
+  extract_helper(&data, ct);
+  // Number the event within its flow.
+  data.seq = next_seq(ct);
+  // Time elapsed since the flow's first event.
+  data.duration = ts - state.start;
 
   // Submit event to userspace.
   bpf_perf_event_output(ctx, &perf_acct_update, CUR_CPU_IDENTIFIER, &data, sizeof(data));
 
   // Set the deadline to the current timestamp plus the cooldown period.
-  next = ts + cd;
-  bpf_map_update_elem(&nextupd, &ct, &next, BPF_ANY);
+  state.next = ts + cd;
+  int err = bpf_map_update_elem(&nextupd, &ct, &state, BPF_ANY);
+
+  // Count the flow if its state was inserted into the map.
+  if (!statep)
+    track_flow(err);
 
   return 0;
 }
@@ -287,29 +763,56 @@ int kprobe__nf_conntrack_free(struct pt_regs *ctx) {
 
   struct nf_conn *ct = (struct nf_conn *) PT_REGS_PARM1(ctx);
 
-  // Remove next-update entry for connection.
-  bpf_map_delete_elem(&nextupd, &ct);
-
-  // Below this point, the kprobe can return early,
-  // make sure all bookkeeping is handled above.
-
-  struct nf_conn_acct *acct_ext = 0;
-  if (get_acct_ext(&acct_ext, ct))
+  // Flows rejected by the port filters only have their rejection, the TCP
+  // flags counted before it and any restored sequence number to remove.
+  if (bpf_map_delete_elem(&filtered, &ct) == 0) {
+    bpf_map_delete_elem(&flowseq, &ct);
+    bpf_map_delete_elem(&tcpflags, &ct);
     return 0;
+  }
+
+  // Claim the flow's last sequence number and remove its counter.
+  u32 seq = next_seq(ct);
+  bpf_map_delete_elem(&flowseq, &ct);
 
   struct acct_event_t data = {
     .start = 0,
     .ts = ts,
     .cid = (u32)ct,
+    .cpu = bpf_get_smp_processor_id(),
+    .seq = seq,
   };
 
+  // Compute the flow's total duration from the start timestamp
+  // in its state, and remove the state.
+  struct flow_state_t *statep = bpf_map_lookup_elem(&nextupd, &ct);
+  if (statep)
+    data.duration = ts - statep->start;
+  if (bpf_map_delete_elem(&nextupd, &ct) == 0)
+    untrack_flow();
+
+  // Claim the flow's TCP flag counters and remove them.
+  extract_tcp_flags(&data, ct);
+  bpf_map_delete_elem(&tcpflags, &ct);
+
+  // Below this point, the kprobe can return early,
+  // make sure all bookkeeping is handled above.
+
+  if (get_counters(&data, ct))
+    return 0;
+
   struct nf_conn_tstamp *ts_ext = 0;
   if (get_ts_ext(&ts_ext, ct) == 0)
     extract_tstamp(&data, ts_ext);
 
-  extract_counters(&data, acct_ext);
   extract_tuple(&data, ct);
+
+  if (!tuple_allowed(&data))
+    return 0;
+
   extract_netns(&data, ct);
+  extract_status(&data, ct);
+  extract_helper(&data, ct);
   bpf_probe_read(&data.connmark, sizeof(data.connmark), &ct->mark);
 
   bpf_perf_event_output(ctx, &perf_acct_end, CUR_CPU_IDENTIFIER, &data, sizeof(data));
@@ -1,31 +1,338 @@
 package cmd
 
 import (
-	"fmt"
+	"net"
+	"os"
 
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/ti-mo/conntracct/internal/pipeline"
-	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
 	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/sinks/writelimit"
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
 var (
 	// Key names in configuration file.
 	cfgAPIEnabled    = "api_enabled"
 	cfgAPIEndpoint   = "api_endpoint"
+	cfgHealthEnabled = "health_enabled"
+	cfgHealthAddr    = "health_endpoint"
 	cfgSysctlManage  = "sysctl_manage"
 	cfgPProfEnabled  = "pprof_enabled"
 	cfgPProfEndpoint = "pprof_endpoint"
 
+	cfgLogLevel  = "log_level"
+	cfgLogFormat = "log_format"
+	cfgLogOutput = "log_output"
+
+	cfgProbeCooldown = "probe_cooldown"
+	cfgProbeDstPorts = "probe_dst_ports"
+	cfgProbeSrcPorts = "probe_src_ports"
+	cfgProbeSequence = "probe_sequence"
+	cfgProbeTCPFlags = "probe_tcp_flags"
+	cfgProbeMaxFlows = "probe_max_flows"
+	cfgProbePinPath  = "probe_pin_path"
+	cfgProbeRawAddrs = "probe_raw_addrs"
+
+	cfgProbeReaderCPUs = "probe_reader_cpus"
+
+	cfgProbeEvents = "probe_events"
+
+	cfgProbeVerifierLog = "probe_verifier_log"
+
+	cfgProbeStateFile = "probe_state_file"
+
+	cfgProbeAllowUnaccounted = "probe_allow_unaccounted"
+
+	cfgProbeBackend         = "probe_backend"
+	cfgProbeNetlinkInterval = "probe_netlink_interval"
+	cfgProbeReplayFile      = "probe_replay_file"
+	cfgProbeReplaySpeed     = "probe_replay_speed"
+
+	cfgProbeReorderWindow = "probe_reorder_window"
+
+	cfgByteOverhead = "byte_overhead"
+
+	cfgDropZeroBytes = "drop_zero_bytes"
+
+	cfgSampleRate            = "sample_rate"
+	cfgSampleSeed            = "sample_seed"
+	cfgSampleUpgradeBytes    = "sample_upgrade_bytes"
+	cfgSampleUpgradePackets  = "sample_upgrade_packets"
+	cfgSampleUpgradeTTL      = "sample_upgrade_ttl"
+	cfgSampleUpgradeMaxFlows = "sample_upgrade_max_flows"
+
+	cfgLabels        = "labels"
+	cfgLabelHostname = "label_hostname"
+
+	cfgServiceLabels    = "service_labels"
+	cfgServiceFile      = "service_file"
+	cfgServiceOverrides = "service_overrides"
+
+	cfgCoalesceWindow   = "coalesce_window"
+	cfgCoalesceTTL      = "coalesce_ttl"
+	cfgCoalesceMaxFlows = "coalesce_max_flows"
+	cfgCoalesceProtos   = "coalesce_protos"
+
+	cfgDestroyDedupWindow   = "destroy_dedup_window"
+	cfgDestroyDedupMaxFlows = "destroy_dedup_max_flows"
+
+	cfgRollupWindow   = "rollup_window"
+	cfgRollupMaxFlows = "rollup_max_flows"
+
+	cfgMinRateBytes    = "min_rate_bytes"
+	cfgMinRatePackets  = "min_rate_packets"
+	cfgMinRateTTL      = "min_rate_ttl"
+	cfgMinRateMaxFlows = "min_rate_max_flows"
+
+	cfgMinFlowAge         = "min_flow_age"
+	cfgMinFlowAgeTTL      = "min_flow_age_ttl"
+	cfgMinFlowAgeMaxFlows = "min_flow_age_max_flows"
+
+	cfgSummaryOnly     = "summary_only"
+	cfgSummaryIdle     = "summary_idle"
+	cfgSummaryMaxFlows = "summary_max_flows"
+
+	cfgDeltaFields   = "delta_fields"
+	cfgDeltaMaxFlows = "delta_max_flows"
+
+	cfgLateEventWindow = "late_event_window"
+
+	cfgDeriveLabels = "derive_labels"
+
+	cfgHostDirection        = "host_direction"
+	cfgHostDirectionRefresh = "host_direction_refresh"
+	cfgHostAddresses        = "host_addresses"
+
+	cfgCheckpointFile     = "checkpoint_file"
+	cfgCheckpointInterval = "checkpoint_interval"
+	cfgCheckpointRetain   = "checkpoint_retain"
+	cfgCheckpointMaxFlows = "checkpoint_max_flows"
+
+	cfgTopTalkersWindow = "top_talkers_window"
+	cfgTopTalkersGroup  = "top_talkers_group"
+	cfgTopTalkersN      = "top_talkers_n"
+	cfgTopTalkersMax    = "top_talkers_max"
+
+	cfgMarkAggregateWindow   = "mark_aggregate_window"
+	cfgMarkAggregateMask     = "mark_aggregate_mask"
+	cfgMarkAggregateTTL      = "mark_aggregate_ttl"
+	cfgMarkAggregateMaxFlows = "mark_aggregate_max_flows"
+
 	cfgSinks = "sinks"
 
+	cfgSinkPoolBuffers    = "sink_pool_buffers"
+	cfgSinkPoolBufferSize = "sink_pool_buffer_size"
+
+	cfgSinkMaxConcurrentWrites = "sink_max_concurrent_writes"
+
+	cfgSinkFailureThreshold = "sink_failure_threshold"
+
+	cfgShutdownTimeout = "shutdown_timeout"
+
+	cfgDryRun = "dry_run"
+
 	// Default application configuration.
 	cfgDefaults = map[string]interface{}{
 		// HTTP API endpoint.
 		cfgAPIEnabled:  true,
 		cfgAPIEndpoint: "localhost:8000",
 
+		// Serve /healthz and /readyz on a separate listener, eg. for
+		// Kubernetes probes. (they are always served on the API endpoint)
+		cfgHealthEnabled: false,
+		cfgHealthAddr:    ":8001",
+
+		// Minimum interval between update events of a flow, in milliseconds.
+		cfgProbeCooldown: 2000,
+
+		// Only account for flows to/from these ports. (empty means all ports)
+		cfgProbeDstPorts: []uint16{},
+		cfgProbeSrcPorts: []uint16{},
+
+		// Number the events of each flow, for detecting duplicates downstream.
+		cfgProbeSequence: false,
+
+		// Count SYN, FIN and RST packets of TCP flows.
+		cfgProbeTCPFlags: false,
+
+		// Maximum amount of flows tracked in the kernel at once.
+		cfgProbeMaxFlows: bpf.DefaultMaxFlows,
+
+		// Start when the conntrack accounting sysctls are disabled,
+		// sending events of flows without counters.
+		cfgProbeAllowUnaccounted: false,
+
+		// Read events from the perf maps of a probe pinned by another
+		// component to this bpffs directory. (empty loads our own probe)
+		cfgProbePinPath: "",
+
+		// Keep IPv4(-mapped) addresses in their 16-byte form, instead of
+		// normalizing them to 4-byte IPv4 addresses.
+		cfgProbeRawAddrs: false,
+
+		// Bind the probe's reader goroutines to these CPUs, eg. the CPUs of
+		// one NUMA node. (empty doesn't bind them)
+		cfgProbeReaderCPUs: []uint{},
+
+		// Kinds of events to attach the probe's kprobes for, at least one of
+		// new, update and destroy.
+		cfgProbeEvents: []string{"new", "update", "destroy"},
+
+		// Write the BPF verifier's log to this file when the kernel rejects
+		// the probe. (empty only includes it in the error)
+		cfgProbeVerifierLog: "",
+
+		// Save the probe's per-flow state to this file on shutdown and restore
+		// it on startup, so established flows aren't seen as new flows again.
+		// (empty doesn't persist it)
+		cfgProbeStateFile: "",
+
+		// Source of accounting data: bpf, netlink, or auto to fall back to
+		// netlink if the BPF probe can't be loaded. Netlink dumps the
+		// conntrack table every probe_netlink_interval. replay replays the
+		// events captured in probe_replay_file at probe_replay_speed times
+		// their original pace. (zero replays as fast as possible)
+		cfgProbeBackend:         "bpf",
+		cfgProbeNetlinkInterval: "10s",
+		cfgProbeReplayFile:      "",
+		cfgProbeReplaySpeed:     1.0,
+
+		// Hold events for this long to deliver the events of every flow in
+		// order, by seq if probe_sequence is enabled. (zero disables it)
+		cfgProbeReorderWindow: "0s",
+
+		// Static labels added to every event, eg. environment or region.
+		// Optionally label events with the host's name. (os.Hostname())
+		cfgLabels:        map[string]string{},
+		cfgLabelHostname: false,
+
+		// Bytes added per packet to the adjusted byte counters of events,
+		// eg. 14 for Ethernet headers. (zero disables adjusted counters)
+		cfgByteOverhead: 0,
+
+		// Only keep the events of 1 in sample_rate flows. (zero or one keeps
+		// all flows) Hosts using the same sample_seed sample the same flows.
+		// Flows not sampled are upgraded to keep all their events once they
+		// reach sample_upgrade_bytes bytes or sample_upgrade_packets packets.
+		// (zero disables a threshold) Upgraded flows are tracked for
+		// sample_upgrade_ttl after their last event, for at most
+		// sample_upgrade_max_flows flows.
+		cfgSampleRate:            0,
+		cfgSampleSeed:            0,
+		cfgSampleUpgradeBytes:    0,
+		cfgSampleUpgradePackets:  0,
+		cfgSampleUpgradeTTL:      "5m",
+		cfgSampleUpgradeMaxFlows: 65536,
+
+		// Drop events with zero bytes in both directions before they reach
+		// the sinks, eg. of entries without accounting data.
+		cfgDropZeroBytes: false,
+
+		// Label TCP and UDP events with the service name of their ports, from
+		// a builtin table of well-known ports and optionally a services(5)
+		// file. Overrides map a port (or port/proto) to a name.
+		cfgServiceLabels:    false,
+		cfgServiceFile:      "",
+		cfgServiceOverrides: map[string]string{},
+
+		// Merge flows tracked as separate conntrack entries per direction into
+		// one flow, emitted once per window. (zero disables coalescing) State is
+		// held for coalesce_ttl after a flow's last event, for at most
+		// coalesce_max_flows flows. Protocol numbers to coalesce, all if empty.
+		cfgCoalesceWindow:   "0s",
+		cfgCoalesceTTL:      "5m",
+		cfgCoalesceMaxFlows: 65536,
+		cfgCoalesceProtos:   []int{},
+
+		// Hold destroy events for destroy_dedup_window, emitting a single
+		// destroy event per flow with its highest totals. (zero disables)
+		// At most destroy_dedup_max_flows flows are held.
+		cfgDestroyDedupWindow:   "0s",
+		cfgDestroyDedupMaxFlows: 65536,
+
+		// Coalesce the update events of each flow into one event per window.
+		// (zero disables the rollup) At most rollup_max_flows flows are held.
+		cfgRollupWindow:   "0s",
+		cfgRollupMaxFlows: 65536,
+
+		// Drop the updates of flows of which the rate since their previous
+		// event is below min_rate_bytes bytes and min_rate_packets packets per
+		// second. (zero disables a floor) New and destroy events are kept. State
+		// is held for min_rate_ttl after a flow's last event, for at most
+		// min_rate_max_flows flows.
+		cfgMinRateBytes:    0,
+		cfgMinRatePackets:  0,
+		cfgMinRateTTL:      "5m",
+		cfgMinRateMaxFlows: 65536,
+
+		// Drop all events of flows younger than min_flow_age, including the
+		// destroy events of flows that never reached it. (zero disables) State
+		// is held for min_flow_age_ttl after a flow's last event, for at most
+		// min_flow_age_max_flows flows.
+		cfgMinFlowAge:         "0s",
+		cfgMinFlowAgeTTL:      "10m",
+		cfgMinFlowAgeMaxFlows: 65536,
+
+		// Only emit a single summary per flow, its destroy event with the
+		// flow's duration and average rate. Flows idle for summary_idle are
+		// flushed with their latest event. At most summary_max_flows flows are
+		// tracked.
+		cfgSummaryOnly:     false,
+		cfgSummaryIdle:     "10m",
+		cfgSummaryMaxFlows: 65536,
+
+		// Add the counters accrued since each flow's previous event to events.
+		// At most delta_max_flows flows are tracked.
+		cfgDeltaFields:   false,
+		cfgDeltaMaxFlows: 65536,
+
+		// Destroyed flows are remembered by the delta and summary stages for
+		// late_event_window, so events of a flow arriving after its destroy
+		// event are recognized as late. (zero disables)
+		cfgLateEventWindow: "1m",
+
+		// Labels computed from expressions over the fields of each event,
+		// of the form 'name = expression'. (see package pkg/expr)
+		cfgDeriveLabels: []string{},
+
+		// Classify the bytes of events as received (bytes_in) and sent
+		// (bytes_out) by the host, based on the addresses of its interfaces,
+		// re-read every host_direction_refresh. Extra addresses are treated as
+		// the host's, eg. addresses DNATed to the host.
+		cfgHostDirection:        false,
+		cfgHostDirectionRefresh: "1m",
+		cfgHostAddresses:        []string{},
+
+		// Record the pipeline's progress in a file, dropping destroy events
+		// emitted before a restart. (empty disables checkpoints) Destroyed
+		// flows are kept for checkpoint_retain, at most checkpoint_max_flows.
+		cfgCheckpointFile:     "",
+		cfgCheckpointInterval: "10s",
+		cfgCheckpointRetain:   "10m",
+		cfgCheckpointMaxFlows: 65536,
+
+		// Rank flows, or their addresses by top_talkers_group, by their traffic
+		// over a sliding window, served at /top on the API endpoint. (zero
+		// disables it) At most top_talkers_max talkers and flows are tracked.
+		cfgTopTalkersWindow: "0s",
+		cfgTopTalkersGroup:  stages.TalkersByFlow,
+		cfgTopTalkersN:      10,
+		cfgTopTalkersMax:    65536,
+
+		// Sum the traffic of all flows by the bits of their connmark in
+		// mark_aggregate_mask, emitting one event per connmark per window.
+		// (zero disables it) Connmarks are dropped after mark_aggregate_ttl
+		// without events. At most mark_aggregate_max_flows flows are tracked.
+		cfgMarkAggregateWindow:   "0s",
+		cfgMarkAggregateMask:     int64(0xffffffff),
+		cfgMarkAggregateTTL:      "10m",
+		cfgMarkAggregateMaxFlows: 65536,
+
 		// Sinks for accounting data.
 		cfgSinks: map[string]interface{}{
 			"stdout": map[string]interface{}{
@@ -34,12 +341,41 @@ var (
 			},
 		},
 
+		// Bound the memory used for batches by all sinks to a pool of
+		// n buffers of the given size (in events). Zero disables the pool.
+		cfgSinkPoolBuffers:    0,
+		cfgSinkPoolBufferSize: 1024,
+
+		// Limit the writes of all network sinks in progress at once,
+		// eg. InfluxDB requests. Zero means no limit.
+		cfgSinkMaxConcurrentWrites: 0,
+
+		// Time a sink needs to be failing to deliver events before it's
+		// reported as unhealthy on the health endpoints.
+		cfgSinkFailureThreshold: "1m",
+
+		// On SIGTERM or SIGINT, deliver pending events and flush the sinks'
+		// pending batches for at most this long before exiting. (zero waits
+		// for all sinks)
+		cfgShutdownTimeout: "10s",
+
+		// Load the probe and initialize the sinks, verifying their
+		// destinations are reachable, and exit without emitting any events.
+		cfgDryRun: false,
+
 		// Automatically manage Conntrack-related sysctls of the host.
 		cfgSysctlManage: true,
 
 		// Run a pprof endpoint during operation. (live profiling)
 		cfgPProfEnabled:  false,
 		cfgPProfEndpoint: "localhost:6060",
+
+		// Minimum level of log entries, their format (text or json) and
+		// output (stderr, stdout or a file path). --debug sets the level
+		// to debug.
+		cfgLogLevel:  "info",
+		cfgLogFormat: "text",
+		cfgLogOutput: "stderr",
 	}
 )
 
@@ -50,22 +386,246 @@ func init() {
 	}
 }
 
-// initRegisterSinks initializes a list of sinks according to their types
-// and registers them to the given pipeline.
-func initRegisterSinks(cl []types.SinkConfig, pipe *pipeline.Pipeline) error {
+// probeConfig builds the accounting probe's configuration
+// from the application configuration.
+func probeConfig() (bpf.Config, error) {
+
+	cfg := bpf.Config{
+		CooldownMillis: uint32(viper.GetInt(cfgProbeCooldown)),
+		Sequence:       viper.GetBool(cfgProbeSequence),
+		TCPFlags:       viper.GetBool(cfgProbeTCPFlags),
+		MaxFlows:       uint32(viper.GetInt(cfgProbeMaxFlows)),
+		PinPath:        viper.GetString(cfgProbePinPath),
+		RawAddrs:       viper.GetBool(cfgProbeRawAddrs),
+
+		VerifierLogPath: viper.GetString(cfgProbeVerifierLog),
+		StateFile:       viper.GetString(cfgProbeStateFile),
+
+		NetlinkInterval: viper.GetDuration(cfgProbeNetlinkInterval),
+
+		ReplayFile:  viper.GetString(cfgProbeReplayFile),
+		ReplaySpeed: viper.GetFloat64(cfgProbeReplaySpeed),
 
-	for _, cfg := range cl {
-		// Create and initialize a new sink based on the SinkConfig.
-		sink, err := sinks.New(cfg)
+		AllowUnaccounted: viper.GetBool(cfgProbeAllowUnaccounted),
+	}
+
+	if err := viper.UnmarshalKey(cfgProbeDstPorts, &cfg.DstPortFilter); err != nil {
+		return cfg, errors.Wrap(err, cfgProbeDstPorts)
+	}
+	if err := viper.UnmarshalKey(cfgProbeSrcPorts, &cfg.SrcPortFilter); err != nil {
+		return cfg, errors.Wrap(err, cfgProbeSrcPorts)
+	}
+	if err := viper.UnmarshalKey(cfgProbeReaderCPUs, &cfg.ReaderCPUs); err != nil {
+		return cfg, errors.Wrap(err, cfgProbeReaderCPUs)
+	}
+
+	events := viper.GetStringSlice(cfgProbeEvents)
+	if len(events) == 0 {
+		return cfg, errors.Errorf("%s: no event types selected", cfgProbeEvents)
+	}
+	for _, name := range events {
+		var et bpf.EventType
+		if err := et.UnmarshalText([]byte(name)); err != nil {
+			return cfg, errors.Wrap(err, cfgProbeEvents)
+		}
+		cfg.Events = append(cfg.Events, et)
+	}
+
+	return cfg, nil
+}
+
+// pipelineLabels builds the static labels added to every event. The hostname
+// label is only set from os.Hostname() if not explicitly configured.
+// Returns nil if no labels are configured.
+func pipelineLabels() (map[string]string, error) {
+
+	labels := viper.GetStringMapString(cfgLabels)
+
+	if _, ok := labels["hostname"]; !ok && viper.GetBool(cfgLabelHostname) {
+		h, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting hostname")
+		}
+		labels["hostname"] = h
+	}
+
+	if len(labels) == 0 {
+		return nil, nil
+	}
+
+	return labels, nil
+}
+
+// pipelineStages builds the list of stages events are run through
+// before being delivered to the pipeline's sinks.
+func pipelineStages() ([]stages.Stage, error) {
+
+	var out []stages.Stage
+
+	if r := viper.GetInt(cfgSampleRate); r > 1 {
+		seed := uint64(viper.GetInt64(cfgSampleSeed))
+		b, p := viper.GetInt64(cfgSampleUpgradeBytes), viper.GetInt64(cfgSampleUpgradePackets)
+		if b > 0 || p > 0 {
+			out = append(out, stages.NewAdaptiveSample(uint32(r), seed, uint64(b), uint64(p),
+				viper.GetDuration(cfgSampleUpgradeTTL), viper.GetInt(cfgSampleUpgradeMaxFlows)))
+		} else {
+			out = append(out, stages.NewSample(uint32(r), seed))
+		}
+	}
+
+	if viper.GetBool(cfgDropZeroBytes) {
+		out = append(out, stages.NewZeroBytes())
+	}
+
+	if viper.GetBool(cfgServiceLabels) {
+		s, err := stages.NewService(viper.GetString(cfgServiceFile), viper.GetStringMapString(cfgServiceOverrides))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+
+	if o := viper.GetInt(cfgByteOverhead); o > 0 {
+		out = append(out, stages.NewOverhead(uint64(o)))
+	}
+
+	if w := viper.GetDuration(cfgCoalesceWindow); w > 0 {
+		var protos []uint8
+		if err := viper.UnmarshalKey(cfgCoalesceProtos, &protos); err != nil {
+			return nil, errors.Wrap(err, cfgCoalesceProtos)
+		}
+		out = append(out, stages.NewCoalesce(w, viper.GetDuration(cfgCoalesceTTL), viper.GetInt(cfgCoalesceMaxFlows), protos))
+	}
+
+	// Duplicate destroys are merged after the halves of flows were coalesced.
+	if w := viper.GetDuration(cfgDestroyDedupWindow); w > 0 {
+		out = append(out, stages.NewDestroyDedup(w, viper.GetInt(cfgDestroyDedupMaxFlows)))
+	}
+
+	if w := viper.GetDuration(cfgRollupWindow); w > 0 {
+		out = append(out, stages.NewRollup(w, viper.GetInt(cfgRollupMaxFlows)))
+	}
+
+	// Rates are computed between the events leaving the rollup, and trickle
+	// updates are dropped before deltas are computed.
+	b, p := viper.GetFloat64(cfgMinRateBytes), viper.GetFloat64(cfgMinRatePackets)
+	if b > 0 || p > 0 {
+		out = append(out, stages.NewMinRate(b, p, viper.GetDuration(cfgMinRateTTL), viper.GetInt(cfgMinRateMaxFlows)))
+	}
+
+	// Young flows are dropped before deltas are computed, so the first delta
+	// of a long-lived flow covers its traffic since its start.
+	if a := viper.GetDuration(cfgMinFlowAge); a > 0 {
+		out = append(out, stages.NewMinAge(a, viper.GetDuration(cfgMinFlowAgeTTL), viper.GetInt(cfgMinFlowAgeMaxFlows)))
+	}
+
+	// Summaries are taken after the filters above, and see the totals of
+	// the flow's destroy event, so they are emitted before deltas.
+	if viper.GetBool(cfgSummaryOnly) {
+		out = append(out, stages.NewSummary(viper.GetDuration(cfgSummaryIdle), viper.GetDuration(cfgLateEventWindow), viper.GetInt(cfgSummaryMaxFlows)))
+	}
+
+	if viper.GetBool(cfgHostDirection) {
+		var extra []net.IP
+		for _, a := range viper.GetStringSlice(cfgHostAddresses) {
+			ip := net.ParseIP(a)
+			if ip == nil {
+				return nil, errors.Errorf("%s: invalid address '%s'", cfgHostAddresses, a)
+			}
+			extra = append(extra, ip)
+		}
+
+		h, err := stages.NewHostDir(extra, viper.GetDuration(cfgHostDirectionRefresh))
+		if err != nil {
+			return nil, errors.Wrap(err, "reading interface addresses")
+		}
+		out = append(out, h)
+	}
+
+	// Deltas are computed between the events leaving the rollup.
+	if viper.GetBool(cfgDeltaFields) {
+		out = append(out, stages.NewDelta(viper.GetDuration(cfgLateEventWindow), viper.GetInt(cfgDeltaMaxFlows)))
+	}
+
+	// Derived labels see the fields set by all stages before.
+	if defs := viper.GetStringSlice(cfgDeriveLabels); len(defs) != 0 {
+		d, err := stages.NewDerive(defs)
+		if err != nil {
+			return nil, errors.Wrap(err, cfgDeriveLabels)
+		}
+		out = append(out, d)
+	}
+
+	// The checkpoint records the events leaving all other stages.
+	if f := viper.GetString(cfgCheckpointFile); f != "" {
+		c, err := stages.NewCheckpoint(f, viper.GetDuration(cfgCheckpointInterval),
+			viper.GetDuration(cfgCheckpointRetain), viper.GetInt(cfgCheckpointMaxFlows))
 		if err != nil {
-			return errors.Wrap(err, fmt.Sprintf("creating sink '%s'", cfg.Name))
+			return nil, err
+		}
+		if s := c.Since(); !s.IsZero() {
+			log.Warnf("Resuming from checkpoint %s, flows destroyed since %s were not accounted", f, s)
 		}
+		out = append(out, c)
+	}
 
-		// Register created sink with pipeline.
-		if err := pipe.RegisterSink(sink); err != nil {
-			return errors.Wrap(err, fmt.Sprintf("registering sink '%s' to pipeline", cfg.Name))
+	// Top talkers observe the events reaching the sinks, before
+	// aggregation replaces them.
+	if w := viper.GetDuration(cfgTopTalkersWindow); w > 0 {
+		tt, err := stages.NewTopTalkers(w, viper.GetInt(cfgTopTalkersN),
+			viper.GetString(cfgTopTalkersGroup), viper.GetInt(cfgTopTalkersMax))
+		if err != nil {
+			return nil, errors.Wrap(err, cfgTopTalkersGroup)
 		}
+		out = append(out, tt)
+	}
+
+	// Aggregation replaces the events of flows, after the checkpoint
+	// dropped destroy events that were already accounted for.
+	if w := viper.GetDuration(cfgMarkAggregateWindow); w > 0 {
+		out = append(out, stages.NewMarkAggregate(w, uint32(viper.GetInt64(cfgMarkAggregateMask)),
+			viper.GetDuration(cfgMarkAggregateTTL), viper.GetInt(cfgMarkAggregateMaxFlows)))
+	}
+
+	return out, nil
+}
+
+// sinkBufferPool returns the buffer pool shared by all sinks,
+// or nil if the pool is disabled.
+func sinkBufferPool() *bufpool.Pool {
+
+	n := viper.GetInt(cfgSinkPoolBuffers)
+	if n <= 0 {
+		return nil
+	}
+
+	return bufpool.New(n, viper.GetInt(cfgSinkPoolBufferSize))
+}
+
+// sinkWriteLimiter returns the limit of concurrent writes shared
+// by all sinks, or nil if writes are not limited.
+func sinkWriteLimiter() *writelimit.Limiter {
+
+	n := viper.GetInt(cfgSinkMaxConcurrentWrites)
+	if n <= 0 {
+		return nil
+	}
+
+	return writelimit.New(n)
+}
+
+// reloadConfig re-reads the configuration file and applies
+// the sink configuration to the given pipeline.
+func reloadConfig(pipe *pipeline.Pipeline) error {
+
+	if err := viper.ReadInConfig(); err != nil {
+		return errors.Wrap(err, "reading config file")
+	}
+
+	scfg, err := types.DecodeSinkConfigMap(viper.GetStringMap(cfgSinks))
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return pipe.ApplySinkConfig(scfg)
 }
@@ -6,15 +6,22 @@ import (
 	"path"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/ti-mo/conntracct/internal/logging"
 )
 
 var (
 	appName = "conntracct"
 
+	// Version of the application, set at build time with
+	// -ldflags "-X github.com/ti-mo/conntracct/cmd.version=<version>".
+	version = "dev"
+
 	cfgFile string
 	debug   bool
 )
@@ -26,7 +33,8 @@ var rootCmd = &cobra.Command{
 	Long: `Conntracct is a tool for extracting network flow information from Linux hosts.
 It hooks into Conntrack's accounting (acct) subsystem using eBPF to receive
 low-overhead updates to connection packet counters.`,
-	PersistentPreRun: rootPreRun,
+	Version:           version,
+	PersistentPreRunE: rootPreRun,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -80,9 +88,22 @@ func initConfig() {
 
 // rootPreRun runs after all commands have been initialized and config
 // flags have been bound.
-func rootPreRun(*cobra.Command, []string) {
+func rootPreRun(*cobra.Command, []string) error {
+
+	lc := logging.Config{
+		Level:  viper.GetString(cfgLogLevel),
+		Format: viper.GetString(cfgLogFormat),
+		Output: viper.GetString(cfgLogOutput),
+	}
+
 	// Enable debug logging if debug flag enabled.
 	if debug {
-		log.SetLevel(log.DebugLevel)
+		lc.Level = log.DebugLevel.String()
+	}
+
+	if err := logging.Configure(log.StandardLogger(), lc); err != nil {
+		return errors.Wrap(err, "configuring logging")
 	}
+
+	return nil
 }
@@ -28,6 +28,10 @@ var runCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(runCmd)
+
+	runCmd.Flags().Bool("dry-run", false,
+		"validate the configuration by loading the probe and sinks, without emitting events")
+	_ = viper.BindPFlag(cfgDryRun, runCmd.Flags().Lookup("dry-run"))
 }
 
 func run(cmd *cobra.Command, args []string) error {
@@ -45,9 +49,35 @@ func run(cmd *cobra.Command, args []string) error {
 	// Log decoded config map to debug.
 	log.Debugf("Sink configuration: %+v", scfg)
 
-	pipe := pipeline.New()
+	pcfg, err := probeConfig()
+	if err != nil {
+		return errors.Wrap(err, "probe configuration")
+	}
+
+	labels, err := pipelineLabels()
+	if err != nil {
+		return errors.Wrap(err, "pipeline labels")
+	}
+
+	stages, err := pipelineStages()
+	if err != nil {
+		return errors.Wrap(err, "pipeline stages")
+	}
+
+	pipe := pipeline.New(pipeline.Config{
+		Probe:         pcfg,
+		Backend:       viper.GetString(cfgProbeBackend),
+		ReorderWindow: viper.GetDuration(cfgProbeReorderWindow),
+		BufferPool:    sinkBufferPool(),
+		WriteLimiter:  sinkWriteLimiter(),
+		Stages:        stages,
+		Labels:        labels,
 
-	if err := initRegisterSinks(scfg, pipe); err != nil {
+		SinkFailureThreshold: viper.GetDuration(cfgSinkFailureThreshold),
+		DryRun:               viper.GetBool(cfgDryRun),
+	})
+
+	if err := pipe.ApplySinkConfig(scfg); err != nil {
 		return errors.Wrap(err, "initialize and register sinks")
 	}
 
@@ -59,18 +89,29 @@ func run(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "start pipeline")
 	}
 
-	// Initialize and run the API server if enabled.
-	if viper.GetBool(cfgAPIEnabled) {
-		if err := apiserver.Init(pipe); err != nil {
+	if viper.GetBool(cfgDryRun) {
+		return dryRun(pipe)
+	}
+
+	// Initialize and run the API server and health listener if enabled.
+	if viper.GetBool(cfgAPIEnabled) || viper.GetBool(cfgHealthEnabled) {
+		if err := apiserver.Init(pipe, version); err != nil {
 			return err
 		}
+	}
+	if viper.GetBool(cfgAPIEnabled) {
 		if err := apiserver.Run(viper.GetString(cfgAPIEndpoint)); err != nil {
 			return err
 		}
 	}
+	if viper.GetBool(cfgHealthEnabled) {
+		if err := apiserver.RunHealth(viper.GetString(cfgHealthAddr)); err != nil {
+			return err
+		}
+	}
 
 	defer func() {
-		if err := pipe.Stop(); err != nil {
+		if err := pipe.Shutdown(viper.GetDuration(cfgShutdownTimeout)); err != nil {
 			log.Fatalf("Failure stopping pipeline: %v", err)
 		}
 	}()
@@ -79,11 +120,61 @@ func run(cmd *cobra.Command, args []string) error {
 		return errors.Wrap(err, "apply system configuration")
 	}
 
-	// Wait for program to be interrupted.
+	// Wait for program to be interrupted, reload sinks on SIGHUP.
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	// Replayed captures end, exit once all events were delivered.
+	s := waitSignals(sig, pipe.ReplayDone(), func() error {
+		return reloadConfig(pipe)
+	})
+	if s == nil {
+		log.Info("Exiting after replaying all events")
+		return nil
+	}
+
+	log.Info("Exiting with signal ", s)
+
+	return nil
+}
 
-	log.Info("Exiting with signal ", <-sig)
+// dryRun shuts down the pipeline, which was started without emitting events
+// after loading the probe and initializing the sinks, which connect to their
+// destinations in Init.
+func dryRun(pipe *pipeline.Pipeline) error {
+
+	n := len(pipe.GetSinks())
+
+	if err := pipe.Shutdown(viper.GetDuration(cfgShutdownTimeout)); err != nil {
+		return errors.Wrap(err, "stop pipeline")
+	}
+
+	log.Infof("Dry run succeeded: loaded the probe and initialized %d sinks", n)
 
 	return nil
 }
+
+// waitSignals blocks until a signal other than SIGHUP is received on sig and
+// returns it, or until done is closed, returning nil. On SIGHUP, calls reload
+// and logs any errors. A nil done is never closed.
+func waitSignals(sig <-chan os.Signal, done <-chan struct{}, reload func() error) os.Signal {
+	for {
+		select {
+		case s, ok := <-sig:
+			if !ok {
+				return nil
+			}
+			if s != syscall.SIGHUP {
+				return s
+			}
+
+			log.Info("Received SIGHUP, reloading sink configuration")
+			if err := reload(); err != nil {
+				log.Errorf("Error reloading sink configuration: %s", err)
+			}
+
+		case <-done:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/pipeline"
+	"github.com/ti-mo/conntracct/internal/sinks"
+)
+
+func TestReloadSignal(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := filepath.Join(dir, "conntracct.yml")
+	writeConfig := func(s string) {
+		require.NoError(t, ioutil.WriteFile(cfg, []byte(s), 0644))
+	}
+
+	writeConfig(`
+sinks:
+  keep:
+    type: dummy
+  change:
+    type: dummy
+    batchSize: 1
+  remove:
+    type: dummy
+`)
+
+	viper.SetConfigFile(cfg)
+	defer viper.Reset()
+
+	pipe := pipeline.New(pipeline.Config{})
+	require.NoError(t, reloadConfig(pipe))
+
+	before := sinksByName(pipe.GetSinks())
+	require.Len(t, before, 3)
+
+	writeConfig(`
+sinks:
+  keep:
+    type: dummy
+  change:
+    type: dummy
+    batchSize: 2
+  add:
+    type: dummy
+`)
+
+	// Simulate a SIGHUP followed by a termination signal.
+	sig := make(chan os.Signal, 2)
+	sig <- syscall.SIGHUP
+	sig <- syscall.SIGTERM
+
+	var reloads int
+	assert.Equal(t, syscall.SIGTERM, waitSignals(sig, nil, func() error {
+		reloads++
+		return reloadConfig(pipe)
+	}))
+	assert.Equal(t, 1, reloads)
+
+	after := sinksByName(pipe.GetSinks())
+
+	var names []string
+	for n := range after {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"add", "change", "keep"}, names)
+
+	// Unchanged sinks are left untouched, changed sinks are re-created.
+	assert.True(t, before["keep"] == after["keep"], "unchanged sink was replaced")
+	assert.False(t, before["change"] == after["change"], "changed sink was not replaced")
+
+	// A broken configuration leaves the pipeline's sinks as they are.
+	writeConfig(`
+sinks:
+  keep:
+    type: dummy
+  broken:
+    type: influxdb-udp
+`)
+	assert.Error(t, reloadConfig(pipe))
+	assert.Equal(t, after, sinksByName(pipe.GetSinks()))
+}
+
+func sinksByName(sl []sinks.Sink) map[string]sinks.Sink {
+	m := make(map[string]sinks.Sink, len(sl))
+	for _, s := range sl {
+		m[s.Name()] = s
+	}
+	return m
+}
@@ -3,22 +3,32 @@ module github.com/ti-mo/conntracct
 go 1.12
 
 require (
+	github.com/alicebob/miniredis/v2 v2.11.0
 	github.com/blang/semver v3.5.1+incompatible
+	github.com/eclipse/paho.mqtt.golang v1.3.0
+	github.com/go-redis/redis v6.15.2+incompatible
+	github.com/gomodule/redigo v2.0.0+incompatible // indirect
 	github.com/gorilla/mux v1.7.0
 	github.com/influxdata/influxdb v1.7.4
 	github.com/influxdata/platform v0.0.0-20190117200541-d500d3cf5589 // indirect
 	github.com/iovisor/gobpf v0.0.0-20190311163924-89fd87167a6e
 	github.com/lorenzosaino/go-sysctl v0.1.0
 	github.com/magefile/mage v1.8.0
+	github.com/mdlayher/netlink v1.1.0
 	github.com/mitchellh/go-homedir v1.0.0
 	github.com/mitchellh/mapstructure v1.1.2
-	github.com/pkg/errors v0.8.1
+	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.0.0
+	github.com/prometheus/client_model v0.0.0-20190129233127-fd36f4220a90
 	github.com/rakyll/statik v0.1.6
 	github.com/sirupsen/logrus v1.4.0
 	github.com/spf13/cobra v0.0.3
 	github.com/spf13/viper v1.3.2
-	github.com/stretchr/testify v1.2.2
+	github.com/stretchr/testify v1.4.0
+	github.com/ti-mo/conntrack v0.3.0
 	github.com/ti-mo/kconfig v0.0.0-20181208153747-0708bf82969f
-	golang.org/x/sync v0.0.0-20180314180146-1d60e4601c6f
-	golang.org/x/sys v0.0.0-20181205085412-a5c9d58dba9a
+	github.com/ti-mo/netfilter v0.3.1
+	github.com/xitongsys/parquet-go v1.5.2
+	golang.org/x/sync v0.0.0-20181221193216-37e7f081c4d4
+	golang.org/x/sys v0.0.0-20200331124033-c3d80250170d
 )
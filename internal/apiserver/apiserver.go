@@ -14,18 +14,23 @@ var (
 	// Processing pipeline handle
 	pipe *pipeline.Pipeline
 
+	// Version of the application, reported by HandleInfo
+	appVersion string
+
 	// Whether or not package was successfully initialized
 	initSuccess bool
 )
 
-// Init configures the package with handles to the objects it manipulates.
-func Init(p *pipeline.Pipeline) error {
+// Init configures the package with handles to the objects it manipulates,
+// and the version of the application.
+func Init(p *pipeline.Pipeline, version string) error {
 
 	if p != nil {
 		pipe = p
 	} else {
 		return errNoPipe
 	}
+	appVersion = version
 
 	// Mark package as initialized
 	initSuccess = true
@@ -44,6 +49,12 @@ func Run(addr string) error {
 	r := mux.NewRouter()
 
 	r.HandleFunc("/stats", HandleStats)
+	r.HandleFunc("/sinks/{name}/events", HandleSinkEvents)
+	r.HandleFunc("/top", HandleTopTalkers)
+	r.HandleFunc("/info", HandleInfo)
+	r.Handle("/metrics", metricsHandler(pipe))
+	r.HandleFunc("/healthz", HandleLive)
+	r.HandleFunc("/readyz", HandleReady)
 
 	http.Handle("/", r)
 	go func() {
@@ -56,3 +67,28 @@ func Run(addr string) error {
 
 	return nil
 }
+
+// RunHealth runs an HTTP listener only serving the health endpoints, eg. on
+// an address reachable by the kubelet while the API listens on localhost.
+func RunHealth(addr string) error {
+
+	// Check if the package was properly initialized
+	if !initSuccess {
+		return errNotInit
+	}
+
+	r := mux.NewRouter()
+
+	r.HandleFunc("/healthz", HandleLive)
+	r.HandleFunc("/readyz", HandleReady)
+
+	go func() {
+		if err := http.ListenAndServe(addr, r); err != nil {
+			log.Fatalf("Error in health listener: %s", err)
+		}
+	}()
+
+	log.Infof("Health endpoints listening on address '%s'", addr)
+
+	return nil
+}
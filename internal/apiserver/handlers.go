@@ -3,25 +3,41 @@ package apiserver
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
+
+	"github.com/ti-mo/conntracct/internal/pipeline"
+	"github.com/ti-mo/conntracct/internal/sinks"
 	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/stages"
 )
 
 // HandleStats returns statistics about the application in JSON format.
 func HandleStats(w http.ResponseWriter, r *http.Request) {
 
 	probe := pipe.ProbeStats()
+	cpus := pipe.ProbeCPUStats()
 	pline := pipe.Stats()
 
+	// Map stats are informational, omit them if they can't be read.
+	maps, err := pipe.ProbeMapStats()
+	if err != nil {
+		maps = nil
+	}
+
 	sinks := make(map[string]types.SinkStats)
 	for _, s := range pipe.GetSinks() {
 		sinks[s.Name()] = s.Stats()
 	}
 
 	s := map[string]interface{}{
-		"probe":    probe,
-		"pipeline": pline,
-		"sinks":    sinks,
+		"probe":      probe,
+		"probe_cpus": cpus,
+		"probe_maps": maps,
+		"pipeline":   pline,
+		"sinks":      sinks,
 	}
 
 	out, err := json.Marshal(s)
@@ -35,3 +51,151 @@ func HandleStats(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	write(w, "%s", out)
 }
+
+// HandleSinkEvents returns the recent events retained by
+// an in-memory sink (eg. memring) in JSON format.
+func HandleSinkEvents(w http.ResponseWriter, r *http.Request) {
+
+	name := mux.Vars(r)["name"]
+
+	var rec sinks.Recorder
+	for _, s := range pipe.GetSinks() {
+		if s.Name() != name {
+			continue
+		}
+
+		var ok bool
+		if rec, ok = sinks.AsRecorder(s); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			write(w, "sink '%s' does not retain events", name)
+			return
+		}
+	}
+
+	if rec == nil {
+		w.WriteHeader(http.StatusNotFound)
+		write(w, "sink '%s' not found", name)
+		return
+	}
+
+	out, err := json.Marshal(rec.Recent())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		write(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	write(w, "%s", out)
+}
+
+// HandleTopTalkers returns the flows with the most traffic over the window
+// of the pipeline's TopTalkers stage in JSON format. The amount of flows and
+// their ranking are given by the 'n' and 'by' (bytes or packets) parameters.
+func HandleTopTalkers(w http.ResponseWriter, r *http.Request) {
+
+	tt := pipe.TopTalkers()
+	if tt == nil {
+		w.WriteHeader(http.StatusNotFound)
+		write(w, "top talkers not enabled")
+		return
+	}
+
+	q := r.URL.Query()
+
+	var n int
+	if s := q.Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			write(w, "invalid amount of talkers '%s'", s)
+			return
+		}
+	}
+
+	by := q.Get("by")
+	if by == "" {
+		by = stages.RankBytes
+	}
+
+	talkers, err := tt.Top(n, by, time.Now())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		write(w, err.Error())
+		return
+	}
+
+	out, err := json.Marshal(map[string]interface{}{
+		"window":  tt.Window().String(),
+		"group":   tt.Group(),
+		"by":      by,
+		"talkers": talkers,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		write(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	write(w, "%s", out)
+}
+
+// HandleInfo returns the version of the application, and the capabilities
+// and configuration of the pipeline in JSON format, see pipeline.Info.
+func HandleInfo(w http.ResponseWriter, r *http.Request) {
+
+	out, err := json.Marshal(struct {
+		Version string `json:"version"`
+		pipeline.Info
+	}{appVersion, pipe.Info()})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		write(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	write(w, "%s", out)
+}
+
+// HandleLive reports whether the pipeline's accounting probe is running,
+// for a liveness probe. Failing sinks don't affect liveness.
+func HandleLive(w http.ResponseWriter, r *http.Request) {
+
+	if !pipe.Health(time.Now()).Probe {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		write(w, "probe not running")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	write(w, "ok")
+}
+
+// HandleReady returns the health of the pipeline and its sinks in JSON
+// format, for a readiness probe. Responds with 503 Service Unavailable
+// if the pipeline can't deliver events.
+func HandleReady(w http.ResponseWriter, r *http.Request) {
+
+	h := pipe.Health(time.Now())
+
+	out, err := json.Marshal(h)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		write(w, err.Error())
+		return
+	}
+
+	code := http.StatusOK
+	if !h.Ready() {
+		code = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	write(w, "%s", out)
+}
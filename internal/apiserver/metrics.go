@@ -0,0 +1,54 @@
+package apiserver
+
+import (
+	"net/http"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ti-mo/conntracct/internal/pipeline"
+)
+
+var (
+	sinkLabels = []string{"sink", "type"}
+
+	descQueueLength = prom.NewDesc("conntracct_sink_queue_length",
+		"Entries in the sink's send queue, events or batches depending on the sink.", sinkLabels, nil)
+	descQueueCapacity = prom.NewDesc("conntracct_sink_queue_capacity",
+		"Capacity of the sink's send queue, events are dropped once it's full.", sinkLabels, nil)
+	descBatchAge = prom.NewDesc("conntracct_sink_batch_age_seconds",
+		"Time since the first event was added to the sink's current batch.", sinkLabels, nil)
+)
+
+// queueCollector is a Prometheus collector of the queues of a pipeline's
+// sinks, see pipeline.SinkQueues. Gauges are labeled by the name and type
+// of their sink.
+type queueCollector struct {
+	p *pipeline.Pipeline
+}
+
+// Describe sends the descriptors of the collector's gauges.
+func (c queueCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- descQueueLength
+	ch <- descQueueCapacity
+	ch <- descBatchAge
+}
+
+// Collect sends the gauges of the queues of the pipeline's sinks.
+func (c queueCollector) Collect(ch chan<- prom.Metric) {
+	for _, q := range c.p.SinkQueues() {
+		ch <- prom.MustNewConstMetric(descQueueLength, prom.GaugeValue, float64(q.Length), q.Name, q.Type)
+		ch <- prom.MustNewConstMetric(descQueueCapacity, prom.GaugeValue, float64(q.Capacity), q.Name, q.Type)
+		ch <- prom.MustNewConstMetric(descBatchAge, prom.GaugeValue, q.BatchAge.Seconds(), q.Name, q.Type)
+	}
+}
+
+// metricsHandler returns a handler serving the metrics of the pipeline's
+// sinks in the Prometheus text format.
+func metricsHandler(p *pipeline.Pipeline) http.Handler {
+
+	reg := prom.NewRegistry()
+	reg.MustRegister(queueCollector{p})
+
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+}
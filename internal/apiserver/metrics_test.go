@@ -0,0 +1,63 @@
+package apiserver
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/pipeline"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// queueSink is a sink with a queue set by the test.
+type queueSink struct {
+	name  string
+	queue types.QueueStats
+}
+
+func (s *queueSink) Init(types.SinkConfig) error  { return nil }
+func (s *queueSink) IsInit() bool                 { return true }
+func (s *queueSink) Name() string                 { return s.name }
+func (s *queueSink) WantUpdate() bool             { return true }
+func (s *queueSink) WantDestroy() bool            { return true }
+func (s *queueSink) WantNew() bool                { return true }
+func (s *queueSink) Push(bpf.Event)               {}
+func (s *queueSink) Stats() types.SinkStats       { return types.SinkStats{} }
+func (s *queueSink) Close() error                 { return nil }
+func (s *queueSink) QueueStats() types.QueueStats { return s.queue }
+
+func TestQueueCollector(t *testing.T) {
+
+	p := pipeline.New(pipeline.Config{})
+
+	qs := &queueSink{name: "events", queue: types.QueueStats{Length: 2, Capacity: 64, BatchAge: 1500 * time.Millisecond}}
+	require.NoError(t, p.RegisterSink(qs))
+
+	c := queueCollector{p}
+	require.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP conntracct_sink_queue_length Entries in the sink's send queue, events or batches depending on the sink.
+# TYPE conntracct_sink_queue_length gauge
+conntracct_sink_queue_length{sink="events",type=""} 2
+# HELP conntracct_sink_queue_capacity Capacity of the sink's send queue, events are dropped once it's full.
+# TYPE conntracct_sink_queue_capacity gauge
+conntracct_sink_queue_capacity{sink="events",type=""} 64
+# HELP conntracct_sink_batch_age_seconds Time since the first event was added to the sink's current batch.
+# TYPE conntracct_sink_batch_age_seconds gauge
+conntracct_sink_batch_age_seconds{sink="events",type=""} 1.5
+`)))
+
+	// Gauges reflect the sink's queue at the time they are collected.
+	qs.queue = types.QueueStats{Capacity: 64}
+	rec := httptest.NewRecorder()
+	metricsHandler(p).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	assert.Contains(t, body, `conntracct_sink_queue_length{sink="events",type=""} 0`)
+	assert.Contains(t, body, `conntracct_sink_batch_age_seconds{sink="events",type=""} 0`)
+}
@@ -0,0 +1,5 @@
+package logging
+
+const (
+	errFmtFormat = "unknown log format '%s'"
+)
@@ -0,0 +1,111 @@
+// Package logging configures the application's logger and provides
+// the contextual fields its components add to their log entries.
+package logging
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of log entries.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Outputs of log entries, any other output is the path of a file.
+const (
+	OutputStderr = "stderr"
+	OutputStdout = "stdout"
+)
+
+// Fields added to log entries, identifying the part of conntracct logging
+// them. Entries of sinks carry the sink's name and type.
+const (
+	FieldComponent = "component"
+	FieldSink      = "sink"
+	FieldSinkType  = "sink_type"
+)
+
+// Components logging entries.
+const (
+	ComponentPipeline = "pipeline"
+	ComponentProbe    = "probe"
+	ComponentSink     = "sink"
+)
+
+// Config is the configuration of a logger.
+type Config struct {
+	// Minimum level of entries to log, eg. "info" or "debug".
+	// Defaults to "info" if empty.
+	Level string
+
+	// Format of log entries, one of the Format* constants.
+	// Defaults to FormatText if empty.
+	Format string
+
+	// Output of log entries, one of the Output* constants or the path of
+	// a file entries are appended to. Defaults to OutputStderr if empty.
+	Output string
+}
+
+// Configure applies the configuration to the logger. The logger is left
+// untouched if the configuration is invalid.
+func Configure(l *log.Logger, cfg Config) error {
+
+	lvl := log.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		if lvl, err = log.ParseLevel(cfg.Level); err != nil {
+			return err
+		}
+	}
+
+	var f log.Formatter
+	switch cfg.Format {
+	case "", FormatText:
+		f = &log.TextFormatter{}
+	case FormatJSON:
+		f = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf(errFmtFormat, cfg.Format)
+	}
+
+	out := os.Stderr
+	switch cfg.Output {
+	case "", OutputStderr:
+	case OutputStdout:
+		out = os.Stdout
+	default:
+		// The file stays open for the lifetime of the process.
+		var err error
+		if out, err = os.OpenFile(cfg.Output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err != nil {
+			return errors.Wrap(err, "opening log file")
+		}
+	}
+
+	l.SetLevel(lvl)
+	l.SetFormatter(f)
+	l.SetOutput(out)
+
+	return nil
+}
+
+// Component returns an entry of the standard logger
+// for logging messages of the given component.
+func Component(c string) *log.Entry {
+	return log.WithField(FieldComponent, c)
+}
+
+// Sink returns an entry of the standard logger for
+// logging messages of the sink with the given name and type.
+func Sink(name string, typ fmt.Stringer) *log.Entry {
+	return log.WithFields(log.Fields{
+		FieldComponent: ComponentSink,
+		FieldSink:      name,
+		FieldSinkType:  typ.String(),
+	})
+}
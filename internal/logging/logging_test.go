@@ -0,0 +1,73 @@
+package logging
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+)
+
+func TestConfigureJSON(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Restore the standard logger's defaults after the test.
+	std := log.StandardLogger()
+	defer func() {
+		std.SetLevel(log.InfoLevel)
+		std.SetFormatter(&log.TextFormatter{})
+		std.SetOutput(os.Stderr)
+	}()
+
+	path := filepath.Join(dir, "conntracct.log")
+	require.NoError(t, Configure(std, Config{Level: "warning", Format: FormatJSON, Output: path}))
+
+	Sink("primary", types.InfluxHTTP).WithError(errors.New("rejected")).Error("Error writing batch, batch dropped")
+	Component(ComponentProbe).Info("Below the configured level")
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	require.Len(t, lines, 1)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+
+	assert.Equal(t, "error", entry["level"])
+	assert.Equal(t, "Error writing batch, batch dropped", entry["msg"])
+	assert.Equal(t, "rejected", entry["error"])
+	assert.Equal(t, ComponentSink, entry[FieldComponent])
+	assert.Equal(t, "primary", entry[FieldSink])
+	assert.Equal(t, "InfluxHTTP", entry[FieldSinkType])
+	assert.Contains(t, entry, "time")
+}
+
+func TestConfigureInvalid(t *testing.T) {
+
+	l := log.New()
+
+	assert.Error(t, Configure(l, Config{Level: "loud"}))
+	assert.EqualError(t, Configure(l, Config{Format: "xml"}), "unknown log format 'xml'")
+	assert.Error(t, Configure(l, Config{Output: "/nonexistent/conntracct.log"}))
+
+	// The logger is left untouched.
+	assert.Equal(t, log.InfoLevel, l.Level)
+	assert.Equal(t, os.Stderr, l.Out)
+
+	require.NoError(t, Configure(l, Config{Level: "debug", Output: OutputStdout}))
+	assert.Equal(t, log.DebugLevel, l.Level)
+	assert.Equal(t, os.Stdout, l.Out)
+	assert.IsType(t, &log.TextFormatter{}, l.Formatter)
+}
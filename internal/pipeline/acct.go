@@ -1,13 +1,22 @@
 package pipeline
 
 import (
-	"github.com/pkg/errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/pkg/errors"
 
+	"github.com/ti-mo/conntracct/internal/logging"
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
+// Loggers of the pipeline and its accounting probe.
+var (
+	pipelineLog = logging.Component(logging.ComponentPipeline)
+	probeLog    = logging.Component(logging.ComponentProbe)
+)
+
 // Init initializes the pipeline. Only runs once, subsequent calls are no-ops.
 func (p *Pipeline) Init() error {
 
@@ -22,34 +31,40 @@ func (p *Pipeline) Init() error {
 // initAcct initializes the accounting probe and consumers.
 // Should only be called once, eg. gated behind a sync.Once.
 func (p *Pipeline) initAcct() error {
-	cfg := bpf.Config{CooldownMillis: 2000}
-
 	// Create a new accounting probe.
-	ap, err := bpf.NewProbe(cfg)
+	ap, err := p.newAcctProbe()
 	if err != nil {
-		return errors.Wrap(err, "initializing BPF probe")
+		return err
 	}
-	log.Infof("Inserted probe version %s", ap.Kernel().Version)
+
+	return p.registerSources(ap)
+}
+
+// registerSources registers the pipeline's update and destroy
+// consumers to the accounting probe.
+func (p *Pipeline) registerSources(ap acctSource) error {
 
 	// Register accounting update/destroy event consumers.
 	// From the perspective of the pipeline, these are sources.
 	au := bpf.NewConsumer("PipelineAcctUpdate", make(chan bpf.Event, 1024), bpf.ConsumerUpdate)
+	au.SetReorder(p.config.ReorderWindow)
 	if err := ap.RegisterConsumer(au); err != nil {
 		return errors.Wrap(err, "registering update consumer to probe")
 	}
 	// Store references to the source and its stats.
 	p.acctUpdateSource = au
 	p.stats.UpdateSourceStats = au.Stats()
-	log.Debug("Registered Probe consumer " + au.Name())
+	probeLog.Debug("Registered Probe consumer " + au.Name())
 
 	ad := bpf.NewConsumer("PipelineAcctDestroy", make(chan bpf.Event, 1024), bpf.ConsumerDestroy)
+	ad.SetReorder(p.config.ReorderWindow)
 	if err := ap.RegisterConsumer(ad); err != nil {
 		return errors.Wrap(err, "registering destroy consumer to probe")
 	}
 	// Store references to the source and its stats.
 	p.acctDestroySource = ad
 	p.stats.DestroySourceStats = ad.Stats()
-	log.Debug("Registered Probe consumer " + ad.Name())
+	probeLog.Debug("Registered Probe consumer " + ad.Name())
 
 	// Save the Probe reference to the pipeline.
 	p.acctProbe = ap
@@ -57,6 +72,91 @@ func (p *Pipeline) initAcct() error {
 	return nil
 }
 
+// newAcctProbe creates the accounting probe of the pipeline's backend.
+func (p *Pipeline) newAcctProbe() (acctSource, error) {
+
+	switch p.config.Backend {
+	case "", BackendBPF:
+		return p.newBPFProbe()
+
+	case BackendNetlink:
+		return p.newNetlinkProbe()
+
+	case BackendAuto:
+		ap, err := p.newBPFProbe()
+		if err == nil {
+			return ap, nil
+		}
+		probeLog.Warnf("Falling back to netlink accounting: %s", err)
+		return p.newNetlinkProbe()
+
+	case BackendReplay:
+		return p.newReplaySource()
+	}
+
+	return nil, fmt.Errorf(errFmtUnknownBackend, p.config.Backend)
+}
+
+// newBPFProbe loads the BPF accounting probe.
+func (p *Pipeline) newBPFProbe() (acctSource, error) {
+
+	ap, err := bpf.NewProbe(p.config.Probe)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing BPF probe")
+	}
+	if pp := p.config.Probe.PinPath; pp != "" {
+		probeLog.Infof("Attached to probe maps pinned at %s", pp)
+	} else {
+		probeLog.Infof("Inserted probe version %s", ap.Kernel().Version)
+	}
+	warnDisabledSysctls(ap.DisabledSysctls())
+
+	return ap, nil
+}
+
+// newNetlinkProbe creates a probe reading conntrack accounting over netlink.
+func (p *Pipeline) newNetlinkProbe() (acctSource, error) {
+
+	np, err := bpf.NewNetlinkProbe(p.config.Probe)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing netlink probe")
+	}
+	probeLog.Infof("Reading conntrack accounting over netlink every %s", np.Interval())
+	warnDisabledSysctls(np.DisabledSysctls())
+
+	return np, nil
+}
+
+// newReplaySource creates a probe replaying events captured in a file.
+func (p *Pipeline) newReplaySource() (acctSource, error) {
+
+	rs, err := bpf.NewReplaySource(p.config.Probe)
+	if err != nil {
+		return nil, errors.Wrap(err, "initializing replay source")
+	}
+	probeLog.Infof("Replaying events from %s", p.config.Probe.ReplayFile)
+
+	return rs, nil
+}
+
+// ReplayDone returns a channel that is closed when the pipeline's replay
+// backend replayed all captured events, see bpf.ReplaySource.Done. Returns
+// nil for other backends, or if the pipeline wasn't initialized.
+func (p *Pipeline) ReplayDone() <-chan struct{} {
+	if rs, ok := p.acctProbe.(*bpf.ReplaySource); ok {
+		return rs.Done()
+	}
+	return nil
+}
+
+// warnDisabledSysctls logs the disabled conntrack accounting sysctls, if any.
+func warnDisabledSysctls(d []string) {
+	if len(d) != 0 {
+		probeLog.Warnf("Conntrack accounting disabled by sysctl(s) %s, "+
+			"events of flows created while disabled have no counters", strings.Join(d, ", "))
+	}
+}
+
 // Start starts all resources registered to the pipeline.
 func (p *Pipeline) Start() error {
 
@@ -77,15 +177,24 @@ func (p *Pipeline) Start() error {
 func (p *Pipeline) startAcct() error {
 
 	// Start the conntracct event consumer.
+	p.workers.Add(2)
 	go p.acctUpdateWorker()
 	go p.acctDestroyWorker()
+	if len(p.config.Stages) != 0 && !p.config.DryRun {
+		go p.flushWorker()
+	}
 
 	// Start the Probe.
 	if err := p.acctProbe.Start(); err != nil {
 		return errors.Wrap(err, "starting Probe")
 	}
+	atomic.StoreUint32(&p.running, 1)
 
-	log.Info("Started accounting probe and workers")
+	if ap, ok := p.acctProbe.(*bpf.Probe); ok && p.config.Probe.StateFile != "" {
+		probeLog.Infof("Restored the state of %d flows from %s", ap.RestoredFlows(), p.config.Probe.StateFile)
+	}
+
+	pipelineLog.Info("Started accounting probe and workers")
 
 	return nil
 }
@@ -96,22 +205,44 @@ func (p *Pipeline) startAcct() error {
 // path, avoiding as much branching and unnecessary work as possible.
 func (p *Pipeline) acctUpdateWorker() {
 
+	defer p.workers.Done()
+
 	c := p.acctUpdateSource.Events()
 
 	for {
 		ae, ok := <-c
 		if !ok {
-			log.Debug("Pipeline's update event channel closed, stopping worker.")
+			pipelineLog.Debug("Pipeline's update event channel closed, stopping worker.")
 			break
 		}
 
 		// Record pipeline statistics.
 		p.stats.IncrEventsUpdate()
 
+		if p.config.DryRun {
+			continue
+		}
+
+		if p.config.Labels != nil {
+			ae.Labels = p.config.Labels
+		}
+
+		// Updates raised before their flow's destroy event
+		// was seen are dropped, see destroyOrder.
+		if p.order.superseded(ae) {
+			p.stats.incrEventsSuperseded()
+			continue
+		}
+
+		if len(p.config.Stages) != 0 {
+			p.process(ae)
+			continue
+		}
+
 		// Fan out to all registered accounting sinks.
 		p.acctSinkMu.RLock()
 		for _, s := range p.acctSinks {
-			if s.WantUpdate() {
+			if s.WantUpdate() || (ae.Type == bpf.EventNew && s.WantNew()) {
 				s.Push(ae)
 			}
 		}
@@ -122,18 +253,35 @@ func (p *Pipeline) acctUpdateWorker() {
 // acctDestroyWorker is a copy of acctUpdateWorker, but for destroy events.
 func (p *Pipeline) acctDestroyWorker() {
 
+	defer p.workers.Done()
+
 	c := p.acctDestroySource.Events()
 
 	for {
 		ae, ok := <-c
 		if !ok {
-			log.Debug("Pipeline's destroy event channel closed, stopping worker.")
+			pipelineLog.Debug("Pipeline's destroy event channel closed, stopping worker.")
 			break
 		}
 
 		// Record pipeline statistics.
 		p.stats.IncrEventsDestroy()
 
+		if p.config.DryRun {
+			continue
+		}
+
+		if p.config.Labels != nil {
+			ae.Labels = p.config.Labels
+		}
+
+		p.order.destroyed(ae)
+
+		if len(p.config.Stages) != 0 {
+			p.process(ae)
+			continue
+		}
+
 		// Fan out to all registered accounting sinks.
 		p.acctSinkMu.RLock()
 		for _, s := range p.acctSinks {
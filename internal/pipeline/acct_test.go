@@ -0,0 +1,100 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestInitBackend(t *testing.T) {
+
+	err := New(Config{Backend: "ebpf"}).Init()
+	assert.EqualError(t, err, "unknown probe backend 'ebpf'")
+
+	// The netlink probe can't read pinned maps.
+	p := New(Config{Backend: BackendNetlink, Probe: bpf.Config{PinPath: "/nonexistent"}})
+	err = p.Init()
+	assert.Error(t, err)
+	assert.Nil(t, p.acctProbe)
+}
+
+func TestReplayBackend(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "conntracct-replay")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	enc := json.NewEncoder(f)
+	for i := uint32(1); i <= 10; i++ {
+		require.NoError(t, enc.Encode(bpf.Event{ConnectionID: i, Type: bpf.EventUpdate}))
+	}
+	require.NoError(t, f.Close())
+
+	p := New(Config{Backend: BackendReplay, Probe: bpf.Config{ReplayFile: f.Name()}})
+	s := &batchSink{healthSink: healthSink{name: "replay"}}
+	require.NoError(t, p.RegisterSink(s))
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start())
+
+	select {
+	case <-p.ReplayDone():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+	require.NoError(t, p.Shutdown(time.Second))
+
+	// The sink received the captured events in order.
+	var ids []uint32
+	for _, e := range s.sent {
+		ids = append(ids, e.ConnectionID)
+	}
+	assert.Equal(t, []uint32{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, ids)
+
+	// Other backends never finish.
+	assert.Nil(t, New(Config{}).ReplayDone())
+}
+
+func TestDryRun(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "conntracct-replay")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	enc := json.NewEncoder(f)
+	for i := uint32(1); i <= 10; i++ {
+		require.NoError(t, enc.Encode(bpf.Event{ConnectionID: i, Type: bpf.EventUpdate}))
+	}
+	require.NoError(t, enc.Encode(bpf.Event{ConnectionID: 1, Type: bpf.EventDestroy}))
+	require.NoError(t, f.Close())
+
+	p := New(Config{Backend: BackendReplay, Probe: bpf.Config{ReplayFile: f.Name()}, DryRun: true})
+	require.NoError(t, p.ApplySinkConfig([]types.SinkConfig{{Name: "dummy", Type: types.Dummy}}))
+	s := &batchSink{healthSink: healthSink{name: "replay"}}
+	require.NoError(t, p.RegisterSink(s))
+	require.NoError(t, p.Init())
+	require.NoError(t, p.Start())
+
+	ss := p.GetSinks()
+	require.Len(t, ss, 2)
+	assert.True(t, ss[0].IsInit())
+
+	select {
+	case <-p.ReplayDone():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+	require.NoError(t, p.Shutdown(time.Second))
+
+	// Events were read from the probe, but never reached the sinks.
+	assert.EqualValues(t, 11, p.Stats().EventsTotal)
+	assert.Zero(t, ss[0].Stats().EventsPushed)
+	assert.Empty(t, s.sent)
+}
@@ -2,6 +2,13 @@ package pipeline
 
 import "errors"
 
+const (
+	errFmtMultipleDeadLetter = "sinks '%s' and '%s' are both configured as dead letter sink"
+	errFmtUnknownBackend     = "unknown probe backend '%s'"
+	errFmtShutdownEvents     = "timed out after %s delivering pending events"
+	errFmtShutdownSinks      = "timed out after %s closing sinks %s"
+)
+
 var (
 	errAcctNotInitialized = errors.New("accounting not yet initialized")
 	errSinkNotInit        = errors.New("sink must be initialized before registering with pipeline")
@@ -0,0 +1,155 @@
+package pipeline
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+)
+
+// Health statuses of the pipeline.
+const (
+	// The probe is running and all sinks are healthy.
+	HealthOK = "ok"
+	// The probe is running, but some non-critical sinks are failing.
+	HealthDegraded = "degraded"
+	// The probe is not running, a critical sink is failing, or all sinks are.
+	HealthUnavailable = "unavailable"
+)
+
+// DefaultSinkFailureThreshold is the time a sink needs to be failing before
+// it's reported as unhealthy, if Config.SinkFailureThreshold is zero.
+const DefaultSinkFailureThreshold = time.Minute
+
+// Health is the health of the pipeline and its sinks.
+type Health struct {
+	Status string `json:"status"`
+
+	// The accounting probe is attached and running.
+	Probe bool `json:"probe"`
+
+	Sinks map[string]SinkHealth `json:"sinks"`
+}
+
+// Ready returns whether the pipeline is able to deliver events, even if some
+// of its non-critical sinks are failing.
+func (h Health) Ready() bool {
+	return h.Status != HealthUnavailable
+}
+
+// SinkHealth is the health of a sink.
+type SinkHealth struct {
+	Healthy  bool `json:"healthy"`
+	Critical bool `json:"critical"`
+
+	// Time the sink started failing, if it is failing.
+	FailingSince *time.Time `json:"failing_since,omitempty"`
+}
+
+// sinkHealthState holds the statistics of a sink at the previous health
+// check, to tell whether it failed or delivered events since.
+type sinkHealthState struct {
+	failures     uint64
+	deliveries   uint64
+	failingSince time.Time
+}
+
+// sinkOutcomes returns the total amount of failed and successful deliveries
+// of batches, messages and files in the sink's statistics.
+func sinkOutcomes(st types.SinkStats) (failures, deliveries uint64) {
+	failures = st.BatchesDropped + st.MessagesFailed + st.FilesFailed
+	deliveries = st.BatchesSent + st.BatchesReplayed + st.MessagesPublished + st.FilesWritten
+	return
+}
+
+// Health returns the health of the pipeline at now. A sink is failing when it
+// failed to deliver events without delivering any others since the previous
+// call, or, if it implements sinks.HealthChecker, when it reports so. Sinks
+// are unhealthy when they have been failing for the pipeline's
+// SinkFailureThreshold, so health is meant to be checked periodically, like
+// by a Kubernetes probe.
+func (p *Pipeline) Health(now time.Time) Health {
+
+	h := Health{
+		Status: HealthOK,
+		Probe:  atomic.LoadUint32(&p.running) == 1,
+		Sinks:  make(map[string]SinkHealth),
+	}
+
+	threshold := p.config.SinkFailureThreshold
+	if threshold == 0 {
+		threshold = DefaultSinkFailureThreshold
+	}
+
+	p.sinkConfigMu.Lock()
+	critical := make(map[string]bool, len(p.sinkConfigs))
+	for name, cfg := range p.sinkConfigs {
+		critical[name] = cfg.Critical
+	}
+	p.sinkConfigMu.Unlock()
+
+	p.healthMu.Lock()
+	defer p.healthMu.Unlock()
+
+	states := make(map[string]*sinkHealthState)
+	healthy := 0
+	for _, s := range p.GetSinks() {
+
+		state, ok := p.healthStates[s.Name()]
+		if !ok {
+			state = &sinkHealthState{}
+		}
+		states[s.Name()] = state
+
+		failures, deliveries := sinkOutcomes(s.Stats())
+
+		failing := !state.failingSince.IsZero()
+		switch {
+		case deliveries > state.deliveries:
+			failing = false
+		case failures > state.failures:
+			failing = true
+		}
+		if hc, ok := sinks.AsHealthChecker(s); ok {
+			failing = !hc.Healthy()
+		}
+
+		state.failures, state.deliveries = failures, deliveries
+
+		sh := SinkHealth{Healthy: true, Critical: critical[s.Name()]}
+		switch {
+		case !failing:
+			state.failingSince = time.Time{}
+		case state.failingSince.IsZero():
+			state.failingSince = now
+			fallthrough
+		default:
+			since := state.failingSince
+			sh.FailingSince = &since
+			sh.Healthy = now.Sub(since) < threshold
+		}
+
+		if sh.Healthy {
+			healthy++
+		} else {
+			h.Status = HealthDegraded
+		}
+
+		h.Sinks[s.Name()] = sh
+	}
+
+	// Forget the state of removed sinks.
+	p.healthStates = states
+
+	if !h.Probe || (len(h.Sinks) != 0 && healthy == 0) {
+		h.Status = HealthUnavailable
+	}
+	for _, sh := range h.Sinks {
+		if sh.Critical && !sh.Healthy {
+			h.Status = HealthUnavailable
+		}
+	}
+
+	return h
+}
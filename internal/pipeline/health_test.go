@@ -0,0 +1,153 @@
+package pipeline
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// healthSink is a sink with statistics set by the test.
+type healthSink struct {
+	name  string
+	stats types.SinkStats
+}
+
+func (s *healthSink) Init(types.SinkConfig) error { return nil }
+func (s *healthSink) IsInit() bool                { return true }
+func (s *healthSink) Name() string                { return s.name }
+func (s *healthSink) WantUpdate() bool            { return true }
+func (s *healthSink) WantDestroy() bool           { return false }
+func (s *healthSink) WantNew() bool               { return false }
+func (s *healthSink) Push(bpf.Event)              {}
+func (s *healthSink) Stats() types.SinkStats      { return s.stats.Get() }
+func (s *healthSink) Close() error                { return nil }
+
+// checkerSink is a healthSink reporting its own health.
+type checkerSink struct {
+	healthSink
+	healthy bool
+}
+
+func (s *checkerSink) Healthy() bool { return s.healthy }
+
+func newHealthPipeline(critical ...string) *Pipeline {
+	p := New(Config{SinkFailureThreshold: time.Minute})
+	atomic.StoreUint32(&p.running, 1)
+
+	p.sinkConfigs = make(map[string]types.SinkConfig)
+	for _, name := range critical {
+		p.sinkConfigs[name] = types.SinkConfig{Name: name, Critical: true}
+	}
+
+	return p
+}
+
+func TestHealthProbe(t *testing.T) {
+
+	p := newHealthPipeline()
+
+	h := p.Health(time.Now())
+	assert.Equal(t, HealthOK, h.Status)
+	assert.True(t, h.Probe)
+	assert.True(t, h.Ready())
+
+	atomic.StoreUint32(&p.running, 0)
+
+	h = p.Health(time.Now())
+	assert.Equal(t, HealthUnavailable, h.Status)
+	assert.False(t, h.Probe)
+	assert.False(t, h.Ready())
+}
+
+func TestHealthSinkFailing(t *testing.T) {
+
+	p := newHealthPipeline()
+
+	a := &healthSink{name: "a"}
+	b := &healthSink{name: "b"}
+	require.NoError(t, p.RegisterSink(a))
+	require.NoError(t, p.RegisterSink(b))
+
+	now := time.Unix(300, 0)
+	assert.Equal(t, HealthOK, p.Health(now).Status)
+
+	// A sink failing to deliver batches isn't unhealthy right away.
+	a.stats.IncrBatchDropped()
+	b.stats.IncrBatchSent()
+	h := p.Health(now.Add(10 * time.Second))
+	assert.Equal(t, HealthOK, h.Status)
+	require.NotNil(t, h.Sinks["a"].FailingSince)
+	assert.Equal(t, now.Add(10*time.Second), *h.Sinks["a"].FailingSince)
+	assert.Nil(t, h.Sinks["b"].FailingSince)
+
+	// Still failing after the threshold, without delivering any batches.
+	a.stats.IncrBatchDropped()
+	h = p.Health(now.Add(80 * time.Second))
+	assert.Equal(t, HealthDegraded, h.Status, "a non-critical sink is failing")
+	assert.True(t, h.Ready())
+	assert.False(t, h.Sinks["a"].Healthy)
+	assert.True(t, h.Sinks["b"].Healthy)
+
+	// Unavailable when all sinks are failing.
+	b.stats.IncrBatchDropped()
+	assert.Equal(t, HealthDegraded, p.Health(now.Add(90*time.Second)).Status)
+	h = p.Health(now.Add(3 * time.Minute))
+	assert.Equal(t, HealthUnavailable, h.Status)
+	assert.False(t, h.Ready())
+
+	// Recovered once they deliver batches again.
+	a.stats.IncrBatchSent()
+	b.stats.AddBatchesReplayed(1)
+	h = p.Health(now.Add(4 * time.Minute))
+	assert.Equal(t, HealthOK, h.Status)
+	assert.True(t, h.Sinks["a"].Healthy)
+	assert.Nil(t, h.Sinks["a"].FailingSince)
+}
+
+func TestHealthCriticalSink(t *testing.T) {
+
+	p := newHealthPipeline("primary")
+
+	primary := &healthSink{name: "primary"}
+	other := &healthSink{name: "other"}
+	require.NoError(t, p.RegisterSink(primary))
+	require.NoError(t, p.RegisterSink(other))
+
+	now := time.Unix(300, 0)
+
+	primary.stats.IncrMessageFailed()
+	other.stats.IncrMessagePublished()
+	h := p.Health(now)
+	assert.Equal(t, HealthOK, h.Status)
+	assert.True(t, h.Sinks["primary"].Critical)
+	assert.False(t, h.Sinks["other"].Critical)
+
+	h = p.Health(now.Add(time.Minute))
+	assert.Equal(t, HealthUnavailable, h.Status, "critical sink failing")
+	assert.False(t, h.Sinks["primary"].Healthy)
+	assert.True(t, h.Sinks["other"].Healthy)
+}
+
+func TestHealthChecker(t *testing.T) {
+
+	p := newHealthPipeline()
+
+	s := &checkerSink{healthSink: healthSink{name: "mqtt"}}
+	require.NoError(t, p.RegisterSink(s))
+
+	now := time.Unix(300, 0)
+
+	// The sink's own health takes precedence over its statistics.
+	s.stats.IncrMessagePublished()
+	assert.Equal(t, HealthOK, p.Health(now).Status)
+	assert.Equal(t, HealthUnavailable, p.Health(now.Add(time.Minute)).Status)
+
+	s.healthy = true
+	assert.Equal(t, HealthOK, p.Health(now.Add(2*time.Minute)).Status)
+}
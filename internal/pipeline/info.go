@@ -0,0 +1,167 @@
+package pipeline
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Transports of events from the kernel, see Info.
+const (
+	// Events are read from the BPF probe's perf ring buffers.
+	TransportPerf = "perf"
+	// Flows are dumped and destroys received over conntrack netlink.
+	TransportNetlink = "netlink"
+	// Events are replayed from a file.
+	TransportReplay = "replay"
+)
+
+// Info describes the capabilities and configuration of a pipeline,
+// for telling instances apart, eg. while rolling out a new version.
+type Info struct {
+	// Version of the serialized form of events, see bpf.SchemaVersion.
+	SchemaVersion int `json:"schema_version"`
+
+	// Release of the running kernel, eg. '5.4.0-42-generic'.
+	KernelRelease string `json:"kernel_release"`
+
+	// Backend of the accounting probe in use, one of the Backend* constants.
+	// BackendAuto is reported as the backend it selected.
+	Backend string `json:"backend"`
+
+	// Transport of events from the kernel, one of the Transport* constants.
+	Transport string `json:"transport"`
+
+	// Kernel version the loaded BPF probe was built against.
+	// Empty for other backends, or if the probe's maps are pinned.
+	ProbeKernel string `json:"probe_kernel,omitempty"`
+
+	// Names of the sink types supported in configuration.
+	SinkTypes []string `json:"sink_types"`
+
+	// Sinks registered to the pipeline, in order.
+	Sinks []SinkInfo `json:"sinks"`
+
+	// Names of the pipeline's stages, in order.
+	Stages []string `json:"stages"`
+
+	// The pipeline doesn't emit any events, see Config.DryRun.
+	DryRun bool `json:"dry_run"`
+}
+
+// SinkInfo describes a sink registered to a pipeline.
+type SinkInfo struct {
+	Name string `json:"name"`
+
+	// Configuration name of the sink's type. Empty for sinks
+	// not created by ApplySinkConfig.
+	Type string `json:"type,omitempty"`
+
+	Critical   bool `json:"critical,omitempty"`
+	DeadLetter bool `json:"dead_letter,omitempty"`
+}
+
+// Info returns the capabilities and configuration of the pipeline.
+// The probe's backend and transport are only known after Init.
+func (p *Pipeline) Info() Info {
+
+	info := Info{
+		SchemaVersion: bpf.SchemaVersion,
+		KernelRelease: unameRelease(),
+		SinkTypes:     types.SinkTypeNames(),
+		Sinks:         []SinkInfo{},
+		Stages:        []string{},
+		DryRun:        p.config.DryRun,
+	}
+
+	switch ap := p.acctProbe.(type) {
+	case *bpf.Probe:
+		info.Backend, info.Transport = BackendBPF, TransportPerf
+		if p.config.Probe.PinPath == "" {
+			info.ProbeKernel = ap.Kernel().Version
+		}
+	case *bpf.NetlinkProbe:
+		info.Backend, info.Transport = BackendNetlink, TransportNetlink
+	case *bpf.ReplaySource:
+		info.Backend, info.Transport = BackendReplay, TransportReplay
+	}
+
+	configs := p.sinkConfigsCopy()
+	for _, s := range p.GetSinks() {
+		si := SinkInfo{Name: s.Name()}
+		if cfg, ok := configs[s.Name()]; ok {
+			si.Type = cfg.Type.ConfigName()
+			si.Critical, si.DeadLetter = cfg.Critical, cfg.DeadLetter
+		}
+		info.Sinks = append(info.Sinks, si)
+	}
+
+	for _, st := range p.config.Stages {
+		info.Stages = append(info.Stages, st.Name())
+	}
+
+	return info
+}
+
+// SinkQueue is the queue of a sink registered to a pipeline.
+type SinkQueue struct {
+	Name string
+	// Configuration name of the sink's type, see SinkInfo.
+	Type string
+
+	types.QueueStats
+}
+
+// SinkQueues returns the queues of the pipeline's sinks that queue events
+// before sending them, see sinks.QueueReporter.
+func (p *Pipeline) SinkQueues() []SinkQueue {
+
+	var out []SinkQueue
+
+	configs := p.sinkConfigsCopy()
+	for _, s := range p.GetSinks() {
+		qr, ok := sinks.AsQueueReporter(s)
+		if !ok {
+			continue
+		}
+
+		q := SinkQueue{Name: s.Name(), QueueStats: qr.QueueStats()}
+		if cfg, ok := configs[s.Name()]; ok {
+			q.Type = cfg.Type.ConfigName()
+		}
+		out = append(out, q)
+	}
+
+	return out
+}
+
+// sinkConfigsCopy returns a copy of the configurations of the
+// sinks created by ApplySinkConfig, by name.
+func (p *Pipeline) sinkConfigsCopy() map[string]types.SinkConfig {
+
+	p.sinkConfigMu.Lock()
+	defer p.sinkConfigMu.Unlock()
+
+	configs := make(map[string]types.SinkConfig, len(p.sinkConfigs))
+	for name, cfg := range p.sinkConfigs {
+		configs[name] = cfg
+	}
+
+	return configs
+}
+
+// unameRelease returns the release of the running kernel,
+// or an empty string if it can't be read.
+func unameRelease() string {
+
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return ""
+	}
+
+	return string(uname.Release[:bytes.IndexByte(uname.Release[:], 0)])
+}
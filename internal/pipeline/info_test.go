@@ -0,0 +1,99 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestInfo(t *testing.T) {
+
+	p := New(Config{Stages: []stages.Stage{stages.NewZeroBytes()}})
+
+	require.NoError(t, p.ApplySinkConfig([]types.SinkConfig{
+		{Name: "events", Type: types.MemRing, Critical: true},
+		{Name: "archive", Type: types.MemRing, DeadLetter: true},
+	}))
+	require.NoError(t, p.RegisterSink(&healthSink{name: "custom"}))
+
+	info := p.Info()
+	assert.Equal(t, bpf.SchemaVersion, info.SchemaVersion)
+	assert.Equal(t, []string{"zero_bytes"}, info.Stages)
+	assert.Contains(t, info.SinkTypes, "memring")
+	assert.Contains(t, info.SinkTypes, "unixsocket")
+	assert.NotContains(t, info.SinkTypes, "elasticsearch")
+
+	// All enabled sinks are listed, sinks not created from
+	// configuration without a type.
+	assert.ElementsMatch(t, []SinkInfo{
+		{Name: "events", Type: "memring", Critical: true},
+		{Name: "archive", Type: "memring", DeadLetter: true},
+		{Name: "custom"},
+	}, info.Sinks)
+
+	// The backend is only known once the pipeline was initialized.
+	assert.Empty(t, info.Backend)
+	assert.Empty(t, info.Transport)
+
+	b, err := json.Marshal(info)
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+	for _, k := range []string{"schema_version", "kernel_release", "backend", "transport", "sink_types", "sinks", "stages", "dry_run"} {
+		assert.Contains(t, m, k)
+	}
+	assert.NotContains(t, m, "probe_kernel")
+}
+
+func TestInfoReplay(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "conntracct-replay")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	require.NoError(t, f.Close())
+
+	p := New(Config{Backend: BackendReplay, Probe: bpf.Config{ReplayFile: f.Name()}})
+	require.NoError(t, p.Init())
+
+	info := p.Info()
+	assert.Equal(t, BackendReplay, info.Backend)
+	assert.Equal(t, TransportReplay, info.Transport)
+	assert.Empty(t, info.ProbeKernel)
+	assert.Empty(t, info.Sinks)
+}
+
+// queueSink is a healthSink with a queue set by the test.
+type queueSink struct {
+	healthSink
+	queue types.QueueStats
+}
+
+func (s *queueSink) QueueStats() types.QueueStats { return s.queue }
+
+func TestSinkQueues(t *testing.T) {
+
+	p := New(Config{})
+	p.sinkConfigs = map[string]types.SinkConfig{"influx": {Name: "influx", Type: types.InfluxDB}}
+
+	q := types.QueueStats{Length: 3, Capacity: 64, BatchAge: time.Second}
+	require.NoError(t, p.RegisterSink(&queueSink{healthSink{name: "influx"}, q}))
+	require.NoError(t, p.RegisterSink(&queueSink{healthSink{name: "custom"}, types.QueueStats{}}))
+
+	// Sinks without a queue are left out.
+	require.NoError(t, p.RegisterSink(&healthSink{name: "plain"}))
+
+	assert.ElementsMatch(t, []SinkQueue{
+		{Name: "influx", Type: "influxdb", QueueStats: q},
+		{Name: "custom"},
+	}, p.SinkQueues())
+}
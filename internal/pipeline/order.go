@@ -0,0 +1,69 @@
+package pipeline
+
+import (
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Amount of destroyed flows remembered by a destroyOrder.
+const orderMaxFlows = 65536
+
+// destroyMark is the position of a flow's destroy event among its events.
+type destroyMark struct {
+	timestamp uint64
+	seq       uint32
+}
+
+// destroyOrder makes the totals of destroy events authoritative. The update
+// and destroy events of a flow are read from separate perf rings and handled
+// by separate workers of the pipeline, so an update of a flow can be delivered
+// after its destroy event, and appear to supersede the flow's final totals.
+//
+// Once a flow's destroy event was seen, its updates raised before the destroy
+// are dropped. Updates are placed before the destroy by their kernel
+// Timestamp, or by their Seq if the probe doesn't decode timestamps. Events
+// without either are never dropped. When only Seq is known, the events of a
+// new flow reusing the ConnectionID of a recently destroyed flow are dropped
+// as well, since its Seq restarts.
+//
+// Only the bookkeeping is serialized, the workers don't hold a lock while
+// running stages or pushing to sinks, so a slow sink doesn't stall other
+// flows. An update checked just before its flow's destroy was seen can still
+// be delivered after the destroy; stateful stages recognize such late events
+// by their own late window.
+//
+// Destroyed flows are remembered up to orderMaxFlows, the least recently
+// destroyed are forgotten first. All methods are safe for concurrent use.
+type destroyOrder struct {
+	table *stages.FlowStateTable
+}
+
+// newDestroyOrder returns a new destroyOrder.
+func newDestroyOrder() *destroyOrder {
+	return &destroyOrder{table: stages.NewFlowStateTable(0, orderMaxFlows, nil)}
+}
+
+// destroyed marks the flow of the destroy event e as destroyed.
+func (o *destroyOrder) destroyed(e bpf.Event) {
+	o.table.Set(stages.NewFlowKey(e), destroyMark{e.Timestamp, e.Seq}, e.Time)
+}
+
+// superseded returns true if the update e was raised before the destroy
+// event of its flow.
+func (o *destroyOrder) superseded(e bpf.Event) bool {
+
+	v, ok := o.table.Peek(stages.NewFlowKey(e))
+	if !ok {
+		return false
+	}
+	m := v.(destroyMark)
+
+	if m.timestamp != 0 && e.Timestamp != 0 {
+		return e.Timestamp <= m.timestamp
+	}
+	if m.seq != 0 && e.Seq != 0 {
+		return e.Seq <= m.seq
+	}
+
+	return false
+}
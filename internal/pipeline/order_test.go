@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestDestroyOrder(t *testing.T) {
+
+	o := newDestroyOrder()
+
+	flow := func(typ bpf.EventType, ts uint64, seq uint32) bpf.Event {
+		return bpf.Event{ConnectionID: 1, Proto: 17, Type: typ, Timestamp: ts, Seq: seq}
+	}
+
+	// Nothing is superseded before the flow's destroy event.
+	assert.False(t, o.superseded(flow(bpf.EventUpdate, 100, 1)))
+
+	o.destroyed(flow(bpf.EventDestroy, 200, 3))
+
+	// Updates raised before the destroy are superseded by its totals,
+	// updates of a new flow reusing the ConnectionID are not.
+	assert.True(t, o.superseded(flow(bpf.EventUpdate, 100, 2)))
+	assert.True(t, o.superseded(flow(bpf.EventUpdate, 200, 2)))
+	assert.False(t, o.superseded(flow(bpf.EventNew, 300, 1)))
+
+	// Without timestamps, updates are ordered by their sequence number.
+	assert.True(t, o.superseded(flow(bpf.EventUpdate, 0, 2)))
+	assert.False(t, o.superseded(flow(bpf.EventUpdate, 0, 4)))
+
+	// Events without either can't be ordered, and are kept.
+	assert.False(t, o.superseded(flow(bpf.EventUpdate, 0, 0)))
+
+	// Other flows are unaffected.
+	other := flow(bpf.EventUpdate, 100, 1)
+	other.ConnectionID = 2
+	assert.False(t, o.superseded(other))
+}
+
+// orderSink records the events pushed into it.
+type orderSink struct {
+	healthSink
+
+	mu     sync.Mutex
+	events []bpf.Event
+}
+
+func (s *orderSink) WantDestroy() bool { return true }
+
+func (s *orderSink) Push(e bpf.Event) {
+	s.mu.Lock()
+	s.events = append(s.events, e)
+	s.mu.Unlock()
+}
+
+func (s *orderSink) get() []bpf.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]bpf.Event(nil), s.events...)
+}
+
+func TestPipelineDestroyOrder(t *testing.T) {
+
+	p := New(Config{})
+	s := &orderSink{healthSink: healthSink{name: "order"}}
+	require.NoError(t, p.RegisterSink(s))
+
+	uc, dc := make(chan bpf.Event, 4), make(chan bpf.Event, 4)
+	p.acctUpdateSource = bpf.NewConsumer("update", uc, bpf.ConsumerUpdate)
+	p.acctDestroySource = bpf.NewConsumer("destroy", dc, bpf.ConsumerDestroy)
+
+	p.workers.Add(2)
+	go p.acctUpdateWorker()
+	go p.acctDestroyWorker()
+
+	// The flow's destroy is delivered before its last update.
+	dc <- bpf.Event{ConnectionID: 1, Type: bpf.EventDestroy, Timestamp: 200, PacketsOrig: 3}
+	deadline := time.Now().Add(time.Second)
+	for len(s.get()) == 0 {
+		require.True(t, time.Now().Before(deadline), "destroy not delivered")
+		time.Sleep(time.Millisecond)
+	}
+
+	uc <- bpf.Event{ConnectionID: 1, Type: bpf.EventUpdate, Timestamp: 100, PacketsOrig: 2}
+	uc <- bpf.Event{ConnectionID: 1, Type: bpf.EventNew, Timestamp: 300, PacketsOrig: 1}
+	close(uc)
+	close(dc)
+	p.workers.Wait()
+
+	// The sink only received the destroy's final totals, and
+	// the new flow reusing the ConnectionID.
+	got := s.get()
+	require.Len(t, got, 2)
+	assert.Equal(t, bpf.EventDestroy, got[0].Type)
+	assert.EqualValues(t, 3, got[0].PacketsOrig)
+	assert.Equal(t, bpf.EventNew, got[1].Type)
+	assert.EqualValues(t, 1, p.Stats().EventsSuperseded)
+}
+
+// blockSink blocks pushes of events of flow 1 until released.
+type blockSink struct {
+	orderSink
+	release chan struct{}
+}
+
+func (s *blockSink) Push(e bpf.Event) {
+	if e.ConnectionID == 1 {
+		<-s.release
+	}
+	s.orderSink.Push(e)
+}
+
+func TestPipelineDestroyOrderBlockingSink(t *testing.T) {
+
+	p := New(Config{})
+	s := &blockSink{orderSink: orderSink{healthSink: healthSink{name: "block"}}, release: make(chan struct{})}
+	require.NoError(t, p.RegisterSink(s))
+
+	uc, dc := make(chan bpf.Event, 4), make(chan bpf.Event, 4)
+	p.acctUpdateSource = bpf.NewConsumer("update", uc, bpf.ConsumerUpdate)
+	p.acctDestroySource = bpf.NewConsumer("destroy", dc, bpf.ConsumerDestroy)
+
+	p.workers.Add(2)
+	go p.acctUpdateWorker()
+	go p.acctDestroyWorker()
+
+	// A sink blocking on the destroy of one flow doesn't stall the
+	// updates of other flows.
+	dc <- bpf.Event{ConnectionID: 1, Type: bpf.EventDestroy, Timestamp: 200}
+	uc <- bpf.Event{ConnectionID: 65, Type: bpf.EventUpdate, Timestamp: 100}
+
+	deadline := time.Now().Add(time.Second)
+	for len(s.get()) == 0 {
+		require.True(t, time.Now().Before(deadline), "update stalled by blocked destroy")
+		time.Sleep(time.Millisecond)
+	}
+	assert.EqualValues(t, 65, s.get()[0].ConnectionID)
+
+	close(s.release)
+	close(uc)
+	close(dc)
+	p.workers.Wait()
+
+	assert.Len(t, s.get(), 2)
+}
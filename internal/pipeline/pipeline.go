@@ -1,34 +1,140 @@
 package pipeline
 
 import (
+	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/sinks/writelimit"
+	"github.com/ti-mo/conntracct/internal/stages"
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
+// Backends of the accounting probe.
+const (
+	// Load the BPF probe. The default backend.
+	BackendBPF = "bpf"
+	// Read conntrack accounting over netlink, see bpf.NetlinkProbe.
+	BackendNetlink = "netlink"
+	// Load the BPF probe, falling back to netlink if it can't be loaded.
+	BackendAuto = "auto"
+	// Replay events captured in a file, see bpf.ReplaySource.
+	BackendReplay = "replay"
+)
+
+// Config is the configuration of a Pipeline.
+type Config struct {
+	// Configuration of the accounting probe.
+	Probe bpf.Config
+
+	// Backend of the accounting probe, one of the Backend* constants.
+	// Defaults to BackendBPF if empty.
+	Backend string
+
+	// Hold events for this long to deliver the events of every flow in
+	// order, see bpf.Consumer.SetReorder. Zero disables reordering.
+	//
+	// Update and destroy events are read by separate consumers, and only
+	// reordered among their own kind: updates are ordered against updates,
+	// never against their flow's destroy. The window doesn't prevent a destroy
+	// from arriving before its flow's last update. Such updates are dropped
+	// by the pipeline instead, see Stats.EventsSuperseded.
+	ReorderWindow time.Duration
+
+	// Pool of event buffers shared by all batching sinks created
+	// by ApplySinkConfig. Each sink allocates its own buffers if nil.
+	BufferPool *bufpool.Pool
+
+	// Limit of the writes in progress at once, shared by all network sinks
+	// created by ApplySinkConfig. No limit if nil.
+	WriteLimiter *writelimit.Limiter
+
+	// Stages events are run through, in order, before being
+	// delivered to the pipeline's sinks.
+	Stages []stages.Stage
+
+	// Static labels added to every event, like the host's name or region.
+	// Passed to sinks that need to know them upfront, like Prometheus.
+	Labels map[string]string
+
+	// Time a sink needs to be failing before it's reported as unhealthy,
+	// see Health. Defaults to DefaultSinkFailureThreshold if zero.
+	SinkFailureThreshold time.Duration
+
+	// Validate the configuration without emitting any events: the probe is
+	// loaded and sinks are initialized, connecting to their destinations,
+	// but events read from the probe are only counted in the pipeline's
+	// statistics and never run through stages or pushed to sinks.
+	DryRun bool
+}
+
 // Pipeline is a structure representing the conntracct
 // data ingest pipeline.
 type Pipeline struct {
+	config Config
+
 	start sync.Once
 
+	stop     chan struct{}
+	stopOnce sync.Once
+
 	init              sync.Once
-	acctProbe         *bpf.Probe
+	acctProbe         acctSource
 	acctUpdateSource  *bpf.Consumer
 	acctDestroySource *bpf.Consumer
 
+	// Orders the events of each flow against its destroy event.
+	order *destroyOrder
+
+	// Tracks the update and destroy workers, which exit when
+	// their sources are closed, see Shutdown.
+	workers sync.WaitGroup
+
 	acctSinkMu sync.RWMutex
 	acctSinks  []sinks.Sink
 
+	// Sink receiving events other sinks failed to deliver, if any.
+	deadLetterMu   sync.RWMutex
+	deadLetterSink sinks.Sink
+
+	// Configurations of sinks created by ApplySinkConfig, by sink name.
+	sinkConfigMu sync.Mutex
+	sinkConfigs  map[string]types.SinkConfig
+
+	// Set to 1 while the accounting probe is running.
+	running uint32
+
+	// Sink statistics at the previous health check, by sink name.
+	healthMu     sync.Mutex
+	healthStates map[string]*sinkHealthState
+
 	stats *Stats
 }
 
+// acctSource is an accounting probe with statistics, implemented
+// by bpf.Probe, bpf.NetlinkProbe and bpf.ReplaySource.
+type acctSource interface {
+	bpf.Source
+	Stats() bpf.ProbeStats
+	CPUStats() []bpf.CPUStats
+	MapStats() ([]bpf.MapStats, error)
+}
+
 // New creates a new Pipeline structure.
-func New() *Pipeline {
+func New(cfg Config) *Pipeline {
 	return &Pipeline{
-		stats: &Stats{},
+		config: cfg,
+		stop:   make(chan struct{}),
+		order:  newDestroyOrder(),
+		stats:  &Stats{},
 	}
 }
 
@@ -67,18 +173,81 @@ func (p *Pipeline) GetSinks() []sinks.Sink {
 	return p.acctSinks
 }
 
+// TopTalkers returns the pipeline's TopTalkers stage,
+// or nil if the pipeline doesn't have one.
+func (p *Pipeline) TopTalkers() *stages.TopTalkers {
+	for _, st := range p.config.Stages {
+		if tt, ok := st.(*stages.TopTalkers); ok {
+			return tt
+		}
+	}
+	return nil
+}
+
 // Stop gracefully tears down all resources of a Pipeline structure.
+// Events read from the probe but not yet delivered to the sinks, and the
+// sinks' pending batches, are not flushed, see Shutdown.
 func (p *Pipeline) Stop() error {
+	if err := p.stopAcct(); err != nil {
+		return err
+	}
+	return p.closeStages()
+}
+
+// stopAcct stops flushing the pipeline's stages and stops the accounting
+// probe, so no new events are read.
+func (p *Pipeline) stopAcct() error {
+	// Stop flushing the pipeline's stages.
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+
 	// Stop the accounting probe.
+	atomic.StoreUint32(&p.running, 0)
 	return p.acctProbe.Stop()
 }
 
+// closeStages closes stages holding on to resources, like the checkpoint file.
+func (p *Pipeline) closeStages() error {
+	for _, st := range p.config.Stages {
+		if c, ok := st.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				return errors.Wrapf(err, "closing stage %s", st.Name())
+			}
+		}
+	}
+
+	return nil
+}
+
 // ProbeStats returns a snapshot copy of the pipeline's probe's statistics.
 func (p *Pipeline) ProbeStats() bpf.ProbeStats {
 	return p.acctProbe.Stats()
 }
 
+// ProbeCPUStats returns a snapshot copy of the pipeline's probe's per-CPU statistics.
+func (p *Pipeline) ProbeCPUStats() []bpf.CPUStats {
+	return p.acctProbe.CPUStats()
+}
+
+// ProbeMapStats returns the utilization of the pipeline's probe's BPF maps.
+func (p *Pipeline) ProbeMapStats() ([]bpf.MapStats, error) {
+	return p.acctProbe.MapStats()
+}
+
 // Stats returns a snapshot copy of the pipeline's statistics.
 func (p *Pipeline) Stats() Stats {
-	return p.stats.Get()
+
+	s := p.stats.Get()
+
+	for _, st := range p.config.Stages {
+		if f, ok := st.(stages.Filter); ok {
+			s.EventsFiltered += f.Filtered()
+		}
+	}
+
+	_, inUse, waits := p.config.WriteLimiter.Stats()
+	s.SinkWritesInProgress, s.SinkWriteWaits = uint64(inUse), waits
+
+	return s
 }
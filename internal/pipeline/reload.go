@@ -0,0 +1,159 @@
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// ApplySinkConfig creates, replaces and removes the pipeline's sinks to match
+// the given list of sink configurations. Sinks are identified by name. Sinks
+// with an unchanged configuration are left untouched, sinks with a changed
+// configuration are re-created and swapped in, and sinks that are no longer
+// in the list are removed and closed. Can be called while the pipeline is
+// running to reload the sink configuration.
+//
+// If any of the new or changed sinks fails to initialize, no changes
+// are made to the pipeline.
+func (p *Pipeline) ApplySinkConfig(cfgs []types.SinkConfig) error {
+
+	p.sinkConfigMu.Lock()
+	defer p.sinkConfigMu.Unlock()
+
+	// Only a single sink can receive events dropped by other sinks.
+	var deadLetter string
+	for _, cfg := range cfgs {
+		if !cfg.DeadLetter {
+			continue
+		}
+		if deadLetter != "" {
+			return fmt.Errorf(errFmtMultipleDeadLetter, deadLetter, cfg.Name)
+		}
+		deadLetter = cfg.Name
+	}
+
+	// Initialize all new and changed sinks before making any changes.
+	created := make(map[string]sinks.Sink)
+	wanted := make(map[string]types.SinkConfig, len(cfgs))
+	for _, cfg := range cfgs {
+		wanted[cfg.Name] = cfg
+
+		if cur, ok := p.sinkConfigs[cfg.Name]; ok && reflect.DeepEqual(cur, cfg) {
+			continue
+		}
+
+		// The pool, write limiter, labels and the dead letter
+		// handler are not part of the sink's configuration.
+		cfg.BufferPool = p.config.BufferPool
+		cfg.WriteLimiter = p.config.WriteLimiter
+		cfg.Labels = p.config.Labels
+		if !cfg.DeadLetter {
+			cfg.OnDrop = p.deadLetter
+		}
+
+		s, err := sinks.New(cfg)
+		if err != nil {
+			closeSinks(created)
+			return errors.Wrap(err, fmt.Sprintf("creating sink '%s'", cfg.Name))
+		}
+
+		created[cfg.Name] = s
+	}
+
+	// Build the new list of sinks, keeping sinks that were not
+	// configured through ApplySinkConfig.
+	p.acctSinkMu.Lock()
+
+	var next []sinks.Sink
+	removed := make(map[string]sinks.Sink)
+	for _, s := range p.acctSinks {
+		_, managed := p.sinkConfigs[s.Name()]
+		_, keep := wanted[s.Name()]
+		_, replace := created[s.Name()]
+
+		if managed && (!keep || replace) {
+			removed[s.Name()] = s
+			continue
+		}
+
+		next = append(next, s)
+	}
+
+	for _, s := range created {
+		if s.WantDestroy() {
+			warnSysctl()
+		}
+		next = append(next, s)
+	}
+
+	p.acctSinks = next
+	p.acctSinkMu.Unlock()
+
+	// Swap in the dead letter sink, if any. Sinks pushing to the
+	// previous dead letter sink are done when the lock is acquired.
+	var dl sinks.Sink
+	for _, s := range next {
+		if s.Name() == deadLetter {
+			dl = s
+		}
+	}
+
+	p.deadLetterMu.Lock()
+	p.deadLetterSink = dl
+	p.deadLetterMu.Unlock()
+
+	p.sinkConfigs = wanted
+
+	// Event workers and the dead letter handler no longer have
+	// a reference to removed sinks, they can be closed safely.
+	closeSinks(removed)
+
+	for name := range created {
+		if _, ok := removed[name]; ok {
+			log.Infof("Reloaded accounting sink '%s'", name)
+		} else {
+			log.Infof("Registered accounting sink '%s' to pipeline", name)
+		}
+	}
+
+	for name := range removed {
+		if _, ok := created[name]; !ok {
+			log.Infof("Removed accounting sink '%s' from pipeline", name)
+		}
+	}
+
+	return nil
+}
+
+// closeSinks closes all sinks in the given map, logging any errors.
+func closeSinks(m map[string]sinks.Sink) {
+	for name, s := range m {
+		if err := s.Close(); err != nil {
+			log.Errorf("Error closing sink '%s': %s", name, err)
+		}
+	}
+}
+
+// deadLetter pushes events dropped by a sink to the pipeline's dead letter
+// sink. Events are discarded if no dead letter sink is configured.
+func (p *Pipeline) deadLetter(evs []bpf.Event) {
+
+	// Not using acctSinkMu, this is called from within
+	// sinks' Push methods while the pipeline holds a read lock.
+	p.deadLetterMu.RLock()
+	defer p.deadLetterMu.RUnlock()
+
+	if p.deadLetterSink == nil {
+		return
+	}
+
+	for _, e := range evs {
+		p.deadLetterSink.Push(e)
+	}
+}
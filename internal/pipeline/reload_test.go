@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// newRejectingInflux returns an InfluxDB HTTP server rejecting all writes.
+func newRejectingInflux() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			http.Error(w, `{"error":"rejected"}`, http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestDeadLetter(t *testing.T) {
+
+	hs := newRejectingInflux()
+	defer hs.Close()
+
+	p := New(Config{})
+
+	require.NoError(t, p.ApplySinkConfig([]types.SinkConfig{
+		{
+			Name:      "primary",
+			Type:      types.InfluxDB,
+			Address:   hs.URL,
+			Database:  "conntracct",
+			BatchSize: 1,
+		},
+		{
+			Name:       "archive",
+			Type:       types.MemRing,
+			DeadLetter: true,
+		},
+	}))
+	require.Len(t, p.GetSinks(), 2)
+
+	var archive sinks.Sink
+	for _, s := range p.GetSinks() {
+		if s.Name() == "archive" {
+			archive = s
+		}
+	}
+	require.NotNil(t, archive)
+	r, ok := sinks.AsRecorder(archive)
+	require.True(t, ok)
+
+	for i := uint32(1); i <= 3; i++ {
+		p.fanout(bpf.Event{ConnectionID: i, Type: bpf.EventUpdate})
+	}
+
+	// All events the primary sink failed to write end up in the dead letter
+	// sink, which does not receive events from the pipeline itself.
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.Recent()) < 3 {
+		require.True(t, time.Now().Before(deadline), "events not dead-lettered")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ev := r.Recent()
+	require.Len(t, ev, 3)
+	for i, e := range ev {
+		assert.EqualValues(t, i+1, e.ConnectionID)
+	}
+
+	// Removing the dead letter sink discards subsequently dropped events.
+	require.NoError(t, p.ApplySinkConfig([]types.SinkConfig{
+		{
+			Name:      "primary",
+			Type:      types.InfluxDB,
+			Address:   hs.URL,
+			Database:  "conntracct",
+			BatchSize: 1,
+		},
+	}))
+	p.fanout(bpf.Event{ConnectionID: 4, Type: bpf.EventUpdate})
+	require.NoError(t, p.ApplySinkConfig(nil))
+
+	assert.Len(t, r.Recent(), 3)
+	assert.Nil(t, p.deadLetterSink)
+}
+
+func TestDeadLetterMultiple(t *testing.T) {
+
+	p := New(Config{})
+
+	err := p.ApplySinkConfig([]types.SinkConfig{
+		{Name: "a", Type: types.MemRing, DeadLetter: true},
+		{Name: "b", Type: types.MemRing, DeadLetter: true},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "both configured as dead letter sink")
+	assert.Empty(t, p.GetSinks())
+}
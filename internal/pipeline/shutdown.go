@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Shutdown stops the pipeline like Stop, flushing all events on a best-effort
+// basis within the given timeout. The probe is stopped first, so no new events
+// are read. Events read before the probe stopped are run through the stages
+// and delivered to the sinks, after which all sinks are closed at once,
+// sending their pending batches. The dead letter sink is closed last, so it
+// receives the events other sinks drop while closing. Zero means no timeout.
+//
+// Returns an error if the timeout passed before the events were delivered or
+// before all sinks were closed, naming the sinks that were still closing.
+// Those are left to close in the background, the caller is expected to exit.
+func (p *Pipeline) Shutdown(timeout time.Duration) error {
+
+	// A nil channel never fires.
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+
+	if err := p.stopAcct(); err != nil {
+		return err
+	}
+
+	// Once removed from the stopped probe, no more events are delivered to the
+	// consumers. The workers exit after they processed the events left in the
+	// consumers' channels.
+	for _, c := range []*bpf.Consumer{p.acctUpdateSource, p.acctDestroySource} {
+		if err := p.acctProbe.RemoveConsumer(c); err != nil {
+			return errors.Wrapf(err, "removing consumer %s", c.Name())
+		}
+		c.Close()
+	}
+
+	if !waitDeadline(&p.workers, deadline) {
+		return errors.Errorf(errFmtShutdownEvents, timeout)
+	}
+
+	if err := p.closeStages(); err != nil {
+		return err
+	}
+
+	// Remove all sinks from the pipeline before closing them.
+	p.acctSinkMu.Lock()
+	all := p.acctSinks
+	p.acctSinks = nil
+	p.acctSinkMu.Unlock()
+
+	p.deadLetterMu.RLock()
+	dl := p.deadLetterSink
+	p.deadLetterMu.RUnlock()
+
+	var others []sinks.Sink
+	for _, s := range all {
+		if s != dl {
+			others = append(others, s)
+		}
+	}
+
+	if open := closeDeadline(others, deadline); len(open) != 0 {
+		return errors.Errorf(errFmtShutdownSinks, timeout, strings.Join(open, ", "))
+	}
+
+	if dl == nil {
+		return nil
+	}
+
+	p.deadLetterMu.Lock()
+	p.deadLetterSink = nil
+	p.deadLetterMu.Unlock()
+
+	if open := closeDeadline([]sinks.Sink{dl}, deadline); len(open) != 0 {
+		return errors.Errorf(errFmtShutdownSinks, timeout, strings.Join(open, ", "))
+	}
+
+	return nil
+}
+
+// waitDeadline waits for wg, returning false if deadline fired first.
+func waitDeadline(wg *sync.WaitGroup, deadline <-chan time.Time) bool {
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// closeDeadline closes all given sinks at once, logging any errors. Returns
+// the names of the sinks that were still closing when deadline fired.
+func closeDeadline(ss []sinks.Sink, deadline <-chan time.Time) []string {
+
+	var mu sync.Mutex
+	open := make(map[string]bool, len(ss))
+	for _, s := range ss {
+		open[s.Name()] = true
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range ss {
+		wg.Add(1)
+		go func(s sinks.Sink) {
+			defer wg.Done()
+
+			if err := s.Close(); err != nil {
+				log.Errorf("Error closing sink '%s': %s", s.Name(), err)
+			}
+
+			mu.Lock()
+			delete(open, s.Name())
+			mu.Unlock()
+		}(s)
+	}
+
+	if waitDeadline(&wg, deadline) {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(open))
+	for n := range open {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,113 @@
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// fakeSource is an acctSource injecting events through a bpf.FakeProbe.
+type fakeSource struct {
+	*bpf.FakeProbe
+}
+
+func (fakeSource) CPUStats() []bpf.CPUStats          { return nil }
+func (fakeSource) MapStats() ([]bpf.MapStats, error) { return nil, nil }
+
+// batchSink is a sink holding pushed events in a pending batch until it's
+// closed. Closing blocks until release is closed, if set.
+type batchSink struct {
+	healthSink
+	release chan struct{}
+
+	mu      sync.Mutex
+	pending []bpf.Event
+	sent    []bpf.Event
+}
+
+func (s *batchSink) Push(e bpf.Event) {
+	s.mu.Lock()
+	s.pending = append(s.pending, e)
+	s.mu.Unlock()
+}
+
+func (s *batchSink) Close() error {
+	if s.release != nil {
+		<-s.release
+	}
+
+	s.mu.Lock()
+	s.sent, s.pending = append(s.sent, s.pending...), nil
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *batchSink) flushed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sent)
+}
+
+// newShutdownPipeline returns a started Pipeline reading events from a
+// FakeProbe and delivering them to the given sinks.
+func newShutdownPipeline(t *testing.T, ss ...*batchSink) (*Pipeline, *bpf.FakeProbe) {
+	t.Helper()
+
+	fp := bpf.NewFakeProbe()
+	p := New(Config{})
+	require.NoError(t, p.registerSources(fakeSource{fp}))
+	p.acctProbe = fakeSource{fp}
+
+	for _, s := range ss {
+		require.NoError(t, p.RegisterSink(s))
+	}
+	require.NoError(t, p.Start())
+
+	return p, fp
+}
+
+func TestShutdownFlush(t *testing.T) {
+
+	a, b := &batchSink{healthSink: healthSink{name: "a"}}, &batchSink{healthSink: healthSink{name: "b"}}
+	p, fp := newShutdownPipeline(t, a, b)
+
+	for i := uint32(0); i < 100; i++ {
+		fp.Inject(bpf.Event{ConnectionID: i})
+	}
+
+	// Events still queued in the pipeline are delivered,
+	// and the sinks' pending batches sent.
+	require.NoError(t, p.Shutdown(time.Second))
+	assert.Equal(t, 100, a.flushed())
+	assert.Equal(t, 100, b.flushed())
+	assert.Empty(t, p.GetSinks())
+
+	// The probe no longer delivers events.
+	fp.Inject(bpf.Event{ConnectionID: 100})
+	assert.Equal(t, 100, a.flushed())
+}
+
+func TestShutdownTimeout(t *testing.T) {
+
+	fast := &batchSink{healthSink: healthSink{name: "fast"}}
+	slow := &batchSink{healthSink: healthSink{name: "slow"}, release: make(chan struct{})}
+	defer close(slow.release)
+
+	p, fp := newShutdownPipeline(t, fast, slow)
+	fp.Inject(bpf.Event{ConnectionID: 1})
+
+	start := time.Now()
+	err := p.Shutdown(50 * time.Millisecond)
+	assert.EqualError(t, err, "timed out after 50ms closing sinks slow")
+	assert.True(t, time.Since(start) < time.Second, "shutdown exceeded its deadline")
+
+	// Sinks closing in time flushed their batches.
+	assert.Equal(t, 1, fast.flushed())
+	assert.Zero(t, slow.flushed())
+}
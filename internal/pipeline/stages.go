@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// flushInterval is the interval at which stages holding
+// on to events are asked to emit events that are due.
+const flushInterval = time.Second
+
+// process runs an event through the pipeline's stages,
+// delivering the resulting events to the pipeline's sinks.
+func (p *Pipeline) process(e bpf.Event) {
+	p.runStages(0, e)
+}
+
+// runStages runs an event through the pipeline's stages starting at index i.
+// Events emitted by the last stage are delivered to the pipeline's sinks.
+func (p *Pipeline) runStages(i int, e bpf.Event) {
+
+	if i == len(p.config.Stages) {
+		p.fanout(e)
+		return
+	}
+
+	p.config.Stages[i].Process(e, func(e bpf.Event) {
+		p.runStages(i+1, e)
+	})
+}
+
+// fanout delivers an event to all registered sinks interested in its type.
+func (p *Pipeline) fanout(e bpf.Event) {
+
+	p.acctSinkMu.RLock()
+	defer p.acctSinkMu.RUnlock()
+
+	for _, s := range p.acctSinks {
+		if e.Type == bpf.EventDestroy {
+			if s.WantDestroy() {
+				s.Push(e)
+			}
+			continue
+		}
+
+		if s.WantUpdate() || (e.Type == bpf.EventNew && s.WantNew()) {
+			s.Push(e)
+		}
+	}
+}
+
+// flushWorker periodically flushes all stages holding on to events, until
+// the pipeline is stopped. Flushed events are run through all stages
+// following the flushed stage.
+func (p *Pipeline) flushWorker() {
+
+	t := time.NewTicker(flushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-t.C:
+			for i, s := range p.config.Stages {
+				f, ok := s.(stages.Flusher)
+				if !ok {
+					continue
+				}
+
+				next := i + 1
+				f.Flush(now, func(e bpf.Event) {
+					p.runStages(next, e)
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestPipelineFiltered(t *testing.T) {
+
+	p := New(Config{Stages: []stages.Stage{stages.NewZeroBytes()}})
+	require.NoError(t, p.ApplySinkConfig([]types.SinkConfig{
+		{Name: "ring", Type: types.MemRing},
+	}))
+
+	p.process(bpf.Event{ConnectionID: 1, Type: bpf.EventUpdate})
+	p.process(bpf.Event{ConnectionID: 2, Type: bpf.EventUpdate, PacketsOrig: 1, BytesOrig: 31})
+	p.process(bpf.Event{ConnectionID: 3, Type: bpf.EventDestroy})
+
+	// Filtered events never reach the sinks.
+	r, ok := sinks.AsRecorder(p.GetSinks()[0])
+	require.True(t, ok)
+	ev := r.Recent()
+	require.Len(t, ev, 1)
+	assert.EqualValues(t, 2, ev[0].ConnectionID)
+
+	assert.EqualValues(t, 2, p.Stats().EventsFiltered)
+	require.NoError(t, p.ApplySinkConfig(nil))
+}
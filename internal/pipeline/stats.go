@@ -15,6 +15,18 @@ type Stats struct {
 	EventsUpdate  uint64 `json:"events_update"`
 	EventsDestroy uint64 `json:"events_destroy"`
 
+	// amount of events dropped by the pipeline's filter stages
+	EventsFiltered uint64 `json:"events_filtered"`
+
+	// amount of updates dropped since they were raised before
+	// their flow's destroy event, which was already delivered
+	EventsSuperseded uint64 `json:"events_superseded"`
+
+	// writes of the sinks in progress, and writes that waited for
+	// a slot, only if the sinks' concurrent writes are limited
+	SinkWritesInProgress uint64 `json:"sink_writes_in_progress,omitempty"`
+	SinkWriteWaits       uint64 `json:"sink_write_waits,omitempty"`
+
 	UpdateSourceStats  *bpf.ConsumerStats `json:"update_source"`
 	DestroySourceStats *bpf.ConsumerStats `json:"destroy_source"`
 }
@@ -38,6 +50,12 @@ func (s *Stats) IncrEventsDestroy() {
 	s.incrEventsTotal()
 }
 
+// incrEventsSuperseded atomically increases the amount of updates
+// dropped for arriving after their flow's destroy event.
+func (s *Stats) incrEventsSuperseded() {
+	atomic.AddUint64(&s.EventsSuperseded, 1)
+}
+
 // Get returns a copy of the Stats structure created using atomic loads.
 // The values can be inconsistent with each other, as they are written and
 // read concurrently without locks.
@@ -47,6 +65,8 @@ func (s *Stats) Get() Stats {
 		EventsTotal:   atomic.LoadUint64(&s.EventsTotal),
 		EventsUpdate:  atomic.LoadUint64(&s.EventsUpdate),
 		EventsDestroy: atomic.LoadUint64(&s.EventsDestroy),
+
+		EventsSuperseded: atomic.LoadUint64(&s.EventsSuperseded),
 	}
 
 	// Get Update source stats if present.
@@ -0,0 +1,298 @@
+// Package batch implements the batching of events shared by all batching
+// sinks. A Batcher collects events and hands them to the sink in batches,
+// when a batch reaches its size, event count or byte limit or its flush
+// interval passes.
+package batch
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Trigger is the reason a batch was handed to a Batcher's ReadyFunc.
+type Trigger uint8
+
+// Triggers of a batch flush.
+const (
+	// The batch reached Config.Size events, or the capacity of its buffer.
+	TriggerSize Trigger = iota + 1
+	// The estimated size of the batch reached Config.Bytes.
+	TriggerBytes
+	// The batch reached Config.MaxEvents events.
+	TriggerCount
+	// Config.Interval passed since the last flush.
+	TriggerInterval
+	// Flush or Close was called.
+	TriggerFlush
+)
+
+var triggerNames = map[Trigger]string{
+	TriggerSize:     "size",
+	TriggerBytes:    "bytes",
+	TriggerCount:    "count",
+	TriggerInterval: "interval",
+	TriggerFlush:    "flush",
+}
+
+// String returns the name of the Trigger.
+func (t Trigger) String() string {
+	return triggerNames[t]
+}
+
+// Batch is a batch of events handed to a Batcher's ReadyFunc.
+type Batch struct {
+	Events []bpf.Event
+
+	// Estimated size of the events, see Config.SizeOf.
+	Bytes int
+
+	// Time the first event was added to the batch.
+	Started time.Time
+
+	Trigger Trigger
+}
+
+// ReadyFunc is called by a Batcher with every non-empty batch it flushes.
+// The function owns the batch's events until it returns them to the
+// Batcher with Put.
+type ReadyFunc func(Batch)
+
+// Config is the configuration of a Batcher.
+type Config struct {
+	// Flush the batch when it holds this many events. Defaults to
+	// the buffer size of Pool if zero.
+	Size int
+
+	// Flush the batch when the estimated size of its events reaches this
+	// many bytes. Zero means no limit.
+	Bytes int
+
+	// Flush the batch when it holds this many events, regardless of Size and
+	// the buffer size of Pool. Zero means no limit.
+	MaxEvents int
+
+	// Flush a non-empty batch at this interval. The interval restarts when
+	// a batch is flushed for reaching MaxEvents, so a batch following one
+	// flushed by count isn't flushed early. Zero means batches are only
+	// flushed when full, or when Flush or Close is called.
+	Interval time.Duration
+
+	// Estimates the size of an event in bytes. Defaults to EventSize.
+	SizeOf func(bpf.Event) int
+
+	// Pool to draw the buffers of batches from. Buffers are allocated by
+	// the Batcher if nil. Batches are also flushed when their buffer is full.
+	Pool *bufpool.Pool
+}
+
+// EventSize estimates the size of an event by the length of its binary form,
+// plus the length of its text attributes.
+func EventSize(e bpf.Event) int {
+
+	n := bpf.EventLength + len(e.Service)
+	for k, v := range e.Labels {
+		n += len(k) + len(v)
+	}
+
+	return n
+}
+
+// Batcher collects events into batches. All methods are safe for concurrent
+// use. Batches are handed to the Batcher's ReadyFunc with its lock held, so
+// they are received in the order they were filled, and Add blocks while the
+// ReadyFunc runs. The ReadyFunc must not call the Batcher's methods other
+// than Put.
+type Batcher struct {
+	cfg   Config
+	ready ReadyFunc
+
+	mu    sync.Mutex
+	batch Batch
+	// The pool was exhausted when the last batch was flushed.
+	noBuf bool
+
+	// Restarts the interval after a batch was flushed by count.
+	reset chan struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a Batcher handing its batches to ready. If the Config has
+// an Interval, starts a worker flushing the batch at the interval until
+// the Batcher is closed.
+func New(cfg Config, ready ReadyFunc) *Batcher {
+
+	if cfg.Size == 0 && cfg.Pool != nil {
+		cfg.Size = cfg.Pool.BufSize()
+	}
+	if cfg.SizeOf == nil {
+		cfg.SizeOf = EventSize
+	}
+
+	b := &Batcher{
+		cfg:   cfg,
+		ready: ready,
+		reset: make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	b.newBuf()
+
+	if cfg.Interval > 0 {
+		go b.tickWorker()
+	} else {
+		close(b.done)
+	}
+
+	return b
+}
+
+// Add adds an event to the current batch, flushing the batch if it is full.
+// Returns false if the event was not added because no buffer could be drawn
+// from the Batcher's pool.
+func (b *Batcher) Add(e bpf.Event) bool {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Try to draw a new buffer if the pool was exhausted before.
+	if b.noBuf && !b.newBuf() {
+		return false
+	}
+
+	if len(b.batch.Events) == 0 {
+		b.batch.Started = time.Now()
+	}
+	b.batch.Events = append(b.batch.Events, e)
+	if b.cfg.Bytes != 0 {
+		b.batch.Bytes += b.cfg.SizeOf(e)
+	}
+
+	n := len(b.batch.Events)
+	switch {
+	case b.cfg.MaxEvents != 0 && n >= b.cfg.MaxEvents:
+		b.flush(TriggerCount)
+		b.resetInterval()
+	case (b.cfg.Size != 0 && n >= b.cfg.Size) || (b.cfg.Pool != nil && n == cap(b.batch.Events)):
+		b.flush(TriggerSize)
+	case b.cfg.Bytes != 0 && b.batch.Bytes >= b.cfg.Bytes:
+		b.flush(TriggerBytes)
+	}
+
+	return true
+}
+
+// Len returns the amount of events in the current batch.
+func (b *Batcher) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.batch.Events)
+}
+
+// Age returns the time since the first event was added to the current batch,
+// or zero if the batch is empty.
+func (b *Batcher) Age(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.batch.Events) == 0 {
+		return 0
+	}
+	return now.Sub(b.batch.Started)
+}
+
+// Flush hands the current batch to the ReadyFunc, if it is not empty.
+func (b *Batcher) Flush() {
+	b.mu.Lock()
+	b.flush(TriggerFlush)
+	b.mu.Unlock()
+}
+
+// Put returns the events of a batch to the Batcher's pool.
+// No-op if the Batcher has no pool.
+func (b *Batcher) Put(events []bpf.Event) {
+	if b.cfg.Pool != nil {
+		b.cfg.Pool.Put(events)
+	}
+}
+
+// Close stops flushing at the Batcher's interval and flushes the current
+// batch. Events must not be added after Close.
+func (b *Batcher) Close() {
+	close(b.stop)
+	<-b.done
+	b.Flush()
+}
+
+// flush hands the current batch to the ReadyFunc and starts a new batch.
+// No-op if the batch is empty. Must be called with mu held.
+func (b *Batcher) flush(t Trigger) {
+
+	if len(b.batch.Events) == 0 {
+		return
+	}
+
+	b.batch.Trigger = t
+	b.ready(b.batch)
+
+	b.newBuf()
+}
+
+// newBuf starts a new, empty batch, drawing its buffer from the pool if the
+// Batcher has one. Returns false if the pool is exhausted. Must be called with
+// mu held.
+func (b *Batcher) newBuf() bool {
+
+	b.batch = Batch{}
+
+	if b.cfg.Pool == nil {
+		return true
+	}
+
+	b.batch.Events, _ = b.cfg.Pool.Get()
+	b.noBuf = b.batch.Events == nil
+
+	return !b.noBuf
+}
+
+// resetInterval restarts the tickWorker's interval. Never blocks, an
+// interval that's already pending a restart isn't restarted again.
+func (b *Batcher) resetInterval() {
+	select {
+	case b.reset <- struct{}{}:
+	default:
+	}
+}
+
+// tickWorker flushes the current batch every interval, until the Batcher
+// is closed. The interval is restarted by resetInterval.
+func (b *Batcher) tickWorker() {
+
+	defer close(b.done)
+
+	t := time.NewTimer(b.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			b.mu.Lock()
+			b.flush(TriggerInterval)
+			b.mu.Unlock()
+		case <-b.reset:
+			if !t.Stop() {
+				select {
+				case <-t.C:
+				default:
+				}
+			}
+		case <-b.stop:
+			return
+		}
+		t.Reset(b.cfg.Interval)
+	}
+}
@@ -0,0 +1,183 @@
+package batch
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// recorder records the batches handed to its ready method.
+type recorder struct {
+	mu      sync.Mutex
+	batches []Batch
+}
+
+func (r *recorder) ready(b Batch) {
+	r.mu.Lock()
+	r.batches = append(r.batches, b)
+	r.mu.Unlock()
+}
+
+func (r *recorder) get() []Batch {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Batch(nil), r.batches...)
+}
+
+func TestBatcherSize(t *testing.T) {
+
+	var r recorder
+	b := New(Config{Size: 3}, r.ready)
+
+	for i := uint32(1); i <= 7; i++ {
+		require.True(t, b.Add(bpf.Event{ConnectionID: i}))
+	}
+
+	got := r.get()
+	require.Len(t, got, 2)
+	for _, bt := range got {
+		assert.Len(t, bt.Events, 3)
+		assert.Equal(t, TriggerSize, bt.Trigger)
+		assert.False(t, bt.Started.IsZero())
+	}
+	assert.EqualValues(t, 4, got[1].Events[0].ConnectionID)
+	assert.Equal(t, 1, b.Len())
+
+	// Close flushes the remaining event.
+	b.Close()
+	got = r.get()
+	require.Len(t, got, 3)
+	assert.Equal(t, TriggerFlush, got[2].Trigger)
+	assert.EqualValues(t, 7, got[2].Events[0].ConnectionID)
+	assert.Zero(t, b.Len())
+}
+
+func TestBatcherBytes(t *testing.T) {
+
+	var r recorder
+	b := New(Config{Size: 100, Bytes: 3*bpf.EventLength + 10}, r.ready)
+
+	// Labels count towards the size of an event.
+	e := bpf.Event{Labels: map[string]string{"host": "a"}}
+	assert.Equal(t, bpf.EventLength+5, EventSize(e))
+
+	for i := 0; i < 5; i++ {
+		b.Add(e)
+	}
+
+	got := r.get()
+	require.Len(t, got, 1)
+	assert.Len(t, got[0].Events, 3)
+	assert.Equal(t, TriggerBytes, got[0].Trigger)
+	assert.Equal(t, 3*(bpf.EventLength+5), got[0].Bytes)
+
+	// A custom estimate of the event size.
+	var r2 recorder
+	b = New(Config{Size: 100, Bytes: 10, SizeOf: func(bpf.Event) int { return 5 }}, r2.ready)
+	b.Add(e)
+	b.Add(e)
+	require.Len(t, r2.get(), 1)
+	assert.Equal(t, 10, r2.get()[0].Bytes)
+}
+
+func TestBatcherAge(t *testing.T) {
+
+	var r recorder
+	b := New(Config{Size: 2}, r.ready)
+
+	assert.Zero(t, b.Age(time.Now()), "empty batch")
+
+	b.Add(bpf.Event{ConnectionID: 1})
+	assert.True(t, b.Age(time.Now().Add(time.Second)) >= time.Second)
+
+	// A new batch is started once the batch is flushed.
+	b.Add(bpf.Event{ConnectionID: 2})
+	require.Len(t, r.get(), 1)
+	assert.Zero(t, b.Age(time.Now().Add(time.Second)))
+}
+
+func TestBatcherInterval(t *testing.T) {
+
+	var r recorder
+	b := New(Config{Size: 100, Interval: 20 * time.Millisecond}, r.ready)
+	defer b.Close()
+
+	b.Add(bpf.Event{ConnectionID: 1})
+	b.Add(bpf.Event{ConnectionID: 2})
+
+	require.Eventually(t, func() bool { return len(r.get()) == 1 }, time.Second, 5*time.Millisecond)
+	got := r.get()
+	assert.Len(t, got[0].Events, 2)
+	assert.Equal(t, TriggerInterval, got[0].Trigger)
+
+	// Empty batches are not flushed.
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, r.get(), 1)
+}
+
+func TestBatcherMaxEvents(t *testing.T) {
+
+	var r recorder
+	b := New(Config{Size: 100, MaxEvents: 2, Interval: 200 * time.Millisecond}, r.ready)
+	defer b.Close()
+
+	start := time.Now()
+	b.Add(bpf.Event{ConnectionID: 1})
+	time.Sleep(100 * time.Millisecond)
+
+	// Reaching the count flushes the batch without waiting for the interval.
+	b.Add(bpf.Event{ConnectionID: 2})
+	got := r.get()
+	require.Len(t, got, 1)
+	assert.Len(t, got[0].Events, 2)
+	assert.Equal(t, TriggerCount, got[0].Trigger)
+	assert.Equal(t, "count", got[0].Trigger.String())
+
+	// The interval restarted with the count flush, the next batch isn't
+	// flushed when the original interval passes.
+	b.Add(bpf.Event{ConnectionID: 3})
+	time.Sleep(time.Until(start.Add(250 * time.Millisecond)))
+	assert.Len(t, r.get(), 1, "flushed by the original interval")
+
+	require.Eventually(t, func() bool { return len(r.get()) == 2 }, time.Second, 5*time.Millisecond)
+	got = r.get()
+	assert.Equal(t, TriggerInterval, got[1].Trigger)
+	assert.EqualValues(t, 3, got[1].Events[0].ConnectionID)
+
+	// The count applies below the buffer size of a pool.
+	var r2 recorder
+	b = New(Config{Pool: bufpool.New(2, 8), MaxEvents: 3}, r2.ready)
+	for i := 0; i < 4; i++ {
+		b.Add(bpf.Event{})
+	}
+	require.Len(t, r2.get(), 1)
+	assert.Len(t, r2.get()[0].Events, 3)
+}
+
+func TestBatcherPool(t *testing.T) {
+
+	p := bufpool.New(1, 2)
+
+	var held [][]bpf.Event
+	b := New(Config{Pool: p}, func(bt Batch) {
+		held = append(held, bt.Events)
+	})
+
+	// The size defaults to the buffer size of the pool.
+	assert.True(t, b.Add(bpf.Event{}))
+	assert.True(t, b.Add(bpf.Event{}))
+	require.Len(t, held, 1)
+
+	// The pool's only buffer is held by the ready function.
+	assert.False(t, b.Add(bpf.Event{}))
+
+	b.Put(held[0])
+	assert.True(t, b.Add(bpf.Event{}))
+	assert.Equal(t, 1, b.Len())
+}
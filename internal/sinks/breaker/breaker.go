@@ -0,0 +1,172 @@
+// Package breaker implements a circuit breaker, used by network sinks to stop
+// sending to a backing storage that keeps failing, instead of spending time
+// and CPU on every batch only to drop it.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Cooldown of a sink's breaker that doesn't have one configured.
+const DefaultCooldown = 30 * time.Second
+
+// State is the state of a Breaker.
+type State uint32
+
+const (
+	// Requests are attempted. The breaker opens after a number of
+	// consecutive failures.
+	Closed State = iota
+	// Requests are rejected until the breaker's cooldown has passed.
+	Open
+	// A single probe request is attempted after the cooldown. The breaker
+	// closes if it succeeds, and opens for another cooldown if it fails.
+	HalfOpen
+)
+
+func (s State) String() string {
+	switch s {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// A Breaker is a circuit breaker tracking the outcome of requests to a single
+// endpoint. Callers ask the breaker whether to attempt a request with Allow,
+// and report its outcome with Success or Failure. A nil Breaker allows all
+// requests. Safe for concurrent use.
+type Breaker struct {
+	threshold int
+	cooldown  time.Duration
+	onChange  func(State)
+
+	mu       sync.Mutex
+	state    State
+	failures int       // consecutive failures while closed
+	opened   time.Time // time the breaker last opened
+	probing  bool      // a probe request is in flight while half-open
+}
+
+// New returns a closed Breaker opening after threshold consecutive failures,
+// for the given cooldown. onChange is called with every new state of the
+// breaker, with the breaker's lock held. It may be nil.
+func New(threshold int, cooldown time.Duration, onChange func(State)) *Breaker {
+
+	if threshold < 1 {
+		threshold = 1
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCooldown
+	}
+
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		onChange:  onChange,
+	}
+}
+
+// Allow returns whether a request should be attempted. Once the cooldown of
+// an open breaker has passed, the breaker turns half-open and allows a single
+// probe request. Other requests are rejected until the probe's outcome is
+// reported.
+func (b *Breaker) Allow() bool {
+
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Open:
+		if time.Since(b.opened) < b.cooldown {
+			return false
+		}
+		b.setState(HalfOpen)
+		b.probing = true
+		return true
+	case HalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+
+	return true
+}
+
+// Success reports a successful request, closing the breaker.
+func (b *Breaker) Success() {
+
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != Closed {
+		b.setState(Closed)
+	}
+}
+
+// Failure reports a failed request. Opens the breaker if the request was a
+// probe, or after the breaker's threshold of consecutive failures.
+func (b *Breaker) Failure() {
+
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case Closed:
+		b.failures++
+		if b.failures < b.threshold {
+			return
+		}
+	case Open:
+		// Requests allowed before the breaker opened.
+		return
+	}
+
+	b.failures = 0
+	b.probing = false
+	b.opened = time.Now()
+	b.setState(Open)
+}
+
+// State returns the breaker's current state. An open breaker is reported as
+// open until the next call to Allow after its cooldown.
+func (b *Breaker) State() State {
+
+	if b == nil {
+		return Closed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// setState sets the breaker's state. Must be called with mu held.
+func (b *Breaker) setState(s State) {
+	b.state = s
+	if b.onChange != nil {
+		b.onChange(s)
+	}
+}
@@ -0,0 +1,103 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+
+	var states []State
+	b := New(3, 10*time.Millisecond, func(s State) {
+		states = append(states, s)
+	})
+
+	// Closed, failures below the threshold don't open the breaker.
+	assert.Equal(t, Closed, b.State())
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+	}
+	assert.Equal(t, Closed, b.State())
+
+	// A success resets the consecutive failures.
+	assert.True(t, b.Allow())
+	b.Success()
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+	}
+	assert.Equal(t, Closed, b.State())
+
+	// The third consecutive failure opens the breaker.
+	assert.True(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.False(t, b.Allow())
+
+	// Half-open after the cooldown, allowing a single probe.
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+	assert.False(t, b.Allow(), "second request allowed while probing")
+
+	// The probe succeeds, closing the breaker.
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	assert.True(t, b.Allow())
+
+	assert.Equal(t, []State{Open, HalfOpen, Closed}, states)
+}
+
+func TestBreakerProbeFailure(t *testing.T) {
+
+	b := New(1, 10*time.Millisecond, nil)
+
+	assert.True(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+
+	// Failures of requests allowed before the breaker opened are ignored.
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+
+	// A failed probe opens the breaker for another cooldown.
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.False(t, b.Allow())
+
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.Allow())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+}
+
+func TestBreakerDefaults(t *testing.T) {
+
+	b := New(0, 0, nil)
+	assert.Equal(t, 1, b.threshold)
+	assert.Equal(t, DefaultCooldown, b.cooldown)
+
+	assert.Equal(t, "closed", Closed.String())
+	assert.Equal(t, "open", Open.String())
+	assert.Equal(t, "half-open", HalfOpen.String())
+	assert.Equal(t, "unknown", State(42).String())
+}
+
+func TestBreakerNil(t *testing.T) {
+
+	var b *Breaker
+
+	for i := 0; i < 10; i++ {
+		assert.True(t, b.Allow())
+		b.Failure()
+	}
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+}
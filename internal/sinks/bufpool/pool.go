@@ -0,0 +1,79 @@
+// Package bufpool implements a bounded pool of event buffers that
+// batching sinks draw their batches from.
+package bufpool
+
+import (
+	"sync"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Pool is a bounded pool of event buffers. Sharing a Pool between sinks
+// bounds the total amount of memory used for batches by all of them.
+// All methods are safe for concurrent use.
+type Pool struct {
+	// Capacity of each buffer, in events.
+	bufSize int
+	// Maximum amount of buffers allocated by the pool.
+	maxBufs int
+
+	mu    sync.Mutex
+	free  [][]bpf.Event
+	alloc int
+}
+
+// New returns a Pool of up to maxBufs buffers with a capacity
+// of bufSize events each. Buffers are allocated on first use.
+func New(maxBufs, bufSize int) *Pool {
+	return &Pool{
+		bufSize: bufSize,
+		maxBufs: maxBufs,
+	}
+}
+
+// Get returns an empty buffer from the pool. Returns false if all
+// buffers of the pool are in use.
+func (p *Pool) Get() ([]bpf.Event, bool) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n := len(p.free); n > 0 {
+		b := p.free[n-1]
+		p.free[n-1] = nil
+		p.free = p.free[:n-1]
+		return b, true
+	}
+
+	if p.alloc >= p.maxBufs {
+		return nil, false
+	}
+
+	p.alloc++
+
+	return make([]bpf.Event, 0, p.bufSize), true
+}
+
+// Put returns a buffer obtained from Get to the pool.
+func (p *Pool) Put(b []bpf.Event) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.free = append(p.free, b[:0])
+}
+
+// BufSize returns the capacity of the pool's buffers.
+func (p *Pool) BufSize() int {
+	return p.bufSize
+}
+
+// Stats returns the amount of buffers allocated by the pool,
+// and the amount of buffers currently in use.
+func (p *Pool) Stats() (allocated, inUse int) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.alloc, p.alloc - len(p.free)
+}
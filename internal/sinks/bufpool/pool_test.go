@@ -0,0 +1,92 @@
+package bufpool_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestPoolBounded(t *testing.T) {
+
+	p := bufpool.New(2, 4)
+	assert.Equal(t, 4, p.BufSize())
+
+	a, ok := p.Get()
+	require.True(t, ok)
+	assert.Len(t, a, 0)
+	assert.Equal(t, 4, cap(a))
+
+	b, ok := p.Get()
+	require.True(t, ok)
+
+	// All buffers are in use.
+	_, ok = p.Get()
+	assert.False(t, ok)
+
+	alloc, used := p.Stats()
+	assert.Equal(t, 2, alloc)
+	assert.Equal(t, 2, used)
+
+	// A returned buffer is reused, and is empty.
+	a = append(a, bpf.Event{ConnectionID: 1})
+	p.Put(a)
+
+	c, ok := p.Get()
+	require.True(t, ok)
+	assert.Len(t, c, 0)
+	assert.Equal(t, &a[:1][0], &c[:1][0], "buffer was not reused")
+
+	p.Put(b)
+	p.Put(c)
+
+	alloc, used = p.Stats()
+	assert.Equal(t, 2, alloc)
+	assert.Equal(t, 0, used)
+}
+
+const (
+	benchSinks     = 4
+	benchBatchSize = 128
+)
+
+// Batches are handed off to a send worker in sinks, make sure they escape.
+var sent []bpf.Event
+
+// fillBatch fills a batch, simulating a batching sink.
+func fillBatch(b []bpf.Event) []bpf.Event {
+	for i := 0; i < benchBatchSize; i++ {
+		b = append(b, bpf.Event{})
+	}
+	return b
+}
+
+// Allocates a new batch for every flush of every sink, like sinks
+// without a pool do.
+func BenchmarkBatchesUnpooled(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for s := 0; s < benchSinks; s++ {
+			sent = fillBatch(make([]bpf.Event, 0, benchBatchSize))
+		}
+	}
+}
+
+// Draws the batches of all sinks from a single shared pool.
+func BenchmarkBatchesPooled(b *testing.B) {
+	b.ReportAllocs()
+
+	p := bufpool.New(benchSinks, benchBatchSize)
+
+	for i := 0; i < b.N; i++ {
+		for s := 0; s < benchSinks; s++ {
+			batch, _ := p.Get()
+			sent = fillBatch(batch)
+			p.Put(sent)
+		}
+	}
+}
@@ -55,7 +55,17 @@ func (d *Dummy) WantDestroy() bool {
 	return true
 }
 
+// WantNew always returns true.
+func (d *Dummy) WantNew() bool {
+	return true
+}
+
 // Stats returns the Dummy's statistics structure.
 func (d *Dummy) Stats() types.SinkStats {
 	return d.stats.Get()
 }
+
+// Close is a no-op, Dummy does not hold any resources.
+func (d *Dummy) Close() error {
+	return nil
+}
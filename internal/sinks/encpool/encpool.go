@@ -0,0 +1,108 @@
+// Package encpool implements a pool of workers encoding the batches of a
+// sink, shared by sinks of which encoding is CPU-heavy. Batches are encoded
+// concurrently while earlier batches are being sent, and are sent one at a
+// time in the order they were submitted, so encoding and I/O overlap without
+// reordering the sink's output.
+package encpool
+
+import (
+	"sync"
+
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+)
+
+// EncodeFunc encodes a batch into the value handed to the Pool's SendFunc.
+// Called concurrently by the Pool's workers.
+type EncodeFunc func(batch.Batch) interface{}
+
+// SendFunc sends a batch along with its encoded value. Called by a single
+// goroutine, in the order the batches were submitted.
+type SendFunc func(b batch.Batch, enc interface{})
+
+// job is a submitted batch, encoded when ready is closed.
+type job struct {
+	batch batch.Batch
+	enc   interface{}
+	ready chan struct{}
+}
+
+// Pool encodes batches using a fixed amount of workers, and sends them
+// in order from a single goroutine.
+type Pool struct {
+	encode EncodeFunc
+	send   SendFunc
+
+	// Batches waiting for a worker to encode them.
+	jobs chan *job
+	// Batches waiting to be sent, in the order they were submitted.
+	order chan *job
+
+	workers sync.WaitGroup
+	done    chan struct{}
+}
+
+// New returns a Pool encoding batches using the given amount of workers.
+// At most workers batches are encoded at once, and as many encoded batches
+// wait for the batch being sent.
+func New(workers int, encode EncodeFunc, send SendFunc) *Pool {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	p := &Pool{
+		encode: encode,
+		send:   send,
+		jobs:   make(chan *job, workers),
+		order:  make(chan *job, 2*workers),
+		done:   make(chan struct{}),
+	}
+
+	p.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.encodeWorker()
+	}
+	go p.sendWorker()
+
+	return p
+}
+
+// Submit queues a batch to be encoded and sent. Blocks while the Pool holds
+// its maximum amount of batches, applying backpressure to the caller. Must
+// not be called concurrently if batches need to be sent in order, and must
+// not be called after Close.
+func (p *Pool) Submit(b batch.Batch) {
+	j := &job{batch: b, ready: make(chan struct{})}
+	p.order <- j
+	p.jobs <- j
+}
+
+// Close waits for all submitted batches to be encoded and sent,
+// and stops the Pool's workers.
+func (p *Pool) Close() {
+	close(p.jobs)
+	close(p.order)
+	<-p.done
+	p.workers.Wait()
+}
+
+// encodeWorker encodes submitted batches until the Pool is closed.
+func (p *Pool) encodeWorker() {
+	defer p.workers.Done()
+
+	for j := range p.jobs {
+		j.enc = p.encode(j.batch)
+		close(j.ready)
+	}
+}
+
+// sendWorker sends encoded batches in the order they were submitted,
+// until the Pool is closed.
+func (p *Pool) sendWorker() {
+	defer close(p.done)
+
+	for j := range p.order {
+		<-j.ready
+		p.send(j.batch, j.enc)
+	}
+}
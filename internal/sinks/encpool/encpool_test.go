@@ -0,0 +1,114 @@
+package encpool
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// numbered returns a batch holding a single event with the given ID.
+func numbered(id uint32) batch.Batch {
+	return batch.Batch{Events: []bpf.Event{{ConnectionID: id}}}
+}
+
+func TestPoolOrder(t *testing.T) {
+
+	// Encoding takes a random amount of time, so batches
+	// finish encoding out of order.
+	encode := func(b batch.Batch) interface{} {
+		time.Sleep(time.Duration(rand.Intn(1000)) * time.Microsecond)
+		return b.Events[0].ConnectionID * 2
+	}
+
+	var sent []uint32
+	send := func(b batch.Batch, enc interface{}) {
+		assert.Equal(t, b.Events[0].ConnectionID*2, enc.(uint32))
+		sent = append(sent, b.Events[0].ConnectionID)
+	}
+
+	p := New(8, encode, send)
+
+	var want []uint32
+	for i := uint32(0); i < 200; i++ {
+		p.Submit(numbered(i))
+		want = append(want, i)
+	}
+
+	// Close waits for all batches to be sent.
+	p.Close()
+	assert.Equal(t, want, sent)
+}
+
+func TestPoolBackpressure(t *testing.T) {
+
+	release := make(chan struct{})
+	send := func(batch.Batch, interface{}) { <-release }
+	p := New(2, func(batch.Batch) interface{} { return nil }, send)
+
+	// One batch being sent and four more waiting to be sent
+	// fill the pool of two workers.
+	submitted := make(chan struct{})
+	go func() {
+		for i := uint32(0); i < 6; i++ {
+			p.Submit(numbered(i))
+		}
+		close(submitted)
+	}()
+
+	select {
+	case <-submitted:
+		t.Fatal("submit did not block on a full pool")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-submitted
+	p.Close()
+}
+
+// encodeHeavy is a CPU-heavy encoder, hashing every event of the batch
+// many times over.
+func encodeHeavy(b batch.Batch) interface{} {
+	var sum [sha256.Size]byte
+	for range b.Events {
+		for i := 0; i < 100; i++ {
+			sum = sha256.Sum256(sum[:])
+		}
+	}
+	return sum
+}
+
+// BenchmarkPool compares sending batches encoded by a CPU-heavy encoder in
+// the sending goroutine to sending them from a Pool. Sending simulates a
+// write to a remote store taking 500µs.
+func BenchmarkPool(b *testing.B) {
+
+	evs := make([]bpf.Event, 128)
+	bt := batch.Batch{Events: evs}
+	send := func(batch.Batch, interface{}) { time.Sleep(500 * time.Microsecond) }
+
+	b.Run("sequential", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			send(bt, encodeHeavy(bt))
+		}
+	})
+
+	for _, w := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", w), func(b *testing.B) {
+			b.ReportAllocs()
+			p := New(w, encodeHeavy, send)
+			for i := 0; i < b.N; i++ {
+				p.Submit(bt)
+			}
+			p.Close()
+		})
+	}
+}
@@ -1,5 +1,13 @@
 package helpers
 
+import (
+	"net"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/breaker"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+)
+
 // ProtoIntStr is a fast conversion of a protocol number into a string.
 // Only the types known in nf_conntrack_tuple_common.h are included.
 func ProtoIntStr(i uint8) string {
@@ -20,3 +28,31 @@ func ProtoIntStr(i uint8) string {
 
 	return "unknown"
 }
+
+// IsTimeout returns true if err is a network error caused by a timeout,
+// like the errors of requests exceeding a sink's write timeout.
+func IsTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// NewBreaker returns the circuit breaker of a sink, recording its state in the
+// sink's stats and logging its transitions. Returns nil, a breaker allowing
+// all writes, if the sink has no BreakerFailures configured.
+func NewBreaker(sc types.SinkConfig, stats *types.SinkStats) *breaker.Breaker {
+
+	if sc.BreakerFailures == 0 {
+		return nil
+	}
+
+	return breaker.New(sc.BreakerFailures, sc.BreakerCooldown, func(s breaker.State) {
+		stats.SetBreakerState(uint32(s))
+		switch s {
+		case breaker.Open:
+			stats.IncrBreakerTrip()
+			logging.Sink(sc.Name, sc.Type).Warn("Circuit breaker open, dropping writes")
+		case breaker.Closed:
+			logging.Sink(sc.Name, sc.Type).Info("Circuit breaker closed")
+		}
+	})
+}
@@ -2,6 +2,15 @@ package influxdb
 
 import "errors"
 
+const (
+	errFmtUnknownAttr = "unknown tag or field '%s'"
+	errFmtCounterTag  = "counter '%s' can only be sent as a field"
+	errFmtDupAttr     = "'%s' cannot be both a tag and a field"
+
+	errFmtUnknownProto  = "unknown protocol '%s', expected 'udp' or 'http'"
+	errFmtProtoConflict = "protocol '%s' conflicts with sink type %s"
+)
+
 var (
 	errEmptySinkName     = errors.New("empty sink name")
 	errEmptySinkAddress  = errors.New("empty sink address")
@@ -1,20 +1,27 @@
 package influxdb
 
 import (
-	"strconv"
-	"sync"
 	"time"
 
 	influx "github.com/influxdata/influxdb/client/v2"
 
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/internal/sinks/breaker"
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
 	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/internal/sinks/spool"
 	"github.com/ti-mo/conntracct/internal/sinks/types"
-	"github.com/ti-mo/conntracct/pkg/boottime"
 	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
 const (
 	defaultBatchSize = 128
+
+	// Interval at which batches are flushed if not full.
+	defaultFlushInterval = time.Second
+
+	// Amount of batches queued for the send worker.
+	sendQueueLength = 64
 )
 
 // InfluxSink is an accounting sink implementing an InfluxDB client.
@@ -26,18 +33,29 @@ type InfluxSink struct {
 	// Sink's configuration object.
 	config types.SinkConfig
 
-	// Boot time of the machine. (estimated)
-	bootTime time.Time
-
 	// Influx driver client handle.
 	client influx.Client
 
-	// Channel the network workers receive influx batches on.
-	sendChan chan influx.BatchPoints
+	// Measurement, tags and fields of the points sent to InfluxDB.
+	layout pointLayout
+
+	// Pool the sink draws its event batches from.
+	pool *bufpool.Pool
+
+	// Spool of batches that failed to send, nil if the sink has no SpoolDir.
+	spool *spool.Spool
+
+	// Circuit breaker of the sink's writes, nil if the sink has none.
+	breaker *breaker.Breaker
+
+	// Collects pushed events into batches drawn from the pool.
+	batcher *batch.Batcher
+
+	// Channel the network workers receive event batches on.
+	sendChan chan []bpf.Event
 
-	// Data point batch.
-	batchMu sync.Mutex
-	batch   influx.BatchPoints
+	// Closed by the send worker when it has written all pending batches.
+	done chan struct{}
 
 	// Sink stats.
 	stats types.SinkStats
@@ -61,70 +79,70 @@ func (s *InfluxSink) Init(sc types.SinkConfig) error {
 	if sc.BatchSize == 0 {
 		sc.BatchSize = defaultBatchSize
 	}
+	if sc.MaxBatchPoints != 0 && sc.BatchSize > sc.MaxBatchPoints {
+		sc.BatchSize = sc.MaxBatchPoints
+	}
+	if sc.FlushInterval == 0 {
+		sc.FlushInterval = defaultFlushInterval
+	}
+	sc.WriteTimeout = sc.GetWriteTimeout()
+	if sc.SpoolRetryInterval == 0 {
+		sc.SpoolRetryInterval = spool.DefaultRetryInterval
+	}
 
-	var c influx.Client
-	var err error
-
-	switch sc.Type {
-	case types.InfluxUDP:
-		// Construct InfluxDB UDP configuration and client.
-		conf := influx.UDPConfig{
-			Addr:        sc.Address,
-			PayloadSize: int(sc.UDPPayloadSize),
-		}
-
-		c, err = influx.NewUDPClient(conf)
-		if err != nil {
-			return err
-		}
-	case types.InfluxHTTP:
-
-		// HTTP client needs a database name to write to.
-		if sc.Database == "" {
-			return errEmptySinkDatabase
-		}
-
-		// Construct InfluxDB HTTP configuration and client.
-		conf := influx.HTTPConfig{
-			Addr:     sc.Address,
-			Username: sc.Username,
-			Password: sc.Password,
-			Timeout:  sc.Timeout,
-		}
+	pl, err := newPointLayout(sc)
+	if err != nil {
+		return err
+	}
 
-		c, err = influx.NewHTTPClient(conf)
-		if err != nil {
-			return err
-		}
+	proto, err := sinkProtocol(sc)
+	if err != nil {
+		return err
+	}
 
-		// Check if the server is up, waiting for a leader for up to 10s.
-		if _, _, err := c.Ping(time.Second * 10); err != nil {
-			return err
-		}
+	sp, err := spool.FromConfig(sc)
+	if err != nil {
+		return err
+	}
+	if sp != nil {
+		s.stats.SetSpoolDepth(sp.Len())
+	}
 
-		// Ensure the database with the given name is created.
-		q := influx.NewQuery("CREATE DATABASE "+sc.Database, "", "")
-		if r, err := c.Query(q); err != nil {
-			return err
-		} else if r.Error() != nil {
-			return r.Error()
-		}
-	default:
-		return errInvalidSinkType
+	// Batching and workers are shared, only the client's transport differs.
+	c, err := newClient(proto, sc)
+	if err != nil {
+		return err
 	}
 
-	// Estimate the machine's boot time, for absolute event timestamps.
-	s.bootTime = boottime.Estimate()
+	// Draw batches from the shared pool if given, otherwise allocate
+	// enough buffers to fill the send queue.
+	s.pool = sc.BufferPool
+	if s.pool == nil {
+		s.pool = bufpool.New(sendQueueLength+2, int(sc.BatchSize))
+	}
 
 	// Make a buffered channel for sendworkers.
-	s.sendChan = make(chan influx.BatchPoints, 64)
+	s.sendChan = make(chan []bpf.Event, sendQueueLength)
+	s.done = make(chan struct{})
 
 	s.client = c  // client handle
 	s.config = sc // config
-	s.newBatch()  // initial empty batch
+	s.layout = pl // point layout
+	s.spool = sp  // spool, if any
+
+	s.breaker = helpers.NewBreaker(sc, &s.stats)
+
+	// Flush the batch when the watermark (at most MaxBatchPoints)
+	// or the buffer's capacity is reached.
+	s.batcher = batch.New(batch.Config{
+		Size:      int(sc.BatchSize),
+		MaxEvents: int(sc.MaxBatchEvents),
+		Bytes:     sc.BatchBytes,
+		Interval:  sc.FlushInterval,
+		Pool:      s.pool,
+	}, s.batchReady)
 
 	go s.sendWorker()
-	go s.tickWorker()
 
 	// Mark the sink as initialized.
 	s.init = true
@@ -133,62 +151,25 @@ func (s *InfluxSink) Init(sc types.SinkConfig) error {
 }
 
 // Push an accounting event into the buffer of the InfluxDB accounting sink.
-// Adds data points to the InfluxDB client buffer in a thread-safe manner.
+// Adds the event to the sink's batch in a thread-safe manner. The event is
+// dropped if no batch could be drawn from the sink's buffer pool.
 func (s *InfluxSink) Push(e bpf.Event) {
 
-	// Create a point and add to batch.
-	tags := map[string]string{
-		"conn_id":  strconv.FormatUint(uint64(e.ConnectionID), 10),
-		"src_addr": e.SrcAddr.String(),
-		"dst_addr": e.DstAddr.String(),
-		"dst_port": strconv.FormatUint(uint64(e.DstPort), 10),
-		"proto":    helpers.ProtoIntStr(e.Proto),
-		"connmark": strconv.FormatUint(uint64(e.Connmark), 16),
-		"netns":    strconv.FormatUint(uint64(e.NetNS), 10),
-	}
-
-	// Optionally set flows' source ports (since they're random in most cases)
-	if s.config.EnableSrcPort {
-		tags["src_port"] = strconv.FormatUint(uint64(e.SrcPort), 10)
-	}
-
-	// https://github.com/influxdata/influxdb/issues/7801
-	// The InfluxDB wire protocol and Go client supports uints and will mark them as such,
-	// though the current version (1.6) has this behind a build flag as it's not yet
-	// generally available. Only send signed ints for now until this is more widely deployed.
-	fields := map[string]interface{}{
-		"bytes_orig":   int64(e.BytesOrig),
-		"bytes_ret":    int64(e.BytesRet),
-		"packets_orig": int64(e.PacketsOrig),
-		"packets_ret":  int64(e.PacketsRet),
+	// Use the time the event was captured in the kernel, unless configured
+	// to use the time the event was pushed into the sink.
+	if s.config.PushTimestamps {
+		e.Time = time.Now()
 	}
 
-	// To obtain the absolute time stamp of an event in kernel space,
-	// we add its (monotonic) time stamp to the estimated boot time of the kernel.
-	ts := s.bootTime.Add(time.Duration(e.Timestamp))
-
-	pt, err := influx.NewPoint("ct_acct", tags, fields, ts)
-	if err != nil {
-		panic(err.Error())
+	if !s.batcher.Add(e) {
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+		return
 	}
 
-	// Add the point to the batch.
-	s.batchMu.Lock()
-	s.batch.AddPoint(pt)
-
-	batchLen := len(s.batch.Points())
-
 	// Record statistics.
-	s.stats.SetBatchLength(batchLen)
+	s.stats.SetBatchLength(s.batcher.Len())
 	s.stats.IncrEventsPushed()
-
-	// Flush the batch when the watermark is reached.
-	if batchLen >= int(s.config.BatchSize) {
-		s.sendChan <- s.batch
-		s.newBatch()
-	}
-
-	s.batchMu.Unlock()
 }
 
 // Name gets the name of the InfluxDB accounting sink.
@@ -211,23 +192,59 @@ func (s *InfluxSink) WantDestroy() bool {
 	return true
 }
 
+// WantNew returns false, InfluxDB receives new flows as update events.
+func (s *InfluxSink) WantNew() bool {
+	return false
+}
+
 // Stats returns the InfluxDB accounting sink's statistics structure.
 func (s *InfluxSink) Stats() types.SinkStats {
 	return s.stats.Get()
 }
 
-// newBatch writes a new InfluxDB client batch to the sink.
-func (s *InfluxSink) newBatch() {
+// QueueStats returns the amount of batches queued for the send worker, and
+// the age of the sink's current batch.
+func (s *InfluxSink) QueueStats() types.QueueStats {
+	return types.QueueStats{
+		Length:   len(s.sendChan),
+		Capacity: cap(s.sendChan),
+		BatchAge: s.batcher.Age(time.Now()),
+	}
+}
+
+// Close flushes the active batch, waits for all pending batches
+// to be written, and closes the InfluxDB client.
+func (s *InfluxSink) Close() error {
+	s.batcher.Close()
+	close(s.sendChan)
+	<-s.done
+	return s.client.Close()
+}
+
+// batchReady queues a full batch for the send worker.
+func (s *InfluxSink) batchReady(b batch.Batch) {
+	s.sendChan <- b.Events
+	s.stats.SetBatchLength(0)
+}
 
-	b, err := influx.NewBatchPoints(influx.BatchPointsConfig{
+// batchPoints converts a batch of events into InfluxDB points.
+func (s *InfluxSink) batchPoints(events []bpf.Event) (influx.BatchPoints, error) {
+
+	bp, err := influx.NewBatchPoints(influx.BatchPointsConfig{
 		Precision: "ns", // nanosecond precision timestamps
 		Database:  s.config.Database,
 	})
-
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	s.batch = b
-	s.stats.SetBatchLength(0)
+	for i := range events {
+		pt, err := s.layout.newPoint(&events[i], events[i].Time)
+		if err != nil {
+			return nil, err
+		}
+		bp.AddPoint(pt)
+	}
+
+	return bp, nil
 }
@@ -0,0 +1,586 @@
+package influxdb
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// newUDPSink returns an InfluxDB UDP sink writing to a local listener.
+func newUDPSink(t *testing.T, name string, pool *bufpool.Pool) *InfluxSink {
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:       name,
+		Type:       types.InfluxUDP,
+		Address:    l.LocalAddr().String(),
+		BatchSize:  2,
+		BufferPool: pool,
+	}))
+
+	return &s
+}
+
+func TestInfluxSinkSharedPool(t *testing.T) {
+
+	// A single buffer shared by two sinks. The first sink draws
+	// the buffer for its initial batch at Init.
+	pool := bufpool.New(1, 2)
+	a := newUDPSink(t, "a", pool)
+	b := newUDPSink(t, "b", pool)
+
+	// The second sink drops events while the pool is exhausted.
+	b.Push(testEvent)
+	assert.EqualValues(t, 1, b.Stats().EventsDropped)
+
+	// Filling the first sink's batch sends it, returning
+	// the buffer to the pool.
+	a.Push(testEvent)
+	a.Push(testEvent)
+
+	deadline := time.Now().Add(time.Second)
+	for b.Stats().EventsPushed == 0 {
+		require.True(t, time.Now().Before(deadline), "buffer not returned to pool")
+		time.Sleep(time.Millisecond)
+		b.Push(testEvent)
+	}
+
+	assert.EqualValues(t, 2, a.Stats().EventsPushed)
+	assert.EqualValues(t, 1, a.Stats().BatchesSent)
+
+	alloc, _ := pool.Stats()
+	assert.Equal(t, 1, alloc, "pool allocated more than its bound")
+
+	require.NoError(t, a.Close())
+	require.NoError(t, b.Close())
+}
+
+func TestSinkProtocol(t *testing.T) {
+
+	tests := []struct {
+		typ   types.SinkType
+		proto string
+		addr  string
+		want  string
+		err   bool
+	}{
+		{typ: types.InfluxUDP, want: protoUDP},
+		{typ: types.InfluxHTTP, want: protoHTTP},
+		{typ: types.InfluxUDP, proto: protoUDP, want: protoUDP},
+		{typ: types.InfluxHTTP, proto: protoUDP, err: true},
+		{typ: types.InfluxDB, proto: protoHTTP, want: protoHTTP},
+		{typ: types.InfluxDB, addr: "localhost:8089", want: protoUDP},
+		{typ: types.InfluxDB, addr: "http://localhost:8086", want: protoHTTP},
+		{typ: types.InfluxDB, addr: "https://localhost:8086", want: protoHTTP},
+		{typ: types.InfluxDB, proto: "tcp", err: true},
+		{typ: types.Redis, err: true},
+	}
+
+	for _, tt := range tests {
+		p, err := sinkProtocol(types.SinkConfig{Type: tt.typ, Protocol: tt.proto, Address: tt.addr})
+		if tt.err {
+			assert.Error(t, err, tt)
+			continue
+		}
+		require.NoError(t, err, tt)
+		assert.Equal(t, tt.want, p, tt)
+	}
+}
+
+// Sends an event through the unified sink over both transports,
+// and checks the line protocol received by the server.
+func TestInfluxSinkTransports(t *testing.T) {
+
+	// UDP server.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	udpLines := make(chan string, 1)
+	go func() {
+		b := make([]byte, 1024)
+		n, _, err := l.ReadFrom(b)
+		if err == nil {
+			udpLines <- string(b[:n])
+		}
+	}()
+
+	// HTTP server, answering pings and queries, and receiving writes.
+	httpLines := make(chan string, 1)
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		case "/write":
+			b, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, "conntracct", r.URL.Query().Get("db"))
+			httpLines <- string(b)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer hs.Close()
+
+	tests := []struct {
+		name  string
+		cfg   types.SinkConfig
+		lines chan string
+	}{
+		{"udp", types.SinkConfig{Protocol: protoUDP, Address: l.LocalAddr().String()}, udpLines},
+		{"http", types.SinkConfig{Protocol: protoHTTP, Address: hs.URL, Database: "conntracct"}, httpLines},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.Name = tt.name
+			tt.cfg.Type = types.InfluxDB
+			tt.cfg.BatchSize = 1
+
+			s := New()
+			require.NoError(t, s.Init(tt.cfg))
+
+			s.Push(testEvent)
+
+			select {
+			case line := <-tt.lines:
+				assert.True(t, strings.HasPrefix(line, "ct_acct,"), line)
+				assert.Contains(t, line, "conn_id=42")
+				assert.Contains(t, line, "bytes_orig=31i")
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for batch")
+			}
+
+			require.NoError(t, s.Close())
+			assert.EqualValues(t, 1, s.Stats().BatchesSent)
+		})
+	}
+}
+
+func TestInfluxSinkMaxBatchPoints(t *testing.T) {
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:           "max",
+		Type:           types.InfluxDB,
+		Address:        l.LocalAddr().String(),
+		BatchSize:      1000,
+		MaxBatchPoints: 3,
+		UDPPayloadSize: 4096, // fit the batch in a single datagram
+	}))
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		s.Push(testEvent)
+	}
+
+	// The first three points are written without waiting for the
+	// ticker, the fourth starts a new batch.
+	b := make([]byte, 4096)
+	require.NoError(t, l.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	n, _, err := l.ReadFrom(b)
+	require.NoError(t, err, "no early flush")
+	assert.True(t, time.Since(start) < time.Second, "flushed by ticker")
+	assert.Equal(t, 3, strings.Count(string(b[:n]), "ct_acct,"))
+	assert.EqualValues(t, 1, s.Stats().BatchLength)
+
+	require.NoError(t, s.Close())
+	assert.EqualValues(t, 2, s.Stats().BatchesSent)
+}
+
+func TestInfluxSinkMaxBatchEvents(t *testing.T) {
+
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:           "count",
+		Type:           types.InfluxDB,
+		Address:        l.LocalAddr().String(),
+		BatchSize:      1000,
+		MaxBatchEvents: 2,
+		FlushInterval:  time.Hour,
+		UDPPayloadSize: 4096,
+	}))
+
+	for i := 0; i < 3; i++ {
+		s.Push(testEvent)
+	}
+
+	// Two points are written long before the flush interval passes.
+	b := make([]byte, 4096)
+	require.NoError(t, l.SetReadDeadline(time.Now().Add(500*time.Millisecond)))
+	n, _, err := l.ReadFrom(b)
+	require.NoError(t, err, "no flush by count")
+	assert.Equal(t, 2, strings.Count(string(b[:n]), "ct_acct,"))
+	assert.EqualValues(t, 1, s.Stats().BatchLength)
+
+	require.NoError(t, s.Close())
+	assert.EqualValues(t, 2, s.Stats().BatchesSent)
+}
+
+func TestInfluxSinkOnDrop(t *testing.T) {
+
+	// HTTP server rejecting all writes.
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			http.Error(w, `{"error":"rejected"}`, http.StatusInternalServerError)
+		}
+	}))
+	defer hs.Close()
+
+	// Record the entries logged by the sink.
+	hook := logtest.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	var mu sync.Mutex
+	var dropped []bpf.Event
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:      "fail",
+		Type:      types.InfluxDB,
+		Address:   hs.URL,
+		Database:  "conntracct",
+		BatchSize: 2,
+		OnDrop: func(evs []bpf.Event) {
+			mu.Lock()
+			dropped = append(dropped, evs...)
+			mu.Unlock()
+		},
+	}))
+
+	// Two full batches and a partial one, flushed by Close.
+	for i := uint32(1); i <= 5; i++ {
+		e := testEvent
+		e.ConnectionID = i
+		s.Push(e)
+	}
+	require.NoError(t, s.Close())
+
+	assert.EqualValues(t, 3, s.Stats().BatchesDropped)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Len(t, dropped, 5)
+	for i, e := range dropped {
+		assert.EqualValues(t, i+1, e.ConnectionID)
+	}
+
+	// Write errors are logged with the sink's fields.
+	e := hook.LastEntry()
+	require.NotNil(t, e)
+	assert.Equal(t, log.ErrorLevel, e.Level)
+	assert.Equal(t, "Error writing batch, batch dropped", e.Message)
+	assert.Equal(t, logging.ComponentSink, e.Data[logging.FieldComponent])
+	assert.Equal(t, "fail", e.Data[logging.FieldSink])
+	assert.Equal(t, types.InfluxDB.String(), e.Data[logging.FieldSinkType])
+	assert.Contains(t, e.Data, log.ErrorKey)
+}
+
+func TestInfluxSinkSpool(t *testing.T) {
+
+	// HTTP server rejecting writes until it is told to accept them.
+	var mu sync.Mutex
+	var accept bool
+	var written []string
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			mu.Lock()
+			defer mu.Unlock()
+			if !accept {
+				http.Error(w, `{"error":"rejected"}`, http.StatusInternalServerError)
+				return
+			}
+			b, _ := ioutil.ReadAll(r.Body)
+			written = append(written, string(b))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer hs.Close()
+
+	dir, err := ioutil.TempDir("", "conntracct-influx-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:               "spool",
+		Type:               types.InfluxDB,
+		Address:            hs.URL,
+		Database:           "conntracct",
+		BatchSize:          2,
+		SpoolDir:           dir,
+		SpoolRetryInterval: 50 * time.Millisecond,
+	}))
+
+	e := testEvent
+	s.Push(e)
+	s.Push(e)
+
+	waitStats(t, &s, func(st types.SinkStats) bool { return st.BatchesSpooled == 1 })
+	assert.Zero(t, s.Stats().BatchesDropped)
+
+	mu.Lock()
+	accept = true
+	mu.Unlock()
+
+	waitStats(t, &s, func(st types.SinkStats) bool { return st.BatchesReplayed == 1 })
+	assert.Zero(t, s.Stats().SpoolDepth)
+	require.NoError(t, s.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, written, 1)
+	assert.Equal(t, 2, strings.Count(written[0], "\n"))
+}
+
+func TestInfluxSinkBreaker(t *testing.T) {
+
+	// HTTP server rejecting writes until it is told to accept them.
+	var mu sync.Mutex
+	var accept bool
+	var writes int
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			mu.Lock()
+			defer mu.Unlock()
+			writes++
+			if !accept {
+				http.Error(w, `{"error":"rejected"}`, http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer hs.Close()
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:            "breaker",
+		Type:            types.InfluxDB,
+		Address:         hs.URL,
+		Database:        "conntracct",
+		BatchSize:       2,
+		BreakerFailures: 2,
+		BreakerCooldown: 50 * time.Millisecond,
+	}))
+
+	// Four batches, the last two are dropped by the open breaker.
+	for i := uint32(1); i <= 8; i++ {
+		e := testEvent
+		e.ConnectionID = i
+		s.Push(e)
+	}
+
+	waitStats(t, &s, func(st types.SinkStats) bool { return st.BatchesDropped == 4 })
+	st := s.Stats()
+	assert.EqualValues(t, 1, st.BreakerState)
+	assert.EqualValues(t, 1, st.BreakerTrips)
+
+	mu.Lock()
+	assert.Equal(t, 2, writes)
+	accept = true
+	mu.Unlock()
+
+	// The probe after the cooldown succeeds and closes the breaker.
+	time.Sleep(60 * time.Millisecond)
+	s.Push(testEvent)
+	s.Push(testEvent)
+
+	waitStats(t, &s, func(st types.SinkStats) bool { return st.BatchesSent == 1 })
+	st = s.Stats()
+	assert.EqualValues(t, 0, st.BreakerState)
+	assert.EqualValues(t, 1, st.BreakerTrips)
+	require.NoError(t, s.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, writes)
+}
+
+// waitStats polls the sink's stats until f returns true, failing
+// the test after one second.
+func waitStats(t *testing.T, s *InfluxSink, f func(types.SinkStats) bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if f(s.Stats()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for sink stats")
+}
+
+func TestInfluxSinkWriteTimeout(t *testing.T) {
+
+	// HTTP server hanging on writes until the test is done.
+	release := make(chan struct{})
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			<-release
+		}
+	}))
+	defer hs.Close()
+	defer close(release)
+
+	var mu sync.Mutex
+	var dropped int
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:         "slow",
+		Type:         types.InfluxDB,
+		Address:      hs.URL,
+		Database:     "conntracct",
+		BatchSize:    2,
+		WriteTimeout: 50 * time.Millisecond,
+		OnDrop: func(evs []bpf.Event) {
+			mu.Lock()
+			dropped += len(evs)
+			mu.Unlock()
+		},
+	}))
+
+	start := time.Now()
+	s.Push(testEvent)
+	s.Push(testEvent)
+	require.NoError(t, s.Close())
+
+	// The batch is dropped after the timeout instead of blocking the sink.
+	assert.True(t, time.Since(start) < time.Second, "write not timed out")
+	st := s.Stats()
+	assert.EqualValues(t, 1, st.BatchesTimedOut)
+	assert.EqualValues(t, 1, st.BatchesDropped)
+	assert.Zero(t, st.BatchesSent)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, dropped)
+}
+
+func TestInfluxSinkDefaultWriteTimeout(t *testing.T) {
+
+	s := newUDPSink(t, "default", nil)
+	assert.Equal(t, types.DefaultWriteTimeout, s.config.WriteTimeout)
+	require.NoError(t, s.Close())
+
+	// The deprecated timeout option is used if no write timeout is given.
+	sc := types.SinkConfig{Timeout: time.Second}
+	assert.Equal(t, time.Second, sc.GetWriteTimeout())
+	sc.WriteTimeout = 2 * time.Second
+	assert.Equal(t, 2*time.Second, sc.GetWriteTimeout())
+}
+
+func TestInfluxSinkQueueStats(t *testing.T) {
+
+	// HTTP server hanging on writes until released.
+	release := make(chan struct{})
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			w.WriteHeader(http.StatusNoContent)
+		case "/query":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+		default:
+			<-release
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer hs.Close()
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:      "queued",
+		Type:      types.InfluxDB,
+		Address:   hs.URL,
+		Database:  "conntracct",
+		BatchSize: 2,
+	}))
+
+	q := s.QueueStats()
+	assert.Zero(t, q.Length)
+	assert.Equal(t, sendQueueLength, q.Capacity)
+	assert.Zero(t, q.BatchAge)
+
+	// The first batch is being written, the second one is queued.
+	for i := 0; i < 4; i++ {
+		s.Push(testEvent)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for s.QueueStats().Length != 1 {
+		require.True(t, time.Now().Before(deadline), "batch not queued")
+		time.Sleep(time.Millisecond)
+	}
+
+	// An event in the current batch ages it.
+	s.Push(testEvent)
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, s.QueueStats().BatchAge >= 10*time.Millisecond)
+
+	close(release)
+	require.NoError(t, s.Close())
+
+	q = s.QueueStats()
+	assert.Zero(t, q.Length)
+	assert.Zero(t, q.BatchAge)
+}
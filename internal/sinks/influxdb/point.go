@@ -0,0 +1,295 @@
+package influxdb
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	defaultMeasurement = "ct_acct"
+
+	// Tag holding bpf.SchemaVersion, added to every point.
+	schemaVersionTag = "schema_version"
+)
+
+var (
+	// Value of the schema version tag.
+	schemaVersion = strconv.Itoa(bpf.SchemaVersion)
+
+	// Attributes sent as tags when the sink's configuration doesn't specify any.
+	// src_port is added when the sink has EnableSrcPort set.
+	defaultTags = []string{"conn_id", "src_addr", "dst_addr", "dst_port", "proto", "connmark", "netns"}
+
+	// Attributes sent as fields when the sink's configuration doesn't specify any.
+	defaultFields = []string{"bytes_orig", "bytes_ret", "packets_orig", "packets_ret"}
+)
+
+// attribute is a property of an accounting event that can be sent
+// to InfluxDB as a tag or as a field.
+type attribute struct {
+	// Value of the attribute when sent as a tag.
+	tag func(e *bpf.Event) string
+	// Value of the attribute when sent as a field.
+	field func(e *bpf.Event) interface{}
+	// Attribute can only be sent as a field.
+	counter bool
+}
+
+// deltaField returns the value of a delta counter of an event as a field,
+// or nil if the event has no delta counters.
+func deltaField(f func(d *bpf.Counters) uint64) func(e *bpf.Event) interface{} {
+	return func(e *bpf.Event) interface{} {
+		if e.Delta == nil {
+			return nil
+		}
+		return int64(f(e.Delta))
+	}
+}
+
+// hostField returns the value of a host direction counter of an event as a
+// field, or nil if the event is forwarded and the counter unset.
+func hostField(f func(e *bpf.Event) uint64) func(e *bpf.Event) interface{} {
+	return func(e *bpf.Event) interface{} {
+		if e.Forwarded {
+			return nil
+		}
+		return int64(f(e))
+	}
+}
+
+// macField returns an Ethernet address of an event as a field,
+// or nil if the event has none.
+func macField(f func(e *bpf.Event) bpf.MAC) func(e *bpf.Event) interface{} {
+	return func(e *bpf.Event) interface{} {
+		if m := f(e); m != nil {
+			return m.String()
+		}
+		return nil
+	}
+}
+
+// https://github.com/influxdata/influxdb/issues/7801
+// The InfluxDB wire protocol and Go client supports uints and will mark them as such,
+// though the current version (1.6) has this behind a build flag as it's not yet
+// generally available. Only send signed ints for now until this is more widely deployed.
+var attributes = map[string]attribute{
+	"conn_id": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatUint(uint64(e.ConnectionID), 10) },
+		field: func(e *bpf.Event) interface{} { return int64(e.ConnectionID) },
+	},
+	"src_addr": {
+		tag:   func(e *bpf.Event) string { return e.SrcAddr.String() },
+		field: func(e *bpf.Event) interface{} { return e.SrcAddr.String() },
+	},
+	"dst_addr": {
+		tag:   func(e *bpf.Event) string { return e.DstAddr.String() },
+		field: func(e *bpf.Event) interface{} { return e.DstAddr.String() },
+	},
+	"src_port": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatUint(uint64(e.SrcPort), 10) },
+		field: func(e *bpf.Event) interface{} { return int64(e.SrcPort) },
+	},
+	"dst_port": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatUint(uint64(e.DstPort), 10) },
+		field: func(e *bpf.Event) interface{} { return int64(e.DstPort) },
+	},
+	"proto": {
+		tag:   func(e *bpf.Event) string { return helpers.ProtoIntStr(e.Proto) },
+		field: func(e *bpf.Event) interface{} { return helpers.ProtoIntStr(e.Proto) },
+	},
+	"src_mac": {
+		tag:   func(e *bpf.Event) string { return e.SrcMAC.String() },
+		field: macField(func(e *bpf.Event) bpf.MAC { return e.SrcMAC }),
+	},
+	"dst_mac": {
+		tag:   func(e *bpf.Event) string { return e.DstMAC.String() },
+		field: macField(func(e *bpf.Event) bpf.MAC { return e.DstMAC }),
+	},
+	"connmark": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatUint(uint64(e.Connmark), 16) },
+		field: func(e *bpf.Event) interface{} { return int64(e.Connmark) },
+	},
+	"service": {
+		tag:   func(e *bpf.Event) string { return e.Service },
+		field: func(e *bpf.Event) interface{} { return e.Service },
+	},
+	"forwarded": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatBool(e.Forwarded) },
+		field: func(e *bpf.Event) interface{} { return e.Forwarded },
+	},
+	"netns": {
+		tag:   func(e *bpf.Event) string { return strconv.FormatUint(uint64(e.NetNS), 10) },
+		field: func(e *bpf.Event) interface{} { return int64(e.NetNS) },
+	},
+	"bytes_orig": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.BytesOrig) },
+		counter: true,
+	},
+	"bytes_ret": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.BytesRet) },
+		counter: true,
+	},
+	"bytes_orig_adjusted": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.BytesOrigAdjusted) },
+		counter: true,
+	},
+	"bytes_ret_adjusted": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.BytesRetAdjusted) },
+		counter: true,
+	},
+	"bytes_in": {
+		field:   hostField(func(e *bpf.Event) uint64 { return e.BytesIn }),
+		counter: true,
+	},
+	"bytes_out": {
+		field:   hostField(func(e *bpf.Event) uint64 { return e.BytesOut }),
+		counter: true,
+	},
+	"packets_orig": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.PacketsOrig) },
+		counter: true,
+	},
+	"packets_ret": {
+		field:   func(e *bpf.Event) interface{} { return int64(e.PacketsRet) },
+		counter: true,
+	},
+	"bytes_orig_delta": {
+		field:   deltaField(func(d *bpf.Counters) uint64 { return d.BytesOrig }),
+		counter: true,
+	},
+	"bytes_ret_delta": {
+		field:   deltaField(func(d *bpf.Counters) uint64 { return d.BytesRet }),
+		counter: true,
+	},
+	"packets_orig_delta": {
+		field:   deltaField(func(d *bpf.Counters) uint64 { return d.PacketsOrig }),
+		counter: true,
+	},
+	"packets_ret_delta": {
+		field:   deltaField(func(d *bpf.Counters) uint64 { return d.PacketsRet }),
+		counter: true,
+	},
+}
+
+// pointLayout describes how accounting events are converted to InfluxDB points.
+type pointLayout struct {
+	measurement string
+	tags        map[string]attribute
+	fields      map[string]attribute
+}
+
+// newPointLayout validates the measurement name and the tags and fields of
+// the given SinkConfig, and returns the pointLayout described by it.
+func newPointLayout(sc types.SinkConfig) (pointLayout, error) {
+
+	pl := pointLayout{
+		measurement: sc.Measurement,
+		tags:        make(map[string]attribute),
+		fields:      make(map[string]attribute),
+	}
+
+	if pl.measurement == "" {
+		pl.measurement = defaultMeasurement
+	}
+
+	tags := sc.Tags
+	if len(tags) == 0 {
+		tags = defaultTags
+		// Optionally set flows' source ports (since they're random in most cases)
+		if sc.EnableSrcPort {
+			tags = append(tags[:len(tags):len(tags)], "src_port")
+		}
+	}
+
+	fields := sc.Fields
+	if len(fields) == 0 {
+		fields = defaultFields
+	}
+
+	for _, t := range tags {
+		a, ok := attributes[t]
+		if !ok {
+			return pl, fmt.Errorf(errFmtUnknownAttr, t)
+		}
+		if a.counter {
+			return pl, fmt.Errorf(errFmtCounterTag, t)
+		}
+		pl.tags[t] = a
+	}
+
+	for _, f := range fields {
+		a, ok := attributes[f]
+		if !ok {
+			return pl, fmt.Errorf(errFmtUnknownAttr, f)
+		}
+		if _, ok := pl.tags[f]; ok {
+			return pl, fmt.Errorf(errFmtDupAttr, f)
+		}
+		pl.fields[f] = a
+	}
+
+	return pl, nil
+}
+
+// LineEncoder renders accounting events as lines of InfluxDB line protocol,
+// holding the points an InfluxDB sink with the same SinkConfig would write.
+type LineEncoder struct {
+	layout pointLayout
+}
+
+// NewLineEncoder returns a LineEncoder for the measurement, tags and fields
+// of the given SinkConfig.
+func NewLineEncoder(sc types.SinkConfig) (*LineEncoder, error) {
+
+	pl, err := newPointLayout(sc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LineEncoder{layout: pl}, nil
+}
+
+// Line returns the line protocol of the event's point without a trailing
+// newline, with the event's Time as its timestamp in nanoseconds.
+func (le *LineEncoder) Line(e bpf.Event) (string, error) {
+
+	pt, err := le.layout.newPoint(&e, e.Time)
+	if err != nil {
+		return "", err
+	}
+
+	return pt.String(), nil
+}
+
+// newPoint creates an InfluxDB point with timestamp ts from an accounting event.
+// The event's labels are added as tags, tags of the layout take precedence.
+// Every point is tagged with the event's schema version.
+func (pl pointLayout) newPoint(e *bpf.Event, ts time.Time) (*influx.Point, error) {
+
+	tags := make(map[string]string, len(pl.tags)+len(e.Labels)+1)
+	for k, v := range e.Labels {
+		tags[k] = v
+	}
+	for k, a := range pl.tags {
+		tags[k] = a.tag(e)
+	}
+	tags[schemaVersionTag] = schemaVersion
+
+	// Fields without a value, like delta counters of events that don't
+	// carry any, are left out of the point.
+	fields := make(map[string]interface{}, len(pl.fields))
+	for k, a := range pl.fields {
+		if v := a.field(e); v != nil {
+			fields[k] = v
+		}
+	}
+
+	return influx.NewPoint(pl.measurement, tags, fields, ts)
+}
@@ -0,0 +1,218 @@
+package influxdb
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+var testEvent = bpf.Event{
+	ConnectionID: 42,
+	Connmark:     255,
+	SrcAddr:      net.IPv4(127, 0, 0, 1),
+	DstAddr:      net.IPv4(127, 0, 0, 2),
+	PacketsOrig:  1,
+	BytesOrig:    31,
+	SrcPort:      4321,
+	DstPort:      1342,
+	NetNS:        4026531993,
+	Proto:        17,
+}
+
+func TestPointLayoutDefault(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{})
+	require.NoError(t, err)
+
+	ts := time.Unix(1, 0)
+	pt, err := pl.newPoint(&testEvent, ts)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ct_acct", pt.Name())
+	assert.Equal(t, ts, pt.Time())
+	assert.Equal(t, map[string]string{
+		"conn_id":  "42",
+		"src_addr": "127.0.0.1",
+		"dst_addr": "127.0.0.2",
+		"dst_port": "1342",
+		"proto":    "udp",
+		"connmark": "ff",
+		"netns":    "4026531993",
+
+		"schema_version": schemaVersion,
+	}, pt.Tags())
+
+	f, err := pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"bytes_orig":   int64(31),
+		"bytes_ret":    int64(0),
+		"packets_orig": int64(1),
+		"packets_ret":  int64(0),
+	}, f)
+
+	// Source ports are added to the default tags when enabled.
+	pl, err = newPointLayout(types.SinkConfig{EnableSrcPort: true})
+	require.NoError(t, err)
+	pt, err = pl.newPoint(&testEvent, ts)
+	require.NoError(t, err)
+	assert.Equal(t, "4321", pt.Tags()["src_port"])
+	assert.Len(t, defaultTags, 7, "default tags unmodified")
+}
+
+func TestPointLayoutLabels(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{Tags: []string{"proto"}})
+	require.NoError(t, err)
+
+	// Labels are added as tags, the layout's tags and the schema version
+	// take precedence.
+	e := testEvent
+	e.Labels = map[string]string{"hostname": "node1", "proto": "label", "schema_version": "label"}
+
+	pt, err := pl.newPoint(&e, time.Unix(1, 0))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"hostname": "node1", "proto": "udp", "schema_version": schemaVersion}, pt.Tags())
+	assert.Contains(t, pt.String(), "ct_acct,hostname=node1,proto=udp,schema_version="+schemaVersion+" ")
+}
+
+func TestPointLayoutCustom(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{
+		Measurement: "flows",
+		Tags:        []string{"proto", "dst_addr"},
+		Fields:      []string{"bytes_orig", "dst_port", "src_port"},
+	})
+	require.NoError(t, err)
+
+	pt, err := pl.newPoint(&testEvent, time.Unix(1, 0))
+	require.NoError(t, err)
+
+	assert.Equal(t, "flows", pt.Name())
+	assert.Equal(t, map[string]string{"proto": "udp", "dst_addr": "127.0.0.2", "schema_version": schemaVersion}, pt.Tags())
+
+	f, err := pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"bytes_orig": int64(31),
+		"dst_port":   int64(1342),
+		"src_port":   int64(4321),
+	}, f)
+}
+
+func TestPointLayoutDelta(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{
+		Fields: []string{"bytes_orig", "packets_orig", "bytes_orig_delta", "packets_orig_delta"},
+	})
+	require.NoError(t, err)
+
+	// Delta fields are sent next to the totals.
+	e := testEvent
+	e.PacketsOrig, e.BytesOrig = 3, 93
+	e.Delta = &bpf.Counters{PacketsOrig: 2, BytesOrig: 62}
+
+	pt, err := pl.newPoint(&e, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err := pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"bytes_orig":         int64(93),
+		"packets_orig":       int64(3),
+		"bytes_orig_delta":   int64(62),
+		"packets_orig_delta": int64(2),
+	}, f)
+
+	// Delta fields are left out of events without deltas.
+	pt, err = pl.newPoint(&testEvent, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err = pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"bytes_orig":   int64(31),
+		"packets_orig": int64(1),
+	}, f)
+}
+
+func TestPointLayoutHostDir(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{
+		Tags:   []string{"forwarded"},
+		Fields: []string{"bytes_orig", "bytes_in", "bytes_out"},
+	})
+	require.NoError(t, err)
+
+	e := testEvent
+	e.BytesIn, e.BytesOut = 62, 31
+
+	pt, err := pl.newPoint(&e, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err := pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"bytes_orig": int64(31),
+		"bytes_in":   int64(62),
+		"bytes_out":  int64(31),
+	}, f)
+	assert.Equal(t, map[string]string{"forwarded": "false", "schema_version": schemaVersion}, pt.Tags())
+
+	// Host direction fields are left out of forwarded events.
+	e = testEvent
+	e.Forwarded = true
+
+	pt, err = pl.newPoint(&e, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err = pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"bytes_orig": int64(31)}, f)
+	assert.Equal(t, map[string]string{"forwarded": "true", "schema_version": schemaVersion}, pt.Tags())
+}
+
+func TestPointLayoutMAC(t *testing.T) {
+
+	pl, err := newPointLayout(types.SinkConfig{
+		Tags:   []string{"src_mac"},
+		Fields: []string{"bytes_orig", "dst_mac"},
+	})
+	require.NoError(t, err)
+
+	e := testEvent
+	e.SrcMAC = bpf.MAC{0, 0, 0x5e, 0, 0x53, 1}
+	e.DstMAC = bpf.MAC{0, 0, 0x5e, 0, 0x53, 2}
+
+	pt, err := pl.newPoint(&e, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err := pt.Fields()
+	require.NoError(t, err)
+	assert.Equal(t, "00:00:5e:00:53:02", f["dst_mac"])
+	assert.Equal(t, "00:00:5e:00:53:01", pt.Tags()["src_mac"])
+
+	// Events without Ethernet addresses don't carry the tag or field.
+	pt, err = pl.newPoint(&testEvent, time.Unix(1, 0))
+	require.NoError(t, err)
+	f, err = pt.Fields()
+	require.NoError(t, err)
+	assert.NotContains(t, f, "dst_mac")
+	assert.NotContains(t, pt.Tags(), "src_mac")
+}
+
+func TestPointLayoutInvalid(t *testing.T) {
+
+	_, err := newPointLayout(types.SinkConfig{Tags: []string{"foo"}})
+	assert.EqualError(t, err, "unknown tag or field 'foo'")
+
+	_, err = newPointLayout(types.SinkConfig{Fields: []string{"bar"}})
+	assert.EqualError(t, err, "unknown tag or field 'bar'")
+
+	_, err = newPointLayout(types.SinkConfig{Tags: []string{"bytes_orig"}})
+	assert.EqualError(t, err, "counter 'bytes_orig' can only be sent as a field")
+
+	_, err = newPointLayout(types.SinkConfig{Tags: []string{"dst_port"}, Fields: []string{"dst_port"}})
+	assert.EqualError(t, err, "'dst_port' cannot be both a tag and a field")
+}
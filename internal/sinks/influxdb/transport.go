@@ -0,0 +1,116 @@
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	influx "github.com/influxdata/influxdb/client/v2"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+)
+
+// Transport protocols of the InfluxDB sink.
+const (
+	protoUDP  = "udp"
+	protoHTTP = "http"
+)
+
+// sinkProtocol returns the transport protocol of the sink. The legacy
+// influxdb-udp and influxdb-http sink types imply their protocol. For the
+// influxdb sink type, the protocol is inferred from the address' scheme
+// if not configured.
+func sinkProtocol(sc types.SinkConfig) (string, error) {
+
+	var implied string
+
+	switch sc.Type {
+	case types.InfluxUDP:
+		implied = protoUDP
+	case types.InfluxHTTP:
+		implied = protoHTTP
+	case types.InfluxDB:
+	default:
+		return "", errInvalidSinkType
+	}
+
+	if implied != "" {
+		if sc.Protocol != "" && sc.Protocol != implied {
+			return "", fmt.Errorf(errFmtProtoConflict, sc.Protocol, sc.Type)
+		}
+		return implied, nil
+	}
+
+	switch sc.Protocol {
+	case protoUDP, protoHTTP:
+		return sc.Protocol, nil
+	case "":
+		if strings.HasPrefix(sc.Address, "http://") || strings.HasPrefix(sc.Address, "https://") {
+			return protoHTTP, nil
+		}
+		return protoUDP, nil
+	}
+
+	return "", fmt.Errorf(errFmtUnknownProto, sc.Protocol)
+}
+
+// newClient returns an InfluxDB client for the given transport protocol.
+func newClient(proto string, sc types.SinkConfig) (influx.Client, error) {
+	if proto == protoHTTP {
+		return newHTTPClient(sc)
+	}
+	return newUDPClient(sc)
+}
+
+// newUDPClient returns an InfluxDB UDP client.
+func newUDPClient(sc types.SinkConfig) (influx.Client, error) {
+
+	// Construct InfluxDB UDP configuration and client.
+	conf := influx.UDPConfig{
+		Addr:        sc.Address,
+		PayloadSize: int(sc.UDPPayloadSize),
+	}
+
+	return influx.NewUDPClient(conf)
+}
+
+// newHTTPClient returns an InfluxDB HTTP client after ensuring the
+// server is reachable and the sink's database exists.
+func newHTTPClient(sc types.SinkConfig) (influx.Client, error) {
+
+	// HTTP client needs a database name to write to.
+	if sc.Database == "" {
+		return nil, errEmptySinkDatabase
+	}
+
+	// Construct InfluxDB HTTP configuration and client.
+	conf := influx.HTTPConfig{
+		Addr:     sc.Address,
+		Username: sc.Username,
+		Password: sc.Password,
+		Timeout:  sc.WriteTimeout,
+	}
+
+	c, err := influx.NewHTTPClient(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the server is up, waiting for a leader for up to 10s.
+	if _, _, err := c.Ping(time.Second * 10); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Ensure the database with the given name is created.
+	q := influx.NewQuery("CREATE DATABASE "+sc.Database, "", "")
+	if r, err := c.Query(q); err != nil {
+		c.Close()
+		return nil, err
+	} else if r.Error() != nil {
+		c.Close()
+		return nil, r.Error()
+	}
+
+	return c, nil
+}
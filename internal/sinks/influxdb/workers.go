@@ -3,47 +3,135 @@ package influxdb
 import (
 	"time"
 
-	log "github.com/sirupsen/logrus"
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
 // sendWorker receives batches from the sink's send channel
 // and uses the InfluxDB client to send it to the database.
+// Batches are returned to the sink's pool after they are sent. Batches that
+// failed to send are spooled if the sink has a spool, otherwise their events
+// are passed to the sink's OnDrop function. Spooled batches are replayed
+// every SpoolRetryInterval. Exits when the send channel is closed.
 func (s *InfluxSink) sendWorker() {
 
+	defer close(s.done)
+
+	// Only replay if the sink has a spool, a nil channel never fires.
+	var retry <-chan time.Time
+	if s.spool != nil {
+		t := time.NewTicker(s.config.SpoolRetryInterval)
+		defer t.Stop()
+		retry = t.C
+	}
+
 	for {
+		select {
+		case events, ok := <-s.sendChan:
+			if !ok {
+				return
+			}
+			s.send(events)
+			s.pool.Put(events)
+		case <-retry:
+			s.replay()
+		}
+	}
+}
+
+// send writes a batch of events to the database. Batches are spooled or
+// dropped without contacting the database while the sink's breaker is open.
+func (s *InfluxSink) send(events []bpf.Event) {
 
-		b := <-s.sendChan
+	b, err := s.batchPoints(events)
+	if err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error creating batch, batch dropped")
+		s.stats.IncrBatchDropped()
+		s.config.OnDrop.Drop(events...)
+		return
+	}
 
-		// Write the batch
-		if err := s.client.Write(b); err != nil {
-			log.Errorf("InfluxDB sink '%s': Error writing batch: %s. Batch dropped.", s.config.Name, err)
+	if !s.breaker.Allow() {
+		if s.spoolBatch(events) {
+			return
+		}
+		s.stats.IncrBatchDropped()
+		s.config.OnDrop.Drop(events...)
+		return
+	}
 
-			// Increase dropped batch counter
-			s.stats.IncrBatchDropped()
-			continue
+	// Write the batch. HTTP writes are bounded by the client's timeout.
+	if err := s.config.WriteLimiter.Do(func() error { return s.client.Write(b) }); err != nil {
+		s.breaker.Failure()
+
+		if s.spoolBatch(events) {
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing batch, batch spooled")
+			return
 		}
 
-		// Increase sent batch counter
-		s.stats.IncrBatchSent()
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing batch, batch dropped")
+
+		// Increase dropped (and timed out) batch counter
+		if helpers.IsTimeout(err) {
+			s.stats.IncrBatchTimedOut()
+		} else {
+			s.stats.IncrBatchDropped()
+		}
+		s.config.OnDrop.Drop(events...)
+		return
 	}
+
+	s.breaker.Success()
+
+	// Increase sent batch counter
+	s.stats.IncrBatchSent()
 }
 
-// tickWorker starts a ticker that periodically flushes the active batch.
-// If the batch is empty when the ticker fires, no action is taken.
-func (s *InfluxSink) tickWorker() {
+// spoolBatch adds a batch that failed to send to the sink's spool. Returns
+// false if the sink has no spool or the batch could not be spooled.
+func (s *InfluxSink) spoolBatch(events []bpf.Event) bool {
 
-	t := time.NewTicker(time.Second)
+	if s.spool == nil {
+		return false
+	}
 
-	for {
-		<-t.C
+	if err := s.spool.Put(events); err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error spooling batch")
+		return false
+	}
 
-		s.batchMu.Lock()
+	s.stats.IncrBatchSpooled()
+	s.stats.SetSpoolDepth(s.spool.Len())
 
-		if len(s.batch.Points()) != 0 {
-			s.sendChan <- s.batch
-			s.newBatch()
+	return true
+}
+
+// replay sends the batches in the sink's spool, until the database
+// fails to accept one. Skipped while the sink's breaker is open.
+func (s *InfluxSink) replay() {
+
+	if s.spool.Len() == 0 || !s.breaker.Allow() {
+		return
+	}
+
+	n, err := s.spool.Replay(func(events []bpf.Event) error {
+		// Spooled batches were converted to points before.
+		b, err := s.batchPoints(events)
+		if err != nil {
+			return err
 		}
+		return s.config.WriteLimiter.Do(func() error { return s.client.Write(b) })
+	})
+
+	s.stats.AddBatchesReplayed(n)
+	s.stats.SetSpoolDepth(s.spool.Len())
 
-		s.batchMu.Unlock()
+	if err != nil {
+		s.breaker.Failure()
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).WithField("batches", s.spool.Len()).Error("Error replaying spool")
+		return
 	}
+
+	s.breaker.Success()
 }
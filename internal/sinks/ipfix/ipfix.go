@@ -0,0 +1,243 @@
+// Package ipfix implements an accounting sink exporting flow records to an
+// IPFIX (RFC 7011) collector over UDP.
+package ipfix
+
+import (
+	"net"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	defaultBatchSize = 128
+
+	// Interval at which batches are flushed if not full.
+	defaultFlushInterval = time.Second
+
+	// Interval at which templates are resent.
+	defaultTemplateRefresh = time.Minute
+
+	// Maximum size of a message, below the MTU of most links.
+	defaultPayloadSize = 1400
+
+	// Amount of buffers of the sink's own pool.
+	poolBuffers = 4
+
+	// Amount of flows of which the sink tracks the counters,
+	// for computing the delta counters of their records.
+	deltaMaxFlows = 65536
+
+	// Time destroyed flows are remembered, for recognizing
+	// their updates arriving after their destroy event.
+	deltaLateWindow = time.Minute
+)
+
+// minPayloadSize is the size of a message holding the template
+// set and a single IPv6 record, the largest record.
+var minPayloadSize = messageHeaderLen + templateSetLen + setHeaderLen + templatesByID[templateIPv6].recordLen()
+
+// IPFIXSink is an accounting sink exporting events as IPFIX flow records
+// over UDP. Every event is exported as a data record holding the flow's
+// tuple, the counters accrued since the flow's previous record as
+// octetDeltaCount and packetDeltaCount, and its totals as octetTotalCount
+// and packetTotalCount. Counters of the reply direction are exported as the
+// reverse elements of RFC 5103. Records of destroy events have flowEndReason
+// end of flow, records of updates active timeout.
+//
+// IPv4 and IPv6 flows use separate templates, which are sent in the first
+// message and resent every TemplateRefresh. The message header's sequence
+// number counts the data records sent by the sink before the message.
+type IPFIXSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Socket connected to the collector.
+	conn net.Conn
+
+	// Encoder of the sink's messages, only used by batchReady.
+	enc encoder
+
+	// Time the templates were last sent, only used by batchReady.
+	templatesSent time.Time
+
+	// Computes the delta counters of events without them,
+	// only used by batchReady.
+	delta *stages.Delta
+
+	// Collects pushed events into batches.
+	batcher *batch.Batcher
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new IPFIX accounting sink.
+func New() IPFIXSink {
+	return IPFIXSink{}
+}
+
+// Init initializes the IPFIX accounting sink.
+func (s *IPFIXSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.IPFIX {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.Address == "" {
+		return errEmptySinkAddress
+	}
+	if sc.UDPPayloadSize == 0 {
+		sc.UDPPayloadSize = defaultPayloadSize
+	}
+	if int(sc.UDPPayloadSize) < minPayloadSize {
+		return errPayloadSize
+	}
+	if sc.BatchSize == 0 {
+		sc.BatchSize = defaultBatchSize
+	}
+	if sc.FlushInterval == 0 {
+		sc.FlushInterval = defaultFlushInterval
+	}
+	if sc.TemplateRefresh == 0 {
+		sc.TemplateRefresh = defaultTemplateRefresh
+	}
+
+	conn, err := net.Dial("udp", sc.Address)
+	if err != nil {
+		return err
+	}
+
+	pool := sc.BufferPool
+	if pool == nil {
+		pool = bufpool.New(poolBuffers, int(sc.BatchSize))
+	}
+
+	s.conn = conn
+	s.config = sc
+	s.enc = encoder{domain: sc.ObservationDomain, maxSize: int(sc.UDPPayloadSize)}
+	s.delta = stages.NewDelta(deltaLateWindow, deltaMaxFlows)
+
+	s.batcher = batch.New(batch.Config{
+		Size:      int(sc.BatchSize),
+		MaxEvents: int(sc.MaxBatchEvents),
+		Bytes:     sc.BatchBytes,
+		Interval:  sc.FlushInterval,
+		Pool:      pool,
+	}, s.batchReady)
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// Push an accounting event into the batch of the IPFIX accounting sink.
+// The event is dropped if no batch could be drawn from the sink's buffer pool.
+func (s *IPFIXSink) Push(e bpf.Event) {
+
+	// Use the time the event was captured in the kernel, unless configured
+	// to use the time the event was pushed into the sink.
+	if s.config.PushTimestamps {
+		e.Time = time.Now()
+	}
+
+	if !s.batcher.Add(e) {
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+		return
+	}
+
+	s.stats.SetBatchLength(s.batcher.Len())
+	s.stats.IncrEventsPushed()
+}
+
+// Name gets the name of the IPFIX accounting sink.
+func (s *IPFIXSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the IPFIX accounting sink was successfully initialized.
+func (s *IPFIXSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate always returns true.
+func (s *IPFIXSink) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, IPFIX receives destroy events. (flow totals)
+func (s *IPFIXSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew returns false, IPFIX receives new flows as update events.
+func (s *IPFIXSink) WantNew() bool {
+	return false
+}
+
+// Stats returns the IPFIX accounting sink's statistics structure.
+func (s *IPFIXSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// QueueStats returns the age of the sink's current batch. Batches are
+// sent as soon as they are full, the sink has no send queue.
+func (s *IPFIXSink) QueueStats() types.QueueStats {
+	return types.QueueStats{BatchAge: s.batcher.Age(time.Now())}
+}
+
+// Close exports the active batch and closes the sink's socket.
+func (s *IPFIXSink) Close() error {
+	s.batcher.Close()
+	return s.conn.Close()
+}
+
+// batchReady exports a batch of events to the collector. Messages that fail
+// to send are dropped along with their events.
+func (s *IPFIXSink) batchReady(b batch.Batch) {
+
+	defer s.batcher.Put(b.Events)
+
+	now := time.Now()
+
+	for i := range b.Events {
+		if b.Events[i].Delta == nil {
+			s.delta.Process(b.Events[i], func(e bpf.Event) {
+				b.Events[i] = e
+			})
+		}
+	}
+
+	templates := s.templatesSent.IsZero() || now.Sub(s.templatesSent) >= s.config.TemplateRefresh
+	if templates {
+		s.templatesSent = now
+	}
+
+	for _, m := range s.enc.encode(b.Events, now, templates) {
+		if err := s.config.WriteLimiter.Do(func() error { _, err := s.conn.Write(m.data); return err }); err != nil {
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).WithField("events", len(m.events)).
+				Error("Error sending message, events dropped")
+			s.stats.IncrMessageFailed()
+			s.config.OnDrop.Drop(m.events...)
+			continue
+		}
+		s.stats.IncrMessagePublished()
+	}
+
+	s.stats.IncrBatchSent()
+	s.stats.SetBatchLength(0)
+}
@@ -0,0 +1,360 @@
+package ipfix_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/ipfix"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// ie identifies an information element, pen is zero for IANA elements.
+type ie struct {
+	id  uint16
+	pen uint32
+}
+
+// Information elements checked by the tests.
+var (
+	octetDeltaCount    = ie{1, 0}
+	packetDeltaCount   = ie{2, 0}
+	protocolIdentifier = ie{4, 0}
+	sourcePort         = ie{7, 0}
+	sourceIPv4         = ie{8, 0}
+	destinationPort    = ie{11, 0}
+	destinationIPv4    = ie{12, 0}
+	sourceIPv6         = ie{27, 0}
+	icmpTypeCodeIPv6   = ie{139, 0}
+	octetTotalCount    = ie{85, 0}
+	packetTotalCount   = ie{86, 0}
+	flowEndReason      = ie{136, 0}
+	flowID             = ie{148, 0}
+	flowStartMillis    = ie{152, 0}
+	reverseOctetDelta  = ie{1, 29305}
+	reversePacketDelta = ie{2, 29305}
+	reverseOctetTotal  = ie{85, 29305}
+	reversePacketTotal = ie{86, 29305}
+)
+
+type fieldSpec struct {
+	ie
+	length int
+}
+
+// record is a decoded data record, the raw values of its elements.
+type record struct {
+	template uint16
+	values   map[ie][]byte
+}
+
+func (r record) uint(e ie) uint64 {
+	var v uint64
+	for _, b := range r.values[e] {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// message is a decoded IPFIX message.
+type message struct {
+	seq       uint32
+	domain    uint32
+	templates []uint16
+	records   []record
+}
+
+// collector is a minimal IPFIX collector, decoding the messages
+// it receives with the templates it received before.
+type collector struct {
+	t         *testing.T
+	conn      *net.UDPConn
+	templates map[uint16][]fieldSpec
+}
+
+func newCollector(t *testing.T) *collector {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	return &collector{t: t, conn: conn, templates: make(map[uint16][]fieldSpec)}
+}
+
+func (c *collector) addr() string {
+	return c.conn.LocalAddr().String()
+}
+
+func (c *collector) close() {
+	c.conn.Close()
+}
+
+// receive reads and decodes a message.
+func (c *collector) receive() message {
+	t := c.t
+	t.Helper()
+
+	require.NoError(t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	buf := make([]byte, 65535)
+	n, err := c.conn.Read(buf)
+	require.NoError(t, err)
+	b := buf[:n]
+
+	require.True(t, len(b) >= 16)
+	require.EqualValues(t, 10, binary.BigEndian.Uint16(b[0:]), "version")
+	require.EqualValues(t, len(b), binary.BigEndian.Uint16(b[2:]), "message length")
+
+	m := message{
+		seq:    binary.BigEndian.Uint32(b[8:]),
+		domain: binary.BigEndian.Uint32(b[12:]),
+	}
+
+	for b = b[16:]; len(b) != 0; {
+		require.True(t, len(b) >= 4)
+		id := binary.BigEndian.Uint16(b[0:])
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		require.True(t, l >= 4 && l <= len(b), "set length")
+
+		set := b[4:l]
+		b = b[l:]
+
+		if id == 2 {
+			m.templates = append(m.templates, c.decodeTemplates(set)...)
+			continue
+		}
+
+		fields, ok := c.templates[id]
+		require.True(t, ok, "data set of unknown template %d", id)
+
+		for len(set) != 0 {
+			r := record{template: id, values: make(map[ie][]byte)}
+			for _, f := range fields {
+				require.True(t, len(set) >= f.length, "truncated record")
+				r.values[f.ie] = set[:f.length]
+				set = set[f.length:]
+			}
+			m.records = append(m.records, r)
+		}
+	}
+
+	return m
+}
+
+func (c *collector) decodeTemplates(set []byte) []uint16 {
+	var ids []uint16
+
+	for len(set) != 0 {
+		id := binary.BigEndian.Uint16(set[0:])
+		count := int(binary.BigEndian.Uint16(set[2:]))
+		set = set[4:]
+
+		var fields []fieldSpec
+		for i := 0; i < count; i++ {
+			f := fieldSpec{
+				ie:     ie{id: binary.BigEndian.Uint16(set[0:])},
+				length: int(binary.BigEndian.Uint16(set[2:])),
+			}
+			set = set[4:]
+			if f.id&0x8000 != 0 {
+				f.id &^= 0x8000
+				f.pen = binary.BigEndian.Uint32(set)
+				set = set[4:]
+			}
+			fields = append(fields, f)
+		}
+
+		c.templates[id] = fields
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func newSink(t *testing.T, c *collector, sc types.SinkConfig) *ipfix.IPFIXSink {
+	sc.Type = types.IPFIX
+	sc.Name = "ipfix"
+	sc.Address = c.addr()
+
+	s := ipfix.New()
+	require.NoError(t, s.Init(sc))
+
+	return &s
+}
+
+var start = time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)
+
+func TestIPFIXSinkRecords(t *testing.T) {
+
+	c := newCollector(t)
+	defer c.close()
+
+	s := newSink(t, c, types.SinkConfig{BatchSize: 3, ObservationDomain: 42})
+	defer s.Close()
+
+	tcp := bpf.Event{
+		Type:         bpf.EventUpdate,
+		ConnectionID: 1,
+		Start:        uint64(start.UnixNano()),
+		Time:         start.Add(10 * time.Second),
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		SrcPort:      40000,
+		DstPort:      443,
+		Proto:        6,
+		PacketsOrig:  10,
+		BytesOrig:    1000,
+		PacketsRet:   5,
+		BytesRet:     5000,
+	}
+
+	destroy := tcp
+	destroy.Type = bpf.EventDestroy
+	destroy.Time = start.Add(20 * time.Second)
+	destroy.PacketsOrig, destroy.BytesOrig = 12, 1200
+	destroy.PacketsRet, destroy.BytesRet = 8, 8000
+
+	icmp := bpf.Event{
+		Type:         bpf.EventUpdate,
+		ConnectionID: 2,
+		Time:         start.Add(3 * time.Second),
+		Duration:     3 * time.Second,
+		SrcAddr:      net.ParseIP("2001:db8::1"),
+		DstAddr:      net.ParseIP("2001:db8::2"),
+		Proto:        58,
+		ICMPType:     128,
+		PacketsOrig:  1,
+		BytesOrig:    64,
+		Delta:        &bpf.Counters{PacketsOrig: 1, BytesOrig: 64},
+	}
+
+	s.Push(tcp)
+	s.Push(destroy)
+	s.Push(icmp)
+
+	m := c.receive()
+	assert.EqualValues(t, 0, m.seq)
+	assert.EqualValues(t, 42, m.domain)
+	assert.Equal(t, []uint16{256, 257}, m.templates, "templates in the first message")
+	require.Len(t, m.records, 3)
+
+	r := m.records[0]
+	assert.EqualValues(t, 256, r.template)
+	assert.EqualValues(t, 1, r.uint(flowID))
+	assert.EqualValues(t, start.UnixNano()/int64(time.Millisecond), r.uint(flowStartMillis))
+	assert.Equal(t, []byte{10, 0, 0, 1}, r.values[sourceIPv4])
+	assert.Equal(t, []byte{10, 0, 0, 2}, r.values[destinationIPv4])
+	assert.EqualValues(t, 40000, r.uint(sourcePort))
+	assert.EqualValues(t, 443, r.uint(destinationPort))
+	assert.EqualValues(t, 6, r.uint(protocolIdentifier))
+	assert.EqualValues(t, 2, r.uint(flowEndReason), "active timeout")
+
+	// The first record of a flow holds its totals as its delta.
+	assert.EqualValues(t, 1000, r.uint(octetDeltaCount))
+	assert.EqualValues(t, 10, r.uint(packetDeltaCount))
+	assert.EqualValues(t, 5000, r.uint(reverseOctetDelta))
+	assert.EqualValues(t, 5, r.uint(reversePacketDelta))
+
+	r = m.records[1]
+	assert.EqualValues(t, 3, r.uint(flowEndReason), "end of flow")
+	assert.EqualValues(t, 200, r.uint(octetDeltaCount))
+	assert.EqualValues(t, 2, r.uint(packetDeltaCount))
+	assert.EqualValues(t, 3000, r.uint(reverseOctetDelta))
+	assert.EqualValues(t, 3, r.uint(reversePacketDelta))
+	assert.EqualValues(t, 1200, r.uint(octetTotalCount))
+	assert.EqualValues(t, 12, r.uint(packetTotalCount))
+	assert.EqualValues(t, 8000, r.uint(reverseOctetTotal))
+	assert.EqualValues(t, 8, r.uint(reversePacketTotal))
+
+	r = m.records[2]
+	assert.EqualValues(t, 257, r.template)
+	assert.Equal(t, []byte(net.ParseIP("2001:db8::1")), r.values[sourceIPv6])
+	assert.EqualValues(t, 128<<8, r.uint(icmpTypeCodeIPv6))
+	assert.EqualValues(t, start.UnixNano()/int64(time.Millisecond), r.uint(flowStartMillis),
+		"start derived from the event's duration")
+
+	// The next message continues the sequence, without templates.
+	s.Push(tcp)
+	s.Push(tcp)
+	s.Push(tcp)
+
+	m = c.receive()
+	assert.EqualValues(t, 3, m.seq)
+	assert.Empty(t, m.templates)
+	assert.Len(t, m.records, 3)
+
+	st := s.Stats()
+	assert.EqualValues(t, 2, st.MessagesPublished)
+	assert.EqualValues(t, 2, st.BatchesSent)
+}
+
+func TestIPFIXSinkTemplateRefresh(t *testing.T) {
+
+	c := newCollector(t)
+	defer c.close()
+
+	s := newSink(t, c, types.SinkConfig{BatchSize: 1, TemplateRefresh: time.Nanosecond})
+	defer s.Close()
+
+	e := bpf.Event{SrcAddr: net.IPv4(10, 0, 0, 1), DstAddr: net.IPv4(10, 0, 0, 2), Proto: 17}
+
+	for i := 0; i < 2; i++ {
+		s.Push(e)
+		m := c.receive()
+		assert.Equal(t, []uint16{256, 257}, m.templates)
+		assert.EqualValues(t, i, m.seq)
+		assert.Len(t, m.records, 1)
+	}
+}
+
+func TestIPFIXSinkMessageSize(t *testing.T) {
+
+	c := newCollector(t)
+	defer c.close()
+
+	// Room for the templates and a single record.
+	s := newSink(t, c, types.SinkConfig{BatchSize: 3, UDPPayloadSize: 400})
+	defer s.Close()
+
+	e := bpf.Event{SrcAddr: net.IPv4(10, 0, 0, 1), DstAddr: net.IPv4(10, 0, 0, 2), Proto: 17}
+	s.Push(e)
+	s.Push(e)
+	s.Push(e)
+
+	m := c.receive()
+	assert.NotEmpty(t, m.templates)
+	require.Len(t, m.records, 1)
+
+	m = c.receive()
+	assert.Empty(t, m.templates)
+	assert.EqualValues(t, 1, m.seq)
+	assert.Len(t, m.records, 2)
+}
+
+func TestIPFIXSinkInit(t *testing.T) {
+
+	c := newCollector(t)
+	defer c.close()
+
+	tests := []struct {
+		name string
+		sc   types.SinkConfig
+	}{
+		{"type", types.SinkConfig{Type: types.MQTT, Name: "t", Address: c.addr()}},
+		{"name", types.SinkConfig{Type: types.IPFIX, Address: c.addr()}},
+		{"address", types.SinkConfig{Type: types.IPFIX, Name: "t"}},
+		{"payload", types.SinkConfig{Type: types.IPFIX, Name: "t", Address: c.addr(), UDPPayloadSize: 256}},
+		{"resolve", types.SinkConfig{Type: types.IPFIX, Name: "t", Address: "localhost:nope"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := ipfix.New()
+			assert.Error(t, s.Init(tt.sc))
+			assert.False(t, s.IsInit())
+		})
+	}
+}
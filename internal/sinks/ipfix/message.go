@@ -0,0 +1,313 @@
+package ipfix
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	// IPFIX protocol version in the message header.
+	version = 10
+
+	// Lengths of the message and set headers.
+	messageHeaderLen = 16
+	setHeaderLen     = 4
+
+	// Set ID of template sets.
+	templateSetID = 2
+
+	// IDs of the templates of IPv4 and IPv6 flow records.
+	templateIPv4 = 256
+	templateIPv6 = 257
+
+	// Private enterprise number of the reverse information elements of
+	// bidirectional flows defined in RFC 5103.
+	reversePEN = 29305
+
+	// Bit marking an enterprise-specific information element.
+	enterpriseBit = 0x8000
+
+	// Values of flowEndReason.
+	endActiveTimeout = 0x02
+	endOfFlow        = 0x03
+)
+
+// field is an information element in a template.
+type field struct {
+	id     uint16
+	length uint16
+	pen    uint32 // enterprise number, zero for IANA elements
+}
+
+// reverse returns the RFC 5103 reverse element of an IANA element.
+func reverse(f field) field {
+	f.pen = reversePEN
+	return f
+}
+
+// Information elements of flow records, see the IANA IPFIX registry.
+var (
+	ieOctetDeltaCount          = field{1, 8, 0}
+	iePacketDeltaCount         = field{2, 8, 0}
+	ieProtocolIdentifier       = field{4, 1, 0}
+	ieSourceTransportPort      = field{7, 2, 0}
+	ieSourceIPv4Address        = field{8, 4, 0}
+	ieDestinationTransportPort = field{11, 2, 0}
+	ieDestinationIPv4Address   = field{12, 4, 0}
+	ieSourceIPv6Address        = field{27, 16, 0}
+	ieDestinationIPv6Address   = field{28, 16, 0}
+	ieICMPTypeCodeIPv4         = field{32, 2, 0}
+	ieOctetTotalCount          = field{85, 8, 0}
+	iePacketTotalCount         = field{86, 8, 0}
+	ieFlowEndReason            = field{136, 1, 0}
+	ieICMPTypeCodeIPv6         = field{139, 2, 0}
+	ieFlowID                   = field{148, 8, 0}
+	ieFlowStartMilliseconds    = field{152, 8, 0}
+	ieFlowEndMilliseconds      = field{153, 8, 0}
+)
+
+// template is the layout of the records of one address family. Addresses,
+// ports and counters of the original direction use the IANA elements, the
+// counters of the reply direction use their RFC 5103 reverse elements.
+type template struct {
+	id     uint16
+	fields []field
+}
+
+// templateFields returns the fields of a template with the given
+// address and ICMP type/code elements.
+func templateFields(src, dst, icmp field) []field {
+	return []field{
+		ieFlowID,
+		ieFlowStartMilliseconds,
+		ieFlowEndMilliseconds,
+		src,
+		dst,
+		ieSourceTransportPort,
+		ieDestinationTransportPort,
+		ieProtocolIdentifier,
+		icmp,
+		ieOctetDeltaCount,
+		iePacketDeltaCount,
+		reverse(ieOctetDeltaCount),
+		reverse(iePacketDeltaCount),
+		ieOctetTotalCount,
+		iePacketTotalCount,
+		reverse(ieOctetTotalCount),
+		reverse(iePacketTotalCount),
+		ieFlowEndReason,
+	}
+}
+
+var templates = []template{
+	{templateIPv4, templateFields(ieSourceIPv4Address, ieDestinationIPv4Address, ieICMPTypeCodeIPv4)},
+	{templateIPv6, templateFields(ieSourceIPv6Address, ieDestinationIPv6Address, ieICMPTypeCodeIPv6)},
+}
+
+// recordLen returns the length of a data record of the template.
+func (t template) recordLen() int {
+	n := 0
+	for _, f := range t.fields {
+		n += int(f.length)
+	}
+	return n
+}
+
+// setLen returns the length of the template's record in a template set.
+func (t template) setLen() int {
+	n := 4 // template ID and field count
+	for _, f := range t.fields {
+		n += 4
+		if f.pen != 0 {
+			n += 4
+		}
+	}
+	return n
+}
+
+// appendTo appends the template's record in a template set to b.
+func (t template) appendTo(b []byte) []byte {
+
+	b = appendUint16(b, t.id)
+	b = appendUint16(b, uint16(len(t.fields)))
+
+	for _, f := range t.fields {
+		if f.pen != 0 {
+			b = appendUint16(b, f.id|enterpriseBit)
+			b = appendUint16(b, f.length)
+			b = appendUint32(b, f.pen)
+			continue
+		}
+		b = appendUint16(b, f.id)
+		b = appendUint16(b, f.length)
+	}
+
+	return b
+}
+
+// templateSetLen is the length of the template set holding all templates.
+var templateSetLen = func() int {
+	n := setHeaderLen
+	for _, t := range templates {
+		n += t.setLen()
+	}
+	return n
+}()
+
+// message is an encoded IPFIX message, and the events of its data records.
+type message struct {
+	data   []byte
+	events []bpf.Event
+}
+
+// encoder encodes events into IPFIX messages of an observation domain,
+// keeping the domain's sequence number. Not safe for concurrent use.
+type encoder struct {
+	domain  uint32
+	maxSize int
+
+	// Amount of data records sent in the domain, modulo 2^32.
+	seq uint32
+}
+
+// encode encodes events into messages of at most the encoder's maximum size,
+// exported at now. If templates is true, the first message starts with the
+// template set. The events' Delta counters must be set.
+func (enc *encoder) encode(events []bpf.Event, now time.Time, templates bool) []message {
+
+	var out []message
+
+	for len(events) != 0 || templates {
+		b := make([]byte, messageHeaderLen, enc.maxSize)
+
+		if templates {
+			b = appendTemplateSet(b)
+			templates = false
+		}
+
+		// Fill the message with data sets, starting a new set
+		// whenever the address family of the events changes.
+		n := 0
+		for n < len(events) {
+			t := templatesByID[templateOf(&events[n])]
+			if len(b)+setHeaderLen+t.recordLen() > enc.maxSize {
+				break
+			}
+
+			set := len(b)
+			b = appendUint16(b, t.id)
+			b = appendUint16(b, 0) // set length, filled in below
+
+			for n < len(events) && templateOf(&events[n]) == t.id && len(b)+t.recordLen() <= enc.maxSize {
+				b = appendRecord(b, &events[n], t.id == templateIPv6)
+				n++
+			}
+
+			binary.BigEndian.PutUint16(b[set+2:], uint16(len(b)-set))
+		}
+
+		// A single record never exceeds the maximum size, see Init.
+		putHeader(b, now, enc.seq, enc.domain)
+		enc.seq += uint32(n)
+
+		out = append(out, message{data: b, events: events[:n]})
+		events = events[n:]
+	}
+
+	return out
+}
+
+var templatesByID = map[uint16]template{
+	templateIPv4: templates[0],
+	templateIPv6: templates[1],
+}
+
+// templateOf returns the ID of the template of the event's record.
+func templateOf(e *bpf.Event) uint16 {
+	if e.SrcAddr.To4() != nil {
+		return templateIPv4
+	}
+	return templateIPv6
+}
+
+// putHeader writes the message header into the first bytes of b.
+func putHeader(b []byte, now time.Time, seq, domain uint32) {
+	binary.BigEndian.PutUint16(b[0:], version)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint32(b[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(b[8:], seq)
+	binary.BigEndian.PutUint32(b[12:], domain)
+}
+
+// appendTemplateSet appends a template set holding all templates to b.
+func appendTemplateSet(b []byte) []byte {
+	b = appendUint16(b, templateSetID)
+	b = appendUint16(b, uint16(templateSetLen))
+	for _, t := range templates {
+		b = t.appendTo(b)
+	}
+	return b
+}
+
+// appendRecord appends the data record of the event to b, in the layout
+// of the IPv4 or IPv6 template.
+func appendRecord(b []byte, e *bpf.Event, v6 bool) []byte {
+
+	end := e.Time
+	start := end.Add(-e.Duration)
+	if e.Start != 0 {
+		start = time.Unix(0, int64(e.Start))
+	}
+
+	b = appendUint64(b, uint64(e.ConnectionID))
+	b = appendUint64(b, uint64(start.UnixNano()/int64(time.Millisecond)))
+	b = appendUint64(b, uint64(end.UnixNano()/int64(time.Millisecond)))
+
+	if v6 {
+		b = append(b, e.SrcAddr.To16()...)
+		b = append(b, e.DstAddr.To16()...)
+	} else {
+		b = append(b, e.SrcAddr.To4()...)
+		b = append(b, e.DstAddr.To4()...)
+	}
+
+	b = appendUint16(b, e.SrcPort)
+	b = appendUint16(b, e.DstPort)
+	b = append(b, e.Proto)
+	b = append(b, e.ICMPType, e.ICMPCode)
+
+	var d bpf.Counters
+	if e.Delta != nil {
+		d = *e.Delta
+	}
+	b = appendUint64(b, d.BytesOrig)
+	b = appendUint64(b, d.PacketsOrig)
+	b = appendUint64(b, d.BytesRet)
+	b = appendUint64(b, d.PacketsRet)
+
+	b = appendUint64(b, e.BytesOrig)
+	b = appendUint64(b, e.PacketsOrig)
+	b = appendUint64(b, e.BytesRet)
+	b = appendUint64(b, e.PacketsRet)
+
+	reason := uint8(endActiveTimeout)
+	if e.Type == bpf.EventDestroy {
+		reason = endOfFlow
+	}
+
+	return append(b, reason)
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
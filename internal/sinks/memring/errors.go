@@ -0,0 +1,8 @@
+package memring
+
+import "errors"
+
+var (
+	errEmptySinkName   = errors.New("empty sink name")
+	errInvalidSinkType = errors.New("invalid sink type")
+)
@@ -0,0 +1,102 @@
+package memring
+
+import (
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	defaultRingSize = 1024
+)
+
+// MemRing is an accounting sink retaining the most recent events in memory,
+// meant for debugging. The events can be retrieved using Recent.
+type MemRing struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Ring buffer holding the most recent events.
+	ring *ring
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new MemRing.
+func New() MemRing {
+	return MemRing{}
+}
+
+// Init initializes the MemRing sink.
+func (m *MemRing) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.MemRing {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.RingSize == 0 {
+		sc.RingSize = defaultRingSize
+	}
+
+	m.ring = newRing(int(sc.RingSize))
+	m.config = sc
+
+	// Mark the sink as initialized.
+	m.init = true
+
+	return nil
+}
+
+// Push stores an event in the ring, dropping the oldest event when full.
+func (m *MemRing) Push(e bpf.Event) {
+	m.ring.put(e)
+	m.stats.IncrEventsPushed()
+	m.stats.SetBatchLength(m.ring.len())
+}
+
+// Recent returns a copy of the events in the ring, from oldest to newest.
+func (m *MemRing) Recent() []bpf.Event {
+	return m.ring.snapshot()
+}
+
+// Name gets the name of the MemRing.
+func (m *MemRing) Name() string {
+	return m.config.Name
+}
+
+// IsInit checks if the MemRing was successfully initialized.
+func (m *MemRing) IsInit() bool {
+	return m.init
+}
+
+// WantUpdate always returns true.
+func (m *MemRing) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, MemRing receives destroy events. (flow totals)
+func (m *MemRing) WantDestroy() bool {
+	return true
+}
+
+// WantNew always returns true.
+func (m *MemRing) WantNew() bool {
+	return true
+}
+
+// Stats returns the MemRing's statistics structure.
+func (m *MemRing) Stats() types.SinkStats {
+	return m.stats.Get()
+}
+
+// Close is a no-op, MemRing does not run any workers.
+func (m *MemRing) Close() error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package memring_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/memring"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func newRing(t *testing.T, size uint32) *memring.MemRing {
+	m := memring.New()
+	require.NoError(t, m.Init(types.SinkConfig{
+		Name:     "test",
+		Type:     types.MemRing,
+		RingSize: size,
+	}))
+	return &m
+}
+
+func TestMemRingWraparound(t *testing.T) {
+
+	m := newRing(t, 4)
+	assert.Empty(t, m.Recent())
+
+	for i := uint32(1); i <= 3; i++ {
+		m.Push(bpf.Event{ConnectionID: i})
+	}
+
+	ids := func() (out []uint32) {
+		for _, e := range m.Recent() {
+			out = append(out, e.ConnectionID)
+		}
+		return
+	}
+
+	assert.Equal(t, []uint32{1, 2, 3}, ids())
+
+	// Oldest events are dropped when the ring is full.
+	for i := uint32(4); i <= 10; i++ {
+		m.Push(bpf.Event{ConnectionID: i})
+	}
+	assert.Equal(t, []uint32{7, 8, 9, 10}, ids())
+
+	st := m.Stats()
+	assert.EqualValues(t, 10, st.EventsPushed)
+	assert.EqualValues(t, 4, st.BatchLength)
+}
+
+func TestMemRingConcurrent(t *testing.T) {
+
+	const (
+		size    = 64
+		writers = 8
+		events  = 2000
+	)
+
+	m := newRing(t, size)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	// Readers check that snapshots are bounded and ordered per writer.
+	for r := 0; r < 2; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				last := make(map[uint32]uint64)
+				evs := m.Recent()
+				assert.True(t, len(evs) <= size)
+				for _, e := range evs {
+					// ConnectionID identifies the writer, Timestamp is its counter.
+					assert.True(t, e.Timestamp > last[e.ConnectionID], "events out of order")
+					last[e.ConnectionID] = e.Timestamp
+				}
+			}
+		}()
+	}
+
+	var ww sync.WaitGroup
+	for w := uint32(0); w < writers; w++ {
+		ww.Add(1)
+		go func(w uint32) {
+			defer ww.Done()
+			for i := uint64(1); i <= events; i++ {
+				m.Push(bpf.Event{ConnectionID: w, Timestamp: i})
+			}
+		}(w)
+	}
+
+	ww.Wait()
+	close(done)
+	wg.Wait()
+
+	assert.Len(t, m.Recent(), size)
+	assert.EqualValues(t, writers*events, m.Stats().EventsPushed)
+}
+
+func TestMemRingInit(t *testing.T) {
+
+	m := memring.New()
+	assert.Error(t, m.Init(types.SinkConfig{Type: types.MemRing}), "empty name")
+	assert.Error(t, m.Init(types.SinkConfig{Name: "test", Type: types.Dummy}), "wrong type")
+
+	// Ring size defaults to a non-zero value.
+	require.NoError(t, m.Init(types.SinkConfig{Name: "test", Type: types.MemRing}))
+	m.Push(bpf.Event{})
+	assert.Len(t, m.Recent(), 1)
+}
@@ -0,0 +1,68 @@
+package memring
+
+import (
+	"sync/atomic"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// slot is an event stored in the ring, along with its sequence number.
+type slot struct {
+	seq uint64
+	e   bpf.Event
+}
+
+// ring is a fixed-size ring buffer of events. Writers claim a sequence number
+// using an atomic increment and store their event in the slot it maps to,
+// overwriting the oldest event. Readers never block writers. Safe for
+// concurrent use without locks.
+type ring struct {
+	// Sequence number of the next event written to the ring.
+	next  uint64
+	slots []atomic.Value
+}
+
+// newRing returns a ring holding up to size events.
+func newRing(size int) *ring {
+	return &ring{slots: make([]atomic.Value, size)}
+}
+
+// put stores an event in the ring, overwriting the oldest event if the ring is full.
+func (r *ring) put(e bpf.Event) {
+	seq := atomic.AddUint64(&r.next, 1) - 1
+	r.slots[seq%uint64(len(r.slots))].Store(&slot{seq: seq, e: e})
+}
+
+// len returns the amount of events in the ring.
+func (r *ring) len() int {
+	n := atomic.LoadUint64(&r.next)
+	if n > uint64(len(r.slots)) {
+		return len(r.slots)
+	}
+	return int(n)
+}
+
+// snapshot returns a copy of the events in the ring, from oldest to newest.
+// Events that are overwritten by concurrent writers while the snapshot is
+// being taken, or that have not yet been stored by their writer, are omitted.
+func (r *ring) snapshot() []bpf.Event {
+
+	head := atomic.LoadUint64(&r.next)
+	size := uint64(len(r.slots))
+
+	var tail uint64
+	if head > size {
+		tail = head - size
+	}
+
+	out := make([]bpf.Event, 0, head-tail)
+	for seq := tail; seq < head; seq++ {
+		s, ok := r.slots[seq%size].Load().(*slot)
+		if !ok || s.seq != seq {
+			continue
+		}
+		out = append(out, s.e)
+	}
+
+	return out
+}
@@ -0,0 +1,14 @@
+package mqtt
+
+import "errors"
+
+var (
+	errEmptySinkName    = errors.New("empty sink name")
+	errEmptySinkAddress = errors.New("empty sink address")
+	errEmptyTopic       = errors.New("empty sink topic")
+	errInvalidQoS       = errors.New("qos must be 0, 1 or 2")
+	errInvalidSinkType  = errors.New("invalid sink type")
+	errInvalidTopic     = errors.New("topic is empty or contains a wildcard")
+	errConnectTimeout   = errors.New("timeout connecting to broker")
+	errPublishTimeout   = errors.New("timeout waiting for broker to acknowledge message")
+)
@@ -0,0 +1,255 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/breaker"
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	// Maximum backoff between reconnection attempts.
+	defaultMaxReconnectInterval = 30 * time.Second
+
+	// Amount of events that can be queued in the sink before
+	// new events are dropped.
+	eventQueueLength = 8192
+)
+
+// MQTTSink is an accounting sink publishing events to an MQTT broker as JSON
+// messages, one message per event. The client reconnects with an exponential
+// backoff when its connection is lost. Events pushed while the client is
+// disconnected are dropped.
+type MQTTSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// MQTT client handle.
+	client paho.Client
+
+	// Topic of the sink's messages, only used by the worker.
+	topic *topic
+
+	// Queue of events to be published.
+	events chan bpf.Event
+
+	// Closed by the worker when it exits after Close.
+	done chan struct{}
+
+	// Circuit breaker of the sink's publishes, nil if the sink has none.
+	breaker *breaker.Breaker
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new MQTT accounting sink.
+func New() MQTTSink {
+	return MQTTSink{}
+}
+
+// Init initializes the MQTT accounting sink and connects to its broker.
+func (s *MQTTSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.MQTT {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.Address == "" {
+		return errEmptySinkAddress
+	}
+	if sc.Topic == "" {
+		return errEmptyTopic
+	}
+	if sc.QoS > 2 {
+		return errInvalidQoS
+	}
+	if sc.ClientID == "" {
+		sc.ClientID = "conntracct-" + sc.Name
+	}
+	if sc.MaxReconnectInterval == 0 {
+		sc.MaxReconnectInterval = defaultMaxReconnectInterval
+	}
+	sc.WriteTimeout = sc.GetWriteTimeout()
+
+	tp, err := newTopic(sc.Topic)
+	if err != nil {
+		return err
+	}
+
+	opts := paho.NewClientOptions().
+		AddBroker(sc.Address).
+		SetClientID(sc.ClientID).
+		SetUsername(sc.Username).
+		SetPassword(sc.Password).
+		SetConnectTimeout(sc.WriteTimeout).
+		SetWriteTimeout(sc.WriteTimeout).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(sc.MaxReconnectInterval).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			logging.Sink(sc.Name, sc.Type).WithError(err).Warn("Connection lost")
+		}).
+		SetReconnectingHandler(func(paho.Client, *paho.ClientOptions) {
+			s.stats.IncrReconnect()
+		})
+
+	// Check if the broker is up.
+	c := paho.NewClient(opts)
+	tok := c.Connect()
+	if !tok.WaitTimeout(sc.WriteTimeout) {
+		c.Disconnect(0)
+		return errConnectTimeout
+	}
+	if err := tok.Error(); err != nil {
+		return err
+	}
+
+	s.client = c
+	s.config = sc
+	s.topic = tp
+	s.breaker = helpers.NewBreaker(sc, &s.stats)
+	s.events = make(chan bpf.Event, eventQueueLength)
+	s.done = make(chan struct{})
+
+	go s.publishWorker()
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// Push an accounting event into the queue of the MQTT accounting sink.
+func (s *MQTTSink) Push(e bpf.Event) {
+
+	// Use the time the event was captured in the kernel, unless configured
+	// to use the time the event was pushed into the sink.
+	if s.config.PushTimestamps {
+		e.Time = time.Now()
+	}
+
+	// Non-blocking send on event channel.
+	select {
+	case s.events <- e:
+		s.stats.IncrEventsPushed()
+		s.stats.SetBatchLength(len(s.events))
+	default:
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+	}
+}
+
+// Name gets the name of the MQTT accounting sink.
+func (s *MQTTSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the MQTT accounting sink was successfully initialized.
+func (s *MQTTSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate always returns true.
+func (s *MQTTSink) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, MQTT receives destroy events. (flow totals)
+func (s *MQTTSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew returns false, MQTT receives new flows as update events.
+func (s *MQTTSink) WantNew() bool {
+	return false
+}
+
+// Stats returns the MQTT accounting sink's statistics structure.
+func (s *MQTTSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// QueueStats returns the amount of events queued for the publish worker.
+func (s *MQTTSink) QueueStats() types.QueueStats {
+	return types.QueueStats{Length: len(s.events), Capacity: cap(s.events)}
+}
+
+// Close stops the MQTT accounting sink after publishing all queued events,
+// Healthy returns whether the sink is connected to its broker.
+func (s *MQTTSink) Healthy() bool {
+	return s.client.IsConnectionOpen()
+}
+
+// and disconnects from the broker.
+func (s *MQTTSink) Close() error {
+	close(s.events)
+	<-s.done
+	s.client.Disconnect(uint(s.config.WriteTimeout / time.Millisecond))
+	return nil
+}
+
+// publishWorker publishes the events on the sink's event channel. Events are
+// dropped without publishing them while the sink's breaker is open.
+// Exits when the event channel is closed.
+func (s *MQTTSink) publishWorker() {
+
+	defer close(s.done)
+
+	for e := range s.events {
+		if !s.breaker.Allow() {
+			s.stats.IncrMessageFailed()
+			s.config.OnDrop.Drop(e)
+		} else if err := s.publish(e); err != nil {
+			s.breaker.Failure()
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error publishing event, event dropped")
+			s.stats.IncrMessageFailed()
+			s.config.OnDrop.Drop(e)
+		} else {
+			s.breaker.Success()
+			s.stats.IncrMessagePublished()
+		}
+		s.stats.SetBatchLength(len(s.events))
+	}
+}
+
+// publish publishes an event to its topic. With a QoS above zero, waits for
+// the broker to acknowledge the message within the sink's write timeout.
+func (s *MQTTSink) publish(e bpf.Event) error {
+
+	t, err := s.topic.render(e)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	// The client queues messages while reconnecting and reports messages
+	// of QoS 0 as sent, drop them instead.
+	if !s.client.IsConnectionOpen() {
+		return paho.ErrNotConnected
+	}
+
+	return s.config.WriteLimiter.Do(func() error {
+		tok := s.client.Publish(t, s.config.QoS, s.config.Retain, b)
+		if !tok.WaitTimeout(s.config.WriteTimeout) {
+			return errPublishTimeout
+		}
+		return tok.Error()
+	})
+}
@@ -0,0 +1,239 @@
+package mqtt_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/mqtt"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// broker is a minimal MQTT broker recording the messages published to it.
+type broker struct {
+	l net.Listener
+
+	mu    sync.Mutex
+	conns []net.Conn
+	msgs  []*packets.PublishPacket
+}
+
+func newBroker(t *testing.T) *broker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	b := &broker{l: l}
+	go b.accept()
+
+	return b
+}
+
+func (b *broker) addr() string {
+	return "tcp://" + b.l.Addr().String()
+}
+
+func (b *broker) accept() {
+	for {
+		c, err := b.l.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns = append(b.conns, c)
+		b.mu.Unlock()
+		go b.serve(c)
+	}
+}
+
+// serve accepts the connection of a client, acknowledges its messages
+// and answers its pings.
+func (b *broker) serve(c net.Conn) {
+
+	defer c.Close()
+
+	for {
+		cp, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+
+		var resp packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			resp = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.mu.Lock()
+			b.msgs = append(b.msgs, p)
+			b.mu.Unlock()
+			if p.Qos == 1 {
+				pa := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				pa.MessageID = p.MessageID
+				resp = pa
+			}
+		case *packets.PingreqPacket:
+			resp = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+
+		if resp != nil {
+			if err := resp.Write(c); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dropConns closes the connections of all clients.
+func (b *broker) dropConns() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+func (b *broker) messages() []*packets.PublishPacket {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*packets.PublishPacket(nil), b.msgs...)
+}
+
+func (b *broker) close() {
+	b.l.Close()
+	b.dropConns()
+}
+
+func testEvent(id uint32, typ bpf.EventType) bpf.Event {
+	return bpf.Event{
+		Type:         typ,
+		ConnectionID: id,
+		SrcAddr:      net.ParseIP("10.0.0.1"),
+		DstAddr:      net.ParseIP("10.0.0.2"),
+		PacketsOrig:  1,
+		BytesOrig:    31,
+		SrcPort:      1234,
+		DstPort:      53,
+		Proto:        17,
+	}
+}
+
+func TestMQTTSink(t *testing.T) {
+
+	b := newBroker(t)
+	defer b.close()
+
+	s := mqtt.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:    "test",
+		Type:    types.MQTT,
+		Address: b.addr(),
+		Topic:   "conntracct/{{.Type}}/{{.DstPort}}",
+		QoS:     1,
+		Retain:  true,
+	}))
+
+	s.Push(testEvent(1, bpf.EventUpdate))
+	s.Push(testEvent(2, bpf.EventDestroy))
+
+	require.Eventually(t, func() bool {
+		return s.Stats().MessagesPublished == 2
+	}, time.Second, 10*time.Millisecond)
+
+	msgs := b.messages()
+	require.Len(t, msgs, 2)
+
+	assert.Equal(t, "conntracct/update/53", msgs[0].TopicName)
+	assert.Equal(t, "conntracct/destroy/53", msgs[1].TopicName)
+
+	for i, m := range msgs {
+		assert.EqualValues(t, 1, m.Qos)
+		assert.True(t, m.Retain)
+
+		var e bpf.Event
+		require.NoError(t, json.Unmarshal(m.Payload, &e))
+		assert.EqualValues(t, i+1, e.ConnectionID)
+		assert.Contains(t, string(m.Payload), fmt.Sprintf(`"schema_version":%d`, bpf.SchemaVersion))
+	}
+
+	assert.Zero(t, s.Stats().MessagesFailed)
+	require.NoError(t, s.Close())
+}
+
+func TestMQTTSinkReconnect(t *testing.T) {
+
+	b := newBroker(t)
+	defer b.close()
+
+	var dropped int
+	var mu sync.Mutex
+
+	s := mqtt.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:                 "test",
+		Type:                 types.MQTT,
+		Address:              b.addr(),
+		Topic:                "conntracct",
+		MaxReconnectInterval: 100 * time.Millisecond,
+		OnDrop: func(evs []bpf.Event) {
+			mu.Lock()
+			dropped += len(evs)
+			mu.Unlock()
+		},
+	}))
+	defer s.Close()
+
+	b.dropConns()
+
+	// Events pushed while the client is disconnected are dropped,
+	// until it reconnects.
+	require.Eventually(t, func() bool {
+		s.Push(testEvent(1, bpf.EventUpdate))
+		return len(b.messages()) != 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	st := s.Stats()
+	assert.NotZero(t, st.Reconnects)
+	assert.NotZero(t, st.MessagesPublished)
+
+	mu.Lock()
+	assert.EqualValues(t, st.MessagesFailed, dropped)
+	mu.Unlock()
+}
+
+func TestMQTTSinkInit(t *testing.T) {
+
+	b := newBroker(t)
+	defer b.close()
+
+	tests := []struct {
+		name string
+		sc   types.SinkConfig
+	}{
+		{"type", types.SinkConfig{Type: types.Redis, Name: "t", Address: b.addr(), Topic: "t"}},
+		{"name", types.SinkConfig{Type: types.MQTT, Address: b.addr(), Topic: "t"}},
+		{"address", types.SinkConfig{Type: types.MQTT, Name: "t", Topic: "t"}},
+		{"topic", types.SinkConfig{Type: types.MQTT, Name: "t", Address: b.addr()}},
+		{"wildcard", types.SinkConfig{Type: types.MQTT, Name: "t", Address: b.addr(), Topic: "conntracct/#"}},
+		{"template", types.SinkConfig{Type: types.MQTT, Name: "t", Address: b.addr(), Topic: "{{.Nope}}"}},
+		{"qos", types.SinkConfig{Type: types.MQTT, Name: "t", Address: b.addr(), Topic: "t", QoS: 3}},
+		{"broker", types.SinkConfig{Type: types.MQTT, Name: "t", Address: "tcp://127.0.0.1:1", Topic: "t"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := mqtt.New()
+			assert.Error(t, s.Init(tt.sc))
+			assert.False(t, s.IsInit())
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package mqtt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// topic renders the MQTT topic of an event. Not safe for concurrent use.
+type topic struct {
+	// Topic of all events if the topic has no template actions.
+	static string
+
+	tmpl *template.Template
+	buf  bytes.Buffer
+}
+
+// newTopic parses a topic template, executed with the event to publish,
+// eg. 'conntracct/{{.Type}}/{{.DstPort}}'. Returns an error if the template
+// can't be executed with an event.
+func newTopic(s string) (*topic, error) {
+
+	if !strings.Contains(s, "{{") {
+		if !validTopic(s) {
+			return nil, errInvalidTopic
+		}
+		return &topic{static: s}, nil
+	}
+
+	tmpl, err := template.New("topic").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("parsing topic: %s", err)
+	}
+
+	t := &topic{tmpl: tmpl}
+	if _, err := t.render(bpf.Event{}); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// render returns the topic of the event.
+func (t *topic) render(e bpf.Event) (string, error) {
+
+	if t.tmpl == nil {
+		return t.static, nil
+	}
+
+	t.buf.Reset()
+	if err := t.tmpl.Execute(&t.buf, e); err != nil {
+		return "", fmt.Errorf("rendering topic: %s", err)
+	}
+
+	s := t.buf.String()
+	if !validTopic(s) {
+		return "", errInvalidTopic
+	}
+
+	return s, nil
+}
+
+// validTopic returns true if s can be published to. Topics of published
+// messages can't be empty and can't contain wildcards.
+func validTopic(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "+#")
+}
@@ -0,0 +1,13 @@
+package parquet
+
+import "errors"
+
+const errFmtShardDir = "shard directory '%s' is empty or outside the sink's directory"
+
+var (
+	errEmptySinkName      = errors.New("empty sink name")
+	errEmptySinkDirectory = errors.New("empty sink directory")
+	errInvalidSinkType    = errors.New("invalid sink type")
+
+	errMemFile = errors.New("in-memory file only supports writing")
+)
@@ -0,0 +1,77 @@
+package parquet
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xitongsys/parquet-go/source"
+)
+
+// localFile is a source.ParquetFile backed by a file on the local filesystem.
+type localFile struct {
+	*os.File
+}
+
+// Create creates or truncates the file at the given path.
+func (f localFile) Create(name string) (source.ParquetFile, error) {
+	fd, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return localFile{fd}, nil
+}
+
+// Open opens the file at the given path for reading.
+func (f localFile) Open(name string) (source.ParquetFile, error) {
+	// Readers reopen the file for every column buffer without giving a name.
+	if name == "" {
+		name = f.Name()
+	}
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return localFile{fd}, nil
+}
+
+// memFile is a write-only source.ParquetFile buffering a file in memory,
+// so files can be encoded separately from writing them to disk.
+type memFile struct {
+	bytes.Buffer
+}
+
+// Close is a no-op, the buffer remains readable.
+func (f *memFile) Close() error {
+	return nil
+}
+
+// Seek always fails, the file is written sequentially.
+func (f *memFile) Seek(int64, int) (int64, error) {
+	return 0, errMemFile
+}
+
+// Open always fails, the file can't be reopened.
+func (f *memFile) Open(string) (source.ParquetFile, error) {
+	return nil, errMemFile
+}
+
+// Create always fails, the file has no name.
+func (f *memFile) Create(string) (source.ParquetFile, error) {
+	return nil, errMemFile
+}
+
+// filePath returns the path of the sink's file created at time t, relative
+// to the sink's directory. Files are partitioned by the UTC date and hour
+// they were created in, using Hive-style partition directories understood by
+// most query engines, eg. 'dt=2020-01-02/hour=15/<name>-<unix nanos>.parquet'.
+func filePath(name string, t time.Time) string {
+	t = t.UTC()
+	return filepath.Join(
+		"dt="+t.Format("2006-01-02"),
+		"hour="+t.Format("15"),
+		fmt.Sprintf("%s-%d.parquet", name, t.UnixNano()),
+	)
+}
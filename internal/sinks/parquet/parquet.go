@@ -0,0 +1,181 @@
+package parquet
+
+import (
+	"os"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/encpool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	// Maximum amount of events in a single file.
+	defaultBatchSize = 65536
+
+	// Maximum time events are buffered before they are written to a file.
+	defaultRotateInterval = 5 * time.Minute
+
+	// Maximum amount of shards buffering events at once.
+	defaultMaxShards = 64
+
+	// Amount of events that can be queued in the sink before
+	// new events are dropped.
+	eventQueueLength = 8192
+)
+
+// ParquetSink is an accounting sink writing events to Apache Parquet files
+// in a local directory, partitioned by the time they were created. See row
+// for the schema of the files. Files are written in full when rotated, and
+// only appear under their final name once complete, so the directory can be
+// synced to object storage by an external tool. Files can be sharded into
+// separate directories by a key of their events, see SinkConfig.ShardBy.
+type ParquetSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Queue of events to be written to files.
+	events chan bpf.Event
+
+	// Renders the shard directory of events.
+	sharder *sharder
+
+	// Shards by their directory, each collecting queued events into the
+	// batches written to its files. Only accessed by the writeWorker.
+	shards    map[string]*shard
+	maxShards int
+
+	// Encodes batches while earlier files are being written, nil if
+	// the sink has no EncodeConcurrency.
+	encoders *encpool.Pool
+
+	// Closed by the worker when it exits after Close.
+	done chan struct{}
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new Parquet accounting sink.
+func New() ParquetSink {
+	return ParquetSink{}
+}
+
+// Init initializes the Parquet accounting sink.
+func (s *ParquetSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.Parquet {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.Directory == "" {
+		return errEmptySinkDirectory
+	}
+	if sc.BatchSize == 0 {
+		sc.BatchSize = defaultBatchSize
+	}
+	if sc.RotateInterval == 0 {
+		sc.RotateInterval = defaultRotateInterval
+	}
+	if sc.MaxShards == 0 {
+		sc.MaxShards = defaultMaxShards
+	}
+
+	sh, err := newSharder(sc.ShardBy)
+	if err != nil {
+		return err
+	}
+
+	// Fail early if the directory can't be created.
+	if err := os.MkdirAll(sc.Directory, 0755); err != nil {
+		return err
+	}
+
+	s.config = sc
+	s.events = make(chan bpf.Event, eventQueueLength)
+	s.done = make(chan struct{})
+	s.sharder = sh
+	s.shards = make(map[string]*shard)
+	s.maxShards = int(sc.MaxShards)
+	if sc.EncodeConcurrency > 1 {
+		s.encoders = encpool.New(int(sc.EncodeConcurrency), s.encodeBatch, s.writeBatch)
+	}
+
+	go s.writeWorker()
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// Push an accounting event into the queue of the Parquet accounting sink.
+func (s *ParquetSink) Push(e bpf.Event) {
+
+	// Use the time the event was captured in the kernel, unless configured
+	// to use the time the event was pushed into the sink.
+	if s.config.PushTimestamps {
+		e.Time = time.Now()
+	}
+
+	// Non-blocking send on event channel.
+	select {
+	case s.events <- e:
+		s.stats.IncrEventsPushed()
+	default:
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+	}
+}
+
+// Name gets the name of the Parquet accounting sink.
+func (s *ParquetSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the Parquet accounting sink was successfully initialized.
+func (s *ParquetSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate always returns true.
+func (s *ParquetSink) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, Parquet files hold destroy events. (flow totals)
+func (s *ParquetSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew returns false, Parquet files hold new flows as update events.
+func (s *ParquetSink) WantNew() bool {
+	return false
+}
+
+// Stats returns the Parquet accounting sink's statistics structure.
+func (s *ParquetSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// QueueStats returns the amount of events queued for the write worker. The
+// batches of the sink's shards are only accessed by the worker, their age
+// isn't reported.
+func (s *ParquetSink) QueueStats() types.QueueStats {
+	return types.QueueStats{Length: len(s.events), Capacity: cap(s.events)}
+}
+
+// Close stops the Parquet accounting sink after writing all queued
+// and buffered events to a final file.
+func (s *ParquetSink) Close() error {
+	close(s.events)
+	<-s.done
+	return nil
+}
@@ -0,0 +1,348 @@
+package parquet
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func testEvent(id uint32) bpf.Event {
+	return bpf.Event{
+		Type:         bpf.EventUpdate,
+		ConnectionID: id,
+		SrcAddr:      net.ParseIP("10.0.0.1"),
+		DstAddr:      net.ParseIP("10.0.0.2"),
+		PacketsOrig:  uint64(id),
+		BytesOrig:    31,
+		SrcPort:      1234,
+		DstPort:      53,
+		Proto:        17,
+		Duration:     time.Second,
+		Labels:       map[string]string{"host": "test"},
+		Time:         time.Unix(1577977200, 0),
+	}
+}
+
+// readFiles returns the rows of all Parquet files in dir.
+func readFiles(t *testing.T, dir string) (files []string, rows []row) {
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		if fi.IsDir() {
+			return nil
+		}
+		files = append(files, path)
+
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+
+		pr, err := reader.NewParquetReader(localFile{f}, new(row), 1)
+		require.NoError(t, err)
+		defer pr.ReadStop()
+
+		r := make([]row, pr.GetNumRows())
+		require.NoError(t, pr.Read(&r))
+		rows = append(rows, r...)
+
+		return nil
+	})
+	require.NoError(t, err)
+
+	return
+}
+
+func TestParquetSink(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:      "test",
+		Type:      types.Parquet,
+		Directory: dir,
+		BatchSize: 2,
+	}))
+
+	e := testEvent(3)
+	e.Type = bpf.EventDestroy
+	e.Delta = &bpf.Counters{PacketsOrig: 1, BytesOrig: 10}
+
+	s.Push(testEvent(1))
+	s.Push(testEvent(2))
+	s.Push(e)
+
+	// Close writes the third event to a second file.
+	require.NoError(t, s.Close())
+
+	st := s.Stats()
+	assert.EqualValues(t, 3, st.EventsPushed)
+	assert.EqualValues(t, 2, st.FilesWritten)
+	assert.Zero(t, st.FilesFailed)
+
+	files, rows := readFiles(t, dir)
+	require.Len(t, files, 2)
+	require.Len(t, rows, 3)
+
+	for _, f := range files {
+		rel, err := filepath.Rel(dir, f)
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(filepath.Base(rel), "test-"), rel)
+		assert.Equal(t, ".parquet", filepath.Ext(rel))
+		assert.Regexp(t, `^dt=\d{4}-\d{2}-\d{2}/hour=\d{2}/`, rel)
+	}
+
+	// Files are named after their creation time, walked in order.
+	for i, r := range rows[:2] {
+		assert.EqualValues(t, bpf.SchemaVersion, r.SchemaVersion)
+		assert.EqualValues(t, i+1, r.ConnectionID)
+		assert.Equal(t, "update", r.Type)
+		assert.Nil(t, r.PacketsOrigDelta)
+	}
+
+	r := rows[2]
+	assert.Equal(t, "destroy", r.Type)
+	assert.EqualValues(t, 1577977200000, r.Time)
+	assert.Equal(t, "10.0.0.1", r.SrcAddr)
+	assert.Equal(t, "10.0.0.2", r.DstAddr)
+	assert.Zero(t, r.SrcPort, "source port written without EnableSrcPort")
+	assert.EqualValues(t, 53, r.DstPort)
+	assert.EqualValues(t, 17, r.Proto)
+	assert.EqualValues(t, 3, r.PacketsOrig)
+	assert.EqualValues(t, 31, r.BytesOrig)
+	assert.EqualValues(t, time.Second, r.Duration)
+	assert.Equal(t, map[string]string{"host": "test"}, r.Labels)
+	require.NotNil(t, r.PacketsOrigDelta)
+	require.NotNil(t, r.BytesOrigDelta)
+	assert.EqualValues(t, 1, *r.PacketsOrigDelta)
+	assert.EqualValues(t, 10, *r.BytesOrigDelta)
+	require.NotNil(t, r.BytesRetDelta)
+	assert.Zero(t, *r.BytesRetDelta)
+}
+
+func TestParquetSinkEncoders(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:              "test",
+		Type:              types.Parquet,
+		Directory:         dir,
+		BatchSize:         10,
+		EncodeConcurrency: 4,
+	}))
+
+	for i := uint32(1); i <= 100; i++ {
+		s.Push(testEvent(i))
+	}
+	require.NoError(t, s.Close())
+
+	assert.EqualValues(t, 10, s.Stats().FilesWritten)
+
+	// Files are written in order, walked in order of their creation time.
+	_, rows := readFiles(t, dir)
+	require.Len(t, rows, 100)
+	for i, r := range rows {
+		assert.EqualValues(t, i+1, r.ConnectionID)
+	}
+}
+
+func TestParquetSinkRotate(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:           "test",
+		Type:           types.Parquet,
+		Directory:      dir,
+		RotateInterval: 10 * time.Millisecond,
+	}))
+	defer s.Close()
+
+	s.Push(testEvent(1))
+
+	// The event is written once the interval passes.
+	for i := 0; i < 100 && s.Stats().FilesWritten == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, rows := readFiles(t, dir)
+	require.Len(t, rows, 1)
+	assert.EqualValues(t, 1, rows[0].ConnectionID)
+}
+
+func TestParquetSinkMaxBatchEvents(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:           "test",
+		Type:           types.Parquet,
+		Directory:      dir,
+		MaxBatchEvents: 2,
+		RotateInterval: time.Hour,
+	}))
+	defer s.Close()
+
+	for i := uint32(1); i <= 5; i++ {
+		s.Push(testEvent(i))
+	}
+
+	// A file is written for every two events, without waiting for rotation.
+	for i := 0; i < 100 && s.Stats().FilesWritten < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files, rows := readFiles(t, dir)
+	assert.Len(t, files, 2)
+	assert.Len(t, rows, 4)
+}
+
+func TestParquetSinkShard(t *testing.T) {
+
+	// The shard of the TCP flow comes first.
+	tests := []struct {
+		key  string
+		dirs []string
+	}{
+		{"proto", []string{"proto=tcp", "proto=udp"}},
+		{"netns", []string{"netns=2", "netns=1"}},
+		{"port={{.DstPort}}", []string{"port=443", "port=53"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+
+			dir, err := ioutil.TempDir("", "conntracct-parquet")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			s := New()
+			require.NoError(t, s.Init(types.SinkConfig{
+				Name:      "test",
+				Type:      types.Parquet,
+				Directory: dir,
+				ShardBy:   tt.key,
+			}))
+
+			// Two UDP flows to port 53 in netns 1, one TCP flow to port 443
+			// in netns 2.
+			for i := uint32(1); i <= 3; i++ {
+				e := testEvent(i)
+				e.NetNS = 1
+				if i == 3 {
+					e.Proto, e.DstPort, e.NetNS = 6, 443, 2
+				}
+				s.Push(e)
+			}
+			require.NoError(t, s.Close())
+			assert.EqualValues(t, 2, s.Stats().FilesWritten)
+
+			// Each shard's events land in its own directory.
+			for i, d := range tt.dirs {
+				files, rows := readFiles(t, filepath.Join(dir, d))
+				require.Len(t, files, 1, d)
+				assert.True(t, strings.HasPrefix(files[0], filepath.Join(dir, d, "dt=2")), files[0])
+				if i == 0 {
+					require.Len(t, rows, 1, d)
+					assert.EqualValues(t, 3, rows[0].ConnectionID)
+				} else {
+					assert.Len(t, rows, 2, d)
+				}
+			}
+		})
+	}
+}
+
+func TestParquetSinkMaxShards(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:      "test",
+		Type:      types.Parquet,
+		Directory: dir,
+		ShardBy:   "netns",
+		MaxShards: 1,
+	}))
+	defer s.Close()
+
+	// A second shard closes the first one, writing its file early.
+	for i := uint32(1); i <= 2; i++ {
+		e := testEvent(i)
+		e.NetNS = i
+		s.Push(e)
+	}
+
+	for i := 0; i < 100 && s.Stats().FilesWritten == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	files, rows := readFiles(t, dir)
+	require.Len(t, files, 1)
+	assert.Contains(t, files[0], "netns=1")
+	assert.EqualValues(t, 1, rows[0].ConnectionID)
+}
+
+func TestParquetSinkIdleShards(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Drive the sink's shards without its writeWorker.
+	sh, err := newSharder("proto")
+	require.NoError(t, err)
+	s := &ParquetSink{
+		config:    types.SinkConfig{Name: "test", Directory: dir, BatchSize: 100, RotateInterval: time.Hour},
+		sharder:   sh,
+		shards:    make(map[string]*shard),
+		maxShards: 64,
+	}
+
+	s.addEvent(testEvent(1))
+	s.closeIdleShards(time.Now().Add(-time.Minute))
+	assert.Len(t, s.shards, 1, "closed shard that received events")
+
+	s.closeIdleShards(time.Now().Add(time.Minute))
+	assert.Empty(t, s.shards)
+	files, _ := readFiles(t, dir)
+	assert.Len(t, files, 1)
+}
+
+func TestParquetSinkInit(t *testing.T) {
+	s := New()
+	assert.Equal(t, errEmptySinkDirectory, s.Init(types.SinkConfig{Name: "test", Type: types.Parquet}))
+	assert.Equal(t, errInvalidSinkType, s.Init(types.SinkConfig{Name: "test", Type: types.Redis}))
+
+	sc := types.SinkConfig{Name: "test", Type: types.Parquet, Directory: os.TempDir()}
+	for _, key := range []string{"{{.Nope}}", "{{", "../{{.Proto}}", "/abs", "{{if .Proto}}x{{end}}"} {
+		sc.ShardBy = key
+		assert.Error(t, s.Init(sc), key)
+	}
+}
@@ -0,0 +1,150 @@
+package parquet
+
+import (
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// row is the schema of the rows in the sink's Parquet files, one row per
+// event. Columns are named after the JSON names of the bpf.Event fields and
+// hold the same values, with the following exceptions:
+//
+//   - time is the event's wall-clock time in milliseconds since the epoch.
+//   - type and trigger_dir are names, eg. 'update' and 'reply'.
+//   - src_addr and dst_addr are the text representation of the addresses,
+//     src_mac and dst_mac of the Ethernet addresses, empty if unset.
+//   - duration is the flow's duration in nanoseconds.
+//   - src_port is zero unless the sink has EnableSrcPort set.
+//   - The counters of the event's Delta are flattened into the optional
+//     *_delta columns, which are null for events without a Delta.
+//   - schema_version is bpf.SchemaVersion, like in the event's JSON form.
+//
+// Unsigned event fields keep their width, using the UINT_* logical types.
+// Adding columns is a compatible change for readers of older files,
+// renaming or removing them is not.
+type row struct {
+	SchemaVersion uint32 `parquet:"name=schema_version, type=UINT_32"`
+
+	Time         int64  `parquet:"name=time, type=TIMESTAMP_MILLIS"`
+	Type         string `parquet:"name=type, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Start        uint64 `parquet:"name=start, type=UINT_64"`
+	Timestamp    uint64 `parquet:"name=timestamp, type=UINT_64"`
+	ConnectionID uint32 `parquet:"name=connection_id, type=UINT_32"`
+	Connmark     uint32 `parquet:"name=connmark, type=UINT_32"`
+	SrcAddr      string `parquet:"name=src_addr, type=UTF8"`
+	DstAddr      string `parquet:"name=dst_addr, type=UTF8"`
+	SrcPort      uint16 `parquet:"name=src_port, type=UINT_16"`
+	DstPort      uint16 `parquet:"name=dst_port, type=UINT_16"`
+	NetNS        uint32 `parquet:"name=netns, type=UINT_32"`
+	Proto        uint8  `parquet:"name=proto, type=UINT_8"`
+	CPU          uint32 `parquet:"name=cpu, type=UINT_32"`
+	Service      string `parquet:"name=service, type=UTF8, encoding=PLAIN_DICTIONARY"`
+
+	PacketsOrig uint64 `parquet:"name=packets_orig, type=UINT_64"`
+	BytesOrig   uint64 `parquet:"name=bytes_orig, type=UINT_64"`
+	PacketsRet  uint64 `parquet:"name=packets_ret, type=UINT_64"`
+	BytesRet    uint64 `parquet:"name=bytes_ret, type=UINT_64"`
+
+	PacketsOrigDelta *uint64 `parquet:"name=packets_orig_delta, type=UINT_64, repetitiontype=OPTIONAL"`
+	BytesOrigDelta   *uint64 `parquet:"name=bytes_orig_delta, type=UINT_64, repetitiontype=OPTIONAL"`
+	PacketsRetDelta  *uint64 `parquet:"name=packets_ret_delta, type=UINT_64, repetitiontype=OPTIONAL"`
+	BytesRetDelta    *uint64 `parquet:"name=bytes_ret_delta, type=UINT_64, repetitiontype=OPTIONAL"`
+
+	BytesOrigAdjusted uint64 `parquet:"name=bytes_orig_adjusted, type=UINT_64"`
+	BytesRetAdjusted  uint64 `parquet:"name=bytes_ret_adjusted, type=UINT_64"`
+
+	BytesIn   uint64 `parquet:"name=bytes_in, type=UINT_64"`
+	BytesOut  uint64 `parquet:"name=bytes_out, type=UINT_64"`
+	Forwarded bool   `parquet:"name=forwarded, type=BOOLEAN"`
+
+	SeenReply   bool   `parquet:"name=seen_reply, type=BOOLEAN"`
+	Assured     bool   `parquet:"name=assured, type=BOOLEAN"`
+	Unaccounted bool   `parquet:"name=unaccounted, type=BOOLEAN"`
+	Expected    bool   `parquet:"name=expected, type=BOOLEAN"`
+	Status      uint32 `parquet:"name=status, type=UINT_32"`
+
+	Helper     string `parquet:"name=helper, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	TriggerDir string `parquet:"name=trigger_dir, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	SrcMAC     string `parquet:"name=src_mac, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	DstMAC     string `parquet:"name=dst_mac, type=UTF8, encoding=PLAIN_DICTIONARY"`
+
+	Seq      uint32 `parquet:"name=seq, type=UINT_32"`
+	SynCount uint32 `parquet:"name=syn_count, type=UINT_32"`
+	FinCount uint32 `parquet:"name=fin_count, type=UINT_32"`
+	RstCount uint32 `parquet:"name=rst_count, type=UINT_32"`
+	Duration int64  `parquet:"name=duration, type=INT64"`
+
+	Labels map[string]string `parquet:"name=labels, type=MAP, keytype=UTF8, valuetype=UTF8"`
+}
+
+// newRow returns the row of the event. The source port is only
+// set if srcPort is true.
+func newRow(e bpf.Event, srcPort bool) row {
+
+	r := row{
+		SchemaVersion: bpf.SchemaVersion,
+
+		Time:         e.Time.UnixNano() / int64(time.Millisecond),
+		Type:         e.Type.String(),
+		Start:        e.Start,
+		Timestamp:    e.Timestamp,
+		ConnectionID: e.ConnectionID,
+		Connmark:     e.Connmark,
+		SrcAddr:      e.SrcAddr.String(),
+		DstAddr:      e.DstAddr.String(),
+		DstPort:      e.DstPort,
+		NetNS:        e.NetNS,
+		Proto:        e.Proto,
+		CPU:          e.CPU,
+		Service:      e.Service,
+
+		PacketsOrig: e.PacketsOrig,
+		BytesOrig:   e.BytesOrig,
+		PacketsRet:  e.PacketsRet,
+		BytesRet:    e.BytesRet,
+
+		BytesOrigAdjusted: e.BytesOrigAdjusted,
+		BytesRetAdjusted:  e.BytesRetAdjusted,
+
+		BytesIn:   e.BytesIn,
+		BytesOut:  e.BytesOut,
+		Forwarded: e.Forwarded,
+
+		SeenReply:   e.SeenReply,
+		Assured:     e.Assured,
+		Unaccounted: e.Unaccounted,
+		Expected:    e.Expected,
+		Status:      uint32(e.Status),
+
+		Helper: e.Helper,
+		SrcMAC: e.SrcMAC.String(),
+		DstMAC: e.DstMAC.String(),
+
+		Seq:      e.Seq,
+		SynCount: e.SynCount,
+		FinCount: e.FinCount,
+		RstCount: e.RstCount,
+		Duration: int64(e.Duration),
+
+		Labels: e.Labels,
+	}
+
+	if srcPort {
+		r.SrcPort = e.SrcPort
+	}
+
+	// Empty in destroy events.
+	if e.TriggerDir != 0 {
+		r.TriggerDir = e.TriggerDir.String()
+	}
+
+	if d := e.Delta; d != nil {
+		r.PacketsOrigDelta = &d.PacketsOrig
+		r.BytesOrigDelta = &d.BytesOrig
+		r.PacketsRetDelta = &d.PacketsRet
+		r.BytesRetDelta = &d.BytesRet
+	}
+
+	return r
+}
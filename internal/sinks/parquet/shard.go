@@ -0,0 +1,161 @@
+package parquet
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Sharding keys of the Parquet sink, see SinkConfig.ShardBy.
+const (
+	shardProto = "proto"
+	shardNetNS = "netns"
+)
+
+// sharder renders the directory of the shard an event is written to,
+// relative to the sink's directory. Safe for concurrent use.
+type sharder struct {
+	key  string
+	tmpl *template.Template
+}
+
+// newSharder returns a sharder for the given key: 'proto', 'netns' or a
+// text/template executed with the event, eg. 'port={{.DstPort}}'. Events
+// are not sharded if the key is empty. Returns an error if the template
+// can't be executed with an event.
+func newSharder(key string) (*sharder, error) {
+
+	sh := &sharder{key: key}
+
+	switch key {
+	case "", shardProto, shardNetNS:
+		return sh, nil
+	}
+
+	tmpl, err := template.New("shard").Parse(key)
+	if err != nil {
+		return nil, fmt.Errorf("parsing shard key: %s", err)
+	}
+	sh.tmpl = tmpl
+
+	if _, err := sh.dir(bpf.Event{}); err != nil {
+		return nil, err
+	}
+
+	return sh, nil
+}
+
+// dir returns the directory of the event's shard, eg. 'proto=tcp'.
+// Returns an empty directory if events are not sharded.
+func (sh *sharder) dir(e bpf.Event) (string, error) {
+
+	switch sh.key {
+	case "":
+		return "", nil
+	case shardProto:
+		return "proto=" + helpers.ProtoIntStr(e.Proto), nil
+	case shardNetNS:
+		return "netns=" + strconv.FormatUint(uint64(e.NetNS), 10), nil
+	}
+
+	var b strings.Builder
+	if err := sh.tmpl.Execute(&b, e); err != nil {
+		return "", fmt.Errorf("rendering shard key: %s", err)
+	}
+
+	// Shards can't escape the sink's directory.
+	d := filepath.Clean(b.String())
+	if b.Len() == 0 || filepath.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../") {
+		return "", fmt.Errorf(errFmtShardDir, b.String())
+	}
+
+	return d, nil
+}
+
+// shard is a directory of the sink's files, with its own batch of events
+// pending to be written to its next file.
+type shard struct {
+	batcher *batch.Batcher
+
+	// Time the shard last received an event.
+	seen time.Time
+}
+
+// addEvent adds an event to the batch of its shard, opening the shard if
+// needed. Drops the event if its shard can't be rendered.
+func (s *ParquetSink) addEvent(e bpf.Event) {
+
+	dir, err := s.sharder.dir(e)
+	if err != nil {
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+		return
+	}
+
+	sh, ok := s.shards[dir]
+	if !ok {
+		if len(s.shards) >= s.maxShards {
+			s.evictShard()
+		}
+		sh = &shard{batcher: s.newBatcher()}
+		s.shards[dir] = sh
+	}
+
+	sh.seen = time.Now()
+	sh.batcher.Add(e)
+	s.stats.SetBatchLength(sh.batcher.Len())
+}
+
+// newBatcher returns the batcher of a new shard, writing a batch to a new
+// file when it holds BatchSize events or RotateInterval has passed.
+func (s *ParquetSink) newBatcher() *batch.Batcher {
+	return batch.New(batch.Config{
+		Size:      int(s.config.BatchSize),
+		MaxEvents: int(s.config.MaxBatchEvents),
+		Bytes:     s.config.BatchBytes,
+		Interval:  s.config.RotateInterval,
+	}, s.batchReady)
+}
+
+// evictShard closes the least recently used shard,
+// writing its pending events to a file.
+func (s *ParquetSink) evictShard() {
+
+	var oldest string
+	var t time.Time
+	for dir, sh := range s.shards {
+		if t.IsZero() || sh.seen.Before(t) {
+			oldest, t = dir, sh.seen
+		}
+	}
+
+	s.shards[oldest].batcher.Close()
+	delete(s.shards, oldest)
+}
+
+// closeIdleShards closes the shards that haven't received any events since
+// before the given time. Their batches were already written when their last
+// RotateInterval passed.
+func (s *ParquetSink) closeIdleShards(before time.Time) {
+	for dir, sh := range s.shards {
+		if sh.seen.Before(before) {
+			sh.batcher.Close()
+			delete(s.shards, dir)
+		}
+	}
+}
+
+// closeShards closes all shards, writing their pending events to files.
+func (s *ParquetSink) closeShards() {
+	for dir, sh := range s.shards {
+		sh.batcher.Close()
+		delete(s.shards, dir)
+	}
+}
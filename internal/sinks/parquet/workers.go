@@ -0,0 +1,150 @@
+package parquet
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// writeWorker receives events from the sink's event channel and adds them
+// to the batcher of their shard, which writes a batch to a new file when it
+// holds BatchSize events or RotateInterval has passed. Closes shards that
+// didn't receive events for a RotateInterval. Writes the remaining events
+// and exits when the event channel is closed.
+func (s *ParquetSink) writeWorker() {
+
+	defer close(s.done)
+
+	t := time.NewTicker(s.config.RotateInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.closeShards()
+				if s.encoders != nil {
+					s.encoders.Close()
+				}
+				return
+			}
+			s.addEvent(e)
+		case now := <-t.C:
+			s.closeIdleShards(now.Add(-s.config.RotateInterval))
+		}
+	}
+}
+
+// encodedFile is the result of encoding a batch into a file.
+type encodedFile struct {
+	data []byte
+	err  error
+}
+
+// batchReady writes a batch to a new file, named after the time
+// its first event was received. With EncodeConcurrency, the batch is
+// handed to the sink's encoders instead, and written once encoded.
+func (s *ParquetSink) batchReady(b batch.Batch) {
+
+	if s.encoders != nil {
+		s.encoders.Submit(b)
+		return
+	}
+
+	s.writeBatch(b, s.encodeBatch(b))
+}
+
+// encodeBatch encodes the events of a batch into a file in memory.
+// Returns an encodedFile.
+func (s *ParquetSink) encodeBatch(b batch.Batch) interface{} {
+	data, err := encodeFile(b.Events, s.config.EnableSrcPort)
+	return encodedFile{data, err}
+}
+
+// writeBatch writes a batch's encoded file to the directory of its shard.
+// The batch's events are dropped if encoding or writing failed.
+func (s *ParquetSink) writeBatch(b batch.Batch, enc interface{}) {
+
+	f := enc.(encodedFile)
+	err := f.err
+	if err == nil {
+		// All events of a batch belong to the same shard.
+		var dir string
+		if dir, err = s.sharder.dir(b.Events[0]); err == nil {
+			err = s.writeFile(filepath.Join(dir, filePath(s.config.Name, b.Started)), f.data)
+		}
+	}
+
+	if err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing file, events dropped")
+		s.stats.IncrFilesFailed()
+		s.config.OnDrop.Drop(b.Events...)
+	} else {
+		s.stats.IncrFilesWritten()
+	}
+
+	s.stats.SetBatchLength(0)
+}
+
+// encodeFile encodes the events into the contents of a Parquet file.
+// The source port is only written if srcPort is true.
+func encodeFile(evs []bpf.Event, srcPort bool) ([]byte, error) {
+
+	var f memFile
+	pw, err := writer.NewParquetWriter(&f, new(row), 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range evs {
+		if err := pw.Write(newRow(e, srcPort)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := pw.WriteStop(); err != nil {
+		return nil, err
+	}
+
+	return f.Bytes(), nil
+}
+
+// writeFile writes the contents of a file to a new file at the given path,
+// relative to the sink's directory. The file is written to a hidden temporary
+// file next to its destination and renamed when complete. The temporary file
+// is removed if writing fails.
+func (s *ParquetSink) writeFile(name string, data []byte) (err error) {
+
+	path := filepath.Join(s.config.Directory, name)
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+		}
+	}()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,13 @@
+package prometheus
+
+import "errors"
+
+const (
+	errFmtBuckets       = "%s buckets must be in increasing order"
+	errFmtReservedLabel = "label '%s' is reserved by the sink"
+)
+
+var (
+	errEmptySinkName   = errors.New("empty sink name")
+	errInvalidSinkType = errors.New("invalid sink type")
+)
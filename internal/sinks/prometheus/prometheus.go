@@ -0,0 +1,198 @@
+package prometheus
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const namespace = "conntracct"
+
+var (
+	// Default buckets of the flow size histograms, from 64 bytes
+	// to 16MiB and from 1 to 262144 packets.
+	defaultByteBuckets   = prom.ExponentialBuckets(64, 4, 10)
+	defaultPacketBuckets = prom.ExponentialBuckets(1, 4, 10)
+)
+
+// PromSink is an accounting sink observing the totals of finished flows
+// into Prometheus histograms of bytes and packets per flow. Histograms are
+// labeled by protocol only, to keep their cardinality low. The pipeline's
+// static labels are added as constant labels.
+type PromSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Registry holding the sink's collectors.
+	registry *prom.Registry
+
+	// Histograms of the totals of destroyed flows.
+	bytes   *prom.HistogramVec
+	packets *prom.HistogramVec
+
+	// HTTP server exposing the registry, nil if the sink has no address.
+	server   *http.Server
+	listener net.Listener
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new Prometheus accounting sink.
+func New() PromSink {
+	return PromSink{}
+}
+
+// Init initializes the Prometheus accounting sink. If an address is
+// configured, the sink's metrics are served over HTTP at /metrics.
+func (s *PromSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.Prometheus {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if len(sc.ByteBuckets) == 0 {
+		sc.ByteBuckets = defaultByteBuckets
+	}
+	if len(sc.PacketBuckets) == 0 {
+		sc.PacketBuckets = defaultPacketBuckets
+	}
+
+	// The client library panics on unsorted buckets.
+	if !increasing(sc.ByteBuckets) {
+		return fmt.Errorf(errFmtBuckets, "byte")
+	}
+	if !increasing(sc.PacketBuckets) {
+		return fmt.Errorf(errFmtBuckets, "packet")
+	}
+
+	labels := prom.Labels{"sink": sc.Name}
+	for k, v := range sc.Labels {
+		if k == "sink" || k == "proto" {
+			return fmt.Errorf(errFmtReservedLabel, k)
+		}
+		labels[k] = v
+	}
+
+	s.bytes = prom.NewHistogramVec(prom.HistogramOpts{
+		Namespace:   namespace,
+		Name:        "flow_bytes",
+		Help:        "Total bytes (both directions) of finished flows.",
+		ConstLabels: labels,
+		Buckets:     sc.ByteBuckets,
+	}, []string{"proto"})
+
+	s.packets = prom.NewHistogramVec(prom.HistogramOpts{
+		Namespace:   namespace,
+		Name:        "flow_packets",
+		Help:        "Total packets (both directions) of finished flows.",
+		ConstLabels: labels,
+		Buckets:     sc.PacketBuckets,
+	}, []string{"proto"})
+
+	// Registering fails on invalid label names.
+	s.registry = prom.NewRegistry()
+	if err := s.registry.Register(s.bytes); err != nil {
+		return err
+	}
+	if err := s.registry.Register(s.packets); err != nil {
+		return err
+	}
+
+	if sc.Address != "" {
+		l, err := net.Listen("tcp", sc.Address)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{}))
+
+		s.server = &http.Server{Handler: mux}
+		s.listener = l
+		go func() { _ = s.server.Serve(l) }()
+	}
+
+	s.config = sc
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// Push observes the totals of a destroyed flow into the sink's histograms.
+func (s *PromSink) Push(e bpf.Event) {
+
+	if e.Type != bpf.EventDestroy {
+		return
+	}
+
+	proto := strconv.Itoa(int(e.Proto))
+	s.bytes.WithLabelValues(proto).Observe(float64(e.BytesOrig + e.BytesRet))
+	s.packets.WithLabelValues(proto).Observe(float64(e.PacketsOrig + e.PacketsRet))
+
+	s.stats.IncrEventsPushed()
+}
+
+// Name gets the name of the Prometheus accounting sink.
+func (s *PromSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the Prometheus accounting sink was successfully initialized.
+func (s *PromSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate returns false, histograms are only built from flow totals.
+func (s *PromSink) WantUpdate() bool {
+	return false
+}
+
+// WantDestroy always returns true, Prometheus receives destroy events. (flow totals)
+func (s *PromSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew returns false, histograms are only built from flow totals.
+func (s *PromSink) WantNew() bool {
+	return false
+}
+
+// Stats returns the Prometheus accounting sink's statistics structure.
+func (s *PromSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// Close stops the sink's HTTP server, if any.
+func (s *PromSink) Close() error {
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
+
+// increasing returns true if the values in b are strictly increasing.
+func increasing(b []float64) bool {
+	for i := 1; i < len(b); i++ {
+		if b[i] <= b[i-1] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package prometheus
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// histogram returns the histogram with the given name and proto label
+// from the sink's registry.
+func histogram(t *testing.T, s *PromSink, name, proto string) *dto.Histogram {
+
+	mfs, err := s.registry.Gather()
+	require.NoError(t, err)
+
+	for _, mf := range mfs {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "proto" && l.GetValue() == proto {
+					return m.GetHistogram()
+				}
+			}
+		}
+	}
+
+	t.Fatalf("histogram %s{proto=%s} not found", name, proto)
+	return nil
+}
+
+// cumulative returns the cumulative bucket counts of a histogram.
+func cumulative(h *dto.Histogram) []uint64 {
+	var out []uint64
+	for _, b := range h.GetBucket() {
+		out = append(out, b.GetCumulativeCount())
+	}
+	return out
+}
+
+func TestPromSinkHistograms(t *testing.T) {
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:          "test",
+		Type:          types.Prometheus,
+		ByteBuckets:   []float64{100, 1000, 10000},
+		PacketBuckets: []float64{1, 10},
+	}))
+	defer s.Close()
+
+	// Flows of known sizes.
+	flows := []struct{ bytes, packets uint64 }{
+		{50, 1},
+		{100, 2},
+		{500, 5},
+		{5000, 50},
+		{50000, 500},
+	}
+	for _, f := range flows {
+		s.Push(bpf.Event{
+			Type:        bpf.EventDestroy,
+			Proto:       6,
+			BytesOrig:   f.bytes / 2,
+			BytesRet:    f.bytes - f.bytes/2,
+			PacketsOrig: f.packets,
+		})
+	}
+
+	// Updates are not flow totals and are ignored.
+	s.Push(bpf.Event{Type: bpf.EventUpdate, Proto: 6, BytesOrig: 1})
+
+	// A flow of another protocol is counted in its own histogram.
+	s.Push(bpf.Event{Type: bpf.EventDestroy, Proto: 17, BytesOrig: 10, PacketsOrig: 1})
+
+	hb := histogram(t, &s, "conntracct_flow_bytes", "6")
+	assert.EqualValues(t, 5, hb.GetSampleCount())
+	assert.EqualValues(t, 55650, hb.GetSampleSum())
+	assert.Equal(t, []uint64{2, 3, 4}, cumulative(hb))
+
+	hp := histogram(t, &s, "conntracct_flow_packets", "6")
+	assert.EqualValues(t, 5, hp.GetSampleCount())
+	assert.Equal(t, []uint64{1, 3}, cumulative(hp))
+
+	hu := histogram(t, &s, "conntracct_flow_bytes", "17")
+	assert.Equal(t, []uint64{1, 1, 1}, cumulative(hu))
+
+	assert.EqualValues(t, 6, s.Stats().EventsPushed)
+}
+
+func TestPromSinkHTTP(t *testing.T) {
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:    "test",
+		Type:    types.Prometheus,
+		Address: "127.0.0.1:0",
+	}))
+
+	// Default buckets are used when none are configured.
+	s.Push(bpf.Event{Type: bpf.EventDestroy, Proto: 6, BytesOrig: 100, PacketsOrig: 2})
+	assert.Len(t, histogram(t, &s, "conntracct_flow_bytes", "6").GetBucket(), len(defaultByteBuckets))
+
+	res, err := http.Get("http://" + s.listener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+
+	assert.Contains(t, string(b), `conntracct_flow_bytes_bucket{proto="6",sink="test",le="256"} 1`)
+
+	require.NoError(t, s.Close())
+}
+
+func TestPromSinkInit(t *testing.T) {
+
+	s := New()
+	assert.Error(t, s.Init(types.SinkConfig{Type: types.Prometheus}), "empty name")
+	assert.Error(t, s.Init(types.SinkConfig{Name: "test", Type: types.Dummy}), "wrong type")
+	assert.Error(t, s.Init(types.SinkConfig{
+		Name:        "test",
+		Type:        types.Prometheus,
+		ByteBuckets: []float64{10, 1},
+	}), "unsorted buckets")
+}
+
+func TestPromSinkLabels(t *testing.T) {
+
+	s := New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:    "test",
+		Type:    types.Prometheus,
+		Address: "127.0.0.1:0",
+		Labels:  map[string]string{"hostname": "node1", "region": "eu"},
+	}))
+
+	s.Push(bpf.Event{Type: bpf.EventDestroy, Proto: 6, BytesOrig: 100, PacketsOrig: 2})
+
+	res, err := http.Get("http://" + s.listener.Addr().String() + "/metrics")
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+
+	assert.Contains(t, string(b), `conntracct_flow_bytes_bucket{hostname="node1",proto="6",region="eu",sink="test",le="256"} 1`)
+
+	require.NoError(t, s.Close())
+
+	// Labels used by the sink itself and invalid label names are rejected.
+	s = New()
+	assert.EqualError(t, s.Init(types.SinkConfig{
+		Name:   "test",
+		Type:   types.Prometheus,
+		Labels: map[string]string{"proto": "x"},
+	}), "label 'proto' is reserved by the sink")
+	assert.Error(t, s.Init(types.SinkConfig{
+		Name:   "test",
+		Type:   types.Prometheus,
+		Labels: map[string]string{"not-valid": "x"},
+	}), "invalid label name")
+}
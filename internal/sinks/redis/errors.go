@@ -0,0 +1,12 @@
+package redis
+
+import "errors"
+
+var (
+	errEmptySinkName    = errors.New("empty sink name")
+	errEmptySinkAddress = errors.New("empty sink address")
+	errNoDestination    = errors.New("sink requires either a stream or a channel")
+	errBothDestinations = errors.New("sink can only have one of stream or channel")
+	errInvalidDatabase  = errors.New("database must be a numeric Redis database index")
+	errInvalidSinkType  = errors.New("invalid sink type")
+)
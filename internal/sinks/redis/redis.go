@@ -0,0 +1,254 @@
+package redis
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/internal/sinks/breaker"
+	"github.com/ti-mo/conntracct/internal/sinks/encpool"
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/internal/sinks/spool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	defaultBatchSize = 128
+
+	// Amount of events that can be queued in the sink before
+	// new events are dropped.
+	eventQueueLength = 8192
+)
+
+// RedisSink is an accounting sink adding events to a Redis stream,
+// or publishing them to a Redis Pub/Sub channel.
+type RedisSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Redis client handle. Manages a connection pool and
+	// transparently reconnects to the server.
+	client *goredis.Client
+
+	// Spool of batches that failed to send, nil if the sink has no SpoolDir.
+	spool *spool.Spool
+
+	// Circuit breaker of the sink's writes, nil if the sink has none.
+	breaker *breaker.Breaker
+
+	// Queue of events to be written to Redis.
+	events chan bpf.Event
+
+	// Collects queued events into the batches written to Redis.
+	batcher *batch.Batcher
+
+	// Encodes batches while earlier batches are being written, nil if
+	// the sink has no EncodeConcurrency.
+	encoders *encpool.Pool
+
+	// Closed by the worker when it exits after Close.
+	done chan struct{}
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new Redis accounting sink.
+func New() RedisSink {
+	return RedisSink{}
+}
+
+// Init initializes the Redis accounting sink.
+func (s *RedisSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.Redis {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.Address == "" {
+		return errEmptySinkAddress
+	}
+	if sc.Stream == "" && sc.Channel == "" {
+		return errNoDestination
+	}
+	if sc.Stream != "" && sc.Channel != "" {
+		return errBothDestinations
+	}
+	if sc.BatchSize == 0 {
+		sc.BatchSize = defaultBatchSize
+	}
+	sc.WriteTimeout = sc.GetWriteTimeout()
+	if sc.SpoolRetryInterval == 0 {
+		sc.SpoolRetryInterval = spool.DefaultRetryInterval
+	}
+
+	// Database is given as a string, Redis databases are numbered.
+	var db int
+	if sc.Database != "" {
+		var err error
+		if db, err = strconv.Atoi(sc.Database); err != nil {
+			return errInvalidDatabase
+		}
+	}
+
+	c := goredis.NewClient(&goredis.Options{
+		Addr:         sc.Address,
+		Password:     sc.Password,
+		DB:           db,
+		WriteTimeout: sc.WriteTimeout,
+		ReadTimeout:  sc.WriteTimeout,
+
+		// Retry failed commands, backing off between reconnection attempts.
+		MaxRetries:      3,
+		MinRetryBackoff: 100 * time.Millisecond,
+		MaxRetryBackoff: 2 * time.Second,
+	})
+
+	// Check if the server is up.
+	if err := c.Ping().Err(); err != nil {
+		return err
+	}
+
+	sp, err := spool.FromConfig(sc)
+	if err != nil {
+		c.Close()
+		return err
+	}
+	if sp != nil {
+		s.stats.SetSpoolDepth(sp.Len())
+	}
+
+	s.client = c
+	s.spool = sp
+	s.breaker = helpers.NewBreaker(sc, &s.stats)
+	s.config = sc
+	s.events = make(chan bpf.Event, eventQueueLength)
+	s.done = make(chan struct{})
+	s.batcher = batch.New(batch.Config{
+		Size:      int(sc.BatchSize),
+		MaxEvents: int(sc.MaxBatchEvents),
+		Bytes:     sc.BatchBytes,
+		Interval:  sc.FlushInterval,
+	}, s.batchReady)
+	if sc.EncodeConcurrency > 1 {
+		s.encoders = encpool.New(int(sc.EncodeConcurrency), s.encodeBatch, s.sendBatch)
+	}
+
+	go s.sendWorker()
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// Push an accounting event into the queue of the Redis accounting sink.
+func (s *RedisSink) Push(e bpf.Event) {
+	// Non-blocking send on event channel.
+	select {
+	case s.events <- e:
+		s.stats.IncrEventsPushed()
+		s.stats.SetBatchLength(len(s.events))
+	default:
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+	}
+}
+
+// Name gets the name of the Redis accounting sink.
+func (s *RedisSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the Redis accounting sink was successfully initialized.
+func (s *RedisSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate always returns true.
+func (s *RedisSink) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, Redis receives destroy events. (flow totals)
+func (s *RedisSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew returns false, Redis receives new flows as update events.
+func (s *RedisSink) WantNew() bool {
+	return false
+}
+
+// Stats returns the Redis accounting sink's statistics structure.
+func (s *RedisSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// QueueStats returns the amount of events queued for the send worker, and
+// the age of the sink's current batch.
+func (s *RedisSink) QueueStats() types.QueueStats {
+	return types.QueueStats{
+		Length:   len(s.events),
+		Capacity: cap(s.events),
+		BatchAge: s.batcher.Age(time.Now()),
+	}
+}
+
+// Close stops the Redis accounting sink after writing all queued events,
+// and closes the client's connections.
+func (s *RedisSink) Close() error {
+	close(s.events)
+	<-s.done
+	return s.client.Close()
+}
+
+// write writes a batch of events to Redis in a single pipeline.
+// Events that fail to encode are skipped.
+func (s *RedisSink) write(events []bpf.Event) error {
+
+	p := s.client.Pipeline()
+	defer p.Close()
+
+	for _, e := range events {
+		b, err := json.Marshal(e)
+		if err != nil {
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error encoding event")
+			continue
+		}
+		s.add(p, b)
+	}
+
+	return s.config.WriteLimiter.Do(func() error {
+		_, err := p.Exec()
+		return err
+	})
+}
+
+// add queues a command writing an encoded event to the configured
+// stream or channel on the given pipeline.
+func (s *RedisSink) add(p goredis.Pipeliner, b []byte) {
+
+	if s.config.Channel != "" {
+		p.Publish(s.config.Channel, b)
+		return
+	}
+
+	p.XAdd(&goredis.XAddArgs{
+		Stream:       s.config.Stream,
+		MaxLenApprox: s.config.StreamMaxLen,
+		Values:       map[string]interface{}{"event": b},
+	})
+}
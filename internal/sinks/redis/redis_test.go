@@ -0,0 +1,298 @@
+package redis_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/redis"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func testEvent(id uint32) bpf.Event {
+	return bpf.Event{
+		ConnectionID: id,
+		SrcAddr:      net.ParseIP("10.0.0.1"),
+		DstAddr:      net.ParseIP("10.0.0.2"),
+		PacketsOrig:  1,
+		BytesOrig:    31,
+		SrcPort:      1234,
+		DstPort:      53,
+		Proto:        17,
+	}
+}
+
+func TestRedisSinkStream(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:         "test",
+		Type:         types.Redis,
+		Address:      mr.Addr(),
+		Stream:       "conntracct",
+		StreamMaxLen: 2,
+	}))
+
+	for i := uint32(1); i <= 3; i++ {
+		s.Push(testEvent(i))
+	}
+
+	// Wait for the last event to be written to the stream.
+	var entries []miniredis.StreamEntry
+	var e bpf.Event
+	waitFor(t, func() bool {
+		entries, _ = mr.Stream("conntracct")
+		if len(entries) == 0 {
+			return false
+		}
+		require.NoError(t, json.Unmarshal([]byte(entries[len(entries)-1].Values[1]), &e))
+		return e.ConnectionID == 3
+	})
+
+	// The stream is trimmed to its maximum length.
+	require.Len(t, entries, 2)
+	assert.Equal(t, "event", entries[1].Values[0])
+
+	want := testEvent(3)
+	assert.Equal(t, want.BytesOrig, e.BytesOrig)
+	assert.Contains(t, entries[1].Values[1], fmt.Sprintf(`"schema_version":%d`, bpf.SchemaVersion))
+	assert.True(t, want.SrcAddr.Equal(e.SrcAddr))
+	assert.Equal(t, want.DstPort, e.DstPort)
+
+	st := s.Stats()
+	assert.EqualValues(t, 3, st.EventsPushed)
+	assert.Zero(t, st.BatchesDropped)
+}
+
+func TestRedisSinkEncoders(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:              "test",
+		Type:              types.Redis,
+		Address:           mr.Addr(),
+		Stream:            "conntracct",
+		BatchSize:         10,
+		FlushInterval:     time.Hour,
+		EncodeConcurrency: 4,
+	}))
+
+	for i := uint32(1); i <= 1000; i++ {
+		s.Push(testEvent(i))
+	}
+
+	// Close sends the batches being encoded.
+	require.NoError(t, s.Close())
+
+	// Batches encoded concurrently are written in order.
+	entries, err := mr.Stream("conntracct")
+	require.NoError(t, err)
+	require.Len(t, entries, 1000)
+	for i, en := range entries {
+		var e bpf.Event
+		require.NoError(t, json.Unmarshal([]byte(en.Values[1]), &e))
+		require.EqualValues(t, i+1, e.ConnectionID)
+	}
+
+	assert.EqualValues(t, 100, s.Stats().BatchesSent)
+}
+
+func TestRedisSinkChannel(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	sub := mr.NewSubscriber()
+	defer sub.Close()
+	sub.Subscribe("conntracct")
+
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:    "test",
+		Type:    types.Redis,
+		Address: mr.Addr(),
+		Channel: "conntracct",
+	}))
+
+	s.Push(testEvent(1))
+
+	select {
+	case m := <-sub.Messages():
+		var e bpf.Event
+		require.NoError(t, json.Unmarshal([]byte(m.Message), &e))
+		assert.EqualValues(t, 1, e.ConnectionID)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for published event")
+	}
+}
+
+func TestRedisSinkFailure(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:    "test",
+		Type:    types.Redis,
+		Address: mr.Addr(),
+		Stream:  "conntracct",
+	}))
+
+	// Writes fail while the server is down.
+	mr.Close()
+	s.Push(testEvent(1))
+	waitFor(t, func() bool {
+		return s.Stats().BatchesDropped == 1
+	})
+
+	// The client reconnects when the server comes back.
+	require.NoError(t, mr.Restart())
+	s.Push(testEvent(2))
+	waitFor(t, func() bool {
+		return s.Stats().BatchesSent == 1
+	})
+}
+
+func TestRedisSinkSpool(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	dir, err := ioutil.TempDir("", "conntracct-redis-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var dropped int
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:               "test",
+		Type:               types.Redis,
+		Address:            mr.Addr(),
+		Stream:             "conntracct",
+		SpoolDir:           dir,
+		SpoolRetryInterval: 50 * time.Millisecond,
+		OnDrop:             func(evs []bpf.Event) { dropped += len(evs) },
+	}))
+
+	// Batches failing while the server is down are spooled, not dropped.
+	mr.Close()
+	s.Push(testEvent(1))
+	waitFor(t, func() bool {
+		return s.Stats().BatchesSpooled == 1
+	})
+	st := s.Stats()
+	assert.EqualValues(t, 1, st.SpoolDepth)
+	assert.Zero(t, st.BatchesDropped)
+	assert.Zero(t, dropped)
+
+	// The spooled batch is replayed when the server comes back.
+	require.NoError(t, mr.Restart())
+	waitFor(t, func() bool {
+		return s.Stats().BatchesReplayed == 1
+	})
+	assert.Zero(t, s.Stats().SpoolDepth)
+
+	entries, err := mr.Stream("conntracct")
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	var e bpf.Event
+	require.NoError(t, json.Unmarshal([]byte(entries[0].Values[1]), &e))
+	assert.EqualValues(t, 1, e.ConnectionID)
+
+	require.NoError(t, s.Close())
+}
+
+func TestRedisSinkInit(t *testing.T) {
+
+	tests := []struct {
+		name string
+		sc   types.SinkConfig
+		err  string
+	}{
+		{"no name", types.SinkConfig{Type: types.Redis}, "empty sink name"},
+		{"no address", types.SinkConfig{Type: types.Redis, Name: "r"}, "empty sink address"},
+		{"no destination", types.SinkConfig{Type: types.Redis, Name: "r", Address: "x"},
+			"sink requires either a stream or a channel"},
+		{"both destinations", types.SinkConfig{Type: types.Redis, Name: "r", Address: "x", Stream: "s", Channel: "c"},
+			"sink can only have one of stream or channel"},
+		{"bad database", types.SinkConfig{Type: types.Redis, Name: "r", Address: "x", Stream: "s", Database: "db"},
+			"database must be a numeric Redis database index"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := redis.New()
+			assert.EqualError(t, s.Init(tt.sc), tt.err)
+			assert.False(t, s.IsInit())
+		})
+	}
+}
+
+func TestRedisSinkMaxBatchEvents(t *testing.T) {
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	s := redis.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:           "test",
+		Type:           types.Redis,
+		Address:        mr.Addr(),
+		Stream:         "conntracct",
+		MaxBatchEvents: 2,
+		FlushInterval:  time.Hour,
+	}))
+	defer s.Close()
+
+	for i := uint32(1); i <= 3; i++ {
+		s.Push(testEvent(i))
+	}
+
+	// Only the first two events reached the count, the third waits for the
+	// flush interval.
+	waitFor(t, func() bool {
+		entries, _ := mr.Stream("conntracct")
+		return len(entries) == 2
+	})
+	time.Sleep(50 * time.Millisecond)
+	entries, err := mr.Stream("conntracct")
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.EqualValues(t, 1, s.Stats().BatchesSent)
+}
+
+// waitFor polls f until it returns true, failing the test after one second.
+func waitFor(t *testing.T, f func() bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("timeout waiting for condition")
+}
@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/internal/sinks/batch"
+	"github.com/ti-mo/conntracct/internal/sinks/helpers"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// sendWorker receives events from the sink's event channel and adds them to
+// the sink's batcher, which writes batches of up to BatchSize events to Redis
+// in a single pipeline. Without a FlushInterval, the batch is written as soon
+// as the event channel is drained, so events queued while a batch is being
+// sent are written together. Batches that failed to send are spooled if the
+// sink has a spool, and replayed every SpoolRetryInterval. Exits when the
+// event channel is closed.
+func (s *RedisSink) sendWorker() {
+
+	defer close(s.done)
+
+	// Only replay if the sink has a spool, a nil channel never fires.
+	var retry <-chan time.Time
+	if s.spool != nil {
+		t := time.NewTicker(s.config.SpoolRetryInterval)
+		defer t.Stop()
+		retry = t.C
+	}
+
+	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.batcher.Close()
+				if s.encoders != nil {
+					s.encoders.Close()
+				}
+				return
+			}
+
+			s.batcher.Add(e)
+			if s.config.FlushInterval == 0 && len(s.events) == 0 {
+				s.batcher.Flush()
+			}
+
+			s.stats.SetBatchLength(len(s.events))
+
+		case <-retry:
+			s.replay()
+		}
+	}
+}
+
+// encodedBatch is a batch of events and their JSON form, without
+// the events that failed to encode.
+type encodedBatch struct {
+	events []bpf.Event
+	values [][]byte
+}
+
+// batchReady writes a batch to Redis. With EncodeConcurrency, the batch is
+// handed to the sink's encoders instead, and written once encoded.
+func (s *RedisSink) batchReady(b batch.Batch) {
+
+	if s.encoders != nil {
+		s.encoders.Submit(b)
+		return
+	}
+
+	s.sendBatch(b, s.encodeBatch(b))
+}
+
+// encodeBatch encodes the events of a batch into their JSON form. Events
+// that fail to encode are dropped from the batch. Returns an encodedBatch.
+func (s *RedisSink) encodeBatch(b batch.Batch) interface{} {
+
+	// The batch is owned by the sink, filter it in place.
+	eb := encodedBatch{
+		events: b.Events[:0],
+		values: make([][]byte, 0, len(b.Events)),
+	}
+
+	for _, e := range b.Events {
+		v, err := json.Marshal(e)
+		if err != nil {
+			s.stats.IncrEventsDropped()
+			s.config.OnDrop.Drop(e)
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error encoding event")
+			continue
+		}
+		eb.events = append(eb.events, e)
+		eb.values = append(eb.values, v)
+	}
+
+	return eb
+}
+
+// sendBatch writes an encoded batch to Redis in a single pipeline. Batches
+// are spooled or dropped without contacting Redis while the sink's breaker
+// is open.
+func (s *RedisSink) sendBatch(_ batch.Batch, enc interface{}) {
+
+	eb := enc.(encodedBatch)
+	events := eb.events
+
+	if len(events) == 0 {
+		return
+	}
+
+	if !s.breaker.Allow() {
+		if s.spoolBatch(events) {
+			return
+		}
+		s.stats.IncrBatchDropped()
+		s.config.OnDrop.Drop(events...)
+		return
+	}
+
+	p := s.client.Pipeline()
+	defer p.Close()
+
+	for _, v := range eb.values {
+		s.add(p, v)
+	}
+
+	if err := s.config.WriteLimiter.Do(func() error { _, err := p.Exec(); return err }); err != nil {
+		s.breaker.Failure()
+
+		if s.spoolBatch(events) {
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing batch, batch spooled")
+			return
+		}
+
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing batch, batch dropped")
+		if helpers.IsTimeout(err) {
+			s.stats.IncrBatchTimedOut()
+		} else {
+			s.stats.IncrBatchDropped()
+		}
+		s.config.OnDrop.Drop(events...)
+		return
+	}
+
+	s.breaker.Success()
+	s.stats.IncrBatchSent()
+}
+
+// spoolBatch adds a batch that failed to send to the sink's spool. Returns
+// false if the sink has no spool or the batch could not be spooled.
+func (s *RedisSink) spoolBatch(batch []bpf.Event) bool {
+
+	if s.spool == nil {
+		return false
+	}
+
+	if err := s.spool.Put(batch); err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error spooling batch")
+		return false
+	}
+
+	s.stats.IncrBatchSpooled()
+	s.stats.SetSpoolDepth(s.spool.Len())
+
+	return true
+}
+
+// replay writes the batches in the sink's spool, until Redis
+// fails to accept one. Skipped while the sink's breaker is open.
+func (s *RedisSink) replay() {
+
+	if s.spool.Len() == 0 || !s.breaker.Allow() {
+		return
+	}
+
+	n, err := s.spool.Replay(s.write)
+
+	s.stats.AddBatchesReplayed(n)
+	s.stats.SetSpoolDepth(s.spool.Len())
+
+	if err != nil {
+		s.breaker.Failure()
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).WithField("batches", s.spool.Len()).Error("Error replaying spool")
+		return
+	}
+
+	s.breaker.Success()
+}
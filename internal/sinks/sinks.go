@@ -4,11 +4,19 @@ import (
 	"fmt"
 
 	"github.com/ti-mo/conntracct/pkg/bpf"
+	"github.com/ti-mo/conntracct/pkg/filter"
 
 	"github.com/ti-mo/conntracct/internal/sinks/dummy"
 	"github.com/ti-mo/conntracct/internal/sinks/influxdb"
+	"github.com/ti-mo/conntracct/internal/sinks/ipfix"
+	"github.com/ti-mo/conntracct/internal/sinks/memring"
+	"github.com/ti-mo/conntracct/internal/sinks/mqtt"
+	"github.com/ti-mo/conntracct/internal/sinks/parquet"
+	"github.com/ti-mo/conntracct/internal/sinks/prometheus"
+	"github.com/ti-mo/conntracct/internal/sinks/redis"
 	"github.com/ti-mo/conntracct/internal/sinks/stdout"
 	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/sinks/unixsocket"
 )
 
 // An Sink represents a timeseries database or other store
@@ -24,9 +32,12 @@ type Sink interface {
 	// Get the sink's name.
 	Name() string
 
-	// Check which kind of events this sink is interested in.
+	// Check which kind of events this sink is interested in. New flow events
+	// are the first update of a flow, sinks that want updates receive them
+	// regardless of WantNew.
 	WantUpdate() bool
 	WantDestroy() bool
+	WantNew() bool
 
 	// Enqueue an accounting event to the sink driver.
 	// Implementation MUST be thread-safe.
@@ -34,17 +45,93 @@ type Sink interface {
 
 	// Get a snapshot copy of the sink's performance statistics.
 	Stats() types.SinkStats
+
+	// Stop the sink's workers, flushing any pending events on a best-effort
+	// basis, and release its resources. Push must not be called after Close.
+	Close() error
+}
+
+// A Recorder is a Sink that retains recent events in memory.
+type Recorder interface {
+	// Get a copy of the retained events, from oldest to newest.
+	Recent() []bpf.Event
+}
+
+// AsRecorder returns the Recorder implemented by the given Sink,
+// looking through the sink's wrappers. Returns false if the Sink
+// does not retain events.
+func AsRecorder(s Sink) (Recorder, bool) {
+	r, ok := unwrap(s).(Recorder)
+	return r, ok
+}
+
+// A HealthChecker is a Sink that reports its own health, eg. whether it's
+// connected to its backing storage. The health of other sinks is derived
+// from their statistics.
+type HealthChecker interface {
+	// Check whether the sink is currently able to deliver events.
+	Healthy() bool
+}
+
+// AsHealthChecker returns the HealthChecker implemented by the given Sink,
+// looking through the sink's wrappers. Returns false if the Sink
+// does not report its own health.
+func AsHealthChecker(s Sink) (HealthChecker, bool) {
+	h, ok := unwrap(s).(HealthChecker)
+	return h, ok
+}
+
+// A QueueReporter is a Sink that queues events before sending them, like
+// sinks sending events from a worker or in batches.
+type QueueReporter interface {
+	// Get a snapshot of the sink's queue.
+	QueueStats() types.QueueStats
+}
+
+// AsQueueReporter returns the QueueReporter implemented by the given Sink,
+// looking through the sink's wrappers. Returns false if the Sink
+// does not queue events.
+func AsQueueReporter(s Sink) (QueueReporter, bool) {
+	q, ok := unwrap(s).(QueueReporter)
+	return q, ok
 }
 
 // New returns a new, initialized Sink based on the type of
 // the given SinkConfig.
 func New(cfg types.SinkConfig) (Sink, error) {
 
+	// Compile the sink's filter expression before initializing
+	// the sink, so no resources are allocated for invalid expressions.
+	var f *filter.Filter
+	if cfg.Filter != "" {
+		var err error
+		if f, err = filter.Compile(cfg.Filter); err != nil {
+			return nil, err
+		}
+	}
+
+	partition, err := newPartitionFunc(cfg.PushPartition)
+	if err != nil {
+		return nil, err
+	}
+
+	// Events dropped by a dead letter sink are not passed on,
+	// avoiding loops if the dead letter sink itself fails.
+	if cfg.DeadLetter {
+		cfg.OnDrop = nil
+	}
+
+	// Sinks knowing the labels upfront, like Prometheus, know the tags too.
+	global := cfg.Labels
+	if len(cfg.StaticTags) != 0 {
+		cfg.Labels = mergeLabels(global, cfg.StaticTags)
+	}
+
 	var sink Sink
 
 	switch cfg.Type {
-	// InfluxDB driver handles UDP and TCP modes internally.
-	case types.InfluxUDP, types.InfluxHTTP:
+	// InfluxDB driver handles UDP and HTTP transports internally.
+	case types.InfluxDB, types.InfluxUDP, types.InfluxHTTP:
 		idb := influxdb.New()
 		if err := idb.Init(cfg); err != nil {
 			return nil, err
@@ -57,6 +144,48 @@ func New(cfg types.SinkConfig) (Sink, error) {
 			return nil, err
 		}
 		sink = &std
+	case types.Redis:
+		rds := redis.New()
+		if err := rds.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &rds
+	case types.Prometheus:
+		ps := prometheus.New()
+		if err := ps.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &ps
+	case types.Parquet:
+		pq := parquet.New()
+		if err := pq.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &pq
+	case types.MQTT:
+		mq := mqtt.New()
+		if err := mq.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &mq
+	case types.IPFIX:
+		ix := ipfix.New()
+		if err := ix.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &ix
+	case types.UnixSocket:
+		us := unixsocket.New()
+		if err := us.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &us
+	case types.MemRing:
+		mr := memring.New()
+		if err := mr.Init(cfg); err != nil {
+			return nil, err
+		}
+		sink = &mr
 	case types.Dummy:
 		d := dummy.New()
 		_ = d.Init(cfg)
@@ -65,5 +194,31 @@ func New(cfg types.SinkConfig) (Sink, error) {
 		return nil, fmt.Errorf("sink type '%s' not implemented", cfg.Type)
 	}
 
+	if len(cfg.StaticTags) != 0 {
+		sink = newTaggedSink(sink, global, cfg.StaticTags)
+	}
+
+	// Check the age of events right before pushing them into the sink,
+	// after they waited in the pool's queue.
+	if cfg.MaxEventAge > 0 {
+		sink = newAgedSink(sink, cfg.MaxEventAge)
+	}
+
+	// Fan pushes out to a pool of workers calling the sink's Push method.
+	if cfg.PushConcurrency > 1 {
+		sink = newPooledSink(sink, int(cfg.PushConcurrency), partition, cfg.OnDrop)
+	}
+
+	// Filter events before they are queued to the pool.
+	if f != nil {
+		sink = filteredSink{sink, f}
+	}
+
+	// Dead letter sinks only receive events pushed by the pipeline's
+	// dead letter handler, never events from the pipeline's sources.
+	if cfg.DeadLetter {
+		sink = deadLetterSink{sink}
+	}
+
 	return sink, nil
 }
@@ -0,0 +1,8 @@
+package spool
+
+import "errors"
+
+var (
+	errSpoolFull  = errors.New("spool is full")
+	errEmptyBatch = errors.New("empty batch")
+)
@@ -0,0 +1,239 @@
+// Package spool implements a bounded on-disk queue of event batches, used by
+// network sinks to keep batches they failed to deliver until their backing
+// storage recovers. Batches survive restarts of the process.
+package spool
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	// Size limit of a sink's spool that doesn't have one configured.
+	DefaultMaxBytes = 64 << 20
+
+	// Interval between replays of a sink's spool that doesn't have one configured.
+	DefaultRetryInterval = 10 * time.Second
+
+	// Extension of the spool's batch files.
+	batchExt = ".batch"
+)
+
+// batchFile is a batch stored in the spool.
+type batchFile struct {
+	seq  uint64
+	size int64
+}
+
+// A Spool is a FIFO queue of event batches stored as files in a directory,
+// one file per batch. The total size of the files is bounded, batches that
+// don't fit are rejected. A directory must only be used by a single Spool.
+type Spool struct {
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	files []batchFile // oldest first
+	size  int64
+	next  uint64 // sequence number of the next batch
+}
+
+// Open opens the spool in the given directory, creating the directory if
+// needed. Batches left in the directory by a previous process are kept and
+// replayed first. The spool holds at most maxBytes of batches.
+func Open(dir string, maxBytes int64) (*Spool, error) {
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir, maxBytes: maxBytes}
+
+	for _, fi := range fis {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, batchExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, batchExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		s.files = append(s.files, batchFile{seq, fi.Size()})
+		s.size += fi.Size()
+	}
+
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].seq < s.files[j].seq
+	})
+	if n := len(s.files); n != 0 {
+		s.next = s.files[n-1].seq + 1
+	}
+
+	return s, nil
+}
+
+// FromConfig opens the spool in the sink's SpoolDir, or returns nil if the
+// sink has no SpoolDir.
+func FromConfig(sc types.SinkConfig) (*Spool, error) {
+
+	if sc.SpoolDir == "" {
+		return nil, nil
+	}
+
+	max := sc.SpoolMaxBytes
+	if max == 0 {
+		max = DefaultMaxBytes
+	}
+
+	return Open(sc.SpoolDir, max)
+}
+
+// Put adds a batch to the tail of the spool. Returns an error if the batch
+// doesn't fit in the spool's remaining space.
+func (s *Spool) Put(evs []bpf.Event) error {
+
+	if len(evs) == 0 {
+		return errEmptyBatch
+	}
+
+	b, err := json.Marshal(evs)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(b)) > s.maxBytes {
+		return errSpoolFull
+	}
+
+	// Write to a temporary file first, so a partially written
+	// batch is never picked up after a crash.
+	seq := s.next
+	tmp := filepath.Join(s.dir, "."+s.name(seq)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path(seq)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.next++
+	s.files = append(s.files, batchFile{seq, int64(len(b))})
+	s.size += int64(len(b))
+
+	return nil
+}
+
+// Replay sends the spooled batches from oldest to newest using send, removing
+// every batch that was sent successfully. Stops at the first batch send fails
+// to deliver, which remains at the head of the spool. Returns the amount of
+// batches sent. Batches that can't be read are removed and reported as an
+// error. Must not be called concurrently.
+func (s *Spool) Replay(send func([]bpf.Event) error) (int, error) {
+
+	var n int
+
+	for {
+		s.mu.Lock()
+		if len(s.files) == 0 {
+			s.mu.Unlock()
+			return n, nil
+		}
+		head := s.files[0]
+		s.mu.Unlock()
+
+		evs, err := s.read(head.seq)
+		if err != nil {
+			s.remove(head)
+			return n, fmt.Errorf("reading spooled batch %d: %s", head.seq, err)
+		}
+
+		if err := send(evs); err != nil {
+			return n, err
+		}
+
+		if err := s.remove(head); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// Len returns the amount of batches in the spool.
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Size returns the total size of the batches in the spool in bytes.
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// read reads the events of the batch with the given sequence number.
+func (s *Spool) read(seq uint64) ([]bpf.Event, error) {
+
+	b, err := ioutil.ReadFile(s.path(seq))
+	if err != nil {
+		return nil, err
+	}
+
+	var evs []bpf.Event
+	if err := json.Unmarshal(b, &evs); err != nil {
+		return nil, err
+	}
+
+	return evs, nil
+}
+
+// remove deletes the batch at the head of the spool.
+func (s *Spool) remove(f batchFile) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files = s.files[1:]
+	s.size -= f.size
+
+	if err := os.Remove(s.path(f.seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// name returns the file name of the batch with the given sequence number.
+// Names are zero-padded to sort in order.
+func (s *Spool) name(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, batchExt)
+}
+
+// path returns the path of the batch with the given sequence number.
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.dir, s.name(seq))
+}
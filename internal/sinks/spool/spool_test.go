@@ -0,0 +1,167 @@
+package spool_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/spool"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+var errSend = errors.New("send failed")
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "conntracct-spool")
+	require.NoError(t, err)
+	return dir
+}
+
+// batch returns a batch of n events with consecutive connection IDs from id.
+func batch(id uint32, n int) []bpf.Event {
+	evs := make([]bpf.Event, n)
+	for i := range evs {
+		evs[i] = bpf.Event{ConnectionID: id + uint32(i), Type: bpf.EventUpdate, BytesOrig: 100}
+	}
+	return evs
+}
+
+// replayIDs replays the spool and returns the connection IDs of its events.
+func replayIDs(t *testing.T, s *spool.Spool) []uint32 {
+	var ids []uint32
+	_, err := s.Replay(func(evs []bpf.Event) error {
+		for _, e := range evs {
+			ids = append(ids, e.ConnectionID)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return ids
+}
+
+func TestSpoolReplay(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := spool.Open(dir, 1<<20)
+	require.NoError(t, err)
+
+	for i := uint32(0); i < 3; i++ {
+		require.NoError(t, s.Put(batch(i*10, 2)))
+	}
+	assert.Equal(t, 3, s.Len())
+	assert.NotZero(t, s.Size())
+
+	// Replay stops at the first failed batch, which stays at the head.
+	var sent int
+	n, err := s.Replay(func(evs []bpf.Event) error {
+		if sent == 1 {
+			return errSend
+		}
+		sent++
+		return nil
+	})
+	assert.Equal(t, errSend, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 2, s.Len())
+
+	assert.Equal(t, []uint32{10, 11, 20, 21}, replayIDs(t, s))
+	assert.Zero(t, s.Len())
+	assert.Zero(t, s.Size())
+
+	// Replayed batches are removed from disk.
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, fis)
+}
+
+func TestSpoolReopen(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := spool.Open(dir, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(batch(1, 1)))
+	require.NoError(t, s.Put(batch(2, 1)))
+
+	// A new process picks up the batches in order, and appends after them.
+	s, err = spool.Open(dir, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, 2, s.Len())
+	require.NoError(t, s.Put(batch(3, 1)))
+
+	assert.Equal(t, []uint32{1, 2, 3}, replayIDs(t, s))
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// Measure the size of a batch on disk.
+	s, err := spool.Open(filepath.Join(dir, "measure"), 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(batch(1, 4)))
+	size := s.Size()
+
+	s, err = spool.Open(filepath.Join(dir, "bounded"), 2*size)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(batch(1, 4)))
+	require.NoError(t, s.Put(batch(5, 4)))
+
+	// The spool is full, new batches are rejected.
+	assert.Error(t, s.Put(batch(9, 4)))
+	assert.Equal(t, 2, s.Len())
+	assert.Equal(t, 2*size, s.Size())
+
+	// Replaying frees up space.
+	replayIDs(t, s)
+	assert.NoError(t, s.Put(batch(9, 4)))
+
+	assert.Error(t, s.Put(nil), "empty batch spooled")
+}
+
+func TestSpoolCorrupt(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := spool.Open(dir, 1<<20)
+	require.NoError(t, err)
+	require.NoError(t, s.Put(batch(1, 1)))
+	require.NoError(t, s.Put(batch(2, 1)))
+
+	fis, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, fis, 2)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fis[0].Name()), []byte("{"), 0600))
+
+	// The unreadable batch is removed, the next replay continues after it.
+	_, err = s.Replay(func([]bpf.Event) error { return nil })
+	assert.Error(t, err)
+	assert.Equal(t, 1, s.Len())
+	assert.Equal(t, []uint32{2}, replayIDs(t, s))
+}
+
+func TestSpoolFromConfig(t *testing.T) {
+
+	s, err := spool.FromConfig(types.SinkConfig{})
+	require.NoError(t, err)
+	assert.Nil(t, s)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err = spool.FromConfig(types.SinkConfig{SpoolDir: filepath.Join(dir, "sink")})
+	require.NoError(t, err)
+	require.NotNil(t, s)
+	assert.DirExists(t, filepath.Join(dir, "sink"))
+}
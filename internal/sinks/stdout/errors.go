@@ -2,6 +2,11 @@ package stdout
 
 import "errors"
 
+const (
+	errFmtUnknownFormat = "unknown format '%s', expected 'line', 'json', 'table' or 'influx'"
+	errFmtUnknownColor  = "unknown color mode '%s', expected 'auto', 'always' or 'never'"
+)
+
 var (
 	errEmptySinkName   = errors.New("empty sink name")
 	errInvalidSinkType = errors.New("invalid sink type")
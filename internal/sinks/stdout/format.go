@@ -0,0 +1,191 @@
+package stdout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/ti-mo/conntracct/internal/sinks/influxdb"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Output formats of the StdOut sink.
+const (
+	formatLine  = "line"
+	formatJSON  = "json"
+	formatTable = "table"
+
+	// InfluxDB line protocol, eg. for piping into Telegraf.
+	formatInflux = "influx"
+)
+
+// Color modes of the StdOut sink.
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+// ANSI escape sequences for coloring event types in table output.
+const (
+	ansiReset = "\x1b[0m"
+	ansiGreen = "\x1b[32m"
+	ansiRed   = "\x1b[31m"
+)
+
+// Column layout of the table format. Addresses are padded to fit an IPv4
+// address and port, longer IPv6 addresses push the following columns right.
+const (
+	tableHeaderFmt = "%-23s  %-7s  %-5s  %-21s  %-21s  %10s  %12s  %10s  %12s\n"
+	tableRowFmt    = "%-23s  %s  %-5s  %-21s  %-21s  %10d  %12d  %10d  %12d\n"
+	tableTimeFmt   = "2006-01-02 15:04:05.000"
+)
+
+// encoder writes events in one of the sink's output formats.
+type encoder struct {
+	format string
+	color  bool
+
+	// The table header is written before the first row.
+	header bool
+
+	// Renders the points of the influx format.
+	points *influxdb.LineEncoder
+}
+
+// newEncoder returns an encoder for the format and color mode of the given
+// SinkConfig. An empty format means 'line', an empty color mode means 'auto'.
+// In auto mode, table rows are colored if f is a terminal. The influx format
+// writes the points of an InfluxDB sink with the SinkConfig's measurement,
+// tags and fields.
+func newEncoder(sc types.SinkConfig, f *os.File) (*encoder, error) {
+
+	format, color := sc.Format, sc.Color
+	enc := &encoder{format: format}
+
+	switch format {
+	case "":
+		enc.format = formatLine
+	case formatLine, formatJSON, formatTable:
+	case formatInflux:
+		le, err := influxdb.NewLineEncoder(sc)
+		if err != nil {
+			return nil, err
+		}
+		enc.points = le
+	default:
+		return nil, fmt.Errorf(errFmtUnknownFormat, format)
+	}
+
+	switch color {
+	case "", colorAuto:
+		enc.color = isTerminal(f)
+	case colorAlways:
+		enc.color = true
+	case colorNever:
+	default:
+		return nil, fmt.Errorf(errFmtUnknownColor, color)
+	}
+
+	return enc, nil
+}
+
+// encode writes e to w, followed by a newline.
+func (enc *encoder) encode(w io.Writer, e bpf.Event) error {
+
+	switch enc.format {
+	case formatJSON:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+
+	case formatTable:
+		if !enc.header {
+			if _, err := fmt.Fprintf(w, tableHeaderFmt, "TIME", "TYPE", "PROTO", "SOURCE",
+				"DESTINATION", "PKTS_ORIG", "BYTES_ORIG", "PKTS_RET", "BYTES_RET"); err != nil {
+				return err
+			}
+			enc.header = true
+		}
+
+		_, err := fmt.Fprintf(w, tableRowFmt,
+			e.Time.Format(tableTimeFmt), enc.eventType(e.Type), bpf.Proto(e.Proto),
+			hostPort(e.SrcAddr, e.SrcPort), hostPort(e.DstAddr, e.DstPort),
+			e.PacketsOrig, e.BytesOrig, e.PacketsRet, e.BytesRet)
+		return err
+
+	case formatInflux:
+		l, err := enc.points.Line(e)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, l+"\n")
+		return err
+	}
+
+	_, err := io.WriteString(w, e.String()+"\n")
+	return err
+}
+
+// suppressed writes a summary of n events suppressed by the sink's rate cap,
+// as an object in JSON output so the output remains one object per line, and
+// as a comment in line protocol output.
+func (enc *encoder) suppressed(w io.Writer, n uint64) error {
+
+	switch enc.format {
+	case formatJSON:
+		_, err := fmt.Fprintf(w, "{\"suppressed\":%d}\n", n)
+		return err
+	case formatInflux:
+		_, err := fmt.Fprintf(w, "# %d events suppressed\n", n)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "-- %d events suppressed --\n", n)
+	return err
+}
+
+// eventType returns the padded name of the event type for a table row,
+// colored if enabled. Padding is applied before coloring, since the escape
+// sequences would otherwise count towards the width of the column.
+func (enc *encoder) eventType(t bpf.EventType) string {
+
+	s := fmt.Sprintf("%-7s", t)
+	if !enc.color {
+		return s
+	}
+
+	switch t {
+	case bpf.EventNew:
+		return ansiGreen + s + ansiReset
+	case bpf.EventDestroy:
+		return ansiRed + s + ansiReset
+	}
+
+	return s
+}
+
+// hostPort formats an address and port, omitting the port if zero.
+func hostPort(ip net.IP, port uint16) string {
+	if port == 0 {
+		return ip.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// isTerminal returns true if f is a character device, like a terminal.
+// Files and pipes are not.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,143 @@
+package stdout
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/influxdata/influxdb/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+var testEvent = bpf.Event{
+	ConnectionID: 42,
+	SrcAddr:      net.IP{10, 0, 0, 1},
+	DstAddr:      net.IP{192, 168, 1, 1},
+	SrcPort:      43210,
+	DstPort:      443,
+	Proto:        6,
+	PacketsOrig:  1,
+	BytesOrig:    31,
+	PacketsRet:   2,
+	BytesRet:     62,
+	Type:         bpf.EventNew,
+	Time:         time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC),
+}
+
+func encode(t *testing.T, format, color string, evs ...bpf.Event) string {
+	t.Helper()
+
+	// A buffer is not a terminal, auto mode disables color.
+	enc, err := newEncoder(types.SinkConfig{Format: format, Color: color}, nil)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	for _, e := range evs {
+		require.NoError(t, enc.encode(&b, e))
+	}
+
+	return b.String()
+}
+
+func TestEncodeLine(t *testing.T) {
+	assert.Equal(t, testEvent.String()+"\n", encode(t, "", "", testEvent))
+	assert.Equal(t, testEvent.String()+"\n", encode(t, formatLine, "", testEvent))
+}
+
+func TestEncodeJSON(t *testing.T) {
+
+	out := encode(t, formatJSON, "", testEvent)
+	require.True(t, strings.HasSuffix(out, "}\n"), out)
+
+	assert.Contains(t, out, `"connection_id":42`)
+	assert.Contains(t, out, `"src_addr":"10.0.0.1"`)
+	assert.Contains(t, out, `"type":"new"`)
+	assert.Contains(t, out, `"time":"2019-06-01T12:30:00Z"`)
+	assert.Contains(t, out, fmt.Sprintf(`"schema_version":%d`, bpf.SchemaVersion))
+	assert.NotContains(t, out, `"labels"`)
+
+	// The pipeline's labels are included as an object.
+	e := testEvent
+	e.Labels = map[string]string{"hostname": "node1", "region": "eu"}
+	out = encode(t, formatJSON, "", e)
+	assert.Contains(t, out, `"labels":{"hostname":"node1","region":"eu"}`)
+}
+
+func TestEncodeTable(t *testing.T) {
+
+	v6 := testEvent
+	v6.SrcAddr = net.ParseIP("2001:db8::1")
+	v6.DstAddr = net.ParseIP("2001:db8::2")
+	v6.Type = bpf.EventDestroy
+
+	icmp := testEvent
+	icmp.Proto = 1
+	icmp.SrcPort, icmp.DstPort = 0, 0
+	icmp.Type = bpf.EventUpdate
+
+	want := "" +
+		"TIME                     TYPE     PROTO  SOURCE                 DESTINATION             PKTS_ORIG    BYTES_ORIG    PKTS_RET     BYTES_RET\n" +
+		"2019-06-01 12:30:00.000  new      tcp    10.0.0.1:43210         192.168.1.1:443                 1            31           2            62\n" +
+		"2019-06-01 12:30:00.000  destroy  tcp    [2001:db8::1]:43210    [2001:db8::2]:443               1            31           2            62\n" +
+		"2019-06-01 12:30:00.000  update   icmp   10.0.0.1               192.168.1.1                     1            31           2            62\n"
+
+	// The header is only written once.
+	assert.Equal(t, want, encode(t, formatTable, colorNever, testEvent, v6, icmp))
+}
+
+func TestEncodeTableColor(t *testing.T) {
+
+	out := encode(t, formatTable, colorAlways, testEvent)
+	assert.Contains(t, out, ansiGreen+"new    "+ansiReset)
+
+	out = encode(t, formatTable, colorAuto, testEvent)
+	assert.NotContains(t, out, "\x1b[")
+}
+
+func TestEncodeInflux(t *testing.T) {
+
+	out := encode(t, formatInflux, "", testEvent)
+	require.True(t, strings.HasSuffix(out, "\n"), out)
+
+	pts, err := models.ParsePointsString(out)
+	require.NoError(t, err, out)
+	require.Len(t, pts, 1)
+
+	pt := pts[0]
+	assert.Equal(t, "ct_acct", string(pt.Name()))
+	assert.Equal(t, testEvent.Time.UnixNano(), pt.UnixNano())
+	assert.Equal(t, "10.0.0.1", string(pt.Tags().Get([]byte("src_addr"))))
+	assert.Equal(t, "tcp", string(pt.Tags().Get([]byte("proto"))))
+	assert.Equal(t, strconv.Itoa(bpf.SchemaVersion), string(pt.Tags().Get([]byte("schema_version"))))
+
+	fields, err := pt.Fields()
+	require.NoError(t, err)
+	assert.EqualValues(t, 31, fields["bytes_orig"])
+	assert.EqualValues(t, 2, fields["packets_ret"])
+
+	// Labels are written as tags, like by the InfluxDB sink.
+	e := testEvent
+	e.Labels = map[string]string{"host": "a b"}
+	pts, err = models.ParsePointsString(encode(t, formatInflux, "", e))
+	require.NoError(t, err)
+	assert.Equal(t, "a b", string(pts[0].Tags().Get([]byte("host"))))
+}
+
+func TestStdOutInitFormat(t *testing.T) {
+
+	s := New()
+	assert.EqualError(t, s.Init(types.SinkConfig{Name: "x", Type: types.StdOut, Format: "xml"}),
+		"unknown format 'xml', expected 'line', 'json', 'table' or 'influx'")
+	assert.EqualError(t, s.Init(types.SinkConfig{Name: "x", Type: types.StdOut, Format: formatInflux, Tags: []string{"nope"}}),
+		"unknown tag or field 'nope'")
+	assert.EqualError(t, s.Init(types.SinkConfig{Name: "x", Type: types.StdOut, Color: "yes"}),
+		"unknown color mode 'yes', expected 'auto', 'always' or 'never'")
+}
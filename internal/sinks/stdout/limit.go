@@ -0,0 +1,47 @@
+package stdout
+
+import "time"
+
+// Interval of the StdOut sink's rate cap and its summaries of suppressed events.
+const rateInterval = time.Second
+
+// limiter caps the amount of events printed per interval. Events exceeding
+// the cap are counted until the next summary.
+type limiter struct {
+	max      uint64
+	interval time.Duration
+
+	start      time.Time // start of the current interval
+	count      uint64    // events allowed in the current interval
+	suppressed uint64    // events suppressed since the last call to take
+}
+
+// newLimiter returns a limiter allowing max events per interval.
+func newLimiter(max uint32, interval time.Duration) *limiter {
+	return &limiter{max: uint64(max), interval: interval}
+}
+
+// allow returns whether the event at now should be printed. The cap applies
+// to consecutive intervals, the first one starting at the first event.
+func (l *limiter) allow(now time.Time) bool {
+
+	if now.Sub(l.start) >= l.interval {
+		l.start = now
+		l.count = 0
+	}
+
+	if l.count < l.max {
+		l.count++
+		return true
+	}
+
+	l.suppressed++
+	return false
+}
+
+// take returns the amount of events suppressed since the previous call.
+func (l *limiter) take() uint64 {
+	n := l.suppressed
+	l.suppressed = 0
+	return n
+}
@@ -0,0 +1,91 @@
+package stdout
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+)
+
+func TestLimiter(t *testing.T) {
+
+	l := newLimiter(2, time.Second)
+	t0 := time.Date(2019, 6, 1, 12, 30, 0, 0, time.UTC)
+
+	assert.True(t, l.allow(t0))
+	assert.True(t, l.allow(t0.Add(100*time.Millisecond)))
+	assert.False(t, l.allow(t0.Add(200*time.Millisecond)))
+	assert.False(t, l.allow(t0.Add(999*time.Millisecond)))
+	assert.EqualValues(t, 2, l.take())
+	assert.Zero(t, l.take())
+
+	// The next interval starts at the first event after the previous one.
+	assert.True(t, l.allow(t0.Add(time.Second)))
+	assert.True(t, l.allow(t0.Add(1500*time.Millisecond)))
+	assert.False(t, l.allow(t0.Add(1999*time.Millisecond)))
+	assert.True(t, l.allow(t0.Add(5*time.Second)))
+	assert.EqualValues(t, 1, l.take())
+}
+
+func TestStdOutMaxRate(t *testing.T) {
+
+	for _, format := range []string{formatLine, formatJSON, formatInflux} {
+		t.Run(format, func(t *testing.T) {
+
+			enc, err := newEncoder(types.SinkConfig{Format: format, Color: colorNever}, nil)
+			require.NoError(t, err)
+
+			// The buffer is only read after Close waited for the worker.
+			var b bytes.Buffer
+			s := New()
+			s.start(types.SinkConfig{Name: "flood", Type: types.StdOut, BatchSize: 2048, MaxRate: 10}, enc, &b)
+
+			// A flood of events within the first interval.
+			for i := 0; i < 1000; i++ {
+				s.Push(testEvent)
+			}
+			require.NoError(t, s.Close())
+
+			st := s.Stats()
+			assert.EqualValues(t, 1000, st.EventsPushed)
+			assert.EqualValues(t, 10, st.BatchesSent)
+			assert.EqualValues(t, 990, st.EventsSuppressed)
+			assert.Zero(t, st.EventsDropped)
+
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			require.Len(t, lines, 11)
+			switch format {
+			case formatJSON:
+				assert.Equal(t, `{"suppressed":990}`, lines[10])
+			case formatInflux:
+				assert.Equal(t, "# 990 events suppressed", lines[10])
+			default:
+				assert.Equal(t, "-- 990 events suppressed --", lines[10])
+			}
+		})
+	}
+}
+
+func TestStdOutUnlimited(t *testing.T) {
+
+	enc, err := newEncoder(types.SinkConfig{Format: formatLine, Color: colorNever}, nil)
+	require.NoError(t, err)
+
+	var b bytes.Buffer
+	s := New()
+	s.start(types.SinkConfig{Name: "all", Type: types.StdOut, BatchSize: 2048}, enc, &b)
+
+	for i := 0; i < 100; i++ {
+		s.Push(testEvent)
+	}
+	require.NoError(t, s.Close())
+
+	assert.EqualValues(t, 100, s.Stats().BatchesSent)
+	assert.Equal(t, 100, strings.Count(b.String(), "\n"))
+	assert.NotContains(t, b.String(), "suppressed")
+}
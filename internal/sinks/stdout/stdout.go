@@ -2,6 +2,7 @@ package stdout
 
 import (
 	"bufio"
+	"io"
 	"os"
 
 	"github.com/ti-mo/conntracct/internal/sinks/types"
@@ -24,8 +25,17 @@ type StdOut struct {
 	// is used as the buffer size of the channel.
 	events chan bpf.Event
 
+	// Closed by the worker when it exits after Close.
+	done chan struct{}
+
 	// Stdout/err writer.
 	writer *bufio.Writer
+
+	// Writes events to writer in the configured format.
+	enc *encoder
+
+	// Caps the rate of events written, nil if the sink has no MaxRate.
+	limiter *limiter
 }
 
 // New returns a new StdOut.
@@ -44,26 +54,45 @@ func (s *StdOut) Init(sc types.SinkConfig) error {
 		sc.BatchSize = 2048
 	}
 
+	var f *os.File
 	switch sc.Type {
 	case types.StdOut:
-		// Initialize stdout writer.
-		s.writer = bufio.NewWriter(os.Stdout)
+		f = os.Stdout
 	case types.StdErr:
-		// Initialize stderr writer.
-		s.writer = bufio.NewWriter(os.Stderr)
+		f = os.Stderr
 	default:
 		return errInvalidSinkType
 	}
 
+	enc, err := newEncoder(sc, f)
+	if err != nil {
+		return err
+	}
+
+	s.start(sc, enc, f)
+
+	return nil
+}
+
+// start starts the sink's worker, writing to w using enc.
+func (s *StdOut) start(sc types.SinkConfig, enc *encoder, w io.Writer) {
+
+	// Initialize stdout/err writer.
+	s.writer = bufio.NewWriter(w)
+	s.enc = enc
+
+	if sc.MaxRate != 0 {
+		s.limiter = newLimiter(sc.MaxRate, rateInterval)
+	}
+
 	s.events = make(chan bpf.Event, sc.BatchSize)
+	s.done = make(chan struct{})
 	s.config = sc
 
 	go s.outWorker()
 
 	// Mark the sink as initialized.
 	s.init = true
-
-	return nil
 }
 
 // Push an accounting event into the buffer of the StdOut accounting sink.
@@ -75,6 +104,7 @@ func (s *StdOut) Push(e bpf.Event) {
 		s.stats.SetBatchLength(len(s.events))
 	default:
 		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
 	}
 }
 
@@ -98,7 +128,24 @@ func (s *StdOut) WantDestroy() bool {
 	return true
 }
 
+// WantNew always returns true, StdOut logs new flows.
+func (s *StdOut) WantNew() bool {
+	return true
+}
+
 // Stats returns the StdOut's statistics structure.
 func (s *StdOut) Stats() types.SinkStats {
 	return s.stats.Get()
 }
+
+// QueueStats returns the amount of events queued for the output worker.
+func (s *StdOut) QueueStats() types.QueueStats {
+	return types.QueueStats{Length: len(s.events), Capacity: cap(s.events)}
+}
+
+// Close stops the StdOut's worker after writing all queued events.
+func (s *StdOut) Close() error {
+	close(s.events)
+	<-s.done
+	return nil
+}
@@ -1,30 +1,88 @@
 package stdout
 
 import (
-	log "github.com/sirupsen/logrus"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
 // outWorker receives events from the sink's event channel
-// and prints them to stdout/stderr.
+// and prints them to stdout/stderr until the channel is closed.
+// With a rate cap, the amount of events suppressed is printed
+// every rateInterval, and once more when the channel is closed.
 func (s *StdOut) outWorker() {
 
+	defer close(s.done)
+
+	// Only summarize if the sink has a rate cap, a nil channel never fires.
+	var summary <-chan time.Time
+	if s.limiter != nil {
+		t := time.NewTicker(rateInterval)
+		defer t.Stop()
+		summary = t.C
+	}
+
 	for {
+		select {
+		case e, ok := <-s.events:
+			if !ok {
+				s.summarize()
+				return
+			}
 
-		e := <-s.events
+			if s.limiter != nil && !s.limiter.allow(time.Now()) {
+				s.stats.AddEventsSuppressed(1)
+				continue
+			}
 
-		if _, err := s.writer.WriteString(e.String() + "\n"); err != nil {
-			s.stats.IncrBatchDropped()
-			log.Errorf("StdOut sink '%s': error writing: %s", s.config.Name, err)
-			continue
-		}
+			s.write(e)
 
-		if err := s.writer.Flush(); err != nil {
-			s.stats.IncrBatchDropped()
-			log.Errorf("StdOut sink '%s': error flushing writer: %s", s.config.Name, err)
-			continue
+		case <-summary:
+			s.summarize()
 		}
+	}
+}
+
+// write prints an event.
+func (s *StdOut) write(e bpf.Event) {
+
+	if err := s.enc.encode(s.writer, e); err != nil {
+		s.stats.IncrBatchDropped()
+		s.config.OnDrop.Drop(e)
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing")
+		return
+	}
 
-		// Increase 'batches' sent counter.
-		s.stats.IncrBatchSent()
+	if err := s.writer.Flush(); err != nil {
+		s.stats.IncrBatchDropped()
+		s.config.OnDrop.Drop(e)
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error flushing writer")
+		return
+	}
+
+	// Increase 'batches' sent counter.
+	s.stats.IncrBatchSent()
+}
+
+// summarize prints the amount of events suppressed by the sink's rate cap
+// since the previous summary, if any.
+func (s *StdOut) summarize() {
+
+	if s.limiter == nil {
+		return
+	}
+
+	n := s.limiter.take()
+	if n == 0 {
+		return
+	}
+
+	if err := s.enc.suppressed(s.writer, n); err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error writing")
+		return
+	}
+	if err := s.writer.Flush(); err != nil {
+		logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error flushing writer")
 	}
 }
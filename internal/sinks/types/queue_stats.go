@@ -0,0 +1,18 @@
+package types
+
+import "time"
+
+// QueueStats is a snapshot of the events queued by an accounting sink before
+// they are sent, for telling when a sink falls behind before it drops events.
+type QueueStats struct {
+	// Amount of entries in the sink's send queue, events or batches
+	// depending on the sink.
+	Length int `json:"length"`
+	// Capacity of the sink's send queue, events are dropped once it's full.
+	// Zero if the sink sends batches as soon as they are full.
+	Capacity int `json:"capacity"`
+
+	// Time since the first event was added to the sink's current batch.
+	// Zero if the batch is empty, or if the sink doesn't batch events.
+	BatchAge time.Duration `json:"batch_age"`
+}
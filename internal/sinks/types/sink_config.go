@@ -6,14 +6,60 @@ import (
 	"time"
 
 	"github.com/mitchellh/mapstructure"
+
+	"github.com/ti-mo/conntracct/internal/sinks/bufpool"
+	"github.com/ti-mo/conntracct/internal/sinks/writelimit"
+	"github.com/ti-mo/conntracct/pkg/bpf"
 )
 
+// DefaultWriteTimeout is the write timeout of network sinks
+// that don't have one configured.
+const DefaultWriteTimeout = 5 * time.Second
+
+// DropFunc is called by a sink with events it failed to deliver.
+// The function must not retain the slice.
+type DropFunc func([]bpf.Event)
+
+// Drop calls f with the given events. No-op if f is nil.
+func (f DropFunc) Drop(evs ...bpf.Event) {
+	if f != nil {
+		f(evs)
+	}
+}
+
 // SinkConfig represents the configuration of an accounting sink.
 type SinkConfig struct {
 
 	// Flush batch when it holds this many points.
 	BatchSize uint32 `mapstructure:"batchSize"`
 
+	// Flush batch when its events take up an estimated this many bytes, for
+	// bounding the size of writes to the sink's backing storage. Zero means
+	// no limit. See batch.EventSize.
+	BatchBytes int `mapstructure:"batchBytes"`
+
+	// Flush a batch that isn't full at this interval. Defaults to one second
+	// for InfluxDB sinks. Redis sinks write queued events right away if zero.
+	// Parquet sinks use RotateInterval.
+	FlushInterval time.Duration `mapstructure:"flushInterval"`
+
+	// Flush batch when it holds this many events, for all batching sinks
+	// (InfluxDB, Redis, Parquet and IPFIX), regardless of BatchSize and the
+	// size of the sink's buffers. Restarts the sink's flush interval, so the
+	// next batch gets a full interval to fill up. Parquet sinks write a file
+	// per batch. Zero means no limit.
+	MaxBatchEvents uint32 `mapstructure:"maxBatchEvents"`
+
+	// Hard limit of points in a single write, only for InfluxDB sinks.
+	// A batch reaching the limit is flushed immediately, regardless of
+	// BatchSize and the size of the sink's buffers. Zero means no limit.
+	MaxBatchPoints uint32 `mapstructure:"maxBatchPoints"`
+
+	// Transport protocol of an InfluxDB sink, 'udp' or 'http'. Inferred from
+	// the scheme of Address if empty. Implied by the influxdb-udp and
+	// influxdb-http sink types.
+	Protocol string `mapstructure:"protocol"`
+
 	// Maximum network payload size, only for UDP-based sinks.
 	UDPPayloadSize uint16 `mapstructure:"udpPayloadSize"`
 
@@ -23,6 +69,10 @@ type SinkConfig struct {
 	// Whether or not the sink should receive the flows' source ports.
 	EnableSrcPort bool `mapstructure:"enableSrcPort"`
 
+	// Timestamp events with the time they were pushed into the sink,
+	// instead of the time they were captured in the kernel.
+	PushTimestamps bool `mapstructure:"pushTimestamps"`
+
 	// Name of the sink.
 	Name string `mapstructure:"-"`
 
@@ -38,8 +88,204 @@ type SinkConfig struct {
 	// Database name of the sink's backing storage.
 	Database string `mapstructure:"database"`
 
-	// Write timeout of the sink's backing storage.
+	// Maximum time a network sink waits for its backing storage to accept
+	// a write, eg. an HTTP request or a Redis pipeline. Batches of writes
+	// timing out are dropped, so a hung endpoint can't stall the sink.
+	// Defaults to DefaultWriteTimeout.
+	WriteTimeout time.Duration `mapstructure:"writeTimeout"`
+
+	// Deprecated: use WriteTimeout. Used as the write timeout if
+	// WriteTimeout is not set.
 	Timeout time.Duration `mapstructure:"timeout"`
+
+	// Name of the measurement to write points to, only for InfluxDB sinks.
+	Measurement string `mapstructure:"measurement"`
+
+	// Event attributes to send as tags and fields, only for InfluxDB sinks.
+	// Tags are indexed and queryable, but increase series cardinality.
+	Tags   []string `mapstructure:"tags"`
+	Fields []string `mapstructure:"fields"`
+
+	// Redis stream to add events to.
+	Stream string `mapstructure:"stream"`
+
+	// Approximate maximum amount of entries in the Redis stream.
+	// Older entries are trimmed when adding new ones. Zero means unlimited.
+	StreamMaxLen int64 `mapstructure:"streamMaxLen"`
+
+	// Redis Pub/Sub channel to publish events to.
+	Channel string `mapstructure:"channel"`
+
+	// MQTT topic to publish events to. A text/template executed with the
+	// event, eg. 'conntracct/{{.Type}}/{{.DstPort}}'.
+	Topic string `mapstructure:"topic"`
+
+	// QoS level (0, 1 or 2) and retained flag of the messages of an MQTT sink.
+	QoS    uint8 `mapstructure:"qos"`
+	Retain bool  `mapstructure:"retain"`
+
+	// Client ID of an MQTT sink, defaults to 'conntracct-<name>'.
+	ClientID string `mapstructure:"clientID"`
+
+	// Maximum backoff between reconnection attempts of an MQTT sink.
+	MaxReconnectInterval time.Duration `mapstructure:"maxReconnectInterval"`
+
+	// Interval at which an IPFIX sink resends its templates, so collectors
+	// started after the sink can decode its records. Defaults to 1 minute.
+	TemplateRefresh time.Duration `mapstructure:"templateRefresh"`
+
+	// Observation domain ID in the messages of an IPFIX sink.
+	ObservationDomain uint32 `mapstructure:"observationDomain"`
+
+	// Path of the socket of a unixsocket sink, and whether the sink 'listen's
+	// on the path for clients (default) or 'connect's to a socket listening
+	// on the path, eg. of a local sidecar. A stale socket at the path is
+	// replaced when listening.
+	SocketPath string `mapstructure:"socketPath"`
+	SocketMode string `mapstructure:"socketMode"`
+
+	// Output format of a stdout/stderr sink: 'line' (default), 'json',
+	// 'table' or 'influx'. 'table' prints aligned columns with a header,
+	// 'influx' InfluxDB line protocol built from Measurement, Tags and Fields.
+	Format string `mapstructure:"format"`
+
+	// Color event types in the table output of a stdout/stderr sink:
+	// 'auto' (default, only when writing to a terminal), 'always' or 'never'.
+	Color string `mapstructure:"color"`
+
+	// Maximum amount of events per second printed by a stdout/stderr sink.
+	// Excess events are suppressed, and the amount of suppressed events is
+	// printed once per second instead. No limit if zero.
+	MaxRate uint32 `mapstructure:"maxRate"`
+
+	// Amount of recent events retained by a memring sink.
+	RingSize uint32 `mapstructure:"ringSize"`
+
+	// Upper bounds of the buckets of the flow size histograms of
+	// a Prometheus sink, in bytes and packets per flow.
+	ByteBuckets   []float64 `mapstructure:"byteBuckets"`
+	PacketBuckets []float64 `mapstructure:"packetBuckets"`
+
+	// Directory to spool batches to that the sink failed to deliver, only for
+	// InfluxDB and Redis sinks. Spooled batches are retried every
+	// SpoolRetryInterval until they are delivered, also after a restart.
+	// The directory must not be shared with other sinks. Batches that don't
+	// fit in SpoolMaxBytes are dropped as usual. No spool if empty.
+	SpoolDir           string        `mapstructure:"spoolDir"`
+	SpoolMaxBytes      int64         `mapstructure:"spoolMaxBytes"`
+	SpoolRetryInterval time.Duration `mapstructure:"spoolRetryInterval"`
+
+	// Open the sink's circuit breaker after this many consecutive failed
+	// writes, only for InfluxDB, Redis and MQTT sinks. While open, batches
+	// and messages are dropped (or spooled) without contacting the backing
+	// storage, until a probe write after BreakerCooldown succeeds.
+	// BreakerCooldown defaults to 30 seconds. No breaker if zero.
+	BreakerFailures int           `mapstructure:"breakerFailures"`
+	BreakerCooldown time.Duration `mapstructure:"breakerCooldown"`
+
+	// Directory to write the files of a Parquet sink to.
+	Directory string `mapstructure:"directory"`
+
+	// Maximum time a Parquet sink buffers events before writing them to a
+	// new file. A file is also written when it reaches BatchSize events.
+	RotateInterval time.Duration `mapstructure:"rotateInterval"`
+
+	// Shard the files of a Parquet sink into separate directories below
+	// Directory by their events' 'proto' or 'netns', or by a text/template
+	// executed with the event, eg. 'port={{.DstPort}}'. Shards are named like
+	// Hive partitions, eg. 'proto=tcp/dt=2020-01-02/hour=15', and batch and
+	// rotate their files separately. At most MaxShards shards buffer events
+	// at once, the least recently used shard's file is written early to make
+	// room for a new one. Shards without events for a RotateInterval are
+	// closed. MaxShards defaults to 64. Not sharded if empty.
+	ShardBy   string `mapstructure:"shardBy"`
+	MaxShards uint32 `mapstructure:"maxShards"`
+
+	// Amount of workers calling the sink's Push method concurrently.
+	// Zero or one pushes events synchronously from the pipeline. With more
+	// than one worker, events may reach the sink out of order, depending on
+	// PushPartition.
+	PushConcurrency uint16 `mapstructure:"pushConcurrency"`
+
+	// Scheme assigning events to the sink's push workers, each pushing the
+	// events assigned to it in the order they were received:
+	//  - round-robin: events are spread evenly over the workers, events of
+	//    the same flow may reach the sink out of order. The default.
+	//  - flow-hash: events are assigned by stages.NewFlowHash, normalized
+	//    over both directions of a connection. Events of the same flow, and
+	//    of the conntrack entries of both directions, reach the sink in order.
+	//  - src-addr: events are assigned by their source address. Events of
+	//    all flows from the same address reach the sink in order.
+	// Hashed schemes can load the workers unevenly, a worker's events are
+	// dropped once its queue is full, even if other workers are idle.
+	PushPartition string `mapstructure:"pushPartition"`
+
+	// Amount of workers encoding the sink's batches, only for Redis and
+	// Parquet sinks. Batches are encoded concurrently while the sink sends
+	// or writes earlier batches, and are still sent in the order they were
+	// filled. Zero or one encodes every batch right before sending it.
+	EncodeConcurrency uint16 `mapstructure:"encodeConcurrency"`
+
+	// Discard events older than this before pushing them to the sink, eg.
+	// events that backed up in the pipeline or the sink's push workers while
+	// the sink was slow, so stale data isn't written once it recovers. The
+	// age of an event is the time since it was captured, see bpf.Event.Time.
+	// Events already pushed to the sink are sent regardless of their age.
+	// Discarded events are counted as expired, and not passed to the
+	// pipeline's dead letter sink. No maximum if zero.
+	MaxEventAge time.Duration `mapstructure:"maxEventAge"`
+
+	// Labels added to every event sent by the sink, next to the pipeline's
+	// labels, eg. a 'source' tag telling apart InfluxDB sinks writing to the
+	// same database. Tags override pipeline labels of the same name. Also
+	// added to the sink's Labels by sinks.New.
+	StaticTags map[string]string `mapstructure:"staticTags"`
+
+	// Only push events matching the given tcpdump-like filter expression
+	// to the sink, eg. 'tcp and dst port 443'. See package pkg/filter.
+	Filter string `mapstructure:"filter"`
+
+	// Designate the sink as the pipeline's dead letter sink. A dead letter sink
+	// only receives copies of events other sinks failed to deliver, like
+	// events in batches the sink's backing storage failed to accept.
+	// Only one sink can be a dead letter sink.
+	DeadLetter bool `mapstructure:"deadLetter"`
+
+	// Report the pipeline as not ready on the health endpoint while the sink
+	// is persistently failing. Failures of other sinks only degrade it.
+	Critical bool `mapstructure:"critical"`
+
+	// Called with events the sink failed to deliver. Not part of the sink's
+	// configuration file, set by the pipeline if the sink is not a dead
+	// letter sink itself.
+	OnDrop DropFunc `mapstructure:"-"`
+
+	// Static labels the pipeline adds to every event. Not part of the sink's
+	// configuration file, set by the pipeline for sinks that need to know the
+	// labels before receiving events, like Prometheus.
+	Labels map[string]string `mapstructure:"-"`
+
+	// Pool of event buffers shared with other batching sinks. Not part of
+	// the sink's configuration file, set by the pipeline. Sinks allocate
+	// their own buffers if nil.
+	BufferPool *bufpool.Pool `mapstructure:"-"`
+
+	// Limit of the writes in progress at once, shared with other network
+	// sinks: InfluxDB, Redis, MQTT and IPFIX. Not part of the sink's
+	// configuration file, set by the pipeline. No limit if nil.
+	WriteLimiter *writelimit.Limiter `mapstructure:"-"`
+}
+
+// GetWriteTimeout returns the sink's write timeout,
+// falling back to Timeout and DefaultWriteTimeout.
+func (sc SinkConfig) GetWriteTimeout() time.Duration {
+	if sc.WriteTimeout != 0 {
+		return sc.WriteTimeout
+	}
+	if sc.Timeout != 0 {
+		return sc.Timeout
+	}
+	return DefaultWriteTimeout
 }
 
 // DecodeSinkConfigMap extracts a map of SinkConfigs from configuration data.
@@ -73,6 +319,53 @@ func DecodeSinkConfigMap(cfg map[string]interface{}) ([]SinkConfig, error) {
 	return out, nil
 }
 
+// sinkTypeNames are the names of the sink types in configuration.
+// A type's first name is its canonical name, see SinkType.ConfigName.
+var sinkTypeNames = []struct {
+	name string
+	st   SinkType
+}{
+	{"dummy", Dummy},
+	{"stdout", StdOut},
+	{"stderr", StdErr},
+	{"influxdb-udp", InfluxUDP},
+	{"influxdb-http", InfluxHTTP},
+	{"elastic", Elastic},
+	{"elasticsearch", Elastic},
+	{"redis", Redis},
+	{"memring", MemRing},
+	{"influxdb", InfluxDB},
+	{"prometheus", Prometheus},
+	{"parquet", Parquet},
+	{"mqtt", MQTT},
+	{"ipfix", IPFIX},
+	{"unixsocket", UnixSocket},
+}
+
+// SinkTypeNames returns the canonical configuration names
+// of all supported sink types.
+func SinkTypeNames() []string {
+	var out []string
+	for i, n := range sinkTypeNames {
+		if i > 0 && sinkTypeNames[i-1].st == n.st {
+			continue
+		}
+		out = append(out, n.name)
+	}
+	return out
+}
+
+// ConfigName returns the canonical name of the sink type in configuration,
+// eg. 'influxdb' for InfluxDB.
+func (st SinkType) ConfigName() string {
+	for _, n := range sinkTypeNames {
+		if n.st == st {
+			return n.name
+		}
+	}
+	return st.String()
+}
+
 // stringToSinkTypeHookFunc returns a mapstructure.DecodeHookFunc that converts
 // strings to SinkTypes.
 func stringToSinkTypeHookFunc() mapstructure.DecodeHookFunc {
@@ -87,21 +380,12 @@ func stringToSinkTypeHookFunc() mapstructure.DecodeHookFunc {
 			return data, nil
 		}
 
-		switch data {
-		case "dummy":
-			return Dummy, nil
-		case "stdout":
-			return StdOut, nil
-		case "stderr":
-			return StdErr, nil
-		case "influxdb-udp":
-			return InfluxUDP, nil
-		case "influxdb-http":
-			return InfluxHTTP, nil
-		case "elastic", "elasticsearch":
-			return Elastic, nil
-		default:
-			return SinkType(0), fmt.Errorf("failed parsing sink type %v", data)
+		for _, n := range sinkTypeNames {
+			if data == n.name {
+				return n.st, nil
+			}
 		}
+
+		return SinkType(0), fmt.Errorf("failed parsing sink type %v", data)
 	}
 }
@@ -11,6 +11,12 @@ type SinkStats struct {
 	EventsPushed uint64 `json:"events_pushed"`
 	// Amount of events failed to be Push()ed into the sink.
 	EventsDropped uint64 `json:"events_dropped"`
+	// Amount of events discarded by the sink's rate cap, only for
+	// stdout/stderr sinks.
+	EventsSuppressed uint64 `json:"events_suppressed,omitempty"`
+	// Amount of events discarded before reaching the sink since they were
+	// older than the sink's MaxEventAge. Not counted as dropped.
+	EventsExpired uint64 `json:"events_expired,omitempty"`
 
 	// Current batch length of the sink.
 	BatchLength uint64 `json:"batch_length"`
@@ -18,6 +24,37 @@ type SinkStats struct {
 	BatchesSent uint64 `json:"batches_sent"`
 	// Amount of batches failed to be sent.
 	BatchesDropped uint64 `json:"batches_dropped"`
+	// Amount of dropped batches that failed to be sent
+	// within the sink's write timeout.
+	BatchesTimedOut uint64 `json:"batches_timed_out"`
+
+	// Amount of batches in the sink's spool, waiting to be replayed.
+	SpoolDepth uint64 `json:"spool_depth,omitempty"`
+	// Amount of failed batches written to the sink's spool instead
+	// of being dropped.
+	BatchesSpooled uint64 `json:"batches_spooled,omitempty"`
+	// Amount of spooled batches delivered when replayed.
+	BatchesReplayed uint64 `json:"batches_replayed,omitempty"`
+
+	// Amount of files written, only for sinks writing files.
+	FilesWritten uint64 `json:"files_written,omitempty"`
+	// Amount of files failed to be written. Their events are dropped.
+	FilesFailed uint64 `json:"files_failed,omitempty"`
+
+	// Amount of messages published, only for sinks publishing
+	// a message per event.
+	MessagesPublished uint64 `json:"messages_published,omitempty"`
+	// Amount of messages failed to be published. Their events are dropped.
+	MessagesFailed uint64 `json:"messages_failed,omitempty"`
+	// Amount of times the sink reconnected to its backing storage.
+	Reconnects uint64 `json:"reconnects,omitempty"`
+
+	// State of the sink's circuit breaker, see breaker.State: 0 (closed),
+	// 1 (open) or 2 (half-open). Batches and messages rejected by an open
+	// breaker are counted as dropped or failed.
+	BreakerState uint64 `json:"breaker_state,omitempty"`
+	// Amount of times the sink's circuit breaker opened.
+	BreakerTrips uint64 `json:"breaker_trips,omitempty"`
 }
 
 // IncrEventsPushed atomically increases the sink's event counter by one.
@@ -30,6 +67,12 @@ func (s *SinkStats) IncrEventsDropped() {
 	atomic.AddUint64(&s.EventsDropped, 1)
 }
 
+// AddEventsSuppressed atomically increases the sink's suppressed event
+// counter by n.
+func (s *SinkStats) AddEventsSuppressed(n uint64) {
+	atomic.AddUint64(&s.EventsSuppressed, n)
+}
+
 // SetBatchLength sets the length of the current batch.
 func (s *SinkStats) SetBatchLength(l int) {
 	atomic.StoreUint64(&s.BatchLength, uint64(l))
@@ -40,11 +83,69 @@ func (s *SinkStats) IncrBatchDropped() {
 	atomic.AddUint64(&s.BatchesDropped, 1)
 }
 
+// IncrBatchTimedOut atomically increases the sink's dropped and
+// timed out batch counters by one.
+func (s *SinkStats) IncrBatchTimedOut() {
+	atomic.AddUint64(&s.BatchesDropped, 1)
+	atomic.AddUint64(&s.BatchesTimedOut, 1)
+}
+
 // IncrBatchSent atomically increases the sink's sent batch counter by one.
 func (s *SinkStats) IncrBatchSent() {
 	atomic.AddUint64(&s.BatchesSent, 1)
 }
 
+// SetSpoolDepth sets the amount of batches in the sink's spool.
+func (s *SinkStats) SetSpoolDepth(l int) {
+	atomic.StoreUint64(&s.SpoolDepth, uint64(l))
+}
+
+// IncrBatchSpooled atomically increases the sink's spooled batch counter by one.
+func (s *SinkStats) IncrBatchSpooled() {
+	atomic.AddUint64(&s.BatchesSpooled, 1)
+}
+
+// AddBatchesReplayed atomically increases the sink's replayed batch counter by n.
+func (s *SinkStats) AddBatchesReplayed(n int) {
+	atomic.AddUint64(&s.BatchesReplayed, uint64(n))
+}
+
+// IncrFilesWritten atomically increases the sink's written file counter by one.
+func (s *SinkStats) IncrFilesWritten() {
+	atomic.AddUint64(&s.FilesWritten, 1)
+}
+
+// IncrFilesFailed atomically increases the sink's failed file counter by one.
+func (s *SinkStats) IncrFilesFailed() {
+	atomic.AddUint64(&s.FilesFailed, 1)
+}
+
+// IncrMessagePublished atomically increases the sink's published message
+// counter by one.
+func (s *SinkStats) IncrMessagePublished() {
+	atomic.AddUint64(&s.MessagesPublished, 1)
+}
+
+// IncrMessageFailed atomically increases the sink's failed message counter by one.
+func (s *SinkStats) IncrMessageFailed() {
+	atomic.AddUint64(&s.MessagesFailed, 1)
+}
+
+// IncrReconnect atomically increases the sink's reconnect counter by one.
+func (s *SinkStats) IncrReconnect() {
+	atomic.AddUint64(&s.Reconnects, 1)
+}
+
+// SetBreakerState sets the state of the sink's circuit breaker.
+func (s *SinkStats) SetBreakerState(state uint32) {
+	atomic.StoreUint64(&s.BreakerState, uint64(state))
+}
+
+// IncrBreakerTrip atomically increases the sink's breaker trip counter by one.
+func (s *SinkStats) IncrBreakerTrip() {
+	atomic.AddUint64(&s.BreakerTrips, 1)
+}
+
 // Get returns a copy of the SinkStats structure created using atomic loads.
 // The values can be inconsistent with each other, as they are written and
 // read concurrently without locks.
@@ -55,5 +156,24 @@ func (s *SinkStats) Get() SinkStats {
 		BatchLength:    atomic.LoadUint64(&s.BatchLength),
 		BatchesSent:    atomic.LoadUint64(&s.BatchesSent),
 		BatchesDropped: atomic.LoadUint64(&s.BatchesDropped),
+
+		EventsSuppressed: atomic.LoadUint64(&s.EventsSuppressed),
+		EventsExpired:    atomic.LoadUint64(&s.EventsExpired),
+
+		BatchesTimedOut: atomic.LoadUint64(&s.BatchesTimedOut),
+
+		SpoolDepth:      atomic.LoadUint64(&s.SpoolDepth),
+		BatchesSpooled:  atomic.LoadUint64(&s.BatchesSpooled),
+		BatchesReplayed: atomic.LoadUint64(&s.BatchesReplayed),
+
+		FilesWritten: atomic.LoadUint64(&s.FilesWritten),
+		FilesFailed:  atomic.LoadUint64(&s.FilesFailed),
+
+		MessagesPublished: atomic.LoadUint64(&s.MessagesPublished),
+		MessagesFailed:    atomic.LoadUint64(&s.MessagesFailed),
+		Reconnects:        atomic.LoadUint64(&s.Reconnects),
+
+		BreakerState: atomic.LoadUint64(&s.BreakerState),
+		BreakerTrips: atomic.LoadUint64(&s.BreakerTrips),
 	}
 }
@@ -12,4 +12,16 @@ const (
 	InfluxUDP
 	InfluxHTTP
 	Elastic
+	Redis
+	MemRing
+
+	// InfluxDB over the transport given in the sink's Protocol.
+	// InfluxUDP and InfluxHTTP are kept for compatibility
+	// and are handled by the same sink.
+	InfluxDB
+	Prometheus
+	Parquet
+	MQTT
+	IPFIX
+	UnixSocket
 )
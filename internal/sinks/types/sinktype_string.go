@@ -14,11 +14,19 @@ func _() {
 	_ = x[InfluxUDP-3]
 	_ = x[InfluxHTTP-4]
 	_ = x[Elastic-5]
+	_ = x[Redis-6]
+	_ = x[MemRing-7]
+	_ = x[InfluxDB-8]
+	_ = x[Prometheus-9]
+	_ = x[Parquet-10]
+	_ = x[MQTT-11]
+	_ = x[IPFIX-12]
+	_ = x[UnixSocket-13]
 }
 
-const _SinkType_name = "DummyStdOutStdErrInfluxUDPInfluxHTTPElastic"
+const _SinkType_name = "DummyStdOutStdErrInfluxUDPInfluxHTTPElasticRedisMemRingInfluxDBPrometheusParquetMQTTIPFIXUnixSocket"
 
-var _SinkType_index = [...]uint8{0, 5, 11, 17, 26, 36, 43}
+var _SinkType_index = [...]uint8{0, 5, 11, 17, 26, 36, 43, 48, 55, 63, 73, 80, 84, 89, 99}
 
 func (i SinkType) String() string {
 	if i >= SinkType(len(_SinkType_index)-1) {
@@ -0,0 +1,14 @@
+package unixsocket
+
+import "errors"
+
+const (
+	errFmtUnknownMode = "unknown socket mode '%s', expected 'listen' or 'connect'"
+	errFmtNotSocket   = "'%s' exists and is not a socket"
+)
+
+var (
+	errEmptySinkName   = errors.New("empty sink name")
+	errEmptySocketPath = errors.New("empty sink socket path")
+	errInvalidSinkType = errors.New("invalid sink type")
+)
@@ -0,0 +1,236 @@
+// Package unixsocket implements an accounting sink streaming events
+// to local processes over a Unix domain socket.
+package unixsocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Socket modes of the UnixSocket sink.
+const (
+	modeListen  = "listen"
+	modeConnect = "connect"
+)
+
+const (
+	// Amount of events queued per client if the sink has no BatchSize.
+	defaultQueueSize = 2048
+
+	// Interval at which a connecting sink redials its socket
+	// after failing to connect or losing its connection.
+	redialInterval = time.Second
+)
+
+// UnixSocketSink is an accounting sink streaming events to local processes
+// over a Unix domain socket, as newline-delimited JSON objects. The sink
+// either listens on its socket and streams events to every connected client,
+// or connects to a socket another process listens on, redialing it when the
+// connection is lost.
+//
+// Every client has its own queue of BatchSize events, so a slow client can't
+// hold up the others. Events that don't fit in a client's queue are dropped
+// for that client and counted as failed messages. A client not accepting
+// a write within the sink's write timeout is disconnected. Events that reach
+// no client are counted as dropped, except when a listening sink has no
+// clients connected.
+type UnixSocketSink struct {
+
+	// Sink had Init() called on it successfully.
+	init bool
+
+	// Sink's configuration object.
+	config types.SinkConfig
+
+	// Listening socket, nil if the sink connects to its socket.
+	listener net.Listener
+
+	// Connected clients, at most one if the sink connects to its socket.
+	// Set to nil when the sink is closed.
+	mu      sync.Mutex
+	clients map[*client]struct{}
+	closed  bool
+
+	// Closed to stop the sink's dialer.
+	quit chan struct{}
+
+	// Waits for the clients' writers to finish after Close.
+	wg sync.WaitGroup
+
+	// Sink stats.
+	stats types.SinkStats
+}
+
+// New returns a new Unix socket accounting sink.
+func New() UnixSocketSink {
+	return UnixSocketSink{}
+}
+
+// Init initializes the Unix socket accounting sink. Listening on the socket
+// fails if the path exists and is not a socket. A connecting sink starts
+// dialing its socket in the background, it doesn't need to exist yet.
+func (s *UnixSocketSink) Init(sc types.SinkConfig) error {
+
+	// Validate / sanitize input.
+	if sc.Type != types.UnixSocket {
+		return errInvalidSinkType
+	}
+	if sc.Name == "" {
+		return errEmptySinkName
+	}
+	if sc.SocketPath == "" {
+		return errEmptySocketPath
+	}
+	if sc.SocketMode == "" {
+		sc.SocketMode = modeListen
+	}
+	if sc.BatchSize == 0 {
+		sc.BatchSize = defaultQueueSize
+	}
+
+	s.config = sc
+	s.clients = make(map[*client]struct{})
+	s.quit = make(chan struct{})
+
+	switch sc.SocketMode {
+	case modeListen:
+		l, err := listen(sc.SocketPath)
+		if err != nil {
+			return err
+		}
+		s.listener = l
+		go s.acceptWorker()
+	case modeConnect:
+		go s.dialWorker()
+	default:
+		return fmt.Errorf(errFmtUnknownMode, sc.SocketMode)
+	}
+
+	// Mark the sink as initialized.
+	s.init = true
+
+	return nil
+}
+
+// listen listens on the Unix socket at path, replacing a stale socket.
+func listen(path string) (net.Listener, error) {
+
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf(errFmtNotSocket, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen("unix", path)
+}
+
+// Push an accounting event into the queues of the sink's clients.
+func (s *UnixSocketSink) Push(e bpf.Event) {
+
+	// Use the time the event was captured in the kernel, unless configured
+	// to use the time the event was pushed into the sink.
+	if s.config.PushTimestamps {
+		e.Time = time.Now()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+		return
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	clients, sent := len(s.clients), 0
+	for c := range s.clients {
+		// Non-blocking send on the client's queue.
+		select {
+		case c.msgs <- b:
+			sent++
+		default:
+			s.stats.IncrMessageFailed()
+		}
+	}
+	s.mu.Unlock()
+
+	// A listening sink without clients has no one to deliver the event to.
+	if sent == 0 && (clients != 0 || s.listener == nil) {
+		s.stats.IncrEventsDropped()
+		s.config.OnDrop.Drop(e)
+		return
+	}
+
+	s.stats.IncrEventsPushed()
+}
+
+// Clients returns the amount of clients connected to the sink.
+func (s *UnixSocketSink) Clients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// Name gets the name of the Unix socket accounting sink.
+func (s *UnixSocketSink) Name() string {
+	return s.config.Name
+}
+
+// IsInit checks if the Unix socket accounting sink was successfully initialized.
+func (s *UnixSocketSink) IsInit() bool {
+	return s.init
+}
+
+// WantUpdate always returns true.
+func (s *UnixSocketSink) WantUpdate() bool {
+	return true
+}
+
+// WantDestroy always returns true, UnixSocket receives destroy events. (flow totals)
+func (s *UnixSocketSink) WantDestroy() bool {
+	return true
+}
+
+// WantNew always returns true, UnixSocket streams new flows.
+func (s *UnixSocketSink) WantNew() bool {
+	return true
+}
+
+// Stats returns the Unix socket accounting sink's statistics structure.
+func (s *UnixSocketSink) Stats() types.SinkStats {
+	return s.stats.Get()
+}
+
+// Close stops accepting or dialing clients, and disconnects the sink's clients
+// after writing their queued events. Removes the socket of a listening sink.
+func (s *UnixSocketSink) Close() error {
+
+	close(s.quit)
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.clients {
+		close(c.msgs)
+	}
+	s.clients = nil
+	s.mu.Unlock()
+
+	s.wg.Wait()
+
+	return err
+}
@@ -0,0 +1,218 @@
+package unixsocket_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/sinks/unixsocket"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// socketPath returns the path of a socket in a temporary directory,
+// and a function removing the directory.
+func socketPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "conntracct-unixsocket")
+	require.NoError(t, err)
+	return filepath.Join(dir, "events.sock"), func() { os.RemoveAll(dir) }
+}
+
+func testEvent(id uint32) bpf.Event {
+	return bpf.Event{
+		Type:         bpf.EventUpdate,
+		ConnectionID: id,
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		DstPort:      443,
+		Proto:        6,
+		BytesOrig:    100,
+	}
+}
+
+// readEvent decodes the next event streamed over r.
+func readEvent(t *testing.T, conn net.Conn, r *bufio.Reader) bpf.Event {
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	l, err := r.ReadBytes('\n')
+	require.NoError(t, err)
+
+	var e bpf.Event
+	require.NoError(t, json.Unmarshal(l, &e))
+
+	return e
+}
+
+// pushUntil pushes events into s until cond returns true.
+func pushUntil(t *testing.T, s *unixsocket.UnixSocketSink, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for i := uint32(0); !cond(); i++ {
+		require.True(t, time.Now().Before(deadline), "condition never satisfied")
+		s.Push(testEvent(i))
+		if i%100 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestUnixSocketInit(t *testing.T) {
+
+	path, cleanup := socketPath(t)
+	defer cleanup()
+
+	s := unixsocket.New()
+	assert.Error(t, s.Init(types.SinkConfig{Name: "us", Type: types.StdOut, SocketPath: path}))
+	assert.Error(t, s.Init(types.SinkConfig{Type: types.UnixSocket, SocketPath: path}))
+	assert.Error(t, s.Init(types.SinkConfig{Name: "us", Type: types.UnixSocket}))
+	assert.EqualError(t, s.Init(types.SinkConfig{Name: "us", Type: types.UnixSocket, SocketPath: path, SocketMode: "bind"}),
+		"unknown socket mode 'bind', expected 'listen' or 'connect'")
+
+	// Refuse to replace a file that isn't a socket.
+	require.NoError(t, ioutil.WriteFile(path, nil, 0600))
+	assert.Error(t, s.Init(types.SinkConfig{Name: "us", Type: types.UnixSocket, SocketPath: path}))
+	assert.False(t, s.IsInit())
+}
+
+func TestUnixSocketListen(t *testing.T) {
+
+	path, cleanup := socketPath(t)
+	defer cleanup()
+
+	// A stale socket is replaced.
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	s := unixsocket.New()
+	require.NoError(t, s.Init(types.SinkConfig{Name: "us", Type: types.UnixSocket, SocketPath: path}))
+	assert.True(t, s.IsInit())
+
+	// Without clients, events are discarded.
+	s.Push(testEvent(1))
+	assert.EqualValues(t, 1, s.Stats().EventsPushed)
+	assert.Zero(t, s.Stats().EventsDropped)
+
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer c.Close()
+		conns = append(conns, c)
+		readers = append(readers, bufio.NewReader(c))
+	}
+	require.Eventually(t, func() bool { return s.Clients() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// Every client receives every event, in order.
+	s.Push(testEvent(2))
+	s.Push(testEvent(3))
+	for i := range conns {
+		assert.EqualValues(t, 2, readEvent(t, conns[i], readers[i]).ConnectionID)
+		e := readEvent(t, conns[i], readers[i])
+		assert.EqualValues(t, 3, e.ConnectionID)
+		assert.True(t, e.DstAddr.Equal(net.IPv4(10, 0, 0, 2)))
+	}
+
+	// A client closing its connection is disconnected on the next write.
+	require.NoError(t, conns[0].Close())
+	pushUntil(t, &s, func() bool { return s.Clients() == 1 })
+
+	require.NoError(t, s.Close())
+	assert.Zero(t, s.Stats().EventsDropped)
+
+	// The socket is removed when the sink is closed.
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnixSocketSlowClient(t *testing.T) {
+
+	path, cleanup := socketPath(t)
+	defer cleanup()
+
+	var dropped int
+	s := unixsocket.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:         "us",
+		Type:         types.UnixSocket,
+		SocketPath:   path,
+		BatchSize:    1,
+		WriteTimeout: 100 * time.Millisecond,
+		OnDrop:       func(evs []bpf.Event) { dropped += len(evs) },
+	}))
+	defer s.Close()
+
+	// A client that never reads.
+	c, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Eventually(t, func() bool { return s.Clients() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Events beyond the client's queue and socket buffer are dropped without
+	// blocking the pipeline, until the client is disconnected once a write
+	// times out.
+	pushUntil(t, &s, func() bool { return s.Clients() == 0 })
+
+	stats := s.Stats()
+	assert.NotZero(t, stats.MessagesFailed)
+	assert.NotZero(t, stats.EventsDropped)
+	assert.EqualValues(t, stats.EventsDropped, dropped)
+}
+
+func TestUnixSocketConnect(t *testing.T) {
+
+	path, cleanup := socketPath(t)
+	defer cleanup()
+
+	var dropped int
+	s := unixsocket.New()
+	require.NoError(t, s.Init(types.SinkConfig{
+		Name:       "us",
+		Type:       types.UnixSocket,
+		SocketPath: path,
+		SocketMode: "connect",
+		OnDrop:     func(evs []bpf.Event) { dropped += len(evs) },
+	}))
+	defer s.Close()
+
+	// Events are dropped while the sink isn't connected.
+	s.Push(testEvent(1))
+	assert.EqualValues(t, 1, s.Stats().EventsDropped)
+	assert.Equal(t, 1, dropped)
+
+	// The sink connects once the socket is listened on.
+	l, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer l.Close()
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	require.Eventually(t, func() bool { return s.Clients() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	s.Push(testEvent(2))
+	assert.EqualValues(t, 2, readEvent(t, conn, r).ConnectionID)
+
+	// The sink redials after losing its connection.
+	require.NoError(t, conn.Close())
+	pushUntil(t, &s, func() bool { return s.Clients() == 0 })
+
+	conn, err = l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	r = bufio.NewReader(conn)
+	require.Eventually(t, func() bool { return s.Clients() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	s.Push(testEvent(4))
+	assert.EqualValues(t, 4, readEvent(t, conn, r).ConnectionID)
+	assert.EqualValues(t, 1, s.Stats().Reconnects)
+}
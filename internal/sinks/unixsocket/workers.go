@@ -0,0 +1,169 @@
+package unixsocket
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/logging"
+)
+
+// client is a connection the sink streams events to.
+type client struct {
+	conn net.Conn
+
+	// Queue of encoded events, closed by the sink's Close.
+	msgs chan []byte
+
+	// Closed when the client is disconnected.
+	quit chan struct{}
+	once sync.Once
+}
+
+// add starts streaming events to conn. Returns nil and closes conn
+// if the sink was closed.
+func (s *UnixSocketSink) add(conn net.Conn) *client {
+
+	c := &client{
+		conn: conn,
+		msgs: make(chan []byte, s.config.BatchSize),
+		quit: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		conn.Close()
+		return nil
+	}
+
+	s.clients[c] = struct{}{}
+
+	s.wg.Add(1)
+	go s.writeWorker(c)
+	go s.readWorker(c)
+
+	return c
+}
+
+// remove disconnects a client. Safe to call more than once.
+func (s *UnixSocketSink) remove(c *client) {
+	c.once.Do(func() {
+		s.mu.Lock()
+		delete(s.clients, c)
+		s.mu.Unlock()
+
+		close(c.quit)
+		c.conn.Close()
+	})
+}
+
+// acceptWorker accepts clients on the sink's listener until it is closed.
+func (s *UnixSocketSink) acceptWorker() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quit:
+			default:
+				logging.Sink(s.config.Name, s.config.Type).WithError(err).Error("Error accepting client")
+			}
+			return
+		}
+		s.add(conn)
+	}
+}
+
+// dialWorker connects to the sink's socket, and redials it every
+// redialInterval while disconnected, until the sink is closed.
+func (s *UnixSocketSink) dialWorker() {
+
+	connected := false
+
+	for {
+		conn, err := net.Dial("unix", s.config.SocketPath)
+		if err == nil {
+			c := s.add(conn)
+			if c == nil {
+				return
+			}
+
+			if connected {
+				s.stats.IncrReconnect()
+			}
+			connected = true
+
+			// Wait for the connection to be lost.
+			select {
+			case <-c.quit:
+				logging.Sink(s.config.Name, s.config.Type).Warn("Connection lost")
+			case <-s.quit:
+				return
+			}
+		}
+
+		select {
+		case <-time.After(redialInterval):
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// writeWorker writes the events queued for a client to its connection, until
+// its queue is closed or it is disconnected. Disconnects the client if a write
+// fails or doesn't complete within the sink's write timeout.
+func (s *UnixSocketSink) writeWorker(c *client) {
+
+	defer s.wg.Done()
+	defer s.remove(c)
+
+	w := bufio.NewWriter(c.conn)
+
+	write := func(f func() error) bool {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(s.config.GetWriteTimeout()))
+		if err := f(); err != nil {
+			s.stats.IncrMessageFailed()
+			logging.Sink(s.config.Name, s.config.Type).WithError(err).Warn("Error writing to client, disconnecting")
+			return false
+		}
+		return true
+	}
+
+	for {
+		select {
+		case m, ok := <-c.msgs:
+			if !ok {
+				write(w.Flush)
+				return
+			}
+
+			if !write(func() error { _, err := w.Write(m); return err }) {
+				return
+			}
+			s.stats.IncrMessagePublished()
+
+			// Flush once the queue is drained, batching writes
+			// while the client is catching up.
+			if len(c.msgs) == 0 && !write(w.Flush) {
+				return
+			}
+
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// readWorker discards anything the client sends, and disconnects the client
+// if its connection fails. A client closing its end of the connection, which
+// may only be its writing half, is disconnected when a write fails.
+func (s *UnixSocketSink) readWorker(c *client) {
+	if _, err := io.Copy(ioutil.Discard, c.conn); err != nil {
+		s.remove(c)
+	}
+}
@@ -0,0 +1,288 @@
+package sinks
+
+import (
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+	"github.com/ti-mo/conntracct/pkg/filter"
+)
+
+const (
+	// Amount of events queued per worker of a pooledSink.
+	poolQueueLength = 1024
+)
+
+// Schemes assigning the events pushed into a pooledSink to its workers,
+// see types.SinkConfig.PushPartition.
+const (
+	PartitionRoundRobin = "round-robin"
+	PartitionFlowHash   = "flow-hash"
+	PartitionSrcAddr    = "src-addr"
+)
+
+// unwrap returns the Sink wrapped by filtered, pooled, aged, tagged and dead
+// letter sinks.
+func unwrap(s Sink) Sink {
+	for {
+		switch w := s.(type) {
+		case filteredSink:
+			s = w.Sink
+		case *agedSink:
+			s = w.Sink
+		case taggedSink:
+			s = w.Sink
+		case *pooledSink:
+			s = w.Sink
+		case deadLetterSink:
+			s = w.Sink
+		default:
+			return s
+		}
+	}
+}
+
+// filteredSink is a Sink that only receives events matching a filter.
+type filteredSink struct {
+	Sink
+	filter *filter.Filter
+}
+
+// Push pushes the event to the underlying Sink if it matches the filter.
+func (fs filteredSink) Push(e bpf.Event) {
+	if fs.filter.Match(e) {
+		fs.Sink.Push(e)
+	}
+}
+
+// agedSink is a Sink that discards events older than a maximum age.
+type agedSink struct {
+	Sink
+	maxAge time.Duration
+
+	// Returns the current time, overridden in tests.
+	now func() time.Time
+
+	// Amount of events discarded because they were too old.
+	expired uint64
+}
+
+// newAgedSink returns a Sink discarding events older than maxAge
+// before pushing them into s.
+func newAgedSink(s Sink, maxAge time.Duration) *agedSink {
+	return &agedSink{Sink: s, maxAge: maxAge, now: time.Now}
+}
+
+// Push pushes the event to the underlying Sink unless it's older than the
+// maximum age. Events without a time are always pushed.
+func (as *agedSink) Push(e bpf.Event) {
+	if !e.Time.IsZero() && as.now().Sub(e.Time) > as.maxAge {
+		atomic.AddUint64(&as.expired, 1)
+		return
+	}
+	as.Sink.Push(e)
+}
+
+// Stats returns the underlying Sink's statistics, with the
+// events discarded because of their age counted as expired.
+func (as *agedSink) Stats() types.SinkStats {
+	st := as.Sink.Stats()
+	st.EventsExpired += atomic.LoadUint64(&as.expired)
+	return st
+}
+
+// taggedSink is a Sink adding static tags to the labels of every event.
+type taggedSink struct {
+	Sink
+	tags map[string]string
+
+	// The pipeline's labels, and the same labels with the tags added,
+	// set on most events.
+	global map[string]string
+	merged map[string]string
+}
+
+// newTaggedSink returns a Sink adding tags to the labels of events pushed
+// into s, overriding labels of the same name, like the global labels.
+func newTaggedSink(s Sink, global, tags map[string]string) taggedSink {
+	return taggedSink{
+		Sink:   s,
+		tags:   tags,
+		global: global,
+		merged: mergeLabels(global, tags),
+	}
+}
+
+// Push pushes the event with the sink's tags added to its labels. The labels
+// of the event are shared with other sinks and are not modified.
+func (ts taggedSink) Push(e bpf.Event) {
+	switch {
+	case len(e.Labels) == 0:
+		e.Labels = ts.tags
+	case sameMap(e.Labels, ts.global):
+		// Labels set by the pipeline, merged upfront.
+		e.Labels = ts.merged
+	default:
+		e.Labels = mergeLabels(e.Labels, ts.tags)
+	}
+	ts.Sink.Push(e)
+}
+
+// mergeLabels returns a new map holding the labels of a and b. Labels
+// of b override those of a.
+func mergeLabels(a, b map[string]string) map[string]string {
+	m := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// sameMap returns true if a and b are the same map, not merely equal.
+func sameMap(a, b map[string]string) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// pooledSink is a Sink that queues events to a pool of workers, which call
+// the underlying Sink's Push method concurrently. Used for sinks that do
+// CPU-heavy work in Push, like encoding events. Every worker has a queue of
+// its own, events are queued to a worker chosen by the pool's partition func.
+type pooledSink struct {
+	Sink
+
+	queues    []chan bpf.Event
+	partition partitionFunc
+	wg        sync.WaitGroup
+	onDrop    types.DropFunc
+
+	// Amount of events dropped because the queue was full.
+	dropped uint64
+}
+
+// partitionFunc returns a number identifying the worker of a pooledSink an
+// event is queued to, modulo the amount of workers.
+type partitionFunc func(bpf.Event) uint32
+
+// newPartitionFunc returns the partitionFunc of the named partitioning
+// scheme, round-robin if empty.
+func newPartitionFunc(scheme string) (partitionFunc, error) {
+
+	switch scheme {
+	case "", PartitionRoundRobin:
+		var next uint32
+		return func(bpf.Event) uint32 {
+			return atomic.AddUint32(&next, 1)
+		}, nil
+	case PartitionFlowHash:
+		return func(e bpf.Event) uint32 {
+			return uint32(stages.NewFlowHash(e))
+		}, nil
+	case PartitionSrcAddr:
+		return srcAddrHash, nil
+	}
+
+	return nil, fmt.Errorf("push partitioning scheme '%s' not implemented", scheme)
+}
+
+// newPooledSink starts n workers pushing events into s, queued to the worker
+// chosen by partition. Events dropped because a worker's queue is full are
+// passed to onDrop.
+func newPooledSink(s Sink, n int, partition partitionFunc, onDrop types.DropFunc) *pooledSink {
+
+	ps := &pooledSink{
+		Sink:      s,
+		queues:    make([]chan bpf.Event, n),
+		partition: partition,
+		onDrop:    onDrop,
+	}
+
+	ps.wg.Add(n)
+	for i := range ps.queues {
+		ps.queues[i] = make(chan bpf.Event, poolQueueLength)
+		go ps.pushWorker(ps.queues[i])
+	}
+
+	return ps
+}
+
+// srcAddrHash returns the FNV-1a hash of the event's source address.
+func srcAddrHash(e bpf.Event) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write(e.SrcAddr.To16())
+	return h.Sum32()
+}
+
+// worker returns the index of the worker the event is queued to.
+func (ps *pooledSink) worker(e bpf.Event) int {
+	return int(ps.partition(e) % uint32(len(ps.queues)))
+}
+
+// Push queues the event to its worker without blocking.
+// The event is dropped if the worker's queue is full.
+func (ps *pooledSink) Push(e bpf.Event) {
+	select {
+	case ps.queues[ps.worker(e)] <- e:
+	default:
+		atomic.AddUint64(&ps.dropped, 1)
+		ps.onDrop.Drop(e)
+	}
+}
+
+// Stats returns the underlying Sink's statistics, with events dropped
+// by the pool added to its dropped event counter.
+func (ps *pooledSink) Stats() types.SinkStats {
+	st := ps.Sink.Stats()
+	st.EventsDropped += atomic.LoadUint64(&ps.dropped)
+	return st
+}
+
+// Close stops the pool's workers after pushing all queued events,
+// and closes the underlying Sink.
+func (ps *pooledSink) Close() error {
+	for _, q := range ps.queues {
+		close(q)
+	}
+	ps.wg.Wait()
+	return ps.Sink.Close()
+}
+
+// pushWorker pushes events from a worker's queue into
+// the underlying Sink until the queue is closed.
+func (ps *pooledSink) pushWorker(q chan bpf.Event) {
+	defer ps.wg.Done()
+
+	for e := range q {
+		ps.Sink.Push(e)
+	}
+}
+
+// deadLetterSink is a Sink that only receives events other sinks failed
+// to deliver. It is registered to the pipeline like other sinks, but
+// does not want any events from the pipeline's sources.
+type deadLetterSink struct {
+	Sink
+}
+
+// WantUpdate always returns false.
+func (deadLetterSink) WantUpdate() bool {
+	return false
+}
+
+// WantDestroy always returns false.
+func (deadLetterSink) WantDestroy() bool {
+	return false
+}
+
+// WantNew always returns false.
+func (deadLetterSink) WantNew() bool {
+	return false
+}
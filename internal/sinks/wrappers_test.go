@@ -0,0 +1,309 @@
+package sinks
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/memring"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// slowSink is a Dummy sink that takes a fixed amount of time per Push.
+type slowSink struct {
+	Sink
+	delay time.Duration
+}
+
+func (s slowSink) Push(e bpf.Event) {
+	time.Sleep(s.delay)
+	s.Sink.Push(e)
+}
+
+func newDummy(t testing.TB) Sink {
+	s, err := New(types.SinkConfig{Name: "dummy", Type: types.Dummy})
+	require.NoError(t, err)
+	return s
+}
+
+// roundRobin returns the partitionFunc of the default scheme.
+func roundRobin(t testing.TB) partitionFunc {
+	pf, err := newPartitionFunc("")
+	require.NoError(t, err)
+	return pf
+}
+
+func TestPooledSinkStats(t *testing.T) {
+
+	const (
+		pushers = 4
+		events  = 1000
+	)
+
+	ps := newPooledSink(newDummy(t), 8, roundRobin(t), nil)
+
+	// Push from multiple goroutines at once, like the pipeline's
+	// update and destroy workers do.
+	var wg sync.WaitGroup
+	for i := 0; i < pushers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < events; j++ {
+				ps.Push(bpf.Event{})
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Close drains the queue before returning.
+	require.NoError(t, ps.Close())
+
+	st := ps.Stats()
+	assert.EqualValues(t, pushers*events, st.EventsPushed)
+	assert.Zero(t, st.EventsDropped)
+}
+
+func TestPooledSinkDrop(t *testing.T) {
+
+	var dropped uint64
+	onDrop := func(evs []bpf.Event) {
+		dropped += uint64(len(evs))
+	}
+
+	// A single worker blocked on a slow sink can't drain the queue.
+	ps := newPooledSink(slowSink{newDummy(t), 100 * time.Millisecond}, 1, roundRobin(t), onDrop)
+
+	for i := 0; i < poolQueueLength+10; i++ {
+		ps.Push(bpf.Event{})
+	}
+
+	// The worker holds at most one event, the rest is queued or dropped.
+	st := ps.Stats()
+	assert.True(t, st.EventsDropped >= 9, "dropped %d events", st.EventsDropped)
+	assert.Equal(t, st.EventsDropped, dropped, "dropped events not passed to onDrop")
+}
+
+func TestPooledSinkPartition(t *testing.T) {
+
+	const workers = 8
+
+	flow := func(cid uint32, src, dst string, sport, dport uint16) bpf.Event {
+		return bpf.Event{
+			ConnectionID: cid, Proto: 6,
+			SrcAddr: net.ParseIP(src), DstAddr: net.ParseIP(dst),
+			SrcPort: sport, DstPort: dport,
+		}
+	}
+
+	// Under flow-hash partitioning, the events of a flow, and of the
+	// conntrack entry of its reverse direction, go to the same worker.
+	pf, err := newPartitionFunc(PartitionFlowHash)
+	require.NoError(t, err)
+	ps := &pooledSink{queues: make([]chan bpf.Event, workers), partition: pf}
+
+	seen := make(map[int]bool)
+	for i := 0; i < 64; i++ {
+		sport := uint16(40000 + i)
+		w := ps.worker(flow(1, "10.0.0.1", "10.0.0.2", sport, 443))
+		for j := 0; j < 4; j++ {
+			assert.Equal(t, w, ps.worker(flow(1, "10.0.0.1", "10.0.0.2", sport, 443)))
+		}
+		assert.Equal(t, w, ps.worker(flow(2, "10.0.0.2", "10.0.0.1", 443, sport)))
+		seen[w] = true
+	}
+	assert.True(t, len(seen) > 1, "all flows assigned to one worker")
+
+	// Under src-addr partitioning, all flows of an address share a worker.
+	pf, err = newPartitionFunc(PartitionSrcAddr)
+	require.NoError(t, err)
+	ps.partition = pf
+
+	w := ps.worker(flow(1, "10.0.0.1", "10.0.0.2", 40000, 443))
+	assert.Equal(t, w, ps.worker(flow(2, "10.0.0.1", "10.0.0.3", 40001, 80)))
+
+	// Round-robin spreads the events of a flow over all workers.
+	pf, err = newPartitionFunc(PartitionRoundRobin)
+	require.NoError(t, err)
+	ps.partition = pf
+
+	seen = make(map[int]bool)
+	for i := 0; i < workers; i++ {
+		seen[ps.worker(flow(1, "10.0.0.1", "10.0.0.2", 40000, 443))] = true
+	}
+	assert.Len(t, seen, workers)
+
+	_, err = newPartitionFunc("random")
+	assert.EqualError(t, err, "push partitioning scheme 'random' not implemented")
+}
+
+func TestPooledSinkFlowOrder(t *testing.T) {
+
+	s, err := New(types.SinkConfig{
+		Name:            "ring",
+		Type:            types.MemRing,
+		PushConcurrency: 4,
+		PushPartition:   PartitionFlowHash,
+	})
+	require.NoError(t, err)
+
+	// Events of each flow are delivered in the order they were pushed.
+	for seq := uint32(1); seq <= 100; seq++ {
+		for port := uint16(1); port <= 8; port++ {
+			s.Push(bpf.Event{ConnectionID: uint32(port), Proto: 17, SrcPort: port, DstPort: 53, Seq: seq})
+		}
+	}
+	require.NoError(t, s.Close())
+
+	r, ok := AsRecorder(s)
+	require.True(t, ok)
+
+	last := make(map[uint32]uint32)
+	for _, e := range r.Recent() {
+		assert.Equal(t, last[e.ConnectionID]+1, e.Seq, "flow %d out of order", e.ConnectionID)
+		last[e.ConnectionID] = e.Seq
+	}
+	assert.Len(t, last, 8)
+
+	_, err = New(types.SinkConfig{Name: "bad", Type: types.Dummy, PushConcurrency: 2, PushPartition: "random"})
+	assert.Error(t, err)
+}
+
+func TestNewWrappers(t *testing.T) {
+
+	s, err := New(types.SinkConfig{
+		Name:            "ring",
+		Type:            types.MemRing,
+		Filter:          "udp",
+		PushConcurrency: 2,
+	})
+	require.NoError(t, err)
+
+	s.Push(bpf.Event{ConnectionID: 1, Proto: 6})
+	s.Push(bpf.Event{ConnectionID: 2, Proto: 17})
+	require.NoError(t, s.Close())
+
+	r, ok := AsRecorder(s)
+	require.True(t, ok)
+	require.IsType(t, &memring.MemRing{}, r)
+
+	ev := r.Recent()
+	require.Len(t, ev, 1)
+	assert.EqualValues(t, 2, ev[0].ConnectionID)
+
+	_, err = New(types.SinkConfig{Name: "bad", Type: types.Dummy, Filter: "tcp and"})
+	assert.Error(t, err)
+}
+
+// Measures throughput of a pooled sink with a Push method taking 10µs,
+// with increasing amounts of workers.
+func BenchmarkPooledSink(b *testing.B) {
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		b.Run(fmt.Sprintf("workers-%d", n), func(b *testing.B) {
+			ps := newPooledSink(slowSink{newDummy(b), 10 * time.Microsecond}, n, roundRobin(b), nil)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Blocking send, so the benchmark measures the rate
+				// at which the workers drain the queue.
+				ps.queues[i%n] <- bpf.Event{}
+			}
+			_ = ps.Close()
+		})
+	}
+}
+
+func TestAgedSink(t *testing.T) {
+
+	now := time.Unix(1510, 0)
+	as := newAgedSink(newDummy(t), time.Minute)
+	as.now = func() time.Time { return now }
+
+	as.Push(bpf.Event{Time: now.Add(-30 * time.Second)})
+	as.Push(bpf.Event{Time: now.Add(-time.Minute)})
+	// Backed up behind the sink for too long.
+	as.Push(bpf.Event{Time: now.Add(-2 * time.Minute)})
+	as.Push(bpf.Event{Time: now.Add(-time.Hour)})
+	// Events without a time are kept.
+	as.Push(bpf.Event{})
+
+	st := as.Stats()
+	assert.EqualValues(t, 3, st.EventsPushed)
+	assert.EqualValues(t, 2, st.EventsExpired)
+	assert.Zero(t, st.EventsDropped)
+}
+
+func TestNewMaxEventAge(t *testing.T) {
+
+	s, err := New(types.SinkConfig{Name: "ring", Type: types.MemRing, MaxEventAge: time.Minute, PushConcurrency: 2})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// Stale events are discarded after waiting in the pool's queue.
+	s.Push(bpf.Event{ConnectionID: 1, Time: time.Now()})
+	s.Push(bpf.Event{ConnectionID: 2, Time: time.Now().Add(-time.Hour)})
+
+	r, ok := AsRecorder(s)
+	require.True(t, ok)
+	assert.Eventually(t, func() bool { return s.Stats().EventsExpired == 1 && len(r.Recent()) == 1 },
+		time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, r.Recent()[0].ConnectionID)
+}
+
+func TestTaggedSink(t *testing.T) {
+
+	global := map[string]string{"hostname": "a", "source": "global"}
+	tags := map[string]string{"source": "edge"}
+
+	mr := memring.New()
+	require.NoError(t, mr.Init(types.SinkConfig{Name: "ring", Type: types.MemRing}))
+	s := newTaggedSink(&mr, global, tags)
+
+	// Events with the pipeline's labels, with other labels, and without.
+	s.Push(bpf.Event{ConnectionID: 1, Labels: global})
+	s.Push(bpf.Event{ConnectionID: 2, Labels: map[string]string{"region": "eu"}})
+	s.Push(bpf.Event{ConnectionID: 3})
+
+	ev := mr.Recent()
+	require.Len(t, ev, 3)
+	assert.Equal(t, map[string]string{"hostname": "a", "source": "edge"}, ev[0].Labels)
+	assert.Equal(t, map[string]string{"region": "eu", "source": "edge"}, ev[1].Labels)
+	assert.Equal(t, tags, ev[2].Labels)
+
+	// The pipeline's labels are shared by all sinks and left untouched.
+	assert.Equal(t, "global", global["source"])
+}
+
+func TestNewStaticTags(t *testing.T) {
+
+	global := map[string]string{"source": "global"}
+	cfg := types.SinkConfig{Name: "ring", Type: types.MemRing, Labels: global}
+
+	plain, err := New(cfg)
+	require.NoError(t, err)
+	defer plain.Close()
+
+	cfg.StaticTags = map[string]string{"source": "edge"}
+	tagged, err := New(cfg)
+	require.NoError(t, err)
+	defer tagged.Close()
+
+	// Only the sink configured with tags sees them.
+	e := bpf.Event{ConnectionID: 1, Labels: global}
+	plain.Push(e)
+	tagged.Push(e)
+
+	r, ok := AsRecorder(plain)
+	require.True(t, ok)
+	assert.Equal(t, "global", r.Recent()[0].Labels["source"])
+
+	r, ok = AsRecorder(tagged)
+	require.True(t, ok)
+	assert.Equal(t, "edge", r.Recent()[0].Labels["source"])
+}
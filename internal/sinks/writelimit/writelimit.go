@@ -0,0 +1,66 @@
+// Package writelimit implements a limit of the writes that network sinks
+// have in progress at once, shared by all sinks of a pipeline.
+package writelimit
+
+import "sync/atomic"
+
+// Limiter is a semaphore bounding the amount of writes to the sinks' backing
+// storage in progress at once, like InfluxDB requests or Redis pipelines.
+// Sharing a Limiter between sinks bounds the connections and requests opened
+// by all of them during a burst, sinks wait for a slot before writing.
+//
+// All methods are safe for concurrent use, and are no-ops on a nil Limiter,
+// so sinks without a Limiter write right away.
+type Limiter struct {
+	slots chan struct{}
+
+	// Amount of writes that waited for a slot.
+	waits uint64
+}
+
+// New returns a Limiter allowing at most n concurrent writes.
+func New(n int) *Limiter {
+	return &Limiter{slots: make(chan struct{}, n)}
+}
+
+// Acquire blocks until a write can start. Every call to Acquire
+// must be followed by a call to Release once the write is done.
+func (l *Limiter) Acquire() {
+
+	if l == nil {
+		return
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		return
+	default:
+	}
+
+	atomic.AddUint64(&l.waits, 1)
+	l.slots <- struct{}{}
+}
+
+// Release marks a write started with Acquire as done.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
+
+// Do calls f holding a slot, and returns its error.
+func (l *Limiter) Do(f func() error) error {
+	l.Acquire()
+	defer l.Release()
+	return f()
+}
+
+// Stats returns the limit of concurrent writes, the amount of writes in
+// progress and the amount of writes that had to wait for a slot.
+func (l *Limiter) Stats() (limit, inUse int, waits uint64) {
+	if l == nil {
+		return 0, 0, 0
+	}
+	return cap(l.slots), len(l.slots), atomic.LoadUint64(&l.waits)
+}
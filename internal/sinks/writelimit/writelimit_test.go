@@ -0,0 +1,98 @@
+package writelimit_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ti-mo/conntracct/internal/sinks/writelimit"
+)
+
+func TestLimiterCap(t *testing.T) {
+
+	const limit = 3
+
+	l := writelimit.New(limit)
+
+	// Writes of many sinks at once never exceed the limit.
+	var cur, max int64
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				_ = l.Do(func() error {
+					n := atomic.AddInt64(&cur, 1)
+					for {
+						m := atomic.LoadInt64(&max)
+						if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+							break
+						}
+					}
+					time.Sleep(100 * time.Microsecond)
+					atomic.AddInt64(&cur, -1)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, limit, max, "concurrent writes")
+
+	n, inUse, waits := l.Stats()
+	assert.Equal(t, limit, n)
+	assert.Zero(t, inUse)
+	assert.NotZero(t, waits)
+}
+
+func TestLimiterAcquire(t *testing.T) {
+
+	l := writelimit.New(1)
+	l.Acquire()
+
+	_, inUse, _ := l.Stats()
+	assert.Equal(t, 1, inUse)
+
+	// A second write waits for the first to be released.
+	done := make(chan struct{})
+	go func() {
+		l.Acquire()
+		l.Release()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write started beyond the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	l.Release()
+	<-done
+
+	_, inUse, waits := l.Stats()
+	assert.Zero(t, inUse)
+	assert.EqualValues(t, 1, waits)
+}
+
+func TestLimiterNil(t *testing.T) {
+
+	// Writes are not limited without a Limiter.
+	var l *writelimit.Limiter
+	err := errors.New("write failed")
+	assert.Equal(t, err, l.Do(func() error { return err }))
+
+	l.Acquire()
+	l.Release()
+
+	n, inUse, waits := l.Stats()
+	assert.Zero(t, n)
+	assert.Zero(t, inUse)
+	assert.Zero(t, waits)
+}
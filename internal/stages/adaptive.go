@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// AdaptiveSample is a Sample stage upgrading large flows to full fidelity.
+// Flows are sampled like by Sample, but the events of a flow that wasn't
+// selected are kept from the first event at which it carried at least the
+// stage's amount of bytes or packets, in both directions, onwards. A zero
+// threshold is not applied. The events of an upgraded flow before its upgrade
+// stay dropped, its later events carry its totals since the start of the flow,
+// so the counters of the flow reach the sinks exactly.
+//
+// Upgraded flows are tracked until their destroy event, and evicted when they
+// were idle for longer than the stage's TTL or when the stage holds its maximum
+// amount of flows. Counters only grow, so the next event of an evicted flow
+// upgrades it again.
+type AdaptiveSample struct {
+	sample *Sample
+
+	bytes   uint64
+	packets uint64
+
+	// Serializes upgrading flows, since events of the same flow can be
+	// processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	filtered uint64
+	upgrades uint64
+}
+
+// NewAdaptiveSample returns an AdaptiveSample stage keeping 1 in every rate
+// flows selected using the given seed, and all events of other flows after
+// they reached the given amount of bytes or packets. Upgraded flows are held
+// until they were idle for ttl, and for at most maxFlows flows. Zero means no
+// limit.
+func NewAdaptiveSample(rate uint32, seed uint64, bytes, packets uint64, ttl time.Duration, maxFlows int) *AdaptiveSample {
+	return &AdaptiveSample{
+		sample:  NewSample(rate, seed),
+		bytes:   bytes,
+		packets: packets,
+		table:   NewFlowStateTable(ttl, maxFlows, nil),
+	}
+}
+
+// Name returns the name of the stage.
+func (a *AdaptiveSample) Name() string {
+	return "adaptive_sample"
+}
+
+// Process drops the event if its flow is not sampled and was not upgraded.
+func (a *AdaptiveSample) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	if a.sample.Sampled(e) || a.upgraded(e) {
+		emit(e)
+		return
+	}
+
+	atomic.AddUint64(&a.filtered, 1)
+}
+
+// upgraded returns true if the event's flow was upgraded to full fidelity,
+// upgrading the flow if the event reaches the stage's thresholds.
+func (a *AdaptiveSample) upgraded(e bpf.Event) bool {
+
+	key := NewFlowKey(e)
+	now := eventTime(e)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, ok := a.table.Get(key, now)
+	if !ok && a.exceeds(e) {
+		ok = true
+		atomic.AddUint64(&a.upgrades, 1)
+	}
+
+	switch {
+	case ok && e.Type == bpf.EventDestroy:
+		a.table.Delete(key)
+	case ok:
+		a.table.Set(key, struct{}{}, now)
+	}
+
+	return ok
+}
+
+// exceeds returns true if the event's counters reach any of the stage's
+// non-zero thresholds.
+func (a *AdaptiveSample) exceeds(e bpf.Event) bool {
+
+	if a.bytes != 0 && e.BytesOrig+e.BytesRet >= a.bytes {
+		return true
+	}
+	if a.packets != 0 && e.PacketsOrig+e.PacketsRet >= a.packets {
+		return true
+	}
+
+	return false
+}
+
+// Flush evicts the upgraded flows that were idle for longer than the stage's
+// TTL. The stage never holds on to events.
+func (a *AdaptiveSample) Flush(now time.Time, _ func(bpf.Event)) {
+	a.table.Expire(now)
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (a *AdaptiveSample) Filtered() uint64 {
+	return atomic.LoadUint64(&a.filtered)
+}
+
+// Upgrades returns the amount of times a flow was upgraded to full fidelity,
+// including flows upgraded again after their eviction.
+func (a *AdaptiveSample) Upgrades() uint64 {
+	return atomic.LoadUint64(&a.upgrades)
+}
@@ -0,0 +1,131 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// unsampledFlow returns an event of a flow not sampled by s.
+func unsampledFlow(t *testing.T, s *stages.Sample) bpf.Event {
+	for _, e := range sampleFlows(100) {
+		if !s.Sampled(e) {
+			return e
+		}
+	}
+	t.Fatal("all flows sampled")
+	return bpf.Event{}
+}
+
+func TestAdaptiveSampleUpgrade(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	// Upgrade flows reaching 10kB or 100 packets.
+	a := stages.NewAdaptiveSample(4, 1, 10000, 100, 0, 0)
+	flow := unsampledFlow(t, stages.NewSample(4, 1))
+
+	// A flow sending 3kB in 3 packets every 10 seconds.
+	for i := 0; i < 6; i++ {
+		e := flow
+		e.Type = bpf.EventUpdate
+		switch i {
+		case 0:
+			e.Type = bpf.EventNew
+		case 5:
+			e.Type = bpf.EventDestroy
+		}
+		e.Time = start.Add(time.Duration(i) * 10 * time.Second)
+		e.BytesOrig = uint64(i+1) * 3000
+		e.PacketsOrig = uint64(i+1) * 3
+		a.Process(e, out.emit)
+	}
+
+	// The flow was upgraded at its fourth event, with 12kB.
+	require.Len(t, out, 3)
+	assert.EqualValues(t, 12000, out[0].BytesOrig)
+	assert.Equal(t, bpf.EventUpdate, out[1].Type)
+	assert.Equal(t, bpf.EventDestroy, out[2].Type)
+	assert.EqualValues(t, 18000, out[2].BytesOrig)
+	assert.EqualValues(t, 3, a.Filtered())
+	assert.EqualValues(t, 1, a.Upgrades())
+
+	// The packet threshold upgrades a flow of small packets.
+	out = nil
+	e := flow
+	e.ConnectionID = 2
+	e.PacketsOrig, e.PacketsRet = 60, 40
+	a.Process(e, out.emit)
+	assert.Len(t, out, 1)
+	assert.EqualValues(t, 2, a.Upgrades())
+}
+
+func TestAdaptiveSampleSampled(t *testing.T) {
+
+	var out collector
+	evs := sampleFlows(100)
+
+	// Sampled flows are kept below the thresholds.
+	s := stages.NewSample(4, 1)
+	a := stages.NewAdaptiveSample(4, 1, 10000, 0, 0, 0)
+	var want int
+	for _, e := range evs {
+		if s.Sampled(e) {
+			want++
+		}
+		a.Process(e, out.emit)
+	}
+
+	assert.Len(t, out, want)
+	assert.EqualValues(t, len(evs)-want, a.Filtered())
+	assert.Zero(t, a.Upgrades())
+}
+
+func TestAdaptiveSampleBounded(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	// At most 2 upgraded flows, idle for at most a minute.
+	a := stages.NewAdaptiveSample(4, 1, 1000, 0, time.Minute, 2)
+	flow := unsampledFlow(t, stages.NewSample(4, 1))
+
+	for id := uint32(1); id <= 3; id++ {
+		e := flow
+		e.ConnectionID = id
+		e.Time = start
+		e.BytesOrig = 1000
+		a.Process(e, out.emit)
+	}
+	assert.EqualValues(t, 3, a.Upgrades())
+
+	// The first flow was evicted, and is upgraded again by its next event.
+	e := flow
+	e.ConnectionID = 1
+	e.Time = start.Add(time.Second)
+	e.BytesOrig = 2000
+	a.Process(e, out.emit)
+	assert.EqualValues(t, 4, a.Upgrades())
+
+	// Idle flows are evicted.
+	a.Flush(start.Add(2*time.Minute), out.emit)
+	e.Time = start.Add(2 * time.Minute)
+	a.Process(e, out.emit)
+	assert.EqualValues(t, 5, a.Upgrades())
+
+	// Destroyed flows are forgotten.
+	e.Type = bpf.EventDestroy
+	a.Process(e, out.emit)
+	e.Type = bpf.EventUpdate
+	a.Process(e, out.emit)
+	assert.EqualValues(t, 6, a.Upgrades())
+
+	assert.Len(t, out, 7)
+	assert.Zero(t, a.Filtered())
+}
@@ -0,0 +1,243 @@
+package stages
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// checkpointKey identifies a destroyed flow. Since the kernel can reuse the
+// ConnectionID of a destroyed flow, the flow's start time is part of the key.
+type checkpointKey struct {
+	FlowKey
+	Start uint64
+}
+
+// checkpointFlow is a destroyed flow in a checkpoint file.
+type checkpointFlow struct {
+	ConnectionID uint32    `json:"connection_id"`
+	NetNS        uint32    `json:"netns"`
+	SrcAddr      net.IP    `json:"src_addr"`
+	DstAddr      net.IP    `json:"dst_addr"`
+	SrcPort      uint16    `json:"src_port"`
+	DstPort      uint16    `json:"dst_port"`
+	Proto        uint8     `json:"proto"`
+	Start        uint64    `json:"start"`
+	Time         time.Time `json:"time"`
+}
+
+// checkpointFile is the content of a checkpoint file.
+type checkpointFile struct {
+	// Time of the latest event processed by the stage.
+	Time      time.Time        `json:"time"`
+	Destroyed []checkpointFlow `json:"destroyed"`
+}
+
+// Checkpoint is a stage recording the pipeline's progress in a file, so it can
+// resume after a restart. The checkpoint holds the time of the latest event
+// the stage processed, and the destroy events it emitted during the stage's
+// retention period. When the stage is created from an existing checkpoint,
+// destroy events of flows it already emitted before the restart are dropped,
+// since they were already delivered to the sinks.
+//
+// Delivery remains at-least-once, not exactly-once. The checkpoint is written
+// at an interval and when the pipeline stops, destroy events emitted after
+// the last write, eg. before a crash, are not recorded and are delivered
+// again if they are seen again after the restart. Events are emitted before
+// they are acknowledged by the sinks, so the checkpoint can't tell whether a
+// sink stored them. Events can't be resumed either: conntrack doesn't keep
+// destroyed flows, so the destroy events of flows that ended while conntracct
+// was not running are lost. Since reports the start of this gap.
+//
+// Place the stage last, so it records the events that reach the sinks.
+type Checkpoint struct {
+	path     string
+	interval time.Duration
+	retain   time.Duration
+
+	// Time of the latest event before the restart.
+	since time.Time
+
+	mu     sync.Mutex
+	latest time.Time
+	table  *FlowStateTable
+	dirty  bool
+	saved  time.Time
+
+	filtered uint64
+}
+
+// NewCheckpoint returns a Checkpoint stage writing its checkpoint to path
+// every interval. The destroy events of at most maxFlows flows are held
+// for retain after the latest event. Zero means no limit. Resumes from the
+// checkpoint at path, if the file exists.
+func NewCheckpoint(path string, interval, retain time.Duration, maxFlows int) (*Checkpoint, error) {
+
+	c := &Checkpoint{
+		path:     path,
+		interval: interval,
+		retain:   retain,
+		table:    NewFlowStateTable(retain, maxFlows, nil),
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "reading checkpoint")
+	}
+
+	var cf checkpointFile
+	if err := json.Unmarshal(b, &cf); err != nil {
+		return nil, errors.Wrapf(err, "decoding checkpoint %s", path)
+	}
+
+	c.since, c.latest = cf.Time, cf.Time
+	for _, f := range cf.Destroyed {
+		k := checkpointKey{
+			FlowKey: FlowKey{
+				ConnectionID: f.ConnectionID,
+				NetNS:        f.NetNS,
+				SrcPort:      f.SrcPort,
+				DstPort:      f.DstPort,
+				Proto:        f.Proto,
+			},
+			Start: f.Start,
+		}
+		copy(k.SrcAddr[:], f.SrcAddr.To16())
+		copy(k.DstAddr[:], f.DstAddr.To16())
+
+		c.table.Set(k, f.Time, f.Time)
+	}
+
+	return c, nil
+}
+
+// Name returns the name of the stage.
+func (c *Checkpoint) Name() string {
+	return "checkpoint"
+}
+
+// Since returns the time of the latest event processed before the restart,
+// or the zero time if the stage did not resume from a checkpoint.
+func (c *Checkpoint) Since() time.Time {
+	return c.since
+}
+
+// Process records the event in the checkpoint, dropping destroy events
+// that were already emitted.
+func (c *Checkpoint) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	t := eventTime(e)
+
+	c.mu.Lock()
+
+	if t.After(c.latest) {
+		c.latest = t
+		c.dirty = true
+	}
+
+	if e.Type == bpf.EventDestroy {
+		k := checkpointKey{FlowKey: NewFlowKey(e), Start: e.Start}
+		if _, ok := c.table.Get(k, t); ok {
+			c.mu.Unlock()
+			atomic.AddUint64(&c.filtered, 1)
+			return
+		}
+		c.table.Set(k, t, t)
+		c.dirty = true
+	}
+
+	c.mu.Unlock()
+
+	emit(e)
+}
+
+// Flush writes the checkpoint if the stage's interval has passed
+// since the last write.
+func (c *Checkpoint) Flush(now time.Time, _ func(bpf.Event)) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.saved) < c.interval {
+		return
+	}
+	c.saved = now
+
+	// Errors are retried at the next interval.
+	_ = c.save()
+}
+
+// Close writes the checkpoint.
+func (c *Checkpoint) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.save()
+}
+
+// Filtered returns the amount of duplicate destroy events dropped by the stage.
+func (c *Checkpoint) Filtered() uint64 {
+	return atomic.LoadUint64(&c.filtered)
+}
+
+// save writes the checkpoint to the stage's file, if it changed since the
+// last write. Must be called with mu held.
+func (c *Checkpoint) save() error {
+
+	if !c.dirty {
+		return nil
+	}
+
+	// Expire flows by event time, since the clock may have
+	// advanced past the events of a paused pipeline.
+	c.table.Expire(c.latest)
+
+	cf := checkpointFile{Time: c.latest}
+	c.table.Range(func(k, v interface{}) bool {
+		key := k.(checkpointKey)
+		cf.Destroyed = append(cf.Destroyed, checkpointFlow{
+			ConnectionID: key.ConnectionID,
+			NetNS:        key.NetNS,
+			SrcAddr:      net.IP(key.SrcAddr[:]),
+			DstAddr:      net.IP(key.DstAddr[:]),
+			SrcPort:      key.SrcPort,
+			DstPort:      key.DstPort,
+			Proto:        key.Proto,
+			Start:        key.Start,
+			Time:         v.(time.Time),
+		})
+		return true
+	})
+
+	b, err := json.Marshal(cf)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a partially
+	// written checkpoint is never read after a crash.
+	tmp := filepath.Join(filepath.Dir(c.path), "."+filepath.Base(c.path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "writing checkpoint")
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "writing checkpoint")
+	}
+
+	c.dirty = false
+
+	return nil
+}
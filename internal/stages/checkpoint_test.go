@@ -0,0 +1,102 @@
+package stages_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestCheckpointRestart(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-checkpoint")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	start := time.Unix(300, 0)
+
+	c, err := stages.NewCheckpoint(path, 10*time.Second, time.Minute, 0)
+	require.NoError(t, err)
+	assert.True(t, c.Since().IsZero(), "no checkpoint to resume from")
+
+	var out collector
+	c.Process(flowEvent(1, bpf.EventUpdate, start, 100), out.emit)
+	c.Process(flowEvent(1, bpf.EventDestroy, start.Add(time.Second), 200), out.emit)
+	c.Process(flowEvent(2, bpf.EventDestroy, start.Add(2*time.Second), 300), out.emit)
+	require.Len(t, out, 3)
+
+	// The checkpoint is written at the stage's interval.
+	c.Flush(time.Now(), out.emit)
+	_, err = os.Stat(path)
+	require.NoError(t, err)
+
+	// Not recorded in the checkpoint before the crash.
+	c.Process(flowEvent(3, bpf.EventDestroy, start.Add(3*time.Second), 400), out.emit)
+	c.Flush(time.Now(), out.emit)
+
+	// Restart from the checkpoint.
+	c, err = stages.NewCheckpoint(path, 10*time.Second, time.Minute, 0)
+	require.NoError(t, err)
+	assert.True(t, start.Add(2*time.Second).Equal(c.Since()))
+
+	out = nil
+	c.Process(flowEvent(1, bpf.EventDestroy, start.Add(time.Second), 200), out.emit)
+	c.Process(flowEvent(2, bpf.EventDestroy, start.Add(2*time.Second), 300), out.emit)
+	assert.Empty(t, out, "destroy events emitted before the restart are dropped")
+	assert.EqualValues(t, 2, c.Filtered())
+
+	// At-least-once: events emitted after the last write are delivered again.
+	c.Process(flowEvent(3, bpf.EventDestroy, start.Add(3*time.Second), 400), out.emit)
+	c.Process(flowEvent(1, bpf.EventUpdate, start.Add(4*time.Second), 100), out.emit)
+	require.Len(t, out, 2)
+
+	// A reused ConnectionID with a different start time is a different flow.
+	e := flowEvent(1, bpf.EventDestroy, start.Add(5*time.Second), 500)
+	e.Start = 42
+	c.Process(e, out.emit)
+	require.Len(t, out, 3)
+
+	// Close writes the checkpoint, destroyed flows are retained
+	// across restarts until they expire.
+	require.NoError(t, c.Close())
+	c, err = stages.NewCheckpoint(path, 10*time.Second, time.Minute, 0)
+	require.NoError(t, err)
+	assert.True(t, start.Add(5*time.Second).Equal(c.Since()))
+
+	out = nil
+	c.Process(flowEvent(2, bpf.EventDestroy, start.Add(2*time.Second), 300), out.emit)
+	c.Process(e, out.emit)
+	assert.Empty(t, out)
+
+	// Expired after the retention period.
+	c.Process(flowEvent(4, bpf.EventUpdate, start.Add(5*time.Minute), 100), out.emit)
+	require.NoError(t, c.Close())
+	c, err = stages.NewCheckpoint(path, 10*time.Second, time.Minute, 0)
+	require.NoError(t, err)
+
+	out = nil
+	c.Process(e, out.emit)
+	assert.Len(t, out, 1)
+}
+
+func TestCheckpointInvalid(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "conntracct-checkpoint")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("{")
+	require.NoError(t, err)
+	f.Close()
+
+	_, err = stages.NewCheckpoint(f.Name(), time.Second, time.Minute, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,316 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// coalesceHalf is the latest event of one of a flow's conntrack entries.
+type coalesceHalf struct {
+	event     bpf.Event
+	seen      bool
+	destroyed bool
+}
+
+// coalesceState is the state of a logical flow in a Coalesce stage.
+type coalesceState struct {
+	// Endpoints of the logical flow, oriented like its first half.
+	src, dst endpoint
+
+	// The first half, defining the orientation of the logical flow,
+	// and the half tracking the opposite direction.
+	halves [2]coalesceHalf
+	last   int // half of the latest event
+
+	window  time.Time // start of the window holding a pending update, if any
+	isNew   bool      // the first event of the flow was a new event
+	emitted bool      // an event of the flow was emitted
+}
+
+// half returns the index of the half the event belongs to, or false if the
+// event's tuple doesn't match the flow, meaning its FlowHash collided.
+func (st *coalesceState) half(e bpf.Event) (int, bool) {
+
+	src, dst := newEndpoint(e.SrcAddr, e.SrcPort), newEndpoint(e.DstAddr, e.DstPort)
+
+	switch {
+	case src == st.src && dst == st.dst:
+		return 0, true
+	case src == st.dst && dst == st.src:
+		return 1, true
+	}
+
+	return 0, false
+}
+
+// done returns true if all of the flow's halves were destroyed.
+func (st *coalesceState) done() bool {
+	return st.halves[0].destroyed && (!st.halves[1].seen || st.halves[1].destroyed)
+}
+
+// merge returns the coalesced event of the flow with the given type. The
+// event is a copy of the flow's first half, with the counters of the opposite
+// half added to the counters of their matching direction.
+func (st *coalesceState) merge(typ bpf.EventType) bpf.Event {
+
+	a, b := st.halves[0].event, st.halves[1].event
+	e := a
+
+	e.Type = typ
+	if typ != bpf.EventDestroy && !st.emitted && st.isNew {
+		e.Type = bpf.EventNew
+	}
+
+	// Sequence numbers are per conntrack entry and
+	// meaningless across the halves of the flow.
+	e.Seq = 0
+
+	if !st.halves[1].seen {
+		return e
+	}
+
+	// The opposite half's original direction is the flow's reply direction.
+	e.PacketsOrig += b.PacketsRet
+	e.BytesOrig += b.BytesRet
+	e.PacketsRet += b.PacketsOrig
+	e.BytesRet += b.BytesOrig
+	e.BytesOrigAdjusted += b.BytesRetAdjusted
+	e.BytesRetAdjusted += b.BytesOrigAdjusted
+
+	e.SynCount += b.SynCount
+	e.FinCount += b.FinCount
+	e.RstCount += b.RstCount
+
+	e.SeenReply = true
+	e.Assured = a.Assured || b.Assured
+	e.Unaccounted = a.Unaccounted && b.Unaccounted
+
+	if b.Start != 0 && (e.Start == 0 || b.Start < e.Start) {
+		e.Start = b.Start
+	}
+	if b.Duration > e.Duration {
+		e.Duration = b.Duration
+	}
+
+	// Time the coalesced event by the latest event of either half.
+	if st.last == 1 {
+		e.Timestamp, e.Time, e.CPU = b.Timestamp, b.Time, b.CPU
+		switch b.TriggerDir {
+		case bpf.DirOriginal:
+			e.TriggerDir = bpf.DirReply
+		case bpf.DirReply:
+			e.TriggerDir = bpf.DirOriginal
+		default:
+			e.TriggerDir = 0
+		}
+	}
+
+	return e
+}
+
+// Coalesce is a stage merging the two halves of a flow that conntrack tracks
+// as separate entries, one per direction, into a single logical flow. This
+// happens for flows of which conntrack misses the packets that would tie the
+// directions together, like UDP flows with asymmetric routing, or connections
+// tracked in different conntrack zones. Each half only sees traffic in its
+// original direction, so its reply counters stay zero.
+//
+// The halves are matched by the FlowHash of their tuples. The logical flow is
+// oriented like the first half the stage sees: its ConnectionID, addresses and
+// ports, and its orig counters, are those of the first half. The orig counters
+// of the opposite half count traffic in the flow's reply direction and are
+// added to the flow's ret counters, and vice versa, so the orig and ret
+// counters of the coalesced event keep their meaning, and are the totals of
+// both halves since their start. The adjusted byte counters and TCP flag
+// counts are combined the same way. Sequence numbers are cleared.
+//
+// Like in a Rollup, update events are held until the end of their window,
+// aligned to multiples of the window length since the Unix epoch, and a
+// single coalesced event is emitted per window. The latest totals of both
+// halves are kept between windows, until the flow is destroyed or was idle
+// for longer than the stage's TTL. A destroy event is emitted once all seen
+// halves were destroyed.
+//
+// Flows tracked in a single conntrack entry don't need coalescing: their
+// events are passed on immediately once the entry has seen reply traffic,
+// and when no opposite half was seen by then. Events of protocols the stage
+// is not configured for are always passed on.
+//
+// Place the stage before Rollup and Delta, so these see the logical flow.
+type Coalesce struct {
+	window time.Duration
+	protos map[uint8]bool
+
+	// Serializes updates to a flow's state, since the halves of a flow can
+	// be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	// Events of flows evicted from the table, emitted
+	// on the next call to Process or Flush.
+	evictMu sync.Mutex
+	evicted []bpf.Event
+}
+
+// NewCoalesce returns a Coalesce stage merging the halves of flows of the
+// given protocols, or of all protocols if none are given, into windows of the
+// given length. The state of flows is held until they were idle for ttl, and
+// for at most maxFlows flows. Zero means no limit. The coalesced events of
+// evicted flows are emitted early.
+func NewCoalesce(window, ttl time.Duration, maxFlows int, protos []uint8) *Coalesce {
+
+	c := &Coalesce{window: window}
+
+	if len(protos) != 0 {
+		c.protos = make(map[uint8]bool, len(protos))
+		for _, p := range protos {
+			c.protos[p] = true
+		}
+	}
+
+	c.table = NewFlowStateTable(ttl, maxFlows, func(_, v interface{}, _ EvictReason) {
+		st := v.(*coalesceState)
+
+		var e bpf.Event
+		switch {
+		case st.halves[0].destroyed || st.halves[1].destroyed:
+			e = st.merge(bpf.EventDestroy)
+		case !st.window.IsZero():
+			e = st.merge(bpf.EventUpdate)
+		default:
+			return
+		}
+
+		c.evictMu.Lock()
+		c.evicted = append(c.evicted, e)
+		c.evictMu.Unlock()
+	})
+
+	return c
+}
+
+// Name returns the name of the stage.
+func (c *Coalesce) Name() string {
+	return "coalesce"
+}
+
+// Process adds the event to the state of its logical flow. Updates are held
+// until the end of their window, the flow's destroy event is emitted when its
+// last half is destroyed.
+func (c *Coalesce) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	defer c.emitEvicted(emit)
+
+	if c.protos != nil && !c.protos[e.Proto] {
+		emit(e)
+		return
+	}
+
+	h := NewFlowHash(e)
+	t := eventTime(e)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.table.Get(h, t)
+	if !ok {
+		if e.SeenReply {
+			// The entry tracks both directions of the flow.
+			emit(e)
+			return
+		}
+
+		if e.Type == bpf.EventDestroy {
+			emit(e)
+			return
+		}
+
+		v = &coalesceState{
+			src:   newEndpoint(e.SrcAddr, e.SrcPort),
+			dst:   newEndpoint(e.DstAddr, e.DstPort),
+			isNew: e.Type == bpf.EventNew,
+		}
+	}
+	st := v.(*coalesceState)
+
+	i, ok := st.half(e)
+	if !ok {
+		// Different flow with a colliding hash.
+		emit(e)
+		return
+	}
+
+	if i == 0 && e.SeenReply && !st.halves[1].seen {
+		// The flow's first half saw reply traffic before an opposite
+		// half appeared, so it tracks both directions itself.
+		c.table.Delete(h)
+		if e.Type != bpf.EventDestroy && !st.emitted && st.isNew {
+			e.Type = bpf.EventNew
+		}
+		emit(e)
+		return
+	}
+
+	win := t.Truncate(c.window)
+
+	// The window of the flow's pending update has ended.
+	if !st.window.IsZero() && !st.window.Equal(win) {
+		emit(st.merge(bpf.EventUpdate))
+		st.emitted = true
+		st.window = time.Time{}
+	}
+
+	st.halves[i].event = e
+	st.halves[i].seen = true
+	st.halves[i].destroyed = e.Type == bpf.EventDestroy
+	st.last = i
+
+	if st.done() {
+		c.table.Delete(h)
+		emit(st.merge(bpf.EventDestroy))
+		return
+	}
+
+	if e.Type != bpf.EventDestroy {
+		st.window = win
+	}
+
+	c.table.Set(h, st, t)
+}
+
+// Flush emits the pending updates of all windows that ended before now,
+// and the events of flows that were idle for longer than the stage's TTL.
+func (c *Coalesce) Flush(now time.Time, emit func(bpf.Event)) {
+
+	defer c.emitEvicted(emit)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.table.Range(func(_, v interface{}) bool {
+		st := v.(*coalesceState)
+		if !st.window.IsZero() && !st.window.Add(c.window).After(now) {
+			emit(st.merge(bpf.EventUpdate))
+			st.emitted = true
+			st.window = time.Time{}
+		}
+		return true
+	})
+
+	c.table.Expire(now)
+}
+
+// emitEvicted emits the coalesced events of evicted flows.
+func (c *Coalesce) emitEvicted(emit func(bpf.Event)) {
+
+	c.evictMu.Lock()
+	ev := c.evicted
+	c.evicted = nil
+	c.evictMu.Unlock()
+
+	for _, e := range ev {
+		emit(e)
+	}
+}
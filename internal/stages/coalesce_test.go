@@ -0,0 +1,166 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// halfFlow returns an event of a UDP conntrack entry of which only the
+// original direction is seen, from the client if reverse is false,
+// or from the server otherwise.
+func halfFlow(id uint32, reverse bool, typ bpf.EventType, t time.Time, packets, bytes uint64) bpf.Event {
+	e := bpf.Event{
+		ConnectionID: id,
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		SrcPort:      40000,
+		DstPort:      53,
+		Proto:        17,
+		Type:         typ,
+		Time:         t,
+		Seq:          3,
+		PacketsOrig:  packets,
+		BytesOrig:    bytes,
+		TriggerDir:   bpf.DirOriginal,
+	}
+
+	if reverse {
+		e.SrcAddr, e.DstAddr = e.DstAddr, e.SrcAddr
+		e.SrcPort, e.DstPort = e.DstPort, e.SrcPort
+	}
+
+	return e
+}
+
+func TestFlowHash(t *testing.T) {
+
+	a := halfFlow(1, false, bpf.EventUpdate, time.Time{}, 0, 0)
+	b := halfFlow(2, true, bpf.EventUpdate, time.Time{}, 0, 0)
+	assert.Equal(t, stages.NewFlowHash(a), stages.NewFlowHash(b), "opposite halves share a hash")
+
+	c := a
+	c.SrcPort++
+	assert.NotEqual(t, stages.NewFlowHash(a), stages.NewFlowHash(c))
+
+	c = a
+	c.NetNS = 1
+	assert.NotEqual(t, stages.NewFlowHash(a), stages.NewFlowHash(c))
+}
+
+func TestCoalesceHalves(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	c := stages.NewCoalesce(30*time.Second, time.Minute, 0, []uint8{17})
+
+	c.Process(halfFlow(1, false, bpf.EventNew, start, 1, 60), out.emit)
+	c.Process(halfFlow(2, true, bpf.EventNew, start.Add(time.Second), 1, 120), out.emit)
+	c.Process(halfFlow(1, false, bpf.EventUpdate, start.Add(2*time.Second), 3, 180), out.emit)
+	c.Process(halfFlow(2, true, bpf.EventUpdate, start.Add(3*time.Second), 2, 240), out.emit)
+	assert.Empty(t, out, "no events emitted within the window")
+
+	// One event per window, combining the counters of both halves.
+	c.Flush(start.Add(30*time.Second), out.emit)
+	require.Len(t, out, 1)
+
+	e := out[0]
+	assert.Equal(t, bpf.EventNew, e.Type)
+	assert.EqualValues(t, 1, e.ConnectionID, "oriented like the first half")
+	assert.Equal(t, net.IPv4(10, 0, 0, 1), e.SrcAddr)
+	assert.EqualValues(t, 53, e.DstPort)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 3, BytesOrig: 180, PacketsRet: 2, BytesRet: 240}, e.Counters())
+	assert.True(t, e.SeenReply)
+	assert.Zero(t, e.Seq)
+	assert.Equal(t, start.Add(3*time.Second), e.Time, "timed by the latest half")
+	assert.Equal(t, bpf.DirReply, e.TriggerDir)
+
+	// Totals of the idle half are kept between windows.
+	out = nil
+	c.Process(halfFlow(1, false, bpf.EventUpdate, start.Add(40*time.Second), 4, 240), out.emit)
+	c.Flush(start.Add(60*time.Second), out.emit)
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventUpdate, out[0].Type)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 4, BytesOrig: 240, PacketsRet: 2, BytesRet: 240}, out[0].Counters())
+
+	// The flow is destroyed along with its last half.
+	out = nil
+	c.Process(halfFlow(2, true, bpf.EventDestroy, start.Add(61*time.Second), 3, 360), out.emit)
+	assert.Empty(t, out)
+
+	c.Process(halfFlow(1, false, bpf.EventDestroy, start.Add(62*time.Second), 5, 300), out.emit)
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventDestroy, out[0].Type)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 5, BytesOrig: 300, PacketsRet: 3, BytesRet: 360}, out[0].Counters())
+
+	// No state is left behind.
+	out = nil
+	c.Flush(start.Add(10*time.Minute), out.emit)
+	assert.Empty(t, out)
+}
+
+func TestCoalescePassThrough(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	c := stages.NewCoalesce(30*time.Second, time.Minute, 0, []uint8{17})
+
+	// Protocols the stage isn't configured for.
+	tcp := halfFlow(1, false, bpf.EventNew, start, 1, 60)
+	tcp.Proto = 6
+	c.Process(tcp, out.emit)
+	require.Len(t, out, 1)
+
+	// Entries tracking both directions themselves. The held new
+	// event is merged into the first update with reply traffic.
+	out = nil
+	c.Process(halfFlow(2, false, bpf.EventNew, start, 1, 60), out.emit)
+	assert.Empty(t, out)
+
+	full := halfFlow(2, false, bpf.EventUpdate, start.Add(time.Second), 2, 120)
+	full.SeenReply, full.PacketsRet, full.BytesRet = true, 1, 100
+	c.Process(full, out.emit)
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventNew, out[0].Type)
+	assert.EqualValues(t, 3, out[0].Seq)
+
+	full.Type = bpf.EventDestroy
+	c.Process(full, out.emit)
+	require.Len(t, out, 2)
+	assert.Equal(t, bpf.EventDestroy, out[1].Type)
+
+	// A one-way flow without an opposite half is emitted on its own.
+	out = nil
+	c.Process(halfFlow(3, true, bpf.EventUpdate, start.Add(2*time.Second), 1, 60), out.emit)
+	c.Process(halfFlow(3, true, bpf.EventDestroy, start.Add(3*time.Second), 2, 120), out.emit)
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventDestroy, out[0].Type)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 2, BytesOrig: 120}, out[0].Counters())
+}
+
+func TestCoalesceEvict(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	c := stages.NewCoalesce(30*time.Second, time.Minute, 0, nil)
+
+	c.Process(halfFlow(1, false, bpf.EventUpdate, start, 1, 60), out.emit)
+	c.Process(halfFlow(2, true, bpf.EventDestroy, start, 1, 120), out.emit)
+
+	// The pending update is emitted at the end of its window, the flow is
+	// emitted as destroyed when its remaining half goes idle.
+	c.Flush(start.Add(2*time.Minute), out.emit)
+	require.Len(t, out, 2)
+	assert.Equal(t, bpf.EventUpdate, out[0].Type)
+	assert.Equal(t, bpf.EventDestroy, out[1].Type)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 1, BytesOrig: 60, PacketsRet: 1, BytesRet: 120}, out[1].Counters())
+}
@@ -0,0 +1,128 @@
+package stages
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Delta is a stage adding the counters accrued since a flow's previous event
+// to every event, as the event's Delta. The event's own counters remain the
+// flow's totals, so sinks can send both in the same record. The first event
+// of a flow seen by the stage carries its totals as the delta, since all of
+// the flow's traffic was accrued before it. The same goes for flows of which
+// the counters were reset, eg. when the flow's ConnectionID was reused by a
+// new flow before the old flow's destroy event was seen. Counters wrapping
+// past 2^64 are not mistaken for a reset, see delta.
+//
+// Events can arrive out of order, so a flow's destroy event can be processed
+// before its last update. A destroy event of a flow without state carries its
+// totals as the delta, like any first event, and the destroyed flow is
+// remembered for the stage's late window. Events of the flow that happened
+// before its destroy event and arrive within the window get a zero delta,
+// since their traffic is included in the destroy event's delta, instead of
+// reporting their totals a second time. Late events arriving after the window
+// are taken for a new flow.
+//
+// Place the stage after stages coalescing or dropping events, like Rollup,
+// so deltas cover the interval between the events that reach the sinks.
+type Delta struct {
+	// Serializes reading and storing a flow's counters, since events of the
+	// same flow can be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	destroyed *destroyedFlows
+}
+
+// NewDelta returns a Delta stage. The counters of at most maxFlows flows are
+// held, the next delta of the least recently updated flows equals their
+// totals when the limit is reached. Zero means no limit. Destroyed flows are
+// remembered for late, a zero late window doesn't recognize late events.
+func NewDelta(late time.Duration, maxFlows int) *Delta {
+	// Flows are removed on their destroy event. Idle flows can't be expired,
+	// their next event would otherwise report their totals as the delta.
+	return &Delta{
+		table:     NewFlowStateTable(0, maxFlows, nil),
+		destroyed: newDestroyedFlows(late, maxFlows),
+	}
+}
+
+// Name returns the name of the stage.
+func (d *Delta) Name() string {
+	return "delta"
+}
+
+// Process sets the delta counters of the event.
+func (d *Delta) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	key := NewFlowKey(e)
+	cur := e.Counters()
+
+	d.mu.Lock()
+
+	// The traffic of late events was accounted for by the destroy event.
+	if d.destroyed.late(e) {
+		d.mu.Unlock()
+
+		e.Delta = &bpf.Counters{}
+		emit(e)
+		return
+	}
+
+	var prev bpf.Counters
+	if v, ok := d.table.Get(key, eventTime(e)); ok {
+		prev = v.(bpf.Counters)
+	}
+
+	if e.Type == bpf.EventDestroy {
+		d.table.Delete(key)
+		d.destroyed.add(e)
+	} else {
+		d.table.Set(key, cur, eventTime(e))
+	}
+
+	d.mu.Unlock()
+
+	e.Delta = delta(cur, prev)
+	emit(e)
+}
+
+// Flush forgets destroyed flows that were destroyed longer than the stage's
+// late window ago. The stage never holds on to events.
+func (d *Delta) Flush(now time.Time, _ func(bpf.Event)) {
+	d.destroyed.expire(now)
+}
+
+// delta returns the counters accrued between prev and cur, or cur if any of
+// its counters was reset.
+//
+// Conntrack's counters are 64-bit atomics, incremented by every accounted
+// packet and only ever reset to zero: when a dump zeroes them (eg. 'conntrack
+// -L -z') or when the ConnectionID is reused by a new flow. A counter lower
+// than in prev is either such a reset, or a wrap past 2^64. A wrap can't be
+// told apart from a reset by the counter alone, so as with sequence number
+// arithmetic (RFC 1982), a counter that advanced by less than 2^63 modulo
+// 2^64 wrapped, and any other decrease is a reset. The counter of a flow would
+// need to advance by more than 2^63 between two events for this to misfire.
+// The traffic accrued between prev and a reset is lost.
+func delta(cur, prev bpf.Counters) *bpf.Counters {
+
+	d := bpf.Counters{
+		PacketsOrig: cur.PacketsOrig - prev.PacketsOrig,
+		BytesOrig:   cur.BytesOrig - prev.BytesOrig,
+		PacketsRet:  cur.PacketsRet - prev.PacketsRet,
+		BytesRet:    cur.BytesRet - prev.BytesRet,
+	}
+
+	// The unsigned differences are the modular distances the counters
+	// advanced by, which exceed 2^63 when the counters were reset.
+	if d.PacketsOrig > math.MaxInt64 || d.BytesOrig > math.MaxInt64 ||
+		d.PacketsRet > math.MaxInt64 || d.BytesRet > math.MaxInt64 {
+		return &cur
+	}
+
+	return &d
+}
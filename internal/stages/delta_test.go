@@ -0,0 +1,149 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestDelta(t *testing.T) {
+
+	d := stages.NewDelta(0, 0)
+
+	flow := func(typ bpf.EventType, pkts, bytes uint64) bpf.Event {
+		return bpf.Event{
+			ConnectionID: 1, Type: typ, Proto: 17,
+			PacketsOrig: pkts, BytesOrig: bytes,
+			PacketsRet: pkts / 2, BytesRet: bytes / 2,
+		}
+	}
+
+	var out collector
+	d.Process(flow(bpf.EventNew, 2, 62), out.emit)
+	d.Process(flow(bpf.EventUpdate, 8, 248), out.emit)
+	d.Process(flow(bpf.EventUpdate, 8, 248), out.emit)
+	d.Process(flow(bpf.EventDestroy, 10, 310), out.emit)
+	require.Len(t, out, 4)
+
+	// The first event's delta equals its totals.
+	assert.Equal(t, out[0].Counters(), *out[0].Delta)
+
+	assert.Equal(t, bpf.Counters{PacketsOrig: 6, BytesOrig: 186, PacketsRet: 3, BytesRet: 93}, *out[1].Delta)
+	assert.Equal(t, bpf.Counters{}, *out[2].Delta, "no traffic between events")
+
+	// Totals are left untouched, the deltas add up to the final totals.
+	var sum bpf.Counters
+	for _, e := range out {
+		sum.PacketsOrig += e.Delta.PacketsOrig
+		sum.BytesOrig += e.Delta.BytesOrig
+		sum.PacketsRet += e.Delta.PacketsRet
+		sum.BytesRet += e.Delta.BytesRet
+	}
+	assert.Equal(t, out[3].Counters(), sum)
+	assert.EqualValues(t, 310, out[3].BytesOrig)
+
+	// The destroy event removed the flow's state, a reused
+	// ConnectionID starts from the new flow's totals.
+	out = nil
+	d.Process(flow(bpf.EventNew, 1, 31), out.emit)
+	assert.Equal(t, out[0].Counters(), *out[0].Delta)
+
+	// Decreasing counters mean a new flow without destroy event.
+	d.Process(flow(bpf.EventUpdate, 4, 124), out.emit)
+	d.Process(flow(bpf.EventUpdate, 2, 62), out.emit)
+	assert.Equal(t, out[2].Counters(), *out[2].Delta)
+}
+
+func TestDeltaWrap(t *testing.T) {
+
+	const max = ^uint64(0)
+
+	d := stages.NewDelta(0, 0)
+
+	var out collector
+	d.Process(bpf.Event{ConnectionID: 1, PacketsOrig: max - 2, BytesOrig: max - 100, PacketsRet: 7}, out.emit)
+
+	// Counters wrapping past 2^64 advance by their modular distance.
+	d.Process(bpf.Event{ConnectionID: 1, PacketsOrig: 1, BytesOrig: 99, PacketsRet: 8}, out.emit)
+	require.Len(t, out, 2)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 4, BytesOrig: 200, PacketsRet: 1}, *out[1].Delta)
+
+	// Up to the boundary exactly.
+	d.Process(bpf.Event{ConnectionID: 2, BytesOrig: max - 1}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 2, BytesOrig: max}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 2, BytesOrig: 0}, out.emit)
+	assert.EqualValues(t, 1, out[3].Delta.BytesOrig)
+	assert.EqualValues(t, 1, out[4].Delta.BytesOrig, "wrapped to zero")
+
+	// Counters reset to zero, eg. by 'conntrack -L -z', restart from
+	// their new totals, even if only one of them decreased.
+	d.Process(bpf.Event{ConnectionID: 3, PacketsOrig: 1000, BytesOrig: 1 << 40}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 3, PacketsOrig: 1001, BytesOrig: 64}, out.emit)
+	assert.Equal(t, bpf.Counters{PacketsOrig: 1001, BytesOrig: 64}, *out[6].Delta)
+
+	// Counters advancing by less than 2^63 modulo 2^64 wrapped,
+	// decreasing by less than 2^63 is a reset.
+	d.Process(bpf.Event{ConnectionID: 4, BytesOrig: 1<<63 + 10}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 4, BytesOrig: 9}, out.emit)
+	assert.EqualValues(t, 1<<63-1, out[8].Delta.BytesOrig)
+
+	d.Process(bpf.Event{ConnectionID: 5, BytesOrig: 1<<63 + 6}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 5, BytesOrig: 7}, out.emit)
+	assert.EqualValues(t, 7, out[10].Delta.BytesOrig)
+}
+
+func TestDeltaMaxFlows(t *testing.T) {
+
+	d := stages.NewDelta(0, 1)
+
+	var out collector
+	d.Process(bpf.Event{ConnectionID: 1, PacketsOrig: 1}, out.emit)
+	d.Process(bpf.Event{ConnectionID: 2, PacketsOrig: 1}, out.emit)
+
+	// Flow 1 was evicted, its delta equals its totals.
+	d.Process(bpf.Event{ConnectionID: 1, PacketsOrig: 3}, out.emit)
+	assert.EqualValues(t, 3, out[2].Delta.PacketsOrig)
+
+	d.Process(bpf.Event{ConnectionID: 1, PacketsOrig: 4}, out.emit)
+	assert.EqualValues(t, 1, out[3].Delta.PacketsOrig)
+}
+
+func TestDeltaLate(t *testing.T) {
+
+	start := time.Unix(300, 0)
+	d := stages.NewDelta(time.Minute, 0)
+
+	var out collector
+	d.Process(flowEvent(1, bpf.EventNew, start, 100), out.emit)
+
+	// The flow's destroy event overtakes its last update.
+	d.Process(flowEvent(1, bpf.EventDestroy, start.Add(20*time.Second), 500), out.emit)
+	d.Process(flowEvent(1, bpf.EventUpdate, start.Add(10*time.Second), 300), out.emit)
+
+	// A destroy of a flow without state, and its late update.
+	d.Process(flowEvent(2, bpf.EventDestroy, start.Add(20*time.Second), 700), out.emit)
+	d.Process(flowEvent(2, bpf.EventUpdate, start.Add(10*time.Second), 400), out.emit)
+
+	require.Len(t, out, 5)
+	assert.EqualValues(t, 400, out[1].Delta.BytesOrig)
+	assert.Equal(t, bpf.Counters{}, *out[2].Delta, "included in the destroy's delta")
+	assert.EqualValues(t, 300, out[2].BytesOrig, "totals are left untouched")
+
+	// The destroy's totals are taken as the flow's baseline.
+	assert.EqualValues(t, 700, out[3].Delta.BytesOrig)
+	assert.Equal(t, bpf.Counters{}, *out[4].Delta)
+
+	// A flow reusing the ConnectionID after the destroy is a new flow.
+	d.Process(flowEvent(1, bpf.EventNew, start.Add(30*time.Second), 50), out.emit)
+	assert.EqualValues(t, 50, out[5].Delta.BytesOrig)
+
+	// Destroyed flows are forgotten after the window.
+	d.Flush(start.Add(2*time.Minute), out.emit)
+	d.Process(flowEvent(2, bpf.EventUpdate, start.Add(15*time.Second), 450), out.emit)
+	assert.EqualValues(t, 450, out[6].Delta.BytesOrig)
+}
@@ -0,0 +1,92 @@
+package stages
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+	"github.com/ti-mo/conntracct/pkg/expr"
+)
+
+// derivedLabel is a label computed from an expression.
+type derivedLabel struct {
+	name string
+	expr *expr.Expr
+}
+
+// Derive is a stage adding labels computed from expressions over the fields
+// of events, eg. 'traffic_class = bytes > 1000000 ? "elephant" : "mouse"'.
+// See package pkg/expr for the expression language. Labels are added next to
+// the pipeline's labels, overriding labels of the same name.
+//
+// The labels of an event are shared with other events, so every event is
+// given a copy of its labels with the derived labels added.
+type Derive struct {
+	labels []derivedLabel
+}
+
+// NewDerive returns a Derive stage adding a label for each of the given
+// definitions of the form 'name = expression'. Expressions can't refer to
+// labels. Returns an error if a definition has an invalid name or expression.
+func NewDerive(defs []string) (*Derive, error) {
+
+	d := &Derive{}
+
+	for _, def := range defs {
+		i := strings.IndexByte(def, '=')
+		if i < 0 || strings.HasPrefix(def[i:], "==") {
+			return nil, fmt.Errorf("derived label '%s': expected 'name = expression'", def)
+		}
+
+		name := strings.TrimSpace(def[:i])
+		if !validLabelName(name) {
+			return nil, fmt.Errorf("derived label '%s': invalid name '%s'", def, name)
+		}
+
+		x, err := expr.Compile(def[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("derived label '%s': %s", name, err)
+		}
+
+		d.labels = append(d.labels, derivedLabel{name: name, expr: x})
+	}
+
+	return d, nil
+}
+
+// validLabelName returns true if name is made up of letters,
+// digits and underscores, and doesn't start with a digit.
+func validLabelName(name string) bool {
+
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+
+	for _, c := range name {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Name returns the name of the stage.
+func (d *Derive) Name() string {
+	return "derive"
+}
+
+// Process adds the derived labels to the event.
+func (d *Derive) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	labels := make(map[string]string, len(e.Labels)+len(d.labels))
+	for k, v := range e.Labels {
+		labels[k] = v
+	}
+	for _, l := range d.labels {
+		labels[l.name] = l.expr.Eval(&e)
+	}
+	e.Labels = labels
+
+	emit(e)
+}
@@ -0,0 +1,63 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestDerive(t *testing.T) {
+
+	d, err := stages.NewDerive([]string{
+		`traffic_class = bytes_orig > 1000000 ? "elephant" : "mouse"`,
+		`avg_packet=bytes_orig / packets_orig`,
+		`host = "b"`,
+	})
+	require.NoError(t, err)
+
+	global := map[string]string{"host": "a", "region": "eu"}
+
+	var out collector
+	for _, b := range []uint64{100, 2000000} {
+		e := flowEvent(1, bpf.EventUpdate, time.Unix(300, 0), b)
+		e.PacketsOrig = 100
+		e.Labels = global
+		d.Process(e, out.emit)
+	}
+
+	require.Len(t, out, 2)
+	assert.Equal(t, map[string]string{
+		"traffic_class": "mouse", "avg_packet": "1", "host": "b", "region": "eu",
+	}, out[0].Labels)
+	assert.Equal(t, "elephant", out[1].Labels["traffic_class"])
+	assert.Equal(t, "20000", out[1].Labels["avg_packet"])
+
+	// The shared labels are not modified.
+	assert.Equal(t, map[string]string{"host": "a", "region": "eu"}, global)
+}
+
+func TestDeriveErrors(t *testing.T) {
+
+	tests := []struct {
+		def string
+		err string
+	}{
+		{"traffic_class", "derived label 'traffic_class': expected 'name = expression'"},
+		{"proto == 6", "derived label 'proto == 6': expected 'name = expression'"},
+		{" = 1", "derived label ' = 1': invalid name ''"},
+		{"1st = 1", "derived label '1st = 1': invalid name '1st'"},
+		{"traffic-class = 1", "derived label 'traffic-class = 1': invalid name 'traffic-class'"},
+		{"c = bytes >", "derived label 'c': expression syntax error at position 8: unexpected end of expression"},
+		{"c = nope", "derived label 'c': expression syntax error at position 1: unknown field 'nope'"},
+	}
+
+	for _, tt := range tests {
+		_, err := stages.NewDerive([]string{tt.def})
+		assert.EqualError(t, err, tt.err, tt.def)
+	}
+}
@@ -0,0 +1,193 @@
+package stages
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// dedupDestroy is a destroy event held by a DestroyDedup stage.
+type dedupDestroy struct {
+	event bpf.Event
+
+	// Time the flow's first destroy event was seen.
+	first time.Time
+}
+
+// sameFlow returns true if the event has the tuple of the held destroy event,
+// in the same orientation. The opposite halves of a flow tracked as separate
+// conntrack entries, and flows of which the FlowHash collided, are different.
+func (d *dedupDestroy) sameFlow(e bpf.Event) bool {
+	h := d.event
+	return h.Proto == e.Proto && h.NetNS == e.NetNS &&
+		newEndpoint(h.SrcAddr, h.SrcPort) == newEndpoint(e.SrcAddr, e.SrcPort) &&
+		newEndpoint(h.DstAddr, h.DstPort) == newEndpoint(e.DstAddr, e.DstPort)
+}
+
+// DestroyDedup is a stage emitting a single destroy event per flow, eg. when
+// a flow is destroyed twice because it was tracked again after its conntrack
+// entry was removed, or when events of a flow arrive out of order. Destroy
+// events are held for the stage's window after the first destroy event of
+// their flow, and all destroy events of the flow within the window are
+// replaced by the one with the highest totals: the most bytes in both
+// directions, then the most packets. Other events are passed on immediately.
+//
+// Flows are matched by their FlowHash and the tuples of their events, in the
+// same orientation, regardless of their ConnectionID, since a flow tracked
+// again gets a new conntrack entry. A duplicate arriving after the window is
+// emitted again, so the window should cover the time between duplicates, while
+// delaying destroy events by the window. When the stage holds its maximum
+// amount of flows, the oldest destroy event is emitted early.
+//
+// Place the stage after Coalesce, which merges the destroy events of the
+// halves of a flow, and before Delta, so deltas are computed against the
+// emitted destroy event.
+type DestroyDedup struct {
+	window time.Duration
+
+	// Serializes updates to the destroy events held per FlowHash, since
+	// events can be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	// Destroy events evicted from the table, emitted
+	// on the next call to Process or Flush.
+	evictMu sync.Mutex
+	evicted []bpf.Event
+
+	filtered uint64
+}
+
+// NewDestroyDedup returns a DestroyDedup stage holding destroy events for the
+// given window, of at most maxFlows flows. Zero means no limit.
+func NewDestroyDedup(window time.Duration, maxFlows int) *DestroyDedup {
+
+	d := &DestroyDedup{window: window}
+
+	d.table = NewFlowStateTable(0, maxFlows, func(_, v interface{}, _ EvictReason) {
+		held := v.([]*dedupDestroy)
+
+		d.evictMu.Lock()
+		for _, h := range held {
+			d.evicted = append(d.evicted, h.event)
+		}
+		d.evictMu.Unlock()
+	})
+
+	return d
+}
+
+// Name returns the name of the stage.
+func (d *DestroyDedup) Name() string {
+	return "destroy_dedup"
+}
+
+// Process holds destroy events until the end of their flow's window, keeping
+// the one with the highest totals. All other events are passed on.
+func (d *DestroyDedup) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	defer d.emitEvicted(emit)
+
+	if e.Type != bpf.EventDestroy {
+		emit(e)
+		return
+	}
+
+	h := NewFlowHash(e)
+	t := eventTime(e)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var held []*dedupDestroy
+	if v, ok := d.table.Get(h, t); ok {
+		held = v.([]*dedupDestroy)
+	}
+
+	for _, dd := range held {
+		if !dd.sameFlow(e) {
+			continue
+		}
+
+		if higher(e, dd.event) {
+			dd.event = e
+		}
+		atomic.AddUint64(&d.filtered, 1)
+		return
+	}
+
+	d.table.Set(h, append(held, &dedupDestroy{event: e, first: t}), t)
+}
+
+// higher returns true if the totals of a are higher than those of b.
+func higher(a, b bpf.Event) bool {
+
+	ab, bb := a.BytesOrig+a.BytesRet, b.BytesOrig+b.BytesRet
+	if ab != bb {
+		return ab > bb
+	}
+
+	return a.PacketsOrig+a.PacketsRet > b.PacketsOrig+b.PacketsRet
+}
+
+// Flush emits the destroy events of which the window ended before now.
+func (d *DestroyDedup) Flush(now time.Time, emit func(bpf.Event)) {
+
+	defer d.emitEvicted(emit)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	type pending struct {
+		hash FlowHash
+		held []*dedupDestroy
+	}
+
+	// The table can't be modified while ranging over it.
+	var due []pending
+	d.table.Range(func(k, v interface{}) bool {
+		held := v.([]*dedupDestroy)
+
+		var keep []*dedupDestroy
+		for _, dd := range held {
+			if dd.first.Add(d.window).After(now) {
+				keep = append(keep, dd)
+				continue
+			}
+			emit(dd.event)
+		}
+
+		if len(keep) != len(held) {
+			due = append(due, pending{k.(FlowHash), keep})
+		}
+		return true
+	})
+
+	for _, p := range due {
+		if len(p.held) == 0 {
+			d.table.Delete(p.hash)
+			continue
+		}
+		d.table.Set(p.hash, p.held, p.held[0].first)
+	}
+}
+
+// emitEvicted emits the destroy events of evicted flows.
+func (d *DestroyDedup) emitEvicted(emit func(bpf.Event)) {
+
+	d.evictMu.Lock()
+	ev := d.evicted
+	d.evicted = nil
+	d.evictMu.Unlock()
+
+	for _, e := range ev {
+		emit(e)
+	}
+}
+
+// Filtered returns the amount of duplicate destroy events dropped by the stage.
+func (d *DestroyDedup) Filtered() uint64 {
+	return atomic.LoadUint64(&d.filtered)
+}
@@ -0,0 +1,112 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestDestroyDedup(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	d := stages.NewDestroyDedup(5*time.Second, 0)
+
+	// Updates are passed on.
+	d.Process(flowEvent(1, bpf.EventUpdate, start, 100), out.emit)
+	require.Len(t, out, 1)
+
+	// Duplicate destroys of the flow, the second one tracked again with
+	// another ConnectionID. The highest totals arrive out of order.
+	d.Process(flowEvent(1, bpf.EventDestroy, start.Add(time.Second), 300), out.emit)
+	d.Process(flowEvent(2, bpf.EventDestroy, start.Add(2*time.Second), 500), out.emit)
+	d.Process(flowEvent(1, bpf.EventDestroy, start.Add(3*time.Second), 400), out.emit)
+	assert.Len(t, out, 1, "destroy events held within the window")
+
+	d.Flush(start.Add(5*time.Second), out.emit)
+	assert.Len(t, out, 1, "window of the first destroy has not ended")
+
+	d.Flush(start.Add(6*time.Second), out.emit)
+	require.Len(t, out, 2)
+	assert.Equal(t, bpf.EventDestroy, out[1].Type)
+	assert.EqualValues(t, 500, out[1].BytesOrig)
+	assert.EqualValues(t, 2, out[1].ConnectionID)
+	assert.EqualValues(t, 2, d.Filtered())
+
+	// A duplicate after the window is emitted again.
+	d.Process(flowEvent(1, bpf.EventDestroy, start.Add(7*time.Second), 500), out.emit)
+	d.Flush(start.Add(20*time.Second), out.emit)
+	assert.Len(t, out, 3)
+}
+
+func TestDestroyDedupPackets(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	d := stages.NewDestroyDedup(time.Second, 0)
+
+	// Equal bytes, the destroy with the most packets is kept.
+	a := flowEvent(1, bpf.EventDestroy, start, 100)
+	a.PacketsOrig = 3
+	b := a
+	b.PacketsRet = 2
+
+	d.Process(b, out.emit)
+	d.Process(a, out.emit)
+	d.Flush(start.Add(time.Second), out.emit)
+
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 2, out[0].PacketsRet)
+}
+
+func TestDestroyDedupFlows(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	d := stages.NewDestroyDedup(time.Second, 0)
+
+	// The halves of a flow tracked in both directions share a FlowHash,
+	// but are different flows. So are flows in other namespaces.
+	a := flowEvent(1, bpf.EventDestroy, start, 100)
+	r := a
+	r.SrcAddr, r.DstAddr = a.DstAddr, a.SrcAddr
+	ns := a
+	ns.NetNS = 4026531993
+	other := a
+	other.DstAddr = net.IPv4(10, 0, 0, 3)
+
+	for _, e := range []bpf.Event{a, r, ns, other} {
+		d.Process(e, out.emit)
+	}
+	d.Flush(start.Add(time.Second), out.emit)
+
+	assert.Len(t, out, 4)
+	assert.Zero(t, d.Filtered())
+}
+
+func TestDestroyDedupMaxFlows(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	d := stages.NewDestroyDedup(time.Minute, 1)
+
+	a := flowEvent(1, bpf.EventDestroy, start, 100)
+	b := a
+	b.DstAddr = net.IPv4(10, 0, 0, 3)
+
+	// The oldest destroy is emitted early to make room.
+	d.Process(a, out.emit)
+	d.Process(b, out.emit)
+	require.Len(t, out, 1)
+	assert.True(t, out[0].DstAddr.Equal(a.DstAddr))
+}
@@ -0,0 +1,334 @@
+package stages
+
+import (
+	"bytes"
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// EvictReason describes why an entry was evicted from a FlowStateTable.
+type EvictReason uint8
+
+// Reasons for evicting an entry from a FlowStateTable.
+const (
+	// The entry was not touched for longer than the table's idle TTL.
+	EvictIdle EvictReason = iota + 1
+	// The table was full and the entry was the least recently used.
+	EvictCapacity
+)
+
+// EvictFunc is called for every entry evicted from a FlowStateTable.
+// It is called without holding the table's lock, so it is safe to call
+// back into the table from within the function.
+type EvictFunc func(key, value interface{}, reason EvictReason)
+
+// FlowKey uniquely identifies a flow for the lifetime of its conntrack entry.
+// It can be used as a key in the map of a FlowStateTable.
+type FlowKey struct {
+	ConnectionID uint32
+	NetNS        uint32
+	SrcAddr      [net.IPv6len]byte
+	DstAddr      [net.IPv6len]byte
+	SrcPort      uint16
+	DstPort      uint16
+	Proto        uint8
+}
+
+// NewFlowKey returns the FlowKey of the flow the given Event belongs to.
+func NewFlowKey(e bpf.Event) FlowKey {
+	k := FlowKey{
+		ConnectionID: e.ConnectionID,
+		NetNS:        e.NetNS,
+		SrcPort:      e.SrcPort,
+		DstPort:      e.DstPort,
+		Proto:        e.Proto,
+	}
+
+	copy(k.SrcAddr[:], e.SrcAddr.To16())
+	copy(k.DstAddr[:], e.DstAddr.To16())
+
+	return k
+}
+
+// FlowHash identifies a flow by its normalized tuple, regardless of direction:
+// the endpoints of the flow are ordered before hashing, so two conntrack
+// entries tracking the opposite directions of the same connection have the
+// same FlowHash. Different connections can collide, users of a FlowHash must
+// compare the tuples of the events they consider the same flow.
+//
+// Unlike a FlowKey, the ConnectionID is not part of the hash, so it is shared
+// by all conntrack entries of the tuple over time.
+type FlowHash uint64
+
+// FNV-1a parameters.
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// NewFlowHash returns the FlowHash of the flow the given Event belongs to.
+func NewFlowHash(e bpf.Event) FlowHash {
+	return newFlowHash(e, 0, true)
+}
+
+// NewSeededFlowHash returns the FlowHash of the flow the given Event belongs
+// to, derived from a seed. Identical seeds produce identical hashes, different
+// seeds different hashes. A zero seed gives the same hash as NewFlowHash.
+func NewSeededFlowHash(e bpf.Event, seed uint64) FlowHash {
+	return newFlowHash(e, seed, true)
+}
+
+// newFlowHash returns the FlowHash of the event's flow, derived from the given
+// seed. Flows hash identically on all hosts using the same seed if netns is
+// false, since network namespace IDs are local to a host.
+func newFlowHash(e bpf.Event, seed uint64, netns bool) FlowHash {
+
+	a, b := newEndpoint(e.SrcAddr, e.SrcPort), newEndpoint(e.DstAddr, e.DstPort)
+	if b.less(a) {
+		a, b = b, a
+	}
+
+	h := uint64(fnvOffset64)
+	write := func(p ...byte) {
+		for _, c := range p {
+			h ^= uint64(c)
+			h *= fnvPrime64
+		}
+	}
+
+	if seed != 0 {
+		for i := uint(0); i < 64; i += 8 {
+			write(byte(seed >> i))
+		}
+	}
+
+	write(a.addr[:]...)
+	write(byte(a.port>>8), byte(a.port))
+	write(b.addr[:]...)
+	write(byte(b.port>>8), byte(b.port))
+	write(e.Proto)
+	if netns {
+		write(byte(e.NetNS>>24), byte(e.NetNS>>16), byte(e.NetNS>>8), byte(e.NetNS))
+	}
+
+	return FlowHash(h)
+}
+
+// endpoint is the address and port of one side of a flow.
+type endpoint struct {
+	addr [net.IPv6len]byte
+	port uint16
+}
+
+func newEndpoint(ip net.IP, port uint16) endpoint {
+	ep := endpoint{port: port}
+	copy(ep.addr[:], ip.To16())
+	return ep
+}
+
+// less orders endpoints by address, then by port.
+func (ep endpoint) less(o endpoint) bool {
+	if c := bytes.Compare(ep.addr[:], o.addr[:]); c != 0 {
+		return c < 0
+	}
+	return ep.port < o.port
+}
+
+// entry is an element in a FlowStateTable's LRU list.
+type entry struct {
+	key   interface{}
+	value interface{}
+	seen  time.Time
+}
+
+// eviction is an entry that was removed from the table, pending a call
+// to the table's EvictFunc.
+type eviction struct {
+	entry
+	reason EvictReason
+}
+
+// FlowStateTable holds per-flow state of stateful stages. Memory use is
+// bounded by evicting entries that have been idle for longer than the table's
+// TTL, and by evicting the least recently used entry when the table is full.
+// All methods are safe for concurrent use.
+type FlowStateTable struct {
+	ttl        time.Duration
+	maxEntries int
+	onEvict    EvictFunc
+
+	mu      sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[interface{}]*list.Element
+}
+
+// NewFlowStateTable returns a new FlowStateTable. A zero ttl disables idle
+// eviction, a zero maxEntries makes the table unbounded. onEvict is optional
+// and called for every entry evicted because of idleness or capacity.
+func NewFlowStateTable(ttl time.Duration, maxEntries int, onEvict EvictFunc) *FlowStateTable {
+	return &FlowStateTable{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		onEvict:    onEvict,
+		lru:        list.New(),
+		entries:    make(map[interface{}]*list.Element),
+	}
+}
+
+// Get returns the value stored under key and marks the entry as used at now.
+// The boolean return value is false if the key is not present in the table.
+func (t *FlowStateTable) Get(key interface{}, now time.Time) (interface{}, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	e.seen = now
+	t.lru.MoveToFront(el)
+
+	return e.value, true
+}
+
+// Peek returns the value stored under key without marking the entry as used.
+// The boolean return value is false if the key is not present in the table.
+func (t *FlowStateTable) Peek(key interface{}) (interface{}, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	return el.Value.(*entry).value, true
+}
+
+// Set stores value under key, marking the entry as used at now. If the table
+// is full, the least recently used entry is evicted to make room.
+func (t *FlowStateTable) Set(key, value interface{}, now time.Time) {
+
+	var ev []eviction
+
+	t.mu.Lock()
+
+	if el, ok := t.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.seen = now
+		t.lru.MoveToFront(el)
+		t.mu.Unlock()
+		return
+	}
+
+	t.entries[key] = t.lru.PushFront(&entry{key: key, value: value, seen: now})
+
+	// Evict least recently used entries until the table is within bounds.
+	for t.maxEntries > 0 && t.lru.Len() > t.maxEntries {
+		ev = append(ev, t.remove(t.lru.Back(), EvictCapacity))
+	}
+
+	t.mu.Unlock()
+
+	t.evict(ev)
+}
+
+// Delete removes the entry with the given key from the table without calling
+// the table's EvictFunc. Returns the removed value, or false if the key was not
+// present in the table.
+func (t *FlowStateTable) Delete(key interface{}) (interface{}, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	el, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	return t.remove(el, 0).value, true
+}
+
+// Expire evicts all entries that were last used more than the table's TTL
+// before now. Returns the amount of evicted entries. No-op if the table does
+// not have a TTL configured.
+func (t *FlowStateTable) Expire(now time.Time) int {
+
+	if t.ttl == 0 {
+		return 0
+	}
+
+	var ev []eviction
+
+	t.mu.Lock()
+
+	// The back of the list holds the least recently used entries,
+	// stop at the first entry that has not yet expired.
+	for el := t.lru.Back(); el != nil; el = t.lru.Back() {
+		if now.Sub(el.Value.(*entry).seen) <= t.ttl {
+			break
+		}
+		ev = append(ev, t.remove(el, EvictIdle))
+	}
+
+	t.mu.Unlock()
+
+	t.evict(ev)
+
+	return len(ev)
+}
+
+// Range calls f for every entry in the table, from most to least recently
+// used, until f returns false. Entries are not marked as used. The table is
+// locked for the duration of the call, f must not call back into the table.
+func (t *FlowStateTable) Range(f func(key, value interface{}) bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for el := t.lru.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*entry)
+		if !f(e.key, e.value) {
+			return
+		}
+	}
+}
+
+// Len returns the amount of entries in the table.
+func (t *FlowStateTable) Len() int {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lru.Len()
+}
+
+// remove removes el from the table. Must be called with the table's lock held.
+func (t *FlowStateTable) remove(el *list.Element, reason EvictReason) eviction {
+	e := el.Value.(*entry)
+	t.lru.Remove(el)
+	delete(t.entries, e.key)
+
+	return eviction{entry: *e, reason: reason}
+}
+
+// evict calls the table's EvictFunc for all given evictions.
+// Must be called without holding the table's lock.
+func (t *FlowStateTable) evict(ev []eviction) {
+	if t.onEvict == nil {
+		return
+	}
+
+	for _, e := range ev {
+		t.onEvict(e.key, e.value, e.reason)
+	}
+}
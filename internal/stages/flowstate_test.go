@@ -0,0 +1,154 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+type evicted struct {
+	key    interface{}
+	reason stages.EvictReason
+}
+
+func TestFlowStateTableExpire(t *testing.T) {
+
+	var ev []evicted
+	now := time.Unix(0, 0)
+
+	ft := stages.NewFlowStateTable(time.Second, 0, func(k, v interface{}, r stages.EvictReason) {
+		ev = append(ev, evicted{k, r})
+	})
+
+	ft.Set(1, "one", now)
+	ft.Set(2, "two", now.Add(500*time.Millisecond))
+
+	// Touch the first entry, so it expires after the second one.
+	_, ok := ft.Get(1, now.Add(time.Second))
+	require.True(t, ok)
+
+	assert.Equal(t, 0, ft.Expire(now.Add(time.Second)), "nothing expired")
+	assert.Equal(t, 1, ft.Expire(now.Add(1600*time.Millisecond)), "second entry expired")
+	assert.Equal(t, []evicted{{2, stages.EvictIdle}}, ev)
+
+	_, ok = ft.Get(2, now)
+	assert.False(t, ok, "second entry removed")
+
+	assert.Equal(t, 1, ft.Expire(now.Add(3*time.Second)), "first entry expired")
+	assert.Equal(t, 0, ft.Len())
+}
+
+func TestFlowStateTableCapacity(t *testing.T) {
+
+	var ev []evicted
+	now := time.Unix(0, 0)
+
+	ft := stages.NewFlowStateTable(0, 3, func(k, v interface{}, r stages.EvictReason) {
+		ev = append(ev, evicted{k, r})
+	})
+
+	for i := 0; i < 3; i++ {
+		ft.Set(i, i, now)
+	}
+
+	// Mark the oldest entry as used, making 1 the least recently used.
+	ft.Get(0, now)
+	ft.Set(3, 3, now)
+	ft.Set(4, 4, now)
+
+	assert.Equal(t, 3, ft.Len())
+	assert.Equal(t, []evicted{{1, stages.EvictCapacity}, {2, stages.EvictCapacity}}, ev)
+
+	// Updating an existing key does not evict anything.
+	ft.Set(0, "zero", now)
+	assert.Len(t, ev, 2)
+
+	v, ok := ft.Get(0, now)
+	require.True(t, ok)
+	assert.Equal(t, "zero", v)
+
+	// Expire is a no-op without a ttl.
+	assert.Equal(t, 0, ft.Expire(now.Add(time.Hour)))
+}
+
+func TestFlowStateTableDelete(t *testing.T) {
+
+	var calls int
+	now := time.Unix(0, 0)
+
+	ft := stages.NewFlowStateTable(time.Second, 0, func(interface{}, interface{}, stages.EvictReason) {
+		calls++
+	})
+
+	ft.Set("a", 1, now)
+
+	v, ok := ft.Delete("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	_, ok = ft.Delete("a")
+	assert.False(t, ok)
+
+	assert.Equal(t, 0, ft.Expire(now.Add(time.Hour)))
+	assert.Equal(t, 0, calls, "Delete does not call EvictFunc")
+}
+
+func TestFlowStateTablePeek(t *testing.T) {
+
+	now := time.Unix(0, 0)
+	ft := stages.NewFlowStateTable(time.Second, 0, nil)
+
+	ft.Set("a", 1, now)
+
+	v, ok := ft.Peek("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	_, ok = ft.Peek("b")
+	assert.False(t, ok)
+
+	// Peeking doesn't mark the entry used.
+	assert.Equal(t, 1, ft.Expire(now.Add(2*time.Second)))
+}
+
+func TestFlowStateTableEvictReentrant(t *testing.T) {
+
+	now := time.Unix(0, 0)
+
+	var ft *stages.FlowStateTable
+	ft = stages.NewFlowStateTable(time.Second, 1, func(k, v interface{}, r stages.EvictReason) {
+		// Calling into the table from the callback must not deadlock.
+		assert.True(t, ft.Len() <= 1)
+	})
+
+	ft.Set(1, 1, now)
+	ft.Set(2, 2, now)
+	ft.Expire(now.Add(time.Hour))
+}
+
+func TestNewFlowKey(t *testing.T) {
+
+	e := bpf.Event{
+		ConnectionID: 1,
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		SrcPort:      1234,
+		DstPort:      80,
+		Proto:        6,
+	}
+
+	k := stages.NewFlowKey(e)
+	assert.Equal(t, k, stages.NewFlowKey(e))
+
+	e.SrcAddr = net.IP{10, 0, 0, 1} // 4-byte representation of the same address
+	assert.Equal(t, k, stages.NewFlowKey(e))
+
+	e.ConnectionID = 2
+	assert.NotEqual(t, k, stages.NewFlowKey(e))
+}
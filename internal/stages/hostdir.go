@@ -0,0 +1,135 @@
+package stages
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// HostDir is a stage classifying the byte counters of every event as bytes
+// received and sent by the host, setting the event's BytesIn and BytesOut.
+// A flow's orig counters count the traffic sent by its source, so if the
+// source is an address of the host, its orig bytes were sent and its ret
+// bytes received. If only the destination is an address of the host, it's
+// the other way around. Traffic between two addresses of the host is
+// classified by its source. Flows of which neither address is an address of
+// the host are marked Forwarded, and their BytesIn and BytesOut left zero.
+//
+// The host's addresses are those of the network interfaces in the network
+// namespace conntracct runs in, and are re-read periodically by Flush. Flows
+// of other namespaces, eg. containers, are classified using the host's
+// addresses too, so traffic of a container is usually Forwarded. Conntrack
+// reports a flow's addresses before NAT, so traffic DNATed to an address of
+// the host is only classified as received if the original destination is
+// listed in the stage's extra addresses.
+//
+// Place the stage after stages merging or coalescing events, like Coalesce,
+// so the final counters of events are classified.
+type HostDir struct {
+	extra   []net.IP
+	refresh time.Duration
+
+	mu    sync.RWMutex
+	addrs map[[net.IPv6len]byte]struct{}
+	next  time.Time // time of the next refresh of addrs
+}
+
+// NewHostDir returns a HostDir stage treating the addresses of the host's
+// network interfaces and the given extra addresses as the host's. The
+// interface addresses are re-read every refresh, zero means never.
+func NewHostDir(extra []net.IP, refresh time.Duration) (*HostDir, error) {
+
+	h := &HostDir{extra: extra, refresh: refresh}
+
+	if err := h.load(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Name returns the name of the stage.
+func (h *HostDir) Name() string {
+	return "hostdir"
+}
+
+// Process sets the host's received and sent byte counters of the event.
+func (h *HostDir) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	h.mu.RLock()
+	src, dst := h.isLocal(e.SrcAddr), h.isLocal(e.DstAddr)
+	h.mu.RUnlock()
+
+	switch {
+	case src:
+		e.BytesOut, e.BytesIn = e.BytesOrig, e.BytesRet
+	case dst:
+		e.BytesIn, e.BytesOut = e.BytesOrig, e.BytesRet
+	default:
+		e.Forwarded = true
+	}
+
+	emit(e)
+}
+
+// Flush re-reads the addresses of the host's interfaces if the stage's
+// refresh interval passed, so addresses added or removed after the stage
+// was created are picked up. The stage never holds on to events. The
+// previous addresses are kept if the interfaces can't be read.
+func (h *HostDir) Flush(now time.Time, _ func(bpf.Event)) {
+
+	h.mu.RLock()
+	due := h.refresh > 0 && !now.Before(h.next)
+	h.mu.RUnlock()
+
+	if due {
+		_ = h.load(now)
+	}
+}
+
+// load reads the addresses of the host's interfaces and replaces
+// the stage's set of addresses.
+func (h *HostDir) load(now time.Time) error {
+
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return err
+	}
+
+	addrs := make(map[[net.IPv6len]byte]struct{}, len(ifaddrs)+len(h.extra))
+	for _, a := range ifaddrs {
+		if n, ok := a.(*net.IPNet); ok {
+			addrs[addrKey(n.IP)] = struct{}{}
+		}
+	}
+	for _, ip := range h.extra {
+		addrs[addrKey(ip)] = struct{}{}
+	}
+
+	h.mu.Lock()
+	h.addrs = addrs
+	h.next = now.Add(h.refresh)
+	h.mu.Unlock()
+
+	return nil
+}
+
+// isLocal returns true if ip is an address of the host.
+// Must be called with mu held.
+func (h *HostDir) isLocal(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	_, ok := h.addrs[addrKey(ip)]
+	return ok
+}
+
+// addrKey returns the 16-byte form of ip, so the 4- and 16-byte forms
+// of an IPv4 address are the same key.
+func addrKey(ip net.IP) [net.IPv6len]byte {
+	var k [net.IPv6len]byte
+	copy(k[:], ip.To16())
+	return k
+}
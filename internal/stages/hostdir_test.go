@@ -0,0 +1,98 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestHostDir(t *testing.T) {
+
+	// Documentation addresses are never assigned to an interface.
+	local4 := net.IP{192, 0, 2, 1}
+	local6 := net.ParseIP("2001:db8::1")
+	remote4 := net.IP{198, 51, 100, 1}
+	other4 := net.IP{203, 0, 113, 1}
+	remote6 := net.ParseIP("2001:db8::2")
+
+	h, err := stages.NewHostDir([]net.IP{local4, local6}, 0)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		src, dst  net.IP
+		in, out   uint64
+		forwarded bool
+	}{
+		{"outbound", local4, remote4, 200, 100, false},
+		{"inbound", remote4, local4, 100, 200, false},
+		{"outbound ipv6", local6, remote6, 200, 100, false},
+		{"inbound ipv6", remote6, local6, 100, 200, false},
+		// The 16-byte form of the host's IPv4 address.
+		{"inbound v4-in-v6", remote4, net.IPv4(192, 0, 2, 1), 100, 200, false},
+		// Classified by the source.
+		{"host to host", local4, local4, 200, 100, false},
+		{"forwarded", remote4, other4, 0, 0, true},
+		{"forwarded ipv6", remote6, net.ParseIP("2001:db8::3"), 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out collector
+			h.Process(bpf.Event{
+				SrcAddr: tt.src, DstAddr: tt.dst,
+				PacketsOrig: 1, BytesOrig: 100, PacketsRet: 2, BytesRet: 200,
+			}, out.emit)
+			require.Len(t, out, 1)
+
+			e := out[0]
+			assert.Equal(t, tt.in, e.BytesIn, "in")
+			assert.Equal(t, tt.out, e.BytesOut, "out")
+			assert.Equal(t, tt.forwarded, e.Forwarded, "forwarded")
+
+			// Raw counters are left untouched.
+			assert.EqualValues(t, 100, e.BytesOrig)
+			assert.EqualValues(t, 200, e.BytesRet)
+		})
+	}
+}
+
+func TestHostDirInterfaces(t *testing.T) {
+
+	addrs, err := net.InterfaceAddrs()
+	require.NoError(t, err)
+
+	var ip net.IP
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() != nil {
+			ip = n.IP.To4()
+			break
+		}
+	}
+	if ip == nil {
+		t.Skip("no IPv4 address on any interface")
+	}
+
+	h, err := stages.NewHostDir(nil, time.Minute)
+	require.NoError(t, err)
+
+	var out collector
+	h.Process(bpf.Event{SrcAddr: net.IP{198, 51, 100, 1}, DstAddr: ip, BytesOrig: 100, BytesRet: 200}, out.emit)
+
+	// Refreshing keeps the host's addresses.
+	h.Flush(time.Now().Add(time.Hour), out.emit)
+	h.Process(bpf.Event{SrcAddr: ip, DstAddr: net.IP{198, 51, 100, 1}, BytesOrig: 100, BytesRet: 200}, out.emit)
+
+	require.Len(t, out, 2)
+	assert.EqualValues(t, 100, out[0].BytesIn)
+	assert.EqualValues(t, 200, out[0].BytesOut)
+	assert.EqualValues(t, 100, out[1].BytesOut)
+	assert.EqualValues(t, 200, out[1].BytesIn)
+	assert.False(t, out[0].Forwarded || out[1].Forwarded)
+}
@@ -0,0 +1,67 @@
+package stages
+
+import (
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// destroyedFlows remembers the destroy events of flows for a window after
+// they were seen, so stages can recognize the events of a flow arriving after
+// its destroy event. Events of a flow are read from different CPUs and
+// processed by separate workers, so a destroy event can overtake the flow's
+// last updates.
+//
+// A stage without state for a flow at its destroy event takes the destroy
+// event's totals as the flow's final state, and events of the flow that
+// happened before the destroy event but arrive within the window after it
+// are known to be late. Events of a flow reusing the destroyed flow's
+// ConnectionID happen after the destroy event, and are not late.
+//
+// A nil destroyedFlows remembers no flows.
+type destroyedFlows struct {
+	table *FlowStateTable
+}
+
+// newDestroyedFlows returns a destroyedFlows remembering destroy events for
+// window, of at most maxFlows flows. Returns nil if window is zero.
+func newDestroyedFlows(window time.Duration, maxFlows int) *destroyedFlows {
+
+	if window == 0 {
+		return nil
+	}
+
+	return &destroyedFlows{table: NewFlowStateTable(window, maxFlows, nil)}
+}
+
+// add remembers the destroy event e.
+func (d *destroyedFlows) add(e bpf.Event) {
+
+	if d == nil {
+		return
+	}
+
+	// Entries hold the time of the destroy event.
+	t := eventTime(e)
+	d.table.Set(NewFlowKey(e), t, t)
+}
+
+// late returns true if e happened before a destroy event of its flow.
+func (d *destroyedFlows) late(e bpf.Event) bool {
+
+	if d == nil {
+		return false
+	}
+
+	// The entry is peeked so it expires a window after the destroy
+	// event, regardless of the flow's late events.
+	v, ok := d.table.Peek(NewFlowKey(e))
+	return ok && eventTime(e).Before(v.(time.Time))
+}
+
+// expire forgets the destroy events seen more than the window before now.
+func (d *destroyedFlows) expire(now time.Time) {
+	if d != nil {
+		d.table.Expire(now)
+	}
+}
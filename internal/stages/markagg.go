@@ -0,0 +1,172 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// markBucket holds the traffic of all flows with a connmark in a window.
+type markBucket struct {
+	window   time.Time    // start of the bucket's current window
+	counters bpf.Counters // traffic accrued in the window
+	seen     time.Time    // time of the bucket's latest event
+	labels   map[string]string
+}
+
+// MarkAggregate is a stage summing the traffic of all flows by their
+// connmark, eg. a tenant ID, emitting one event per connmark per window
+// instead of the events of every flow. Only the bits of the connmark in the
+// stage's mask are kept, so flows with different values in other bits of the
+// connmark are summed into the same bucket. Windows are aligned to multiples
+// of the window length since the Unix epoch, like Rollup's.
+//
+// Aggregated events are update events holding the connmark and the packets
+// and bytes accrued by its flows during the window, not their totals. Their
+// Time is the end of the window, all other fields are zero, apart from the
+// labels of the bucket's latest event. Windows without traffic are not
+// emitted. The events of the flows themselves, including destroy events, are
+// consumed by the stage.
+//
+// The traffic of a flow is the difference between the counters of its
+// consecutive events, see Delta. The first event of a flow seen by the stage
+// accounts for all of the flow's traffic up to then.
+type MarkAggregate struct {
+	window time.Duration
+	mask   uint32
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	flows   *FlowStateTable // counters of each flow at its previous event
+	buckets map[uint32]*markBucket
+}
+
+// NewMarkAggregate returns a MarkAggregate summing traffic into windows of
+// the given length by the bits of the connmark in mask. Buckets are removed
+// when their connmark has not been seen for ttl. The counters of at most
+// maxFlows flows are held, zero means no limit, see NewDelta.
+func NewMarkAggregate(window time.Duration, mask uint32, ttl time.Duration, maxFlows int) *MarkAggregate {
+	return &MarkAggregate{
+		window:  window,
+		mask:    mask,
+		ttl:     ttl,
+		flows:   NewFlowStateTable(0, maxFlows, nil),
+		buckets: make(map[uint32]*markBucket),
+	}
+}
+
+// Name returns the name of the stage.
+func (a *MarkAggregate) Name() string {
+	return "mark_aggregate"
+}
+
+// Process adds the traffic of the event's flow since its previous event to
+// the bucket of its connmark. Emits the bucket's previous window if it ended.
+func (a *MarkAggregate) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	key := NewFlowKey(e)
+	t := eventTime(e)
+	cur := e.Counters()
+	mark := e.Connmark & a.mask
+	win := t.Truncate(a.window)
+
+	a.mu.Lock()
+
+	var prev bpf.Counters
+	if v, ok := a.flows.Get(key, t); ok {
+		prev = v.(bpf.Counters)
+	}
+	if e.Type == bpf.EventDestroy {
+		a.flows.Delete(key)
+	} else {
+		a.flows.Set(key, cur, t)
+	}
+
+	b, ok := a.buckets[mark]
+	if !ok {
+		b = &markBucket{window: win}
+		a.buckets[mark] = b
+	}
+
+	// Late events of an earlier window are added to the current one.
+	var due []bpf.Event
+	if win.After(b.window) {
+		if ev, ok := a.bucketEvent(mark, b); ok {
+			due = append(due, ev)
+		}
+		b.window, b.counters = win, bpf.Counters{}
+	}
+
+	d := delta(cur, prev)
+	b.counters.PacketsOrig += d.PacketsOrig
+	b.counters.BytesOrig += d.BytesOrig
+	b.counters.PacketsRet += d.PacketsRet
+	b.counters.BytesRet += d.BytesRet
+	b.labels = e.Labels
+	if t.After(b.seen) {
+		b.seen = t
+	}
+
+	a.mu.Unlock()
+
+	for _, ev := range due {
+		emit(ev)
+	}
+}
+
+// Flush emits the buckets of all windows that ended before now, and removes
+// the buckets of connmarks that have not been seen for the stage's ttl.
+func (a *MarkAggregate) Flush(now time.Time, emit func(bpf.Event)) {
+
+	var due []bpf.Event
+
+	a.mu.Lock()
+
+	for mark, b := range a.buckets {
+		if !b.window.Add(a.window).After(now) {
+			if ev, ok := a.bucketEvent(mark, b); ok {
+				due = append(due, ev)
+			}
+			b.counters = bpf.Counters{}
+		}
+
+		if now.Sub(b.seen) > a.ttl {
+			delete(a.buckets, mark)
+		}
+	}
+
+	a.mu.Unlock()
+
+	for _, ev := range due {
+		emit(ev)
+	}
+}
+
+// Len returns the amount of connmarks the stage holds a bucket for.
+func (a *MarkAggregate) Len() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.buckets)
+}
+
+// bucketEvent returns the aggregated event of a bucket's window,
+// or false if no traffic was accrued in the window.
+func (a *MarkAggregate) bucketEvent(mark uint32, b *markBucket) (bpf.Event, bool) {
+
+	c := b.counters
+	if c == (bpf.Counters{}) {
+		return bpf.Event{}, false
+	}
+
+	return bpf.Event{
+		Type:        bpf.EventUpdate,
+		Time:        b.window.Add(a.window),
+		Connmark:    mark,
+		PacketsOrig: c.PacketsOrig,
+		BytesOrig:   c.BytesOrig,
+		PacketsRet:  c.PacketsRet,
+		BytesRet:    c.BytesRet,
+		Labels:      b.labels,
+	}, true
+}
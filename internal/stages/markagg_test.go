@@ -0,0 +1,145 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// markEvent returns an event of flow id with the given connmark at t,
+// with the given totals in both directions.
+func markEvent(id, mark uint32, typ bpf.EventType, t time.Time, bytes, packets uint64) bpf.Event {
+	e := flowEvent(id, typ, t, bytes)
+	e.Connmark = mark
+	e.PacketsOrig = packets
+	e.BytesRet, e.PacketsRet = bytes/2, packets/2
+	return e
+}
+
+// byMark returns the events by their connmark.
+func byMark(evs []bpf.Event) map[uint32]bpf.Event {
+	m := make(map[uint32]bpf.Event)
+	for _, e := range evs {
+		m[e.Connmark] = e
+	}
+	return m
+}
+
+func TestMarkAggregateSums(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	a := stages.NewMarkAggregate(30*time.Second, 0xffffffff, time.Minute, 0)
+
+	// Tenant 1 has two flows, tenant 2 a single flow. Events carry the
+	// flows' totals, of which only the traffic since the flow's previous
+	// event is summed.
+	a.Process(markEvent(1, 1, bpf.EventNew, start, 100, 10), out.emit)
+	a.Process(markEvent(2, 1, bpf.EventNew, start.Add(time.Second), 50, 4), out.emit)
+	a.Process(markEvent(3, 2, bpf.EventNew, start.Add(time.Second), 1000, 20), out.emit)
+	a.Process(markEvent(1, 1, bpf.EventUpdate, start.Add(10*time.Second), 300, 30), out.emit)
+	a.Process(markEvent(3, 2, bpf.EventDestroy, start.Add(20*time.Second), 1200, 24), out.emit)
+
+	assert.Empty(t, out, "flow events are consumed")
+
+	a.Flush(start.Add(29*time.Second), out.emit)
+	assert.Empty(t, out, "no events emitted within the window")
+
+	// One event per connmark at the end of the window.
+	a.Flush(start.Add(30*time.Second), out.emit)
+	require.Len(t, out, 2)
+
+	m := byMark(out)
+	assert.EqualValues(t, 350, m[1].BytesOrig)
+	assert.EqualValues(t, 34, m[1].PacketsOrig)
+	assert.EqualValues(t, 175, m[1].BytesRet)
+	assert.EqualValues(t, 17, m[1].PacketsRet)
+	assert.EqualValues(t, 1200, m[2].BytesOrig)
+	assert.EqualValues(t, 24, m[2].PacketsOrig)
+	for _, e := range out {
+		assert.Equal(t, bpf.EventUpdate, e.Type)
+		assert.True(t, start.Add(30*time.Second).Equal(e.Time), "events carry the end of the window")
+		assert.Zero(t, e.ConnectionID)
+		assert.Nil(t, e.SrcAddr)
+	}
+
+	// The next window only holds the traffic accrued since. Tenant 2's flow
+	// was destroyed and accrued nothing, so its window isn't emitted.
+	out = nil
+	a.Process(markEvent(1, 1, bpf.EventUpdate, start.Add(40*time.Second), 400, 35), out.emit)
+	a.Process(markEvent(2, 1, bpf.EventDestroy, start.Add(45*time.Second), 60, 5), out.emit)
+	a.Flush(start.Add(60*time.Second), out.emit)
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 1, out[0].Connmark)
+	assert.EqualValues(t, 110, out[0].BytesOrig)
+	assert.EqualValues(t, 6, out[0].PacketsOrig)
+}
+
+func TestMarkAggregateMask(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	// Tenant IDs in the upper 16 bits, the lower bits are used for routing.
+	a := stages.NewMarkAggregate(30*time.Second, 0xffff0000, time.Minute, 0)
+
+	a.Process(markEvent(1, 0x00010001, bpf.EventNew, start, 100, 1), out.emit)
+	a.Process(markEvent(2, 0x00010002, bpf.EventNew, start, 200, 2), out.emit)
+	a.Process(markEvent(3, 0x00020001, bpf.EventNew, start, 400, 4), out.emit)
+	a.Flush(start.Add(30*time.Second), out.emit)
+
+	m := byMark(out)
+	require.Len(t, m, 2)
+	assert.EqualValues(t, 300, m[0x00010000].BytesOrig)
+	assert.EqualValues(t, 400, m[0x00020000].BytesOrig)
+}
+
+func TestMarkAggregateWindows(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	a := stages.NewMarkAggregate(30*time.Second, 0xffffffff, time.Minute, 0)
+
+	// An event in the next window emits the previous window of its
+	// connmark, even if the stage wasn't flushed in between.
+	a.Process(markEvent(1, 7, bpf.EventNew, start, 100, 1), out.emit)
+	a.Process(markEvent(1, 7, bpf.EventUpdate, start.Add(35*time.Second), 250, 3), out.emit)
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 100, out[0].BytesOrig)
+	assert.True(t, start.Add(30*time.Second).Equal(out[0].Time))
+
+	// Late events of an earlier window count towards the current window.
+	a.Process(markEvent(2, 7, bpf.EventUpdate, start.Add(20*time.Second), 10, 1), out.emit)
+	a.Flush(start.Add(60*time.Second), out.emit)
+	require.Len(t, out, 2)
+	assert.EqualValues(t, 160, out[1].BytesOrig)
+	assert.True(t, start.Add(60*time.Second).Equal(out[1].Time))
+}
+
+func TestMarkAggregateEvict(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	a := stages.NewMarkAggregate(30*time.Second, 0xffffffff, time.Minute, 0)
+
+	a.Process(markEvent(1, 1, bpf.EventNew, start, 100, 1), out.emit)
+	a.Process(markEvent(2, 2, bpf.EventNew, start.Add(50*time.Second), 100, 1), out.emit)
+	assert.Equal(t, 2, a.Len())
+
+	// Connmark 1 was last seen more than a minute ago,
+	// its bucket is emitted one last time and removed.
+	a.Flush(start.Add(90*time.Second), out.emit)
+	assert.Len(t, out, 2)
+	assert.Equal(t, 1, a.Len())
+
+	a.Flush(start.Add(3*time.Minute), out.emit)
+	assert.Zero(t, a.Len())
+}
@@ -0,0 +1,127 @@
+package stages
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// minAgeState is the state of a flow seen by a MinAge stage.
+type minAgeState struct {
+	// Time of the flow's first event seen by the stage.
+	first time.Time
+	// The flow reached the stage's minimum age.
+	passed bool
+}
+
+// MinAge is a stage only passing on the events of long-lived flows, dropping
+// all events of flows younger than the stage's minimum age, eg. the churn of
+// short connections. Once a flow reaches the minimum age, all of its following
+// events are passed on, including its destroy event. Flows destroyed before
+// reaching the minimum age are dropped entirely.
+//
+// The age of a flow at an event is the longest of the event's Duration, the
+// time since the flow's Start, if conntrack timestamps are enabled, and the
+// time since the flow's first event seen by the stage. The latter covers
+// flows of which the Duration restarted or is unknown, like flows that were
+// established before the Probe was loaded.
+//
+// The state of flows is removed on their destroy event, and evicted when flows
+// were idle for longer than the stage's TTL or when the stage holds its
+// maximum amount of flows. An evicted flow's age is only known from its next
+// event's Duration and Start, so keep the TTL longer than the interval between
+// updates.
+//
+// Place the stage before Delta, so the delta of a flow's first event passed
+// on covers its traffic since its start.
+type MinAge struct {
+	min time.Duration
+
+	// Serializes reading and storing a flow's state, since events of the
+	// same flow can be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	filtered uint64
+}
+
+// NewMinAge returns a MinAge stage dropping the events of flows younger than
+// min. The state of flows is held until they were idle for ttl, and for at
+// most maxFlows flows. Zero means no limit.
+func NewMinAge(min, ttl time.Duration, maxFlows int) *MinAge {
+	return &MinAge{
+		min:   min,
+		table: NewFlowStateTable(ttl, maxFlows, nil),
+	}
+}
+
+// Name returns the name of the stage.
+func (m *MinAge) Name() string {
+	return "min_age"
+}
+
+// Process drops the event if its flow has not reached the stage's
+// minimum age yet.
+func (m *MinAge) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	key := NewFlowKey(e)
+	now := eventTime(e)
+
+	m.mu.Lock()
+
+	st := minAgeState{first: now}
+	if v, ok := m.table.Get(key, now); ok {
+		st = v.(minAgeState)
+	}
+
+	if !st.passed && flowAge(e, st.first, now) >= m.min {
+		st.passed = true
+	}
+
+	if e.Type == bpf.EventDestroy {
+		m.table.Delete(key)
+	} else {
+		m.table.Set(key, st, now)
+	}
+
+	m.mu.Unlock()
+
+	if !st.passed {
+		atomic.AddUint64(&m.filtered, 1)
+		return
+	}
+
+	emit(e)
+}
+
+// flowAge returns the age of the event's flow at now, the flow's first
+// event seen at first.
+func flowAge(e bpf.Event, first, now time.Time) time.Duration {
+
+	age := e.Duration
+
+	if e.Start != 0 {
+		if a := now.Sub(time.Unix(0, int64(e.Start))); a > age {
+			age = a
+		}
+	}
+
+	if a := now.Sub(first); a > age {
+		age = a
+	}
+
+	return age
+}
+
+// Flush evicts the state of flows that were idle for longer than the stage's
+// TTL. The stage never holds on to events.
+func (m *MinAge) Flush(now time.Time, _ func(bpf.Event)) {
+	m.table.Expire(now)
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (m *MinAge) Filtered() uint64 {
+	return atomic.LoadUint64(&m.filtered)
+}
@@ -0,0 +1,117 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestMinAge(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	m := stages.NewMinAge(time.Minute, 0, 0)
+
+	// A short flow destroyed after 30 seconds, and a long flow destroyed
+	// after 2 minutes, both updated every 30 seconds.
+	for i := 0; i < 5; i++ {
+		typ := bpf.EventUpdate
+		switch i {
+		case 0:
+			typ = bpf.EventNew
+		case 4:
+			typ = bpf.EventDestroy
+		}
+		at := start.Add(time.Duration(i) * 30 * time.Second)
+
+		if i < 2 {
+			short := flowEvent(1, typ, at, uint64(i+1)*100)
+			if i == 1 {
+				short.Type = bpf.EventDestroy
+			}
+			m.Process(short, out.emit)
+		}
+
+		m.Process(flowEvent(2, typ, at, uint64(i+1)*100), out.emit)
+	}
+
+	// None of the short flow's events were emitted. The long flow's events
+	// were emitted from the update at the minute, including its destroy.
+	var types []bpf.EventType
+	for _, e := range out {
+		assert.EqualValues(t, 2, e.ConnectionID)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []bpf.EventType{bpf.EventUpdate, bpf.EventUpdate, bpf.EventDestroy}, types)
+	assert.EqualValues(t, 4, m.Filtered())
+	assert.EqualValues(t, 300, out[0].BytesOrig)
+}
+
+func TestMinAgeKernelAge(t *testing.T) {
+
+	start := time.Unix(300, 0)
+
+	tests := []struct {
+		name  string
+		event func(e *bpf.Event)
+		keep  bool
+	}{
+		{"unknown age", func(e *bpf.Event) {}, false},
+		{"duration below", func(e *bpf.Event) { e.Duration = 30 * time.Second }, false},
+		{"duration above", func(e *bpf.Event) { e.Duration = 90 * time.Second }, true},
+		{"start below", func(e *bpf.Event) { e.Start = uint64(start.Add(-30 * time.Second).UnixNano()) }, false},
+		{"start above", func(e *bpf.Event) { e.Start = uint64(start.Add(-90 * time.Second).UnixNano()) }, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out collector
+			m := stages.NewMinAge(time.Minute, 0, 0)
+
+			// The first event seen of a flow established before the stage
+			// saw it, like flows established before the probe was loaded.
+			e := flowEvent(1, bpf.EventUpdate, start, 100)
+			tt.event(&e)
+			m.Process(e, out.emit)
+
+			if tt.keep {
+				assert.Len(t, out, 1)
+			} else {
+				assert.Empty(t, out)
+			}
+		})
+	}
+}
+
+func TestMinAgeEvict(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	m := stages.NewMinAge(time.Minute, time.Minute, 0)
+
+	m.Process(flowEvent(1, bpf.EventNew, start, 60), out.emit)
+	m.Process(flowEvent(1, bpf.EventUpdate, start.Add(30*time.Second), 120), out.emit)
+	assert.Empty(t, out)
+
+	// The flow's state is evicted after it was idle for a minute, so its age
+	// is only known from its next event.
+	m.Flush(start.Add(2*time.Minute), out.emit)
+	m.Process(flowEvent(1, bpf.EventUpdate, start.Add(3*time.Minute), 180), out.emit)
+	assert.Empty(t, out)
+
+	e := flowEvent(1, bpf.EventUpdate, start.Add(3*time.Minute+10*time.Second), 240)
+	e.Duration = 190 * time.Second
+	m.Process(e, out.emit)
+	assert.Len(t, out, 1)
+
+	// The flow keeps passing once it reached the minimum age.
+	m.Process(flowEvent(1, bpf.EventDestroy, start.Add(3*time.Minute+20*time.Second), 300), out.emit)
+	assert.Len(t, out, 2)
+	assert.EqualValues(t, 3, m.Filtered())
+}
@@ -0,0 +1,124 @@
+package stages
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// minRateState is the counters of a flow at the time of its previous event.
+type minRateState struct {
+	counters bpf.Counters
+	time     time.Time
+}
+
+// MinRate is a stage dropping the update events of trickle flows, eg. flows
+// only carrying keepalives. The rate of a flow is its traffic in both
+// directions accrued since its previous event, divided by the time between
+// both events. Updates are dropped if their rate is below the stage's bytes
+// per second floor and below its packets per second floor, a zero floor is
+// not applied. New and destroy events are always kept, so every flow's first
+// and final counters reach the sinks.
+//
+// The rate is always computed between consecutive events of a flow, whether
+// the previous one was dropped or not. It can't be computed for a flow's first
+// event seen by the stage, so the update is kept. The state of flows is removed
+// on their destroy event, and evicted when flows were idle for longer than
+// the stage's TTL or when the stage holds its maximum amount of flows. An
+// evicted flow's next update is kept for the same reason, so a TTL shorter
+// than the interval between updates of trickle flows keeps all their updates.
+//
+// Place the stage after stages coalescing events, like Rollup, so rates are
+// computed between the events that reach the sinks, and before Delta, so
+// deltas cover the traffic of the dropped updates.
+type MinRate struct {
+	bytes   float64
+	packets float64
+
+	// Serializes reading and storing a flow's counters, since events of the
+	// same flow can be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	filtered uint64
+}
+
+// NewMinRate returns a MinRate stage dropping updates below the given amount
+// of bytes and packets per second. The state of flows is held until they were
+// idle for ttl, and for at most maxFlows flows. Zero means no limit.
+func NewMinRate(bytes, packets float64, ttl time.Duration, maxFlows int) *MinRate {
+	return &MinRate{
+		bytes:   bytes,
+		packets: packets,
+		table:   NewFlowStateTable(ttl, maxFlows, nil),
+	}
+}
+
+// Name returns the name of the stage.
+func (m *MinRate) Name() string {
+	return "min_rate"
+}
+
+// Process drops the event if it's an update of a flow of which
+// the rate since its previous event is below the stage's floors.
+func (m *MinRate) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	key := NewFlowKey(e)
+	now := eventTime(e)
+	cur := e.Counters()
+
+	m.mu.Lock()
+
+	var prev minRateState
+	v, seen := m.table.Get(key, now)
+	if seen {
+		prev = v.(minRateState)
+	}
+
+	if e.Type == bpf.EventDestroy {
+		m.table.Delete(key)
+	} else {
+		m.table.Set(key, minRateState{counters: cur, time: now}, now)
+	}
+
+	m.mu.Unlock()
+
+	if e.Type == bpf.EventUpdate && seen && m.below(delta(cur, prev.counters), now.Sub(prev.time)) {
+		atomic.AddUint64(&m.filtered, 1)
+		return
+	}
+
+	emit(e)
+}
+
+// below returns true if the traffic d accrued over dt is below the stage's
+// floors. The rate over a zero or negative interval is unknown.
+func (m *MinRate) below(d *bpf.Counters, dt time.Duration) bool {
+
+	if dt <= 0 || (m.bytes == 0 && m.packets == 0) {
+		return false
+	}
+
+	s := dt.Seconds()
+	if m.bytes != 0 && float64(d.BytesOrig+d.BytesRet)/s >= m.bytes {
+		return false
+	}
+	if m.packets != 0 && float64(d.PacketsOrig+d.PacketsRet)/s >= m.packets {
+		return false
+	}
+
+	return true
+}
+
+// Flush evicts the state of flows that were idle for longer than the stage's
+// TTL. The stage never holds on to events.
+func (m *MinRate) Flush(now time.Time, _ func(bpf.Event)) {
+	m.table.Expire(now)
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (m *MinRate) Filtered() uint64 {
+	return atomic.LoadUint64(&m.filtered)
+}
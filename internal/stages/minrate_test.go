@@ -0,0 +1,120 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestMinRate(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	// 1000 bytes per second, or 10 packets per second.
+	m := stages.NewMinRate(1000, 10, 0, 0)
+
+	// A keepalive flow sending 60 bytes in one packet every 10 seconds,
+	// and a bulk flow sending 100kB in 100 packets every 10 seconds.
+	for i := 0; i < 5; i++ {
+		typ := bpf.EventUpdate
+		switch i {
+		case 0:
+			typ = bpf.EventNew
+		case 4:
+			typ = bpf.EventDestroy
+		}
+		at := start.Add(time.Duration(i) * 10 * time.Second)
+
+		low := flowEvent(1, typ, at, uint64(i+1)*60)
+		low.PacketsOrig = uint64(i + 1)
+		m.Process(low, out.emit)
+
+		high := flowEvent(2, typ, at, uint64(i+1)*100000)
+		high.PacketsOrig = uint64(i+1) * 100
+		m.Process(high, out.emit)
+	}
+
+	// The new and destroy events of the keepalive flow and all events
+	// of the bulk flow were kept.
+	var low, high []bpf.EventType
+	for _, e := range out {
+		if e.ConnectionID == 1 {
+			low = append(low, e.Type)
+		} else {
+			high = append(high, e.Type)
+		}
+	}
+	assert.Equal(t, []bpf.EventType{bpf.EventNew, bpf.EventDestroy}, low)
+	assert.Len(t, high, 5)
+	assert.EqualValues(t, 3, m.Filtered())
+}
+
+func TestMinRateFloors(t *testing.T) {
+
+	start := time.Unix(300, 0)
+
+	tests := []struct {
+		name           string
+		bytes, packets float64
+		keep           bool
+	}{
+		{"no floors", 0, 0, true},
+		{"above bytes", 50, 0, true},
+		{"below bytes", 200, 0, false},
+		{"above packets", 0, 5, true},
+		{"below packets", 0, 20, false},
+		// The packet rate keeps the event in spite of the low byte rate.
+		{"below bytes above packets", 200, 5, true},
+		{"below both", 200, 20, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out collector
+			m := stages.NewMinRate(tt.bytes, tt.packets, 0, 0)
+
+			// 100 bytes in 10 packets per second, counting both directions.
+			first := flowEvent(1, bpf.EventUpdate, start, 0)
+			m.Process(first, out.emit)
+
+			next := flowEvent(1, bpf.EventUpdate, start.Add(2*time.Second), 100)
+			next.BytesRet = 100
+			next.PacketsOrig, next.PacketsRet = 10, 10
+			m.Process(next, out.emit)
+
+			// The first event seen of the flow is kept, its rate is unknown.
+			if tt.keep {
+				assert.Len(t, out, 2)
+			} else {
+				assert.Len(t, out, 1)
+			}
+		})
+	}
+}
+
+func TestMinRateEvict(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	m := stages.NewMinRate(1000, 0, time.Minute, 0)
+
+	m.Process(flowEvent(1, bpf.EventNew, start, 60), out.emit)
+	m.Process(flowEvent(1, bpf.EventUpdate, start.Add(10*time.Second), 120), out.emit)
+	assert.Len(t, out, 1)
+
+	// The flow's state is evicted after it was idle for a minute,
+	// its next update is kept since its rate is unknown.
+	m.Flush(start.Add(2*time.Minute), out.emit)
+	m.Process(flowEvent(1, bpf.EventUpdate, start.Add(3*time.Minute), 180), out.emit)
+	assert.Len(t, out, 2)
+
+	m.Process(flowEvent(1, bpf.EventUpdate, start.Add(3*time.Minute+10*time.Second), 240), out.emit)
+	assert.Len(t, out, 2)
+	assert.EqualValues(t, 2, m.Filtered())
+}
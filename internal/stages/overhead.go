@@ -0,0 +1,41 @@
+package stages
+
+import (
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Common per-packet overheads in bytes, for use with NewOverhead.
+const (
+	// Ethernet header without VLAN tag.
+	OverheadEthernet = 14
+	// Ethernet header, frame check sequence, preamble and inter-frame gap.
+	// Approximates the bandwidth used on the wire.
+	OverheadEthernetWire = 14 + 4 + 8 + 12
+)
+
+// Overhead is a stage approximating byte counters at a lower layer than
+// conntrack's L3 (IP) counters. It sets the adjusted byte counters of every
+// event to bytes + packets * overhead, leaving the raw counters untouched.
+// This is an approximation, the actual overhead of a packet depends on
+// the path it took, eg. VLAN tags, tunnels, or link types other than Ethernet.
+type Overhead struct {
+	bytes uint64
+}
+
+// NewOverhead returns an Overhead stage adding the given
+// amount of bytes per packet to the adjusted byte counters.
+func NewOverhead(bytes uint64) *Overhead {
+	return &Overhead{bytes: bytes}
+}
+
+// Name returns the name of the stage.
+func (o *Overhead) Name() string {
+	return "overhead"
+}
+
+// Process sets the adjusted byte counters of the event.
+func (o *Overhead) Process(e bpf.Event, emit func(bpf.Event)) {
+	e.BytesOrigAdjusted = e.BytesOrig + e.PacketsOrig*o.bytes
+	e.BytesRetAdjusted = e.BytesRet + e.PacketsRet*o.bytes
+	emit(e)
+}
@@ -0,0 +1,47 @@
+package stages_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestOverhead(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		overhead uint64
+		in       bpf.Event
+		orig     uint64
+		ret      uint64
+	}{
+		// The single 31-byte UDP packet of the probe's verify test.
+		{"udp echo", stages.OverheadEthernet,
+			bpf.Event{PacketsOrig: 1, BytesOrig: 31, PacketsRet: 1, BytesRet: 31}, 45, 45},
+		{"wire", stages.OverheadEthernetWire,
+			bpf.Event{PacketsOrig: 10, BytesOrig: 15000, PacketsRet: 5, BytesRet: 260}, 15380, 450},
+		{"no packets", stages.OverheadEthernet, bpf.Event{}, 0, 0},
+		{"no overhead", 0,
+			bpf.Event{PacketsOrig: 3, BytesOrig: 180, PacketsRet: 2, BytesRet: 120}, 180, 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out collector
+			stages.NewOverhead(tt.overhead).Process(tt.in, out.emit)
+			require.Len(t, out, 1)
+
+			e := out[0]
+			assert.Equal(t, tt.orig, e.BytesOrigAdjusted, "orig")
+			assert.Equal(t, tt.ret, e.BytesRetAdjusted, "ret")
+
+			// Raw counters are left untouched.
+			assert.Equal(t, tt.in.BytesOrig, e.BytesOrig)
+			assert.Equal(t, tt.in.BytesRet, e.BytesRet)
+		})
+	}
+}
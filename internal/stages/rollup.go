@@ -0,0 +1,123 @@
+package stages
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// rollupState is the pending event of a flow in a Rollup.
+type rollupState struct {
+	window time.Time // start of the window holding the event
+	event  bpf.Event // latest update event of the flow in the window
+}
+
+// Rollup is a stage coalescing the update events of each flow into a single
+// event per window. Windows are aligned to multiples of the window length
+// since the Unix epoch, eg. :00 and :30 for 30-second windows. The coalesced
+// event is the latest update of the flow in the window, carrying the flow's
+// latest totals. It is emitted when the window ends, or before the flow's
+// destroy event, which is always passed on immediately.
+type Rollup struct {
+	window time.Duration
+	table  *FlowStateTable
+
+	// Events of flows evicted from the table, emitted
+	// on the next call to Process or Flush.
+	evictMu sync.Mutex
+	evicted []bpf.Event
+}
+
+// NewRollup returns a Rollup coalescing updates into windows of the given
+// length. At most maxFlows flows are tracked, pending events of the least
+// recently updated flows are emitted early when the limit is reached.
+func NewRollup(window time.Duration, maxFlows int) *Rollup {
+
+	r := &Rollup{window: window}
+
+	// Entries are removed when their window ends, the TTL only
+	// covers flows that stop receiving events without a flush.
+	r.table = NewFlowStateTable(2*window, maxFlows, func(_, v interface{}, _ EvictReason) {
+		r.evictMu.Lock()
+		r.evicted = append(r.evicted, v.(rollupState).event)
+		r.evictMu.Unlock()
+	})
+
+	return r
+}
+
+// Name returns the name of the stage.
+func (r *Rollup) Name() string {
+	return "rollup"
+}
+
+// Process holds update events until the end of their window. Destroy events
+// are passed on, preceded by the flow's pending update event, if any.
+func (r *Rollup) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	defer r.emitEvicted(emit)
+
+	key := NewFlowKey(e)
+	t := eventTime(e)
+
+	if e.Type == bpf.EventDestroy {
+		if v, ok := r.table.Delete(key); ok {
+			emit(v.(rollupState).event)
+		}
+		emit(e)
+		return
+	}
+
+	win := t.Truncate(r.window)
+
+	if v, ok := r.table.Get(key, t); ok {
+		st := v.(rollupState)
+		if st.window.Equal(win) {
+			// Keep marking the flow as new if its first event was coalesced.
+			if st.event.Type == bpf.EventNew {
+				e.Type = bpf.EventNew
+			}
+		} else {
+			// The flow's previous window has ended.
+			emit(st.event)
+		}
+	}
+
+	r.table.Set(key, rollupState{window: win, event: e}, t)
+}
+
+// Flush emits the pending events of all windows that ended before now.
+func (r *Rollup) Flush(now time.Time, emit func(bpf.Event)) {
+
+	defer r.emitEvicted(emit)
+
+	var due []interface{}
+	r.table.Range(func(k, v interface{}) bool {
+		if !v.(rollupState).window.Add(r.window).After(now) {
+			due = append(due, k)
+		}
+		return true
+	})
+
+	for _, k := range due {
+		if v, ok := r.table.Delete(k); ok {
+			emit(v.(rollupState).event)
+		}
+	}
+
+	r.table.Expire(now)
+}
+
+// emitEvicted emits the pending events of evicted flows.
+func (r *Rollup) emitEvicted(emit func(bpf.Event)) {
+
+	r.evictMu.Lock()
+	ev := r.evicted
+	r.evicted = nil
+	r.evictMu.Unlock()
+
+	for _, e := range ev {
+		emit(e)
+	}
+}
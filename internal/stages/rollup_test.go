@@ -0,0 +1,159 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// collector records all events emitted by a stage.
+type collector []bpf.Event
+
+func (c *collector) emit(e bpf.Event) {
+	*c = append(*c, e)
+}
+
+// flowEvent returns an event of flow id at t, with the given byte total.
+func flowEvent(id uint32, typ bpf.EventType, t time.Time, bytes uint64) bpf.Event {
+	return bpf.Event{
+		ConnectionID: id,
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		Proto:        6,
+		Type:         typ,
+		Time:         t,
+		BytesOrig:    bytes,
+	}
+}
+
+func TestRollupCoalesce(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	r := stages.NewRollup(30*time.Second, 0)
+
+	// Two flows sending updates every 2 seconds within a single window.
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * 2 * time.Second)
+		r.Process(flowEvent(1, bpf.EventUpdate, ts, uint64(i*100)), out.emit)
+		r.Process(flowEvent(2, bpf.EventUpdate, ts, uint64(i*10)), out.emit)
+	}
+
+	assert.Empty(t, out, "no events emitted within the window")
+
+	// Flushing before the end of the window is a no-op.
+	r.Flush(start.Add(29*time.Second), out.emit)
+	assert.Empty(t, out)
+
+	// A single event per flow at the window boundary, carrying the latest totals.
+	r.Flush(start.Add(30*time.Second), out.emit)
+	require.Len(t, out, 2)
+
+	totals := map[uint32]uint64{}
+	for _, e := range out {
+		totals[e.ConnectionID] = e.BytesOrig
+	}
+	assert.Equal(t, map[uint32]uint64{1: 900, 2: 90}, totals)
+
+	// Flushed flows are no longer held.
+	out = nil
+	r.Flush(start.Add(time.Hour), out.emit)
+	assert.Empty(t, out)
+}
+
+func TestRollupBoundary(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	r := stages.NewRollup(30*time.Second, 0)
+
+	r.Process(flowEvent(1, bpf.EventUpdate, start.Add(10*time.Second), 1), out.emit)
+	r.Process(flowEvent(1, bpf.EventUpdate, start.Add(20*time.Second), 2), out.emit)
+	assert.Empty(t, out)
+
+	// An update in the next window emits the previous window's event,
+	// even if the stage was not yet flushed.
+	r.Process(flowEvent(1, bpf.EventUpdate, start.Add(31*time.Second), 3), out.emit)
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 2, out[0].BytesOrig)
+
+	r.Flush(start.Add(60*time.Second), out.emit)
+	require.Len(t, out, 2)
+	assert.EqualValues(t, 3, out[1].BytesOrig)
+}
+
+func TestRollupDestroy(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	r := stages.NewRollup(30*time.Second, 0)
+
+	r.Process(flowEvent(1, bpf.EventNew, start, 1), out.emit)
+	r.Process(flowEvent(1, bpf.EventUpdate, start.Add(time.Second), 2), out.emit)
+
+	// Destroy events flush the pending update and are passed on immediately.
+	r.Process(flowEvent(1, bpf.EventDestroy, start.Add(2*time.Second), 3), out.emit)
+	require.Len(t, out, 2)
+
+	// The coalesced event retains the New type of its first event.
+	assert.Equal(t, bpf.EventNew, out[0].Type)
+	assert.EqualValues(t, 2, out[0].BytesOrig)
+	assert.Equal(t, bpf.EventDestroy, out[1].Type)
+
+	// Destroy events of flows without pending updates are passed on as well.
+	r.Process(flowEvent(2, bpf.EventDestroy, start, 0), out.emit)
+	assert.Len(t, out, 3)
+
+	r.Flush(start.Add(time.Hour), out.emit)
+	assert.Len(t, out, 3)
+}
+
+func TestRollupMaxFlows(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	r := stages.NewRollup(30*time.Second, 2)
+
+	for i := uint32(1); i <= 3; i++ {
+		r.Process(flowEvent(i, bpf.EventUpdate, start, 0), out.emit)
+	}
+
+	// The least recently updated flow is emitted early.
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 1, out[0].ConnectionID)
+}
+
+func TestRollupOneWay(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	r := stages.NewRollup(30*time.Second, 0)
+
+	// A flow without reply traffic, eg. because of asymmetric routing.
+	for i := uint64(1); i <= 3; i++ {
+		e := flowEvent(1, bpf.EventUpdate, start.Add(time.Duration(i)*time.Second), 31*i)
+		e.PacketsOrig = i
+		r.Process(e, out.emit)
+	}
+
+	r.Flush(start.Add(30*time.Second), out.emit)
+	require.Len(t, out, 1, "one-way flow suppressed")
+	assert.EqualValues(t, 3, out[0].PacketsOrig)
+	assert.EqualValues(t, 93, out[0].BytesOrig)
+	assert.Zero(t, out[0].PacketsRet)
+
+	r.Process(flowEvent(1, bpf.EventDestroy, start.Add(40*time.Second), 93), out.emit)
+	require.Len(t, out, 2)
+	assert.Equal(t, bpf.EventDestroy, out[1].Type)
+}
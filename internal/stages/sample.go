@@ -0,0 +1,71 @@
+package stages
+
+import (
+	"sync/atomic"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Sample is a stage passing on the events of 1 in every N flows, dropping the
+// events of all others. Flows are selected by a hash of their tuple, so all
+// events of a sampled flow are kept, from its first event to its destroy
+// event, and the counters of sampled flows are exact. Counters are not scaled
+// by the sample rate.
+//
+// The hash is derived from the stage's seed, and doesn't include a flow's
+// network namespace. Identical seeds produce identical sampling decisions for
+// the same flow, across restarts and on every host, so the flows sampled by
+// hosts on both ends of a connection can be correlated. Different seeds
+// select different sets of flows.
+type Sample struct {
+	rate uint64
+	seed uint64
+
+	filtered uint64
+}
+
+// NewSample returns a Sample stage keeping 1 in every rate flows, selected
+// using the given seed. A rate of 0 or 1 keeps all flows.
+func NewSample(rate uint32, seed uint64) *Sample {
+	return &Sample{rate: uint64(rate), seed: seed}
+}
+
+// Name returns the name of the stage.
+func (s *Sample) Name() string {
+	return "sample"
+}
+
+// Process drops the event if its flow is not sampled.
+func (s *Sample) Process(e bpf.Event, emit func(bpf.Event)) {
+	if !s.Sampled(e) {
+		atomic.AddUint64(&s.filtered, 1)
+		return
+	}
+	emit(e)
+}
+
+// Sampled returns true if the event's flow is selected by the stage.
+func (s *Sample) Sampled(e bpf.Event) bool {
+
+	if s.rate <= 1 {
+		return true
+	}
+
+	return mix64(uint64(newFlowHash(e, s.seed, false)))%s.rate == 0
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (s *Sample) Filtered() uint64 {
+	return atomic.LoadUint64(&s.filtered)
+}
+
+// mix64 is the finalizer of SplitMix64, spreading the bits of an FNV hash
+// evenly so its remainder selects 1 in N flows independent of N.
+func mix64(h uint64) uint64 {
+	h ^= h >> 30
+	h *= 0xbf58476d1ce4e5b9
+	h ^= h >> 27
+	h *= 0x94d049bb133111eb
+	h ^= h >> 31
+	return h
+}
@@ -0,0 +1,105 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// sampleFlows returns an event of each of n flows with different source ports.
+func sampleFlows(n int) []bpf.Event {
+	evs := make([]bpf.Event, n)
+	for i := range evs {
+		evs[i] = bpf.Event{
+			ConnectionID: uint32(i),
+			SrcAddr:      net.IPv4(10, 0, 0, 1),
+			DstAddr:      net.IPv4(10, 0, 0, 2),
+			SrcPort:      uint16(1024 + i),
+			DstPort:      443,
+			Proto:        6,
+		}
+	}
+	return evs
+}
+
+// sampled returns the sampling decisions of s for evs.
+func sampled(s *stages.Sample, evs []bpf.Event) []bool {
+	out := make([]bool, len(evs))
+	for i, e := range evs {
+		out[i] = s.Sampled(e)
+	}
+	return out
+}
+
+func TestSampleSeed(t *testing.T) {
+
+	evs := sampleFlows(10000)
+
+	// Identical seeds produce identical decisions.
+	a := sampled(stages.NewSample(10, 42), evs)
+	assert.Equal(t, a, sampled(stages.NewSample(10, 42), evs))
+
+	// Different seeds select different flows.
+	b := sampled(stages.NewSample(10, 43), evs)
+	assert.NotEqual(t, a, b)
+
+	// Roughly 1 in 10 flows are sampled.
+	var n int
+	for _, s := range a {
+		if s {
+			n++
+		}
+	}
+	assert.InDelta(t, 1000, n, 150)
+
+	// Decisions don't depend on the flow's direction or namespace,
+	// so hosts on both ends of a connection sample the same flows.
+	s := stages.NewSample(10, 42)
+	for i, e := range evs {
+		r := e
+		r.SrcAddr, r.DstAddr = e.DstAddr, e.SrcAddr
+		r.SrcPort, r.DstPort = e.DstPort, e.SrcPort
+		r.NetNS = 4026531992
+		require.Equal(t, a[i], s.Sampled(r), "flow %d", i)
+	}
+}
+
+func TestSampleProcess(t *testing.T) {
+
+	evs := sampleFlows(100)
+
+	var out collector
+	s := stages.NewSample(4, 1)
+	for _, e := range evs {
+		s.Process(e, out.emit)
+	}
+
+	assert.NotEmpty(t, out)
+	assert.EqualValues(t, len(evs)-len(out), s.Filtered())
+	for _, e := range out {
+		assert.True(t, s.Sampled(e))
+	}
+
+	// A rate of 1 keeps all flows.
+	out = nil
+	s = stages.NewSample(1, 1)
+	for _, e := range evs {
+		s.Process(e, out.emit)
+	}
+	assert.Len(t, out, len(evs))
+	assert.Zero(t, s.Filtered())
+}
+
+func TestSeededFlowHash(t *testing.T) {
+
+	e := sampleFlows(1)[0]
+
+	assert.Equal(t, stages.NewFlowHash(e), stages.NewSeededFlowHash(e, 0))
+	assert.Equal(t, stages.NewSeededFlowHash(e, 7), stages.NewSeededFlowHash(e, 7))
+	assert.NotEqual(t, stages.NewSeededFlowHash(e, 7), stages.NewSeededFlowHash(e, 8))
+}
@@ -0,0 +1,229 @@
+package stages
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	// ServiceUnknown is the service of TCP and UDP events
+	// of which neither port has a known service.
+	ServiceUnknown = "unknown"
+)
+
+var errOtherProto = errors.New("protocol is not tcp or udp")
+
+// builtinServices maps well-known ports to their service names, for both
+// TCP and UDP. Names are shorter than or differ from their services(5)
+// names where the common name is clearer on a dashboard, eg. 53 is dns.
+var builtinServices = map[uint16]string{
+	20:    "ftp-data",
+	21:    "ftp",
+	22:    "ssh",
+	23:    "telnet",
+	25:    "smtp",
+	53:    "dns",
+	67:    "dhcp",
+	68:    "dhcp",
+	69:    "tftp",
+	80:    "http",
+	88:    "kerberos",
+	110:   "pop3",
+	123:   "ntp",
+	137:   "netbios-ns",
+	138:   "netbios-dgm",
+	139:   "netbios-ssn",
+	143:   "imap",
+	161:   "snmp",
+	162:   "snmp-trap",
+	179:   "bgp",
+	389:   "ldap",
+	443:   "https",
+	445:   "smb",
+	465:   "smtps",
+	514:   "syslog",
+	587:   "submission",
+	636:   "ldaps",
+	853:   "dns-tls",
+	873:   "rsync",
+	993:   "imaps",
+	995:   "pop3s",
+	1194:  "openvpn",
+	1433:  "mssql",
+	1812:  "radius",
+	2049:  "nfs",
+	3306:  "mysql",
+	3389:  "rdp",
+	5060:  "sip",
+	5432:  "postgresql",
+	5672:  "amqp",
+	6379:  "redis",
+	8080:  "http-alt",
+	8443:  "https-alt",
+	9092:  "kafka",
+	11211: "memcached",
+	27017: "mongodb",
+}
+
+// serviceKey is a port of a transport protocol.
+type serviceKey struct {
+	proto uint8
+	port  uint16
+}
+
+// Service is a stage labeling TCP and UDP events with the name of their
+// flow's service, based on the flow's ports. The destination port is looked
+// up first, since the original direction of a flow is usually from a client
+// to a service. The source port is looked up if the destination port is not
+// a known service. Events of other protocols don't get a service name.
+// Accounting data is left untouched.
+type Service struct {
+	names map[serviceKey]string
+}
+
+// NewService returns a Service stage. The builtin table of well-known ports
+// is extended with the services in the services(5) file at path, if not
+// empty. Names in the file replace builtin names of the same port. The keys
+// of overrides are a port, or a port and protocol like
+// '8080/tcp', and take precedence over any other names of the port.
+func NewService(path string, overrides map[string]string) (*Service, error) {
+
+	s := &Service{names: make(map[serviceKey]string)}
+
+	for port, name := range builtinServices {
+		s.set(port, 0, name)
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		if err := s.parseServices(f); err != nil {
+			return nil, fmt.Errorf("parsing %s: %s", path, err)
+		}
+	}
+
+	for k, name := range overrides {
+		port, proto, err := parsePortProto(k)
+		if err != nil {
+			return nil, fmt.Errorf("service override '%s': %s", k, err)
+		}
+		s.set(port, proto, name)
+	}
+
+	return s, nil
+}
+
+// Name returns the name of the stage.
+func (s *Service) Name() string {
+	return "service"
+}
+
+// Process sets the service name of the event.
+func (s *Service) Process(e bpf.Event, emit func(bpf.Event)) {
+	e.Service = s.lookup(e)
+	emit(e)
+}
+
+// lookup returns the service name of the event's flow.
+func (s *Service) lookup(e bpf.Event) string {
+
+	if e.Proto != protoTCP && e.Proto != protoUDP {
+		return ""
+	}
+
+	if name, ok := s.names[serviceKey{e.Proto, e.DstPort}]; ok {
+		return name
+	}
+	if name, ok := s.names[serviceKey{e.Proto, e.SrcPort}]; ok {
+		return name
+	}
+
+	return ServiceUnknown
+}
+
+// set names the port of the given protocol, or of both TCP and UDP if zero.
+func (s *Service) set(port uint16, proto uint8, name string) {
+	if proto == 0 {
+		s.names[serviceKey{protoTCP, port}] = name
+		s.names[serviceKey{protoUDP, port}] = name
+		return
+	}
+	s.names[serviceKey{proto, port}] = name
+}
+
+// parseServices reads TCP and UDP services from a services(5) file.
+// Each line holds a service name, a port/protocol pair and optional aliases,
+// comments start with a '#'.
+func (s *Service) parseServices(r io.Reader) error {
+
+	sc := bufio.NewScanner(r)
+
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if len(f) < 2 {
+			return fmt.Errorf("line %d: missing port", n)
+		}
+
+		// Skip protocols without ports in events, eg. sctp.
+		port, proto, err := parsePortProto(f[1])
+		if err == errOtherProto {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %s", n, err)
+		}
+
+		s.set(port, proto, f[0])
+	}
+
+	return sc.Err()
+}
+
+// parsePortProto parses a port optionally followed by a protocol, eg. '443'
+// or '443/tcp'. The protocol is zero if omitted. Returns errOtherProto if
+// the protocol is not TCP or UDP.
+func parsePortProto(s string) (uint16, uint8, error) {
+
+	ps, protos := s, ""
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		ps, protos = s[:i], s[i+1:]
+	}
+
+	port, err := strconv.ParseUint(ps, 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port '%s'", ps)
+	}
+
+	switch protos {
+	case "":
+		return uint16(port), 0, nil
+	case "tcp":
+		return uint16(port), protoTCP, nil
+	case "udp":
+		return uint16(port), protoUDP, nil
+	}
+
+	return 0, 0, errOtherProto
+}
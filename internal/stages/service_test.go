@@ -0,0 +1,109 @@
+package stages_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// service runs an event with the given protocol and
+// ports through the stage and returns its service.
+func service(t *testing.T, s *stages.Service, proto uint8, src, dst uint16) string {
+	t.Helper()
+
+	var out collector
+	s.Process(bpf.Event{Proto: proto, SrcPort: src, DstPort: dst, BytesOrig: 31}, out.emit)
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 31, out[0].BytesOrig, "accounting data changed")
+
+	return out[0].Service
+}
+
+func TestService(t *testing.T) {
+
+	s, err := stages.NewService("", map[string]string{
+		"8080":     "api",
+		"9000/tcp": "minio",
+		"53/udp":   "resolver",
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		proto    uint8
+		src, dst uint16
+		want     string
+	}{
+		{"known tcp", 6, 43210, 443, "https"},
+		{"known udp", 17, 43210, 123, "ntp"},
+		{"source port", 6, 22, 43210, "ssh"},
+		{"destination first", 6, 80, 443, "https"},
+		{"override", 6, 43210, 8080, "api"},
+		{"override tcp only", 6, 43210, 9000, "minio"},
+		{"override not udp", 17, 43210, 9000, stages.ServiceUnknown},
+		{"override udp only", 17, 43210, 53, "resolver"},
+		{"builtin tcp kept", 6, 43210, 53, "dns"},
+		{"unknown", 6, 43210, 43211, stages.ServiceUnknown},
+		{"no ports", 1, 0, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, service(t, s, tt.proto, tt.src, tt.dst))
+		})
+	}
+}
+
+func TestServiceFile(t *testing.T) {
+
+	f, err := ioutil.TempFile("", "services")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`# Network services, Internet style
+domain		53/tcp				# Domain Name Server
+domain		53/udp
+myservice	4242/tcp	mysvc	# local
+sctpsvc		4243/sctp
+
+`)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err := stages.NewService(f.Name(), map[string]string{"4242": "override"})
+	require.NoError(t, err)
+
+	// Names in the file replace builtin names, overrides replace both.
+	assert.Equal(t, "domain", service(t, s, 17, 43210, 53))
+	assert.Equal(t, "override", service(t, s, 6, 43210, 4242))
+	assert.Equal(t, stages.ServiceUnknown, service(t, s, 6, 43210, 4243))
+	assert.Equal(t, "https", service(t, s, 6, 43210, 443))
+}
+
+func TestServiceErrors(t *testing.T) {
+
+	_, err := stages.NewService("/nonexistent/services", nil)
+	assert.Error(t, err)
+
+	_, err = stages.NewService("", map[string]string{"http": "web"})
+	assert.EqualError(t, err, "service override 'http': invalid port 'http'")
+
+	_, err = stages.NewService("", map[string]string{"80/sctp": "web"})
+	assert.EqualError(t, err, "service override '80/sctp': protocol is not tcp or udp")
+
+	f, err := ioutil.TempFile("", "services")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("ok 1/tcp\nbroken\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = stages.NewService(f.Name(), nil)
+	assert.EqualError(t, err, "parsing "+f.Name()+": line 2: missing port")
+}
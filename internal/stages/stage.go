@@ -0,0 +1,44 @@
+// Package stages implements processing stages the pipeline runs events
+// through before pushing them to its sinks.
+package stages
+
+import (
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Stage processes events on their way to the pipeline's sinks. Process is
+// called for every update and destroy event, and calls emit for every event
+// (zero or more) to pass on to the next stage. Stages are called concurrently
+// from the pipeline's update and destroy workers and must be safe for
+// concurrent use.
+//
+// Stages must handle flows without reply traffic, of which PacketsRet and
+// BytesRet stay zero, eg. because of asymmetric routing. Those flows are not
+// idle and must not be suppressed, nor cause divisions by zero.
+type Stage interface {
+	Name() string
+	Process(e bpf.Event, emit func(bpf.Event))
+}
+
+// Flusher is a Stage holding on to events. Flush is called periodically by
+// the pipeline and emits all events that are due at now.
+type Flusher interface {
+	Flush(now time.Time, emit func(bpf.Event))
+}
+
+// Filter is a Stage dropping events. Filtered returns the amount
+// of events the stage dropped since it was created.
+type Filter interface {
+	Filtered() uint64
+}
+
+// eventTime returns the wall-clock time of the event, or now
+// if the event has not been timestamped.
+func eventTime(e bpf.Event) time.Time {
+	if e.Time.IsZero() {
+		return time.Now()
+	}
+	return e.Time
+}
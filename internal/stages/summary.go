@@ -0,0 +1,161 @@
+package stages
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// summaryState is the state of a flow seen by a Summary stage.
+type summaryState struct {
+	// Time of the flow's first event seen by the stage.
+	first time.Time
+	// The flow's latest event, emitted if the flow is evicted.
+	last bpf.Event
+}
+
+// Summary is a stage emitting a single record per flow, eg. for billing: the
+// destroy event of the flow, with its Duration set to the flow's age and its
+// AvgBytesPerSec to its total bytes in both directions over the Duration. All
+// new and update events are dropped. The event's totals are the flow's totals.
+//
+// The age of a flow is computed like by MinAge, from the destroy event's
+// Duration, the flow's Start, if conntrack timestamps are enabled, and the
+// time since the flow's first event seen by the stage.
+//
+// Flows that never send a destroy event, eg. because the destroy was lost,
+// are flushed after they were idle for longer than the stage's idle timeout,
+// and when the stage holds its maximum amount of flows. Their latest event is
+// emitted as their summary, with its type left unchanged, so flushed flows can
+// be told apart from destroyed flows. A flushed flow sending more events gets
+// another summary, covering its events after it was flushed.
+//
+// Events can arrive out of order, so a flow's destroy event can be processed
+// before its last update. A destroy event of a flow without state is
+// summarized from its own totals, Duration and Start, and the destroyed flow
+// is remembered for the stage's late window. Events of the flow that happened
+// before its destroy event and arrive within the window are dropped, instead
+// of being held as a new flow and flushed as a second summary.
+//
+// Place the stage after Coalesce and DestroyDedup, so a summary is emitted for
+// the merged destroy event of a flow.
+type Summary struct {
+	// Serializes reading and storing a flow's state, since events of the
+	// same flow can be processed by the update and destroy workers at once.
+	mu    sync.Mutex
+	table *FlowStateTable
+
+	destroyed *destroyedFlows
+
+	// Summaries of flows evicted from the table, emitted
+	// on the next call to Process or Flush.
+	evictMu sync.Mutex
+	evicted []bpf.Event
+
+	filtered uint64
+}
+
+// NewSummary returns a Summary stage flushing flows that were idle for idle,
+// holding the state of at most maxFlows flows. Zero means no limit. Destroyed
+// flows are remembered for late, a zero late window doesn't drop late events.
+func NewSummary(idle, late time.Duration, maxFlows int) *Summary {
+
+	s := &Summary{destroyed: newDestroyedFlows(late, maxFlows)}
+
+	s.table = NewFlowStateTable(idle, maxFlows, func(_, v interface{}, _ EvictReason) {
+		st := v.(summaryState)
+
+		s.evictMu.Lock()
+		s.evicted = append(s.evicted, summarize(st.last, st.first))
+		s.evictMu.Unlock()
+	})
+
+	return s
+}
+
+// Name returns the name of the stage.
+func (s *Summary) Name() string {
+	return "summary"
+}
+
+// Process emits the summary of the event's flow if the event is a destroy
+// event. Other events are held as the flow's latest event and dropped.
+func (s *Summary) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	defer s.emitEvicted(emit)
+
+	key := NewFlowKey(e)
+	now := eventTime(e)
+
+	s.mu.Lock()
+
+	if s.destroyed.late(e) {
+		s.mu.Unlock()
+
+		atomic.AddUint64(&s.filtered, 1)
+		return
+	}
+
+	st := summaryState{first: now}
+	if v, ok := s.table.Get(key, now); ok {
+		st = v.(summaryState)
+	}
+
+	if e.Type != bpf.EventDestroy {
+		st.last = e
+		s.table.Set(key, st, now)
+		s.mu.Unlock()
+
+		atomic.AddUint64(&s.filtered, 1)
+		return
+	}
+
+	s.table.Delete(key)
+	s.destroyed.add(e)
+	s.mu.Unlock()
+
+	emit(summarize(e, st.first))
+}
+
+// summarize returns e with its Duration set to the age of its flow, the
+// flow's first event seen at first, and its AvgBytesPerSec over the Duration.
+func summarize(e bpf.Event, first time.Time) bpf.Event {
+
+	e.Duration = flowAge(e, first, eventTime(e))
+
+	e.AvgBytesPerSec = 0
+	if e.Duration > 0 {
+		e.AvgBytesPerSec = float64(e.BytesOrig+e.BytesRet) / e.Duration.Seconds()
+	}
+
+	return e
+}
+
+// Flush emits the summaries of flows that were idle for longer than the
+// stage's idle timeout, and forgets flows destroyed longer than the stage's
+// late window ago.
+func (s *Summary) Flush(now time.Time, emit func(bpf.Event)) {
+	defer s.emitEvicted(emit)
+	s.table.Expire(now)
+	s.destroyed.expire(now)
+}
+
+// emitEvicted emits the summaries of evicted flows.
+func (s *Summary) emitEvicted(emit func(bpf.Event)) {
+
+	s.evictMu.Lock()
+	ev := s.evicted
+	s.evicted = nil
+	s.evictMu.Unlock()
+
+	for _, e := range ev {
+		emit(e)
+	}
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (s *Summary) Filtered() uint64 {
+	return atomic.LoadUint64(&s.filtered)
+}
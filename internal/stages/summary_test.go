@@ -0,0 +1,140 @@
+package stages_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestSummary(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	s := stages.NewSummary(0, 0, 0)
+
+	// A flow transferring 1000 bytes per second for 10 seconds, and a flow
+	// of which the kernel measured a duration of 4 seconds.
+	s.Process(flowEvent(1, bpf.EventNew, start, 0), out.emit)
+	s.Process(flowEvent(1, bpf.EventUpdate, start.Add(5*time.Second), 5000), out.emit)
+	s.Process(flowEvent(2, bpf.EventNew, start, 0), out.emit)
+	assert.Empty(t, out)
+
+	d := flowEvent(1, bpf.EventDestroy, start.Add(10*time.Second), 6000)
+	d.BytesRet = 4000
+	s.Process(d, out.emit)
+
+	d = flowEvent(2, bpf.EventDestroy, start.Add(2*time.Second), 1000)
+	d.Duration = 4 * time.Second
+	s.Process(d, out.emit)
+
+	require.Len(t, out, 2)
+
+	assert.EqualValues(t, 1, out[0].ConnectionID)
+	assert.Equal(t, bpf.EventDestroy, out[0].Type)
+	assert.Equal(t, 10*time.Second, out[0].Duration)
+	assert.EqualValues(t, 6000, out[0].BytesOrig)
+	assert.EqualValues(t, 4000, out[0].BytesRet)
+	assert.Equal(t, 1000.0, out[0].AvgBytesPerSec)
+
+	assert.EqualValues(t, 2, out[1].ConnectionID)
+	assert.Equal(t, 4*time.Second, out[1].Duration)
+	assert.Equal(t, 250.0, out[1].AvgBytesPerSec)
+
+	assert.EqualValues(t, 3, s.Filtered())
+}
+
+func TestSummaryKernelAge(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	s := stages.NewSummary(0, 0, 0)
+
+	// A destroy of a flow established before the stage saw it, with
+	// conntrack timestamps enabled.
+	d := flowEvent(1, bpf.EventDestroy, start, 8000)
+	d.Start = uint64(start.Add(-8 * time.Second).UnixNano())
+	s.Process(d, out.emit)
+
+	// And one of which the age is unknown.
+	s.Process(flowEvent(2, bpf.EventDestroy, start, 100), out.emit)
+
+	require.Len(t, out, 2)
+	assert.Equal(t, 8*time.Second, out[0].Duration)
+	assert.Equal(t, 1000.0, out[0].AvgBytesPerSec)
+	assert.Zero(t, out[1].Duration)
+	assert.Zero(t, out[1].AvgBytesPerSec)
+}
+
+func TestSummaryIdle(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	s := stages.NewSummary(time.Minute, 0, 0)
+
+	s.Process(flowEvent(1, bpf.EventNew, start, 0), out.emit)
+	s.Process(flowEvent(1, bpf.EventUpdate, start.Add(20*time.Second), 2000), out.emit)
+
+	s.Flush(start.Add(time.Minute), out.emit)
+	assert.Empty(t, out)
+
+	// A flow idle for longer than a minute is flushed with its latest event.
+	s.Flush(start.Add(2*time.Minute), out.emit)
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventUpdate, out[0].Type)
+	assert.Equal(t, 20*time.Second, out[0].Duration)
+	assert.Equal(t, 100.0, out[0].AvgBytesPerSec)
+
+	s.Flush(start.Add(3*time.Minute), out.emit)
+	assert.Len(t, out, 1)
+}
+
+func TestSummaryMaxFlows(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	s := stages.NewSummary(0, 0, 1)
+
+	s.Process(flowEvent(1, bpf.EventNew, start, 100), out.emit)
+	assert.Empty(t, out)
+
+	// The least recently seen flow is flushed to make room for another.
+	s.Process(flowEvent(2, bpf.EventNew, start.Add(time.Second), 100), out.emit)
+	require.Len(t, out, 1)
+	assert.EqualValues(t, 1, out[0].ConnectionID)
+	assert.Equal(t, bpf.EventNew, out[0].Type)
+}
+
+func TestSummaryLate(t *testing.T) {
+
+	var out collector
+	start := time.Unix(300, 0)
+
+	s := stages.NewSummary(time.Minute, time.Minute, 0)
+
+	// A destroy arriving before the flow's only update, without any prior
+	// state, is summarized from its own totals and duration.
+	d := flowEvent(1, bpf.EventDestroy, start.Add(20*time.Second), 4000)
+	d.Duration = 20 * time.Second
+	s.Process(d, out.emit)
+	s.Process(flowEvent(1, bpf.EventUpdate, start.Add(10*time.Second), 2000), out.emit)
+
+	require.Len(t, out, 1)
+	assert.Equal(t, bpf.EventDestroy, out[0].Type)
+	assert.Equal(t, 20*time.Second, out[0].Duration)
+	assert.Equal(t, 200.0, out[0].AvgBytesPerSec)
+
+	// The late update isn't held as a new flow, so no second summary is
+	// flushed once it would have been idle.
+	s.Flush(start.Add(5*time.Minute), out.emit)
+	assert.Len(t, out, 1)
+	assert.EqualValues(t, 1, s.Filtered())
+}
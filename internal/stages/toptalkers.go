@@ -0,0 +1,306 @@
+package stages
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Groupings of the traffic ranked by a TopTalkers stage.
+const (
+	// Every flow separately, by its tuple and ConnectionID.
+	TalkersByFlow = "flow"
+	// All flows of a source or destination address.
+	TalkersBySrc = "src"
+	TalkersByDst = "dst"
+	// All flows between a source and destination address.
+	TalkersByPair = "pair"
+)
+
+// Rankings of the talkers returned by TopTalkers.Top.
+const (
+	RankBytes   = "bytes"
+	RankPackets = "packets"
+)
+
+// Amount of slots the window of a TopTalkers stage is divided into.
+const talkerSlots = 10
+
+// talkerSlot is the traffic of a talker in a slot of the window.
+type talkerSlot struct {
+	start   time.Time
+	packets uint64
+	bytes   uint64
+}
+
+// talker is the traffic of a flow or group of flows in the recent slots.
+type talker struct {
+	key   FlowKey
+	slots [talkerSlots]talkerSlot
+	last  time.Time // time of the talker's latest event
+}
+
+// Talker is the traffic of a flow or group of flows within the window of a
+// TopTalkers stage, in both directions. Only the fields of the stage's
+// grouping are set.
+type Talker struct {
+	SrcAddr      net.IP `json:"src_addr,omitempty"`
+	DstAddr      net.IP `json:"dst_addr,omitempty"`
+	SrcPort      uint16 `json:"src_port,omitempty"`
+	DstPort      uint16 `json:"dst_port,omitempty"`
+	Proto        uint8  `json:"proto,omitempty"`
+	NetNS        uint32 `json:"netns,omitempty"`
+	ConnectionID uint32 `json:"connection_id,omitempty"`
+
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// TopTalkers is a stage ranking flows, or the flows of source and/or
+// destination addresses, by their traffic over a sliding window, for
+// answering who is using the most bandwidth without querying a sink's
+// backing storage, see Top. Events are passed on unmodified.
+//
+// The window is divided into ten slots, it slides by one slot at a time. The
+// traffic of a flow is the difference between the counters of its consecutive
+// events, see Delta, accounted to the slot of the later event's time. The
+// first event of a flow seen by the stage accounts for all of the flow's
+// traffic up to then. Traffic of events older than the window is discarded.
+//
+// At most maxTalkers talkers, and the counters of as many flows, are held.
+// When full, the talker or flow that was updated least recently is evicted.
+// Talkers without traffic for a window are removed by Flush.
+type TopTalkers struct {
+	window time.Duration
+	slot   time.Duration
+	n      int
+	group  string
+
+	mu      sync.Mutex
+	flows   *FlowStateTable // counters of each flow at its previous event
+	talkers *FlowStateTable
+}
+
+// NewTopTalkers returns a TopTalkers stage ranking the traffic of the given
+// grouping over window, returning the top n talkers by default. The grouping
+// is one of TalkersByFlow (default if empty), TalkersBySrc, TalkersByDst or
+// TalkersByPair. Zero maxTalkers means no limit.
+func NewTopTalkers(window time.Duration, n int, group string, maxTalkers int) (*TopTalkers, error) {
+
+	switch group {
+	case "":
+		group = TalkersByFlow
+	case TalkersByFlow, TalkersBySrc, TalkersByDst, TalkersByPair:
+	default:
+		return nil, fmt.Errorf("unknown top talkers grouping '%s', expected 'flow', 'src', 'dst' or 'pair'", group)
+	}
+
+	slot := window / talkerSlots
+	if slot <= 0 {
+		slot = 1
+	}
+
+	return &TopTalkers{
+		window:  slot * talkerSlots,
+		slot:    slot,
+		n:       n,
+		group:   group,
+		flows:   NewFlowStateTable(0, maxTalkers, nil),
+		talkers: NewFlowStateTable(slot*talkerSlots, maxTalkers, nil),
+	}, nil
+}
+
+// Name returns the name of the stage.
+func (tt *TopTalkers) Name() string {
+	return "top_talkers"
+}
+
+// Window returns the length of the stage's sliding window.
+func (tt *TopTalkers) Window() time.Duration {
+	return tt.window
+}
+
+// Group returns the stage's grouping of flows.
+func (tt *TopTalkers) Group() string {
+	return tt.group
+}
+
+// Process adds the traffic of the event's flow since its previous event
+// to the event's talker, and passes on the event.
+func (tt *TopTalkers) Process(e bpf.Event, emit func(bpf.Event)) {
+
+	key := NewFlowKey(e)
+	t := eventTime(e)
+	cur := e.Counters()
+
+	tt.mu.Lock()
+
+	var prev bpf.Counters
+	if v, ok := tt.flows.Get(key, t); ok {
+		prev = v.(bpf.Counters)
+	}
+	if e.Type == bpf.EventDestroy {
+		tt.flows.Delete(key)
+	} else {
+		tt.flows.Set(key, cur, t)
+	}
+
+	d := delta(cur, prev)
+	packets, bytes := d.PacketsOrig+d.PacketsRet, d.BytesOrig+d.BytesRet
+
+	if packets != 0 || bytes != 0 {
+		tk := tt.groupKey(key)
+
+		var tl *talker
+		if v, ok := tt.talkers.Get(tk, t); ok {
+			tl = v.(*talker)
+		} else {
+			tl = &talker{key: tk}
+			tt.talkers.Set(tk, tl, t)
+		}
+
+		// Late events don't set back the time the talker was last used.
+		if t.After(tl.last) {
+			tl.last = t
+		} else {
+			tt.talkers.Set(tk, tl, tl.last)
+		}
+
+		tt.add(tl, t, packets, bytes)
+	}
+
+	tt.mu.Unlock()
+
+	emit(e)
+}
+
+// groupKey returns the key of the talker of a flow, holding only the fields
+// of the flow's key the stage groups by.
+func (tt *TopTalkers) groupKey(k FlowKey) FlowKey {
+	switch tt.group {
+	case TalkersBySrc:
+		return FlowKey{SrcAddr: k.SrcAddr}
+	case TalkersByDst:
+		return FlowKey{DstAddr: k.DstAddr}
+	case TalkersByPair:
+		return FlowKey{SrcAddr: k.SrcAddr, DstAddr: k.DstAddr}
+	}
+	return k
+}
+
+// add accounts traffic at time t to the slot of a talker.
+func (tt *TopTalkers) add(tl *talker, t time.Time, packets, bytes uint64) {
+
+	start := t.Truncate(tt.slot)
+	s := &tl.slots[(start.UnixNano()/int64(tt.slot))%talkerSlots]
+
+	switch {
+	case start.After(s.start):
+		*s = talkerSlot{start: start}
+	case start.Before(s.start):
+		// The slot was reused by a later slot, so t is out of the window.
+		return
+	}
+
+	s.packets += packets
+	s.bytes += bytes
+}
+
+// Flush removes talkers without traffic for a window. Emits no events.
+func (tt *TopTalkers) Flush(now time.Time, _ func(bpf.Event)) {
+	tt.mu.Lock()
+	tt.talkers.Expire(now)
+	tt.mu.Unlock()
+}
+
+// Len returns the amount of talkers held by the stage.
+func (tt *TopTalkers) Len() int {
+	return tt.talkers.Len()
+}
+
+// Top returns the n talkers with the most traffic in the window ending at
+// now, ranked by RankBytes or RankPackets, from highest to lowest. Talkers
+// ranking equally are ordered by the other counter. If n is zero, the stage's
+// default amount is returned, all talkers if that is zero too.
+func (tt *TopTalkers) Top(n int, by string, now time.Time) ([]Talker, error) {
+
+	if by != RankBytes && by != RankPackets {
+		return nil, fmt.Errorf("unknown ranking '%s', expected 'bytes' or 'packets'", by)
+	}
+	if n == 0 {
+		n = tt.n
+	}
+
+	// Slots starting within the window, the current slot being the last.
+	cur := now.Truncate(tt.slot)
+
+	// Empty rather than nil, so no talkers marshal into an empty list.
+	out := []Talker{}
+
+	tt.mu.Lock()
+	tt.talkers.Range(func(_, v interface{}) bool {
+		tl := v.(*talker)
+
+		var packets, bytes uint64
+		for _, s := range tl.slots {
+			if age := cur.Sub(s.start); age >= 0 && age < tt.window {
+				packets += s.packets
+				bytes += s.bytes
+			}
+		}
+
+		if packets != 0 || bytes != 0 {
+			out = append(out, tl.toTalker(packets, bytes))
+		}
+		return true
+	})
+	tt.mu.Unlock()
+
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if by == RankPackets {
+			if a.Packets != b.Packets {
+				return a.Packets > b.Packets
+			}
+			return a.Bytes > b.Bytes
+		}
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Packets > b.Packets
+	})
+
+	if n > 0 && len(out) > n {
+		out = out[:n]
+	}
+
+	return out, nil
+}
+
+// toTalker returns the Talker of tl with the given traffic.
+func (tl *talker) toTalker(packets, bytes uint64) Talker {
+	k := tl.key
+	return Talker{
+		SrcAddr:      keyAddr(k.SrcAddr),
+		DstAddr:      keyAddr(k.DstAddr),
+		SrcPort:      k.SrcPort,
+		DstPort:      k.DstPort,
+		Proto:        k.Proto,
+		NetNS:        k.NetNS,
+		ConnectionID: k.ConnectionID,
+		Packets:      packets,
+		Bytes:        bytes,
+	}
+}
+
+// keyAddr returns the address held by a FlowKey, nil if unset.
+func keyAddr(a [16]byte) net.IP {
+	if a == ([16]byte{}) {
+		return nil
+	}
+	return net.IP(append([]byte(nil), a[:]...))
+}
@@ -0,0 +1,183 @@
+package stages_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestTopTalkers(t *testing.T) {
+
+	var out collector
+	start := time.Unix(600, 0)
+
+	tt, err := stages.NewTopTalkers(time.Minute, 2, "", 0)
+	require.NoError(t, err)
+
+	// Flow 1 sends 300 bytes in total, flow 2 500 and flow 3 200.
+	tt.Process(flowEvent(1, bpf.EventNew, start, 100), out.emit)
+	tt.Process(flowEvent(2, bpf.EventNew, start, 500), out.emit)
+	tt.Process(flowEvent(3, bpf.EventUpdate, start.Add(time.Second), 200), out.emit)
+	tt.Process(flowEvent(1, bpf.EventDestroy, start.Add(2*time.Second), 300), out.emit)
+	assert.Len(t, out, 4, "events are passed on")
+
+	top, err := tt.Top(0, stages.RankBytes, start.Add(3*time.Second))
+	require.NoError(t, err)
+	require.Len(t, top, 2, "default amount of talkers")
+	assert.EqualValues(t, 2, top[0].ConnectionID)
+	assert.EqualValues(t, 500, top[0].Bytes)
+	assert.EqualValues(t, 1, top[1].ConnectionID)
+	assert.EqualValues(t, 300, top[1].Bytes)
+	assert.True(t, top[0].SrcAddr.Equal(net.IPv4(10, 0, 0, 1)))
+	assert.EqualValues(t, 6, top[0].Proto)
+
+	top, err = tt.Top(10, stages.RankBytes, start.Add(3*time.Second))
+	require.NoError(t, err)
+	assert.Len(t, top, 3)
+
+	_, err = tt.Top(0, "flows", start)
+	assert.Error(t, err)
+}
+
+func TestTopTalkersPackets(t *testing.T) {
+
+	var out collector
+	start := time.Unix(600, 0)
+
+	tt, err := stages.NewTopTalkers(time.Minute, 0, stages.TalkersByFlow, 0)
+	require.NoError(t, err)
+
+	// Flow 1 has fewer but larger packets.
+	a := flowEvent(1, bpf.EventUpdate, start, 3000)
+	a.PacketsOrig = 2
+	b := flowEvent(2, bpf.EventUpdate, start, 1000)
+	b.PacketsOrig = 10
+	c := flowEvent(3, bpf.EventUpdate, start, 500)
+	c.PacketsOrig = 10
+
+	for _, e := range []bpf.Event{a, b, c} {
+		tt.Process(e, out.emit)
+	}
+
+	top, err := tt.Top(0, stages.RankPackets, start)
+	require.NoError(t, err)
+	require.Len(t, top, 3)
+
+	// Equal packets are ranked by bytes.
+	assert.EqualValues(t, 2, top[0].ConnectionID)
+	assert.EqualValues(t, 3, top[1].ConnectionID)
+	assert.EqualValues(t, 1, top[2].ConnectionID)
+	assert.EqualValues(t, 10, top[0].Packets)
+
+	top, err = tt.Top(1, stages.RankBytes, start)
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	assert.EqualValues(t, 1, top[0].ConnectionID)
+}
+
+func TestTopTalkersWindow(t *testing.T) {
+
+	var out collector
+	start := time.Unix(600, 0)
+
+	// Slots of a second.
+	tt, err := stages.NewTopTalkers(10*time.Second, 0, "", 0)
+	require.NoError(t, err)
+	assert.Equal(t, 10*time.Second, tt.Window())
+
+	// Flow 1 was busy at the start, flow 2 later on.
+	tt.Process(flowEvent(1, bpf.EventUpdate, start, 1000), out.emit)
+	tt.Process(flowEvent(1, bpf.EventUpdate, start.Add(5*time.Second), 1100), out.emit)
+	tt.Process(flowEvent(2, bpf.EventUpdate, start.Add(5*time.Second), 500), out.emit)
+	tt.Process(flowEvent(2, bpf.EventUpdate, start.Add(9*time.Second), 900), out.emit)
+
+	top, err := tt.Top(0, stages.RankBytes, start.Add(9*time.Second))
+	require.NoError(t, err)
+	require.Len(t, top, 2)
+	assert.EqualValues(t, 1, top[0].ConnectionID)
+	assert.EqualValues(t, 1100, top[0].Bytes)
+
+	// Once the bytes of flow 1's first event leave the window,
+	// flow 2 ranks above it, counting only its traffic since.
+	top, err = tt.Top(0, stages.RankBytes, start.Add(10*time.Second))
+	require.NoError(t, err)
+	require.Len(t, top, 2)
+	assert.EqualValues(t, 2, top[0].ConnectionID)
+	assert.EqualValues(t, 900, top[0].Bytes)
+	assert.EqualValues(t, 100, top[1].Bytes)
+
+	// Traffic of a slot that was reused is discarded.
+	tt.Process(flowEvent(2, bpf.EventUpdate, start.Add(16*time.Second), 1000), out.emit)
+	tt.Process(flowEvent(2, bpf.EventUpdate, start.Add(6*time.Second), 1200), out.emit)
+	top, err = tt.Top(0, stages.RankBytes, start.Add(16*time.Second))
+	require.NoError(t, err)
+	require.Len(t, top, 1)
+	assert.EqualValues(t, 500, top[0].Bytes)
+
+	// Talkers without traffic for a window are removed.
+	assert.Equal(t, 2, tt.Len())
+	tt.Flush(start.Add(20*time.Second), out.emit)
+	assert.Equal(t, 1, tt.Len())
+}
+
+func TestTopTalkersGroup(t *testing.T) {
+
+	start := time.Unix(600, 0)
+
+	// Two flows from 10.0.0.1 and one from 10.0.0.3, all to 10.0.0.2.
+	a := flowEvent(1, bpf.EventUpdate, start, 100)
+	b := flowEvent(2, bpf.EventUpdate, start, 200)
+	c := flowEvent(3, bpf.EventUpdate, start, 250)
+	c.SrcAddr = net.IPv4(10, 0, 0, 3)
+
+	tests := []struct {
+		group string
+		bytes []uint64
+	}{
+		{stages.TalkersByFlow, []uint64{250, 200, 100}},
+		{stages.TalkersBySrc, []uint64{300, 250}},
+		{stages.TalkersByDst, []uint64{550}},
+		{stages.TalkersByPair, []uint64{300, 250}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.group, func(t *testing.T) {
+			var out collector
+
+			tt, err := stages.NewTopTalkers(time.Minute, 0, tc.group, 0)
+			require.NoError(t, err)
+
+			for _, e := range []bpf.Event{a, b, c} {
+				tt.Process(e, out.emit)
+			}
+
+			top, err := tt.Top(0, stages.RankBytes, start)
+			require.NoError(t, err)
+
+			var bytes []uint64
+			for _, tl := range top {
+				bytes = append(bytes, tl.Bytes)
+			}
+			assert.Equal(t, tc.bytes, bytes)
+
+			switch tc.group {
+			case stages.TalkersBySrc:
+				assert.True(t, top[0].SrcAddr.Equal(net.IPv4(10, 0, 0, 1)))
+				assert.Nil(t, top[0].DstAddr)
+				assert.Zero(t, top[0].ConnectionID)
+			case stages.TalkersByDst:
+				assert.Nil(t, top[0].SrcAddr)
+				assert.True(t, top[0].DstAddr.Equal(net.IPv4(10, 0, 0, 2)))
+			}
+		})
+	}
+
+	_, err := stages.NewTopTalkers(time.Minute, 0, "port", 0)
+	assert.Error(t, err)
+}
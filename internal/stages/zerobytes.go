@@ -0,0 +1,40 @@
+package stages
+
+import (
+	"sync/atomic"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// ZeroBytes is a stage dropping events of which both byte counters are
+// zero, like events of conntrack entries without accounting data. Every
+// accounted packet has a non-zero length, so flows are never dropped once
+// their first packet is accounted, eg. the 31-byte first packet of a UDP
+// flow. Events with zero bytes in only one direction are kept, see Stage.
+type ZeroBytes struct {
+	filtered uint64
+}
+
+// NewZeroBytes returns a ZeroBytes stage.
+func NewZeroBytes() *ZeroBytes {
+	return &ZeroBytes{}
+}
+
+// Name returns the name of the stage.
+func (z *ZeroBytes) Name() string {
+	return "zero_bytes"
+}
+
+// Process drops the event if it has zero bytes in both directions.
+func (z *ZeroBytes) Process(e bpf.Event, emit func(bpf.Event)) {
+	if e.BytesOrig == 0 && e.BytesRet == 0 {
+		atomic.AddUint64(&z.filtered, 1)
+		return
+	}
+	emit(e)
+}
+
+// Filtered returns the amount of events dropped by the stage.
+func (z *ZeroBytes) Filtered() uint64 {
+	return atomic.LoadUint64(&z.filtered)
+}
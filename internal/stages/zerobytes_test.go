@@ -0,0 +1,49 @@
+package stages_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ti-mo/conntracct/internal/stages"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+func TestZeroBytes(t *testing.T) {
+
+	tests := []struct {
+		name string
+		in   bpf.Event
+		keep bool
+	}{
+		{"zero", bpf.Event{}, false},
+		{"zero packets counted", bpf.Event{PacketsOrig: 1}, false},
+		{"zero destroy", bpf.Event{Type: bpf.EventDestroy}, false},
+		// The first packet of the probe's verify test.
+		{"first packet", bpf.Event{Type: bpf.EventNew, PacketsOrig: 1, BytesOrig: 31}, true},
+		{"reply only", bpf.Event{PacketsRet: 1, BytesRet: 60}, true},
+		{"both", bpf.Event{BytesOrig: 31, BytesRet: 31}, true},
+	}
+
+	z := stages.NewZeroBytes()
+	var dropped uint64
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out collector
+			z.Process(tt.in, out.emit)
+
+			if !tt.keep {
+				dropped++
+				assert.Empty(t, out)
+				return
+			}
+
+			if assert.Len(t, out, 1) {
+				assert.Equal(t, tt.in, out[0])
+			}
+		})
+	}
+
+	assert.Equal(t, dropped, z.Filtered())
+}
@@ -85,6 +85,12 @@ func Generate() error {
 	return nil
 }
 
+// Bench runs the probe's benchmarks, like the throughput and latency of
+// decoding and fanning out events in BenchmarkProbePerfWorker.
+func Bench() error {
+	return sh.RunV("go", "test", "-run", "^$", "-bench", ".", "-benchmem", "./pkg/bpf/")
+}
+
 // Lint runs golangci-lint with the project's configuration.
 func Lint() error {
 	return sh.RunV("golangci-lint", "run")
@@ -0,0 +1,50 @@
+package bpf
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// lockAffinity locks the calling goroutine to its OS thread and binds the
+// thread to the given CPUs. The goroutine keeps the thread to itself until
+// it exits, after which the runtime discards the thread, so the affinity
+// never leaks to other goroutines. The goroutine is unlocked on failure.
+func lockAffinity(cpus []uint) error {
+
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(int(cpu))
+	}
+
+	runtime.LockOSThread()
+
+	if err := unix.SchedSetaffinity(0, &set); err != nil {
+		runtime.UnlockOSThread()
+		return errors.Wrapf(err, "binding reader to CPUs %v", cpus)
+	}
+
+	return nil
+}
+
+// checkReaderCPUs returns an error if any of the CPUs is not online.
+func checkReaderCPUs(cpus, online []uint) error {
+
+	for _, cpu := range cpus {
+		var ok bool
+		for _, o := range online {
+			if cpu == o {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf(errFmtReaderCPU, cpu)
+		}
+	}
+
+	return nil
+}
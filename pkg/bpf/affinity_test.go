@@ -0,0 +1,64 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// allowedCPU returns a CPU the test process is allowed to run on.
+func allowedCPU(t *testing.T) uint {
+	t.Helper()
+
+	var set unix.CPUSet
+	require.NoError(t, unix.SchedGetaffinity(0, &set))
+
+	for cpu := 0; ; cpu++ {
+		if set.IsSet(cpu) {
+			return uint(cpu)
+		}
+	}
+}
+
+func TestCheckReaderCPUs(t *testing.T) {
+	assert.NoError(t, checkReaderCPUs(nil, []uint{0, 1}))
+	assert.NoError(t, checkReaderCPUs([]uint{1}, []uint{0, 1}))
+	assert.EqualError(t, checkReaderCPUs([]uint{0, 2}, []uint{0, 1}), "reader CPU 2 is not online")
+}
+
+func TestProbePerfWorkerAffinity(t *testing.T) {
+
+	cpu := allowedCPU(t)
+
+	ap := &Probe{
+		perfUpdateChan:  make(chan []byte, 1),
+		perfDestroyChan: make(chan []byte, 1),
+		readerCPUs:      []uint{cpu},
+		stats:           &ProbeStats{},
+	}
+
+	// The consumer's filter runs on the worker's goroutine.
+	sets := make(chan unix.CPUSet, 1)
+	c := NewConsumer("affinity", make(chan Event, 1), ConsumerAll)
+	c.SetFilter(func(Event) bool {
+		var set unix.CPUSet
+		if err := unix.SchedGetaffinity(0, &set); err == nil {
+			sets <- set
+		}
+		return true
+	})
+	require.NoError(t, ap.RegisterConsumer(c))
+
+	ap.workers.Add(1)
+	go ap.perfWorker()
+
+	ap.perfUpdateChan <- make([]byte, EventLength)
+	set := <-sets
+	assert.Equal(t, 1, set.Count())
+	assert.True(t, set.IsSet(int(cpu)), "worker not bound to CPU %d", cpu)
+
+	close(ap.perfUpdateChan)
+	ap.workers.Wait()
+}
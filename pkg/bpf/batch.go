@@ -0,0 +1,119 @@
+package bpf
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher accumulates the events of a batch Consumer, and sends them to the
+// consumer's batch channel when the batch is full or its window has passed.
+type batcher struct {
+	size   int
+	window time.Duration
+
+	mu      sync.Mutex
+	out     chan []Event
+	stats   *ConsumerStats
+	pending []Event
+	timer   *time.Timer
+	closed  bool
+}
+
+// NewBatchConsumer returns a new Consumer receiving events in batches on the
+// given channel, instead of one at a time. A batch is sent when it holds size
+// events, or when window has passed since its first event was received,
+// whichever comes first. A zero window only sends full batches.
+//
+// Like events sent to a single-event Consumer, batches are sent without
+// blocking. All events of a batch are counted as lost if the channel is full.
+// The receiver owns the batches sent on the channel.
+func NewBatchConsumer(name string, batches chan []Event, mode ConsumerMode, size int, window time.Duration) *Consumer {
+
+	if size < 1 {
+		size = 1
+	}
+
+	ac := NewConsumer(name, nil, mode)
+	ac.batch = &batcher{
+		size:   size,
+		window: window,
+		out:    batches,
+		stats:  ac.stats,
+	}
+
+	return ac
+}
+
+// add adds an event to the current batch, sending the batch if it is full.
+// Starts the batch's window timer on its first event.
+func (b *batcher) add(e Event) {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	if b.pending == nil {
+		b.pending = make([]Event, 0, b.size)
+		if b.window > 0 {
+			b.timer = time.AfterFunc(b.window, b.expire)
+		}
+	}
+
+	b.pending = append(b.pending, e)
+
+	if len(b.pending) == b.size {
+		b.send()
+	}
+}
+
+// expire sends the current batch when its window has passed.
+func (b *batcher) expire() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// The batch may have been sent while the timer fired.
+	if b.closed || b.pending == nil {
+		return
+	}
+
+	b.send()
+}
+
+// send sends the current batch to the consumer's batch channel without
+// blocking, and starts a new batch. Must be called with mu held.
+func (b *batcher) send() {
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+
+	batch := b.pending
+	b.pending = nil
+
+	select {
+	case b.out <- batch:
+		b.stats.setQueueLength(len(b.out))
+		b.stats.addEventsReceived(len(batch))
+	default:
+		b.stats.addEventsLost(len(batch))
+	}
+}
+
+// close sends the current batch, if any, and closes the batch channel.
+func (b *batcher) close() {
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.pending != nil {
+		b.send()
+	}
+
+	b.closed = true
+	close(b.out)
+}
@@ -0,0 +1,118 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readBatch reads a batch from c, failing the test after timeout.
+func readBatch(t *testing.T, c *Consumer, timeout time.Duration) []Event {
+	t.Helper()
+
+	select {
+	case b, ok := <-c.Batches():
+		require.True(t, ok, "batch channel closed")
+		return b
+	case <-time.After(timeout):
+		t.Fatal("timeout waiting for batch")
+	}
+
+	return nil
+}
+
+func TestBatchConsumerSize(t *testing.T) {
+
+	ap := &Probe{}
+
+	// The window is long enough to never expire during the test.
+	c := NewBatchConsumer("batch", make(chan []Event, 4), ConsumerAll, 10, time.Hour)
+	require.NoError(t, ap.RegisterConsumer(c))
+	assert.Nil(t, c.Events())
+
+	for i := uint32(0); i < 25; i++ {
+		ap.fanoutEvent(Event{ConnectionID: i, Type: EventUpdate})
+	}
+
+	// Full batches are sent right away, in order.
+	for i := 0; i < 2; i++ {
+		b := readBatch(t, c, 10*time.Millisecond)
+		require.Len(t, b, 10)
+		assert.EqualValues(t, i*10, b[0].ConnectionID)
+		assert.EqualValues(t, i*10+9, b[9].ConnectionID)
+	}
+
+	select {
+	case b := <-c.Batches():
+		t.Fatalf("unexpected batch of %d events", len(b))
+	default:
+	}
+
+	// Closing the consumer sends the pending batch.
+	require.NoError(t, ap.RemoveConsumer(c))
+	c.Close()
+	assert.Len(t, readBatch(t, c, 10*time.Millisecond), 5)
+	_, ok := <-c.Batches()
+	assert.False(t, ok, "batch channel not closed")
+
+	st := c.Stats().Get()
+	assert.EqualValues(t, 25, st.EventsReceived)
+	assert.Zero(t, st.EventsLost)
+}
+
+func TestBatchConsumerWindow(t *testing.T) {
+
+	const window = 50 * time.Millisecond
+
+	ap := &Probe{}
+
+	c := NewBatchConsumer("batch", make(chan []Event, 1), ConsumerAll, 100, window)
+	require.NoError(t, ap.RegisterConsumer(c))
+	defer c.Close()
+
+	// A partial batch is sent when its window has passed.
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ap.fanoutEvent(Event{Type: EventUpdate})
+	}
+
+	b := readBatch(t, c, time.Second)
+	assert.Len(t, b, 3)
+	assert.True(t, time.Since(start) >= window, "batch sent before its window passed")
+
+	// Batches are dropped when the channel is full.
+	ap.fanoutEvent(Event{Type: EventUpdate})
+	ap.fanoutEvent(Event{Type: EventUpdate})
+	time.Sleep(2 * window)
+	ap.fanoutEvent(Event{Type: EventUpdate})
+	time.Sleep(2 * window)
+
+	assert.Len(t, readBatch(t, c, time.Second), 2)
+	assert.EqualValues(t, 1, c.Stats().Get().EventsLost)
+}
+
+func TestBatchConsumerNoWindow(t *testing.T) {
+
+	ap := &Probe{}
+
+	// Without a window, only full batches are sent.
+	c := NewBatchConsumer("batch", make(chan []Event, 1), ConsumerDestroy, 2, 0)
+	require.NoError(t, ap.RegisterConsumer(c))
+
+	ap.fanoutEvent(Event{Type: EventUpdate})
+	ap.fanoutEvent(Event{Type: EventDestroy})
+	time.Sleep(20 * time.Millisecond)
+
+	select {
+	case <-c.Batches():
+		t.Fatal("partial batch sent")
+	default:
+	}
+
+	ap.fanoutEvent(Event{Type: EventDestroy})
+	assert.Len(t, readBatch(t, c, 10*time.Millisecond), 2)
+
+	c.Close()
+}
@@ -0,0 +1,47 @@
+package bpf
+
+// RegisterCallbackConsumer registers a Consumer calling fn for every event
+// of the Probe, instead of sending events to a channel read by the caller.
+// Events are buffered like the events of a channel Consumer, up to
+// EventsBufferSize of them, and fn is called for one event at a time on a
+// goroutine owned by the Consumer.
+//
+// fn must not block. The Probe never waits for a Consumer, so events arriving
+// while fn is slow to return fill up the buffer and are then dropped and
+// counted as lost in the Consumer's stats, the same as events sent to a full
+// channel. The returned Consumer is used to read its stats and to unregister
+// it. After removing it from the Probe, Close stops the goroutine once fn was
+// called for the events still buffered.
+func (ap *Probe) RegisterCallbackConsumer(name string, fn func(Event)) (*Consumer, error) {
+
+	if fn == nil {
+		return nil, errCallbackNil
+	}
+
+	events := make(chan Event, EventsBufferSize)
+	ac := NewConsumer(name, events, ConsumerAll)
+
+	if err := ap.RegisterConsumer(ac); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for e := range events {
+			fn(e)
+		}
+	}()
+
+	return ac, nil
+}
+
+// RegisterCallbackConsumer registers a Consumer calling fn for every event
+// of the FakeProbe. See Probe.RegisterCallbackConsumer.
+func (fp *FakeProbe) RegisterCallbackConsumer(name string, fn func(Event)) (*Consumer, error) {
+	return fp.probe.RegisterCallbackConsumer(name, fn)
+}
+
+// RegisterCallbackConsumer registers a Consumer calling fn for every event
+// of the NetlinkProbe. See Probe.RegisterCallbackConsumer.
+func (np *NetlinkProbe) RegisterCallbackConsumer(name string, fn func(Event)) (*Consumer, error) {
+	return np.probe.RegisterCallbackConsumer(name, fn)
+}
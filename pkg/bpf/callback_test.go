@@ -0,0 +1,82 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCallbackConsumer(t *testing.T) {
+
+	ap := &Probe{}
+
+	_, err := ap.RegisterCallbackConsumer("nil", nil)
+	assert.Error(t, err, "nil callback")
+
+	got := make(chan Event, 16)
+	c, err := ap.RegisterCallbackConsumer("callback", func(e Event) { got <- e })
+	require.NoError(t, err)
+
+	_, err = ap.RegisterCallbackConsumer("callback", func(Event) {})
+	assert.Error(t, err, "duplicate name")
+
+	for i := uint32(0); i < 10; i++ {
+		ap.fanoutEvent(Event{ConnectionID: i, Type: EventUpdate})
+	}
+
+	// The callback is called for every event, in order.
+	for i := uint32(0); i < 10; i++ {
+		select {
+		case e := <-got:
+			assert.Equal(t, i, e.ConnectionID)
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for callback")
+		}
+	}
+
+	require.NoError(t, ap.RemoveConsumer(c))
+	c.Close()
+
+	st := c.Stats().Get()
+	assert.EqualValues(t, 10, st.EventsReceived)
+	assert.Zero(t, st.EventsLost)
+}
+
+func TestCallbackConsumerSlow(t *testing.T) {
+
+	ap := &Probe{}
+
+	// The callback blocks on the first event until the end of the test.
+	called := make(chan struct{})
+	unblock := make(chan struct{})
+	c, err := ap.RegisterCallbackConsumer("slow", func(Event) {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-unblock
+	})
+	require.NoError(t, err)
+	defer close(unblock)
+
+	ap.fanoutEvent(Event{Type: EventUpdate})
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for callback")
+	}
+
+	// Fill the buffer while the callback is blocked, the overflow is lost.
+	for i := 0; i < EventsBufferSize+10; i++ {
+		ap.fanoutEvent(Event{Type: EventUpdate})
+	}
+
+	st := c.Stats().Get()
+	assert.EqualValues(t, EventsBufferSize+1, st.EventsReceived)
+	assert.EqualValues(t, 10, st.EventsLost)
+
+	require.NoError(t, ap.RemoveConsumer(c))
+	c.Close()
+}
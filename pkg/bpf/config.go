@@ -1,6 +1,8 @@
 package bpf
 
 import (
+	"encoding/binary"
+	"time"
 	"unsafe"
 
 	"github.com/pkg/errors"
@@ -10,16 +12,162 @@ import (
 
 var (
 	// Map indices of configuration values for acct probe.
-	configCooldown = 0
+	configCooldown      = 0
+	configDstPortFilter = 1
+	configSrcPortFilter = 2
+	configSequence      = 3
+	configTCPFlags      = 4
+	configMaxFlows      = 5
+	configUnaccounted   = 6
 )
 
 const (
 	bpfAny = 0 // BPF_ANY
+
+	// DefaultMaxFlows is the amount of flows tracked by the probe
+	// if Config.MaxFlows is zero.
+	DefaultMaxFlows = 1024
 )
 
 // Config is a configuration object for the acct BPF probe.
 type Config struct {
 	CooldownMillis uint32
+
+	// Only account for flows with a destination or source port in the given
+	// sets. The filters are applied in the kernel and are combined, a flow needs
+	// to match both filters to be accounted for. An empty set disables the filter.
+	// Protocols without ports (eg. ICMP) are not accounted for when a filter is set.
+	// Rejected flows are remembered in a map of 1024 flows of their own, to
+	// drop their packets cheaply. They don't count towards MaxFlows.
+	DstPortFilter []uint16
+	SrcPortFilter []uint16
+
+	// Assign per-flow sequence numbers to events. See Event.Seq.
+	Sequence bool
+
+	// Count the SYN, FIN and RST packets of TCP flows. See Event.SynCount.
+	TCPFlags bool
+
+	// Maximum amount of flows of which the probe keeps state in the kernel,
+	// like the deadline of their next update event. When the limit is reached,
+	// the state of the least recently updated flow is evicted to make room for
+	// a new flow, and the evicted flow is sent as a new flow on its next update.
+	// Kernels before 4.10 can't evict flows, new flows exceeding the limit are
+	// not rate limited and send an event for every packet. Flows exceeding the
+	// limit are counted in the nextupd map's MapStats. Defaults to
+	// DefaultMaxFlows if zero.
+	//
+	// The state maps are allocated in full when the probe is loaded, at about
+	// 72 bytes per flow, plus 64 bytes per flow for each of Sequence and
+	// TCPFlags if enabled. 2^20 flows with both options enabled take about
+	// 200MiB of kernel memory.
+	MaxFlows uint32
+
+	// Deliver events of flows without conntrack accounting data, instead of
+	// failing NewProbe when the net.netfilter.nf_conntrack_acct or
+	// nf_conntrack_timestamp sysctls are disabled, eg. in environments where
+	// sysctls can't be changed. Events of these flows carry the flow's tuple
+	// with zero counters and have Event.Unaccounted set, and are only rate
+	// limited by the cooldown. Without timestamps, Event.Start is zero.
+	// See Probe.DisabledSysctls.
+	AllowUnaccounted bool
+
+	// Deliver event addresses in the 16-byte form they're decoded from,
+	// instead of normalizing IPv4 and IPv4-mapped IPv6 addresses to 4-byte
+	// IPv4 addresses. See Event.UnmarshalBinary.
+	RawAddrs bool
+
+	// Directory in bpffs (eg. /sys/fs/bpf/conntracct) holding the perf maps
+	// perf_acct_update and perf_acct_end of an acct probe loaded and pinned
+	// by another component. If set, the Probe reads events from the pinned
+	// maps instead of loading its own program. The other settings of the
+	// program in Config are ignored, since the probe's config maps are owned
+	// by that component. RawAddrs is applied to events read from the maps.
+	PinPath string
+
+	// File to write the BPF verifier's log to when the kernel rejects the
+	// probe, for attaching to bug reports. The log is always part of the
+	// LoadError returned by NewProbe. Not written if empty.
+	VerifierLogPath string
+
+	// File the probe's per-flow state is saved to when the Probe is stopped,
+	// and restored from when it is started, so flows established before a
+	// restart resume being sampled by their cooldown instead of being seen as
+	// new flows, sending a new event and another startup burst. The state is
+	// each flow's update deadline, start time for Duration, sequence number
+	// and TCP flag counters. The file is removed once its state was restored.
+	//
+	// The state is best-effort. It's only saved by a graceful Stop, after a
+	// crash flows are seen as new again. Flows destroyed while the probe was
+	// stopped leave stale state behind until it's evicted from the maps, and
+	// the kernel can allocate a new flow at the same address as one of them,
+	// so the new flow is taken for the old one: it has no new event or startup
+	// burst, and its Duration and Seq continue the old flow's. State saved in
+	// a previous boot is ignored, as is the state of maps of which the layout
+	// changed, eg. after an upgrade. Not restored if empty. Ignored with
+	// PinPath, not used by the NetlinkProbe.
+	StateFile string
+
+	// CPUs to bind the OS threads of the Probe's reader goroutines to, eg. the
+	// CPUs of one NUMA node, to keep the events read from the perf maps in that
+	// node's caches. The goroutines decoding events and delivering them to
+	// consumers, and polling the perf rings of a Probe using PinPath, are
+	// bound. The poller of a Probe loading its own program is owned by gobpf
+	// and runs unbound. Binding the readers to few or busy CPUs can make them
+	// fall behind the kernel, losing events once the perf rings fill up. The
+	// rings of all CPUs are always read, since the program writes an event to
+	// the ring of the CPU handling the packet, and events of CPUs without a
+	// reader would be lost. Not bound if empty. Not used by the NetlinkProbe.
+	ReaderCPUs []uint
+
+	// Kinds of events to attach the probe's kprobes for, eg. only EventDestroy
+	// to account for flows when they end, at a fraction of the overhead of
+	// also probing every packet's accounting update. New and update events
+	// share __nf_ct_refresh_acct's kprobes, and destroy events are emitted by
+	// the nf_conntrack_free kprobe. If update events are not selected but new
+	// events are, the updates following a flow's new event are dropped in
+	// userspace. Destroy events of flows the probe hasn't seen an update of
+	// carry their counters, but have no Duration. All kinds if empty. Ignored
+	// with PinPath, not used by the NetlinkProbe.
+	Events []EventType
+
+	// Interval between conntrack table dumps of a NetlinkProbe, which sends
+	// an update event for every flow in each dump. Defaults to
+	// DefaultNetlinkInterval if zero. Not used by the Probe.
+	NetlinkInterval time.Duration
+
+	// File holding the JSON lines of the events replayed by a ReplaySource,
+	// replayed at ReplaySpeed times the pace they were captured at, eg. 1 for
+	// their original timing or 10 to replay them ten times faster. Zero
+	// replays them as fast as possible. Not used by the Probe.
+	ReplayFile  string
+	ReplaySpeed float64
+}
+
+// maxFlows returns the amount of flows tracked by the probe.
+func (cfg Config) maxFlows() uint32 {
+	if cfg.MaxFlows == 0 {
+		return DefaultMaxFlows
+	}
+	return cfg.MaxFlows
+}
+
+// sectionParams returns the parameters of the ELF sections to apply when
+// loading the probe, sizing its per-flow state maps. The maps of disabled
+// options keep the size they have in the ELF.
+func sectionParams(cfg Config) map[string]elf.SectionParams {
+
+	size := elf.SectionParams{MapMaxEntries: int(cfg.maxFlows())}
+
+	params := map[string]elf.SectionParams{"maps/nextupd": size}
+	if cfg.Sequence {
+		params["maps/flowseq"] = size
+	}
+	if cfg.TCPFlags {
+		params["maps/tcpflags"] = size
+	}
+
+	return params
 }
 
 // configureProbe sets configuration values in the probe's config map.
@@ -27,6 +175,12 @@ func configureProbe(mod *elf.Module, cfg Config) error {
 
 	cm := mod.Map("config")
 
+	// Enables counting flows exceeding the size of the nextupd map.
+	max := uint64(cfg.maxFlows())
+	if err := mod.UpdateElement(cm, unsafe.Pointer(&configMaxFlows), unsafe.Pointer(&max), bpfAny); err != nil {
+		return errors.Wrap(err, "max flows")
+	}
+
 	if cfg.CooldownMillis != 0 {
 		cd := cfg.CooldownMillis * 1000000 // 1 ms = 1 million ns
 		if err := mod.UpdateElement(cm, unsafe.Pointer(&configCooldown), unsafe.Pointer(&cd), bpfAny); err != nil {
@@ -34,5 +188,64 @@ func configureProbe(mod *elf.Module, cfg Config) error {
 		}
 	}
 
+	if err := configurePortFilter(mod, configDstPortFilter, "dstports", cfg.DstPortFilter); err != nil {
+		return errors.Wrap(err, "destination port filter")
+	}
+
+	if err := configurePortFilter(mod, configSrcPortFilter, "srcports", cfg.SrcPortFilter); err != nil {
+		return errors.Wrap(err, "source port filter")
+	}
+
+	if cfg.Sequence {
+		enabled := uint64(1)
+		if err := mod.UpdateElement(cm, unsafe.Pointer(&configSequence), unsafe.Pointer(&enabled), bpfAny); err != nil {
+			return errors.Wrap(err, "sequence numbering")
+		}
+	}
+
+	if cfg.TCPFlags {
+		enabled := uint64(1)
+		if err := mod.UpdateElement(cm, unsafe.Pointer(&configTCPFlags), unsafe.Pointer(&enabled), bpfAny); err != nil {
+			return errors.Wrap(err, "tcp flag accounting")
+		}
+	}
+
+	if cfg.AllowUnaccounted {
+		enabled := uint64(1)
+		if err := mod.UpdateElement(cm, unsafe.Pointer(&configUnaccounted), unsafe.Pointer(&enabled), bpfAny); err != nil {
+			return errors.Wrap(err, "unaccounted flows")
+		}
+	}
+
+	return nil
+}
+
+// configurePortFilter inserts the given ports into the named port set
+// and enables the port filter at the given index of the config map.
+// No-op if the list of ports is empty.
+func configurePortFilter(mod *elf.Module, idx int, name string, ports []uint16) error {
+
+	if len(ports) == 0 {
+		return nil
+	}
+
+	pm := mod.Map(name)
+
+	for _, p := range ports {
+		// Ports are stored in network byte order in conntrack tuples.
+		var k [2]byte
+		binary.BigEndian.PutUint16(k[:], p)
+
+		v := uint8(1)
+		if err := mod.UpdateElement(pm, unsafe.Pointer(&k), unsafe.Pointer(&v), bpfAny); err != nil {
+			return errors.Wrapf(err, "port %d", p)
+		}
+	}
+
+	enabled := uint64(1)
+	if err := mod.UpdateElement(mod.Map("config"), unsafe.Pointer(&idx), unsafe.Pointer(&enabled), bpfAny); err != nil {
+		return errors.Wrap(err, "enabling filter")
+	}
+
 	return nil
 }
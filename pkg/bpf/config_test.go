@@ -0,0 +1,24 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/iovisor/gobpf/elf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSectionParams(t *testing.T) {
+
+	// Only the flow deadlines are tracked by default.
+	assert.Equal(t, map[string]elf.SectionParams{
+		"maps/nextupd": {MapMaxEntries: DefaultMaxFlows},
+	}, sectionParams(Config{}))
+
+	// The maps of enabled options are sized to the maximum amount of flows.
+	size := elf.SectionParams{MapMaxEntries: 16}
+	assert.Equal(t, map[string]elf.SectionParams{
+		"maps/nextupd":  size,
+		"maps/flowseq":  size,
+		"maps/tcpflags": size,
+	}, sectionParams(Config{MaxFlows: 16, Sequence: true, TCPFlags: true}))
+}
@@ -1,14 +1,27 @@
 package bpf
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 // ConsumerMode defines whether the consumer
-// receives updates, destroys, or both.
+// receives new flows, updates, destroys, or any combination.
 type ConsumerMode uint8
 
-// Kind of events the consumer subscribes to.
+// Kind of events the consumer subscribes to. New events are the first
+// update of a flow, so ConsumerUpdate implies ConsumerNew.
 const (
 	ConsumerUpdate  ConsumerMode = 1
 	ConsumerDestroy ConsumerMode = 2
-	ConsumerAll     ConsumerMode = (ConsumerUpdate | ConsumerDestroy)
+	ConsumerNew     ConsumerMode = 4
+	ConsumerAll     ConsumerMode = (ConsumerUpdate | ConsumerDestroy | ConsumerNew)
+)
+
+// Buffer size and name of the Consumer backing Probe.Events.
+const (
+	EventsBufferSize   = 4096
+	EventsConsumerName = "events"
 )
 
 // A Consumer of accounting events.
@@ -16,9 +29,23 @@ type Consumer struct {
 	name   string
 	events chan Event
 
-	// Kinds of events the consumer wants to receive. (update, destroy, all)
+	// Kinds of events the consumer wants to receive. (new, update, destroy, all)
 	mode ConsumerMode
 
+	// Optional predicate events need to match to be delivered to the consumer.
+	filter func(Event) bool
+
+	// Fields of events the consumer wants to receive, see SetFields.
+	fields EventField
+
+	// Accumulates events into batches, nil if the consumer
+	// receives events one at a time.
+	batch *batcher
+
+	// Holds events to deliver them in per-flow order, nil if events
+	// are delivered in the order they are received.
+	reorder *reorderer
+
 	stats *ConsumerStats
 }
 
@@ -33,6 +60,7 @@ func NewConsumer(name string, events chan Event, mode ConsumerMode) *Consumer {
 		name:   name,
 		events: events,
 		mode:   mode,
+		fields: FieldAll,
 		stats:  &ConsumerStats{},
 	}
 
@@ -45,10 +73,20 @@ func (ac *Consumer) Name() string {
 }
 
 // Events returns the consumer's Event channel.
+// Returns nil for batch consumers, see Batches.
 func (ac *Consumer) Events() <-chan Event {
 	return ac.events
 }
 
+// Batches returns the batch channel of a consumer created using
+// NewBatchConsumer. Returns nil for single-event consumers.
+func (ac *Consumer) Batches() <-chan []Event {
+	if ac.batch == nil {
+		return nil
+	}
+	return ac.batch.out
+}
+
 // Stats returns a reference to the Consumer's ConsumerStats structure.
 // This structure is updated using sync/atomic. Use the ConsumerStats' Get()
 // methods to obtain a copy created using atomic loads.
@@ -66,12 +104,104 @@ func (ac *Consumer) WantDestroy() bool {
 	return (ac.mode & ConsumerDestroy) > 0
 }
 
-// Close closes the Consumer's event channel.
+// WantNew returns whether or not this consumer wants to receive new flow events.
+func (ac *Consumer) WantNew() bool {
+	return (ac.mode & (ConsumerNew | ConsumerUpdate)) > 0
+}
+
+// wantType returns whether or not this consumer wants to receive events of type t.
+func (ac *Consumer) wantType(t EventType) bool {
+	switch t {
+	case EventNew:
+		return ac.WantNew()
+	case EventUpdate:
+		return ac.WantUpdate()
+	case EventDestroy:
+		return ac.WantDestroy()
+	}
+	return false
+}
+
+// SetFilter sets a predicate that events need to match to be delivered
+// to the consumer, eg. the Match method of a compiled pkg/filter expression.
+// Must be called before the consumer is registered to a Probe.
+func (ac *Consumer) SetFilter(f func(Event) bool) {
+	ac.filter = f
+}
+
+// SetFields sets the fields of events the consumer needs, FieldAll by
+// default. The Probe only decodes the fields wanted by any of its consumers,
+// which saves decoding time for narrow consumers at high event rates, eg. a
+// consumer only using FieldTuple and FieldCounters. Events may still hold
+// fields outside the set if another consumer wants them, so don't rely on them
+// being zero. The set must include the fields used by the consumer's filter.
+// Must be called before the consumer is registered to a Probe.
+func (ac *Consumer) SetFields(f EventField) {
+	ac.fields = f
+}
+
+// SetReorder makes the consumer deliver the events of every flow in order,
+// at the cost of latency. The Probe delivers events in the order they are
+// read from the kernel, which can differ from the order they were generated
+// in when a flow's packets are handled by multiple CPUs. The consumer holds
+// every event for window before delivering it, so events of the same flow
+// received within that time are delivered in order: by their Seq if sequence
+// numbering is enabled (see Config.Sequence), by their Time otherwise.
+//
+// A larger window tolerates more skew between CPUs, but delays every event
+// by at least the window, and events of the same flow by at most twice the
+// window, while holding more events in memory. Events received after a later
+// event of their flow was delivered, for exceeding the window, are delivered
+// right away, out of order, and counted as late in the consumer's stats.
+// A zero window disables reordering. Must be called before the consumer
+// is registered to a Probe.
+func (ac *Consumer) SetReorder(window time.Duration) {
+	if window <= 0 {
+		ac.reorder = nil
+		return
+	}
+	ac.reorder = newReorderer(window, ac.stats, ac.send)
+}
+
+// send delivers an event to the consumer's channel or batch without blocking.
+// The event is counted as lost if the channel is full.
+func (ac *Consumer) send(e Event) {
+
+	if ac.batch != nil {
+		ac.batch.add(e)
+		return
+	}
+
+	select {
+	case ac.events <- e:
+		ac.stats.setQueueLength(len(ac.events))
+		ac.stats.incrEventsReceived()
+	default:
+		// If the channel can't be written to immediately,
+		// increment the consumer's lost counter.
+		ac.stats.incrEventsLost()
+	}
+}
+
+// Close closes the Consumer's event channel. Batch consumers send
+// their pending batch, if any, before closing their batch channel. Events
+// held for reordering are delivered before closing.
 func (ac *Consumer) Close() {
+	if ac.reorder != nil {
+		ac.reorder.close()
+	}
+	if ac.batch != nil {
+		ac.batch.close()
+		return
+	}
 	close(ac.events)
 }
 
-// RegisterConsumer registers an Consumer in an Probe.
+// RegisterConsumer registers an Consumer in an Probe. The Consumer only
+// receives the kinds of events in its ConsumerMode, events of other kinds are
+// skipped when fanning out, eg. a ConsumerDestroy never receives updates.
+// Events of kinds no registered Consumer wants are not fanned out at all, and
+// only decoded as far as needed for the Probe's statistics.
 func (ap *Probe) RegisterConsumer(ac *Consumer) error {
 
 	if ac == nil {
@@ -89,6 +219,7 @@ func (ap *Probe) RegisterConsumer(ac *Consumer) error {
 
 	// Append the consumer to the probe's list of consumers.
 	ap.consumers = append(ap.consumers, ac)
+	ap.updateFields()
 
 	return nil
 }
@@ -114,6 +245,7 @@ func (ap *Probe) RemoveConsumer(ac *Consumer) error {
 			ap.consumers[len(ap.consumers)-1] = nil
 			// Shrink the slice by one element.
 			ap.consumers = ap.consumers[:len(ap.consumers)-1]
+			ap.updateFields()
 
 			return nil
 		}
@@ -122,6 +254,22 @@ func (ap *Probe) RemoveConsumer(ac *Consumer) error {
 	return errNoConsumer
 }
 
+// updateFields sets the fields decoded by the Probe and the kinds of events
+// it delivers to the ones wanted by any of its consumers. Must be called with
+// consumerMu held.
+func (ap *Probe) updateFields() {
+
+	var f EventField
+	var m ConsumerMode
+	for _, c := range ap.consumers {
+		f |= c.fields
+		m |= c.mode
+	}
+
+	atomic.StoreUint32(&ap.fields, uint32(f))
+	atomic.StoreUint32(&ap.modes, uint32(m))
+}
+
 // GetConsumer looks up and returns an Consumer registered in an Probe
 // based on its name. Returns nil if consumer does not exist in probe.
 func (ap *Probe) GetConsumer(name string) *Consumer {
@@ -137,3 +285,67 @@ func (ap *Probe) GetConsumer(name string) *Consumer {
 
 	return nil
 }
+
+// Events returns a channel receiving all of the Probe's events: new flows,
+// updates and destroys. It is the simplest way of reading events from the
+// Probe without creating and registering a Consumer. The first call registers
+// a Consumer named EventsConsumerName, later calls return the same channel
+// until CloseEvents is called.
+//
+// The channel buffers up to EventsBufferSize events. Like with any Consumer,
+// the Probe never blocks on a slow reader: events arriving while the buffer
+// is full are dropped and counted as lost in the Consumer's stats. Use
+// GetConsumer(EventsConsumerName) to access them.
+func (ap *Probe) Events() <-chan Event {
+
+	ap.eventsMu.Lock()
+	defer ap.eventsMu.Unlock()
+
+	if ap.eventsConsumer == nil {
+		ac := NewConsumer(EventsConsumerName, make(chan Event, EventsBufferSize), ConsumerAll)
+
+		// Bypass RegisterConsumer, this call can't fail
+		// over a user-defined consumer with the same name.
+		ap.consumerMu.Lock()
+		ap.consumers = append(ap.consumers, ac)
+		ap.updateFields()
+		ap.consumerMu.Unlock()
+
+		ap.eventsConsumer = ac
+	}
+
+	return ap.eventsConsumer.Events()
+}
+
+// CloseEvents unregisters the Consumer backing the channel returned by
+// Events and closes the channel. A later call to Events returns a new channel.
+func (ap *Probe) CloseEvents() error {
+
+	ap.eventsMu.Lock()
+	defer ap.eventsMu.Unlock()
+
+	ac := ap.eventsConsumer
+	if ac == nil {
+		return errNoConsumer
+	}
+
+	// Remove the consumer by reference instead of by name. The channel
+	// can only be closed when it's no longer receiving events.
+	ap.consumerMu.Lock()
+	for i, c := range ap.consumers {
+		if c == ac {
+			n := len(ap.consumers) - 1
+			copy(ap.consumers[i:], ap.consumers[i+1:])
+			ap.consumers[n] = nil
+			ap.consumers = ap.consumers[:n]
+			break
+		}
+	}
+	ap.updateFields()
+	ap.consumerMu.Unlock()
+
+	ac.Close()
+	ap.eventsConsumer = nil
+
+	return nil
+}
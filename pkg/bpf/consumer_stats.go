@@ -9,8 +9,11 @@ type ConsumerStats struct {
 	EventsReceived uint64 `json:"events_received"`
 	// amount of events that could not be received by the consumer
 	EventsLost uint64 `json:"events_lost"`
-	// length of the consumer's event queue
+	// length of the consumer's event queue, in batches for batch consumers
 	EventQueueLength uint64 `json:"event_queue_length"`
+	// amount of events delivered out of order, after the consumer's reorder
+	// window had passed for a later event of their flow
+	EventsLate uint64 `json:"events_late"`
 }
 
 // incrEventsReceived atomically increases the events received counter by one.
@@ -23,6 +26,21 @@ func (s *ConsumerStats) incrEventsLost() {
 	atomic.AddUint64(&s.EventsLost, 1)
 }
 
+// incrEventsLate atomically increases the late events counter by one.
+func (s *ConsumerStats) incrEventsLate() {
+	atomic.AddUint64(&s.EventsLate, 1)
+}
+
+// addEventsReceived atomically increases the events received counter by n.
+func (s *ConsumerStats) addEventsReceived(n int) {
+	atomic.AddUint64(&s.EventsReceived, uint64(n))
+}
+
+// addEventsLost atomically increases the events lost counter by n.
+func (s *ConsumerStats) addEventsLost(n int) {
+	atomic.AddUint64(&s.EventsLost, uint64(n))
+}
+
 // setQueueLength atomically sets the queue length of the consumer.
 func (s *ConsumerStats) setQueueLength(l int) {
 	atomic.StoreUint64(&s.EventQueueLength, uint64(l))
@@ -36,5 +54,6 @@ func (s *ConsumerStats) Get() ConsumerStats {
 		EventsReceived:   atomic.LoadUint64(&s.EventsReceived),
 		EventsLost:       atomic.LoadUint64(&s.EventsLost),
 		EventQueueLength: atomic.LoadUint64(&s.EventQueueLength),
+		EventsLate:       atomic.LoadUint64(&s.EventsLate),
 	}
 }
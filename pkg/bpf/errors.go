@@ -6,6 +6,27 @@ const (
 	errFmtSplitKprobe = "expected string of format 'k(ret)probe/<kernel-symbol>': %s"
 	errFmtSymNotFound = "kernel symbol '%s' not found"
 	errKernelRelease  = "invalid kernel release version '%s'"
+
+	errFmtSysctlsDisabled = "conntrack accounting is disabled by sysctl(s) %s: " +
+		"set them to 1 (see Sysctls), or set Config.AllowUnaccounted to account for flows without counters"
+
+	errFmtPinnedMapType    = "map type %d is not a perf event array (%d)"
+	errFmtPinnedMapLayout  = "key size %d and value size %d, expected 4 and 4"
+	errFmtPinnedMapEntries = "%d entries is too small for CPU %d"
+
+	errFmtReaderCPU = "reader CPU %d is not online"
+
+	errFmtEventType = "unknown event type %d"
+
+	errFmtReplaySpeed = "replay speed %g is negative"
+
+	errFmtEventLength = "event of %d bytes, expected %d: " +
+		"the probe and its userspace were built from different versions"
+
+	errFmtImageSections = "missing sections %s: " +
+		"the probe's object is older than its userspace, rebuild it with 'mage bpf:build'"
+	errFmtImageConfig = "config map of %d entries, expected at least %d: " +
+		"the probe's object is older than its userspace, rebuild it with 'mage bpf:build'"
 )
 
 var (
@@ -13,9 +34,14 @@ var (
 
 	errProbeStarted    = errors.New("probe already running")
 	errProbeNotStarted = errors.New("probe is not running")
+	errProbeUnloaded   = errors.New("probe module is not loaded, create a new probe")
+
+	errNetlinkPinned = errors.New("netlink probe can't read pinned maps, unset Config.PinPath")
+	errReplayNoFile  = errors.New("no file to replay events from, set Config.ReplayFile")
 
 	errDupConsumer = errors.New("a Consumer with the same name is already registered")
 	errNoConsumer  = errors.New("could not find the Consumer to delete")
 
 	errConsumerNil = errors.New("given Consumer is nil")
+	errCallbackNil = errors.New("given callback is nil")
 )
@@ -1,82 +1,405 @@
 package bpf
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"net"
+	"reflect"
+	"strings"
+	"time"
 	"unsafe"
 )
 
 // EventLength is the length of the struct sent by BPF.
-const EventLength = 104
+const EventLength = 160
+
+// SchemaVersion is the version of the Event's serialized form, sent along
+// with every serialized Event, eg. as 'schema_version' in JSON, so consumers
+// can tell which fields to expect while producers of different versions are
+// being rolled out. Bump it when fields of Event are added, removed, renamed
+// or change meaning.
+const SchemaVersion = 5
 
 // Event is an accounting event delivered to userspace from the Probe.
 type Event struct {
-	Start        uint64 // epoch timestamp of flow start
-	Timestamp    uint64 // ktime timestamp of event
-	ConnectionID uint32
-	Connmark     uint32
-	SrcAddr      net.IP
-	DstAddr      net.IP
-	PacketsOrig  uint64
-	BytesOrig    uint64
-	PacketsRet   uint64
-	BytesRet     uint64
-	SrcPort      uint16
-	DstPort      uint16
-	NetNS        uint32
-	Proto        uint8
+	Start        uint64 `json:"start"`     // epoch timestamp of flow start
+	Timestamp    uint64 `json:"timestamp"` // ktime timestamp of event
+	ConnectionID uint32 `json:"connection_id"`
+	Connmark     uint32 `json:"connmark"`
+	SrcAddr      net.IP `json:"src_addr"`
+	DstAddr      net.IP `json:"dst_addr"`
+
+	// Original direction counters. All counters are totals since the start of
+	// the flow. Destroy events read them when conntrack frees the flow, after
+	// its last packet was accounted, so they hold the flow's final totals even
+	// if the flow ended before sending an update after its startup burst.
+	//
+	// The kernel keeps the counters as 64-bit atomics, decoded as unsigned
+	// integers by both the BPF and netlink probes. They wrap around to zero
+	// after 2^64, and are reset to zero when a conntrack dump zeroes them,
+	// eg. 'conntrack -L -z', so a flow's counters can decrease between events.
+	PacketsOrig uint64 `json:"packets_orig"`
+	BytesOrig   uint64 `json:"bytes_orig"`
+
+	// Reply direction counters. Remain zero for the lifetime of flows of
+	// which only the original direction is seen, like one-way UDP traffic or
+	// flows with asymmetric routing or direct server return. These flows are
+	// accounted and emitted like any other flow.
+	PacketsRet uint64 `json:"packets_ret"`
+	BytesRet   uint64 `json:"bytes_ret"`
+
+	// SrcPort and DstPort are only set for protocols of which conntrack tracks
+	// ports: TCP, UDP, UDP-Lite, SCTP and DCCP, see HasPorts. Zero for all other
+	// protocols, even if conntrack stores other data in their place, see ICMPType.
+	SrcPort uint16 `json:"src_port"`
+	DstPort uint16 `json:"dst_port"`
+	NetNS   uint32 `json:"netns"`
+	Proto   uint8  `json:"proto"` // see Proto for its name
+	CPU     uint32 `json:"cpu"`   // CPU the event was generated on
+
+	// Type, code and identifier of the ICMP or ICMPv6 message that created
+	// the flow, eg. type 8 (echo request) for ping. Only set for ICMP and
+	// ICMPv6 flows, zero for all other protocols. Flows are only created by
+	// requests, so ICMPType is never zero for ICMP flows.
+	ICMPType uint8  `json:"icmp_type,omitempty"`
+	ICMPCode uint8  `json:"icmp_code,omitempty"`
+	ICMPID   uint16 `json:"icmp_id,omitempty"`
+
+	// Kind of event (new, update or destroy). Set by the Probe.
+	Type EventType `json:"type"`
+
+	// Name of the flow's service based on its ports, eg. https, or 'unknown'.
+	// Only set for TCP and UDP flows, by the pipeline's service stage.
+	Service string `json:"service,omitempty"`
+
+	// Conntrack status of the flow when the event was generated. SeenReply is
+	// set once the flow has seen traffic in the reply direction. Assured is set
+	// when conntrack considers the flow established, eg. after a TCP handshake.
+	// The event of the first reply packet may not yet have SeenReply set,
+	// since conntrack updates its status after accounting the packet.
+	SeenReply bool `json:"seen_reply"`
+	Assured   bool `json:"assured"`
+
+	// The flow's full conntrack status bitmap, of which SeenReply, Assured and
+	// Expected are single bits. Test bits with Status.Has, eg. to tell NATed
+	// flows with StatusNAT. Sent as its numeric value.
+	Status Status `json:"status"`
+
+	// The flow has no conntrack accounting data and its counters are zero,
+	// see Config.AllowUnaccounted.
+	Unaccounted bool `json:"unaccounted,omitempty"`
+
+	// Direction of the packet that triggered the event, telling which of the
+	// flow's counters advanced last. Informational, eg. for finding out which
+	// side of a flow caused an update after its cooldown. Zero in destroy
+	// events, which are triggered by conntrack freeing the flow.
+	TriggerDir Direction `json:"trigger_dir,omitempty"`
+
+	// Ethernet addresses of the packet that triggered the event, as received
+	// by the host, eg. for attributing flows to hosts on an L2 segment. The
+	// source is the sending host, or the router the packet came through. Per
+	// TriggerDir, that's the flow's originator's side for original packets and
+	// its responder's for replies.
+	//
+	// Only available for packets received on Ethernet interfaces, since
+	// conntrack accounts packets at the PREROUTING and OUTPUT hooks, where
+	// only received packets have an L2 header. Nil in events triggered by
+	// locally generated packets, packets on interfaces without Ethernet
+	// headers like tunnels or loopback, in destroy events, which are not
+	// triggered by a packet, and in events of the NetlinkProbe.
+	SrcMAC MAC `json:"src_mac,omitempty"`
+	DstMAC MAC `json:"dst_mac,omitempty"`
+
+	// Sequence number of the event within its flow, if enabled in the Probe's
+	// Config. The first event of a flow has sequence number 1, every following
+	// update or destroy event increments it by one, regardless of which CPU
+	// generated the event. Events can be reordered by Seq, and a repeated Seq
+	// of a flow identifies a duplicate. Zero when sequence numbering is disabled.
+	//
+	// The counter is reset when the flow is destroyed or the Probe is reloaded.
+	// Since the kernel can reuse the ConnectionID of a destroyed flow, Seq only
+	// increases between a flow's first event and its destroy event. Flows of
+	// which the counter could not be stored (see Config.MaxFlows) are sent
+	// with Seq 0. The counter wraps around to zero after 2^32-1 events, which
+	// takes over 200 years at the default cooldown.
+	Seq uint32 `json:"seq"`
+
+	// Amount of packets of a TCP flow carrying the SYN, FIN or RST flag, in
+	// both directions, if enabled in the Probe's Config. Like the other
+	// counters, these are totals since the start of the flow. Zero for other
+	// protocols and when TCP flag accounting is disabled.
+	//
+	// Flags are read from the packet headers in the kernel, costing a map
+	// lookup per accounted packet and a map update per packet carrying one
+	// of the flags. The counters of at most Config.MaxFlows flows are stored
+	// at once, flows exceeding the limit are sent with zero counts. Flags of
+	// IPv6 packets with extension headers are not counted.
+	SynCount uint32 `json:"syn_count,omitempty"`
+	FinCount uint32 `json:"fin_count,omitempty"`
+	RstCount uint32 `json:"rst_count,omitempty"`
+
+	// Time elapsed between the flow's first event and this event, measured in
+	// the kernel. Zero in new events. Destroy events hold the flow's total
+	// duration from its first packet until conntrack freed the flow, which
+	// includes the conntrack timeout after the flow's last packet. Only counts
+	// from the flow's next event if its state was evicted from the kernel
+	// (see Config.MaxFlows), and is zero in destroy events of flows of which
+	// no state was kept, like flows destroyed before loading the Probe.
+	Duration time.Duration `json:"duration,omitempty"`
+
+	// Name of the conntrack helper assigned to the flow, eg. 'ftp' or 'sip',
+	// which tracks the flow's control traffic to create expectations for its
+	// related data flows. Empty for the vast majority of flows, which have no
+	// helper. The kernel identifies helpers by name only, there is no numeric
+	// helper ID.
+	//
+	// Since kernel 4.7, helpers are no longer assigned automatically based on
+	// a flow's port (see the nf_conntrack_helper sysctl), but through explicit
+	// rules, eg. 'iptables -t raw -A PREROUTING -p tcp --dport 21 -j CT
+	// --helper ftp'. Flows are only sent with a helper name once the helper
+	// was assigned, which happens when conntrack creates the flow.
+	Helper string `json:"helper,omitempty"`
+
+	// The flow was created from an expectation of another flow's conntrack
+	// helper, eg. the data connection of an active FTP session.
+	Expected bool `json:"expected,omitempty"`
+
+	// Counters accrued since the flow's previous event, next to the totals in
+	// the event's own counters. Nil unless the event was run through a delta
+	// stage of the pipeline.
+	Delta *Counters `json:"delta,omitempty"`
+
+	// Byte counters adjusted for per-packet overhead not accounted for by
+	// conntrack, like Ethernet headers. Conntrack only counts bytes at L3, so
+	// these are approximations computed as bytes + packets * overhead. Zero
+	// unless the event was run through an overhead stage of the pipeline.
+	BytesOrigAdjusted uint64 `json:"bytes_orig_adjusted,omitempty"`
+	BytesRetAdjusted  uint64 `json:"bytes_ret_adjusted,omitempty"`
+
+	// Bytes received and sent by the host, for billing traffic relative to
+	// the host instead of the flow's initiator. When the flow's source is an
+	// address of the host, BytesOut are its orig bytes and BytesIn its ret
+	// bytes, and the other way around when only its destination is. Zero
+	// unless the event was run through a host direction stage of the pipeline.
+	BytesIn  uint64 `json:"bytes_in,omitempty"`
+	BytesOut uint64 `json:"bytes_out,omitempty"`
+
+	// Neither of the flow's addresses is an address of the host, eg. traffic
+	// routed through the host. BytesIn and BytesOut are left zero. Only set by
+	// the host direction stage.
+	Forwarded bool `json:"forwarded,omitempty"`
+
+	// Average bytes per second in both directions over the flow's Duration.
+	// Zero unless the event was run through a summary stage of the pipeline.
+	AvgBytesPerSec float64 `json:"avg_bytes_per_sec,omitempty"`
+
+	// Static labels of the host that produced the event, like its hostname
+	// or region. Set by the pipeline, shared between events and must not be
+	// modified.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Wall-clock time of the event, derived from Timestamp and the estimated
+	// boot time of the machine. Set by the Probe when the event is received.
+	Time time.Time `json:"time"`
+}
+
+// Counters holds the packet and byte counters of a flow in both directions.
+type Counters struct {
+	PacketsOrig uint64 `json:"packets_orig"`
+	BytesOrig   uint64 `json:"bytes_orig"`
+	PacketsRet  uint64 `json:"packets_ret"`
+	BytesRet    uint64 `json:"bytes_ret"`
+}
+
+// Counters returns the event's packet and byte counters.
+func (e *Event) Counters() Counters {
+	return Counters{
+		PacketsOrig: e.PacketsOrig,
+		BytesOrig:   e.BytesOrig,
+		PacketsRet:  e.PacketsRet,
+		BytesRet:    e.BytesRet,
+	}
 }
 
 // UnmarshalBinary unmarshals a binary Event representation
 // into a struct, using the machine's native endianness.
+// IPv4 and IPv4-mapped IPv6 addresses are decoded into their
+// 4-byte IPv4 form, see normalizeAddr.
 func (e *Event) UnmarshalBinary(b []byte) error {
+	return e.unmarshalBinary(b, true, FieldAll)
+}
+
+// unmarshalBinary unmarshals the given fields of a binary Event
+// representation, other fields are left untouched. If normalize is false,
+// addresses are decoded into their raw 16-byte form instead.
+// Does not set the event's Time, see Probe.perfWorker.
+func (e *Event) unmarshalBinary(b []byte, normalize bool, fields EventField) error {
 
 	if len(b) != EventLength {
-		return fmt.Errorf("input byte array incorrect length %d", len(b))
+		return fmt.Errorf(errFmtEventLength, len(b), EventLength)
 	}
 
-	e.Start = *(*uint64)(unsafe.Pointer(&b[0]))
-	e.Timestamp = *(*uint64)(unsafe.Pointer(&b[8]))
 	e.ConnectionID = *(*uint32)(unsafe.Pointer(&b[16]))
-	e.Connmark = *(*uint32)(unsafe.Pointer(&b[20]))
+	e.Proto = b[96]
 
-	// Build an IPv4 address if only the first four bytes
-	// of the nf_inet_addr union are filled.
-	// Assigning 4 bytes directly into IP() is incorrect,
-	// an IPv4 is stored in the last 4 bytes of an IP().
-	if isIPv4(b[24:40]) {
-		e.SrcAddr = net.IPv4(b[24], b[25], b[26], b[27])
-	} else {
-		e.SrcAddr = net.IP(b[24:40])
+	// The probe marks the first event of a flow.
+	flags := b[97]
+	if flags&eventFlagNew != 0 {
+		e.Type = EventNew
 	}
+	e.SeenReply = flags&eventFlagSeenReply != 0
+	e.Assured = flags&eventFlagAssured != 0
+	e.Unaccounted = flags&eventFlagUnaccounted != 0
+	e.Expected = flags&eventFlagExpected != 0
+	e.Status = Status(*(*uint32)(unsafe.Pointer(&b[144])))
+	e.TriggerDir = DirOriginal
+	if flags&eventFlagReply != 0 {
+		e.TriggerDir = DirReply
+	}
+
+	e.CPU = *(*uint32)(unsafe.Pointer(&b[100]))
 
-	if isIPv4(b[40:56]) {
-		e.DstAddr = net.IPv4(b[40], b[41], b[42], b[43])
-	} else {
-		e.DstAddr = net.IP(b[40:56])
+	if fields.has(FieldTime) {
+		e.Start = *(*uint64)(unsafe.Pointer(&b[0]))
+		e.Timestamp = *(*uint64)(unsafe.Pointer(&b[8]))
 	}
 
-	e.PacketsOrig = *(*uint64)(unsafe.Pointer(&b[56]))
-	e.BytesOrig = *(*uint64)(unsafe.Pointer(&b[64]))
-	e.PacketsRet = *(*uint64)(unsafe.Pointer(&b[72]))
-	e.BytesRet = *(*uint64)(unsafe.Pointer(&b[80]))
+	if fields.has(FieldTuple) {
+		e.SrcAddr = decodeAddr(b[24:40], normalize)
+		e.DstAddr = decodeAddr(b[40:56], normalize)
 
-	// Only extract ports for UDP and TCP.
-	e.Proto = b[96]
-	if e.Proto == 6 || e.Proto == 17 {
-		e.SrcPort = binary.BigEndian.Uint16(b[88:90])
-		e.DstPort = binary.BigEndian.Uint16(b[90:92])
+		// The probe copies the protocol-specific parts of the tuple as-is.
+		// For ICMP, the source holds the identifier and the destination the
+		// type and code, in place of the ports of other protocols.
+		e.SrcPort, e.DstPort = 0, 0
+		e.ICMPType, e.ICMPCode, e.ICMPID = 0, 0, 0
+		switch {
+		case HasPorts(e.Proto):
+			e.SrcPort = binary.BigEndian.Uint16(b[88:90])
+			e.DstPort = binary.BigEndian.Uint16(b[90:92])
+		case isICMP(e.Proto):
+			e.ICMPID = binary.BigEndian.Uint16(b[88:90])
+			e.ICMPType = b[90]
+			e.ICMPCode = b[91]
+		}
 	}
 
-	e.NetNS = *(*uint32)(unsafe.Pointer(&b[92]))
+	if fields.has(FieldCounters) {
+		e.PacketsOrig = *(*uint64)(unsafe.Pointer(&b[56]))
+		e.BytesOrig = *(*uint64)(unsafe.Pointer(&b[64]))
+		e.PacketsRet = *(*uint64)(unsafe.Pointer(&b[72]))
+		e.BytesRet = *(*uint64)(unsafe.Pointer(&b[80]))
+	}
+
+	if fields.has(FieldMarks) {
+		e.Connmark = *(*uint32)(unsafe.Pointer(&b[20]))
+		e.NetNS = *(*uint32)(unsafe.Pointer(&b[92]))
+	}
+
+	if fields.has(FieldSeq) {
+		e.Seq = *(*uint32)(unsafe.Pointer(&b[104]))
+	}
+
+	if fields.has(FieldTCPFlags) {
+		e.SynCount, e.FinCount, e.RstCount = 0, 0, 0
+		if e.Proto == protoTCP {
+			e.SynCount = *(*uint32)(unsafe.Pointer(&b[108]))
+			e.FinCount = *(*uint32)(unsafe.Pointer(&b[112]))
+			e.RstCount = *(*uint32)(unsafe.Pointer(&b[116]))
+		}
+	}
+
+	if fields.has(FieldDuration) {
+		e.Duration = time.Duration(*(*uint64)(unsafe.Pointer(&b[120])))
+	}
+
+	if fields.has(FieldHelper) {
+		e.Helper = decodeName(b[128:144])
+	}
+
+	if fields.has(FieldMAC) {
+		e.SrcMAC, e.DstMAC = decodeMACs(b[148:160])
+	}
 
 	return nil
 }
 
-// String returns a readable string representation of the Event.
+// MarshalJSON marshals the Event into a JSON object holding its fields and
+// its schema_version, see SchemaVersion.
+func (e Event) MarshalJSON() ([]byte, error) {
+
+	// The alias has none of Event's methods, so it is marshaled as usual.
+	type event Event
+
+	return json.Marshal(struct {
+		SchemaVersion int `json:"schema_version"`
+		*event
+	}{SchemaVersion, (*event)(&e)})
+}
+
+// String returns a readable string representation of the Event, its fields
+// formatted like by the %+v verb, with the Proto rendered as its name.
 func (e *Event) String() string {
-	return fmt.Sprintf("%+v", *e)
+
+	v := reflect.ValueOf(*e)
+	t := v.Type()
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < v.NumField(); i++ {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+
+		f := v.Field(i).Interface()
+		if t.Field(i).Name == "Proto" {
+			f = Proto(e.Proto)
+		}
+		fmt.Fprintf(&b, "%s:%+v", t.Field(i).Name, f)
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+// decodeName decodes a NUL-terminated C string of at most len(b) bytes.
+// Empty names, like those of flows without a helper, are not allocated.
+func decodeName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// decodeAddr decodes a 16-byte nf_inet_addr union into a net.IP.
+// A normalized address is a 4-byte IPv4 address if the union holds either
+// an IPv4 address or an IPv4-mapped IPv6 address (::ffff:a.b.c.d), so both
+// forms of the same address compare, hash and print the same. Otherwise,
+// IPv4 addresses are returned in their 16-byte (v4-in-v6) form and IPv6
+// addresses are returned as-is.
+func decodeAddr(b []byte, normalize bool) net.IP {
+
+	// Build an IPv4 address if only the first four bytes
+	// of the nf_inet_addr union are filled.
+	// Assigning 4 bytes directly into IP() is incorrect,
+	// an IPv4 is stored in the last 4 bytes of an IP().
+	if isIPv4(b) {
+		if normalize {
+			return net.IP{b[0], b[1], b[2], b[3]}
+		}
+		return net.IPv4(b[0], b[1], b[2], b[3])
+	}
+
+	ip := net.IP(b)
+	if normalize {
+		if v4 := ip.To4(); v4 != nil {
+			return v4
+		}
+	}
+
+	return ip
 }
 
 // isIPv4 checks if everything but the first 4 bytes of a bytearray
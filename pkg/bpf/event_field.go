@@ -0,0 +1,43 @@
+package bpf
+
+// EventField is a set of Event fields decoded by the Probe, see
+// Consumer.SetFields. A few fields are always decoded, since the Probe needs
+// them itself: ConnectionID, Proto, Type, CPU, SeenReply, Assured,
+// Unaccounted, Expected, Status and TriggerDir.
+type EventField uint32
+
+// Fields of an Event that can be left undecoded. Most fields are plain loads
+// from the binary event and cost next to nothing to decode. The exceptions
+// are FieldTuple, which scans and converts both 16-byte address unions, and
+// FieldTime, which computes the event's wall-clock time. Leaving out the
+// others is only worthwhile for consumers receiving millions of events per
+// second.
+const (
+	// SrcAddr, DstAddr, SrcPort, DstPort and the ICMP fields.
+	// The most expensive to decode.
+	FieldTuple EventField = 1 << iota
+	// PacketsOrig, BytesOrig, PacketsRet and BytesRet.
+	FieldCounters
+	// Start, Timestamp and Time.
+	FieldTime
+	// Connmark and NetNS.
+	FieldMarks
+	// Seq.
+	FieldSeq
+	// SynCount, FinCount and RstCount.
+	FieldTCPFlags
+	// Duration.
+	FieldDuration
+	// Helper, allocated for the few flows that have one.
+	FieldHelper
+	// SrcMAC and DstMAC, allocated for events that have them.
+	FieldMAC
+
+	FieldAll = FieldTuple | FieldCounters | FieldTime | FieldMarks |
+		FieldSeq | FieldTCPFlags | FieldDuration | FieldHelper | FieldMAC
+)
+
+// has returns true if f contains all of the given fields.
+func (f EventField) has(fields EventField) bool {
+	return f&fields == fields
+}
@@ -0,0 +1,484 @@
+package bpf
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventWithAddrs returns a binary Event holding the given
+// 16-byte nf_inet_addr unions as source and destination address.
+func eventWithAddrs(src, dst []byte) []byte {
+	b := make([]byte, EventLength)
+	copy(b[24:40], src)
+	copy(b[40:56], dst)
+	return b
+}
+
+func TestEventAddrNormalize(t *testing.T) {
+
+	// nf_inet_addr holding an IPv4 address in its first 4 bytes.
+	v4 := make([]byte, 16)
+	copy(v4, []byte{192, 0, 2, 1})
+
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	v6 := net.ParseIP("2001:db8::1")
+
+	tests := []struct {
+		name      string
+		addr      []byte
+		normal    net.IP
+		raw       net.IP
+		normalLen int
+	}{
+		{"ipv4", v4, net.IP{192, 0, 2, 1}, net.IPv4(192, 0, 2, 1), net.IPv4len},
+		{"ipv4-mapped", mapped, net.IP{192, 0, 2, 1}, mapped, net.IPv4len},
+		{"ipv6", v6, v6, v6, net.IPv6len},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := eventWithAddrs(tt.addr, tt.addr)
+
+			var e Event
+			require.NoError(t, e.UnmarshalBinary(b))
+			assert.Equal(t, tt.normal, e.SrcAddr)
+			assert.Equal(t, tt.normal, e.DstAddr)
+			assert.Len(t, e.SrcAddr, tt.normalLen)
+
+			require.NoError(t, e.unmarshalBinary(b, false, FieldAll))
+			assert.Equal(t, tt.raw, e.SrcAddr)
+			assert.Equal(t, tt.raw, e.DstAddr)
+			assert.Len(t, e.SrcAddr, net.IPv6len)
+		})
+	}
+
+	// IPv4 and IPv4-mapped forms of an address decode identically.
+	var a, m Event
+	require.NoError(t, a.UnmarshalBinary(eventWithAddrs(v4, v4)))
+	require.NoError(t, m.UnmarshalBinary(eventWithAddrs(mapped, mapped)))
+	assert.Equal(t, a.SrcAddr, m.SrcAddr)
+	assert.Equal(t, "192.0.2.1", m.SrcAddr.String())
+}
+
+func TestEventTCPFlags(t *testing.T) {
+
+	b := make([]byte, EventLength)
+	b[96] = 6 // proto
+	*(*uint32)(unsafe.Pointer(&b[108])) = 2
+	*(*uint32)(unsafe.Pointer(&b[112])) = 1
+	*(*uint32)(unsafe.Pointer(&b[116])) = 3
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.EqualValues(t, 2, e.SynCount)
+	assert.EqualValues(t, 1, e.FinCount)
+	assert.EqualValues(t, 3, e.RstCount)
+
+	// Events of the previous layout are rejected.
+	assert.Error(t, e.UnmarshalBinary(b[:112]))
+}
+
+func TestEventCounterWidth(t *testing.T) {
+
+	// The kernel's counters are signed 64-bit atomics, counters past 2^63
+	// have their sign bit set and are decoded as unsigned.
+	b := make([]byte, EventLength)
+	*(*int64)(unsafe.Pointer(&b[56])) = -1
+	*(*int64)(unsafe.Pointer(&b[64])) = -1 << 63
+	*(*uint64)(unsafe.Pointer(&b[72])) = 1<<63 - 1
+	*(*uint64)(unsafe.Pointer(&b[80])) = 1 << 32
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, ^uint64(0), e.PacketsOrig)
+	assert.EqualValues(t, uint64(1)<<63, e.BytesOrig)
+	assert.EqualValues(t, uint64(1)<<63-1, e.PacketsRet)
+	assert.EqualValues(t, uint64(1)<<32, e.BytesRet)
+}
+
+func TestEventDuration(t *testing.T) {
+
+	b := make([]byte, EventLength)
+	*(*uint64)(unsafe.Pointer(&b[120])) = uint64(90 * time.Second)
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, 90*time.Second, e.Duration)
+
+	// Events of the previous layout are rejected.
+	assert.Error(t, e.UnmarshalBinary(b[:120]))
+}
+
+func TestEventHelper(t *testing.T) {
+
+	b := make([]byte, EventLength)
+
+	// Most flows have no helper.
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Empty(t, e.Helper)
+	assert.False(t, e.Expected)
+
+	copy(b[128:144], "ftp")
+	b[97] = eventFlagExpected
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, "ftp", e.Helper)
+	assert.True(t, e.Expected)
+
+	// Names of the maximum length have no terminator.
+	copy(b[128:144], "abcdefghijklmnop")
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, "abcdefghijklmnop", e.Helper)
+
+	// Left untouched if not decoded.
+	e.Helper = "sip"
+	require.NoError(t, e.unmarshalBinary(b, true, FieldAll&^FieldHelper))
+	assert.Equal(t, "sip", e.Helper)
+
+	// Events of the previous layout are rejected.
+	assert.Error(t, e.UnmarshalBinary(b[:128]))
+}
+
+func TestEventStatus(t *testing.T) {
+
+	b := make([]byte, EventLength)
+
+	// A confirmed, established TCP flow between NATed addresses.
+	status := StatusSeenReply | StatusAssured | StatusConfirmed | StatusSrcNAT | StatusSrcNATDone
+	*(*uint32)(unsafe.Pointer(&b[144])) = uint32(status)
+	b[97] = eventFlagSeenReply | eventFlagAssured
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, status, e.Status)
+	assert.True(t, e.Status.Has(StatusAssured))
+	assert.False(t, e.Status.Has(StatusNAT), "only source NAT applied")
+	assert.False(t, e.Status.Has(StatusDying))
+
+	// Decoded along with the flags, whatever fields are decoded.
+	e = Event{}
+	require.NoError(t, e.unmarshalBinary(b, true, 0))
+	assert.Equal(t, status, e.Status)
+	assert.True(t, e.SeenReply)
+
+	// Events of the previous layout are rejected.
+	assert.Error(t, e.UnmarshalBinary(b[:144]))
+}
+
+func TestEventMAC(t *testing.T) {
+
+	b := make([]byte, EventLength)
+
+	// The source and destination of the packet's Ethernet header.
+	copy(b[148:], []byte{0, 0, 0x5e, 0, 0x53, 1})
+	copy(b[154:], []byte{0, 0, 0x5e, 0, 0x53, 2})
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, "00:00:5e:00:53:01", e.SrcMAC.String())
+	assert.Equal(t, "00:00:5e:00:53:02", e.DstMAC.String())
+
+	// Appending to one address doesn't overwrite the other.
+	_ = append(e.SrcMAC, 0xff)
+	assert.Equal(t, "00:00:5e:00:53:02", e.DstMAC.String())
+
+	// Sent in their text form, and read back.
+	j, err := json.Marshal(e)
+	require.NoError(t, err)
+	assert.Contains(t, string(j), `"src_mac":"00:00:5e:00:53:01","dst_mac":"00:00:5e:00:53:02"`)
+
+	var r Event
+	require.NoError(t, json.Unmarshal(j, &r))
+	assert.Equal(t, e.SrcMAC, r.SrcMAC)
+	assert.Equal(t, e.DstMAC, r.DstMAC)
+
+	// Not decoded unless asked for.
+	e = Event{}
+	require.NoError(t, e.unmarshalBinary(b, true, FieldAll&^FieldMAC))
+	assert.Nil(t, e.SrcMAC)
+
+	// Packets without an Ethernet header carry zero addresses,
+	// the fields are left out.
+	e = Event{}
+	require.NoError(t, e.UnmarshalBinary(make([]byte, EventLength)))
+	assert.Nil(t, e.SrcMAC)
+	assert.Nil(t, e.DstMAC)
+	j, err = json.Marshal(e)
+	require.NoError(t, err)
+	assert.NotContains(t, string(j), "mac")
+
+	// Events of the previous layout are rejected.
+	assert.Error(t, e.UnmarshalBinary(b[:152]))
+}
+
+// testEventBinary returns a binary TCP Event with all fields set.
+func testEventBinary() []byte {
+	b := eventWithAddrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"))
+	*(*uint64)(unsafe.Pointer(&b[8])) = 1000
+	*(*uint32)(unsafe.Pointer(&b[16])) = 42
+	*(*uint32)(unsafe.Pointer(&b[20])) = 7
+	*(*uint64)(unsafe.Pointer(&b[64])) = 1500
+	b[89], b[91] = 1, 2 // ports, big endian
+	b[96] = 6
+	*(*uint32)(unsafe.Pointer(&b[104])) = 3
+	*(*uint32)(unsafe.Pointer(&b[108])) = 1
+	*(*uint64)(unsafe.Pointer(&b[120])) = uint64(time.Second)
+	return b
+}
+
+func TestEventFields(t *testing.T) {
+
+	b := testEventBinary()
+
+	var full, masked Event
+	require.NoError(t, full.UnmarshalBinary(b))
+	require.NoError(t, masked.unmarshalBinary(b, true, FieldTuple|FieldCounters))
+
+	assert.Equal(t, full.SrcAddr, masked.SrcAddr)
+	assert.Equal(t, full.DstPort, masked.DstPort)
+	assert.Equal(t, full.BytesOrig, masked.BytesOrig)
+
+	// Fields needed by the Probe are always decoded.
+	assert.EqualValues(t, 42, masked.ConnectionID)
+	assert.EqualValues(t, 6, masked.Proto)
+
+	// Fields outside the set are left untouched.
+	assert.NotZero(t, full.Timestamp)
+	assert.Zero(t, masked.Timestamp)
+	assert.NotZero(t, full.Connmark)
+	assert.Zero(t, masked.Connmark)
+	assert.NotZero(t, full.Seq)
+	assert.Zero(t, masked.Seq)
+	assert.NotZero(t, full.SynCount)
+	assert.Zero(t, masked.SynCount)
+	assert.NotZero(t, full.Duration)
+	assert.Zero(t, masked.Duration)
+
+	var none Event
+	require.NoError(t, none.unmarshalBinary(b, true, 0))
+	assert.Nil(t, none.SrcAddr)
+	assert.Zero(t, none.BytesOrig)
+}
+
+// Compares decoding all fields of an event to decoding only its
+// tuple and counters, or only the fields that are always decoded.
+func BenchmarkEventUnmarshal(b *testing.B) {
+
+	eb := testEventBinary()
+
+	for _, bb := range []struct {
+		name   string
+		fields EventField
+	}{
+		{"full", FieldAll},
+		{"tuple-counters", FieldTuple | FieldCounters},
+		{"counters", FieldCounters},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var e Event
+				if err := e.unmarshalBinary(eb, true, bb.fields); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEventTriggerDir(t *testing.T) {
+
+	b := make([]byte, EventLength)
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, DirOriginal, e.TriggerDir)
+
+	b[97] = eventFlagReply
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.Equal(t, DirReply, e.TriggerDir)
+	assert.Equal(t, "reply", e.TriggerDir.String())
+
+	// Destroy events have no trigger and omit the field.
+	j, err := json.Marshal(Event{TriggerDir: DirReply})
+	require.NoError(t, err)
+	assert.Contains(t, string(j), `"trigger_dir":"reply"`)
+
+	j, err = json.Marshal(Event{})
+	require.NoError(t, err)
+	assert.NotContains(t, string(j), "trigger_dir")
+
+	var d Direction
+	require.NoError(t, d.UnmarshalText([]byte("original")))
+	assert.Equal(t, DirOriginal, d)
+	assert.Error(t, d.UnmarshalText([]byte("sideways")))
+}
+
+func TestEventProtoFields(t *testing.T) {
+
+	// Protocol-specific part of the tuple, as copied by the probe.
+	eventWithProto := func(proto uint8) []byte {
+		b := make([]byte, EventLength)
+		b[88], b[89] = 0x12, 0x34
+		b[90], b[91] = 8, 3
+		b[96] = proto
+		*(*uint32)(unsafe.Pointer(&b[108])) = 2
+		return b
+	}
+
+	for _, proto := range []uint8{6, 17, 33, 132, 136} {
+		var e Event
+		require.NoError(t, e.UnmarshalBinary(eventWithProto(proto)))
+		assert.EqualValues(t, 0x1234, e.SrcPort, "proto %d", proto)
+		assert.EqualValues(t, 0x0803, e.DstPort, "proto %d", proto)
+		assert.Zero(t, e.ICMPType, "proto %d", proto)
+		assert.Zero(t, e.ICMPID, "proto %d", proto)
+	}
+
+	for _, proto := range []uint8{1, 58} {
+		var e Event
+		require.NoError(t, e.UnmarshalBinary(eventWithProto(proto)))
+		assert.Zero(t, e.SrcPort, "proto %d", proto)
+		assert.Zero(t, e.DstPort, "proto %d", proto)
+		assert.EqualValues(t, 8, e.ICMPType, "proto %d", proto)
+		assert.EqualValues(t, 3, e.ICMPCode, "proto %d", proto)
+		assert.EqualValues(t, 0x1234, e.ICMPID, "proto %d", proto)
+		assert.Zero(t, e.SynCount, "proto %d", proto)
+	}
+
+	// Protocols without protocol-specific fields, like GRE and ESP.
+	for _, proto := range []uint8{47, 50} {
+		var e Event
+		require.NoError(t, e.UnmarshalBinary(eventWithProto(proto)))
+		assert.Zero(t, e.SrcPort, "proto %d", proto)
+		assert.Zero(t, e.DstPort, "proto %d", proto)
+		assert.Zero(t, e.ICMPType, "proto %d", proto)
+		assert.Zero(t, e.ICMPID, "proto %d", proto)
+		assert.Zero(t, e.SynCount, "proto %d", proto)
+	}
+
+	// Decoding into a reused Event clears the fields of the previous protocol.
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(eventWithProto(1)))
+	require.NoError(t, e.UnmarshalBinary(eventWithProto(6)))
+	assert.Zero(t, e.ICMPType)
+	assert.EqualValues(t, 2, e.SynCount)
+}
+
+func TestEventSchemaVersion(t *testing.T) {
+
+	e := Event{ConnectionID: 42, SrcAddr: net.IP{10, 0, 0, 1}, Delta: &Counters{BytesOrig: 1}}
+
+	// Marshaling values and pointers both include the version.
+	for _, v := range []interface{}{e, &e} {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+
+		var m map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &m))
+		assert.EqualValues(t, SchemaVersion, m["schema_version"])
+		assert.EqualValues(t, 42, m["connection_id"])
+		assert.Equal(t, "10.0.0.1", m["src_addr"])
+		assert.Equal(t, map[string]interface{}{
+			"packets_orig": 0.0, "bytes_orig": 1.0, "packets_ret": 0.0, "bytes_ret": 0.0,
+		}, m["delta"])
+
+		// The version is ignored when unmarshaling.
+		var out Event
+		require.NoError(t, json.Unmarshal(b, &out))
+		assert.Equal(t, e.ConnectionID, out.ConnectionID)
+		assert.Equal(t, *e.Delta, *out.Delta)
+	}
+}
+
+// schemaFields are the JSON fields of an Event at SchemaVersion.
+var schemaFields = []string{
+	"start", "timestamp", "connection_id", "connmark", "src_addr", "dst_addr",
+	"packets_orig", "bytes_orig", "packets_ret", "bytes_ret",
+	"src_port", "dst_port", "netns", "proto", "cpu",
+	"icmp_type", "icmp_code", "icmp_id", "type", "service",
+	"seen_reply", "assured", "status", "unaccounted", "trigger_dir",
+	"src_mac", "dst_mac", "seq",
+	"syn_count", "fin_count", "rst_count", "duration", "helper", "expected", "delta",
+	"bytes_orig_adjusted", "bytes_ret_adjusted", "bytes_in", "bytes_out",
+	"forwarded", "avg_bytes_per_sec", "labels", "time", "schema_version",
+}
+
+func TestEventSchemaFields(t *testing.T) {
+
+	// All fields set, so none are omitted.
+	e := Event{
+		ICMPType: 1, ICMPCode: 1, ICMPID: 1, Service: "dns", Unaccounted: true,
+		TriggerDir: DirReply, SynCount: 1, FinCount: 1, RstCount: 1, Duration: 1,
+		Helper: "ftp", Expected: true, Delta: &Counters{}, BytesOrigAdjusted: 1,
+		SrcMAC: MAC{0, 0, 0x5e, 0, 0x53, 1}, DstMAC: MAC{0, 0, 0x5e, 0, 0x53, 2},
+		BytesRetAdjusted: 1, BytesIn: 1, BytesOut: 1, Forwarded: true, AvgBytesPerSec: 1, Labels: map[string]string{"a": "b"},
+	}
+
+	b, err := json.Marshal(e)
+	require.NoError(t, err)
+
+	var m map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	var fields []string
+	for k := range m {
+		fields = append(fields, k)
+	}
+	assert.ElementsMatch(t, schemaFields, fields,
+		"fields of Event changed, bump SchemaVersion (%d) and update schemaFields", SchemaVersion)
+}
+
+func TestProtoString(t *testing.T) {
+
+	tests := []struct {
+		proto uint8
+		name  string
+	}{
+		{1, "icmp"},
+		{6, "tcp"},
+		{17, "udp"},
+		{47, "gre"},
+		{58, "icmp6"},
+		{132, "sctp"},
+		{136, "udplite"},
+		// Unknown protocols fall back to their number.
+		{0, "0"},
+		{253, "253"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.name, Proto(tt.proto).String())
+	}
+}
+
+func TestEventString(t *testing.T) {
+
+	e := Event{
+		ConnectionID: 42,
+		SrcAddr:      net.IPv4(10, 0, 0, 1),
+		DstAddr:      net.IPv4(10, 0, 0, 2),
+		DstPort:      53,
+		Proto:        17,
+		Type:         EventUpdate,
+	}
+
+	// Formatted like %+v, with the protocol's name.
+	s := e.String()
+	assert.Contains(t, s, " Proto:udp ")
+	assert.Equal(t, strings.Replace(fmt.Sprintf("%+v", e), " Proto:17 ", " Proto:udp ", 1), s)
+
+	// The numeric protocol remains on the Event.
+	assert.EqualValues(t, 17, e.Proto)
+
+	e.Proto = 253
+	assert.Contains(t, e.String(), " Proto:253 ")
+}
@@ -0,0 +1,120 @@
+package bpf
+
+import "fmt"
+
+// EventType is the kind of an accounting Event.
+type EventType uint8
+
+// Kinds of events emitted by the Probe.
+const (
+	// The first event of a flow, emitted when the probe first observes it.
+	// A new event is also the flow's first update event, and is delivered
+	// to consumers that want update events as well.
+	EventNew EventType = iota + 1
+	// A periodic update of a flow's counters.
+	EventUpdate
+	// The flow's totals, emitted when its conntrack entry is destroyed.
+	EventDestroy
+)
+
+// Flags of the event struct sent by BPF.
+const (
+	eventFlagNew         = 1 << 0
+	eventFlagSeenReply   = 1 << 1
+	eventFlagAssured     = 1 << 2
+	eventFlagUnaccounted = 1 << 3
+	eventFlagReply       = 1 << 4
+	eventFlagExpected    = 1 << 5
+)
+
+var eventTypeNames = map[EventType]string{
+	EventNew:     "new",
+	EventUpdate:  "update",
+	EventDestroy: "destroy",
+}
+
+// String returns the name of the EventType.
+func (t EventType) String() string {
+	if s, ok := eventTypeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("EventType(%d)", t)
+}
+
+// MarshalText marshals the EventType into its name.
+// The zero value is marshaled into an empty string.
+func (t EventType) MarshalText() ([]byte, error) {
+	if t == 0 {
+		return []byte{}, nil
+	}
+	if _, ok := eventTypeNames[t]; !ok {
+		return nil, fmt.Errorf("unknown event type %d", t)
+	}
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText unmarshals the name of an EventType.
+func (t *EventType) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*t = 0
+		return nil
+	}
+	for et, s := range eventTypeNames {
+		if s == string(b) {
+			*t = et
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type '%s'", b)
+}
+
+// Direction is the direction of a packet within its flow.
+type Direction uint8
+
+// Directions of a flow's packets.
+const (
+	// Sent by the flow's initiator.
+	DirOriginal Direction = iota + 1
+	// Sent in response to the flow's initiator.
+	DirReply
+)
+
+var directionNames = map[Direction]string{
+	DirOriginal: "original",
+	DirReply:    "reply",
+}
+
+// String returns the name of the Direction.
+func (d Direction) String() string {
+	if s, ok := directionNames[d]; ok {
+		return s
+	}
+	return fmt.Sprintf("Direction(%d)", d)
+}
+
+// MarshalText marshals the Direction into its name.
+// The zero value is marshaled into an empty string.
+func (d Direction) MarshalText() ([]byte, error) {
+	if d == 0 {
+		return []byte{}, nil
+	}
+	if _, ok := directionNames[d]; !ok {
+		return nil, fmt.Errorf("unknown direction %d", d)
+	}
+	return []byte(d.String()), nil
+}
+
+// UnmarshalText unmarshals the name of a Direction.
+func (d *Direction) UnmarshalText(b []byte) error {
+	if len(b) == 0 {
+		*d = 0
+		return nil
+	}
+	for dir, s := range directionNames {
+		if s == string(b) {
+			*d = dir
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown direction '%s'", b)
+}
@@ -0,0 +1,133 @@
+package bpf
+
+import "sync"
+
+// FakeProbe is a Source of events injected by the caller, for testing code
+// consuming events without a kernel. Events are delivered to its Consumers
+// the same way a Probe delivers them: according to the consumers' modes and
+// filters, without blocking on full channels.
+type FakeProbe struct {
+
+	// Probe holding the consumers, never loaded into the kernel.
+	probe *Probe
+
+	startMu sync.Mutex
+	started bool
+	errChan chan error
+}
+
+// NewFakeProbe returns a new FakeProbe.
+func NewFakeProbe() *FakeProbe {
+	return &FakeProbe{
+		probe: &Probe{stats: &ProbeStats{}},
+	}
+}
+
+// RegisterConsumer registers a Consumer in the FakeProbe.
+func (fp *FakeProbe) RegisterConsumer(ac *Consumer) error {
+	return fp.probe.RegisterConsumer(ac)
+}
+
+// RemoveConsumer removes a Consumer from the FakeProbe.
+func (fp *FakeProbe) RemoveConsumer(ac *Consumer) error {
+	return fp.probe.RemoveConsumer(ac)
+}
+
+// Start marks the FakeProbe as started and creates its error channel.
+func (fp *FakeProbe) Start() error {
+
+	fp.startMu.Lock()
+	defer fp.startMu.Unlock()
+
+	if fp.started {
+		return errProbeStarted
+	}
+
+	fp.errChan = make(chan error)
+	fp.probe.errSubs.reopen()
+	fp.started = true
+
+	return nil
+}
+
+// Stop marks the FakeProbe as stopped and closes its error channel.
+func (fp *FakeProbe) Stop() error {
+
+	fp.startMu.Lock()
+	defer fp.startMu.Unlock()
+
+	if !fp.started {
+		return errProbeNotStarted
+	}
+
+	close(fp.errChan)
+	fp.probe.errSubs.close()
+	fp.started = false
+
+	return nil
+}
+
+// ErrChan returns the FakeProbe's unbuffered error channel.
+// Returns nil if the FakeProbe has not been Start()ed yet.
+func (fp *FakeProbe) ErrChan() chan error {
+	fp.startMu.Lock()
+	defer fp.startMu.Unlock()
+	return fp.errChan
+}
+
+// Errors returns a channel receiving the FakeProbe's errors of at least the
+// given severity. Like the Probe's, it is closed when the FakeProbe is stopped.
+func (fp *FakeProbe) Errors(min Severity) <-chan *ProbeError {
+	return fp.probe.errSubs.add(min)
+}
+
+// Inject delivers the given events to all registered consumers wanting
+// their type, like the Probe does with events read from the kernel.
+// Events without a Type are delivered as update events.
+func (fp *FakeProbe) Inject(evs ...Event) {
+	for _, e := range evs {
+		if e.Type == 0 {
+			e.Type = EventUpdate
+		}
+		if e.Type == EventDestroy {
+			fp.probe.stats.incrPerfEventsDestroy()
+		} else {
+			fp.probe.stats.incrPerfEventsUpdate()
+		}
+		fp.probe.fanoutEvent(e)
+	}
+}
+
+// SendError sends an error on the FakeProbe's error channels. Errors other
+// than a *ProbeError are sent as a recoverable ProbeError of SeverityError.
+// Like the Probe, the error is dropped from ErrChan if there is no receiver
+// ready. Returns true if the error was received on ErrChan. No-op if the
+// FakeProbe is not started.
+func (fp *FakeProbe) SendError(err error) bool {
+
+	fp.startMu.Lock()
+	defer fp.startMu.Unlock()
+
+	if !fp.started {
+		return false
+	}
+
+	pe, ok := err.(*ProbeError)
+	if !ok {
+		pe = newProbeError("", SeverityError, err)
+	}
+	fp.probe.errSubs.send(pe)
+
+	select {
+	case fp.errChan <- pe:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stats returns a snapshot copy of the FakeProbe's statistics,
+// counting the injected events.
+func (fp *FakeProbe) Stats() ProbeStats {
+	return fp.probe.Stats()
+}
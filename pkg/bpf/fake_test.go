@@ -0,0 +1,164 @@
+package bpf_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/internal/sinks/dummy"
+	"github.com/ti-mo/conntracct/internal/sinks/types"
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// forwardDestroys is an example of code consuming events. It pushes the
+// destroy events of a started Source to a sink in the background, until the
+// Source is stopped. The returned channel receives the result of removing
+// the consumer from the Source.
+func forwardDestroys(src bpf.Source, push func(bpf.Event)) (<-chan error, error) {
+
+	events := make(chan bpf.Event, 16)
+	c := bpf.NewConsumer("forward", events, bpf.ConsumerDestroy)
+	if err := src.RegisterConsumer(c); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	errs := src.ErrChan()
+
+	go func() {
+		for {
+			select {
+			case e := <-events:
+				push(e)
+			case _, ok := <-errs:
+				if ok {
+					continue
+				}
+				// Deliver events pending at the time of the stop.
+				for len(events) > 0 {
+					push(<-events)
+				}
+				done <- src.RemoveConsumer(c)
+				return
+			}
+		}
+	}()
+
+	return done, nil
+}
+
+func ExampleFakeProbe() {
+
+	fp := bpf.NewFakeProbe()
+	if err := fp.Start(); err != nil {
+		panic(err)
+	}
+
+	sink := dummy.New()
+	_ = sink.Init(types.SinkConfig{Name: "example", Type: types.Dummy})
+
+	done, err := forwardDestroys(fp, sink.Push)
+	if err != nil {
+		panic(err)
+	}
+
+	// Inject the events of a single flow.
+	fp.Inject(
+		bpf.Event{ConnectionID: 1, PacketsOrig: 1, Type: bpf.EventNew},
+		bpf.Event{ConnectionID: 1, PacketsOrig: 2},
+		bpf.Event{ConnectionID: 1, PacketsOrig: 3, Type: bpf.EventDestroy},
+	)
+
+	_ = fp.Stop()
+	if err := <-done; err != nil {
+		panic(err)
+	}
+
+	fmt.Println("events pushed to sink:", sink.Stats().EventsPushed)
+	// Output: events pushed to sink: 1
+}
+
+func TestFakeProbe(t *testing.T) {
+
+	fp := bpf.NewFakeProbe()
+	assert.Nil(t, fp.ErrChan())
+	assert.Error(t, fp.Stop(), "stop before start")
+
+	all := make(chan bpf.Event, 4)
+	ac := bpf.NewConsumer("all", all, bpf.ConsumerAll)
+	require.NoError(t, fp.RegisterConsumer(ac))
+	assert.Error(t, fp.RegisterConsumer(bpf.NewConsumer("all", nil, 0)), "duplicate name")
+
+	upd := make(chan bpf.Event, 4)
+	uc := bpf.NewConsumer("update", upd, bpf.ConsumerUpdate)
+	uc.SetFilter(func(e bpf.Event) bool { return e.Proto == 17 })
+	require.NoError(t, fp.RegisterConsumer(uc))
+
+	fp.Inject(
+		bpf.Event{ConnectionID: 1, Proto: 17},
+		bpf.Event{ConnectionID: 2, Proto: 6},
+		bpf.Event{ConnectionID: 1, Proto: 17, Type: bpf.EventDestroy},
+	)
+
+	// Events without a type are delivered as updates.
+	require.Len(t, all, 3)
+	assert.Equal(t, bpf.EventUpdate, (<-all).Type)
+
+	// Consumer modes and filters are applied.
+	require.Len(t, upd, 1)
+	assert.EqualValues(t, 1, (<-upd).ConnectionID)
+
+	st := fp.Stats()
+	assert.EqualValues(t, 2, st.PerfEventsUpdate)
+	assert.EqualValues(t, 1, st.PerfEventsDestroy)
+
+	// Events are dropped for full consumer channels.
+	for i := 0; i < 4; i++ {
+		fp.Inject(bpf.Event{})
+	}
+	assert.EqualValues(t, 2, ac.Stats().Get().EventsLost)
+
+	require.NoError(t, fp.RemoveConsumer(uc))
+	assert.Error(t, fp.RemoveConsumer(uc))
+
+	// Errors are only delivered to a ready receiver.
+	require.NoError(t, fp.Start())
+	assert.Error(t, fp.Start(), "double start")
+	errInjected := errors.New("injected")
+	assert.False(t, fp.SendError(errInjected))
+
+	received := make(chan error)
+	go func() { received <- <-fp.ErrChan() }()
+	for !fp.SendError(errInjected) {
+	}
+	pe, ok := (<-received).(*bpf.ProbeError)
+	require.True(t, ok, "error is a ProbeError")
+	assert.Equal(t, errInjected, pe.Err)
+
+	require.NoError(t, fp.Stop())
+	_, ok = <-fp.ErrChan()
+	assert.False(t, ok, "error channel not closed")
+	assert.False(t, fp.SendError(errInjected))
+}
+
+func TestFakeProbeErrors(t *testing.T) {
+
+	fp := bpf.NewFakeProbe()
+	fatal := fp.Errors(bpf.SeverityFatal)
+	require.NoError(t, fp.Start())
+
+	// Plain errors are recoverable.
+	fp.SendError(errors.New("decoding failed"))
+	fp.SendError(&bpf.ProbeError{Err: errors.New("lost"), Severity: bpf.SeverityFatal})
+
+	pe := <-fatal
+	assert.Equal(t, "lost", pe.Error())
+	assert.Len(t, fatal, 0, "recoverable error sent to fatal subscriber")
+
+	require.NoError(t, fp.Stop())
+	_, ok := <-fatal
+	assert.False(t, ok, "subscription not closed")
+}
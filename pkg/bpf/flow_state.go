@@ -0,0 +1,245 @@
+package bpf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// Version of the layout of flow state files, see Config.StateFile.
+const flowStateVersion = 1
+
+// Maps of the acct probe holding the state of each flow between its events:
+// its next update deadline and first event's timestamp, its last sequence
+// number and its TCP flag counters. The maps are keyed by conntrack entry.
+var flowStateMaps = []string{"nextupd", "flowseq", "tcpflags"}
+
+// Index of the tracked flow counter in the probe's counters map.
+var counterFlows = uint32(0)
+
+// File holding the kernel's random identifier of the current boot.
+var bootIDPath = "/proc/sys/kernel/random/boot_id"
+
+// flowStateFile is the content of a flow state file.
+type flowStateFile struct {
+	Version int `json:"version"`
+
+	// Boot the state was saved in. The maps' keys and timestamps are
+	// only meaningful within the same boot.
+	BootID string `json:"boot_id"`
+
+	Time time.Time      `json:"time"`
+	Maps []flowStateMap `json:"maps"`
+}
+
+// flowStateMap holds the raw entries of one of the probe's flow state maps.
+type flowStateMap struct {
+	Name      string           `json:"name"`
+	KeySize   uint32           `json:"key_size"`
+	ValueSize uint32           `json:"value_size"`
+	Entries   []flowStateEntry `json:"entries"`
+}
+
+// flowStateEntry is a key and value of a flow state map.
+type flowStateEntry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// bootID returns the identifier of the current boot.
+func bootID() (string, error) {
+	b, err := ioutil.ReadFile(bootIDPath)
+	if err != nil {
+		return "", errors.Wrap(err, "reading boot ID")
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// saveFlowState writes the entries of the module's flow state maps to path.
+func saveFlowState(mod bpfModule, path string) error {
+
+	id, err := bootID()
+	if err != nil {
+		return err
+	}
+
+	fs := flowStateFile{
+		Version: flowStateVersion,
+		BootID:  id,
+		Time:    time.Now(),
+	}
+
+	for _, name := range flowStateMaps {
+		fd, ok := mod.mapFd(name)
+		if !ok {
+			continue
+		}
+
+		m, err := dumpMap(fd)
+		if err != nil {
+			return errors.Wrapf(err, "reading map %s", name)
+		}
+		m.Name = name
+
+		fs.Maps = append(fs.Maps, m)
+	}
+
+	b, err := json.Marshal(fs)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a partially
+	// written state file is never read after a crash.
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// readFlowState reads the flow state file at path. Returns nil if the file
+// doesn't exist, or if it was saved by a different version or in a previous
+// boot, since its state can't be restored.
+func readFlowState(path string) (*flowStateFile, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var fs flowStateFile
+	if err := json.Unmarshal(b, &fs); err != nil {
+		return nil, errors.Wrapf(err, "decoding %s", path)
+	}
+
+	id, err := bootID()
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.Version != flowStateVersion || fs.BootID != id {
+		return nil, nil
+	}
+
+	return &fs, nil
+}
+
+// restoreFlowState inserts the entries of the flow state file at path into the
+// module's flow state maps, and returns the amount of flows restored. Maps of
+// which the key or value size changed since the state was saved, eg. by an
+// upgrade of the probe, are not restored. Once a map is full, its remaining
+// entries are discarded.
+func restoreFlowState(mod bpfModule, path string) (int, error) {
+
+	fs, err := readFlowState(path)
+	if err != nil || fs == nil {
+		return 0, err
+	}
+
+	var flows int
+	for _, m := range fs.Maps {
+		fd, ok := mod.mapFd(m.Name)
+		if !ok {
+			continue
+		}
+
+		info, err := bpfGetMapInfo(fd)
+		if err != nil {
+			return 0, errors.Wrapf(err, "getting info of map %s", m.Name)
+		}
+		if info.KeySize != m.KeySize || info.ValueSize != m.ValueSize {
+			continue
+		}
+
+		var n int
+		for _, e := range m.Entries {
+			if uint32(len(e.Key)) != m.KeySize || uint32(len(e.Value)) != m.ValueSize {
+				return 0, errors.Errorf("entry of map %s has the wrong size", m.Name)
+			}
+
+			err := bpfUpdateElem(fd, unsafe.Pointer(&e.Key[0]), unsafe.Pointer(&e.Value[0]))
+			if err == unix.E2BIG || err == unix.ENOMEM {
+				break
+			}
+			if err != nil {
+				return 0, errors.Wrapf(err, "restoring map %s", m.Name)
+			}
+			n++
+		}
+
+		if m.Name == "nextupd" {
+			flows = n
+			if err := addCounter(mod, counterFlows, uint64(n)); err != nil {
+				return 0, errors.Wrap(err, "restoring flow counter")
+			}
+		}
+	}
+
+	return flows, nil
+}
+
+// dumpMap returns the entries of the hash map with the given fd. Entries
+// deleted while the map is read are skipped.
+func dumpMap(fd int) (flowStateMap, error) {
+
+	info, err := bpfGetMapInfo(fd)
+	if err != nil {
+		return flowStateMap{}, err
+	}
+
+	m := flowStateMap{KeySize: info.KeySize, ValueSize: info.ValueSize}
+
+	err = walkMapKeys(fd, info, func(key []byte) error {
+		value := make([]byte, info.ValueSize)
+		err := bpfMapCall(bpfMapLookupElem, fd, key, value)
+		if err == unix.ENOENT {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		m.Entries = append(m.Entries, flowStateEntry{
+			Key:   append([]byte(nil), key...),
+			Value: value,
+		})
+		return nil
+	})
+
+	return m, err
+}
+
+// addCounter adds n to the value at index idx of the module's counters map.
+// Does nothing if the module has no counters map.
+func addCounter(mod bpfModule, idx uint32, n uint64) error {
+
+	fd, ok := mod.mapFd("counters")
+	if !ok {
+		return nil
+	}
+
+	v, err := readCounter(mod, idx)
+	if err != nil {
+		return err
+	}
+	v += n
+
+	return bpfUpdateElem(fd, unsafe.Pointer(&idx), unsafe.Pointer(&v))
+}
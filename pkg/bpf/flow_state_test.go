@@ -0,0 +1,123 @@
+package bpf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withBootID points bootIDPath to a file in dir holding id, and returns
+// a function restoring it.
+func withBootID(t *testing.T, dir, id string) func() {
+	path := filepath.Join(dir, "boot_id")
+	require.NoError(t, ioutil.WriteFile(path, []byte(id+"\n"), 0600))
+
+	prev := bootIDPath
+	bootIDPath = path
+	return func() { bootIDPath = prev }
+}
+
+func writeFlowState(t *testing.T, path string, fs flowStateFile) {
+	b, err := json.Marshal(fs)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, b, 0600))
+}
+
+func TestReadFlowState(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-flowstate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer withBootID(t, dir, "boot-a")()
+
+	path := filepath.Join(dir, "state.json")
+
+	// A missing file has no state to restore.
+	fs, err := readFlowState(path)
+	require.NoError(t, err)
+	assert.Nil(t, fs)
+
+	maps := []flowStateMap{{
+		Name: "nextupd", KeySize: 4, ValueSize: 16,
+		Entries: []flowStateEntry{{Key: make([]byte, 4), Value: make([]byte, 16)}},
+	}}
+
+	writeFlowState(t, path, flowStateFile{Version: flowStateVersion, BootID: "boot-a", Maps: maps})
+	fs, err = readFlowState(path)
+	require.NoError(t, err)
+	require.NotNil(t, fs)
+	assert.Equal(t, maps, fs.Maps)
+
+	// State of a previous boot or another version is ignored.
+	writeFlowState(t, path, flowStateFile{Version: flowStateVersion, BootID: "boot-b", Maps: maps})
+	fs, err = readFlowState(path)
+	require.NoError(t, err)
+	assert.Nil(t, fs)
+
+	writeFlowState(t, path, flowStateFile{Version: flowStateVersion + 1, BootID: "boot-a", Maps: maps})
+	fs, err = readFlowState(path)
+	require.NoError(t, err)
+	assert.Nil(t, fs)
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+	_, err = readFlowState(path)
+	assert.Error(t, err)
+}
+
+func TestProbeStateFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-flowstate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer withBootID(t, dir, "boot-a")()
+
+	path := filepath.Join(dir, "state.json")
+	writeFlowState(t, path, flowStateFile{Version: flowStateVersion, BootID: "boot-a"})
+
+	var mods []*fakeModule
+	ap := newFakeProbe("", &mods)
+	ap.stateFile = path
+
+	// The state file is removed once restored.
+	require.NoError(t, ap.Start())
+	assert.Zero(t, ap.RestoredFlows())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	// And saved again when the probe is stopped.
+	require.NoError(t, ap.Stop())
+	fs, err := readFlowState(path)
+	require.NoError(t, err)
+	require.NotNil(t, fs)
+	assert.Equal(t, "boot-a", fs.BootID)
+	assert.False(t, fs.Time.IsZero())
+}
+
+func TestProbeStateFileCorrupt(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-flowstate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer withBootID(t, dir, "boot-a")()
+
+	path := filepath.Join(dir, "state.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("{"), 0600))
+
+	var mods []*fakeModule
+	ap := newFakeProbe("", &mods)
+	ap.stateFile = path
+
+	// The probe isn't started, and is unwound like on a failure to attach.
+	err = ap.Start()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "restoring flow state")
+	assert.False(t, ap.started)
+	require.Len(t, mods, 2)
+	assert.Equal(t, 1, mods[0].closed)
+	assert.Equal(t, ap.module, mods[1])
+}
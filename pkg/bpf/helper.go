@@ -65,3 +65,62 @@ func checkProbeKsyms(probes []string) error {
 
 	return nil
 }
+
+// eventSymbols holds the kernel symbol probed for each kind of event.
+// New flows are detected by the probe on their first update.
+var eventSymbols = map[EventType]string{
+	EventNew:     "__nf_ct_refresh_acct",
+	EventUpdate:  "__nf_ct_refresh_acct",
+	EventDestroy: "nf_conntrack_free",
+}
+
+// checkEventTypes returns an error if any of the events is not a known kind.
+func checkEventTypes(events []EventType) error {
+
+	for _, et := range events {
+		if _, ok := eventSymbols[et]; !ok {
+			return fmt.Errorf(errFmtEventType, et)
+		}
+	}
+
+	return nil
+}
+
+// wantsEvent returns true if the events contain t, or if no events are given.
+func wantsEvent(events []EventType, t EventType) bool {
+
+	if len(events) == 0 {
+		return true
+	}
+
+	for _, et := range events {
+		if et == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// eventKprobes returns the k(ret)probes needed to emit the given kinds of
+// events, in the order they appear in probes. Returns all probes if no events
+// are given.
+func eventKprobes(probes []string, events []EventType) []string {
+
+	if len(events) == 0 {
+		return probes
+	}
+
+	var out []string
+	for _, p := range probes {
+		ps := strings.Split(p, "/")
+		for _, et := range events {
+			if len(ps) == 2 && ps[1] == eventSymbols[et] {
+				out = append(out, p)
+				break
+			}
+		}
+	}
+
+	return out
+}
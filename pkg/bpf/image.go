@@ -0,0 +1,84 @@
+package bpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Sections of the acct probe's ELF object used by its userspace: the kprobes
+// attached by the Probe, and the maps it configures, reads or saves.
+var imageSections = []string{
+	"kprobe/__nf_ct_refresh_acct",
+	"kretprobe/__nf_ct_refresh_acct",
+	"kprobe/nf_conntrack_free",
+	"maps/perf_acct_update",
+	"maps/perf_acct_end",
+	"maps/nextupd",
+	"maps/filtered",
+	"maps/currct",
+	"maps/flowseq",
+	"maps/tcpflags",
+	"maps/config",
+	"maps/counters",
+	"maps/dstports",
+	"maps/srcports",
+}
+
+// checkImage verifies that the ELF image of a probe was built from the same
+// version of acct.c as its userspace. The objects embedded in the package are
+// built separately, and an outdated object loads fine, but sends events of
+// a different layout that are all dropped as malformed.
+func checkImage(image []byte) error {
+
+	f, err := elf.NewFile(bytes.NewReader(image))
+	if err != nil {
+		return errors.Wrap(err, "reading ELF image")
+	}
+	defer f.Close()
+
+	if missing := missingSections(f, imageSections); len(missing) != 0 {
+		return fmt.Errorf(errFmtImageSections, strings.Join(missing, ", "))
+	}
+
+	n, err := mapMaxEntries(f.Section("maps/config"))
+	if err != nil {
+		return errors.Wrap(err, "reading config map")
+	}
+	// The config map needs room for all keys written by configureProbe.
+	if want := uint32(configUnaccounted + 1); n < want {
+		return fmt.Errorf(errFmtImageConfig, n, want)
+	}
+
+	return nil
+}
+
+// missingSections returns the names of the sections not present in f.
+func missingSections(f *elf.File, names []string) []string {
+
+	var missing []string
+	for _, n := range names {
+		if f.Section(n) == nil {
+			missing = append(missing, n)
+		}
+	}
+
+	return missing
+}
+
+// mapMaxEntries returns the max_entries field of the bpf_map_def in the
+// given map section, following its type, key_size and value_size.
+func mapMaxEntries(s *elf.Section) (uint32, error) {
+
+	var def [4]uint32
+	if err := binary.Read(io.NewSectionReader(s, 0, 16), binary.LittleEndian, &def); err != nil {
+		return 0, err
+	}
+
+	return def[3], nil
+}
@@ -0,0 +1,139 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testImage returns a relocatable ELF64 object holding a section of the given
+// name for each key of sections, with the section's value as its content.
+func testImage(sections map[string][]byte) []byte {
+
+	const ehsize, shentsize = 64, 64
+
+	names := []string{""}
+	for n := range sections {
+		names = append(names, n)
+	}
+	names = append(names, ".shstrtab")
+
+	// Section name string table, starting with the empty name.
+	var strtab bytes.Buffer
+	offs := make([]uint32, len(names))
+	for i, n := range names {
+		if n == "" {
+			strtab.WriteByte(0)
+			continue
+		}
+		offs[i] = uint32(strtab.Len())
+		strtab.WriteString(n)
+		strtab.WriteByte(0)
+	}
+
+	// Section contents follow the ELF header, then the section headers.
+	var data bytes.Buffer
+	pos := make([]uint64, len(names))
+	for i, n := range names {
+		pos[i] = uint64(ehsize + data.Len())
+		switch n {
+		case "":
+		case ".shstrtab":
+			data.Write(strtab.Bytes())
+		default:
+			data.Write(sections[n])
+		}
+	}
+
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	w := func(v interface{}) { _ = binary.Write(&b, le, v) }
+
+	// ELF header: ELFCLASS64, ELFDATA2LSB, EV_CURRENT, ET_REL, EM_BPF.
+	b.Write([]byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0})
+	b.Write(make([]byte, 8))
+	w(uint16(1))
+	w(uint16(247))
+	w(uint32(1))
+	w(uint64(0))                   // entry
+	w(uint64(0))                   // phoff
+	w(uint64(ehsize + data.Len())) // shoff
+	w(uint32(0))                   // flags
+	w(uint16(ehsize))              // ehsize
+	w(uint16(0))                   // phentsize
+	w(uint16(0))                   // phnum
+	w(uint16(shentsize))           // shentsize
+	w(uint16(len(names)))          // shnum
+	w(uint16(len(names) - 1))      // shstrndx
+
+	b.Write(data.Bytes())
+
+	for i, n := range names {
+		if n == "" {
+			b.Write(make([]byte, shentsize))
+			continue
+		}
+
+		size := uint64(len(sections[n]))
+		typ := uint32(1) // SHT_PROGBITS
+		if n == ".shstrtab" {
+			size = uint64(strtab.Len())
+			typ = 3 // SHT_STRTAB
+		}
+
+		w(offs[i])
+		w(typ)
+		w(uint64(0)) // flags
+		w(uint64(0)) // addr
+		w(pos[i])
+		w(size)
+		w(uint32(0)) // link
+		w(uint32(0)) // info
+		w(uint64(1)) // addralign
+		w(uint64(0)) // entsize
+	}
+
+	return b.Bytes()
+}
+
+// testMapDef returns a bpf_map_def with the given max_entries.
+func testMapDef(maxEntries uint32) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, [6]uint32{1, 4, 8, maxEntries, 0, 0})
+	return b.Bytes()
+}
+
+// testSections returns the sections of an up-to-date probe object.
+func testSections() map[string][]byte {
+	s := make(map[string][]byte)
+	for _, n := range imageSections {
+		s[n] = testMapDef(1024)
+	}
+	s["maps/config"] = testMapDef(7)
+	return s
+}
+
+func TestCheckImage(t *testing.T) {
+
+	require.NoError(t, checkImage(testImage(testSections())))
+
+	// An object built before the probe counted flows and numbered events.
+	s := testSections()
+	delete(s, "maps/counters")
+	delete(s, "maps/flowseq")
+	err := checkImage(testImage(s))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing sections maps/flowseq, maps/counters")
+	assert.Contains(t, err.Error(), "mage bpf:build")
+
+	// An object without room for all config keys.
+	s = testSections()
+	s["maps/config"] = testMapDef(1)
+	assert.EqualError(t, checkImage(testImage(s)), "config map of 1 entries, expected at least 7: "+
+		"the probe's object is older than its userspace, rebuild it with 'mage bpf:build'")
+
+	assert.Error(t, checkImage([]byte("not an ELF object")))
+}
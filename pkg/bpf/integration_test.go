@@ -3,17 +3,27 @@
 package bpf
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"sort"
 	"syscall"
 	"testing"
 	"time"
+	"unsafe"
 
+	"github.com/iovisor/gobpf/elf"
+	"github.com/iovisor/gobpf/pkg/bpffs"
+	"github.com/iovisor/gobpf/pkg/cpuonline"
+	sysctl "github.com/lorenzosaino/go-sysctl"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/conntracct/pkg/kernel"
 	"github.com/ti-mo/conntracct/pkg/udpecho"
 	"golang.org/x/sys/unix"
 )
@@ -22,6 +32,9 @@ import (
 const (
 	udpServ = 1342
 	cd      = 20
+
+	// Listen port of a mock UDP server that is not in the probe's port filter.
+	udpServFiltered = 1343
 )
 
 var (
@@ -39,6 +52,15 @@ func TestMain(m *testing.M) {
 		// but long enough to allow startup burst to occur without
 		// injecting unwanted events. (eg. on slower machines)
 		CooldownMillis: cd,
+
+		// Only account for flows to the mock UDP server.
+		DstPortFilter: []uint16{udpServ},
+
+		// Number events within their flow.
+		Sequence: true,
+
+		// Count the SYN, FIN and RST packets of TCP flows.
+		TCPFlags: true,
 	}
 
 	// Set the required sysctl's for the probe to gather accounting data.
@@ -110,9 +132,27 @@ func TestProbeStartup(t *testing.T) {
 	ev, err = readTimeout(out, 10)
 	assert.EqualError(t, err, "timeout", ev.String())
 
+	// The loaded object sends events of the layout decoded by userspace.
+	assert.Zero(t, acctProbe.Stats().PerfEventsMalformed)
+
 	require.NoError(t, acctProbe.RemoveConsumer(ac))
 }
 
+// Embedded objects of all kernel builds were built from the current acct.c.
+func TestProbeImages(t *testing.T) {
+
+	for _, k := range kernel.Builds {
+		br, _, err := Select(k.Version)
+		require.NoError(t, err)
+
+		image := make([]byte, br.Len())
+		_, err = br.Read(image)
+		require.NoError(t, err)
+
+		assert.NoError(t, checkImage(image), k.Version)
+	}
+}
+
 // Runs past the 'connection startup burst' events and tries to obtain two
 // events generated by sending packets right after the flow's cooldown timer
 // expires.
@@ -200,41 +240,1338 @@ func TestProbeVerify(t *testing.T) {
 	// Connection tuple
 	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
 	assert.EqualValues(t, mc.ClientPort(), ev.SrcPort, ev.String())
-	assert.EqualValues(t, net.IPv4(127, 0, 0, 1), ev.SrcAddr, ev.String())
-	assert.EqualValues(t, net.IPv4(127, 0, 0, 1), ev.DstAddr, ev.String())
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.SrcAddr, ev.String())
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.DstAddr, ev.String())
 	assert.EqualValues(t, 17, ev.Proto, ev.String())
 
 	require.NoError(t, acctProbe.RemoveConsumer(ac))
 }
 
-// filterSourcePort returns an unbuffered channel of Events
-// that has its event stream filtered by the given source port.
-func filterSourcePort(in chan Event, port uint16) chan Event {
+// Verifies the fields of a TCP flow's first event, like TestProbeVerify.
+func TestProbeVerifyTCP(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", udpServ))
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Hold on to the accepted connection until the test ends.
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	defer func() {
+		select {
+		case c := <-accepted:
+			c.Close()
+		default:
+		}
+	}()
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	laddr := c.LocalAddr().(*net.TCPAddr)
+
 	out := make(chan Event)
-	go filterWorker(in, out,
-		func(ev Event) bool {
-			if ev.SrcPort == port {
-				return true
-			}
-			return false
-		})
+	go filterWorker(in, out, func(ev Event) bool {
+		return ev.Proto == 6 && ev.SrcPort == uint16(laddr.Port)
+	})
 
-	return out
+	// The flow's first event is sent for the client's SYN.
+	ev, err := readTimeout(out, 20)
+	require.NoError(t, err)
+
+	ns, err := getNSID()
+	require.NoError(t, err)
+	assert.EqualValues(t, ns, ev.NetNS, ev.String())
+	assert.EqualValues(t, 0, ev.Connmark, ev.String())
+
+	// A SYN without payload, the IP header and TCP header with options.
+	assert.EqualValues(t, 1, ev.PacketsOrig, ev.String())
+	assert.True(t, ev.BytesOrig > 40, ev.String())
+	assert.EqualValues(t, 0, ev.PacketsRet, ev.String())
+
+	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
+	assert.EqualValues(t, laddr.Port, ev.SrcPort, ev.String())
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.SrcAddr, ev.String())
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.DstAddr, ev.String())
+	assert.EqualValues(t, 6, ev.Proto, ev.String())
+	assert.EqualValues(t, 1, ev.SynCount, ev.String())
+
+	// No ICMP fields for TCP flows.
+	assert.Zero(t, ev.ICMPType, ev.String())
+	assert.Zero(t, ev.ICMPCode, ev.String())
+	assert.Zero(t, ev.ICMPID, ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
 }
 
-// filterWorker sends an Event from in to out if the given function f yields true.
-func filterWorker(in <-chan Event, out chan<- Event, f func(Event) bool) {
-	for {
-		ev, ok := <-in
-		if !ok {
-			close(out)
-			return
+// Verifies the fields of an ICMP echo request flow's first event, like
+// TestProbeVerify. The ICMP identifier, type and code are stored in place
+// of the ports in the flow's tuple, and must not be decoded as ports.
+func TestProbeVerifyICMP(t *testing.T) {
+
+	// ICMP flows have no ports, so they never match the
+	// port filter of the suite's probe. Load one without.
+	ap, err := NewProbe(Config{CooldownMillis: cd})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+	defer ap.Stop()
+
+	in := make(chan Event, 2048)
+	ac := NewConsumer(t.Name(), in, ConsumerUpdate)
+	require.NoError(t, ap.RegisterConsumer(ac))
+	defer ac.Close()
+
+	fac, fin := newUpdateConsumer(t)
+	defer fac.Close()
+
+	const id = 0x1342
+	payload := []byte("ping")
+
+	out := make(chan Event)
+	go filterWorker(in, out, func(ev Event) bool {
+		return ev.Proto == 1 && ev.ICMPID == id
+	})
+	fout := make(chan Event)
+	go filterWorker(fin, fout, func(ev Event) bool {
+		return ev.Proto == 1
+	})
+
+	c, err := net.ListenPacket("ip4:icmp", "127.0.0.1")
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.WriteTo(icmpEcho(id, 1, payload), &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+
+	ev, err := readTimeout(out, 20)
+	require.NoError(t, err)
+
+	ns, err := getNSID()
+	require.NoError(t, err)
+	assert.EqualValues(t, ns, ev.NetNS, ev.String())
+	assert.EqualValues(t, 0, ev.Connmark, ev.String())
+
+	// The IP header, ICMP header and payload.
+	assert.EqualValues(t, 1, ev.PacketsOrig, ev.String())
+	assert.EqualValues(t, 20+8+len(payload), ev.BytesOrig, ev.String())
+
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.SrcAddr, ev.String())
+	assert.EqualValues(t, net.IPv4(127, 0, 0, 1).To4(), ev.DstAddr, ev.String())
+	assert.EqualValues(t, 1, ev.Proto, ev.String())
+	assert.EqualValues(t, 8, ev.ICMPType, ev.String()) // echo request
+	assert.EqualValues(t, 0, ev.ICMPCode, ev.String())
+	assert.EqualValues(t, id, ev.ICMPID, ev.String())
+
+	// No ports or TCP flags for ICMP flows.
+	assert.Zero(t, ev.SrcPort, ev.String())
+	assert.Zero(t, ev.DstPort, ev.String())
+	assert.Zero(t, ev.SynCount, ev.String())
+
+	// The suite's probe filters on ports, and doesn't account for the flow.
+	ev, err = readTimeout(fout, 20)
+	assert.EqualError(t, err, "timeout", ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(fac))
+}
+
+// Generates a one-way flow (no replies, like with asymmetric routing) and
+// verifies its events are emitted like those of a two-way flow.
+func TestProbeOneWay(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	// Create UDP client.
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	// Filter BPF Events based on client port.
+	out := filterSourcePort(in, mc.ClientPort())
+
+	for i := uint64(1); i <= 3; i++ {
+		mc.Nop(1)
+
+		ev, err := readTimeout(out, 20)
+		require.NoError(t, err, "no event for packet %d", i)
+		assert.Equal(t, i, ev.PacketsOrig, ev.String())
+		assert.Equal(t, 31*i, ev.BytesOrig, ev.String())
+		assert.Zero(t, ev.PacketsRet, ev.String())
+		assert.Zero(t, ev.BytesRet, ev.String())
+		assert.False(t, ev.SeenReply, ev.String())
+
+		// Wait for the flow's cooldown to expire.
+		time.Sleep(cd * time.Millisecond)
+	}
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Sends a single packet and lets the flow expire before it can send an update
+// after the startup burst. Verifies the flow's destroy event carries the
+// totals of the packet actually sent, equal to those of its only update.
+func TestProbeDestroyShortFlow(t *testing.T) {
+
+	// Let UDP flows expire quickly. The timeout is applied to a flow
+	// when it is refreshed, so set it before sending any packets.
+	const timeoutKey = "net.netfilter.nf_conntrack_udp_timeout"
+	timeout, err := sysctl.Get(timeoutKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(timeoutKey, "1"))
+	defer func() {
+		require.NoError(t, sysctl.Set(timeoutKey, timeout))
+	}()
+
+	uc := make(chan Event, 2048)
+	uac := NewConsumer(t.Name()+"-update", uc, ConsumerUpdate)
+	require.NoError(t, acctProbe.RegisterConsumer(uac))
+	defer uac.Close()
+
+	dc := make(chan Event, 2048)
+	dac := NewConsumer(t.Name()+"-destroy", dc, ConsumerDestroy)
+	require.NoError(t, acctProbe.RegisterConsumer(dac))
+	defer dac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	uout := filterSourcePort(uc, mc.ClientPort())
+	dout := filterSourcePort(dc, mc.ClientPort())
+
+	// A single packet with a 4-byte payload behind an IPv4 and a UDP header,
+	// without a reply. The flow never leaves its startup burst.
+	const bytes = 20 + 8 + 4
+	mc.Nop(1)
+
+	up, err := readTimeout(uout, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, EventNew, up.Type, up.String())
+
+	// Looking up the expired flow makes conntrack destroy it,
+	// the packet is accounted to a new flow.
+	time.Sleep(1500 * time.Millisecond)
+	mc.Nop(1)
+
+	ev, err := readTimeout(dout, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, EventDestroy, ev.Type, ev.String())
+	assert.Equal(t, up.ConnectionID, ev.ConnectionID, ev.String())
+	assert.EqualValues(t, 1, ev.PacketsOrig, ev.String())
+	assert.EqualValues(t, bytes, ev.BytesOrig, ev.String())
+	assert.Zero(t, ev.PacketsRet, ev.String())
+	assert.Zero(t, ev.BytesRet, ev.String())
+
+	// The destroy's totals are those of the flow's only update.
+	assert.Equal(t, up.PacketsOrig, ev.PacketsOrig)
+	assert.Equal(t, up.BytesOrig, ev.BytesOrig)
+
+	require.NoError(t, acctProbe.RemoveConsumer(uac))
+	require.NoError(t, acctProbe.RemoveConsumer(dac))
+}
+
+// Disables conntrack accounting and checks that probes refuse to load, unless
+// unaccounted flows are allowed, in which case they send flows without counters.
+func TestProbeUnaccounted(t *testing.T) {
+
+	const acctKey = "net.netfilter.nf_conntrack_acct"
+	acct, err := sysctl.Get(acctKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(acctKey, "0"))
+	defer func() {
+		require.NoError(t, sysctl.Set(acctKey, acct))
+	}()
+
+	cfg := Config{CooldownMillis: cd, DstPortFilter: []uint16{udpServ}}
+	_, err = NewProbe(cfg)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), acctKey)
+
+	cfg.AllowUnaccounted = true
+	ap, err := NewProbe(cfg)
+	require.NoError(t, err)
+	assert.Contains(t, ap.DisabledSysctls(), acctKey)
+	require.NoError(t, ap.Start())
+	defer ap.Stop()
+
+	in := make(chan Event, 2048)
+	ac := NewConsumer(t.Name(), in, ConsumerUpdate)
+	require.NoError(t, ap.RegisterConsumer(ac))
+	defer ac.Close()
+
+	// Flows created while accounting is disabled have no accounting extension.
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	mc.Nop(1)
+
+	ev, err := readTimeout(filterSourcePort(in, mc.ClientPort()), 20)
+	require.NoError(t, err)
+	assert.Equal(t, EventNew, ev.Type, ev.String())
+	assert.True(t, ev.Unaccounted, ev.String())
+	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
+	assert.Zero(t, ev.PacketsOrig, ev.String())
+	assert.Zero(t, ev.BytesOrig, ev.String())
+}
+
+// Holds a flow open across multiple cooldowns, lets it expire and checks
+// that its destroy event carries the time since the flow's first packet.
+func TestProbeDestroyDuration(t *testing.T) {
+
+	const timeoutKey = "net.netfilter.nf_conntrack_udp_timeout"
+	timeout, err := sysctl.Get(timeoutKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(timeoutKey, "1"))
+	defer func() {
+		require.NoError(t, sysctl.Set(timeoutKey, timeout))
+	}()
+
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	dc := make(chan Event, 2048)
+	dac := NewConsumer(t.Name()+"-destroy", dc, ConsumerDestroy)
+	require.NoError(t, acctProbe.RegisterConsumer(dac))
+	defer dac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	out := filterSourcePort(in, mc.ClientPort())
+	dout := filterSourcePort(dc, mc.ClientPort())
+
+	mc.Nop(1)
+	first, err := readTimeout(out, 20)
+	require.NoError(t, err)
+	assert.Equal(t, EventNew, first.Type, first.String())
+	assert.Zero(t, first.Duration, first.String())
+
+	// Keep the flow alive for a second, every packet sends an update.
+	for i := 1; i <= 4; i++ {
+		time.Sleep(250 * time.Millisecond)
+		mc.Nop(1)
+
+		up, err := readTimeout(out, 20)
+		require.NoError(t, err)
+		assert.Equal(t, time.Duration(up.Timestamp-first.Timestamp), up.Duration, up.String())
+	}
+
+	// Let the flow expire and destroy it by looking it up.
+	time.Sleep(1500 * time.Millisecond)
+	mc.Nop(1)
+
+	ev, err := readTimeout(dout, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, first.ConnectionID, ev.ConnectionID, ev.String())
+	assert.Equal(t, time.Duration(ev.Timestamp-first.Timestamp), ev.Duration, ev.String())
+
+	// The flow was held open for 1 second and expired 1.5 seconds later.
+	want := 2500 * time.Millisecond
+	assert.True(t, ev.Duration > want-100*time.Millisecond && ev.Duration < want+250*time.Millisecond,
+		"duration %s not within tolerance of %s", ev.Duration, want)
+
+	require.NoError(t, acctProbe.RemoveConsumer(dac))
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Checks the direction of the packets triggering the events of a two-way
+// and a one-way flow's startup burst.
+func TestProbeTriggerDir(t *testing.T) {
+
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	// Two-way flow: the first packet is sent by the client, the second is
+	// the server's reply. Their events can be delivered out of order.
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	out := filterSourcePort(in, mc.ClientPort())
+
+	mc.Ping(1)
+	for i := 0; i < 2; i++ {
+		ev, err := readTimeout(out, 20)
+		require.NoError(t, err)
+
+		want := DirOriginal
+		if ev.PacketsRet == 1 {
+			want = DirReply
 		}
+		assert.Equal(t, want, ev.TriggerDir, ev.String())
+	}
 
-		if f(ev) {
-			out <- ev
+	// One-way flow: all packets are sent by the client.
+	mco := udpecho.Dial(udpServ)
+	defer mco.Close()
+	outo := filterSourcePort(in, mco.ClientPort())
+
+	mco.Nop(2)
+	for i := 0; i < 2; i++ {
+		ev, err := readTimeout(outo, 20)
+		require.NoError(t, err)
+		assert.Equal(t, DirOriginal, ev.TriggerDir, ev.String())
+		assert.Zero(t, ev.PacketsRet, ev.String())
+	}
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Packets on the loopback interface carry a zeroed Ethernet header, and
+// locally generated packets have none when conntrack sees them. Testing
+// actual addresses needs traffic received on an Ethernet interface.
+func TestProbeMACLoopback(t *testing.T) {
+
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	out := filterSourcePort(in, mc.ClientPort())
+
+	mc.Ping(1)
+	for i := 0; i < 2; i++ {
+		ev, err := readTimeout(out, 20)
+		require.NoError(t, err)
+		assert.Nil(t, ev.SrcMAC, ev.String())
+		assert.Nil(t, ev.DstMAC, ev.String())
+	}
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Reads the startup burst events of a flow using only the Probe's Events
+// channel, without registering a Consumer.
+func TestProbeEventsChannel(t *testing.T) {
+
+	events := acctProbe.Events()
+	defer acctProbe.CloseEvents()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	port := mc.ClientPort()
+	read := func() Event {
+		for {
+			select {
+			case ev := <-events:
+				if ev.SrcPort == port {
+					return ev
+				}
+			case <-time.After(20 * time.Millisecond):
+				t.Fatal("timeout reading from events channel")
+			}
+		}
+	}
+
+	// Packets 1 and 2 of the flow's startup burst. Both events are sent
+	// too closely together to rely on their order.
+	mc.Nop(2)
+
+	seen := make(map[EventType]uint64)
+	for i := 0; i < 2; i++ {
+		ev := read()
+		seen[ev.Type] = ev.PacketsOrig
+	}
+	assert.Equal(t, map[EventType]uint64{EventNew: 1, EventUpdate: 2}, seen)
+}
+
+// Opens and closes a TCP connection to the mock server's port, and verifies
+// the flow's destroy event counts the SYN and FIN packets of the handshake
+// and teardown.
+func TestProbeTCPFlags(t *testing.T) {
+
+	// Let closed TCP flows expire quickly. Conntrack destroys the old flow
+	// when its tuple is reused, at the latest when the flow is expired.
+	const timeoutKey = "net.netfilter.nf_conntrack_tcp_timeout_time_wait"
+	timeout, err := sysctl.Get(timeoutKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(timeoutKey, "1"))
+	defer func() {
+		require.NoError(t, sysctl.Set(timeoutKey, timeout))
+	}()
+
+	l, err := net.Listen("tcp4", fmt.Sprintf("127.0.0.1:%d", udpServ))
+	require.NoError(t, err)
+	defer l.Close()
+
+	// Close accepted connections right away, so the server
+	// sends the first FIN and the client's port can be reused.
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
 		}
+	}()
+
+	dc := make(chan Event, 2048)
+	dac := NewConsumer(t.Name(), dc, ConsumerDestroy)
+	require.NoError(t, acctProbe.RegisterConsumer(dac))
+	defer dac.Close()
+
+	c, err := net.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	laddr := c.LocalAddr().(*net.TCPAddr)
+
+	// Wait for the server's FIN, then close our side.
+	_, err = c.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NoError(t, c.Close())
+
+	// Reconnect from the same port once the flow has expired.
+	time.Sleep(1500 * time.Millisecond)
+	d := net.Dialer{LocalAddr: laddr}
+	c, err = d.Dial("tcp4", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	out := make(chan Event)
+	go filterWorker(dc, out, func(ev Event) bool {
+		return ev.Proto == 6 && ev.SrcPort == uint16(laddr.Port)
+	})
+
+	ev, err := readTimeout(out, 1000)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, ev.SynCount, ev.String()) // SYN, SYN-ACK
+	assert.EqualValues(t, 2, ev.FinCount, ev.String()) // both sides' FIN
+	assert.Zero(t, ev.RstCount, ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(dac))
+}
+
+// Generates events spaced apart by the probe's cooldown and verifies their
+// wall-clock timestamps are monotonic and close to the time of capture.
+func TestProbeTimestamp(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	// Create UDP client.
+	mc := udpecho.Dial(udpServ)
+
+	// Filter BPF Events based on client port.
+	out := filterSourcePort(in, mc.ClientPort())
+
+	var last time.Time
+	for i := 0; i < 3; i++ {
+		before := time.Now()
+		mc.Nop(1)
+
+		ev, err := readTimeout(out, 20)
+		require.NoError(t, err)
+
+		assert.WithinDuration(t, before, ev.Time, 10*time.Millisecond, ev.String())
+		assert.True(t, ev.Time.After(last), ev.String())
+		last = ev.Time
+
+		// Wait for the flow's cooldown to expire.
+		time.Sleep(cd * time.Millisecond)
+	}
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Generates load and verifies per-CPU statistics are reported
+// for all online CPUs.
+func TestProbeCPUStats(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	out := filterSourcePort(in, mc.ClientPort())
+
+	// Generate the flow's startup burst and read its events.
+	mc.Ping(16)
+	for i := 0; i < 4; i++ {
+		_, err := readTimeout(out, 10)
+		require.NoError(t, err)
 	}
+
+	cpus, err := cpuonline.Get()
+	require.NoError(t, err)
+
+	stats := acctProbe.CPUStats()
+	require.Len(t, stats, len(cpus))
+
+	var total uint64
+	for i, s := range stats {
+		assert.Equal(t, cpus[i], s.CPU)
+		total += s.PerfEventsRead
+	}
+	assert.True(t, total >= 4, "total events read from all CPUs")
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Sends traffic to an echo server on a port that is not in the probe's
+// destination port filter, and to one that is. Only the latter should
+// generate events.
+func TestProbePortFilter(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	// Create a UDP listener on a port that is not in the probe's filter.
+	c := udpecho.ListenAndEcho(udpServFiltered)
+	defer c.Close()
+
+	// Create UDP clients for both servers.
+	mcf := udpecho.Dial(udpServFiltered)
+	defer mcf.Close()
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	// Filter BPF Events based on both clients' ports.
+	out := make(chan Event)
+	go filterWorker(in, out, func(ev Event) bool {
+		return ev.SrcPort == mcf.ClientPort() || ev.SrcPort == mc.ClientPort()
+	})
+
+	// Traffic to the filtered port should not generate an event.
+	mcf.Ping(1)
+	ev, err := readTimeout(out, 20)
+	assert.EqualError(t, err, "timeout", ev.String())
+
+	// Traffic to the allowed port should.
+	mc.Nop(1)
+	ev, err = readTimeout(out, 20)
+	require.NoError(t, err)
+	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
+	assert.EqualValues(t, mc.ClientPort(), ev.SrcPort, ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Runs a second Probe with a different port filter and cooldown next to the
+// suite's Probe, and verifies both only account their own flows, and the
+// suite's Probe keeps working after the second is stopped.
+func TestProbeConcurrent(t *testing.T) {
+
+	ap, err := NewProbe(Config{
+		CooldownMillis: cd * 2,
+		DstPortFilter:  []uint16{udpServFiltered},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+
+	// The probes' kprobe events don't share names.
+	assert.NotEqual(t, acctProbe.module.(*elfModule).prefix, ap.module.(*elfModule).prefix)
+	b, err := ioutil.ReadFile(kprobeEventsPath)
+	require.NoError(t, err)
+	for _, k := range ap.module.(*elfModule).kprobes {
+		assert.Contains(t, string(b), k.name)
+	}
+
+	// Consumers of both probes.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+	inf := make(chan Event, 2048)
+	acf := NewConsumer(t.Name()+"-filtered", inf, ConsumerUpdate)
+	require.NoError(t, ap.RegisterConsumer(acf))
+
+	c := udpecho.ListenAndEcho(udpServFiltered)
+	defer c.Close()
+
+	mcf := udpecho.Dial(udpServFiltered)
+	defer mcf.Close()
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	out := filterSourcePort(in, mc.ClientPort())
+	outf := filterSourcePort(inf, mcf.ClientPort())
+
+	// Each probe only accounts the flows to its own port.
+	mcf.Nop(1)
+	ev, err := readTimeout(outf, 20)
+	require.NoError(t, err)
+	assert.EqualValues(t, udpServFiltered, ev.DstPort, ev.String())
+
+	mc.Nop(1)
+	ev, err = readTimeout(out, 20)
+	require.NoError(t, err)
+	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
+
+	_, err = readTimeout(outf, 20)
+	assert.Equal(t, errChanTimeout, err, "second probe accounted flow to suite port")
+
+	// Stopping the second probe removes its kprobe events only.
+	names := ap.module.(*elfModule).kprobes
+	require.NoError(t, ap.Stop())
+	b, err = ioutil.ReadFile(kprobeEventsPath)
+	require.NoError(t, err)
+	for _, k := range names {
+		assert.NotContains(t, string(b), k.name)
+	}
+
+	mc.Nop(1)
+	ev, err = readTimeout(out, 20)
+	require.NoError(t, err, "suite probe stopped delivering events")
+	assert.EqualValues(t, mc.ClientPort(), ev.SrcPort, ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Loads a probe attached for destroy events only, and verifies a flow's
+// packets don't raise any update events, only its destroy event.
+func TestProbeEventsDestroyOnly(t *testing.T) {
+
+	// Let UDP flows expire quickly, like in TestProbeDestroyShortFlow.
+	const timeoutKey = "net.netfilter.nf_conntrack_udp_timeout"
+	timeout, err := sysctl.Get(timeoutKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(timeoutKey, "1"))
+	defer func() {
+		require.NoError(t, sysctl.Set(timeoutKey, timeout))
+	}()
+
+	_, err = NewProbe(Config{Events: []EventType{EventDestroy, 0}})
+	assert.EqualError(t, err, "unknown event type 0")
+
+	ap, err := NewProbe(Config{
+		CooldownMillis: cd,
+		Events:         []EventType{EventDestroy},
+	})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+	defer ap.Stop()
+
+	// Only the destroy kprobe is attached.
+	require.Len(t, ap.module.(*elfModule).kprobes, 1)
+
+	in := make(chan Event, 2048)
+	require.NoError(t, ap.RegisterConsumer(NewConsumer(t.Name(), in, ConsumerAll)))
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	out := filterSourcePort(in, mc.ClientPort())
+
+	mc.Nop(10)
+	time.Sleep(1500 * time.Millisecond)
+	mc.Nop(1)
+
+	ev, err := readTimeout(out, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, EventDestroy, ev.Type, ev.String())
+	assert.EqualValues(t, 10, ev.PacketsOrig, ev.String())
+
+	_, err = readTimeout(out, 20)
+	assert.Equal(t, errChanTimeout, err, "received event after destroy")
+	assert.Zero(t, ap.Stats().PerfEventsUpdate)
+}
+
+// Generates a flow's startup burst and a long-term update, and verifies
+// exactly one new event is emitted for the flow. A consumer of new events
+// only receives the new event, update consumers receive all of them.
+func TestProbeNew(t *testing.T) {
+
+	// Create and register consumers.
+	au, inu := newUpdateConsumer(t)
+	defer au.Close()
+
+	inn := make(chan Event, 2048)
+	an := NewConsumer(t.Name()+"New", inn, ConsumerNew)
+	require.NoError(t, acctProbe.RegisterConsumer(an))
+	defer an.Close()
+
+	mc := udpecho.Dial(udpServ)
+	outu := filterSourcePort(inu, mc.ClientPort())
+	outn := filterSourcePort(inn, mc.ClientPort())
+
+	// Generate the startup burst (4 events) and one update after the cooldown.
+	mc.Ping(16)
+	time.Sleep(cd * time.Millisecond)
+	mc.Nop(1)
+
+	var news int
+	for i := 0; i < 5; i++ {
+		ev, err := readTimeout(outu, 20)
+		require.NoError(t, err)
+
+		switch ev.Type {
+		case EventNew:
+			news++
+			assert.EqualValues(t, 1, ev.PacketsOrig+ev.PacketsRet, ev.String())
+		case EventUpdate:
+		default:
+			t.Fatalf("unexpected event type %s: %s", ev.Type, ev.String())
+		}
+	}
+	assert.Equal(t, 1, news, "new events received by update consumer")
+
+	ev, err := readTimeout(outn, 20)
+	require.NoError(t, err)
+	assert.Equal(t, EventNew, ev.Type, ev.String())
+
+	// Further attempt(s) to read from the channels should time out.
+	ev, err = readTimeout(outn, 10)
+	assert.EqualError(t, err, "timeout", ev.String())
+	ev, err = readTimeout(outu, 10)
+	assert.EqualError(t, err, "timeout", ev.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(au))
+	require.NoError(t, acctProbe.RemoveConsumer(an))
+}
+
+// Compares the conntrack status flags of a one-way flow against
+// those of a two-way flow.
+func TestProbeStatus(t *testing.T) {
+
+	// Create and register consumer.
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	// One-way flow, the server does not reply to Nop.
+	mco := udpecho.Dial(udpServ)
+	defer mco.Close()
+	outo := filterSourcePort(in, mco.ClientPort())
+
+	mco.Nop(1)
+	ev, err := readTimeout(outo, 20)
+	require.NoError(t, err)
+	assert.False(t, ev.SeenReply, ev.String())
+	assert.False(t, ev.Assured, ev.String())
+	assert.False(t, ev.Status.Has(StatusSeenReply), ev.Status.String())
+	assert.False(t, ev.Status.Has(StatusAssured), ev.Status.String())
+	assert.False(t, ev.Status.Has(StatusNAT), ev.Status.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+
+	// Two-way flow. The event of packet 2 (the first reply) can be generated
+	// before conntrack marks the flow as seen-reply, so check packet 8.
+	ac, in = newUpdateConsumer(t)
+	defer ac.Close()
+
+	mct := udpecho.Dial(udpServ)
+	defer mct.Close()
+	outt := filterSourcePort(in, mct.ClientPort())
+
+	mct.Ping(4)
+	for i := 0; i < 3; i++ {
+		ev, err = readTimeout(outt, 20)
+		require.NoError(t, err)
+		if ev.PacketsOrig+ev.PacketsRet == 8 {
+			break
+		}
+	}
+	require.EqualValues(t, 8, ev.PacketsOrig+ev.PacketsRet, ev.String())
+	assert.True(t, ev.SeenReply, ev.String())
+	assert.True(t, ev.Status.Has(StatusSeenReply|StatusConfirmed), ev.Status.String())
+	assert.False(t, ev.Status.Has(StatusDying), ev.Status.String())
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Generates the startup burst and a number of cooldown updates of a flow,
+// and checks that each event of the flow has a unique, increasing sequence number.
+func TestProbeSeq(t *testing.T) {
+
+	ac, in := newUpdateConsumer(t)
+	defer ac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	out := filterSourcePort(in, mc.ClientPort())
+
+	// Startup burst (4 events), followed by an update after every cooldown.
+	const updates = 5
+	mc.Ping(16)
+	for i := 0; i < updates; i++ {
+		time.Sleep(cd * time.Millisecond)
+		mc.Nop(1)
+	}
+
+	// Events of different CPUs can arrive out of order, collect them first.
+	var evs []Event
+	for i := 0; i < 4+updates; i++ {
+		ev, err := readTimeout(out, 50)
+		require.NoError(t, err)
+		evs = append(evs, ev)
+	}
+
+	seen := make(map[uint32]bool)
+	for _, ev := range evs {
+		assert.NotZero(t, ev.Seq, ev.String())
+		assert.False(t, seen[ev.Seq], "duplicate sequence number %d", ev.Seq)
+		seen[ev.Seq] = true
+	}
+
+	// In timestamp order, sequence numbers increase by one,
+	// starting at 1 on the flow's first event.
+	sort.Slice(evs, func(i, j int) bool { return evs[i].Timestamp < evs[j].Timestamp })
+	for i, ev := range evs {
+		assert.EqualValues(t, i+1, ev.Seq, ev.String())
+	}
+	assert.Equal(t, EventNew, evs[0].Type)
+
+	require.NoError(t, acctProbe.RemoveConsumer(ac))
+}
+
+// Creates a number of flows and checks that the utilization
+// of the probe's per-flow state map rises accordingly.
+func TestProbeMapStats(t *testing.T) {
+
+	nextupd := func() MapStats {
+		// Bypass the cache of MapStats.
+		acctProbe.mapStatsMu.Lock()
+		acctProbe.mapStats = nil
+		acctProbe.mapStatsMu.Unlock()
+
+		ms, err := acctProbe.MapStats()
+		require.NoError(t, err)
+		for _, s := range ms {
+			if s.Name == "nextupd" {
+				return s
+			}
+		}
+		t.Fatal("no stats for map nextupd")
+		return MapStats{}
+	}
+
+	before := nextupd()
+	assert.EqualValues(t, 1024, before.MaxEntries)
+
+	// Every flow gets an entry in nextupd after its first event.
+	const flows = 16
+	for i := 0; i < flows; i++ {
+		mc := udpecho.Dial(udpServ)
+		mc.Nop(1)
+		defer mc.Close()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	after := nextupd()
+	assert.True(t, after.Entries >= before.Entries+flows,
+		"entries went from %d to %d", before.Entries, after.Entries)
+	assert.True(t, after.Utilization() > before.Utilization())
+}
+
+// Loads a second probe tracking only a few flows, and checks that flows
+// exceeding the limit evict older flows instead of going unaccounted.
+func TestProbeMaxFlows(t *testing.T) {
+
+	const (
+		maxFlows = 4
+		flows    = 16
+	)
+
+	ap, err := NewProbe(Config{
+		CooldownMillis: cd,
+		DstPortFilter:  []uint16{udpServ},
+		MaxFlows:       maxFlows,
+	})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+	defer ap.Stop()
+
+	in := make(chan Event, 2048)
+	ac := NewConsumer(t.Name(), in, ConsumerUpdate)
+	require.NoError(t, ap.RegisterConsumer(ac))
+	defer ac.Close()
+
+	// Every flow's first packet is sent as a new event.
+	news := make(map[uint16]bool)
+	for i := 0; i < flows; i++ {
+		mc := udpecho.Dial(udpServ)
+		defer mc.Close()
+		mc.Nop(1)
+		news[mc.ClientPort()] = false
+	}
+	for i := 0; i < flows; i++ {
+		ev, err := readTimeout(in, 20)
+		require.NoError(t, err, "event %d", i)
+		if _, ok := news[ev.SrcPort]; ok && ev.Type == EventNew {
+			news[ev.SrcPort] = true
+		}
+	}
+	for port, seen := range news {
+		assert.True(t, seen, "no new event for flow from port %d", port)
+	}
+
+	ms, err := ap.MapStats()
+	require.NoError(t, err)
+	for _, s := range ms {
+		if s.Name != "nextupd" {
+			continue
+		}
+
+		assert.EqualValues(t, maxFlows, s.MaxEntries)
+		assert.True(t, s.Entries <= maxFlows, "%d entries", s.Entries)
+		assert.True(t, s.Overflows > 0, "no overflows counted")
+		return
+	}
+	t.Fatal("no stats for map nextupd")
+}
+
+// Loads a second probe tracking only a few flows, sends traffic of more flows
+// than that to a port rejected by its filter, and checks that an accounted
+// flow keeps its state instead of being evicted by the rejected flows.
+func TestProbeMaxFlowsFiltered(t *testing.T) {
+
+	const (
+		maxFlows = 4
+		flows    = 16
+	)
+
+	ap, err := NewProbe(Config{
+		// Long enough for the flow's deadline not to expire during the test.
+		CooldownMillis: 10000,
+		DstPortFilter:  []uint16{udpServ},
+		Sequence:       true,
+		MaxFlows:       maxFlows,
+	})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+	defer ap.Stop()
+
+	in := make(chan Event, 2048)
+	ac := NewConsumer(t.Name(), in, ConsumerUpdate)
+	require.NoError(t, ap.RegisterConsumer(ac))
+	defer ac.Close()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	out := filterSourcePort(in, mc.ClientPort())
+
+	// packet 1
+	mc.Nop(1)
+	ev, err := readTimeout(out, 20)
+	require.NoError(t, err)
+	require.Equal(t, EventNew, ev.Type, ev.String())
+
+	for i := 0; i < flows; i++ {
+		mcf := udpecho.Dial(udpServFiltered)
+		defer mcf.Close()
+		mcf.Nop(2)
+	}
+
+	// packet 2, the accounted flow continues its startup burst.
+	mc.Nop(1)
+	ev, err = readTimeout(out, 20)
+	require.NoError(t, err)
+	assert.Equal(t, EventUpdate, ev.Type, ev.String())
+	assert.EqualValues(t, 2, ev.Seq, ev.String())
+	assert.EqualValues(t, 2, ev.PacketsOrig, ev.String())
+
+	ms, err := ap.MapStats()
+	require.NoError(t, err)
+
+	var seen int
+	for _, s := range ms {
+		switch s.Name {
+		case "nextupd":
+			assert.EqualValues(t, 1, s.Entries)
+			assert.Zero(t, s.Overflows)
+			seen++
+		case "filtered":
+			assert.True(t, s.Entries >= flows, "%d entries", s.Entries)
+			seen++
+		}
+	}
+	assert.Equal(t, 2, seen, "no stats for maps nextupd and filtered")
+}
+
+// Restarts a probe with a state file in the middle of a flow's startup burst,
+// and verifies the restarted probe resumes the flow's burst and sequence
+// instead of sending another new event for it.
+func TestProbeStateFileRestart(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "conntracct-state")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		// Long enough for the flow's deadline not to expire during the test.
+		CooldownMillis: 10000,
+		DstPortFilter:  []uint16{udpServ},
+		Sequence:       true,
+		StateFile:      filepath.Join(dir, "state.json"),
+	}
+
+	start := func() (*Probe, chan Event) {
+		ap, err := NewProbe(cfg)
+		require.NoError(t, err)
+		require.NoError(t, ap.Start())
+
+		in := make(chan Event, 2048)
+		require.NoError(t, ap.RegisterConsumer(NewConsumer(t.Name(), in, ConsumerUpdate)))
+		return ap, in
+	}
+
+	ap, in := start()
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+	out := filterSourcePort(in, mc.ClientPort())
+
+	// Packets 1 and 2 of the startup burst, the first a new event.
+	mc.Ping(2)
+	var news int
+	for i := 0; i < 2; i++ {
+		ev, err := readTimeout(out, 20)
+		require.NoError(t, err)
+		if ev.Type == EventNew {
+			news++
+		}
+	}
+	assert.Equal(t, 1, news)
+
+	require.NoError(t, ap.Stop())
+	_, err = os.Stat(cfg.StateFile)
+	require.NoError(t, err, "state file not saved")
+
+	ap, in = start()
+	defer ap.Stop()
+	assert.True(t, ap.RestoredFlows() > 0)
+	out = filterSourcePort(in, mc.ClientPort())
+
+	// Packet 5 is within the restored deadline and not part of the burst.
+	// Without the restored state, it would be sent as a new event.
+	mc.Nop(1)
+	ev, err := readTimeout(out, 20)
+	assert.EqualError(t, err, "timeout", ev.String())
+
+	// Packet 8 continues the burst and the flow's sequence.
+	mc.Nop(3)
+	ev, err = readTimeout(out, 20)
+	require.NoError(t, err)
+	assert.Equal(t, EventUpdate, ev.Type, ev.String())
+	assert.EqualValues(t, 8, ev.PacketsOrig+ev.PacketsRet, ev.String())
+	assert.EqualValues(t, 3, ev.Seq, ev.String())
+}
+
+// Checks the amount of keys counted in hash maps of different sizes.
+func TestCountMapKeys(t *testing.T) {
+
+	for _, n := range []uint32{0, 1, 10, 64} {
+		attr := struct{ MapType, KeySize, ValueSize, MaxEntries, MapFlags uint32 }{bpfMapTypeHash, 4, 4, 64, 0}
+		fd, err := bpfCall(0, unsafe.Pointer(&attr), unsafe.Sizeof(attr)) // BPF_MAP_CREATE
+		require.NoError(t, err)
+
+		for i := uint32(0); i < n; i++ {
+			k, v := i, i
+			require.NoError(t, bpfUpdateElem(fd, unsafe.Pointer(&k), unsafe.Pointer(&v)))
+		}
+
+		info, err := bpfGetMapInfo(fd)
+		require.NoError(t, err)
+
+		c, err := countMapKeys(fd, info)
+		require.NoError(t, err)
+		assert.Equal(t, n, c)
+
+		unix.Close(fd)
+	}
+}
+
+// Pins a set of perf maps like another component loading the probe would,
+// and verifies a Probe attaches to the pinned maps instead of its own.
+// Reads a flow's events over netlink, with its update and destroy events
+// carrying the same counters as the BPF probe's.
+func TestNetlinkProbe(t *testing.T) {
+
+	// Let UDP flows expire quickly, like in TestProbeDestroyShortFlow.
+	const timeoutKey = "net.netfilter.nf_conntrack_udp_timeout"
+	timeout, err := sysctl.Get(timeoutKey)
+	require.NoError(t, err)
+	require.NoError(t, sysctl.Set(timeoutKey, "1"))
+	defer func() {
+		require.NoError(t, sysctl.Set(timeoutKey, timeout))
+	}()
+
+	np, err := NewNetlinkProbe(Config{
+		DstPortFilter:   []uint16{udpServ},
+		NetlinkInterval: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	uc := make(chan Event, 1024)
+	require.NoError(t, np.RegisterConsumer(NewConsumer(t.Name()+"-update", uc, ConsumerUpdate)))
+	dc := make(chan Event, 1024)
+	require.NoError(t, np.RegisterConsumer(NewConsumer(t.Name()+"-destroy", dc, ConsumerDestroy)))
+
+	require.NoError(t, np.Start())
+
+	mc := udpecho.Dial(udpServ)
+	defer mc.Close()
+
+	out := filterSourcePort(uc, mc.ClientPort())
+	dout := filterSourcePort(dc, mc.ClientPort())
+
+	mc.Ping(2)
+
+	ev, err := readTimeout(out, 500)
+	require.NoError(t, err)
+	assert.Equal(t, EventNew, ev.Type, ev.String())
+	assert.EqualValues(t, udpServ, ev.DstPort, ev.String())
+	assert.EqualValues(t, 2, ev.PacketsOrig, ev.String())
+	assert.EqualValues(t, 2, ev.PacketsRet, ev.String())
+	assert.True(t, ev.SeenReply, ev.String())
+	assert.NotZero(t, ev.Start, ev.String())
+
+	up, err := readTimeout(out, 500)
+	require.NoError(t, err)
+	assert.Equal(t, EventUpdate, up.Type, up.String())
+	assert.Equal(t, ev.ConnectionID, up.ConnectionID, up.String())
+
+	// Looking up the expired flow makes conntrack destroy it.
+	time.Sleep(1500 * time.Millisecond)
+	mc.Nop(1)
+
+	de, err := readTimeout(dout, 1000)
+	require.NoError(t, err)
+	assert.Equal(t, EventDestroy, de.Type, de.String())
+	assert.Equal(t, ev.ConnectionID, de.ConnectionID, de.String())
+	assert.EqualValues(t, 2, de.PacketsOrig, de.String())
+	assert.EqualValues(t, 2, de.PacketsRet, de.String())
+
+	require.NoError(t, np.Stop())
+	assert.True(t, np.Stats().PerfEventsDestroy >= 1)
+}
+
+func TestProbePinned(t *testing.T) {
+
+	require.NoError(t, bpffs.Mount())
+
+	dir := filepath.Join(elf.BPFFSPath, "conntracct-test")
+	require.NoError(t, os.MkdirAll(dir, 0700))
+	defer os.RemoveAll(dir)
+
+	cpus, err := cpuonline.Get()
+	require.NoError(t, err)
+	maxCPU := uint32(cpus[len(cpus)-1] + 1)
+
+	ids := make(map[string]uint32)
+	for _, name := range []string{perfUpdateMap, perfDestroyMap} {
+		fd := createPinnedMap(t, filepath.Join(dir, name), bpfMapTypePerfEventArray, maxCPU)
+		info, err := bpfGetMapInfo(fd)
+		require.NoError(t, err)
+		ids[name] = info.ID
+	}
+
+	ap, err := NewProbe(Config{PinPath: dir})
+	require.NoError(t, err)
+	require.NoError(t, ap.Start())
+
+	// The probe holds the pinned maps, with a perf ring for each CPU.
+	pm, ok := ap.module.(*pinnedModule)
+	require.True(t, ok, "probe did not open pinned maps")
+	for name, id := range ids {
+		info, err := bpfGetMapInfo(pm.maps[name])
+		require.NoError(t, err)
+		assert.Equal(t, id, info.ID, name)
+	}
+	require.Len(t, pm.readers, 2)
+	assert.Len(t, pm.readers[0].rings, len(cpus))
+
+	require.NoError(t, ap.Stop())
+
+	// Maps of the wrong type are rejected.
+	require.NoError(t, os.Remove(filepath.Join(dir, perfDestroyMap)))
+	createPinnedMap(t, filepath.Join(dir, perfDestroyMap), bpfMapTypeHash, maxCPU)
+
+	_, err = NewProbe(Config{PinPath: dir})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is not a perf event array")
+}
+
+const bpfMapTypeHash = 1 // BPF_MAP_TYPE_HASH
+
+// createPinnedMap creates a BPF map with 4-byte keys and values,
+// and pins it to the given path. Returns the map's fd.
+func createPinnedMap(t *testing.T, path string, typ, entries uint32) int {
+
+	attr := struct {
+		MapType    uint32
+		KeySize    uint32
+		ValueSize  uint32
+		MaxEntries uint32
+		MapFlags   uint32
+	}{typ, 4, 4, entries, 0}
+
+	fd, err := bpfCall(0, unsafe.Pointer(&attr), unsafe.Sizeof(attr)) // BPF_MAP_CREATE
+	require.NoError(t, err)
+
+	p, err := unix.BytePtrFromString(path)
+	require.NoError(t, err)
+
+	pin := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(p))), BpfFd: uint32(fd)}
+
+	_, err = bpfCall(6, unsafe.Pointer(&pin), unsafe.Sizeof(pin)) // BPF_OBJ_PIN
+	require.NoError(t, err)
+
+	return fd
+}
+
+// filterSourcePort returns an unbuffered channel of Events
+// that has its event stream filtered by the given source port.
+func filterSourcePort(in chan Event, port uint16) chan Event {
+	out := make(chan Event)
+	go filterWorker(in, out,
+		func(ev Event) bool {
+			if ev.SrcPort == port {
+				return true
+			}
+			return false
+		})
+
+	return out
+}
+
+// filterWorker sends an Event from in to out if the given function f yields true.
+func filterWorker(in <-chan Event, out chan<- Event, f func(Event) bool) {
+	for {
+		ev, ok := <-in
+		if !ok {
+			close(out)
+			return
+		}
+
+		if f(ev) {
+			out <- ev
+		}
+	}
+}
+
+// icmpEcho returns an ICMP echo request message with the given
+// identifier, sequence number and payload.
+func icmpEcho(id, seq uint16, payload []byte) []byte {
+
+	b := make([]byte, 8+len(payload))
+	b[0] = 8 // echo request
+	binary.BigEndian.PutUint16(b[4:6], id)
+	binary.BigEndian.PutUint16(b[6:8], seq)
+	copy(b[8:], payload)
+
+	// Internet checksum over the whole message.
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	binary.BigEndian.PutUint16(b[2:4], ^uint16(sum))
+
+	return b
 }
 
 // errWorker listens for errors on the Probe's error channel.
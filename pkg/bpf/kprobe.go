@@ -0,0 +1,167 @@
+package bpf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	kprobeEventsPath = "/sys/kernel/debug/tracing/kprobe_events"
+	kprobeIDPathFmt  = "/sys/kernel/debug/tracing/events/kprobes/%s/id"
+)
+
+// Amount of modules created by the process, numbering their kprobe events.
+var kprobeModules uint32
+
+// kprobeEvent is a kprobe event created through tracefs, and the perf event
+// attaching a BPF program to it.
+type kprobeEvent struct {
+	name string
+	fd   int
+}
+
+// kprobePrefix returns a prefix for the names of the kprobe events of a new
+// module, unique within the machine while the process is running.
+//
+// gobpf names kprobe events after the probed symbol only, eg.
+// 'p__nf_ct_refresh_acct', so a second module probing the same symbol fails
+// to create its event, and closing either module removes the event both of
+// them use. The names of the events of every module include the process' PID
+// and the module's number instead, allowing multiple Probes in one or more
+// processes to be attached at once.
+func kprobePrefix() string {
+	return fmt.Sprintf("conntracct_%d_%d_", os.Getpid(), atomic.AddUint32(&kprobeModules, 1))
+}
+
+// enableKprobe creates a kprobe event for the given section of a BPF module,
+// eg. 'kprobe/__nf_ct_refresh_acct', named prefix followed by the kind of
+// probe and its symbol. Attaches the module's program with file descriptor
+// progFd to it. See elf.Module.EnableKprobe for the meaning of maxactive.
+func enableKprobe(prefix, secName string, progFd, maxactive int) (kprobeEvent, error) {
+
+	probeType, symbol := "p", strings.TrimPrefix(secName, "kprobe/")
+	var maxactiveStr string
+	if strings.HasPrefix(secName, "kretprobe/") {
+		probeType, symbol = "r", strings.TrimPrefix(secName, "kretprobe/")
+		if maxactive > 0 {
+			maxactiveStr = strconv.Itoa(maxactive)
+		}
+	}
+	name := prefix + probeType + symbol
+
+	id, err := writeKprobeEvent(fmt.Sprintf("%s%s:%s %s\n", probeType, maxactiveStr, name, symbol), name)
+	if os.IsNotExist(errors.Cause(err)) && maxactiveStr != "" {
+		// Kernels older than 4.12 don't support maxactive.
+		_ = removeKprobeEvent(name)
+		id, err = writeKprobeEvent(fmt.Sprintf("%s:%s %s\n", probeType, name, symbol), name)
+	}
+	if err != nil {
+		return kprobeEvent{}, err
+	}
+
+	fd, err := attachTracepoint(id, progFd)
+	if err != nil {
+		_ = removeKprobeEvent(name)
+		return kprobeEvent{}, err
+	}
+
+	return kprobeEvent{name: name, fd: fd}, nil
+}
+
+// close detaches the BPF program from the kprobe event and removes the event.
+func (k kprobeEvent) close() error {
+
+	if err := unix.Close(k.fd); err != nil {
+		return errors.Wrapf(err, "closing perf event of kprobe %s", k.name)
+	}
+
+	return removeKprobeEvent(k.name)
+}
+
+// writeKprobeEvent writes the definition of a kprobe event to kprobe_events
+// and returns the ID of the event.
+func writeKprobeEvent(def, name string) (int, error) {
+
+	f, err := os.OpenFile(kprobeEventsPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return -1, errors.Wrap(err, "opening kprobe_events")
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(def); err != nil {
+		return -1, errors.Wrapf(err, "writing %q to kprobe_events", strings.TrimSpace(def))
+	}
+
+	b, err := ioutil.ReadFile(fmt.Sprintf(kprobeIDPathFmt, name))
+	if err != nil {
+		return -1, errors.Wrapf(err, "reading id of kprobe %s", name)
+	}
+
+	id, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return -1, errors.Wrapf(err, "invalid id of kprobe %s", name)
+	}
+
+	return id, nil
+}
+
+// removeKprobeEvent removes the named kprobe event. Events that don't exist
+// are ignored.
+func removeKprobeEvent(name string) error {
+
+	f, err := os.OpenFile(kprobeEventsPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return errors.Wrap(err, "opening kprobe_events")
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString("-:" + name + "\n"); err != nil {
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOENT {
+			return nil
+		}
+		return errors.Wrapf(err, "removing kprobe %s", name)
+	}
+
+	return nil
+}
+
+// attachTracepoint opens a perf event for the tracepoint with the given ID,
+// like the tracepoint of a kprobe event, and attaches the BPF program with
+// file descriptor progFd to it. Returns the perf event's file descriptor.
+func attachTracepoint(id, progFd int) (int, error) {
+
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_TRACEPOINT,
+		Config:      uint64(id),
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+
+	fd, err := unix.PerfEventOpen(&attr, -1, 0, -1, perfFlagFdCloexec)
+	if err != nil {
+		return -1, errors.Wrap(err, "opening perf event")
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, progFd); err != nil {
+		_ = unix.Close(fd)
+		return -1, errors.Wrap(err, "attaching program to perf event")
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		_ = unix.Close(fd)
+		return -1, errors.Wrap(err, "enabling perf event")
+	}
+
+	return fd, nil
+}
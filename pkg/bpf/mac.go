@@ -0,0 +1,55 @@
+package bpf
+
+import "net"
+
+// MAC is the Ethernet address of a packet, see Event.SrcMAC.
+// It is marshaled into its colon-separated text form, eg. 00:00:5e:00:53:01.
+type MAC net.HardwareAddr
+
+// String returns the text form of the MAC, or an empty string if unset.
+func (m MAC) String() string {
+	return net.HardwareAddr(m).String()
+}
+
+// MarshalText marshals the MAC into its text form.
+func (m MAC) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText unmarshals the text form of a MAC.
+// An empty string unmarshals into a nil MAC.
+func (m *MAC) UnmarshalText(b []byte) error {
+
+	if len(b) == 0 {
+		*m = nil
+		return nil
+	}
+
+	hw, err := net.ParseMAC(string(b))
+	if err != nil {
+		return err
+	}
+	*m = MAC(hw)
+
+	return nil
+}
+
+// decodeMACs decodes the source and destination Ethernet addresses of an
+// event, both nil if the packet had none. Packets of interfaces without
+// Ethernet headers, like loopback, carry all-zero addresses, decoded as none.
+func decodeMACs(b []byte) (MAC, MAC) {
+
+	for _, v := range b {
+		if v != 0 {
+			// A single allocation backing both addresses.
+			m := make([]byte, 2*macLen)
+			copy(m, b)
+			return m[:macLen:macLen], m[macLen:]
+		}
+	}
+
+	return nil, nil
+}
+
+// macLen is the length of an Ethernet address.
+const macLen = 6
@@ -0,0 +1,193 @@
+package bpf
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	bpfMapLookupElem  = 1 // BPF_MAP_LOOKUP_ELEM
+	bpfMapGetNextKey  = 4 // BPF_MAP_GET_NEXT_KEY
+	mapStatsCacheTime = time.Second
+)
+
+// Hash maps of the acct probe holding per-flow or per-call state. When
+// nextupd is full, new flows evict the least recently updated flow.
+// On kernels before 4.10, new flows are not tracked instead.
+var statMaps = []string{"nextupd", "filtered", "currct", "flowseq", "tcpflags", "dstports", "srcports"}
+
+// Index of the overflow counter in the probe's counters map.
+var counterOverflows = uint32(1)
+
+// MapStats holds the utilization of one of the probe's BPF maps.
+type MapStats struct {
+	Name       string `json:"name"`
+	Entries    uint32 `json:"entries"`
+	MaxEntries uint32 `json:"max_entries"`
+
+	// Amount of new flows inserted into the map while it was full, since the
+	// probe was loaded. Each evicted the least recently updated flow, or went
+	// untracked on kernels before 4.10. Only counted for nextupd.
+	Overflows uint64 `json:"overflows,omitempty"`
+}
+
+// Utilization returns the fraction of the map's capacity that is in use.
+func (s MapStats) Utilization() float64 {
+	if s.MaxEntries == 0 {
+		return 0
+	}
+	return float64(s.Entries) / float64(s.MaxEntries)
+}
+
+// MapStats returns the utilization of the Probe's BPF hash maps. The amount
+// of entries is counted by walking the maps' keys, which are bounded by their
+// maximum size. Results are cached for a second to keep repeated calls cheap.
+// Returns no stats for a Probe reading from pinned maps.
+func (ap *Probe) MapStats() ([]MapStats, error) {
+
+	ap.mapStatsMu.Lock()
+	defer ap.mapStatsMu.Unlock()
+
+	if ap.mapStats != nil && time.Since(ap.mapStatsTime) < mapStatsCacheTime {
+		return ap.mapStats, nil
+	}
+
+	ap.startMu.Lock()
+	defer ap.startMu.Unlock()
+
+	if ap.module == nil {
+		return nil, errProbeUnloaded
+	}
+
+	out := make([]MapStats, 0, len(statMaps))
+	for _, name := range statMaps {
+		fd, ok := ap.module.mapFd(name)
+		if !ok {
+			continue
+		}
+
+		info, err := bpfGetMapInfo(fd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting info of map %s", name)
+		}
+
+		n, err := countMapKeys(fd, info)
+		if err != nil {
+			return nil, errors.Wrapf(err, "counting entries of map %s", name)
+		}
+
+		ms := MapStats{Name: name, Entries: n, MaxEntries: info.MaxEntries}
+
+		if name == "nextupd" {
+			ms.Overflows, err = readCounter(ap.module, counterOverflows)
+			if err != nil {
+				return nil, errors.Wrap(err, "reading overflow counter")
+			}
+		}
+
+		out = append(out, ms)
+	}
+
+	ap.mapStats = out
+	ap.mapStatsTime = time.Now()
+
+	return out, nil
+}
+
+// readCounter reads the value at index idx of the module's counters map.
+// Returns zero if the module has no counters map.
+func readCounter(mod bpfModule, idx uint32) (uint64, error) {
+
+	fd, ok := mod.mapFd("counters")
+	if !ok {
+		return 0, nil
+	}
+
+	key := make([]byte, 4)
+	value := make([]byte, 8)
+	*(*uint32)(unsafe.Pointer(&key[0])) = idx
+
+	if err := bpfMapCall(bpfMapLookupElem, fd, key, value); err != nil {
+		return 0, err
+	}
+
+	return *(*uint64)(unsafe.Pointer(&value[0])), nil
+}
+
+// countMapKeys counts the keys of a hash map by walking them. Since the map
+// can be modified during the walk, the count is capped to the map's maximum size.
+func countMapKeys(fd int, info bpfMapInfo) (uint32, error) {
+
+	var n uint32
+	err := walkMapKeys(fd, info, func([]byte) error {
+		n++
+		return nil
+	})
+
+	return n, err
+}
+
+// walkMapKeys calls fn with every key of a hash map, stopping at the first
+// error. Since the map can be modified during the walk, at most the map's
+// maximum size of keys is walked. fn must not retain the key.
+func walkMapKeys(fd int, info bpfMapInfo, fn func(key []byte) error) error {
+
+	key := make([]byte, info.KeySize)
+	next := make([]byte, info.KeySize)
+	value := make([]byte, info.ValueSize)
+
+	// Getting the key after a key that is not in the map returns the first
+	// key of the map. Kernels before 4.12 don't accept a NULL key for this,
+	// so look for a key that is not in the map. One of the first MaxEntries+1
+	// candidates is guaranteed to be absent.
+	for i := uint32(0); i <= info.MaxEntries; i++ {
+		for b := range key {
+			key[b] = byte(i >> (8 * uint(b%4)))
+		}
+		if err := bpfMapCall(bpfMapLookupElem, fd, key, value); err == unix.ENOENT {
+			break
+		}
+	}
+
+	for n := uint32(0); n < info.MaxEntries; n++ {
+		err := bpfMapCall(bpfMapGetNextKey, fd, key, next)
+		if err == unix.ENOENT {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := fn(next); err != nil {
+			return err
+		}
+
+		key, next = next, key
+	}
+
+	return nil
+}
+
+// bpfMapCall issues a bpf(2) map command taking a key and a value
+// or next key, like BPF_MAP_LOOKUP_ELEM and BPF_MAP_GET_NEXT_KEY.
+func bpfMapCall(cmd int, fd int, key, value []byte) error {
+
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{
+		MapFd: uint32(fd),
+		Key:   uint64(uintptr(unsafe.Pointer(&key[0]))),
+		Value: uint64(uintptr(unsafe.Pointer(&value[0]))),
+	}
+
+	_, err := bpfCall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	return err
+}
@@ -0,0 +1,195 @@
+package bpf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/iovisor/gobpf/elf"
+	"github.com/pkg/errors"
+
+	"github.com/ti-mo/conntracct/pkg/kernel"
+)
+
+// bpfModule is the set of operations the Probe performs on its BPF module.
+// Allows injecting failures in tests.
+type bpfModule interface {
+	EnableKprobe(secName string, maxactive int) error
+	InitPerfMap(name string, events chan []byte, lost chan uint64) (perfReader, error)
+
+	// mapFd returns the file descriptor of the named map, if the module has it.
+	mapFd(name string) (int, bool)
+
+	// Close detaches all kprobes, closes all maps, perf event file
+	// descriptors and programs of the module.
+	Close() error
+}
+
+// perfReader polls a perf map for events.
+type perfReader interface {
+	PollStart()
+	PollStop()
+}
+
+// elfModule is a bpfModule backed by a gobpf elf.Module. Its kprobes are
+// attached to kprobe events of its own, see kprobePrefix.
+type elfModule struct {
+	*elf.Module
+
+	// Prefix of the names of the module's kprobe events.
+	prefix  string
+	kprobes []kprobeEvent
+}
+
+// newElfModule returns an elfModule of the loaded module mod.
+func newElfModule(mod *elf.Module) *elfModule {
+	return &elfModule{Module: mod, prefix: kprobePrefix()}
+}
+
+// EnableKprobe attaches the program in the given section of the module to
+// a kprobe event of the module, see elf.Module.EnableKprobe.
+func (m *elfModule) EnableKprobe(secName string, maxactive int) error {
+
+	kp := m.Kprobe(secName)
+	if kp == nil {
+		return fmt.Errorf("no such kprobe %q", secName)
+	}
+
+	k, err := enableKprobe(m.prefix, secName, kp.Fd(), maxactive)
+	if err != nil {
+		return err
+	}
+	m.kprobes = append(m.kprobes, k)
+
+	return nil
+}
+
+// Close removes the module's kprobe events, and closes the module.
+func (m *elfModule) Close() error {
+
+	var err error
+	for _, k := range m.kprobes {
+		if kerr := k.close(); kerr != nil && err == nil {
+			err = kerr
+		}
+	}
+	m.kprobes = nil
+
+	if merr := m.Module.Close(); merr != nil && err == nil {
+		err = merr
+	}
+
+	return err
+}
+
+// InitPerfMap initializes a reader for the named perf map of the module.
+func (m *elfModule) InitPerfMap(name string, events chan []byte, lost chan uint64) (perfReader, error) {
+	return elf.InitPerfMap(m.Module, name, events, lost)
+}
+
+func (m *elfModule) mapFd(name string) (int, bool) {
+	mp := m.Map(name)
+	if mp == nil {
+		return 0, false
+	}
+	return mp.Fd(), true
+}
+
+// LoadError is returned by NewProbe when the kernel rejects the BPF program.
+// It carries the verifier's log, the only clue to why a program fails to
+// load on a kernel it wasn't tested on.
+type LoadError struct {
+	Err error
+
+	// Version of the probe that failed to load.
+	Version string
+
+	// Output of the BPF verifier, empty if the failure happened before
+	// the program was verified, eg. when creating its maps.
+	VerifierLog string
+
+	// File the verifier log was written to, see Config.VerifierLogPath.
+	LogPath string
+}
+
+// Error returns the load error, followed by the verifier log if any.
+func (e *LoadError) Error() string {
+
+	msg := fmt.Sprintf("failed to load ELF binary version %s: %s", e.Version, e.Err)
+	if e.LogPath != "" {
+		msg += fmt.Sprintf(" (verifier log written to %s)", e.LogPath)
+	}
+	if e.VerifierLog != "" {
+		msg += ", verifier log:\n" + e.VerifierLog
+	}
+
+	return msg
+}
+
+// Cause returns the underlying error, for use with errors.Cause.
+func (e *LoadError) Cause() error {
+	return e.Err
+}
+
+// loadModule inserts the module into the kernel, returning the contents of
+// the module's verifier log buffer on failure. Replaceable in tests.
+var loadModule = func(mod *elf.Module, params map[string]elf.SectionParams) ([]byte, error) {
+	if err := mod.Load(params); err != nil {
+		return mod.Log(), err
+	}
+	return nil, nil
+}
+
+// newLoadError returns a LoadError of a probe version failing to load with
+// the given error and verifier log buffer. Writes the log to path if not
+// empty and the log is not empty.
+func newLoadError(version string, err error, logBuf []byte, path string) error {
+
+	// Log buffer and error string from go-bpf contain many NUL characters
+	// and need to be trimmed. The error string embeds the log after its
+	// first line, the log is kept separately.
+	vlog := strings.TrimSpace(strings.TrimRight(string(logBuf), "\x00"))
+	msg := strings.TrimRight(err.Error(), "\x00")
+	if vlog != "" {
+		msg = strings.TrimSuffix(strings.SplitN(msg, "\n", 2)[0], ":")
+	}
+
+	le := &LoadError{
+		Err:         errors.New(msg),
+		Version:     version,
+		VerifierLog: vlog,
+	}
+
+	if path == "" || vlog == "" {
+		return le
+	}
+
+	if werr := ioutil.WriteFile(path, []byte(vlog+"\n"), 0644); werr != nil {
+		return errors.Wrapf(le, "(writing verifier log failed: %s)", werr)
+	}
+	le.LogPath = path
+
+	return le
+}
+
+// elfLoader returns a function loading the ELF image into the kernel
+// and configuring it with cfg.
+func elfLoader(image []byte, k kernel.Kernel, cfg Config) func() (bpfModule, error) {
+	return func() (bpfModule, error) {
+
+		// Load the module from the bytes.Reader and insert into the kernel.
+		mod := elf.NewModuleFromReader(bytes.NewReader(image))
+		if vlog, err := loadModule(mod, sectionParams(cfg)); err != nil {
+			return nil, newLoadError(k.Version, err, vlog, cfg.VerifierLogPath)
+		}
+
+		// Apply probe configuration, unloading the module on failure.
+		if err := configureProbe(mod, cfg); err != nil {
+			_ = mod.Close()
+			return nil, errors.Wrap(err, "configuring BPF probe")
+		}
+
+		return newElfModule(mod), nil
+	}
+}
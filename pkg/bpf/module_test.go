@@ -0,0 +1,83 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/iovisor/gobpf/elf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/kernel"
+)
+
+func TestElfLoaderVerifierLog(t *testing.T) {
+
+	const vlog = "0: (79) r1 = *(u64 *)(r1 +104)\ninvalid bpf_context access off=104 size=8"
+
+	// Like gobpf, fail with the log embedded in the error, padded with NULs.
+	buf := make([]byte, 256)
+	copy(buf, vlog)
+
+	defer func(f func(*elf.Module, map[string]elf.SectionParams) ([]byte, error)) {
+		loadModule = f
+	}(loadModule)
+	loadModule = func(*elf.Module, map[string]elf.SectionParams) ([]byte, error) {
+		return buf, fmt.Errorf("error while loading %q (%v):\n%s", "kprobe/__nf_ct_refresh_acct", syscall.EACCES, buf)
+	}
+
+	dir, err := ioutil.TempDir("", "conntracct-verifier")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "verifier.log")
+
+	k := kernel.Kernel{Version: "acct_5.0"}
+	_, err = elfLoader(nil, k, Config{VerifierLogPath: path})()
+	require.Error(t, err)
+
+	le, ok := err.(*LoadError)
+	require.True(t, ok, "error is a %T", err)
+	assert.Equal(t, "acct_5.0", le.Version)
+	assert.Equal(t, vlog, le.VerifierLog)
+	assert.Equal(t, path, le.LogPath)
+	assert.EqualError(t, le.Err, `error while loading "kprobe/__nf_ct_refresh_acct" (permission denied)`)
+
+	assert.Contains(t, err.Error(), "invalid bpf_context access off=104 size=8")
+	assert.NotContains(t, err.Error(), "\x00")
+
+	b, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, vlog+"\n", string(b))
+
+	// Failures before verification have no log to write.
+	require.NoError(t, os.Remove(path))
+	loadModule = func(*elf.Module, map[string]elf.SectionParams) ([]byte, error) {
+		return make([]byte, 256), errors.New("error while loading map \"config\"")
+	}
+
+	_, err = elfLoader(nil, k, Config{VerifierLogPath: path})()
+	le, ok = err.(*LoadError)
+	require.True(t, ok, "error is a %T", err)
+	assert.Empty(t, le.VerifierLog)
+	assert.Empty(t, le.LogPath)
+	assert.EqualError(t, err, `failed to load ELF binary version acct_5.0: error while loading map "config"`)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestKprobePrefix(t *testing.T) {
+
+	// Modules of the same process get distinct kprobe event names.
+	a, b := newElfModule(nil), newElfModule(nil)
+	assert.NotEqual(t, a.prefix, b.prefix)
+
+	pid := fmt.Sprintf("conntracct_%d_", os.Getpid())
+	assert.True(t, strings.HasPrefix(a.prefix, pid), a.prefix)
+	assert.True(t, strings.HasPrefix(b.prefix, pid), b.prefix)
+}
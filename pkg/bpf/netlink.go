@@ -0,0 +1,437 @@
+package bpf
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/pkg/errors"
+	"github.com/ti-mo/conntrack"
+	"github.com/ti-mo/netfilter"
+
+	"github.com/ti-mo/conntracct/pkg/boottime"
+)
+
+// DefaultNetlinkInterval is the interval between conntrack table dumps
+// of a NetlinkProbe if Config.NetlinkInterval is zero.
+const DefaultNetlinkInterval = 10 * time.Second
+
+// Capacity of the channel receiving conntrack destroy events from netlink.
+const netlinkEventBuffer = 1024
+
+// NetlinkProbe is a Source of events reading conntrack accounting data over
+// netlink (ctnetlink) instead of a BPF program, for hosts that can't load
+// the Probe, eg. because of missing kernel symbols or privileges. It dumps
+// the conntrack table every Config.NetlinkInterval and listens for conntrack
+// destroy events. Its events are delivered to Consumers like the Probe's, and
+// have the same fields where possible:
+//
+//   - A flow's first dump sends a new event, following dumps send an update
+//     event. Flows living shorter than the interval only send a destroy event.
+//   - ConnectionID is the flow's conntrack ID, Start is set from its
+//     conntrack timestamp and Timestamp is the time the event was received.
+//   - Unaccounted is set for flows without counters, like accounting
+//     disabled by sysctl (see Config.AllowUnaccounted).
+//   - NetNS, CPU, Seq, TriggerDir and the TCP flag counters are zero. Only
+//     flows in the network namespace of the process are seen.
+//
+// Config.DstPortFilter and Config.SrcPortFilter are applied in userspace,
+// along with RawAddrs. The other settings of the BPF program are ignored.
+type NetlinkProbe struct {
+
+	// Probe holding the consumers and statistics, never loaded into the kernel.
+	probe *Probe
+
+	interval time.Duration
+	dstPorts map[uint16]bool
+	srcPorts map[uint16]bool
+
+	// Separate connections for dumps and events, since a connection
+	// subscribed to multicast groups can't be used for requests.
+	dump   *conntrack.Conn
+	listen *conntrack.Conn
+
+	startMu sync.Mutex
+	started bool
+	stop    chan struct{}
+	workers sync.WaitGroup
+
+	// IDs of the flows seen in the last dump. Their next dump sends an
+	// update event instead of a new event.
+	seenMu sync.Mutex
+	seen   map[uint32]bool
+}
+
+// NewNetlinkProbe returns a NetlinkProbe with open netlink connections.
+// Like NewProbe, returns an error if conntrack accounting is disabled by
+// sysctl, unless the Config allows unaccounted flows. Config.PinPath is
+// not supported.
+func NewNetlinkProbe(cfg Config) (*NetlinkProbe, error) {
+
+	if cfg.PinPath != "" {
+		return nil, errNetlinkPinned
+	}
+
+	disabled, err := checkSysctls(cfg.AllowUnaccounted)
+	if err != nil {
+		return nil, err
+	}
+
+	np := NetlinkProbe{
+		probe: &Probe{
+			bootTime:        boottime.Estimate(),
+			stats:           &ProbeStats{},
+			normalizeAddrs:  !cfg.RawAddrs,
+			disabledSysctls: disabled,
+		},
+		interval: cfg.NetlinkInterval,
+		dstPorts: portSet(cfg.DstPortFilter),
+		srcPorts: portSet(cfg.SrcPortFilter),
+		seen:     make(map[uint32]bool),
+	}
+	if np.interval == 0 {
+		np.interval = DefaultNetlinkInterval
+	}
+
+	if np.dump, err = conntrack.Dial(nil); err != nil {
+		return nil, errors.Wrap(err, "opening conntrack netlink connection")
+	}
+
+	if np.listen, err = conntrack.Dial(nil); err != nil {
+		np.dump.Close()
+		return nil, errors.Wrap(err, "opening conntrack netlink connection")
+	}
+
+	// Drop destroy events when the socket's receive buffer overflows,
+	// instead of failing the listener.
+	if err := np.listen.SetOption(netlink.NoENOBUFS, true); err != nil {
+		np.close()
+		return nil, errors.Wrap(err, "setting NoENOBUFS on netlink connection")
+	}
+
+	return &np, nil
+}
+
+// RegisterConsumer registers a Consumer in the NetlinkProbe.
+func (np *NetlinkProbe) RegisterConsumer(ac *Consumer) error {
+	return np.probe.RegisterConsumer(ac)
+}
+
+// RemoveConsumer removes a Consumer from the NetlinkProbe.
+func (np *NetlinkProbe) RemoveConsumer(ac *Consumer) error {
+	return np.probe.RemoveConsumer(ac)
+}
+
+// Start subscribes to conntrack destroy events and starts dumping the
+// conntrack table. The first dump is made right away.
+func (np *NetlinkProbe) Start() error {
+
+	np.startMu.Lock()
+	defer np.startMu.Unlock()
+
+	if np.started {
+		return errProbeStarted
+	}
+
+	if np.dump == nil {
+		return errProbeUnloaded
+	}
+
+	evs := make(chan conntrack.Event, netlinkEventBuffer)
+	errs, err := np.listen.Listen(evs, 1, []netfilter.NetlinkGroup{netfilter.GroupCTDestroy})
+	if err != nil {
+		return errors.Wrap(err, "subscribing to conntrack destroy events")
+	}
+
+	np.probe.errChan = make(chan error)
+	np.probe.errSubs.reopen()
+	np.stop = make(chan struct{})
+
+	np.workers.Add(2)
+	go np.listenWorker(evs, errs)
+	go np.dumpWorker(np.dump, np.stop)
+
+	np.started = true
+
+	return nil
+}
+
+// Stop closes the NetlinkProbe's netlink connections, waits for its workers
+// to exit and closes its error channels. Can only be called after Start().
+// A stopped NetlinkProbe can't be started again.
+func (np *NetlinkProbe) Stop() error {
+
+	np.startMu.Lock()
+	defer np.startMu.Unlock()
+
+	if !np.started {
+		return errProbeNotStarted
+	}
+
+	// Closing the connections interrupts any dump in progress
+	// and makes the listener return an error.
+	close(np.stop)
+	err := np.close()
+
+	// Workers may send errors until they exit.
+	np.workers.Wait()
+	close(np.probe.errChan)
+	np.probe.errSubs.close()
+
+	np.started = false
+
+	return err
+}
+
+// close closes both netlink connections of the NetlinkProbe.
+func (np *NetlinkProbe) close() error {
+
+	derr := np.dump.Close()
+	lerr := np.listen.Close()
+	np.dump, np.listen = nil, nil
+
+	if derr != nil {
+		return derr
+	}
+	return lerr
+}
+
+// DisabledSysctls returns the sysctls required for accounting flows that were
+// disabled when the NetlinkProbe was created. See Probe.DisabledSysctls.
+func (np *NetlinkProbe) DisabledSysctls() []string {
+	return np.probe.DisabledSysctls()
+}
+
+// Interval returns the interval between the NetlinkProbe's conntrack dumps.
+func (np *NetlinkProbe) Interval() time.Duration {
+	return np.interval
+}
+
+// ErrChan returns the NetlinkProbe's unbuffered error channel. Like the
+// Probe's, errors are dropped if there is no ready receiver. Returns nil
+// if the NetlinkProbe has not been Start()ed yet.
+func (np *NetlinkProbe) ErrChan() chan error {
+	np.startMu.Lock()
+	defer np.startMu.Unlock()
+	return np.probe.errChan
+}
+
+// Errors returns a channel receiving the NetlinkProbe's errors of at least
+// the given severity. See Probe.Errors.
+func (np *NetlinkProbe) Errors(min Severity) <-chan *ProbeError {
+	return np.probe.errSubs.add(min)
+}
+
+// Stats returns a snapshot copy of the NetlinkProbe's statistics. Events
+// received over netlink are counted like the Probe's perf events, lost
+// events are not counted.
+func (np *NetlinkProbe) Stats() ProbeStats {
+	return np.probe.Stats()
+}
+
+// CPUStats always returns nil, netlink events are not generated per CPU.
+func (np *NetlinkProbe) CPUStats() []CPUStats {
+	return nil
+}
+
+// MapStats always returns no stats, the NetlinkProbe has no BPF maps.
+func (np *NetlinkProbe) MapStats() ([]MapStats, error) {
+	return nil, nil
+}
+
+// dumpWorker dumps the conntrack table over c every interval until stop is
+// closed, sending an event for every flow in the table.
+func (np *NetlinkProbe) dumpWorker(c *conntrack.Conn, stop chan struct{}) {
+
+	defer np.workers.Done()
+
+	t := time.NewTicker(np.interval)
+	defer t.Stop()
+
+	for {
+		flows, err := c.Dump()
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			np.probe.sendError(ComponentNetlink, SeverityError, errors.Wrap(err, "dumping conntrack table"))
+		} else {
+			np.dumped(flows, time.Now())
+		}
+
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// dumped sends an event for every flow of a dump received at now, and
+// remembers the dumped flows for telling apart new flows in the next dump.
+func (np *NetlinkProbe) dumped(flows []conntrack.Flow, now time.Time) {
+
+	seen := make(map[uint32]bool, len(flows))
+
+	np.seenMu.Lock()
+	defer np.seenMu.Unlock()
+
+	for i := range flows {
+		f := &flows[i]
+		if !np.wantFlow(f) {
+			continue
+		}
+		seen[f.ID] = true
+
+		typ := EventNew
+		if np.seen[f.ID] {
+			typ = EventUpdate
+		}
+
+		np.probe.stats.incrPerfEventsUpdate()
+		np.probe.fanoutEvent(np.flowEvent(f, typ, now))
+	}
+
+	np.seen = seen
+}
+
+// listenWorker sends a destroy event for every flow received on evs,
+// until the listener returns an error on errs.
+func (np *NetlinkProbe) listenWorker(evs chan conntrack.Event, errs chan error) {
+
+	defer np.workers.Done()
+
+	for {
+		select {
+		case ev := <-evs:
+			np.destroyed(ev.Flow, time.Now())
+
+		case err := <-errs:
+			// The listener exits after its first error, including
+			// the one caused by closing its connection in Stop.
+			select {
+			case <-np.stop:
+			default:
+				np.probe.sendError(ComponentNetlink, SeverityFatal, errors.Wrap(err, "receiving conntrack events"))
+			}
+			return
+		}
+	}
+}
+
+// destroyed sends a destroy event of the flow received at now.
+func (np *NetlinkProbe) destroyed(f *conntrack.Flow, now time.Time) {
+
+	if f == nil || !np.wantFlow(f) {
+		return
+	}
+
+	np.seenMu.Lock()
+	delete(np.seen, f.ID)
+	np.seenMu.Unlock()
+
+	np.probe.stats.incrPerfEventsDestroy()
+	np.probe.fanoutEvent(np.flowEvent(f, EventDestroy, now))
+}
+
+// wantFlow returns true if the flow matches the NetlinkProbe's port filters.
+// Like in the BPF program, flows without ports don't match a filter.
+func (np *NetlinkProbe) wantFlow(f *conntrack.Flow) bool {
+
+	if np.dstPorts == nil && np.srcPorts == nil {
+		return true
+	}
+
+	p := f.TupleOrig.Proto
+	if !HasPorts(p.Protocol) {
+		return false
+	}
+
+	if np.dstPorts != nil && !np.dstPorts[p.DestinationPort] {
+		return false
+	}
+	if np.srcPorts != nil && !np.srcPorts[p.SourcePort] {
+		return false
+	}
+
+	return true
+}
+
+// flowEvent returns an Event of the given type for a conntrack flow
+// received at now.
+func (np *NetlinkProbe) flowEvent(f *conntrack.Flow, typ EventType, now time.Time) Event {
+
+	e := Event{
+		Type:         typ,
+		Time:         now,
+		Timestamp:    uint64(now.Sub(np.probe.bootTime)),
+		ConnectionID: f.ID,
+		Connmark:     f.Mark,
+		SrcAddr:      np.addr(f.TupleOrig.IP.SourceAddress),
+		DstAddr:      np.addr(f.TupleOrig.IP.DestinationAddress),
+		Proto:        f.TupleOrig.Proto.Protocol,
+		PacketsOrig:  f.CountersOrig.Packets,
+		BytesOrig:    f.CountersOrig.Bytes,
+		PacketsRet:   f.CountersReply.Packets,
+		BytesRet:     f.CountersReply.Bytes,
+		SeenReply:    f.Status.SeenReply(),
+		Assured:      f.Status.Assured(),
+		Expected:     f.Status.Expected(),
+		Status:       Status(f.Status.Value),
+		Helper:       f.Helper.Name,
+	}
+
+	switch p := f.TupleOrig.Proto; {
+	case HasPorts(e.Proto):
+		e.SrcPort = p.SourcePort
+		e.DstPort = p.DestinationPort
+	case isICMP(e.Proto):
+		e.ICMPType = p.ICMPType
+		e.ICMPCode = p.ICMPCode
+		e.ICMPID = p.ICMPID
+	}
+
+	// Every accounted flow has seen at least one packet.
+	e.Unaccounted = e.PacketsOrig == 0 && e.PacketsRet == 0
+
+	if start := f.Timestamp.Start; !start.IsZero() {
+		e.Start = uint64(start.UnixNano())
+
+		end := now
+		if stop := f.Timestamp.Stop; !stop.IsZero() {
+			end = stop
+		}
+		e.Duration = end.Sub(start)
+	}
+
+	return e
+}
+
+// addr returns the 4-byte form of IPv4 addresses if the NetlinkProbe
+// normalizes addresses, or the 16-byte form otherwise.
+func (np *NetlinkProbe) addr(ip net.IP) net.IP {
+	if np.probe.normalizeAddrs {
+		if v4 := ip.To4(); v4 != nil {
+			return v4
+		}
+	}
+	return ip.To16()
+}
+
+// portSet returns a set of the given ports, or nil if empty.
+func portSet(ports []uint16) map[uint16]bool {
+
+	if len(ports) == 0 {
+		return nil
+	}
+
+	s := make(map[uint16]bool, len(ports))
+	for _, p := range ports {
+		s[p] = true
+	}
+
+	return s
+}
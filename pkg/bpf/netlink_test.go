@@ -0,0 +1,163 @@
+package bpf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ti-mo/conntrack"
+)
+
+// newTestNetlinkProbe returns a NetlinkProbe without netlink connections.
+func newTestNetlinkProbe(cfg Config) *NetlinkProbe {
+	return &NetlinkProbe{
+		probe: &Probe{
+			bootTime:       time.Unix(1000, 0),
+			stats:          &ProbeStats{},
+			normalizeAddrs: !cfg.RawAddrs,
+		},
+		dstPorts: portSet(cfg.DstPortFilter),
+		srcPorts: portSet(cfg.SrcPortFilter),
+		seen:     make(map[uint32]bool),
+	}
+}
+
+// testFlow returns a UDP flow with the given ID and source port.
+func testFlow(id uint32, sport uint16) conntrack.Flow {
+	f := conntrack.NewFlow(17, conntrack.StatusSeenReply|conntrack.StatusAssured,
+		net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), sport, 53, 30, 42)
+	f.ID = id
+	f.CountersOrig = conntrack.Counter{Packets: 2, Bytes: 100}
+	f.CountersReply = conntrack.Counter{Packets: 1, Bytes: 200, Direction: true}
+	f.Timestamp.Start = time.Unix(1500, 0)
+	return f
+}
+
+func TestNetlinkFlowEvent(t *testing.T) {
+
+	np := newTestNetlinkProbe(Config{})
+	f := testFlow(7, 1234)
+	now := time.Unix(1510, 0)
+
+	e := np.flowEvent(&f, EventUpdate, now)
+	assert.Equal(t, EventUpdate, e.Type)
+	assert.EqualValues(t, 7, e.ConnectionID)
+	assert.EqualValues(t, 42, e.Connmark)
+	assert.Equal(t, net.IP{10, 0, 0, 1}, e.SrcAddr)
+	assert.Equal(t, net.IP{10, 0, 0, 2}, e.DstAddr)
+	assert.EqualValues(t, 1234, e.SrcPort)
+	assert.EqualValues(t, 53, e.DstPort)
+	assert.EqualValues(t, 17, e.Proto)
+	assert.Equal(t, Counters{PacketsOrig: 2, BytesOrig: 100, PacketsRet: 1, BytesRet: 200}, e.Counters())
+	assert.True(t, e.SeenReply)
+	assert.True(t, e.Assured)
+	assert.False(t, e.Unaccounted)
+	assert.Equal(t, now, e.Time)
+	assert.EqualValues(t, 510*time.Second, e.Timestamp)
+	assert.EqualValues(t, time.Unix(1500, 0).UnixNano(), e.Start)
+	assert.Equal(t, 10*time.Second, e.Duration)
+
+	// Destroy events last until the flow's stop timestamp.
+	f.Timestamp.Stop = time.Unix(1505, 0)
+	e = np.flowEvent(&f, EventDestroy, now)
+	assert.Equal(t, 5*time.Second, e.Duration)
+
+	// Flows of a conntrack helper's expectation.
+	f.Helper.Name = "ftp"
+	f.Status.Value |= conntrack.StatusExpected
+	e = np.flowEvent(&f, EventUpdate, now)
+	assert.Equal(t, "ftp", e.Helper)
+	assert.True(t, e.Expected)
+	assert.True(t, e.Status.Has(StatusExpected|StatusAssured))
+
+	// Flows without counters or timestamps.
+	f = testFlow(8, 1234)
+	f.CountersOrig, f.CountersReply = conntrack.Counter{}, conntrack.Counter{}
+	f.Timestamp.Start = time.Time{}
+	e = np.flowEvent(&f, EventUpdate, now)
+	assert.True(t, e.Unaccounted)
+	assert.Zero(t, e.Start)
+	assert.Zero(t, e.Duration)
+
+	// ICMP flows carry the ICMP fields instead of ports.
+	f = conntrack.NewFlow(1, 0, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), 0, 0, 30, 0)
+	f.TupleOrig.Proto.ICMPv4 = true
+	f.TupleOrig.Proto.ICMPType, f.TupleOrig.Proto.ICMPCode, f.TupleOrig.Proto.ICMPID = 8, 0, 77
+	e = np.flowEvent(&f, EventUpdate, now)
+	assert.Zero(t, e.SrcPort)
+	assert.Zero(t, e.DstPort)
+	assert.EqualValues(t, 8, e.ICMPType)
+	assert.EqualValues(t, 77, e.ICMPID)
+
+	np = newTestNetlinkProbe(Config{RawAddrs: true})
+	e = np.flowEvent(&f, EventUpdate, now)
+	assert.Equal(t, net.IPv4(10, 0, 0, 1), e.SrcAddr)
+	assert.Len(t, e.SrcAddr, net.IPv6len)
+}
+
+func TestNetlinkDumped(t *testing.T) {
+
+	np := newTestNetlinkProbe(Config{})
+
+	c := NewConsumer("all", make(chan Event, 8), ConsumerAll)
+	require.NoError(t, np.RegisterConsumer(c))
+
+	now := time.Unix(1510, 0)
+	np.dumped([]conntrack.Flow{testFlow(1, 1000), testFlow(2, 1001)}, now)
+
+	// Flows seen in the previous dump are updates.
+	np.dumped([]conntrack.Flow{testFlow(2, 1001), testFlow(3, 1002)}, now)
+
+	f := testFlow(3, 1002)
+	np.destroyed(&f, now)
+
+	// Destroyed flows are new again if their ID is reused.
+	np.dumped([]conntrack.Flow{testFlow(3, 1003)}, now)
+
+	want := []struct {
+		id  uint32
+		typ EventType
+	}{
+		{1, EventNew}, {2, EventNew},
+		{2, EventUpdate}, {3, EventNew},
+		{3, EventDestroy},
+		{3, EventNew},
+	}
+
+	require.Len(t, c.events, len(want))
+	for _, w := range want {
+		e := <-c.events
+		assert.Equal(t, w.id, e.ConnectionID)
+		assert.Equal(t, w.typ, e.Type, "event of flow %d", w.id)
+	}
+
+	st := np.Stats()
+	assert.EqualValues(t, 5, st.PerfEventsUpdate)
+	assert.EqualValues(t, 1, st.PerfEventsDestroy)
+}
+
+func TestNetlinkPortFilter(t *testing.T) {
+
+	np := newTestNetlinkProbe(Config{DstPortFilter: []uint16{53}, SrcPortFilter: []uint16{1000}})
+
+	match := testFlow(1, 1000)
+	assert.True(t, np.wantFlow(&match))
+
+	other := testFlow(2, 1001)
+	assert.False(t, np.wantFlow(&other))
+
+	// Flows without ports don't match a filter.
+	icmp := testFlow(3, 1000)
+	icmp.TupleOrig.Proto.Protocol = 1
+	assert.False(t, np.wantFlow(&icmp))
+
+	np = newTestNetlinkProbe(Config{})
+	assert.True(t, np.wantFlow(&icmp))
+}
+
+func TestNewNetlinkProbePinned(t *testing.T) {
+	_, err := NewNetlinkProbe(Config{PinPath: "/sys/fs/bpf/conntracct"})
+	assert.Equal(t, errNetlinkPinned, err)
+}
@@ -0,0 +1,434 @@
+package bpf
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// bpf(2) commands, map types and perf constants missing from x/sys/unix.
+const (
+	bpfMapUpdateElem = 2  // BPF_MAP_UPDATE_ELEM
+	bpfObjGet        = 7  // BPF_OBJ_GET
+	bpfObjGetInfo    = 15 // BPF_OBJ_GET_INFO_BY_FD
+
+	bpfMapTypePerfEventArray = 4 // BPF_MAP_TYPE_PERF_EVENT_ARRAY
+
+	perfCountSWBPFOutput = 10  // PERF_COUNT_SW_BPF_OUTPUT
+	perfFlagFdCloexec    = 0x8 // PERF_FLAG_FD_CLOEXEC
+
+	// Amount of data pages of each ring buffer, like gobpf's default.
+	perfPageCount = 8
+)
+
+// bpfMapInfo is the head of the kernel's struct bpf_map_info.
+type bpfMapInfo struct {
+	Type       uint32
+	ID         uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	MapFlags   uint32
+}
+
+// bpfCall issues a bpf(2) syscall with the given command and attribute.
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(r), nil
+}
+
+// bpfObjGetFd opens the BPF object pinned at the given path.
+func bpfObjGetFd(path string) (int, error) {
+
+	p, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return -1, err
+	}
+
+	attr := struct {
+		Pathname  uint64
+		BpfFd     uint32
+		FileFlags uint32
+	}{Pathname: uint64(uintptr(unsafe.Pointer(p)))}
+
+	return bpfCall(bpfObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// bpfGetMapInfo returns information about the BPF map with the given fd.
+func bpfGetMapInfo(fd int) (bpfMapInfo, error) {
+
+	var info bpfMapInfo
+
+	attr := struct {
+		BpfFd   uint32
+		InfoLen uint32
+		Info    uint64
+	}{
+		BpfFd:   uint32(fd),
+		InfoLen: uint32(unsafe.Sizeof(info)),
+		Info:    uint64(uintptr(unsafe.Pointer(&info))),
+	}
+
+	_, err := bpfCall(bpfObjGetInfo, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	return info, err
+}
+
+// bpfUpdateElem sets the value of key in the BPF map with the given fd.
+func bpfUpdateElem(fd int, key, value unsafe.Pointer) error {
+
+	attr := struct {
+		MapFd uint32
+		_     uint32
+		Key   uint64
+		Value uint64
+		Flags uint64
+	}{
+		MapFd: uint32(fd),
+		Key:   uint64(uintptr(key)),
+		Value: uint64(uintptr(value)),
+	}
+
+	_, err := bpfCall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+
+	return err
+}
+
+// checkPerfMapInfo checks if a map can be used as one of the probe's perf
+// maps, receiving events on the given CPUs.
+func checkPerfMapInfo(info bpfMapInfo, cpus []uint) error {
+
+	if info.Type != bpfMapTypePerfEventArray {
+		return fmt.Errorf(errFmtPinnedMapType, info.Type, bpfMapTypePerfEventArray)
+	}
+	if info.KeySize != 4 || info.ValueSize != 4 {
+		return fmt.Errorf(errFmtPinnedMapLayout, info.KeySize, info.ValueSize)
+	}
+
+	for _, cpu := range cpus {
+		if cpu >= uint(info.MaxEntries) {
+			return fmt.Errorf(errFmtPinnedMapEntries, info.MaxEntries, cpu)
+		}
+	}
+
+	return nil
+}
+
+// pinnedModule is a bpfModule reading events from the perf maps of an acct
+// probe that was loaded and pinned to bpffs by another component. Kprobes are
+// attached by the component owning the program, so EnableKprobe is a no-op.
+type pinnedModule struct {
+	dir string
+
+	// CPUs to open perf rings on.
+	cpus []uint
+
+	// CPUs the pollers of the module's readers are bound to, if any.
+	readerCPUs []uint
+
+	// File descriptors of the pinned perf maps, by name.
+	maps map[string]int
+
+	readers []*pinnedReader
+}
+
+// newPinnedModule opens and validates the probe's perf maps pinned in dir.
+func newPinnedModule(dir string, cpus []uint) (*pinnedModule, error) {
+
+	m := &pinnedModule{dir: dir, cpus: cpus, maps: make(map[string]int)}
+
+	for _, name := range []string{perfUpdateMap, perfDestroyMap} {
+		path := filepath.Join(dir, name)
+
+		fd, err := bpfObjGetFd(path)
+		if err != nil {
+			_ = m.Close()
+			return nil, errors.Wrapf(err, "opening pinned map %s", path)
+		}
+		m.maps[name] = fd
+
+		info, err := bpfGetMapInfo(fd)
+		if err != nil {
+			_ = m.Close()
+			return nil, errors.Wrapf(err, "getting info of pinned map %s", path)
+		}
+
+		if err := checkPerfMapInfo(info, cpus); err != nil {
+			_ = m.Close()
+			return nil, errors.Wrapf(err, "pinned map %s", path)
+		}
+	}
+
+	return m, nil
+}
+
+// EnableKprobe is a no-op, the probe's kprobes are managed by
+// the component that pinned its maps.
+func (m *pinnedModule) EnableKprobe(secName string, maxactive int) error {
+	return nil
+}
+
+// mapFd returns false, the pinned probe's state maps are not accessible.
+func (m *pinnedModule) mapFd(name string) (int, bool) {
+	return 0, false
+}
+
+// InitPerfMap opens a perf ring buffer on every online CPU and inserts them
+// into the named pinned perf map, replacing the rings of any previous reader.
+func (m *pinnedModule) InitPerfMap(name string, events chan []byte, lost chan uint64) (perfReader, error) {
+
+	fd, ok := m.maps[name]
+	if !ok {
+		return nil, fmt.Errorf("no map with name %s", name)
+	}
+
+	r := &pinnedReader{
+		cpus:   m.readerCPUs,
+		events: events,
+		lost:   lost,
+		stop:   make(chan struct{}),
+	}
+	m.readers = append(m.readers, r)
+
+	for _, cpu := range m.cpus {
+		ring, err := newPerfRing(int(cpu))
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening perf ring on CPU %d", cpu)
+		}
+		r.rings = append(r.rings, ring)
+
+		key, value := uint32(cpu), uint32(ring.fd)
+		if err := bpfUpdateElem(fd, unsafe.Pointer(&key), unsafe.Pointer(&value)); err != nil {
+			return nil, errors.Wrapf(err, "inserting perf ring of CPU %d into map %s", cpu, name)
+		}
+	}
+
+	return r, nil
+}
+
+// Close stops all readers and closes their perf rings and the pinned maps.
+// The pinned maps themselves are left in place.
+func (m *pinnedModule) Close() error {
+
+	for _, r := range m.readers {
+		r.close()
+	}
+	m.readers = nil
+
+	for name, fd := range m.maps {
+		_ = unix.Close(fd)
+		delete(m.maps, name)
+	}
+
+	return nil
+}
+
+// perfRing is a perf event ring buffer of a single CPU.
+type perfRing struct {
+	fd   int
+	mem  []byte
+	meta *unix.PerfEventMmapPage
+	data []byte
+}
+
+// newPerfRing opens a BPF output perf event on the given CPU and maps its
+// ring buffer into memory.
+func newPerfRing(cpu int) (*perfRing, error) {
+
+	attr := unix.PerfEventAttr{
+		Type:        unix.PERF_TYPE_SOFTWARE,
+		Config:      perfCountSWBPFOutput,
+		Sample_type: unix.PERF_SAMPLE_RAW,
+		Sample:      1,
+		Wakeup:      1,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, perfFlagFdCloexec)
+	if err != nil {
+		return nil, errors.Wrap(err, "perf_event_open")
+	}
+
+	ps := os.Getpagesize()
+	mem, err := unix.Mmap(fd, 0, ps*(perfPageCount+1), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, errors.Wrap(err, "mmap")
+	}
+
+	if err := unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0); err != nil {
+		_ = unix.Munmap(mem)
+		_ = unix.Close(fd)
+		return nil, errors.Wrap(err, "enabling perf event")
+	}
+
+	return &perfRing{
+		fd:   fd,
+		mem:  mem,
+		meta: (*unix.PerfEventMmapPage)(unsafe.Pointer(&mem[0])),
+		data: mem[ps:],
+	}, nil
+}
+
+// read calls fn for every record in the ring buffer with the record's type
+// and its body, and marks the records as consumed. The body is only valid
+// during the call.
+func (r *perfRing) read(fn func(typ uint32, body []byte)) {
+
+	head := atomic.LoadUint64(&r.meta.Data_head)
+	tail := r.meta.Data_tail
+	size := uint64(len(r.data))
+
+	var rec []byte
+	for tail < head {
+		// Records can wrap around the end of the ring, copy them out.
+		var hdr [8]byte
+		r.copy(hdr[:], tail%size)
+
+		// struct perf_event_header.
+		typ := *(*uint32)(unsafe.Pointer(&hdr[0]))
+		n := uint64(*(*uint16)(unsafe.Pointer(&hdr[6])))
+		if n < 8 {
+			break
+		}
+
+		if uint64(cap(rec)) < n {
+			rec = make([]byte, n)
+		}
+		rec = rec[:n]
+		r.copy(rec, tail%size)
+
+		fn(typ, rec[8:])
+
+		tail += n
+	}
+
+	atomic.StoreUint64(&r.meta.Data_tail, tail)
+}
+
+// copy copies len(dst) bytes from the ring's data area starting at offset,
+// wrapping around the end of the ring.
+func (r *perfRing) copy(dst []byte, offset uint64) {
+	n := copy(dst, r.data[offset:])
+	copy(dst[n:], r.data)
+}
+
+func (r *perfRing) close() {
+	_ = unix.Munmap(r.mem)
+	_ = unix.Close(r.fd)
+}
+
+// pinnedReader polls the perf rings of a pinned perf map.
+type pinnedReader struct {
+	rings  []*perfRing
+	cpus   []uint // CPUs the poller is bound to, if any
+	events chan []byte
+	lost   chan uint64
+
+	startOnce sync.Once
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// PollStart starts polling the reader's rings for events.
+func (r *pinnedReader) PollStart() {
+	r.startOnce.Do(func() {
+		r.wg.Add(1)
+		go r.poll()
+	})
+}
+
+// PollStop stops polling and waits for the poller to exit.
+func (r *pinnedReader) PollStop() {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	r.wg.Wait()
+}
+
+// close stops polling and releases the reader's rings.
+func (r *pinnedReader) close() {
+	r.PollStop()
+	for _, ring := range r.rings {
+		ring.close()
+	}
+	r.rings = nil
+}
+
+// poll waits for the rings to become readable and sends their samples to
+// the events channel, and the amount of lost samples to the lost channel.
+func (r *pinnedReader) poll() {
+
+	defer r.wg.Done()
+
+	// The perfWorker reports failing to bind to the same CPUs.
+	if len(r.cpus) != 0 {
+		_ = lockAffinity(r.cpus)
+	}
+
+	pfds := make([]unix.PollFd, len(r.rings))
+	for i, ring := range r.rings {
+		pfds[i] = unix.PollFd{Fd: int32(ring.fd), Events: unix.POLLIN}
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		// Wake up periodically to check for stop.
+		if _, err := unix.Poll(pfds, 500); err != nil && err != unix.EINTR {
+			return
+		}
+
+		for _, ring := range r.rings {
+			ring.read(r.record)
+		}
+	}
+}
+
+// record handles a single record read from a ring.
+func (r *pinnedReader) record(typ uint32, body []byte) {
+
+	switch typ {
+	case unix.PERF_RECORD_SAMPLE:
+		if len(body) < 4 {
+			return
+		}
+		// Like gobpf, strip the size field and the 4 bytes of padding
+		// the kernel adds to the raw sample to align it to 8 bytes.
+		size := int(*(*uint32)(unsafe.Pointer(&body[0]))) - 4
+		if size < 0 || 4+size > len(body) {
+			return
+		}
+		b := make([]byte, size)
+		copy(b, body[4:])
+
+		select {
+		case r.events <- b:
+		case <-r.stop:
+		}
+
+	case unix.PERF_RECORD_LOST:
+		if len(body) < 16 || r.lost == nil {
+			return
+		}
+		select {
+		case r.lost <- *(*uint64)(unsafe.Pointer(&body[8])):
+		case <-r.stop:
+		}
+	}
+}
@@ -1,13 +1,17 @@
 package bpf
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/iovisor/gobpf/elf"
+	"github.com/iovisor/gobpf/pkg/cpuonline"
 	"github.com/pkg/errors"
 
+	"github.com/ti-mo/conntracct/pkg/boottime"
 	"github.com/ti-mo/conntracct/pkg/kernel"
 )
 
@@ -18,17 +22,62 @@ const perfDestroyMap = "perf_acct_end"
 type Probe struct {
 
 	// gobpf/elf objects.
-	module      *elf.Module
-	perfUpdate  *elf.PerfMap
-	perfDestroy *elf.PerfMap
+	module      bpfModule
+	perfUpdate  perfReader
+	perfDestroy perfReader
+
+	// Loads a fresh copy of the probe's BPF module into the kernel.
+	// Used for restoring the probe after a failed Start().
+	load func() (bpfModule, error)
+
+	// Returns the CPUs online on the machine. Replaceable in tests.
+	onlineCPUs func() ([]uint, error)
 
 	// Target kernel of the loaded probe.
 	kernel kernel.Kernel
 
+	// Kinds of events the probe's kprobes are attached for, all if empty.
+	// See Config.Events.
+	events []EventType
+
+	// Normalize addresses of decoded events, see Config.RawAddrs.
+	normalizeAddrs bool
+
+	// CPUs the reader goroutines are bound to, see Config.ReaderCPUs.
+	readerCPUs []uint
+
+	// Required sysctls that were disabled when the probe was created.
+	disabledSysctls []string
+
+	// File the probe's flow state is saved to and restored from, see
+	// Config.StateFile, and the amount of flows restored by Start.
+	stateFile     string
+	restoredFlows int
+
+	// Boot time of the machine (estimated), used for converting
+	// kernel event timestamps into wall-clock time.
+	bootTime time.Time
+
 	// List of event consumers of the probe.
 	consumerMu sync.RWMutex
 	consumers  []*Consumer
 
+	// Fields decoded from events, wanted by any of the consumers.
+	// Accessed atomically, see updateFields.
+	fields uint32
+
+	// Kinds of events wanted by any of the consumers, a ConsumerMode.
+	// Accessed atomically, see updateFields.
+	modes uint32
+
+	// Set to 1 while the probe is paused. Accessed atomically.
+	paused uint32
+
+	// Consumer backing the channel returned by Events(), nil until
+	// Events() is first called.
+	eventsMu       sync.Mutex
+	eventsConsumer *Consumer
+
 	// Channel for receiving IDs of lost perf events.
 	lostChan chan uint64
 
@@ -37,17 +86,64 @@ type Probe struct {
 	perfDestroyChan chan []byte
 	errChan         chan error
 
+	// Subscriptions to errors of a minimum severity, see Errors().
+	errSubs errorSubs
+
 	// Started status of the probe.
 	startMu sync.Mutex
 	started bool
 
+	// Closed when the probe is stopped.
+	stop chan struct{}
+
+	// Tracks the probe's perfWorker and lostWorker.
+	workers sync.WaitGroup
+
 	stats *ProbeStats
+
+	// Average rate of events read, see ProbeStats.PerfEventsRate.
+	rate rateMeter
+
+	// Per-CPU event counters, populated on Start().
+	cpuStats cpuCounters
+
+	// Cached result of MapStats().
+	mapStatsMu   sync.Mutex
+	mapStatsTime time.Time
+	mapStats     []MapStats
 }
 
 // NewProbe instantiates an Probe using the given Config.
 // Loads the BPF program into the kernel but does not attach its kprobes yet.
+// If the Config has a PinPath, opens the pinned perf maps instead.
+// Returns an error if conntrack accounting is disabled by sysctl, unless
+// the Config allows unaccounted flows. Multiple Probes with different
+// Configs can run at once, each with its own maps and kprobe events.
 func NewProbe(cfg Config) (*Probe, error) {
 
+	if len(cfg.ReaderCPUs) != 0 {
+		online, err := cpuonline.Get()
+		if err != nil {
+			return nil, errors.Wrap(err, "getting online CPUs")
+		}
+		if err := checkReaderCPUs(cfg.ReaderCPUs, online); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkEventTypes(cfg.Events); err != nil {
+		return nil, err
+	}
+
+	if cfg.PinPath != "" {
+		return newPinnedProbe(cfg)
+	}
+
+	disabled, err := checkSysctls(cfg.AllowUnaccounted)
+	if err != nil {
+		return nil, err
+	}
+
 	kr, err := kernelRelease()
 	if err != nil {
 		return nil, err
@@ -59,29 +155,73 @@ func NewProbe(cfg Config) (*Probe, error) {
 		return nil, errors.Wrap(err, "selecting BPF probe")
 	}
 
+	image := make([]byte, br.Len())
+	if _, err := br.Read(image); err != nil {
+		return nil, errors.Wrap(err, "reading BPF probe")
+	}
+
+	// Refuse objects not matching the event layout and maps of userspace.
+	if err := checkImage(image); err != nil {
+		return nil, errors.Wrapf(err, "checking BPF probe version %s", k.Version)
+	}
+
 	// Instantiate Probe with selected target kernel struct.
 	ap := Probe{
-		kernel: k,
-		stats:  &ProbeStats{},
+		kernel:          k,
+		events:          cfg.Events,
+		bootTime:        boottime.Estimate(),
+		stats:           &ProbeStats{},
+		load:            elfLoader(image, k, cfg),
+		onlineCPUs:      cpuonline.Get,
+		normalizeAddrs:  !cfg.RawAddrs,
+		readerCPUs:      cfg.ReaderCPUs,
+		disabledSysctls: disabled,
+		stateFile:       cfg.StateFile,
 	}
 
 	// Scan kallsyms before attempting BPF load to avoid arcane error output from eBPF attach.
-	err = checkProbeKsyms(k.Probes)
+	err = checkProbeKsyms(eventKprobes(k.Probes, cfg.Events))
 	if err != nil {
 		return nil, err
 	}
 
-	// Load the module from the bytes.Reader and insert into the kernel.
-	ap.module = elf.NewModuleFromReader(br)
-	if err := ap.module.Load(nil); err != nil {
-		// Error string from go-bpf can contain many NUL characters and need to be trimmed.
-		err = errors.New(strings.TrimRight(err.Error(), "\x00"))
-		return nil, errors.Wrap(err, fmt.Sprintf("failed to load ELF binary version %s", k.Version))
+	// Load and configure the module.
+	if ap.module, err = ap.load(); err != nil {
+		return nil, err
+	}
+
+	return &ap, nil
+}
+
+// newPinnedProbe returns a Probe reading events from the perf maps
+// pinned in the Config's PinPath.
+func newPinnedProbe(cfg Config) (*Probe, error) {
+
+	dir := cfg.PinPath
+
+	cpus, err := cpuonline.Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting online CPUs")
+	}
+
+	ap := Probe{
+		bootTime:       boottime.Estimate(),
+		stats:          &ProbeStats{},
+		onlineCPUs:     cpuonline.Get,
+		normalizeAddrs: !cfg.RawAddrs,
+		readerCPUs:     cfg.ReaderCPUs,
+		load: func() (bpfModule, error) {
+			m, err := newPinnedModule(dir, cpus)
+			if err != nil {
+				return nil, err
+			}
+			m.readerCPUs = cfg.ReaderCPUs
+			return m, nil
+		},
 	}
 
-	// Apply probe configuration.
-	if err := configureProbe(ap.module, cfg); err != nil {
-		return nil, errors.Wrap(err, "configuring BPF probe")
+	if ap.module, err = ap.load(); err != nil {
+		return nil, err
 	}
 
 	return &ap, nil
@@ -97,48 +237,147 @@ func (ap *Probe) Start() error {
 		return errProbeStarted
 	}
 
-	// Enable all kprobes in target kernel's probe list.
-	for _, p := range ap.kernel.Probes {
+	if ap.module == nil {
+		return errProbeUnloaded
+	}
+
+	// Restore the flow state before the kprobes are attached,
+	// so the program never sees the flows without their state.
+	if ap.stateFile != "" {
+		n, err := restoreFlowState(ap.module, ap.stateFile)
+		if err != nil {
+			return ap.unwind(errors.Wrap(err, "restoring flow state"))
+		}
+		ap.restoredFlows = n
+	}
+
+	if err := ap.attach(); err != nil {
+		// Kprobes and perf maps can't be detached individually, unload
+		// the module entirely and load a fresh copy of it, so the probe
+		// is in the same state as before the call and can be started again.
+		return ap.unwind(err)
+	}
+
+	ap.workers.Add(2)
+
+	// Start the event message decoder and fanout worker.
+	go ap.perfWorker()
+
+	// Start worker counting the amount of lost messages.
+	go ap.lostWorker()
+
+	// Start polling the BPF perf ring buffer, into update and destroy chans.
+	ap.perfUpdate.PollStart()
+	ap.perfDestroy.PollStart()
+
+	ap.stop = make(chan struct{})
+	ap.started = true
+
+	// The restored state goes stale as soon as the probe runs.
+	if ap.stateFile != "" {
+		_ = os.Remove(ap.stateFile)
+	}
+
+	return nil
+}
+
+// StartContext starts the Probe like Start, and stops it like Stop when ctx
+// is done. Errors stopping the Probe are sent on its ErrChan. Calling Stop
+// before ctx is done stops the Probe as usual.
+func (ap *Probe) StartContext(ctx context.Context) error {
+
+	if err := ap.Start(); err != nil {
+		return err
+	}
+
+	ap.startMu.Lock()
+	stop := ap.stop
+	ap.startMu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			if err := ap.Stop(); err != nil && err != errProbeNotStarted {
+				ap.sendError(ComponentLifecycle, SeverityFatal, errors.Wrap(err, "stopping probe"))
+			}
+		case <-stop:
+		}
+	}()
+
+	return nil
+}
+
+// attach enables the kprobes of the probe's kinds of events and sets up its
+// perf map readers. Does not start any goroutines, so the Probe can be
+// unwound on error.
+func (ap *Probe) attach() error {
+
+	// Enable the kprobes in target kernel's probe list needed for the events.
+	for _, p := range eventKprobes(ap.kernel.Probes, ap.events) {
 		if err := ap.module.EnableKprobe(p, 0); err != nil {
-			return errors.Wrap(err, "enabling kprobe")
+			return errors.Wrapf(err, "enabling kprobe %s", p)
 		}
 	}
 
-	ap.perfUpdateChan = make(chan []byte, 1024)
-	ap.perfDestroyChan = make(chan []byte, 1024)
-	ap.lostChan = make(chan uint64)
-	ap.errChan = make(chan error)
+	// Create event counters for all online CPUs.
+	cpus, err := ap.onlineCPUs()
+	if err != nil {
+		return errors.Wrap(err, "getting online CPUs")
+	}
+
+	perfUpdateChan := make(chan []byte, 1024)
+	perfDestroyChan := make(chan []byte, 1024)
+	lostChan := make(chan uint64)
 
 	// Set up perf maps with an event and lost channel.
-	um, err := elf.InitPerfMap(ap.module, perfUpdateMap, ap.perfUpdateChan, ap.lostChan)
+	um, err := ap.module.InitPerfMap(perfUpdateMap, perfUpdateChan, lostChan)
 	if err != nil {
 		return errors.Wrap(err, fmt.Sprintf("InitPerfMap %s", perfUpdateMap))
 	}
-	ap.perfUpdate = um
 
-	dm, err := elf.InitPerfMap(ap.module, perfDestroyMap, ap.perfDestroyChan, ap.lostChan)
+	dm, err := ap.module.InitPerfMap(perfDestroyMap, perfDestroyChan, lostChan)
 	if err != nil {
-		return errors.Wrap(err, fmt.Sprintf("InitPerfMap %s", perfUpdateMap))
+		return errors.Wrap(err, fmt.Sprintf("InitPerfMap %s", perfDestroyMap))
 	}
+
+	// Only commit to the Probe after all steps succeeded.
+	ap.cpuStats = newCPUCounters(cpus)
+	ap.perfUpdateChan = perfUpdateChan
+	ap.perfDestroyChan = perfDestroyChan
+	ap.lostChan = lostChan
+	ap.errChan = make(chan error)
+	ap.perfUpdate = um
 	ap.perfDestroy = dm
 
-	// Start the event message decoder and fanout worker.
-	go ap.perfWorker()
+	return nil
+}
 
-	// Start worker counting the amount of lost messages.
-	go ap.lostWorker()
+// unwind releases all kernel resources of a partially started probe by
+// closing its module, and loads a fresh copy of the module. Returns cause,
+// annotated with any errors that occurred while unwinding. If the module
+// can't be reloaded, the Probe can no longer be started.
+func (ap *Probe) unwind(cause error) error {
 
-	// Start polling the BPF perf ring buffer, into update and destroy chans.
-	um.PollStart()
-	dm.PollStart()
+	err := ap.module.Close()
+	ap.module = nil
+	if err != nil {
+		return errors.Wrapf(cause, "starting probe (cleanup failed: %s)", err)
+	}
 
-	ap.started = true
+	ap.module, err = ap.load()
+	if err != nil {
+		return errors.Wrapf(cause, "starting probe (reloading failed: %s)", err)
+	}
 
-	return nil
+	return errors.Wrap(cause, "starting probe")
 }
 
 // Stop stops the BPF program and releases all its related resources.
-// Closes all Probe's channels. Can only be called after Start().
+// Closes all Probe's channels and waits for its workers to exit.
+// Can only be called after Start(). A stopped Probe can't be started again.
+// Saves the probe's flow state to the Config's StateFile, if any, before
+// unloading the probe. Failing to save it doesn't stop the Probe from being
+// stopped, the error is returned afterwards.
 func (ap *Probe) Stop() error {
 
 	ap.startMu.Lock()
@@ -148,6 +387,13 @@ func (ap *Probe) Stop() error {
 		return errProbeNotStarted
 	}
 
+	// Save the flow state while the maps are still open. The probe is
+	// stopped regardless, since the state is best-effort.
+	var serr error
+	if ap.stateFile != "" {
+		serr = saveFlowState(ap.module, ap.stateFile)
+	}
+
 	// Releases all gobpf-internal resources, including the perfMap poller.
 	if err := ap.module.Close(); err != nil {
 		return err
@@ -156,9 +402,57 @@ func (ap *Probe) Stop() error {
 	close(ap.lostChan)
 	close(ap.perfUpdateChan)
 	close(ap.perfDestroyChan)
+
+	// Workers may send errors until they exit.
+	ap.workers.Wait()
 	close(ap.errChan)
+	ap.errSubs.close()
 
-	return nil
+	close(ap.stop)
+	ap.started = false
+	ap.module = nil
+
+	return errors.Wrap(serr, "saving flow state")
+}
+
+// Pause stops delivering events to the Probe's consumers, without detaching
+// the probe or stopping its consumers, eg. to stop sinks from writing during
+// maintenance. Can be called whether or not the Probe is started.
+//
+// The kernel keeps generating events while paused. They are read from the
+// perf rings and discarded, counted in the Probe's PerfEventsPaused, so the
+// rings don't fill up and events read right after Resume are not stale or
+// lost. The probe's per-flow state in the kernel is maintained as usual.
+// Since events carry the totals of their flows, the first event of a flow
+// after Resume accounts for the flow's traffic during the pause, but flows
+// destroyed during the pause are not accounted.
+func (ap *Probe) Pause() {
+	atomic.StoreUint32(&ap.paused, 1)
+}
+
+// Resume resumes delivering events to the Probe's consumers after Pause.
+func (ap *Probe) Resume() {
+	atomic.StoreUint32(&ap.paused, 0)
+}
+
+// Paused returns true if the Probe is paused, see Pause.
+func (ap *Probe) Paused() bool {
+	return atomic.LoadUint32(&ap.paused) == 1
+}
+
+// DisabledSysctls returns the sysctls required for accounting flows that were
+// disabled when the Probe was created. Only non-empty if the Probe's Config
+// allows unaccounted flows. Always empty for Probes reading pinned maps.
+func (ap *Probe) DisabledSysctls() []string {
+	return ap.disabledSysctls
+}
+
+// RestoredFlows returns the amount of flows of which the state was restored
+// from the Config's StateFile when the Probe was started.
+func (ap *Probe) RestoredFlows() int {
+	ap.startMu.Lock()
+	defer ap.startMu.Unlock()
+	return ap.restoredFlows
 }
 
 // Kernel returns the target kernel structure of the selected probe.
@@ -169,23 +463,52 @@ func (ap *Probe) Kernel() kernel.Kernel {
 // ErrChan returns an initialized Probe's unbuffered error channel.
 // The error channel is unbuffered because it doesn't make sense to have
 // stale error data. If there is no ready consumer on the channel, errors
-// are dropped.
+// are dropped. Errors of all severities are sent as a *ProbeError.
 // Returns nil if the Probe has not been Start()ed yet.
 func (ap *Probe) ErrChan() chan error {
 	return ap.errChan
 }
 
+// Errors returns a channel receiving the Probe's errors of at least the
+// given severity, eg. SeverityFatal for a supervisor recreating the Probe
+// when it stops delivering events. Can be called before the Probe is
+// started. The channel is buffered, errors are dropped when it is full.
+// It is closed when the Probe is stopped, or right away if it's already
+// stopped.
+func (ap *Probe) Errors(min Severity) <-chan *ProbeError {
+	return ap.errSubs.add(min)
+}
+
 // Stats returns a snapshot copy of the Probe's statistics.
 func (ap *Probe) Stats() ProbeStats {
-	return ap.stats.Get()
+	st := ap.stats.Get()
+	st.PerfEventsRate = ap.rate.update(st.PerfEventsTotal, time.Now())
+	return st
+}
+
+// CPUStats returns a snapshot copy of the Probe's per-CPU statistics,
+// with an entry for every CPU that was online when the Probe was started.
+// Lost events are only available in aggregate in the Probe's Stats(),
+// since the perf reader does not report which CPU's ring lost events.
+// Returns nil if the Probe has not been Start()ed yet.
+func (ap *Probe) CPUStats() []CPUStats {
+	if ap.cpuStats == nil {
+		return nil
+	}
+	return ap.cpuStats.get()
 }
 
-// sendError safely sends a message on the Probe's unbuffered errChan.
-// If there is no ready channel receiver, sendError is a no-op. A return value
-// of true means the error was successfully sent on the channel.
-func (ap *Probe) sendError(err error) bool {
+// sendError safely sends an error raised by the given component on the
+// Probe's unbuffered errChan, and to the subscribers of its severity.
+// If there is no ready channel receiver, sending on errChan is a no-op.
+// A return value of true means the error was successfully sent on errChan.
+func (ap *Probe) sendError(component string, sev Severity, err error) bool {
+
+	pe := newProbeError(component, sev, err)
+	ap.errSubs.send(pe)
+
 	select {
-	case ap.errChan <- err:
+	case ap.errChan <- pe:
 		return true
 	default:
 		return false
@@ -197,18 +520,32 @@ func (ap *Probe) sendError(err error) bool {
 // consumers' event channels. Exits if perfUpdateChan or perfDestroyChan are closed.
 func (ap *Probe) perfWorker() {
 
+	defer ap.workers.Done()
+
+	if len(ap.readerCPUs) != 0 {
+		if err := lockAffinity(ap.readerCPUs); err != nil {
+			ap.sendError(ComponentLifecycle, SeverityWarning, err)
+		}
+	}
+
 	var eb []byte
 	var ok bool
 	var update bool
 
+	// The kprobes emitting new events also emit updates.
+	dropUpdates := !wantsEvent(ap.events, EventUpdate)
+
 	for {
+		// Both rings are read fairly, so destroy events aren't starved under
+		// sustained update load. Events are not ordered between the rings: an
+		// update can be read after its flow's destroy. Consumers needing the
+		// destroy's totals to be final must drop updates raised before it, by
+		// their Timestamp or Seq, like the pipeline does.
 		select {
 		case eb, ok = <-ap.perfUpdateChan:
 			update = true
-			ap.stats.incrPerfEventsUpdate()
 		case eb, ok = <-ap.perfDestroyChan:
 			update = false
-			ap.stats.incrPerfEventsDestroy()
 		}
 
 		if !ok {
@@ -216,54 +553,108 @@ func (ap *Probe) perfWorker() {
 			return
 		}
 
+		if update {
+			ap.stats.incrPerfEventsUpdate()
+		} else {
+			ap.stats.incrPerfEventsDestroy()
+		}
+
+		// Drain the perf rings while paused, without decoding events.
+		if ap.Paused() {
+			ap.stats.incrPerfEventsPaused()
+			continue
+		}
+
+		fields := EventField(atomic.LoadUint32(&ap.fields))
+
+		// Events of kinds no consumer wants are only decoded for the stats.
+		modes := ConsumerMode(atomic.LoadUint32(&ap.modes))
+		wanted := modes&ConsumerDestroy != 0
+		if update {
+			wanted = modes&(ConsumerUpdate|ConsumerNew) != 0
+		}
+		if !wanted {
+			fields = 0
+		}
+
 		var ae Event
-		if err := ae.UnmarshalBinary(eb); err != nil {
-			ap.sendError(errors.Wrap(err, "error unmarshaling Event byte array"))
+		if err := ae.unmarshalBinary(eb, ap.normalizeAddrs, fields); err != nil {
+			// Malformed events are dropped, they'd be delivered with
+			// misread or missing fields otherwise.
+			ap.stats.incrPerfEventsMalformed()
+			ap.sendError(ComponentDecoder, SeverityError, errors.Wrap(err, "decoding perf event"))
+			continue
+		}
+
+		// To obtain the absolute time stamp of an event in kernel space,
+		// we add its (monotonic) time stamp to the estimated boot time of the kernel.
+		if fields.has(FieldTime) {
+			ae.Time = ap.bootTime.Add(time.Duration(ae.Timestamp))
+		}
+
+		ap.cpuStats.incr(uint(ae.CPU))
+
+		// Only new events are marked by the probe, the type of
+		// other events depends on the perf map they were read from.
+		if !update {
+			ae.Type = EventDestroy
+			ae.TriggerDir = 0
+		} else if ae.Type != EventNew {
+			if dropUpdates {
+				continue
+			}
+			ae.Type = EventUpdate
+		}
+
+		if !wanted {
+			continue
 		}
 
 		// Fanout to all registered consumers.
-		ap.fanoutEvent(ae, update)
+		ap.fanoutEvent(ae)
 	}
 }
 
-// lostWorker increments the Probe's lost field for every message
-// received on its lostChan. Exits if lostChan is closed.
+// lostWorker increments the Probe's lost field by the amount of lost events
+// in every message received on its lostChan. Exits if lostChan is closed.
 func (ap *Probe) lostWorker() {
 
+	defer ap.workers.Done()
+
 	for {
-		_, ok := <-ap.lostChan
+		n, ok := <-ap.lostChan
 		if !ok {
 			// Channel closed.
 			return
 		}
 
-		ap.stats.incrPerfEventsLost()
+		ap.stats.addPerfEventsLost(n)
 	}
 }
 
-// fanoutEvent sends the given Event to all registered consumers.
-// The update flag specifies whether the event is an update (true) or destroy
-// (false) event.
-func (ap *Probe) fanoutEvent(ae Event, update bool) {
+// fanoutEvent sends the given Event to all registered consumers
+// that want to receive events of its type.
+//
+// Sends never block, an event is counted as lost by a consumer whose channel
+// is full. This keeps delivery fair: a consumer that stops reading its channel
+// only loses its own events, and does not delay delivery to other consumers,
+// regardless of the order in which consumers were registered.
+func (ap *Probe) fanoutEvent(ae Event) {
 
 	// Take a read lock on the consumers so we don't send to closed or already
 	// unregistered consumer channels.
 	ap.consumerMu.RLock()
 
 	for _, c := range ap.consumers {
-		// Require the update/destroy condition of the event to match
-		// the requested event type of the consumer.
-		if (update && c.WantUpdate()) || (!update && c.WantDestroy()) {
-			// Non-blocking send to the consumer's event channel.
-			select {
-			case c.events <- ae:
-				c.stats.setQueueLength(len(c.events))
-				c.stats.incrEventsReceived()
-			default:
-				// If the channel can't be written to immediately,
-				// increment the consumer's lost counter.
-				c.stats.incrEventsLost()
+		// Require the type of the event to match
+		// the requested event types of the consumer.
+		if c.wantType(ae.Type) && (c.filter == nil || c.filter(ae)) {
+			if c.reorder != nil {
+				c.reorder.add(ae)
+				continue
 			}
+
+			c.send(ae)
 		}
 	}
 
@@ -0,0 +1,151 @@
+package bpf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrorsBufferSize is the capacity of the channels returned by Errors.
+const ErrorsBufferSize = 16
+
+// Severity is the severity of an error raised by a running Probe.
+type Severity uint8
+
+// Severities of errors raised by the Probe, from least to most severe.
+const (
+	// The Probe is working as intended, but something needs attention.
+	SeverityWarning Severity = iota + 1
+	// An operation failed, eg. an event was lost. The Probe keeps running.
+	SeverityError
+	// The Probe can no longer deliver events and needs to be recreated.
+	SeverityFatal
+)
+
+var severityNames = map[Severity]string{
+	SeverityWarning: "warning",
+	SeverityError:   "error",
+	SeverityFatal:   "fatal",
+}
+
+// String returns the name of the Severity.
+func (s Severity) String() string {
+	if n, ok := severityNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("Severity(%d)", s)
+}
+
+// Components of the Probe raising errors.
+const (
+	ComponentDecoder   = "decoder"
+	ComponentLifecycle = "lifecycle"
+	ComponentNetlink   = "netlink"
+)
+
+// ProbeError is an error raised by a running Probe. Errors sent on the
+// Probe's ErrChan and Errors channels are always a *ProbeError.
+type ProbeError struct {
+	Err error
+
+	Severity Severity
+	// Part of the Probe raising the error, one of the Component* constants.
+	Component string
+	// False if the Probe stopped delivering events because of the error.
+	Recoverable bool
+	Time        time.Time
+}
+
+// newProbeError returns a ProbeError for err raised now. Only fatal
+// errors are unrecoverable.
+func newProbeError(component string, sev Severity, err error) *ProbeError {
+	return &ProbeError{
+		Err:         err,
+		Severity:    sev,
+		Component:   component,
+		Recoverable: sev < SeverityFatal,
+		Time:        time.Now(),
+	}
+}
+
+// Error returns the message of the underlying error.
+func (e *ProbeError) Error() string {
+	return e.Err.Error()
+}
+
+// Cause returns the underlying error, for use with errors.Cause.
+func (e *ProbeError) Cause() error {
+	return e.Err
+}
+
+// errorSub is a subscription to errors at or above a minimum severity.
+type errorSub struct {
+	min Severity
+	c   chan *ProbeError
+}
+
+// errorSubs holds the subscriptions to a Probe's errors.
+type errorSubs struct {
+	mu     sync.Mutex
+	subs   []errorSub
+	closed bool
+}
+
+// add subscribes to errors of at least the given severity. The returned
+// channel is closed right away if the subscriptions are closed.
+func (s *errorSubs) add(min Severity) <-chan *ProbeError {
+
+	c := make(chan *ProbeError, ErrorsBufferSize)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		close(c)
+		return c
+	}
+
+	s.subs = append(s.subs, errorSub{min, c})
+
+	return c
+}
+
+// send delivers the error to all subscriptions wanting its severity.
+// Never blocks, the error is dropped for subscribers with a full channel.
+func (s *errorSubs) send(pe *ProbeError) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if pe.Severity < sub.min {
+			continue
+		}
+		select {
+		case sub.c <- pe:
+		default:
+		}
+	}
+}
+
+// close closes the channels of all subscriptions and removes them.
+// Later subscriptions are closed right away, until the subscriptions
+// are reopened.
+func (s *errorSubs) close() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		close(sub.c)
+	}
+	s.subs = nil
+	s.closed = true
+}
+
+// reopen accepts new subscriptions after close.
+func (s *errorSubs) reopen() {
+	s.mu.Lock()
+	s.closed = false
+	s.mu.Unlock()
+}
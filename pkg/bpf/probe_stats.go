@@ -1,6 +1,9 @@
 package bpf
 
-import "sync/atomic"
+import (
+	"sort"
+	"sync/atomic"
+)
 
 // ProbeStats holds various statistics and information about the
 // BPF probe.
@@ -16,6 +19,19 @@ type ProbeStats struct {
 	PerfEventsUpdate uint64 `json:"perf_events_update"`
 	// amount of destroy events received from the kernel
 	PerfEventsDestroy uint64 `json:"perf_events_destroy"`
+
+	// amount of events received from the kernel that could not be decoded,
+	// eg. because the probe's event layout differs from userspace's
+	PerfEventsMalformed uint64 `json:"perf_events_malformed"`
+
+	// amount of events received from the kernel and discarded
+	// while the probe was paused
+	PerfEventsPaused uint64 `json:"perf_events_paused"`
+
+	// events received from the kernel per second, as an exponentially
+	// weighted moving average over about a minute, updated when the
+	// stats are read
+	PerfEventsRate float64 `json:"perf_events_rate"`
 }
 
 // incrPerfEventsTotal atomically increases the total event counter by one.
@@ -38,9 +54,21 @@ func (s *ProbeStats) incrPerfEventsDestroy() {
 	s.incrPerfEventsTotal()
 }
 
-// IncrPerfEventsLost atomically increases the amount of lost perf events.
-func (s *ProbeStats) incrPerfEventsLost() {
-	atomic.AddUint64(&s.PerfEventsLost, 1)
+// incrPerfEventsMalformed atomically increases the amount of events
+// that could not be decoded by one.
+func (s *ProbeStats) incrPerfEventsMalformed() {
+	atomic.AddUint64(&s.PerfEventsMalformed, 1)
+}
+
+// incrPerfEventsPaused atomically increases the amount of events
+// discarded while paused by one.
+func (s *ProbeStats) incrPerfEventsPaused() {
+	atomic.AddUint64(&s.PerfEventsPaused, 1)
+}
+
+// addPerfEventsLost atomically increases the amount of lost perf events by n.
+func (s *ProbeStats) addPerfEventsLost(n uint64) {
+	atomic.AddUint64(&s.PerfEventsLost, n)
 }
 
 // Get returns a copy of the Stats structure created using atomic loads.
@@ -53,5 +81,48 @@ func (s *ProbeStats) Get() ProbeStats {
 		PerfEventsLost:    atomic.LoadUint64(&s.PerfEventsLost),
 		PerfEventsUpdate:  atomic.LoadUint64(&s.PerfEventsUpdate),
 		PerfEventsDestroy: atomic.LoadUint64(&s.PerfEventsDestroy),
+
+		PerfEventsMalformed: atomic.LoadUint64(&s.PerfEventsMalformed),
+		PerfEventsPaused:    atomic.LoadUint64(&s.PerfEventsPaused),
+	}
+}
+
+// CPUStats holds statistics about the events generated on a single CPU.
+type CPUStats struct {
+	CPU uint `json:"cpu"`
+	// amount of events read from the CPU's perf ring
+	PerfEventsRead uint64 `json:"perf_events_read"`
+}
+
+// cpuCounters holds per-CPU event counters. The map is populated once
+// when the Probe is started and is only read afterwards.
+type cpuCounters map[uint]*uint64
+
+// newCPUCounters returns a set of zeroed counters for the given CPUs.
+func newCPUCounters(cpus []uint) cpuCounters {
+	c := make(cpuCounters, len(cpus))
+	for _, cpu := range cpus {
+		c[cpu] = new(uint64)
+	}
+	return c
+}
+
+// incr atomically increases the counter of the given CPU by one.
+// No-op for CPUs that were not online when the counters were created.
+func (c cpuCounters) incr(cpu uint) {
+	if p, ok := c[cpu]; ok {
+		atomic.AddUint64(p, 1)
 	}
 }
+
+// get returns a list of CPUStats created using atomic loads, sorted by CPU.
+func (c cpuCounters) get() []CPUStats {
+	out := make([]CPUStats, 0, len(c))
+	for cpu, p := range c {
+		out = append(out, CPUStats{CPU: cpu, PerfEventsRead: atomic.LoadUint64(p)})
+	}
+
+	sort.Slice(out, func(i, j int) bool { return out[i].CPU < out[j].CPU })
+
+	return out
+}
@@ -0,0 +1,490 @@
+package bpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/kernel"
+)
+
+var errInjected = errors.New("injected failure")
+
+// fakeModule is a bpfModule keeping track of the resources it holds.
+// Fails when the operation named in fail is performed.
+type fakeModule struct {
+	fail string
+
+	kprobes []string
+	readers []*fakeReader
+	closed  int
+}
+
+type fakeReader struct{ polling bool }
+
+func (r *fakeReader) PollStart() { r.polling = true }
+func (r *fakeReader) PollStop()  { r.polling = false }
+
+func (m *fakeModule) EnableKprobe(secName string, maxactive int) error {
+	if m.fail == secName {
+		return errInjected
+	}
+	m.kprobes = append(m.kprobes, secName)
+	return nil
+}
+
+func (m *fakeModule) InitPerfMap(name string, events chan []byte, lost chan uint64) (perfReader, error) {
+	if m.fail == name {
+		return nil, errInjected
+	}
+	r := &fakeReader{}
+	m.readers = append(m.readers, r)
+	return r, nil
+}
+
+func (m *fakeModule) mapFd(name string) (int, bool) {
+	return 0, false
+}
+
+func (m *fakeModule) Close() error {
+	m.closed++
+	m.kprobes = nil
+	m.readers = nil
+	return nil
+}
+
+// leaked returns true if the module holds any resources.
+func (m *fakeModule) leaked() bool {
+	return m.closed == 0 && (len(m.kprobes) != 0 || len(m.readers) != 0)
+}
+
+// newFakeProbe returns a Probe with a fakeModule failing at the given stage.
+// All modules loaded into the Probe are appended to mods.
+func newFakeProbe(fail string, mods *[]*fakeModule) *Probe {
+
+	load := func() (bpfModule, error) {
+		m := &fakeModule{fail: fail}
+		*mods = append(*mods, m)
+		return m, nil
+	}
+
+	m, _ := load()
+
+	return &Probe{
+		module: m,
+		load:   load,
+		onlineCPUs: func() ([]uint, error) {
+			if fail == "cpus" {
+				return nil, errInjected
+			}
+			return []uint{0, 1}, nil
+		},
+		kernel: kernel.Kernel{Probes: []string{"kprobe/one", "kretprobe/two"}},
+		stats:  &ProbeStats{},
+	}
+}
+
+func TestProbeStartUnwind(t *testing.T) {
+
+	tests := []struct {
+		fail string
+		err  string
+	}{
+		{"kprobe/one", "enabling kprobe kprobe/one"},
+		{"kretprobe/two", "enabling kprobe kretprobe/two"},
+		{"cpus", "getting online CPUs"},
+		{perfUpdateMap, "InitPerfMap " + perfUpdateMap},
+		{perfDestroyMap, "InitPerfMap " + perfDestroyMap},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fail, func(t *testing.T) {
+			var mods []*fakeModule
+			ap := newFakeProbe(tt.fail, &mods)
+
+			err := ap.Start()
+			require.Error(t, err)
+			assert.Equal(t, "starting probe: "+tt.err+": injected failure", err.Error())
+
+			// The failed module was released and replaced by a fresh one.
+			require.Len(t, mods, 2)
+			assert.Equal(t, 1, mods[0].closed)
+			assert.False(t, mods[0].leaked())
+			assert.Equal(t, ap.module, mods[1])
+			assert.Empty(t, mods[1].kprobes)
+			assert.Empty(t, mods[1].readers)
+
+			// No state of the failed attempt is kept on the Probe.
+			assert.False(t, ap.started)
+			assert.Nil(t, ap.perfUpdate)
+			assert.Nil(t, ap.perfDestroy)
+			assert.Nil(t, ap.cpuStats)
+			assert.Nil(t, ap.errChan)
+
+			// Starting again tries again from scratch.
+			assert.Error(t, ap.Start())
+			assert.Len(t, mods, 3)
+			assert.Equal(t, 1, mods[1].closed)
+		})
+	}
+}
+
+func TestProbeStartUnwindCleanupError(t *testing.T) {
+
+	// Make the module fail on attach and on close.
+	var mods []*fakeModule
+	ap := newFakeProbe(perfDestroyMap, &mods)
+	ap.module = failingCloser{mods[0]}
+
+	err := ap.Start()
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "cleanup failed"), err.Error())
+
+	// The Probe can't be started again without a module.
+	assert.Nil(t, ap.module)
+	assert.Equal(t, errProbeUnloaded, ap.Start())
+}
+
+// failingCloser is a bpfModule that fails to Close.
+type failingCloser struct {
+	bpfModule
+}
+
+func (failingCloser) Close() error { return errInjected }
+
+func TestProbeStart(t *testing.T) {
+
+	var mods []*fakeModule
+	ap := newFakeProbe("", &mods)
+
+	require.NoError(t, ap.Start())
+	assert.True(t, ap.started)
+	assert.Equal(t, []string{"kprobe/one", "kretprobe/two"}, mods[0].kprobes)
+	require.Len(t, mods[0].readers, 2)
+	assert.True(t, mods[0].readers[0].polling)
+	assert.True(t, mods[0].readers[1].polling)
+
+	assert.Equal(t, errProbeStarted, ap.Start())
+
+	require.NoError(t, ap.Stop())
+	assert.Equal(t, 1, mods[0].closed)
+	assert.Len(t, mods, 1)
+}
+
+// waitStopped waits for the Probe to be stopped and for the amount of
+// running goroutines to drop to n.
+func waitStopped(t *testing.T, ap *Probe, n int) {
+	t.Helper()
+
+	stopped := func() bool {
+		ap.startMu.Lock()
+		defer ap.startMu.Unlock()
+		return !ap.started
+	}
+
+	for i := 0; i < 100; i++ {
+		if stopped() && runtime.NumGoroutine() <= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("probe stopped: %t, %d goroutines running, expected %d",
+		stopped(), runtime.NumGoroutine(), n)
+}
+
+func TestProbeStartContext(t *testing.T) {
+
+	var mods []*fakeModule
+	ap := newFakeProbe("", &mods)
+	base := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, ap.StartContext(ctx))
+	assert.True(t, runtime.NumGoroutine() > base, "no workers started")
+
+	// Cancelling the context stops the probe and all its goroutines.
+	cancel()
+	waitStopped(t, ap, base)
+
+	assert.Equal(t, 1, mods[0].closed)
+	assert.Nil(t, ap.module)
+	_, ok := <-ap.ErrChan()
+	assert.False(t, ok, "error channel not closed")
+
+	assert.Equal(t, errProbeNotStarted, ap.Stop())
+	assert.Equal(t, errProbeUnloaded, ap.Start())
+}
+
+func TestProbeStartContextStop(t *testing.T) {
+
+	var mods []*fakeModule
+	ap := newFakeProbe("", &mods)
+	base := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stopping the probe before the context is done
+	// also stops the goroutine watching the context.
+	require.NoError(t, ap.StartContext(ctx))
+	require.NoError(t, ap.Stop())
+	waitStopped(t, ap, base)
+	assert.Equal(t, 1, mods[0].closed)
+
+	// Starting with a context that's already done stops right away.
+	mods = nil
+	ap = newFakeProbe("", &mods)
+	cancel()
+	require.NoError(t, ap.StartContext(ctx))
+	waitStopped(t, ap, base)
+	assert.Equal(t, 1, mods[0].closed)
+}
+
+func TestProbeFanoutFair(t *testing.T) {
+
+	const (
+		fast   = 3
+		events = 1000
+	)
+
+	ap := &Probe{}
+
+	// The blocked consumer is registered first, and its
+	// channel is never read from once it is full.
+	blocked := NewConsumer("blocked", make(chan Event, 1), ConsumerAll)
+	require.NoError(t, ap.RegisterConsumer(blocked))
+
+	var consumers []*Consumer
+	done := make(chan int)
+	for i := 0; i < fast; i++ {
+		c := NewConsumer(fmt.Sprintf("fast%d", i), make(chan Event, 16), ConsumerAll)
+		require.NoError(t, ap.RegisterConsumer(c))
+		consumers = append(consumers, c)
+
+		go func(c *Consumer) {
+			var n int
+			for range c.Events() {
+				n++
+			}
+			done <- n
+		}(c)
+	}
+
+	// Give fast consumers a chance to keep up with the
+	// fanout, like the perf reader's pace would.
+	for i := 0; i < events; i++ {
+		ap.fanoutEvent(Event{Type: EventUpdate})
+		for _, c := range consumers {
+			for len(c.events) == cap(c.events) {
+				runtime.Gosched()
+			}
+		}
+	}
+
+	for _, c := range consumers {
+		c.Close()
+	}
+	for i := 0; i < fast; i++ {
+		assert.Equal(t, events, <-done, "fast consumer missed events")
+	}
+
+	// The blocked consumer held one event, and lost all others.
+	st := blocked.Stats().Get()
+	assert.EqualValues(t, 1, st.EventsReceived)
+	assert.EqualValues(t, events-1, st.EventsLost)
+}
+
+func TestProbePerfWorkerFair(t *testing.T) {
+
+	const updates = 64
+
+	ap := &Probe{
+		perfUpdateChan:  make(chan []byte, updates),
+		perfDestroyChan: make(chan []byte, 1),
+		stats:           &ProbeStats{},
+	}
+
+	out := make(chan Event, updates+1)
+	require.NoError(t, ap.RegisterConsumer(NewConsumer("fair", out, ConsumerAll)))
+
+	// Queue a destroy event behind a backlog of updates, like under
+	// sustained update load.
+	for i := 0; i < updates; i++ {
+		ap.perfUpdateChan <- make([]byte, EventLength)
+	}
+	ap.perfDestroyChan <- make([]byte, EventLength)
+
+	ap.workers.Add(1)
+	go ap.perfWorker()
+
+	// The destroy event is not held back until all updates are drained.
+	var pos int
+	for i := 0; i <= updates; i++ {
+		if (<-out).Type == EventDestroy {
+			pos = i
+		}
+	}
+	assert.True(t, pos < updates, "destroy event read after all %d updates", updates)
+
+	close(ap.perfUpdateChan)
+	ap.workers.Wait()
+
+	st := ap.Stats()
+	assert.EqualValues(t, updates, st.PerfEventsUpdate)
+	assert.EqualValues(t, 1, st.PerfEventsDestroy)
+}
+
+func TestCheckPerfMapInfo(t *testing.T) {
+
+	cpus := []uint{0, 1, 3}
+	ok := bpfMapInfo{Type: bpfMapTypePerfEventArray, KeySize: 4, ValueSize: 4, MaxEntries: 4}
+	assert.NoError(t, checkPerfMapInfo(ok, cpus))
+
+	bad := ok
+	bad.Type = 1
+	assert.EqualError(t, checkPerfMapInfo(bad, cpus), "map type 1 is not a perf event array (4)")
+
+	bad = ok
+	bad.ValueSize = 8
+	assert.EqualError(t, checkPerfMapInfo(bad, cpus), "key size 4 and value size 8, expected 4 and 4")
+
+	bad = ok
+	bad.MaxEntries = 3
+	assert.EqualError(t, checkPerfMapInfo(bad, cpus), "3 entries is too small for CPU 3")
+}
+
+func TestProbeErrorsSeverity(t *testing.T) {
+
+	ap := &Probe{stats: &ProbeStats{}}
+
+	all := ap.Errors(SeverityWarning)
+	fatal := ap.Errors(SeverityFatal)
+
+	// No receiver is ready on the unbuffered errChan.
+	assert.False(t, ap.sendError(ComponentDecoder, SeverityError, errInjected))
+	assert.False(t, ap.sendError(ComponentLifecycle, SeverityFatal, errInjected))
+
+	pe := <-all
+	assert.Equal(t, SeverityError, pe.Severity)
+	assert.Equal(t, ComponentDecoder, pe.Component)
+	assert.True(t, pe.Recoverable)
+	assert.False(t, pe.Time.IsZero())
+	assert.Equal(t, errInjected, pe.Err)
+	assert.Equal(t, errInjected.Error(), pe.Error())
+
+	pe = <-all
+	assert.Equal(t, SeverityFatal, pe.Severity)
+
+	// Recoverable errors don't reach the fatal-only subscriber.
+	pe = <-fatal
+	assert.Equal(t, SeverityFatal, pe.Severity)
+	assert.Equal(t, ComponentLifecycle, pe.Component)
+	assert.False(t, pe.Recoverable)
+	assert.Len(t, fatal, 0)
+
+	// Subscriptions are closed when the probe stops, later ones right away.
+	ap.errSubs.close()
+	_, ok := <-fatal
+	assert.False(t, ok, "subscription not closed")
+	_, ok = <-ap.Errors(SeverityWarning)
+	assert.False(t, ok, "subscription after stop not closed")
+}
+
+// Drives the perfWorker's decode and fan-out path with synthetic perf
+// samples, for tuning buffer sizes and the amount of consumers. Reports the
+// throughput, the percentiles of the latency between a sample entering the
+// perf channel and its event reaching the first consumer, and the events
+// lost by consumers that fell behind.
+func BenchmarkProbePerfWorker(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("consumers-%d", n), func(b *testing.B) {
+			benchmarkPerfWorker(b, n)
+		})
+	}
+}
+
+func benchmarkPerfWorker(b *testing.B, consumers int) {
+
+	const bufs = 2048
+
+	ap := &Probe{
+		perfUpdateChan:  make(chan []byte, bufs/2),
+		perfDestroyChan: make(chan []byte),
+		stats:           &ProbeStats{},
+		bootTime:        time.Now(),
+	}
+
+	// The first consumer records the latency of every event.
+	lat := make([]time.Duration, 0, b.N)
+	var cs []*Consumer
+	var drained sync.WaitGroup
+	for i := 0; i < consumers; i++ {
+		c := make(chan Event, 4096)
+		ac := NewConsumer(fmt.Sprintf("bench-%d", i), c, ConsumerAll)
+		if err := ap.RegisterConsumer(ac); err != nil {
+			b.Fatal(err)
+		}
+		cs = append(cs, ac)
+
+		drained.Add(1)
+		go func(first bool) {
+			defer drained.Done()
+			for e := range c {
+				if first {
+					lat = append(lat, time.Since(e.Time))
+				}
+			}
+		}(i == 0)
+	}
+
+	// Samples are reused once the perfWorker is done with them, a buffer is
+	// only rewritten after the channel cycled through all others.
+	samples := make([][]byte, bufs)
+	for i := range samples {
+		samples[i] = testEventBinary()
+	}
+
+	ap.workers.Add(1)
+	go ap.perfWorker()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+
+	for i := 0; i < b.N; i++ {
+		s := samples[i%bufs]
+		*(*uint64)(unsafe.Pointer(&s[8])) = uint64(time.Since(ap.bootTime))
+		ap.perfUpdateChan <- s
+	}
+
+	close(ap.perfUpdateChan)
+	ap.workers.Wait()
+	elapsed := time.Since(start)
+	b.StopTimer()
+
+	var lost uint64
+	for _, ac := range cs {
+		lost += ac.Stats().Get().EventsLost
+		ac.Close()
+	}
+	drained.Wait()
+
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "events/s")
+	b.ReportMetric(float64(lost)/float64(b.N*consumers), "lost/event")
+	if len(lat) != 0 {
+		sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+		b.ReportMetric(float64(lat[len(lat)/2]), "p50-ns")
+		b.ReportMetric(float64(lat[len(lat)*99/100]), "p99-ns")
+	}
+}
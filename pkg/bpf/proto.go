@@ -0,0 +1,83 @@
+package bpf
+
+import "strconv"
+
+// IP protocol numbers of which flows carry protocol-specific fields.
+const (
+	protoICMP    = 1
+	protoTCP     = 6
+	protoUDP     = 17
+	protoDCCP    = 33
+	protoICMPv6  = 58
+	protoSCTP    = 132
+	protoUDPLite = 136
+)
+
+// Proto is an IP protocol number, like the Proto of an Event. Its String
+// method renders the protocol's name.
+type Proto uint8
+
+// Names of common IP protocols, mostly their IANA keywords.
+var protoNames = map[Proto]string{
+	1:   "icmp",
+	2:   "igmp",
+	4:   "ipip",
+	6:   "tcp",
+	17:  "udp",
+	33:  "dccp",
+	41:  "ipv6",
+	47:  "gre",
+	50:  "esp",
+	51:  "ah",
+	58:  "icmp6",
+	89:  "ospf",
+	103: "pim",
+	112: "vrrp",
+	132: "sctp",
+	136: "udplite",
+}
+
+// String returns the name of the protocol, eg. 'udp' for 17, or its number
+// if the protocol is not known.
+func (p Proto) String() string {
+	if n, ok := protoNames[p]; ok {
+		return n
+	}
+	return strconv.Itoa(int(p))
+}
+
+// HasPorts returns true if conntrack identifies flows of the given protocol
+// by their source and destination port: TCP, UDP, UDP-Lite, SCTP and DCCP.
+// The ports of events of other protocols are always zero.
+func HasPorts(proto uint8) bool {
+	switch proto {
+	case protoTCP, protoUDP, protoDCCP, protoSCTP, protoUDPLite:
+		return true
+	}
+	return false
+}
+
+// isICMP returns true if the protocol is ICMP or ICMPv6, of which conntrack
+// identifies flows by their type, code and identifier.
+func isICMP(proto uint8) bool {
+	return proto == protoICMP || proto == protoICMPv6
+}
+
+// clearProtoFields zeroes the fields of the event that don't apply to its
+// protocol, like the decoders of the Probe and the netlink source do: the
+// ports, ICMP fields and TCP flag counters of flows of other protocols.
+// For events that weren't decoded from conntrack, like replayed events.
+func (e *Event) clearProtoFields() {
+
+	if !HasPorts(e.Proto) {
+		e.SrcPort, e.DstPort = 0, 0
+	}
+
+	if !isICMP(e.Proto) {
+		e.ICMPType, e.ICMPCode, e.ICMPID = 0, 0, 0
+	}
+
+	if e.Proto != protoTCP {
+		e.SynCount, e.FinCount, e.RstCount = 0, 0, 0
+	}
+}
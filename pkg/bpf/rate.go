@@ -0,0 +1,47 @@
+package bpf
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Time constant of the exponentially weighted moving average of the rate of
+// events read by a Probe, see ProbeStats.PerfEventsRate.
+const perfRateWindow = time.Minute
+
+// rateMeter keeps an exponentially weighted moving average of the rate at
+// which a counter increases, with a time constant of perfRateWindow. The
+// average is updated when it's read, weighing the counter's rate since the
+// previous read by the time that passed, so it doesn't depend on how often
+// it's read. The zero value is ready to use and safe for concurrent use.
+type rateMeter struct {
+	mu    sync.Mutex
+	last  time.Time
+	total uint64
+	rate  float64
+}
+
+// update returns the average rate per second of the counter, given its
+// current total at time now. Returns zero on the first call.
+func (m *rateMeter) update(total uint64, now time.Time) float64 {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dt := now.Sub(m.last)
+	if m.last.IsZero() || total < m.total {
+		m.last, m.total = now, total
+		return m.rate
+	}
+	if dt <= 0 {
+		return m.rate
+	}
+
+	cur := float64(total-m.total) / dt.Seconds()
+	w := math.Exp(-float64(dt) / float64(perfRateWindow))
+	m.rate = m.rate*w + cur*(1-w)
+	m.last, m.total = now, total
+
+	return m.rate
+}
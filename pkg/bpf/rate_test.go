@@ -0,0 +1,39 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateMeter(t *testing.T) {
+
+	m := rateMeter{}
+	start := time.Unix(100, 0)
+
+	assert.Zero(t, m.update(500, start))
+
+	// A steady rate converges regardless of how often the meter is read.
+	var r float64
+	for i := 1; i <= 600; i++ {
+		r = m.update(500+uint64(i)*1000, start.Add(time.Duration(i)*time.Second))
+	}
+	assert.InDelta(t, 1000, r, 1)
+
+	sparse := rateMeter{}
+	sparse.update(0, start)
+	for i := 1; i <= 10; i++ {
+		r = sparse.update(uint64(i)*60000, start.Add(time.Duration(i)*time.Minute))
+	}
+	assert.InDelta(t, 1000, r, 1)
+
+	// The average decays to about a third of the rate a window after
+	// events stop.
+	now := start.Add(600 * time.Second)
+	r = m.update(500+600*1000, now.Add(time.Minute))
+	assert.InDelta(t, 368, r, 1)
+
+	// Reads at the same time don't change the average.
+	assert.Equal(t, r, m.update(500+600*1000, now.Add(time.Minute)))
+}
@@ -0,0 +1,193 @@
+package bpf
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// reorderKey identifies a flow in a reorderer. The flow's Start is not part
+// of it, since only destroy events carry it: the probe leaves it zero on new
+// and update events. A new flow reusing the ConnectionID of a flow destroyed
+// within the window is taken for the same flow. Ordered by Time, its events
+// come after the destroyed flow's. Ordered by Seq, which restarts, its events
+// are delivered first, or right away as late events.
+type reorderKey struct {
+	connectionID uint32
+	netNS        uint32
+}
+
+// reorderEvent is an event held by a reorderer until its deadline.
+type reorderEvent struct {
+	Event
+	deadline time.Time
+}
+
+// reorderFlow holds the events of a flow awaiting delivery, in flow order.
+type reorderFlow struct {
+	pending []reorderEvent
+
+	// The flow's latest delivered event, and when it was delivered.
+	last      Event
+	delivered time.Time
+	hasLast   bool
+}
+
+// reorderDeadline is a flow of which an event is held until deadline, or
+// which is forgotten at deadline if all its events were delivered.
+type reorderDeadline struct {
+	deadline time.Time
+	key      reorderKey
+}
+
+// reorderer holds the events of a Consumer for its window, delivering the
+// events of every flow in order, see Consumer.SetReorder.
+type reorderer struct {
+	window  time.Duration
+	deliver func(Event)
+	stats   *ConsumerStats
+
+	mu    sync.Mutex
+	flows map[reorderKey]*reorderFlow
+	// Deadlines in the order they were added. All deadlines are the time
+	// they were added plus window, so the queue is sorted by deadline.
+	queue  []reorderDeadline
+	timer  *time.Timer
+	closed bool
+}
+
+func newReorderer(window time.Duration, stats *ConsumerStats, deliver func(Event)) *reorderer {
+	return &reorderer{
+		window:  window,
+		deliver: deliver,
+		stats:   stats,
+		flows:   make(map[reorderKey]*reorderFlow),
+	}
+}
+
+// before returns whether event a comes before event b of the same flow. Events
+// are ordered by Seq if both have one, and by Time otherwise. Destroy events
+// come after other events of the same time.
+func before(a, b *Event) bool {
+	if a.Seq != 0 && b.Seq != 0 {
+		return a.Seq < b.Seq
+	}
+	if !a.Time.Equal(b.Time) {
+		return a.Time.Before(b.Time)
+	}
+	return a.Type != EventDestroy && b.Type == EventDestroy
+}
+
+// add holds the event until the reorderer's window has passed. Events arriving
+// after a later event of their flow was delivered are delivered right away.
+func (r *reorderer) add(e Event) {
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return
+	}
+
+	key := reorderKey{e.ConnectionID, e.NetNS}
+	f, ok := r.flows[key]
+	if !ok {
+		f = &reorderFlow{}
+		r.flows[key] = f
+	}
+
+	if f.hasLast && before(&e, &f.last) {
+		r.stats.incrEventsLate()
+		r.deliver(e)
+		return
+	}
+
+	// Insert after the pending events that don't come after e,
+	// keeping the arrival order of duplicates.
+	i := sort.Search(len(f.pending), func(i int) bool {
+		return before(&e, &f.pending[i].Event)
+	})
+	f.pending = append(f.pending, reorderEvent{})
+	copy(f.pending[i+1:], f.pending[i:])
+	f.pending[i] = reorderEvent{Event: e, deadline: now.Add(r.window)}
+
+	r.queue = append(r.queue, reorderDeadline{now.Add(r.window), key})
+	if r.timer == nil {
+		r.timer = time.AfterFunc(r.window, r.expire)
+	}
+}
+
+// expire delivers the events of which the deadline passed, and schedules
+// itself for the next deadline.
+func (r *reorderer) expire() {
+
+	now := time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.timer = nil
+	if r.closed {
+		return
+	}
+
+	n := 0
+	for ; n < len(r.queue) && !r.queue[n].deadline.After(now); n++ {
+		key := r.queue[n].key
+		f, ok := r.flows[key]
+		if !ok {
+			continue
+		}
+
+		// Deliver the flow's events in order, until an event that is not due
+		// yet. Events coming after it wait for it, at most another window.
+		i := 0
+		for ; i < len(f.pending) && !f.pending[i].deadline.After(now); i++ {
+			r.deliver(f.pending[i].Event)
+			f.last, f.delivered, f.hasLast = f.pending[i].Event, now, true
+		}
+		if i == 0 {
+			// Forget flows of which all events were delivered over a window
+			// ago. Their late events can no longer be told apart.
+			if len(f.pending) == 0 && now.Sub(f.delivered) >= r.window {
+				delete(r.flows, key)
+			}
+			continue
+		}
+
+		f.pending = append(f.pending[:0], f.pending[i:]...)
+		if len(f.pending) == 0 {
+			r.queue = append(r.queue, reorderDeadline{now.Add(r.window), key})
+		}
+	}
+
+	r.queue = append(r.queue[:0], r.queue[n:]...)
+
+	if len(r.queue) != 0 {
+		r.timer = time.AfterFunc(r.queue[0].deadline.Sub(now), r.expire)
+	}
+}
+
+// close delivers all held events, in order within their flow.
+func (r *reorderer) close() {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+
+	for _, f := range r.flows {
+		for _, e := range f.pending {
+			r.deliver(e.Event)
+		}
+	}
+
+	r.flows = nil
+	r.queue = nil
+	r.closed = true
+}
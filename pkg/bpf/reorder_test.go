@@ -0,0 +1,160 @@
+package bpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvents reads n events from c, failing the test after timeout.
+func readEvents(t *testing.T, c *Consumer, n int, timeout time.Duration) []Event {
+	t.Helper()
+
+	var out []Event
+	deadline := time.After(timeout)
+	for len(out) < n {
+		select {
+		case e, ok := <-c.Events():
+			require.True(t, ok, "event channel closed")
+			out = append(out, e)
+		case <-deadline:
+			t.Fatalf("timeout waiting for events, received %d of %d", len(out), n)
+		}
+	}
+
+	return out
+}
+
+// flowSeqs returns the Seq of the events of each flow, in delivery order.
+func flowSeqs(evs []Event) map[uint32][]uint32 {
+	out := make(map[uint32][]uint32)
+	for _, e := range evs {
+		out[e.ConnectionID] = append(out[e.ConnectionID], e.Seq)
+	}
+	return out
+}
+
+func TestReorderSeq(t *testing.T) {
+
+	const window = 50 * time.Millisecond
+
+	ap := &Probe{}
+
+	c := NewConsumer("reorder", make(chan Event, 16), ConsumerAll)
+	c.SetReorder(window)
+	require.NoError(t, ap.RegisterConsumer(c))
+	defer c.Close()
+
+	// Events of two flows, out of order within each flow.
+	start := time.Now()
+	for _, e := range []Event{
+		{ConnectionID: 1, Seq: 3, Type: EventUpdate},
+		{ConnectionID: 2, Seq: 2, Type: EventDestroy},
+		{ConnectionID: 1, Seq: 1, Type: EventNew},
+		{ConnectionID: 2, Seq: 1, Type: EventNew},
+		{ConnectionID: 1, Seq: 4, Type: EventDestroy},
+		{ConnectionID: 1, Seq: 2, Type: EventUpdate},
+	} {
+		ap.fanoutEvent(e)
+	}
+
+	evs := readEvents(t, c, 6, time.Second)
+	assert.True(t, time.Since(start) >= window, "events delivered before the window passed")
+
+	assert.Equal(t, map[uint32][]uint32{
+		1: {1, 2, 3, 4},
+		2: {1, 2},
+	}, flowSeqs(evs))
+
+	st := c.Stats().Get()
+	assert.EqualValues(t, 6, st.EventsReceived)
+	assert.Zero(t, st.EventsLate)
+}
+
+func TestReorderTime(t *testing.T) {
+
+	ap := &Probe{}
+
+	c := NewConsumer("reorder", make(chan Event, 16), ConsumerAll)
+	c.SetReorder(20 * time.Millisecond)
+	require.NoError(t, ap.RegisterConsumer(c))
+	defer c.Close()
+
+	// Without sequence numbers, events are ordered by time. A destroy event
+	// comes after an update of the same time, and is ordered against the
+	// flow's updates though only the destroy carries the flow's Start.
+	t0 := time.Unix(300, 0)
+	ap.fanoutEvent(Event{ConnectionID: 1, Start: 42, Type: EventDestroy, Time: t0.Add(time.Second)})
+	ap.fanoutEvent(Event{ConnectionID: 1, Type: EventUpdate, Time: t0.Add(time.Second)})
+	ap.fanoutEvent(Event{ConnectionID: 1, Type: EventNew, Time: t0})
+
+	// A new flow reusing the ConnectionID comes after the destroyed flow.
+	ap.fanoutEvent(Event{ConnectionID: 1, Type: EventNew, Time: t0.Add(2 * time.Second)})
+
+	var flow []EventType
+	for _, e := range readEvents(t, c, 4, time.Second) {
+		flow = append(flow, e.Type)
+	}
+	assert.Equal(t, []EventType{EventNew, EventUpdate, EventDestroy, EventNew}, flow)
+}
+
+func TestReorderLate(t *testing.T) {
+
+	const window = 20 * time.Millisecond
+
+	ap := &Probe{}
+
+	c := NewConsumer("reorder", make(chan Event, 16), ConsumerAll)
+	c.SetReorder(window)
+	require.NoError(t, ap.RegisterConsumer(c))
+	defer c.Close()
+
+	ap.fanoutEvent(Event{ConnectionID: 1, Seq: 2, Type: EventUpdate})
+	require.Len(t, readEvents(t, c, 1, time.Second), 1)
+
+	// An event arriving after the window passed for a later event
+	// of its flow is delivered right away, out of order.
+	ap.fanoutEvent(Event{ConnectionID: 1, Seq: 1, Type: EventNew})
+	select {
+	case e := <-c.Events():
+		assert.EqualValues(t, 1, e.Seq)
+	default:
+		t.Fatal("late event not delivered right away")
+	}
+	assert.EqualValues(t, 1, c.Stats().Get().EventsLate)
+
+	// Later events of the flow are still held.
+	ap.fanoutEvent(Event{ConnectionID: 1, Seq: 3, Type: EventUpdate})
+	assert.Empty(t, c.Events())
+	assert.EqualValues(t, 3, readEvents(t, c, 1, time.Second)[0].Seq)
+
+	// Flows are forgotten a window after their last delivery.
+	time.Sleep(4 * window)
+	c.reorder.mu.Lock()
+	assert.Empty(t, c.reorder.flows)
+	c.reorder.mu.Unlock()
+}
+
+func TestReorderClose(t *testing.T) {
+
+	ap := &Probe{}
+
+	c := NewConsumer("reorder", make(chan Event, 16), ConsumerAll)
+	c.SetReorder(time.Hour)
+	require.NoError(t, ap.RegisterConsumer(c))
+
+	ap.fanoutEvent(Event{ConnectionID: 1, Seq: 2, Type: EventDestroy})
+	ap.fanoutEvent(Event{ConnectionID: 1, Seq: 1, Type: EventNew})
+	assert.Empty(t, c.Events())
+
+	// Held events are delivered in order before the channel is closed.
+	c.Close()
+
+	var seqs []uint32
+	for e := range c.Events() {
+		seqs = append(seqs, e.Seq)
+	}
+	assert.Equal(t, []uint32{1, 2}, seqs)
+}
@@ -0,0 +1,289 @@
+package bpf
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Maximum length of a line of a replayed capture.
+const replayLineMax = 1 << 20
+
+// ReplaySource is a Source replaying events captured in JSON lines, like the
+// output of the stdout sink's json format, for testing consumers and sinks
+// against recorded traffic without a kernel. Events are delivered to its
+// Consumers like the Probe's, in the order they were captured in:
+//
+//   - Config.ReplaySpeed sets the pace, the time between two events is their
+//     difference in Time divided by the speed. Events without a Time, or out
+//     of order with the previous event, are replayed right away.
+//   - Events keep the Time and Timestamp they were captured with. Events
+//     without a type are replayed as update events.
+//   - Protocol-specific fields that don't apply to the event's protocol are
+//     cleared like the Probe does, eg. the ports of ICMP, GRE or ESP flows
+//     captured by other tools.
+//   - Fields set by pipeline stages, like Delta, are replayed as captured.
+//     Capture the events to replay from a pipeline without stages to run
+//     them through stages again.
+//
+// Like the Probe, events are dropped when a Consumer's channel is full. When
+// replaying as fast as possible, consumers falling behind lose events, see
+// ConsumerStats. Lines that can't be decoded are skipped, raising an error, and
+// counted as malformed events.
+//
+// Config.RawAddrs is applied to the decoded addresses. The other settings of
+// the Probe are ignored, captured events are replayed as-is.
+type ReplaySource struct {
+
+	// Probe holding the consumers and statistics, never loaded into the kernel.
+	probe *Probe
+
+	f     *os.File
+	speed float64
+
+	startMu sync.Mutex
+	started bool
+	stop    chan struct{}
+	done    chan struct{}
+	worker  sync.WaitGroup
+}
+
+// NewReplaySource returns a ReplaySource replaying the events captured in
+// Config.ReplayFile.
+func NewReplaySource(cfg Config) (*ReplaySource, error) {
+
+	if cfg.ReplayFile == "" {
+		return nil, errReplayNoFile
+	}
+	if cfg.ReplaySpeed < 0 {
+		return nil, errors.Errorf(errFmtReplaySpeed, cfg.ReplaySpeed)
+	}
+
+	f, err := os.Open(cfg.ReplayFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening replay file")
+	}
+
+	return &ReplaySource{
+		probe: &Probe{
+			stats:          &ProbeStats{},
+			normalizeAddrs: !cfg.RawAddrs,
+		},
+		f:     f,
+		speed: cfg.ReplaySpeed,
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// RegisterConsumer registers a Consumer in the ReplaySource.
+func (rs *ReplaySource) RegisterConsumer(ac *Consumer) error {
+	return rs.probe.RegisterConsumer(ac)
+}
+
+// RemoveConsumer removes a Consumer from the ReplaySource.
+func (rs *ReplaySource) RemoveConsumer(ac *Consumer) error {
+	return rs.probe.RemoveConsumer(ac)
+}
+
+// Start starts replaying the captured events. Register Consumers
+// beforehand, so they receive the capture's first events.
+func (rs *ReplaySource) Start() error {
+
+	rs.startMu.Lock()
+	defer rs.startMu.Unlock()
+
+	if rs.started {
+		return errProbeStarted
+	}
+
+	if rs.f == nil {
+		return errProbeUnloaded
+	}
+
+	rs.probe.errChan = make(chan error)
+	rs.probe.errSubs.reopen()
+	rs.stop = make(chan struct{})
+
+	rs.worker.Add(1)
+	go rs.replayWorker(rs.f, rs.stop)
+
+	rs.started = true
+
+	return nil
+}
+
+// Stop interrupts the replay if it's still in progress, closes the replayed
+// file and closes the ReplaySource's error channels. Can only be called after
+// Start(). A stopped ReplaySource can't be started again.
+func (rs *ReplaySource) Stop() error {
+
+	rs.startMu.Lock()
+	defer rs.startMu.Unlock()
+
+	if !rs.started {
+		return errProbeNotStarted
+	}
+
+	close(rs.stop)
+
+	// The worker may send errors until it exits.
+	rs.worker.Wait()
+	close(rs.probe.errChan)
+	rs.probe.errSubs.close()
+
+	err := rs.f.Close()
+	rs.f = nil
+
+	rs.started = false
+
+	return err
+}
+
+// Done returns a channel that is closed when the ReplaySource delivered all
+// captured events, or when the replay was interrupted by an error or Stop.
+func (rs *ReplaySource) Done() <-chan struct{} {
+	return rs.done
+}
+
+// ErrChan returns the ReplaySource's unbuffered error channel. Like the
+// Probe's, errors are dropped if there is no ready receiver. Returns nil
+// if the ReplaySource has not been Start()ed yet.
+func (rs *ReplaySource) ErrChan() chan error {
+	rs.startMu.Lock()
+	defer rs.startMu.Unlock()
+	return rs.probe.errChan
+}
+
+// Errors returns a channel receiving the ReplaySource's errors of at least
+// the given severity. See Probe.Errors.
+func (rs *ReplaySource) Errors(min Severity) <-chan *ProbeError {
+	return rs.probe.errSubs.add(min)
+}
+
+// Stats returns a snapshot copy of the ReplaySource's statistics. Replayed
+// events are counted like the Probe's perf events.
+func (rs *ReplaySource) Stats() ProbeStats {
+	return rs.probe.Stats()
+}
+
+// CPUStats always returns nil, replayed events are not generated per CPU.
+func (rs *ReplaySource) CPUStats() []CPUStats {
+	return nil
+}
+
+// MapStats always returns no stats, the ReplaySource has no BPF maps.
+func (rs *ReplaySource) MapStats() ([]MapStats, error) {
+	return nil, nil
+}
+
+// replayWorker reads the events captured in f and delivers them to the
+// consumers until the end of the file, or until stop is closed.
+func (rs *ReplaySource) replayWorker(f *os.File, stop chan struct{}) {
+
+	defer rs.worker.Done()
+	defer close(rs.done)
+
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, replayLineMax)
+
+	// Wall-clock time the capture's first event was replayed at,
+	// and the time it was captured at.
+	var start, first time.Time
+
+	for line := 1; s.Scan(); line++ {
+
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+
+		var e Event
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			rs.probe.stats.incrPerfEventsMalformed()
+			rs.probe.sendError(ComponentDecoder, SeverityError,
+				errors.Wrapf(err, "decoding event on line %d", line))
+			continue
+		}
+
+		if start.IsZero() {
+			start, first = time.Now(), e.Time
+		}
+		if !rs.wait(start, e.Time.Sub(first), stop) {
+			return
+		}
+
+		rs.replay(e)
+	}
+
+	if err := s.Err(); err != nil {
+		rs.probe.sendError(ComponentDecoder, SeverityFatal, errors.Wrap(err, "reading replay file"))
+	}
+}
+
+// wait waits until the given offset into the capture, scaled by the
+// ReplaySource's speed, has passed since start. Returns false if stop
+// was closed before.
+func (rs *ReplaySource) wait(start time.Time, offset time.Duration, stop chan struct{}) bool {
+
+	var d time.Duration
+	if rs.speed != 0 && offset > 0 {
+		d = time.Until(start.Add(time.Duration(float64(offset) / rs.speed)))
+	}
+
+	if d <= 0 {
+		select {
+		case <-stop:
+			return false
+		default:
+			return true
+		}
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// replay delivers a decoded event to the consumers.
+func (rs *ReplaySource) replay(e Event) {
+
+	if e.Type == 0 {
+		e.Type = EventUpdate
+	}
+
+	e.SrcAddr = rs.addr(e.SrcAddr)
+	e.DstAddr = rs.addr(e.DstAddr)
+	e.clearProtoFields()
+
+	if e.Type == EventDestroy {
+		rs.probe.stats.incrPerfEventsDestroy()
+	} else {
+		rs.probe.stats.incrPerfEventsUpdate()
+	}
+
+	rs.probe.fanoutEvent(e)
+}
+
+// addr returns the 4-byte form of IPv4 addresses if the ReplaySource
+// normalizes addresses, or the 16-byte form otherwise.
+func (rs *ReplaySource) addr(ip net.IP) net.IP {
+	if ip == nil {
+		return nil
+	}
+	if rs.probe.normalizeAddrs {
+		if v4 := ip.To4(); v4 != nil {
+			return v4
+		}
+	}
+	return ip.To16()
+}
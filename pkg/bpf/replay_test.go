@@ -0,0 +1,220 @@
+package bpf_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// writeCapture writes the lines to a temporary capture file and returns its
+// path. Events are written in their JSON form, strings as-is.
+func writeCapture(t *testing.T, lines ...interface{}) string {
+	t.Helper()
+
+	f, err := ioutil.TempFile("", "conntracct-replay")
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, l := range lines {
+		b, ok := l.(string)
+		if !ok {
+			j, err := json.Marshal(l)
+			require.NoError(t, err)
+			b = string(j)
+		}
+		_, err := f.WriteString(b + "\n")
+		require.NoError(t, err)
+	}
+
+	return f.Name()
+}
+
+// replayAll replays a capture through a ReplaySource with the given Config
+// and returns the events received by a consumer of all events.
+func replayAll(t *testing.T, cfg bpf.Config) []bpf.Event {
+	t.Helper()
+
+	rs, err := bpf.NewReplaySource(cfg)
+	require.NoError(t, err)
+
+	events := make(chan bpf.Event, 16)
+	require.NoError(t, rs.RegisterConsumer(bpf.NewConsumer("replay", events, bpf.ConsumerAll)))
+
+	require.NoError(t, rs.Start())
+	select {
+	case <-rs.Done():
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for replay")
+	}
+	require.NoError(t, rs.Stop())
+	close(events)
+
+	var out []bpf.Event
+	for e := range events {
+		out = append(out, e)
+	}
+
+	return out
+}
+
+func TestReplaySource(t *testing.T) {
+
+	start := time.Unix(1510, 0).UTC()
+	path := writeCapture(t,
+		bpf.Event{ConnectionID: 1, Type: bpf.EventNew, Time: start,
+			SrcAddr: net.ParseIP("10.0.0.1"), DstAddr: net.ParseIP("2001:db8::1")},
+		bpf.Event{ConnectionID: 1, Type: bpf.EventUpdate, Time: start.Add(time.Second), BytesOrig: 100},
+		"",
+		bpf.Event{ConnectionID: 2, Time: start.Add(time.Second)},
+		bpf.Event{ConnectionID: 1, Type: bpf.EventDestroy, Time: start.Add(2 * time.Second), BytesOrig: 200},
+	)
+	defer os.Remove(path)
+
+	// Replayed as fast as possible, in the order they were captured.
+	out := replayAll(t, bpf.Config{ReplayFile: path})
+	require.Len(t, out, 4)
+
+	var ids []uint32
+	var types []bpf.EventType
+	for _, e := range out {
+		ids = append(ids, e.ConnectionID)
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []uint32{1, 1, 2, 1}, ids)
+	assert.Equal(t, []bpf.EventType{bpf.EventNew, bpf.EventUpdate, bpf.EventUpdate, bpf.EventDestroy}, types,
+		"events without a type are replayed as updates")
+
+	assert.EqualValues(t, 200, out[3].BytesOrig)
+	assert.True(t, start.Add(2*time.Second).Equal(out[3].Time), "captured time is kept")
+	assert.Equal(t, net.IP{10, 0, 0, 1}, out[0].SrcAddr)
+	assert.Equal(t, net.ParseIP("2001:db8::1"), out[0].DstAddr)
+
+	// Raw addresses keep their 16-byte form.
+	out = replayAll(t, bpf.Config{ReplayFile: path, RawAddrs: true})
+	assert.Len(t, out[0].SrcAddr, net.IPv6len)
+}
+
+func TestReplaySourceProtoFields(t *testing.T) {
+
+	// Captures of other tools may hold ports of flows without ports.
+	path := writeCapture(t,
+		`{"proto":1,"src_port":1234,"dst_port":2051,"icmp_type":8,"icmp_id":1234}`,
+		`{"proto":47,"src_port":1234,"dst_port":2051,"icmp_type":8,"syn_count":1}`,
+		`{"proto":50,"src_port":1234,"dst_port":2051}`,
+		`{"proto":6,"src_port":1234,"dst_port":443,"icmp_type":8,"syn_count":1}`,
+	)
+	defer os.Remove(path)
+
+	out := replayAll(t, bpf.Config{ReplayFile: path})
+	require.Len(t, out, 4)
+
+	for _, e := range out[:3] {
+		assert.Zero(t, e.SrcPort, "proto %d", e.Proto)
+		assert.Zero(t, e.DstPort, "proto %d", e.Proto)
+		assert.Zero(t, e.SynCount, "proto %d", e.Proto)
+	}
+	assert.EqualValues(t, 8, out[0].ICMPType)
+	assert.EqualValues(t, 1234, out[0].ICMPID)
+	assert.Zero(t, out[1].ICMPType)
+
+	assert.EqualValues(t, 1234, out[3].SrcPort)
+	assert.EqualValues(t, 443, out[3].DstPort)
+	assert.EqualValues(t, 1, out[3].SynCount)
+	assert.Zero(t, out[3].ICMPType)
+}
+
+func TestReplaySourceSpeed(t *testing.T) {
+
+	start := time.Unix(1510, 0)
+	path := writeCapture(t,
+		bpf.Event{ConnectionID: 1, Time: start},
+		bpf.Event{ConnectionID: 2, Time: start.Add(400 * time.Millisecond)},
+		// Out of order, replayed right away.
+		bpf.Event{ConnectionID: 3, Time: start.Add(300 * time.Millisecond)},
+	)
+	defer os.Remove(path)
+
+	// The capture spans 400ms, replayed at four times the pace.
+	begin := time.Now()
+	out := replayAll(t, bpf.Config{ReplayFile: path, ReplaySpeed: 4})
+	elapsed := time.Since(begin)
+
+	assert.Len(t, out, 3)
+	assert.True(t, elapsed >= 100*time.Millisecond && elapsed < 400*time.Millisecond,
+		"replay took %s, expected about 100ms", elapsed)
+}
+
+func TestReplaySourceInvalid(t *testing.T) {
+
+	path := writeCapture(t,
+		bpf.Event{ConnectionID: 1},
+		`{"connection_id": "one"}`,
+		bpf.Event{ConnectionID: 2},
+	)
+	defer os.Remove(path)
+
+	rs, err := bpf.NewReplaySource(bpf.Config{ReplayFile: path})
+	require.NoError(t, err)
+
+	events := make(chan bpf.Event, 16)
+	require.NoError(t, rs.RegisterConsumer(bpf.NewConsumer("replay", events, bpf.ConsumerAll)))
+	errs := rs.Errors(bpf.SeverityError)
+
+	require.NoError(t, rs.Start())
+	<-rs.Done()
+
+	// Lines that can't be decoded are skipped.
+	pe := <-errs
+	assert.Equal(t, bpf.ComponentDecoder, pe.Component)
+	assert.Contains(t, pe.Error(), "line 2")
+	assert.Len(t, events, 2)
+	assert.EqualValues(t, 2, rs.Stats().PerfEventsTotal)
+	assert.EqualValues(t, 1, rs.Stats().PerfEventsMalformed)
+
+	require.NoError(t, rs.Stop())
+
+	// A stopped ReplaySource can't be restarted.
+	assert.Error(t, rs.Start())
+}
+
+func TestReplaySourceStop(t *testing.T) {
+
+	start := time.Unix(1510, 0)
+	path := writeCapture(t,
+		bpf.Event{ConnectionID: 1, Time: start},
+		bpf.Event{ConnectionID: 2, Time: start.Add(time.Hour)},
+	)
+	defer os.Remove(path)
+
+	rs, err := bpf.NewReplaySource(bpf.Config{ReplayFile: path, ReplaySpeed: 1})
+	require.NoError(t, err)
+	require.NoError(t, rs.Start())
+
+	// Stopping interrupts the replay waiting for the next event.
+	require.NoError(t, rs.Stop())
+	select {
+	case <-rs.Done():
+	default:
+		t.Fatal("replay not done after stop")
+	}
+}
+
+func TestNewReplaySource(t *testing.T) {
+
+	_, err := bpf.NewReplaySource(bpf.Config{})
+	assert.Error(t, err)
+
+	_, err = bpf.NewReplaySource(bpf.Config{ReplayFile: "/nonexistent"})
+	assert.Error(t, err)
+
+	_, err = bpf.NewReplaySource(bpf.Config{ReplayFile: "/dev/null", ReplaySpeed: -1})
+	assert.EqualError(t, err, "replay speed -1 is negative")
+}
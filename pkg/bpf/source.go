@@ -0,0 +1,21 @@
+package bpf
+
+// Source is a source of accounting events delivering events to its
+// registered Consumers. It is implemented by Probe, and by FakeProbe and
+// ReplaySource for testing consumers of events without loading a probe into
+// the kernel.
+type Source interface {
+	RegisterConsumer(ac *Consumer) error
+	RemoveConsumer(ac *Consumer) error
+	Start() error
+	Stop() error
+	ErrChan() chan error
+	Errors(min Severity) <-chan *ProbeError
+}
+
+var (
+	_ Source = (*Probe)(nil)
+	_ Source = (*FakeProbe)(nil)
+	_ Source = (*NetlinkProbe)(nil)
+	_ Source = (*ReplaySource)(nil)
+)
@@ -0,0 +1,69 @@
+package bpf
+
+import "strings"
+
+// Status is the bitmap of conntrack status bits of a flow, enum
+// ip_conntrack_status in the kernel's uapi headers. Bits the kernel adds in
+// the future are passed through as-is, test them with Has.
+type Status uint32
+
+// Conntrack status bits.
+const (
+	// The flow was created from an expectation of another flow's helper.
+	StatusExpected Status = 1 << iota
+	// The flow has seen traffic in the reply direction.
+	StatusSeenReply
+	// Conntrack considers the flow established and won't evict it early.
+	StatusAssured
+	// The flow was confirmed, its original packet left the host.
+	StatusConfirmed
+	// The flow's source or destination address is translated.
+	StatusSrcNAT
+	StatusDstNAT
+	// TCP sequence numbers of the flow are adjusted, eg. by a helper.
+	StatusSeqAdjust
+	// Source or destination NAT has been set up for the flow.
+	StatusSrcNATDone
+	StatusDstNATDone
+	// The flow is being removed from the conntrack table.
+	StatusDying
+	// The flow's timeout can't be changed.
+	StatusFixedTimeout
+	// The entry is a template, eg. created by the CT target.
+	StatusTemplate
+	// Untracked in kernels before 4.12, NAT clash resolution since 5.1.
+	StatusNATClash
+	// The flow has a helper assigned, see Event.Helper.
+	StatusHelper
+	// The flow is offloaded to the flow table, in software or hardware.
+	StatusOffload
+	StatusHWOffload
+
+	// Source or destination address is translated.
+	StatusNAT = StatusSrcNAT | StatusDstNAT
+)
+
+var statusNames = []string{
+	"EXPECTED", "SEEN_REPLY", "ASSURED", "CONFIRMED", "SRC_NAT", "DST_NAT",
+	"SEQ_ADJUST", "SRC_NAT_DONE", "DST_NAT_DONE", "DYING", "FIXED_TIMEOUT",
+	"TEMPLATE", "NAT_CLASH", "HELPER", "OFFLOAD", "HW_OFFLOAD",
+}
+
+// Has returns true if all of the given bits are set.
+func (s Status) Has(bits Status) bool {
+	return s&bits == bits
+}
+
+// String returns the names of the set bits separated by '|', eg.
+// 'SEEN_REPLY|ASSURED|CONFIRMED'. Unnamed bits are omitted.
+func (s Status) String() string {
+
+	var names []string
+	for i, n := range statusNames {
+		if s.Has(1 << uint(i)) {
+			names = append(names, n)
+		}
+	}
+
+	return strings.Join(names, "|")
+}
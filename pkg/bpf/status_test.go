@@ -0,0 +1,20 @@
+package bpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+
+	s := StatusSeenReply | StatusAssured | StatusConfirmed | StatusDstNAT
+	assert.True(t, s.Has(StatusSeenReply|StatusAssured))
+	assert.False(t, s.Has(StatusNAT))
+	assert.True(t, (s | StatusSrcNAT).Has(StatusNAT))
+
+	assert.Equal(t, "SEEN_REPLY|ASSURED|CONFIRMED|DST_NAT", s.String())
+	assert.Equal(t, "DYING|HW_OFFLOAD", (StatusDying | StatusHWOffload | 1<<20).String(),
+		"unnamed bits are omitted")
+	assert.Empty(t, Status(0).String())
+}
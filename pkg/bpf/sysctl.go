@@ -1,6 +1,22 @@
 package bpf
 
-import "github.com/ti-mo/conntracct/internal/sysctl"
+import (
+	"fmt"
+	"strings"
+
+	gosysctl "github.com/lorenzosaino/go-sysctl"
+
+	"github.com/ti-mo/conntracct/internal/sysctl"
+)
+
+// Sysctls the probe needs enabled to account for flows.
+var requiredSysctls = []string{
+	"net.netfilter.nf_conntrack_acct",
+	"net.netfilter.nf_conntrack_timestamp",
+}
+
+// getSysctl reads the value of a sysctl. Replaceable in tests.
+var getSysctl = gosysctl.Get
 
 // Sysctls applies a list of sysctls on the machine.
 // When verbose is true, logs any changes made to stdout.
@@ -20,3 +36,27 @@ func Sysctls(verbose bool) error {
 
 	return sysctl.Apply(sysctls, verbose)
 }
+
+// checkSysctls returns the sysctls required by the probe that are disabled
+// on the machine. Sysctls that can't be read, eg. because the conntrack
+// module is not loaded yet, are not reported. Returns an error listing the
+// disabled sysctls, unless allow is true.
+func checkSysctls(allow bool) ([]string, error) {
+
+	var disabled []string
+	for _, name := range requiredSysctls {
+		v, err := getSysctl(name)
+		if err != nil {
+			continue
+		}
+		if strings.TrimSpace(v) == "0" {
+			disabled = append(disabled, name)
+		}
+	}
+
+	if len(disabled) != 0 && !allow {
+		return disabled, fmt.Errorf(errFmtSysctlsDisabled, strings.Join(disabled, ", "))
+	}
+
+	return disabled, nil
+}
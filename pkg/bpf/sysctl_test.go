@@ -0,0 +1,68 @@
+package bpf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// withSysctls replaces the sysctls read by the probe.
+// Sysctls missing from the map can't be read.
+func withSysctls(ctls map[string]string) {
+	getSysctl = func(name string) (string, error) {
+		v, ok := ctls[name]
+		if !ok {
+			return "", errors.New("no such sysctl")
+		}
+		return v, nil
+	}
+}
+
+func TestCheckSysctls(t *testing.T) {
+
+	orig := getSysctl
+	defer func() { getSysctl = orig }()
+
+	withSysctls(map[string]string{
+		"net.netfilter.nf_conntrack_acct":      "1\n",
+		"net.netfilter.nf_conntrack_timestamp": "1\n",
+	})
+	disabled, err := checkSysctls(false)
+	require.NoError(t, err)
+	assert.Empty(t, disabled)
+
+	// Accounting disabled, the error names the sysctl and how to proceed.
+	withSysctls(map[string]string{
+		"net.netfilter.nf_conntrack_acct":      "0\n",
+		"net.netfilter.nf_conntrack_timestamp": "1\n",
+	})
+	disabled, err = checkSysctls(false)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "net.netfilter.nf_conntrack_acct")
+	assert.Contains(t, err.Error(), "AllowUnaccounted")
+	assert.Equal(t, []string{"net.netfilter.nf_conntrack_acct"}, disabled)
+
+	// Degraded mode reports the disabled sysctls without failing.
+	disabled, err = checkSysctls(true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"net.netfilter.nf_conntrack_acct"}, disabled)
+
+	// Sysctls that can't be read, eg. without the conntrack module, are ignored.
+	withSysctls(nil)
+	disabled, err = checkSysctls(false)
+	require.NoError(t, err)
+	assert.Empty(t, disabled)
+}
+
+func TestEventUnaccounted(t *testing.T) {
+
+	b := make([]byte, EventLength)
+	b[97] = eventFlagUnaccounted
+
+	var e Event
+	require.NoError(t, e.UnmarshalBinary(b))
+	assert.True(t, e.Unaccounted)
+	assert.False(t, e.Assured)
+}
@@ -0,0 +1,31 @@
+package expr
+
+import "fmt"
+
+const (
+	errFmtUnexpected    = "unexpected '%s'"
+	errFmtExpected      = "expected %s, got '%s'"
+	errFmtInvalidNumber = "invalid number '%s'"
+	errFmtUnknownField  = "unknown field '%s'"
+	errFmtOperand       = "operator '%s' expects %s operands, got %s and %s"
+	errFmtOperandUnary  = "operator '%s' expects a %s operand, got %s"
+	errFmtCondition     = "condition must be a bool, got %s"
+	errFmtBranches      = "branches must be of the same type, got %s and %s"
+	errEmptyExpression  = "empty expression"
+	errTrailingOperator = "unexpected end of expression"
+	errUnbalancedParen  = "unbalanced parenthesis"
+	errUnterminatedStr  = "unterminated string"
+)
+
+// SyntaxError is returned by Compile when an expression cannot be parsed,
+// or when the types of its operands don't match their operators.
+type SyntaxError struct {
+	// Offset of the token that caused the error in the expression.
+	Pos int
+	Msg string
+}
+
+// Error implements the error interface.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("expression syntax error at position %d: %s", e.Pos, e.Msg)
+}
@@ -0,0 +1,126 @@
+// Package expr implements a small expression language computing values from
+// the fields of accounting events, eg. to derive labels. Expressions are
+// statically typed and compiled into a tree of functions over bpf.Events,
+// evaluating an expression can't fail and doesn't allocate unless it builds
+// a string.
+//
+// Values are numbers (float64), strings and bools. Supported terms:
+//
+//	bytes_orig, src_port, ...    fields of the event, see Fields
+//	1000000, 1.5, 0xff           number literals
+//	"elephant"                   string literals, with Go escapes
+//	true, false                  bool literals
+//
+// Supported operators, from lowest to highest precedence:
+//
+//	c ? a : b                    a if c is true, b otherwise
+//	||, or                       bools
+//	&&, and                      bools
+//	== != < <= > >=              numbers, strings (lexically) or bools (== !=)
+//	+ -                          numbers, + also concatenates strings
+//	* / %                        numbers, dividing by zero yields zero
+//	-x, !x, not x                numbers, bools
+//
+// Terms can be grouped using parentheses. For example:
+//
+//	bytes_orig + bytes_ret > 1000000 ? "elephant" : "mouse"
+package expr
+
+import (
+	"strconv"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Kind is the type of the value of an expression.
+type Kind uint8
+
+// Kinds of values.
+const (
+	Number Kind = iota + 1
+	String
+	Bool
+)
+
+// String returns the name of the Kind.
+func (k Kind) String() string {
+	switch k {
+	case Number:
+		return "number"
+	case String:
+		return "string"
+	case Bool:
+		return "bool"
+	}
+	return "Kind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Expr is a compiled expression.
+// It is safe for concurrent use.
+type Expr struct {
+	src  string
+	root value
+}
+
+// Compile parses the given expression into an Expr. Returns a *SyntaxError
+// if the expression is invalid or its operands have the wrong types.
+func Compile(src string) (*Expr, error) {
+
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parse(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Expr{src: src, root: root}, nil
+}
+
+// Kind returns the type of the expression's value.
+func (x *Expr) Kind() Kind {
+	return x.root.kind
+}
+
+// Eval evaluates the expression for the Event, formatting its value as a
+// string. Integral numbers are formatted without a fraction, bools as 'true'
+// or 'false'.
+func (x *Expr) Eval(e *bpf.Event) string {
+	switch x.root.kind {
+	case Number:
+		return strconv.FormatFloat(x.root.num(e), 'f', -1, 64)
+	case Bool:
+		return strconv.FormatBool(x.root.bool(e))
+	}
+	return x.root.str(e)
+}
+
+// String returns the expression the Expr was compiled from.
+func (x *Expr) String() string {
+	return x.src
+}
+
+// value is a node in a compiled expression tree, evaluating
+// to the value of its kind using the matching function.
+type value struct {
+	kind Kind
+	pos  int
+
+	num  func(e *bpf.Event) float64
+	str  func(e *bpf.Event) string
+	bool func(e *bpf.Event) bool
+}
+
+func numValue(pos int, f func(e *bpf.Event) float64) value {
+	return value{kind: Number, pos: pos, num: f}
+}
+
+func strValue(pos int, f func(e *bpf.Event) string) value {
+	return value{kind: String, pos: pos, str: f}
+}
+
+func boolValue(pos int, f func(e *bpf.Event) bool) value {
+	return value{kind: Bool, pos: pos, bool: f}
+}
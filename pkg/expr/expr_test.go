@@ -0,0 +1,143 @@
+package expr_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+	"github.com/ti-mo/conntracct/pkg/expr"
+)
+
+// TCP flow from 10.0.0.1:43210 to 192.168.1.1:443.
+var evTCP = bpf.Event{
+	Type:        bpf.EventUpdate,
+	SrcAddr:     net.IPv4(10, 0, 0, 1),
+	DstAddr:     net.IPv4(192, 168, 1, 1),
+	SrcPort:     43210,
+	DstPort:     443,
+	Proto:       6,
+	BytesOrig:   1500000,
+	BytesRet:    500,
+	PacketsOrig: 1000,
+	PacketsRet:  10,
+	Service:     "https",
+	Assured:     true,
+}
+
+func TestExprEval(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		kind expr.Kind
+		want string
+	}{
+		// Arithmetic.
+		{"1 + 2 * 3", expr.Number, "7"},
+		{"(1 + 2) * 3", expr.Number, "9"},
+		{"10 - 4 - 3", expr.Number, "3"},
+		{"7 / 2", expr.Number, "3.5"},
+		{"7 % 4", expr.Number, "3"},
+		{"7 / 0", expr.Number, "0"},
+		{"-dst_port + 0x10", expr.Number, "-427"},
+		{"bytes", expr.Number, "1500500"},
+		{"bytes_orig / packets_orig", expr.Number, "1500"},
+		{".5 * 4", expr.Number, "2"},
+
+		// Comparisons.
+		{"bytes_orig > 1000000", expr.Bool, "true"},
+		{"bytes_ret >= 500 && packets_ret < 10", expr.Bool, "false"},
+		{"proto == 6 and not (dst_port != 443)", expr.Bool, "true"},
+		{"service == \"https\" || false", expr.Bool, "true"},
+		{"src_addr < dst_addr", expr.Bool, "true"},
+		{"assured == !false", expr.Bool, "true"},
+		{"type == \"update\"", expr.Bool, "true"},
+
+		// Strings.
+		{`bytes_orig > 1000000 ? "elephant" : "mouse"`, expr.String, "elephant"},
+		{`packets > 1e6 ? "elephant" : "mouse"`, expr.String, "mouse"},
+		{`service + "/" + "tcp"`, expr.String, "https/tcp"},
+		{`"a\tb"`, expr.String, "a\tb"},
+		{`dst_port < 1024 ? dst_addr : src_addr`, expr.String, "192.168.1.1"},
+		{`proto == 17 ? "udp" : proto == 6 ? "tcp" : "other"`, expr.String, "tcp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			x, err := expr.Compile(tt.expr)
+			require.NoError(t, err)
+			assert.Equal(t, tt.kind, x.Kind())
+			assert.Equal(t, tt.want, x.Eval(&evTCP))
+			assert.Equal(t, tt.expr, x.String())
+		})
+	}
+}
+
+func TestExprSyntaxError(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{"", 0, "empty expression"},
+		{"   ", 0, "empty expression"},
+		{"1 +", 3, "unexpected end of expression"},
+		{"(1 + 2", 0, "unbalanced parenthesis"},
+		{"1 + 2)", 5, "unbalanced parenthesis"},
+		{"1 2", 2, "unexpected '2'"},
+		{"bytes = 1", 6, "unexpected '='"},
+		{"bytes_total > 1", 0, "unknown field 'bytes_total'"},
+		{"0x", 0, "invalid number '0x'"},
+		{"1.2.3", 0, "invalid number '1.2.3'"},
+		{`"mouse`, 0, "unterminated string"},
+		{`"\q"`, 0, `unexpected '"\q"'`},
+		{`bytes + "b"`, 6, "operator '+' expects number operands, got number and string"},
+		{`"a" * 2`, 4, "operator '*' expects number operands, got string and number"},
+		{"bytes && true", 6, "operator '&&' expects bool operands, got number and bool"},
+		{"assured or 1", 8, "operator 'or' expects bool operands, got bool and number"},
+		{`service == 443`, 8, "operator '==' expects matching operands, got string and number"},
+		{"assured < true", 8, "operator '<' expects number or string operands, got bool and bool"},
+		{"!bytes", 0, "operator '!' expects a bool operand, got number"},
+		{`-service`, 0, "operator '-' expects a number operand, got string"},
+		{`bytes ? "a" : "b"`, 0, "condition must be a bool, got number"},
+		{`assured ? "a" : 1`, 10, "branches must be of the same type, got string and number"},
+		{`assured ? "a"`, 13, "expected ':', got 'end of expression'"},
+		{"1 < 2 < 3", 6, "unexpected '<'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := expr.Compile(tt.expr)
+			require.Error(t, err)
+
+			se, ok := err.(*expr.SyntaxError)
+			require.True(t, ok, "error is not a *SyntaxError: %T", err)
+			assert.Equal(t, tt.pos, se.Pos)
+			assert.Equal(t, tt.msg, se.Msg)
+		})
+	}
+}
+
+func TestExprFields(t *testing.T) {
+
+	// Every field can be referred to.
+	for _, f := range expr.Fields() {
+		_, err := expr.Compile(f)
+		assert.NoError(t, err, f)
+	}
+	assert.Contains(t, expr.Fields(), "bytes_orig")
+}
+
+func BenchmarkExprEval(b *testing.B) {
+
+	x, err := expr.Compile(`bytes_orig + bytes_ret > 1000000 && proto == 6 ? "elephant" : "mouse"`)
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		x.Eval(&evTCP)
+	}
+}
@@ -0,0 +1,64 @@
+package expr
+
+import (
+	"sort"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// fields maps the names of event fields to their accessors. Names match the
+// keys of the event's JSON representation, 'bytes' and 'packets' are the
+// flow's traffic in both directions.
+var fields = map[string]value{
+	"connection_id": numField(func(e *bpf.Event) float64 { return float64(e.ConnectionID) }),
+	"connmark":      numField(func(e *bpf.Event) float64 { return float64(e.Connmark) }),
+	"src_port":      numField(func(e *bpf.Event) float64 { return float64(e.SrcPort) }),
+	"dst_port":      numField(func(e *bpf.Event) float64 { return float64(e.DstPort) }),
+	"proto":         numField(func(e *bpf.Event) float64 { return float64(e.Proto) }),
+	"netns":         numField(func(e *bpf.Event) float64 { return float64(e.NetNS) }),
+	"cpu":           numField(func(e *bpf.Event) float64 { return float64(e.CPU) }),
+	"icmp_type":     numField(func(e *bpf.Event) float64 { return float64(e.ICMPType) }),
+	"icmp_code":     numField(func(e *bpf.Event) float64 { return float64(e.ICMPCode) }),
+
+	"bytes_orig":   numField(func(e *bpf.Event) float64 { return float64(e.BytesOrig) }),
+	"bytes_ret":    numField(func(e *bpf.Event) float64 { return float64(e.BytesRet) }),
+	"packets_orig": numField(func(e *bpf.Event) float64 { return float64(e.PacketsOrig) }),
+	"packets_ret":  numField(func(e *bpf.Event) float64 { return float64(e.PacketsRet) }),
+	"bytes":        numField(func(e *bpf.Event) float64 { return float64(e.BytesOrig + e.BytesRet) }),
+	"packets":      numField(func(e *bpf.Event) float64 { return float64(e.PacketsOrig + e.PacketsRet) }),
+
+	"bytes_orig_adjusted": numField(func(e *bpf.Event) float64 { return float64(e.BytesOrigAdjusted) }),
+	"bytes_ret_adjusted":  numField(func(e *bpf.Event) float64 { return float64(e.BytesRetAdjusted) }),
+	"bytes_in":            numField(func(e *bpf.Event) float64 { return float64(e.BytesIn) }),
+	"bytes_out":           numField(func(e *bpf.Event) float64 { return float64(e.BytesOut) }),
+
+	"src_addr": strField(func(e *bpf.Event) string { return e.SrcAddr.String() }),
+	"dst_addr": strField(func(e *bpf.Event) string { return e.DstAddr.String() }),
+	"src_mac":  strField(func(e *bpf.Event) string { return e.SrcMAC.String() }),
+	"dst_mac":  strField(func(e *bpf.Event) string { return e.DstMAC.String() }),
+	"type":     strField(func(e *bpf.Event) string { return e.Type.String() }),
+	"service":  strField(func(e *bpf.Event) string { return e.Service }),
+	"helper":   strField(func(e *bpf.Event) string { return e.Helper }),
+
+	"seen_reply": boolField(func(e *bpf.Event) bool { return e.SeenReply }),
+	"assured":    boolField(func(e *bpf.Event) bool { return e.Assured }),
+	"expected":   boolField(func(e *bpf.Event) bool { return e.Expected }),
+	"forwarded":  boolField(func(e *bpf.Event) bool { return e.Forwarded }),
+}
+
+func numField(f func(e *bpf.Event) float64) value { return numValue(0, f) }
+func strField(f func(e *bpf.Event) string) value  { return strValue(0, f) }
+func boolField(f func(e *bpf.Event) bool) value   { return boolValue(0, f) }
+
+// Fields returns the sorted names of the event fields
+// that can be referred to in expressions.
+func Fields() []string {
+
+	names := make([]string, 0, len(fields))
+	for n := range fields {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,580 @@
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+
+	// Normalized operator of an op token, eg. '&&' for 'and'.
+	op string
+}
+
+// operators are the symbolic operators, longest first.
+var operators = []string{
+	"||", "&&", "==", "!=", "<=", ">=",
+	"?", ":", "<", ">", "+", "-", "*", "/", "%", "!",
+}
+
+// wordOperators are the operators spelled as words.
+var wordOperators = map[string]string{
+	"and": "&&",
+	"or":  "||",
+	"not": "!",
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// lex splits an expression into tokens.
+func lex(src string) ([]token, error) {
+
+	var toks []token
+
+lex:
+	for i := 0; i < len(src); {
+		c := src[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case c == '(':
+			toks = append(toks, token{kind: tokLParen, text: "(", pos: i})
+			i++
+			continue
+		case c == ')':
+			toks = append(toks, token{kind: tokRParen, text: ")", pos: i})
+			i++
+			continue
+
+		case c == '"':
+			// Strings run until the next unescaped quote.
+			start := i
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, &SyntaxError{start, errUnterminatedStr}
+			}
+			i++
+
+			s, err := strconv.Unquote(src[start:i])
+			if err != nil {
+				return nil, &SyntaxError{start, fmt.Sprintf(errFmtUnexpected, src[start:i])}
+			}
+			toks = append(toks, token{kind: tokString, text: s, pos: start})
+			continue
+
+		case isDigit(c) || (c == '.' && i+1 < len(src) && isDigit(src[i+1])):
+			start := i
+			for i < len(src) && (isLetter(src[i]) || isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], pos: start})
+			continue
+
+		case isLetter(c):
+			start := i
+			for i < len(src) && (isLetter(src[i]) || isDigit(src[i])) {
+				i++
+			}
+
+			w := src[start:i]
+			t := token{kind: tokIdent, text: w, pos: start}
+			if op, ok := wordOperators[w]; ok {
+				t.kind, t.op = tokOp, op
+			}
+			toks = append(toks, t)
+			continue
+		}
+
+		for _, op := range operators {
+			if strings.HasPrefix(src[i:], op) {
+				toks = append(toks, token{kind: tokOp, text: op, pos: i, op: op})
+				i += len(op)
+				continue lex
+			}
+		}
+
+		return nil, &SyntaxError{i, fmt.Sprintf(errFmtUnexpected, string(c))}
+	}
+
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+// parser is a recursive descent parser over a list of tokens.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parse builds an expression tree from a list of tokens ending in tokEOF.
+func parse(toks []token) (value, error) {
+
+	if len(toks) == 1 {
+		return value{}, &SyntaxError{0, errEmptyExpression}
+	}
+
+	p := parser{toks: toks}
+
+	v, err := p.ternary()
+	if err != nil {
+		return value{}, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		if t.kind == tokRParen {
+			return value{}, &SyntaxError{t.pos, errUnbalancedParen}
+		}
+		return value{}, p.unexpected(t)
+	}
+
+	return v, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// peekOp returns the next token if it is one of the given operators.
+func (p *parser) peekOp(ops ...string) (token, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return t, false
+	}
+	for _, op := range ops {
+		if t.op == op {
+			return t, true
+		}
+	}
+	return t, false
+}
+
+// unexpected returns a SyntaxError for an unexpected token.
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokEOF {
+		return &SyntaxError{t.pos, errTrailingOperator}
+	}
+	return &SyntaxError{t.pos, fmt.Sprintf(errFmtUnexpected, t.text)}
+}
+
+// expected returns a SyntaxError for a token that is not what was expected.
+func (p *parser) expected(what string, t token) error {
+	if t.kind == tokEOF {
+		return &SyntaxError{t.pos, fmt.Sprintf(errFmtExpected, what, "end of expression")}
+	}
+	return &SyntaxError{t.pos, fmt.Sprintf(errFmtExpected, what, t.text)}
+}
+
+// operands returns a SyntaxError if l and r are not both of kind k.
+func operands(op token, k Kind, l, r value) error {
+	if l.kind != k || r.kind != k {
+		return &SyntaxError{op.pos, fmt.Sprintf(errFmtOperand, op.text, k, l.kind, r.kind)}
+	}
+	return nil
+}
+
+// ternary parses a conditional expression, right-associative.
+func (p *parser) ternary() (value, error) {
+
+	c, err := p.or()
+	if err != nil {
+		return value{}, err
+	}
+
+	if _, ok := p.peekOp("?"); !ok {
+		return c, nil
+	}
+	p.next()
+
+	if c.kind != Bool {
+		return value{}, &SyntaxError{c.pos, fmt.Sprintf(errFmtCondition, c.kind)}
+	}
+
+	a, err := p.ternary()
+	if err != nil {
+		return value{}, err
+	}
+	if t, ok := p.peekOp(":"); !ok {
+		return value{}, p.expected("':'", t)
+	}
+	p.next()
+	b, err := p.ternary()
+	if err != nil {
+		return value{}, err
+	}
+
+	if a.kind != b.kind {
+		return value{}, &SyntaxError{a.pos, fmt.Sprintf(errFmtBranches, a.kind, b.kind)}
+	}
+
+	cond := c.bool
+	switch a.kind {
+	case Number:
+		return numValue(c.pos, func(e *bpf.Event) float64 {
+			if cond(e) {
+				return a.num(e)
+			}
+			return b.num(e)
+		}), nil
+	case String:
+		return strValue(c.pos, func(e *bpf.Event) string {
+			if cond(e) {
+				return a.str(e)
+			}
+			return b.str(e)
+		}), nil
+	}
+	return boolValue(c.pos, func(e *bpf.Event) bool {
+		if cond(e) {
+			return a.bool(e)
+		}
+		return b.bool(e)
+	}), nil
+}
+
+// or parses a list of and-expressions separated by '||'.
+func (p *parser) or() (value, error) {
+
+	l, err := p.and()
+	if err != nil {
+		return value{}, err
+	}
+
+	for {
+		op, ok := p.peekOp("||")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+
+		r, err := p.and()
+		if err != nil {
+			return value{}, err
+		}
+		if err := operands(op, Bool, l, r); err != nil {
+			return value{}, err
+		}
+
+		lf, rf := l.bool, r.bool
+		l = boolValue(l.pos, func(e *bpf.Event) bool { return lf(e) || rf(e) })
+	}
+}
+
+// and parses a list of comparisons separated by '&&'.
+func (p *parser) and() (value, error) {
+
+	l, err := p.comparison()
+	if err != nil {
+		return value{}, err
+	}
+
+	for {
+		op, ok := p.peekOp("&&")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+
+		r, err := p.comparison()
+		if err != nil {
+			return value{}, err
+		}
+		if err := operands(op, Bool, l, r); err != nil {
+			return value{}, err
+		}
+
+		lf, rf := l.bool, r.bool
+		l = boolValue(l.pos, func(e *bpf.Event) bool { return lf(e) && rf(e) })
+	}
+}
+
+// comparison parses a comparison of two sums. Comparisons don't chain.
+func (p *parser) comparison() (value, error) {
+
+	l, err := p.sum()
+	if err != nil {
+		return value{}, err
+	}
+
+	op, ok := p.peekOp("==", "!=", "<", "<=", ">", ">=")
+	if !ok {
+		return l, nil
+	}
+	p.next()
+
+	r, err := p.sum()
+	if err != nil {
+		return value{}, err
+	}
+
+	// Bools are not ordered.
+	ordered := op.op != "==" && op.op != "!="
+	if l.kind != r.kind || (ordered && l.kind == Bool) {
+		want := "matching"
+		if ordered && (l.kind == Bool || r.kind == Bool) {
+			want = "number or string"
+		}
+		return value{}, &SyntaxError{op.pos, fmt.Sprintf(errFmtOperand, op.text, want, l.kind, r.kind)}
+	}
+
+	switch l.kind {
+	case Number:
+		lf, rf := l.num, r.num
+		var f func(e *bpf.Event) bool
+		switch op.op {
+		case "==":
+			f = func(e *bpf.Event) bool { return lf(e) == rf(e) }
+		case "!=":
+			f = func(e *bpf.Event) bool { return lf(e) != rf(e) }
+		case "<":
+			f = func(e *bpf.Event) bool { return lf(e) < rf(e) }
+		case "<=":
+			f = func(e *bpf.Event) bool { return lf(e) <= rf(e) }
+		case ">":
+			f = func(e *bpf.Event) bool { return lf(e) > rf(e) }
+		case ">=":
+			f = func(e *bpf.Event) bool { return lf(e) >= rf(e) }
+		}
+		return boolValue(l.pos, f), nil
+
+	case String:
+		lf, rf := l.str, r.str
+		var f func(e *bpf.Event) bool
+		switch op.op {
+		case "==":
+			f = func(e *bpf.Event) bool { return lf(e) == rf(e) }
+		case "!=":
+			f = func(e *bpf.Event) bool { return lf(e) != rf(e) }
+		case "<":
+			f = func(e *bpf.Event) bool { return lf(e) < rf(e) }
+		case "<=":
+			f = func(e *bpf.Event) bool { return lf(e) <= rf(e) }
+		case ">":
+			f = func(e *bpf.Event) bool { return lf(e) > rf(e) }
+		case ">=":
+			f = func(e *bpf.Event) bool { return lf(e) >= rf(e) }
+		}
+		return boolValue(l.pos, f), nil
+	}
+
+	lf, rf := l.bool, r.bool
+	if op.op == "==" {
+		return boolValue(l.pos, func(e *bpf.Event) bool { return lf(e) == rf(e) }), nil
+	}
+	return boolValue(l.pos, func(e *bpf.Event) bool { return lf(e) != rf(e) }), nil
+}
+
+// sum parses a list of products separated by '+' or '-'.
+func (p *parser) sum() (value, error) {
+
+	l, err := p.product()
+	if err != nil {
+		return value{}, err
+	}
+
+	for {
+		op, ok := p.peekOp("+", "-")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+
+		r, err := p.product()
+		if err != nil {
+			return value{}, err
+		}
+
+		// Strings are concatenated.
+		if op.op == "+" && l.kind == String && r.kind == String {
+			lf, rf := l.str, r.str
+			l = strValue(l.pos, func(e *bpf.Event) string { return lf(e) + rf(e) })
+			continue
+		}
+
+		if err := operands(op, Number, l, r); err != nil {
+			return value{}, err
+		}
+
+		lf, rf := l.num, r.num
+		if op.op == "+" {
+			l = numValue(l.pos, func(e *bpf.Event) float64 { return lf(e) + rf(e) })
+		} else {
+			l = numValue(l.pos, func(e *bpf.Event) float64 { return lf(e) - rf(e) })
+		}
+	}
+}
+
+// product parses a list of unary expressions separated by '*', '/' or '%'.
+func (p *parser) product() (value, error) {
+
+	l, err := p.unary()
+	if err != nil {
+		return value{}, err
+	}
+
+	for {
+		op, ok := p.peekOp("*", "/", "%")
+		if !ok {
+			return l, nil
+		}
+		p.next()
+
+		r, err := p.unary()
+		if err != nil {
+			return value{}, err
+		}
+		if err := operands(op, Number, l, r); err != nil {
+			return value{}, err
+		}
+
+		lf, rf := l.num, r.num
+		switch op.op {
+		case "*":
+			l = numValue(l.pos, func(e *bpf.Event) float64 { return lf(e) * rf(e) })
+		case "/":
+			l = numValue(l.pos, func(e *bpf.Event) float64 {
+				d := rf(e)
+				if d == 0 {
+					return 0
+				}
+				return lf(e) / d
+			})
+		case "%":
+			l = numValue(l.pos, func(e *bpf.Event) float64 {
+				d := rf(e)
+				if d == 0 {
+					return 0
+				}
+				return math.Mod(lf(e), d)
+			})
+		}
+	}
+}
+
+// unary parses a negated expression or a primary expression.
+func (p *parser) unary() (value, error) {
+
+	op, ok := p.peekOp("-", "!")
+	if !ok {
+		return p.primary()
+	}
+	p.next()
+
+	v, err := p.unary()
+	if err != nil {
+		return value{}, err
+	}
+
+	if op.op == "-" {
+		if v.kind != Number {
+			return value{}, &SyntaxError{op.pos, fmt.Sprintf(errFmtOperandUnary, op.text, Number, v.kind)}
+		}
+		f := v.num
+		return numValue(op.pos, func(e *bpf.Event) float64 { return -f(e) }), nil
+	}
+
+	if v.kind != Bool {
+		return value{}, &SyntaxError{op.pos, fmt.Sprintf(errFmtOperandUnary, op.text, Bool, v.kind)}
+	}
+	f := v.bool
+	return boolValue(op.pos, func(e *bpf.Event) bool { return !f(e) }), nil
+}
+
+// primary parses a literal, a field or a parenthesized expression.
+func (p *parser) primary() (value, error) {
+
+	t := p.next()
+
+	switch t.kind {
+	case tokLParen:
+		v, err := p.ternary()
+		if err != nil {
+			return value{}, err
+		}
+		if p.next().kind != tokRParen {
+			return value{}, &SyntaxError{t.pos, errUnbalancedParen}
+		}
+		v.pos = t.pos
+		return v, nil
+
+	case tokNumber:
+		n, err := parseNumber(t.text)
+		if err != nil {
+			return value{}, &SyntaxError{t.pos, fmt.Sprintf(errFmtInvalidNumber, t.text)}
+		}
+		return numValue(t.pos, func(*bpf.Event) float64 { return n }), nil
+
+	case tokString:
+		s := t.text
+		return strValue(t.pos, func(*bpf.Event) string { return s }), nil
+
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			b := t.text == "true"
+			return boolValue(t.pos, func(*bpf.Event) bool { return b }), nil
+		}
+
+		v, ok := fields[t.text]
+		if !ok {
+			return value{}, &SyntaxError{t.pos, fmt.Sprintf(errFmtUnknownField, t.text)}
+		}
+		v.pos = t.pos
+		return v, nil
+	}
+
+	return value{}, p.unexpected(t)
+}
+
+// parseNumber parses an integer, with a 0x prefix if hexadecimal, or a
+// decimal floating point number.
+func parseNumber(s string) (float64, error) {
+
+	if n, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return float64(n), nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) {
+		return 0, fmt.Errorf(errFmtInvalidNumber, s)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,30 @@
+package filter
+
+import "fmt"
+
+const (
+	errFmtUnexpected    = "unexpected '%s'"
+	errFmtExpected      = "expected %s, got '%s'"
+	errFmtInvalidAddr   = "invalid address '%s'"
+	errFmtInvalidNet    = "invalid network '%s'"
+	errFmtInvalidPort   = "invalid port '%s'"
+	errFmtInvalidRange  = "invalid port range '%s'"
+	errFmtInvalidNumber = "invalid number '%s'"
+	errFmtUnknownProto  = "unknown protocol '%s'"
+	errFmtQualifier     = "'%s' cannot be qualified with '%s'"
+	errEmptyExpression  = "empty expression"
+	errTrailingOperator = "unexpected end of expression"
+	errUnbalancedParen  = "unbalanced parenthesis"
+)
+
+// SyntaxError is returned by Compile when a filter expression cannot be parsed.
+type SyntaxError struct {
+	// Offset of the token that caused the error in the expression.
+	Pos int
+	Msg string
+}
+
+// Error implements the error interface.
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("filter syntax error at position %d: %s", e.Pos, e.Msg)
+}
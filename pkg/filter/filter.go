@@ -0,0 +1,164 @@
+// Package filter implements a tcpdump-like filter expression language
+// for accounting events. Expressions are compiled into predicates over
+// bpf.Events, matching on the flow's tuple and metadata.
+//
+// Supported primitives:
+//
+//	tcp, udp, icmp, icmp6, sctp, dccp, gre  protocol of the flow
+//	proto <name|number>                     protocol of the flow
+//	ip, ip6                                 address family of the flow
+//	[dir] host <address>                    source and/or destination address
+//	[dir] net <cidr>                        address in network
+//	[proto] [dir] port <port>               source and/or destination port
+//	[proto] [dir] portrange <port>-<port>   port in inclusive range
+//	netns <inode>                           network namespace of the flow
+//	mark <connmark>                         conntrack mark (decimal or 0x hex)
+//
+// The direction qualifier dir is one of 'src', 'dst', 'src or dst' (default)
+// or 'src and dst'. Primitives can be combined using 'and', 'or' and 'not'
+// (or '&&', '||' and '!') and grouped using parentheses. 'not' binds tighter
+// than 'and', which binds tighter than 'or'.
+//
+// Ports are only matched for protocols with ports, see bpf.HasPorts. Port
+// primitives never match flows of other protocols, like ICMP or GRE, not even
+// 'port 0'.
+//
+// For example: tcp and dst port 443 and net 10.0.0.0/8
+package filter
+
+import (
+	"net"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Filter is a compiled filter expression.
+// It is safe for concurrent use.
+type Filter struct {
+	expr string
+	root node
+}
+
+// Compile parses the given filter expression into a Filter. Returns
+// a *SyntaxError if the expression is invalid.
+func Compile(expr string) (*Filter, error) {
+
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := parse(toks)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{expr: expr, root: root}, nil
+}
+
+// Match returns true if the Event matches the Filter's expression.
+func (f *Filter) Match(e bpf.Event) bool {
+	return f.root.match(&e)
+}
+
+// String returns the expression the Filter was compiled from.
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// node is a node in a compiled expression tree.
+type node interface {
+	match(e *bpf.Event) bool
+}
+
+type andNode struct{ l, r node }
+
+func (n andNode) match(e *bpf.Event) bool { return n.l.match(e) && n.r.match(e) }
+
+type orNode struct{ l, r node }
+
+func (n orNode) match(e *bpf.Event) bool { return n.l.match(e) || n.r.match(e) }
+
+type notNode struct{ n node }
+
+func (n notNode) match(e *bpf.Event) bool { return !n.n.match(e) }
+
+// protoNode matches the protocol of the flow.
+type protoNode struct{ proto uint8 }
+
+func (n protoNode) match(e *bpf.Event) bool { return e.Proto == n.proto }
+
+// familyNode matches the address family of the flow.
+type familyNode struct{ v4 bool }
+
+func (n familyNode) match(e *bpf.Event) bool { return (e.SrcAddr.To4() != nil) == n.v4 }
+
+// direction is the part of the flow's tuple a primitive applies to.
+type direction uint8
+
+const (
+	dirSrcOrDst direction = iota
+	dirSrcAndDst
+	dirSrc
+	dirDst
+)
+
+// matchDir combines the results of matching the source and
+// the destination of the flow according to the direction.
+func matchDir(d direction, src, dst bool) bool {
+	switch d {
+	case dirSrc:
+		return src
+	case dirDst:
+		return dst
+	case dirSrcAndDst:
+		return src && dst
+	}
+	return src || dst
+}
+
+// hostNode matches the flow's addresses.
+type hostNode struct {
+	dir direction
+	ip  net.IP
+}
+
+func (n hostNode) match(e *bpf.Event) bool {
+	return matchDir(n.dir, n.ip.Equal(e.SrcAddr), n.ip.Equal(e.DstAddr))
+}
+
+// netNode matches the flow's addresses against a network.
+type netNode struct {
+	dir direction
+	net *net.IPNet
+}
+
+func (n netNode) match(e *bpf.Event) bool {
+	return matchDir(n.dir, n.net.Contains(e.SrcAddr), n.net.Contains(e.DstAddr))
+}
+
+// portNode matches the flow's ports against an inclusive range.
+// Ports are only known for flows of protocols with ports.
+type portNode struct {
+	dir    direction
+	lo, hi uint16
+}
+
+func (n portNode) match(e *bpf.Event) bool {
+	if !bpf.HasPorts(e.Proto) {
+		return false
+	}
+	return matchDir(n.dir,
+		e.SrcPort >= n.lo && e.SrcPort <= n.hi,
+		e.DstPort >= n.lo && e.DstPort <= n.hi)
+}
+
+// netnsNode matches the flow's network namespace.
+type netnsNode struct{ netns uint32 }
+
+func (n netnsNode) match(e *bpf.Event) bool { return e.NetNS == n.netns }
+
+// markNode matches the flow's connmark.
+type markNode struct{ mark uint32 }
+
+func (n markNode) match(e *bpf.Event) bool { return e.Connmark == n.mark }
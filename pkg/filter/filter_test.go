@@ -0,0 +1,154 @@
+package filter_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+	"github.com/ti-mo/conntracct/pkg/filter"
+)
+
+var (
+	// TCP flow from 10.0.0.1:43210 to 192.168.1.1:443.
+	evTCP = bpf.Event{
+		SrcAddr:  net.IPv4(10, 0, 0, 1),
+		DstAddr:  net.IPv4(192, 168, 1, 1),
+		SrcPort:  43210,
+		DstPort:  443,
+		Proto:    6,
+		NetNS:    4026531993,
+		Connmark: 0xff,
+	}
+
+	// UDP flow from 2001:db8::1:5353 to 2001:db8::2:53.
+	evUDP6 = bpf.Event{
+		SrcAddr: net.ParseIP("2001:db8::1"),
+		DstAddr: net.ParseIP("2001:db8::2"),
+		SrcPort: 5353,
+		DstPort: 53,
+		Proto:   17,
+	}
+
+	// ICMP flow from 10.0.0.1 to 10.0.0.2.
+	evICMP = bpf.Event{
+		SrcAddr: net.IPv4(10, 0, 0, 1),
+		DstAddr: net.IPv4(10, 0, 0, 2),
+		Proto:   1,
+	}
+)
+
+func TestFilterMatch(t *testing.T) {
+
+	tests := []struct {
+		expr      string
+		tcp, udp6 bool
+		icmp      bool
+	}{
+		{expr: "tcp", tcp: true},
+		{expr: "udp or icmp", udp6: true, icmp: true},
+		{expr: "proto 17", udp6: true},
+		{expr: "proto icmp", icmp: true},
+		{expr: "ip", tcp: true, icmp: true},
+		{expr: "ip6", udp6: true},
+		{expr: "host 10.0.0.1", tcp: true, icmp: true},
+		{expr: "dst host 10.0.0.1"},
+		{expr: "src host 2001:db8::1", udp6: true},
+		{expr: "net 10.0.0.0/8", tcp: true, icmp: true},
+		{expr: "src and dst net 10.0.0.0/8", icmp: true},
+		{expr: "src or dst net 192.168.0.0/16", tcp: true},
+		{expr: "dst net 2001:db8::/32", udp6: true},
+		{expr: "port 53", udp6: true},
+		{expr: "src port 53"},
+		{expr: "tcp port 53"},
+		{expr: "udp dst port 53", udp6: true},
+		{expr: "portrange 400-500", tcp: true},
+		{expr: "src portrange 5000-6000", udp6: true},
+		{expr: "tcp and dst port 443 and net 10.0.0.0/8", tcp: true},
+		{expr: "not tcp", udp6: true, icmp: true},
+		{expr: "!icmp && !ip6", tcp: true},
+		{expr: "not (tcp or udp)", icmp: true},
+		{expr: "tcp or udp and port 80", tcp: true},
+		{expr: "(tcp or udp) and port 80"},
+		{expr: "mark 0xff", tcp: true},
+		{expr: "mark 255 and netns 4026531993", tcp: true},
+		{expr: "netns 0", udp6: true, icmp: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			f, err := filter.Compile(tt.expr)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.expr, f.String())
+			assert.Equal(t, tt.tcp, f.Match(evTCP), "tcp")
+			assert.Equal(t, tt.udp6, f.Match(evUDP6), "udp6")
+			assert.Equal(t, tt.icmp, f.Match(evICMP), "icmp")
+		})
+	}
+}
+
+func TestFilterPortless(t *testing.T) {
+
+	// Port primitives don't match flows without ports, even if they carry
+	// ports, eg. events that weren't decoded from conntrack.
+	for _, proto := range []uint8{1, 47, 50, 58} {
+		e := bpf.Event{Proto: proto, SrcPort: 443, DstPort: 443}
+		for _, expr := range []string{"port 0", "port 443", "portrange 0-65535"} {
+			f, err := filter.Compile(expr)
+			require.NoError(t, err)
+			assert.False(t, f.Match(e), "proto %d: %s", proto, expr)
+			assert.False(t, f.Match(bpf.Event{Proto: proto}), "proto %d: %s", proto, expr)
+		}
+	}
+
+	// Ports of other protocols with ports can be matched.
+	evSCTP := bpf.Event{Proto: 132, SrcPort: 36412, DstPort: 38412}
+	for _, expr := range []string{"port 38412", "sctp dst port 38412", "dccp or sctp src port 36412"} {
+		f, err := filter.Compile(expr)
+		require.NoError(t, err)
+		assert.True(t, f.Match(evSCTP), expr)
+	}
+}
+
+func TestFilterSyntaxError(t *testing.T) {
+
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{"", 0, "empty expression"},
+		{"tcp and", 7, "unexpected end of expression"},
+		{"tcp udp", 4, "unexpected 'udp'"},
+		{"(tcp or udp", 0, "unbalanced parenthesis"},
+		{"tcp)", 3, "unbalanced parenthesis"},
+		{"tcp & udp", 4, "unexpected '&'"},
+		{"foo", 0, "unexpected 'foo'"},
+		{"host", 4, "expected address, got 'end of expression'"},
+		{"host 10.0.0", 5, "invalid address '10.0.0'"},
+		{"net 10.0.0.1", 4, "invalid network '10.0.0.1'"},
+		{"port 65536", 5, "invalid port '65536'"},
+		{"portrange 20-10", 10, "invalid port range '20-10'"},
+		{"src foo", 4, "expected host, net, port or portrange, got 'foo'"},
+		{"icmp port 1", 5, "'port' cannot be qualified with 'icmp'"},
+		{"gre port 1", 4, "'port' cannot be qualified with 'gre'"},
+		{"tcp host 10.0.0.1", 4, "'host' cannot be qualified with 'tcp'"},
+		{"proto foo", 6, "unknown protocol 'foo'"},
+		{"mark 0xfffffffff", 5, "invalid number '0xfffffffff'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := filter.Compile(tt.expr)
+			require.Error(t, err)
+
+			se, ok := err.(*filter.SyntaxError)
+			require.True(t, ok, "error is a SyntaxError")
+			assert.Equal(t, tt.pos, se.Pos, err.Error())
+			assert.Equal(t, tt.msg, se.Msg)
+		})
+	}
+}
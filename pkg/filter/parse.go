@@ -0,0 +1,421 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ti-mo/conntracct/pkg/bpf"
+)
+
+// Protocols that can be referred to by name.
+var protocols = map[string]uint8{
+	"icmp":  1,
+	"tcp":   6,
+	"udp":   17,
+	"dccp":  33,
+	"gre":   47,
+	"icmp6": 58,
+	"sctp":  132,
+}
+
+type tokenKind uint8
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokLParen
+	tokRParen
+	tokAnd
+	tokOr
+	tokNot
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// lex splits a filter expression into tokens.
+func lex(expr string) ([]token, error) {
+
+	var toks []token
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case c == '!':
+			toks = append(toks, token{tokNot, "!", i})
+			i++
+		case strings.HasPrefix(expr[i:], "&&"):
+			toks = append(toks, token{tokAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(expr[i:], "||"):
+			toks = append(toks, token{tokOr, "||", i})
+			i += 2
+		case c == '&' || c == '|':
+			return nil, &SyntaxError{i, fmt.Sprintf(errFmtUnexpected, string(c))}
+		default:
+			// Words run until whitespace or the next operator character.
+			start := i
+			for i < len(expr) && !strings.ContainsRune(" \t\n()!&|", rune(expr[i])) {
+				i++
+			}
+
+			w := expr[start:i]
+			t := token{tokWord, w, start}
+			switch w {
+			case "and":
+				t.kind = tokAnd
+			case "or":
+				t.kind = tokOr
+			case "not":
+				t.kind = tokNot
+			}
+			toks = append(toks, t)
+		}
+	}
+
+	return append(toks, token{tokEOF, "", len(expr)}), nil
+}
+
+// parser is a recursive descent parser over a list of tokens.
+type parser struct {
+	toks []token
+	pos  int
+}
+
+// parse builds an expression tree from a list of tokens ending in tokEOF.
+func parse(toks []token) (node, error) {
+
+	if len(toks) == 1 {
+		return nil, &SyntaxError{0, errEmptyExpression}
+	}
+
+	p := parser{toks: toks}
+
+	n, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokEOF {
+		if t.kind == tokRParen {
+			return nil, &SyntaxError{t.pos, errUnbalancedParen}
+		}
+		return nil, p.unexpected(t)
+	}
+
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.pos]
+}
+
+func (p *parser) peekN(n int) token {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1]
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// unexpected returns a SyntaxError for an unexpected token.
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokEOF {
+		return &SyntaxError{t.pos, errTrailingOperator}
+	}
+	return &SyntaxError{t.pos, fmt.Sprintf(errFmtUnexpected, t.text)}
+}
+
+// or parses a list of and-expressions separated by 'or'.
+func (p *parser) or() (node, error) {
+
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokOr {
+		p.next()
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		l = orNode{l, r}
+	}
+
+	return l, nil
+}
+
+// and parses a list of unary expressions separated by 'and'.
+func (p *parser) and() (node, error) {
+
+	l, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek().kind == tokAnd {
+		p.next()
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l = andNode{l, r}
+	}
+
+	return l, nil
+}
+
+// unary parses a negated expression, a parenthesized expression or a primitive.
+func (p *parser) unary() (node, error) {
+
+	t := p.peek()
+
+	switch t.kind {
+	case tokNot:
+		p.next()
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{n}, nil
+
+	case tokLParen:
+		p.next()
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokRParen {
+			return nil, &SyntaxError{t.pos, errUnbalancedParen}
+		}
+		return n, nil
+
+	case tokWord:
+		return p.primitive()
+	}
+
+	return nil, p.unexpected(t)
+}
+
+// primitive parses a single primitive with its qualifiers.
+func (p *parser) primitive() (node, error) {
+
+	t := p.next()
+
+	// Protocol names can qualify port primitives, eg. 'tcp dst port 443'.
+	if proto, ok := protocols[t.text]; ok {
+		pn := protoNode{proto}
+
+		switch p.peek().text {
+		case "src", "dst", "port", "portrange":
+			if !bpf.HasPorts(proto) {
+				return nil, &SyntaxError{p.peek().pos, fmt.Sprintf(errFmtQualifier, p.peek().text, t.text)}
+			}
+			n, err := p.primitive()
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := n.(portNode); !ok {
+				return nil, &SyntaxError{t.pos, fmt.Sprintf(errFmtQualifier, "host/net", t.text)}
+			}
+			return andNode{pn, n}, nil
+		case "host", "net":
+			return nil, &SyntaxError{p.peek().pos, fmt.Sprintf(errFmtQualifier, p.peek().text, t.text)}
+		}
+
+		return pn, nil
+	}
+
+	switch t.text {
+	case "ip":
+		return familyNode{v4: true}, nil
+	case "ip6":
+		return familyNode{v4: false}, nil
+
+	case "proto":
+		a := p.next()
+		if a.kind != tokWord {
+			return nil, p.expected("protocol", a)
+		}
+		if proto, ok := protocols[a.text]; ok {
+			return protoNode{proto}, nil
+		}
+		n, err := strconv.ParseUint(a.text, 10, 8)
+		if err != nil {
+			return nil, &SyntaxError{a.pos, fmt.Sprintf(errFmtUnknownProto, a.text)}
+		}
+		return protoNode{uint8(n)}, nil
+
+	case "netns":
+		n, err := p.number(32)
+		if err != nil {
+			return nil, err
+		}
+		return netnsNode{uint32(n)}, nil
+
+	case "mark":
+		n, err := p.number(32)
+		if err != nil {
+			return nil, err
+		}
+		return markNode{uint32(n)}, nil
+
+	case "src", "dst":
+		p.pos--
+		return p.directional(p.direction())
+
+	case "host", "net", "port", "portrange":
+		p.pos--
+		return p.directional(dirSrcOrDst)
+	}
+
+	return nil, p.unexpected(t)
+}
+
+// direction parses a direction qualifier. The current token must be 'src' or 'dst'.
+func (p *parser) direction() direction {
+
+	first := p.next().text
+
+	// 'src or dst' and 'src and dst' are only a qualifier if followed by a
+	// primitive, otherwise the operator belongs to the surrounding expression.
+	op, other := p.peek(), p.peekN(1)
+	if (op.kind == tokOr || op.kind == tokAnd) &&
+		(other.text == "src" || other.text == "dst") && other.text != first {
+		p.next()
+		p.next()
+		if op.kind == tokAnd {
+			return dirSrcAndDst
+		}
+		return dirSrcOrDst
+	}
+
+	if first == "src" {
+		return dirSrc
+	}
+	return dirDst
+}
+
+// directional parses a host, net, port or portrange primitive.
+func (p *parser) directional(d direction) (node, error) {
+
+	t := p.next()
+
+	switch t.text {
+	case "host":
+		a := p.next()
+		if a.kind != tokWord {
+			return nil, p.expected("address", a)
+		}
+		ip := net.ParseIP(a.text)
+		if ip == nil {
+			return nil, &SyntaxError{a.pos, fmt.Sprintf(errFmtInvalidAddr, a.text)}
+		}
+		return hostNode{d, ip}, nil
+
+	case "net":
+		a := p.next()
+		if a.kind != tokWord {
+			return nil, p.expected("network", a)
+		}
+		_, n, err := net.ParseCIDR(a.text)
+		if err != nil {
+			return nil, &SyntaxError{a.pos, fmt.Sprintf(errFmtInvalidNet, a.text)}
+		}
+		return netNode{d, n}, nil
+
+	case "port":
+		a := p.next()
+		if a.kind != tokWord {
+			return nil, p.expected("port", a)
+		}
+		port, err := strconv.ParseUint(a.text, 10, 16)
+		if err != nil {
+			return nil, &SyntaxError{a.pos, fmt.Sprintf(errFmtInvalidPort, a.text)}
+		}
+		return portNode{d, uint16(port), uint16(port)}, nil
+
+	case "portrange":
+		a := p.next()
+		if a.kind != tokWord {
+			return nil, p.expected("port range", a)
+		}
+		lo, hi, err := parseRange(a.text)
+		if err != nil {
+			return nil, &SyntaxError{a.pos, fmt.Sprintf(errFmtInvalidRange, a.text)}
+		}
+		return portNode{d, lo, hi}, nil
+	}
+
+	return nil, p.expected("host, net, port or portrange", t)
+}
+
+// expected returns a SyntaxError for a token that is not what was expected.
+func (p *parser) expected(what string, t token) error {
+	if t.kind == tokEOF {
+		return &SyntaxError{t.pos, fmt.Sprintf(errFmtExpected, what, "end of expression")}
+	}
+	return &SyntaxError{t.pos, fmt.Sprintf(errFmtExpected, what, t.text)}
+}
+
+// number parses the next token as an unsigned integer of the given bit size.
+// Hexadecimal numbers are prefixed with 0x.
+func (p *parser) number(bits int) (uint64, error) {
+
+	t := p.next()
+	if t.kind != tokWord {
+		return 0, p.expected("number", t)
+	}
+
+	n, err := strconv.ParseUint(t.text, 0, bits)
+	if err != nil {
+		return 0, &SyntaxError{t.pos, fmt.Sprintf(errFmtInvalidNumber, t.text)}
+	}
+
+	return n, nil
+}
+
+// parseRange parses an inclusive port range of the form <lo>-<hi>.
+func parseRange(s string) (uint16, uint16, error) {
+
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf(errFmtInvalidRange, s)
+	}
+
+	lo, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf(errFmtInvalidRange, s)
+	}
+
+	return uint16(lo), uint16(hi), nil
+}